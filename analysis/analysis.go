@@ -0,0 +1,136 @@
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package analysis reads the results of etrace exec and analyzes them, so that
+// other tools can embed etrace measurements and assert on them without
+// scraping the output of etrace.
+package analysis
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/anonymouse64/etrace/internal/schema"
+)
+
+// Result is the JSON output of etrace exec, only the fields which are
+// analyzed here are decoded
+type Result struct {
+	Runs []Run
+	// Summary is the statistics of the times of the runs without errors,
+	// results of etrace before it was added don't have it
+	Summary *Summary
+}
+
+// Summary is the statistics of the times of the runs without errors of etrace
+// exec, the times which weren't measured are missing
+type Summary struct {
+	TimeToDisplay *Distribution `json:",omitempty"`
+	TimeToRun     *Distribution `json:",omitempty"`
+}
+
+// Structured returns the summary as encoded since version 2 of the schema.
+func (s *Summary) Structured() interface{} {
+	var v struct {
+		TimeToDisplay interface{} `json:",omitempty"`
+		TimeToRun     interface{} `json:",omitempty"`
+	}
+	if s.TimeToDisplay != nil {
+		v.TimeToDisplay = s.TimeToDisplay.Structured()
+	}
+	if s.TimeToRun != nil {
+		v.TimeToRun = s.TimeToRun.Structured()
+	}
+	return v
+}
+
+// Run is a single run of etrace exec
+type Run struct {
+	TimeToDisplay      time.Duration
+	TimeToRun          time.Duration
+	NamespaceSetupTime time.Duration
+	FontCacheTime      time.Duration
+	Milestones         []Milestone
+	Marks              []Mark
+	Errors             []string
+}
+
+// Milestone is when the program reached a milestone, relative to its start
+type Milestone struct {
+	Name string
+	Time time.Duration
+}
+
+// Mark is a phase mark the program wrote, see --phase-marks
+type Mark struct {
+	Name string
+	// Offset is when the mark was received relative to the start of the
+	// program
+	Offset time.Duration
+}
+
+// Load reads the JSON output of etrace exec.
+func Load(r io.Reader) (*Result, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	// durations are objects since version 2 of the results
+	legacy, err := schema.Downgrade(data)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode etrace result: %v", err)
+	}
+	var res Result
+	if err := json.Unmarshal(legacy, &res); err != nil {
+		return nil, fmt.Errorf("cannot decode etrace result: %v", err)
+	}
+	return &res, nil
+}
+
+// LoadFile reads the JSON output of etrace exec from a file.
+func LoadFile(path string) (*Result, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Load(f)
+}
+
+// TimesToDisplay returns the times to display of the runs which have one.
+func (r *Result) TimesToDisplay() []time.Duration {
+	var times []time.Duration
+	for _, run := range r.Runs {
+		if run.TimeToDisplay != 0 {
+			times = append(times, run.TimeToDisplay)
+		}
+	}
+	return times
+}
+
+// Errors returns all the errors of the runs.
+func (r *Result) Errors() []string {
+	var errs []string
+	for _, run := range r.Runs {
+		errs = append(errs, run.Errors...)
+	}
+	return errs
+}
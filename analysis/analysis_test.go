@@ -0,0 +1,166 @@
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package analysis_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/anonymouse64/etrace/analysis"
+
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type analysisTestSuite struct{}
+
+var _ = check.Suite(&analysisTestSuite{})
+
+const ms = time.Millisecond
+
+// result is the output of etrace exec --json --phase-marks with fields which
+// are not analyzed
+const result = `{
+	"Runs": [
+		{
+			"ExecveTiming": {"TotalTime": 1000000000},
+			"TimeToDisplay": 1000000000,
+			"Milestones": [{"Name": "dbus", "Time": 300000000}],
+			"Marks": [{"Name": "config-loaded", "Time": "2021-07-26T14:38:58Z", "Offset": 100000000}],
+			"Errors": ["something went wrong"]
+		},
+		{
+			"TimeToDisplay": 1200000000,
+			"Milestones": [{"Name": "dbus", "Time": 500000000}],
+			"Marks": [{"Name": "config-loaded", "Time": "2021-07-26T14:38:59Z", "Offset": 200000000}]
+		}
+	]
+}`
+
+func (s *analysisTestSuite) TestLoad(c *check.C) {
+	res, err := analysis.Load(strings.NewReader(result))
+	c.Assert(err, check.IsNil)
+	c.Check(res.TimesToDisplay(), check.DeepEquals, []time.Duration{1000 * ms, 1200 * ms})
+	c.Check(res.Errors(), check.DeepEquals, []string{"something went wrong"})
+
+	_, err = analysis.Load(strings.NewReader("not json"))
+	c.Check(err, check.ErrorMatches, "cannot decode etrace result: .*")
+}
+
+func (s *analysisTestSuite) TestLoadStructuredDurations(c *check.C) {
+	res, err := analysis.Load(strings.NewReader(`{"SchemaVersion": 2, "Runs": [
+		{"TimeToDisplay": {"ns": 1000000000, "text": "1s"}, "Marks": [{"Name": "ready", "Offset": {"ns": 500000000, "text": "500ms"}}]}
+	]}`))
+	c.Assert(err, check.IsNil)
+	c.Check(res.TimesToDisplay(), check.DeepEquals, []time.Duration{1000 * ms})
+	c.Check(res.Runs[0].Marks, check.DeepEquals, []analysis.Mark{{Name: "ready", Offset: 500 * ms}})
+	c.Check(res.Summary, check.IsNil)
+
+	res, err = analysis.Load(strings.NewReader(`{"SchemaVersion": 2, "Runs": [], "Summary": {
+		"TimeToDisplay": {"N": 2, "Mean": {"ns": 1000000000, "text": "1s"}, "P90": {"ns": 1100000000, "text": "1.1s"}}
+	}}`))
+	c.Assert(err, check.IsNil)
+	c.Assert(res.Summary, check.NotNil)
+	c.Assert(res.Summary.TimeToDisplay, check.NotNil)
+	c.Check(res.Summary.TimeToDisplay.N, check.Equals, 2)
+	c.Check(res.Summary.TimeToDisplay.Mean, check.Equals, 1000*ms)
+	c.Check(res.Summary.TimeToDisplay.P90, check.Equals, 1100*ms)
+	c.Check(res.Summary.TimeToRun, check.IsNil)
+}
+
+func (s *analysisTestSuite) TestCompute(c *check.C) {
+	st := analysis.Compute([]time.Duration{50 * ms, 10 * ms, 40 * ms, 20 * ms, 30 * ms})
+	c.Check(st.N, check.Equals, 5)
+	c.Check(st.Mean, check.Equals, 30*ms)
+	c.Check(st.StdDev, check.Equals, time.Duration(14142135))
+	c.Check(st.Median, check.Equals, 30*ms)
+	c.Check(st.Min, check.Equals, 10*ms)
+	c.Check(st.Max, check.Equals, 50*ms)
+	c.Check(int(st.Variation), check.Equals, 47)
+
+	c.Check(analysis.Compute([]time.Duration{10 * ms, 20 * ms}).Median, check.Equals, 15*ms)
+	c.Check(analysis.Compute(nil), check.DeepEquals, analysis.Stats{})
+
+	c.Check(st.Within(30*ms), check.IsNil)
+	c.Check(st.Within(29*ms), check.ErrorMatches, "mean 30ms of 5 samples is over the budget of 29ms")
+}
+
+func (s *analysisTestSuite) TestPercentile(c *check.C) {
+	var samples []time.Duration
+	for i := 100; i > 0; i-- {
+		samples = append(samples, time.Duration(i)*ms)
+	}
+	c.Check(analysis.Percentile(samples, 90), check.Equals, 90*ms)
+	c.Check(analysis.Percentile(samples, 99), check.Equals, 99*ms)
+	c.Check(analysis.Percentile(samples, 100), check.Equals, 100*ms)
+	c.Check(analysis.Percentile(samples, 0), check.Equals, 1*ms)
+	// the samples are not sorted in place
+	c.Check(samples[0], check.Equals, 100*ms)
+
+	// with few samples the high percentiles are the maximum
+	d := analysis.Describe([]time.Duration{30 * ms, 10 * ms, 20 * ms})
+	c.Check(d.Mean, check.Equals, 20*ms)
+	c.Check(d.P90, check.Equals, 30*ms)
+	c.Check(d.P99, check.Equals, 30*ms)
+
+	c.Check(analysis.Percentile(nil, 90), check.Equals, time.Duration(0))
+}
+
+func (s *analysisTestSuite) TestCompare(c *check.C) {
+	base := []time.Duration{100 * ms, 102 * ms, 98 * ms, 101 * ms, 99 * ms}
+
+	cmp := analysis.Compare(base, []time.Duration{120 * ms, 122 * ms, 118 * ms, 121 * ms, 119 * ms})
+	c.Check(cmp.Change, check.Equals, float64(20))
+	c.Check(cmp.Significant, check.Equals, true)
+	c.Check(cmp.Regression(10), check.ErrorMatches, `mean went from 100ms to 120ms \(\+20.00%\), more than the tolerated 10.00%`)
+	c.Check(cmp.Regression(25), check.IsNil)
+
+	// the change is within the noise
+	cmp = analysis.Compare(base, []time.Duration{80 * ms, 130 * ms, 90 * ms, 120 * ms, 90 * ms})
+	c.Check(cmp.Change, check.Equals, float64(2))
+	c.Check(cmp.Significant, check.Equals, false)
+	c.Check(cmp.Regression(0), check.IsNil)
+
+	// faster is never a regression
+	cmp = analysis.Compare(base, []time.Duration{80 * ms, 82 * ms, 78 * ms, 81 * ms, 79 * ms})
+	c.Check(cmp.Significant, check.Equals, true)
+	c.Check(cmp.Regression(0), check.IsNil)
+}
+
+func (s *analysisTestSuite) TestPhases(c *check.C) {
+	res, err := analysis.Load(strings.NewReader(result))
+	c.Assert(err, check.IsNil)
+
+	c.Check(analysis.Phases(res.Runs[0]), check.DeepEquals, []analysis.Phase{
+		{Name: "config-loaded", Start: 0, Duration: 100 * ms},
+		{Name: "dbus", Start: 100 * ms, Duration: 200 * ms},
+		{Name: analysis.PhaseDisplay, Start: 300 * ms, Duration: 700 * ms},
+	})
+
+	breakdown := res.PhaseBreakdown()
+	c.Assert(breakdown, check.HasLen, 3)
+	c.Check(breakdown[0].Name, check.Equals, "config-loaded")
+	c.Check(breakdown[0].Mean, check.Equals, 150*ms)
+	c.Check(breakdown[1].Name, check.Equals, "dbus")
+	c.Check(breakdown[1].Mean, check.Equals, 250*ms)
+	c.Check(breakdown[2].Name, check.Equals, analysis.PhaseDisplay)
+	c.Check(breakdown[2].Mean, check.Equals, 700*ms)
+	c.Check(breakdown[2].N, check.Equals, 2)
+}
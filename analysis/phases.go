@@ -0,0 +1,89 @@
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package analysis
+
+import (
+	"sort"
+	"time"
+)
+
+// PhaseDisplay is the name of the phase from the last milestone or mark until
+// the window was displayed
+const PhaseDisplay = "display"
+
+// Phase is a part of the startup of a program, which ends with the milestone
+// or mark it is named after
+type Phase struct {
+	Name     string
+	Start    time.Duration
+	Duration time.Duration
+}
+
+// Phases breaks the startup of the run down into phases between its
+// milestones and marks, in the order they were reached.
+func Phases(run Run) []Phase {
+	type point struct {
+		name string
+		at   time.Duration
+	}
+	var points []point
+	for _, m := range run.Milestones {
+		points = append(points, point{m.Name, m.Time})
+	}
+	for _, m := range run.Marks {
+		points = append(points, point{m.Name, m.Offset})
+	}
+	sort.SliceStable(points, func(i, j int) bool { return points[i].at < points[j].at })
+	if run.TimeToDisplay != 0 && (len(points) == 0 || points[len(points)-1].at < run.TimeToDisplay) {
+		points = append(points, point{PhaseDisplay, run.TimeToDisplay})
+	}
+
+	phases := make([]Phase, 0, len(points))
+	var start time.Duration
+	for _, p := range points {
+		phases = append(phases, Phase{Name: p.name, Start: start, Duration: p.at - start})
+		start = p.at
+	}
+	return phases
+}
+
+// PhaseStats are the statistics of the duration of a phase over runs
+type PhaseStats struct {
+	Name string
+	Stats
+}
+
+// PhaseBreakdown returns the statistics of the duration of each phase over all
+// the runs, in the order the phases were first reached.
+func (r *Result) PhaseBreakdown() []PhaseStats {
+	var names []string
+	samples := make(map[string][]time.Duration)
+	for _, run := range r.Runs {
+		for _, p := range Phases(run) {
+			if _, ok := samples[p.Name]; !ok {
+				names = append(names, p.Name)
+			}
+			samples[p.Name] = append(samples[p.Name], p.Duration)
+		}
+	}
+	breakdown := make([]PhaseStats, 0, len(names))
+	for _, name := range names {
+		breakdown = append(breakdown, PhaseStats{Name: name, Stats: Compute(samples[name])})
+	}
+	return breakdown
+}
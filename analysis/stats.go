@@ -0,0 +1,213 @@
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package analysis
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/anonymouse64/etrace/internal/schema"
+)
+
+// Stats are the statistics of a set of samples
+type Stats struct {
+	N      int
+	Mean   time.Duration
+	StdDev time.Duration
+	Median time.Duration
+	Min    time.Duration
+	Max    time.Duration
+	// Variation is the coefficient of variation, i.e. the standard deviation
+	// as a percentage of the mean
+	Variation float64
+}
+
+// StructuredStats are statistics as encoded since version 2 of the schema,
+// which the types embedding Stats embed in their structured form instead.
+type StructuredStats struct {
+	N         int
+	Mean      schema.Duration
+	StdDev    schema.Duration
+	Median    schema.Duration
+	Min       schema.Duration
+	Max       schema.Duration
+	Variation float64
+}
+
+// Structured returns the statistics as encoded since version 2 of the schema.
+func (s Stats) Structured() StructuredStats {
+	return StructuredStats{
+		N:         s.N,
+		Mean:      schema.NewDuration(s.Mean),
+		StdDev:    schema.NewDuration(s.StdDev),
+		Median:    schema.NewDuration(s.Median),
+		Min:       schema.NewDuration(s.Min),
+		Max:       schema.NewDuration(s.Max),
+		Variation: s.Variation,
+	}
+}
+
+// Compute returns the statistics of the samples, the standard deviation is
+// the population one.
+func Compute(samples []time.Duration) Stats {
+	s := Stats{N: len(samples)}
+	if s.N == 0 {
+		return s
+	}
+
+	sorted := make([]time.Duration, len(samples))
+	copy(sorted, samples)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	s.Min, s.Max = sorted[0], sorted[s.N-1]
+	if s.N%2 == 1 {
+		s.Median = sorted[s.N/2]
+	} else {
+		s.Median = (sorted[s.N/2-1] + sorted[s.N/2]) / 2
+	}
+
+	count := float64(s.N)
+	var mean float64
+	for _, d := range samples {
+		mean += float64(d)
+	}
+	mean = mean / count
+
+	sumDiffSq := float64(0)
+	for _, d := range samples {
+		diff := float64(d) - mean
+		sumDiffSq += (diff * diff)
+	}
+	s.Mean = time.Duration(mean)
+	s.StdDev = time.Duration(math.Sqrt(sumDiffSq / count))
+	if s.Mean != 0 {
+		s.Variation = 100 * float64(s.StdDev) / float64(s.Mean)
+	}
+	return s
+}
+
+// Distribution is the statistics of samples along with their 90th and 99th
+// percentiles
+type Distribution struct {
+	Stats
+	P90 time.Duration
+	P99 time.Duration
+}
+
+// Structured returns the distribution as encoded since version 2 of the
+// schema.
+func (d *Distribution) Structured() interface{} {
+	return struct {
+		StructuredStats
+		P90 schema.Duration
+		P99 schema.Duration
+	}{d.Stats.Structured(), schema.NewDuration(d.P90), schema.NewDuration(d.P99)}
+}
+
+// Describe returns the distribution of the samples.
+func Describe(samples []time.Duration) Distribution {
+	return Distribution{
+		Stats: Compute(samples),
+		P90:   Percentile(samples, 90),
+		P99:   Percentile(samples, 99),
+	}
+}
+
+// Percentile returns the p-th percentile of the samples with the nearest-rank
+// method, i.e. the smallest sample which at least p percent of the samples are
+// less than or equal to, or 0 without samples.
+func Percentile(samples []time.Duration, p float64) time.Duration {
+	if len(samples) == 0 {
+		return 0
+	}
+	sorted := make([]time.Duration, len(samples))
+	copy(sorted, samples)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	if rank > len(sorted) {
+		rank = len(sorted)
+	}
+	return sorted[rank-1]
+}
+
+// Within returns an error if the mean is over the budget.
+func (s Stats) Within(budget time.Duration) error {
+	if s.Mean > budget {
+		return fmt.Errorf("mean %v of %d samples is over the budget of %v", s.Mean, s.N, budget)
+	}
+	return nil
+}
+
+// Comparison compares the samples of a baseline with new ones
+type Comparison struct {
+	Base Stats
+	New  Stats
+	// Change is the change of the mean as a percentage of the mean of the
+	// baseline
+	Change float64
+	// Significant is whether the change of the mean is larger than the noise,
+	// i.e. the t statistic of Welch's t-test is at least 2, which is roughly a
+	// 95% confidence for the usual number of runs
+	Significant bool
+}
+
+// Structured returns the comparison as encoded since version 2 of the schema.
+func (c Comparison) Structured() interface{} {
+	type plain Comparison
+	return struct {
+		plain
+		Base StructuredStats
+		New  StructuredStats
+	}{plain(c), c.Base.Structured(), c.New.Structured()}
+}
+
+// Compare compares the samples of a baseline with new ones.
+func Compare(base, new []time.Duration) Comparison {
+	c := Comparison{Base: Compute(base), New: Compute(new)}
+	if c.Base.Mean != 0 {
+		c.Change = 100 * float64(c.New.Mean-c.Base.Mean) / float64(c.Base.Mean)
+	}
+	if c.Base.N < 2 || c.New.N < 2 {
+		return c
+	}
+	// the sample variances for the standard error
+	baseVar := sampleVariance(c.Base)
+	newVar := sampleVariance(c.New)
+	stdErr := math.Sqrt(baseVar/float64(c.Base.N) + newVar/float64(c.New.N))
+	diff := math.Abs(float64(c.New.Mean - c.Base.Mean))
+	c.Significant = diff != 0 && (stdErr == 0 || diff/stdErr >= 2)
+	return c
+}
+
+func sampleVariance(s Stats) float64 {
+	v := float64(s.StdDev) * float64(s.StdDev)
+	return v * float64(s.N) / float64(s.N-1)
+}
+
+// Regression returns an error if the new samples are significantly slower than
+// the baseline by more than the tolerated percentage.
+func (c Comparison) Regression(tolerance float64) error {
+	if c.Significant && c.Change > tolerance {
+		return fmt.Errorf("mean went from %v to %v (%+.2f%%), more than the tolerated %.2f%%", c.Base.Mean, c.New.Mean, c.Change, tolerance)
+	}
+	return nil
+}
@@ -18,21 +18,25 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"regexp"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/anonymouse64/etrace/analysis"
 	"github.com/anonymouse64/etrace/internal/commands"
+	"github.com/anonymouse64/etrace/internal/profiling"
+	"github.com/anonymouse64/etrace/internal/schema"
 	"github.com/anonymouse64/etrace/internal/snaps"
+	"github.com/anonymouse64/etrace/internal/squashfs"
 
 	// TODO: eliminate this dependency
 	"github.com/snapcore/snapd/gadget/quantity"
@@ -41,6 +45,11 @@ import (
 type cmdAnalyzeSnap struct {
 	InstallChannel    string `long:"channel" description:"Channel to install the snap from if not already installed"`
 	CompressionMethod string `long:"compression" description:"Compression method to use to compare performance methods with"`
+	Sandboxed         bool   `long:"sandboxed" description:"Don't install or remove any snaps, compare the read throughput of the snap mounted in a private mount namespace instead"`
+	Checks            string `long:"checks" description:"Comma separated checks to run, one of size, compression, content-deps, payload, throughput, cold, hot or baseline (default: all the checks for the mode)"`
+	Baseline          string `long:"baseline" description:"YAML file with the reference measurements to compare with instead of the ones shipped with etrace"`
+	UpdateBaseline    bool   `long:"update-baseline" description:"Add the measurements of the snap to the file of --baseline, which starts from the reference measurements shipped with etrace if it doesn't exist"`
+	HardwareClass     string `long:"hardware-class" description:"Class of hardware the snap is measured on, to only compare with reference measurements on the same class of hardware, like desktop, laptop or low-end"`
 	Args              struct {
 		Snap string `description:"Snap to analyze" required:"yes"`
 	} `positional-args:"yes" required:"yes"`
@@ -51,155 +60,268 @@ func (x *cmdAnalyzeSnap) Execute(args []string) error {
 	snapName := x.Args.Snap
 	x.CompressionMethod = strings.ToLower(x.CompressionMethod)
 
-	// analyze looks at a few aspects of the snap:
-	// 1. The size of the snap as-is from installed
-	// 2. What compression format the snap is using
-	// 3. What content interface dependency snaps does this snap have
-	// 4. Worst case performance launch data
-	// 5. Best case performance launch data
-	// 6. (optional) if different compression method requested, worst case performance launch if it was switched
-	// 7. (optional) if different compression method requested, best case performance launch if it was switched
-	// 8. (optional) if different compression method requested, file size increase if it was switched
+	// analyze runs checks looking at a few aspects of the snap, see
+	// analysisChecks, and then runs them again for the snap repacked with a
+	// different compression method if one was requested
 
-	tmpWorkDir, err := ioutil.TempDir("", fmt.Sprintf("etrace-analyze-%s", snapName))
+	checks, err := selectChecks(x.Checks, x.Sandboxed)
 	if err != nil {
 		return err
 	}
-
-	// first ensure the snap is installed, if it is not then download it
-	if !snaps.IsInstalled(snapName) {
-		// then install it
-		if err := exec.Command("snap", "install", snapName, "--channel="+x.InstallChannel).Run(); err != nil {
-			return fmt.Errorf("unable to install snap %s and analyze: %w", snapName, err)
-		}
+	if x.UpdateBaseline && x.Baseline == "" {
+		return fmt.Errorf("cannot use --update-baseline without --baseline")
 	}
 
-	// now make a copy of what is currently installed as the original version to
-	// analyze and compare with possibly alternative compression formats
-	rev, err := snaps.Revision(snapName)
+	tmpWorkDir, err := ioutil.TempDir("", fmt.Sprintf("etrace-analyze-%s", snapName))
 	if err != nil {
 		return err
 	}
 
 	originalSnapFile := filepath.Join(tmpWorkDir, snapName+".snap")
-	// TODO: need to use cp manually here
-	cpCmd := exec.Command("cp", filepath.Join("/var/lib/snapd/snaps/", snapName+"_"+rev+".snap"), originalSnapFile)
-	commands.AddSudoIfNeeded(cpCmd)
-	if err := cpCmd.Run(); err != nil {
-		return err
-	}
+	installed := snaps.IsInstalled(snapName)
+	if !installed && x.Sandboxed {
+		// only download the snap, to leave the system as it is
+		downloadCmd := exec.Command("snap", "download",
+			"--channel="+x.InstallChannel,
+			"--basename="+snapName,
+			"--target-directory="+tmpWorkDir,
+			snapName,
+		)
+		if out, err := downloadCmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("unable to download snap %s and analyze: %v (%s)", snapName, err, string(out))
+		}
+	} else {
+		// first ensure the snap is installed, if it is not then download it
+		if !installed {
+			// then install it
+			if err := exec.Command("snap", "install", snapName, "--channel="+x.InstallChannel).Run(); err != nil {
+				return fmt.Errorf("unable to install snap %s and analyze: %w", snapName, err)
+			}
+			installed = true
+		}
 
-	// 1. get the original size
-	st, err := os.Stat(originalSnapFile)
-	if err != nil {
-		// very unexpected as we just copied the file
-		return err
-	}
-	origSz := quantity.Size(st.Size())
-	fmt.Printf("original snap size: %s\n", origSz.IECString())
+		// now make a copy of what is currently installed as the original
+		// version to analyze and compare with possibly alternative compression
+		// formats
+		rev, err := snaps.Revision(snapName)
+		if err != nil {
+			return err
+		}
 
-	// 2. get what compression format this snap is using
-	unsquashfsCmd := exec.Command("unsquashfs", "-s", originalSnapFile)
-	if err := commands.AddSudoIfNeeded(unsquashfsCmd); err != nil {
-		return err
+		// TODO: need to use cp manually here
+		cpCmd := exec.Command("cp", filepath.Join("/var/lib/snapd/snaps/", snapName+"_"+rev+".snap"), originalSnapFile)
+		commands.AddSudoIfNeeded(cpCmd)
+		if err := cpCmd.Run(); err != nil {
+			return err
+		}
 	}
 
-	unsquashfsOut, err := unsquashfsCmd.CombinedOutput()
-	if err != nil {
+	a := &snapAnalysis{
+		snapName:   snapName,
+		snapFile:   originalSnapFile,
+		installed:  installed,
+		tmpWorkDir: tmpWorkDir,
+		out:        os.Stdout,
+
+		baselineFile:   x.Baseline,
+		updateBaseline: x.UpdateBaseline,
+		hardwareClass:  x.HardwareClass,
+	}
+	if currentCmd.JSONOutput {
+		// only the recommendations are output as JSON
+		a.out = ioutil.Discard
+	}
+	if err := a.run(checks, x.CompressionMethod); err != nil {
 		return err
 	}
 
-	// look for the compression format line
-	s := bufio.NewScanner(bytes.NewReader(unsquashfsOut))
-	compressionLineRegexp := regexp.MustCompile(`^Compression ([a-zA-Z0-9]+)$`)
-	compressionFormat := ""
-	for s.Scan() {
-		line := s.Text()
-		matches := compressionLineRegexp.FindStringSubmatch(line)
-		if len(matches) == 0 {
-			continue
+	recommendations := recommend(&a.findings)
+	if currentCmd.JSONOutput {
+		res := AnalysisResult{
+			Snap:            snapName,
+			Recommendations: recommendations,
 		}
-		compressionFormat = matches[1]
-		break
+		if res.Recommendations == nil {
+			res.Recommendations = []Recommendation{}
+		}
+		return json.NewEncoder(os.Stdout).Encode(res)
 	}
-
-	if compressionFormat == "" {
-		// TODO: what about test snaps with actually no compression in the squashfs?
-		return fmt.Errorf("error: snap has no compression or unsquashfs output is corrupted")
+	if len(recommendations) != 0 {
+		fmt.Printf("recommendations:\n")
+		for _, r := range recommendations {
+			fmt.Printf("\t%s\n", r)
+		}
 	}
-	compressionFormat = strings.ToLower(compressionFormat)
+	return nil
+}
+
+// AnalysisResult is the JSON output of analyze-snap
+type AnalysisResult struct {
+	Snap            string
+	Recommendations []Recommendation
+}
+
+// snapAnalysis is the state of analyzing a snap shared by the checks
+type snapAnalysis struct {
+	snapName   string
+	snapFile   string
+	installed  bool
+	tmpWorkDir string
+
+	// compression is the compression method of the snap
+	compression string
+	// altFile is the snap repacked with altCompression
+	altFile string
+
+	// the results of the checks for the snap as it is, which the checks
+	// compare the results for the repacked snap with
+	size                   quantity.Size
+	throughput             *squashfs.Throughput
+	meanWorst, stdDevWorst time.Duration
+	meanBest, stdDevBest   time.Duration
+
+	findings
+
+	// baselineFile is the file of reference measurements to compare with,
+	// the ones shipped with etrace are used if it's empty
+	baselineFile   string
+	updateBaseline bool
+	hardwareClass  string
+
+	// out is where the checks output their results for humans
+	out io.Writer
+}
 
-	if x.CompressionMethod == "" {
+// run runs the checks for the snap and then for the snap repacked with the
+// given compression method if it differs from the one of the snap.
+func (a *snapAnalysis) run(checks []*analysisCheck, compressionMethod string) error {
+	// the compression method is always needed to know what to compare with
+	var err error
+	a.compression, err = squashfs.Compression(a.snapFile)
+	if err != nil {
+		return err
+	}
+	if compressionMethod == "" {
 		// if the snap was xz, by default test against lzo
-		if compressionFormat == "xz" {
-			x.CompressionMethod = "lzo"
+		if a.compression == "xz" {
+			compressionMethod = "lzo"
 		} else {
 			// otherwise make the "desired" format the same as what it is so
 			// we effectively skip the check against another format
-			x.CompressionMethod = compressionFormat
+			compressionMethod = a.compression
 		}
 	}
-
-	fmt.Printf("original compression format is %s\n", compressionFormat)
-
-	// 3. get what content interface dependency snaps this snap has by looking
-	// at the slots for all connections, excluding system snap provided slots
-	// and slots this snap provides
-	conns, err := snaps.CurrentConnections(snapName)
-	if err != nil {
-		return err
-	}
-	contentInterfaceDependencySnapsMap := map[string]bool{}
-	for _, conn := range conns {
-		switch conn.SlotSnap {
-		case "system", snapName:
-			continue
-		default:
-			contentInterfaceDependencySnapsMap[conn.SlotSnap] = true
+	if compressionMethod != a.compression {
+		for _, check := range checks {
+			if check.repacked != nil {
+				a.altCompression = compressionMethod
+				break
+			}
 		}
 	}
 
-	contentInterfaceDependencySnaps := make([]string, 0, len(contentInterfaceDependencySnapsMap))
-	for snap := range contentInterfaceDependencySnapsMap {
-		contentInterfaceDependencySnaps = append(contentInterfaceDependencySnaps, snap)
+	// the static checks and repacking the snap run concurrently, since they
+	// don't depend on each other, the output of the checks is kept in order.
+	// The repacking isn't overlapped with the launches though, as its load
+	// would skew them, so this only saves the time of the shorter steps.
+	outputs := make([]bytes.Buffer, len(checks))
+	errs := make([]error, len(checks))
+	var repackErr error
+	var wg sync.WaitGroup
+	if a.altCompression != "" {
+		a.altFile = filepath.Join(a.tmpWorkDir, fmt.Sprintf("%s_%s.snap", a.snapName, a.altCompression))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			repackErr = repackSnap(a.snapFile, a.altFile, filepath.Join(a.tmpWorkDir, "unpacked-snap"), a.altCompression)
+		}()
+	}
+	for i, check := range checks {
+		if !check.static {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, check *analysisCheck) {
+			defer wg.Done()
+			errs[i] = check.original(a, &outputs[i])
+		}(i, check)
+	}
+	wg.Wait()
+	for i, check := range checks {
+		if !check.static {
+			continue
+		}
+		a.out.Write(outputs[i].Bytes())
+		if errs[i] != nil {
+			return fmt.Errorf("cannot run check %s: %v", check.name, errs[i])
+		}
 	}
-
-	fmt.Printf("content snap slot dependencies: %+v\n", contentInterfaceDependencySnaps)
-
-	// 4. Get the worst case performance data using etrace
-	meanWorst, stdDevWorst, err := performanceData("--cold", snapName)
-	if err != nil {
-		return err
+	if repackErr != nil {
+		return fmt.Errorf("cannot repack snap with %s compression: %v", a.altCompression, repackErr)
 	}
 
-	fmt.Printf("worst case performance:\n")
-	fmt.Printf("\taverage time to display: %s\n", meanWorst)
-	fmt.Printf("\tstandard deviation for time to display: %s\n", stdDevWorst)
-
-	// 5. Get the best case performance data using etrace
-	meanBest, stdDevBest, err := performanceData("--hot", snapName)
-	if err != nil {
-		return err
+	// the other checks measure the snap, so they are never run concurrently
+	// with anything, since any other load would skew them
+	for _, check := range checks {
+		if check.static {
+			continue
+		}
+		if err := check.original(a, a.out); err != nil {
+			return fmt.Errorf("cannot run check %s: %v", check.name, err)
+		}
 	}
 
-	fmt.Printf("best case performance:\n")
-	fmt.Printf("\taverage time to display: %s\n", meanBest)
-	fmt.Printf("\tstandard deviation for time to display: %s\n", stdDevBest)
-
-	// if the requested compression method is what was requested, then we can
-	// stop
-	if compressionFormat == x.CompressionMethod {
+	if a.altCompression == "" {
 		// nothing left to check
 		return nil
 	}
 
-	// otherwise it was different, we should check the compression method
-	// requested
+	// the checks launching the snap need the repacked snap installed, which
+	// is only done once for all of them
+	repackedInstalled := false
+	for _, check := range checks {
+		if check.repacked == nil || !check.launches {
+			continue
+		}
+		if !repackedInstalled {
+			// TODO: handle devmode or classic snap options, etc. with the
+			// logic from exec cmd
+			installCmd := exec.Command("snap", "install", "--dangerous", a.altFile)
+			commands.AddSudoIfNeeded(installCmd)
+			if err := installCmd.Run(); err != nil {
+				return err
+			}
+			repackedInstalled = true
+
+			// defer a revert command to the original revision we had installed
+			defer func() {
+				revertCmd := exec.Command("snap", "install", a.snapFile)
+				commands.AddSudoIfNeeded(revertCmd)
+				if err := revertCmd.Run(); err != nil {
+					fmt.Printf("error reverting to previous version of %s\n: %v", a.snapName, err)
+				}
+			}()
+		}
+		if err := check.repacked(a, a.out); err != nil {
+			return fmt.Errorf("cannot run check %s with %s compression: %v", check.name, a.altCompression, err)
+		}
+	}
+	for _, check := range checks {
+		if check.repacked == nil || check.launches {
+			continue
+		}
+		if err := check.repacked(a, a.out); err != nil {
+			return fmt.Errorf("cannot run check %s with %s compression: %v", check.name, a.altCompression, err)
+		}
+	}
 
-	// first unpack the snap and repack it with the desired compression method
-	altCompSnapFile := filepath.Join(tmpWorkDir, fmt.Sprintf("%s_%s.snap", snapName, x.CompressionMethod))
-	unpackDir := filepath.Join(tmpWorkDir, "unpacked-snap")
-	unsquashfsCmd = exec.Command("unsquashfs", "-d", unpackDir, originalSnapFile)
+	return nil
+}
+
+// repackSnap unpacks the snap file to the unpack directory and packs it again
+// with the given compression method as altFile.
+func repackSnap(snapFile, altFile, unpackDir, method string) error {
+	unsquashfsCmd := exec.Command("unsquashfs", "-d", unpackDir, snapFile)
 	commands.AddSudoIfNeeded(unsquashfsCmd)
 	if err := unsquashfsCmd.Run(); err != nil {
 		return err
@@ -207,19 +329,19 @@ func (x *cmdAnalyzeSnap) Execute(args []string) error {
 
 	// now re-pack
 	var packCmd *exec.Cmd
-	switch x.CompressionMethod {
+	switch method {
 	case "xz", "lzo":
 		// supported by snap pack properly
 		packCmd = exec.Command("snap",
 			"pack",
-			"--filename="+altCompSnapFile,
-			"--compression="+x.CompressionMethod,
+			"--filename="+altFile,
+			"--compression="+method,
 			unpackDir,
 		)
 	case "none":
 		packCmd = exec.Command("mksquashfs",
 			unpackDir,
-			altCompSnapFile,
+			altFile,
 			"-noappend",
 			"-noD", // don't compress data blocks
 			// TODO: investigate the other options to see if they have any effect
@@ -238,9 +360,9 @@ func (x *cmdAnalyzeSnap) Execute(args []string) error {
 	case "zstd", "gzip":
 		packCmd = exec.Command("mksquashfs",
 			unpackDir,
-			altCompSnapFile,
+			altFile,
 			"-noappend",
-			"-comp", x.CompressionMethod,
+			"-comp", method,
 			"-no-fragments",
 			"-no-progress",
 			// these options should only be used for app snaps, not for snapd/core snap,
@@ -250,64 +372,48 @@ func (x *cmdAnalyzeSnap) Execute(args []string) error {
 			"-no-xattrs",
 		)
 	default:
-		return fmt.Errorf("unknown compression method %s", x.CompressionMethod)
+		return fmt.Errorf("unknown compression method %s", method)
 	}
 	commands.AddSudoIfNeeded(packCmd)
-	if err := packCmd.Run(); err != nil {
-		return err
-	}
+	return packCmd.Run()
+}
 
-	// now install the new version
-	// TODO: handle devmode or classic snap options, etc. with the logic from
-	// exec cmd
-	installCmd := exec.Command("snap", "install", "--dangerous", altCompSnapFile)
-	commands.AddSudoIfNeeded(installCmd)
-	if err := installCmd.Run(); err != nil {
-		return err
+// readThroughput returns the read throughput of the files of the snap after
+// dropping the caches.
+func readThroughput(snapFile string) (*squashfs.Throughput, error) {
+	if err := profiling.FreeCaches(); err != nil {
+		return nil, err
 	}
+	return squashfs.ReadThroughput(snapFile)
+}
 
-	// defer a revert command to the original revision we had installed
-	defer func() {
-		revertCmd := exec.Command("snap", "install", originalSnapFile)
-		commands.AddSudoIfNeeded(revertCmd)
-		if err := revertCmd.Run(); err != nil {
-			fmt.Printf("error reverting to previous version of %s\n: %v", snapName, err)
-		}
-	}()
-
-	// now we should have the new version installed, get data for this one
-
-	// 6. Get the worst case performance data using etrace
-	meanWorstAlt, stdDevWorseAlt, err := performanceData("--cold", snapName)
-	if err != nil {
-		return err
+// contentSnapDependencies returns the snaps the snap depends on through the
+// content interface by looking at the slots for all connections, excluding
+// system snap provided slots and slots this snap provides. A snap which is not
+// installed has no connections.
+func contentSnapDependencies(snapName string, installed bool) ([]string, error) {
+	if !installed {
+		return []string{}, nil
 	}
-
-	fmt.Printf("worst case performance with %s compression:\n", x.CompressionMethod)
-	fmt.Printf("\taverage time to display: %s\n", meanWorstAlt)
-	fmt.Printf("\tstandard deviation for time to display: %s\n", stdDevWorseAlt)
-	fmt.Printf("\taverage time to display percent change: %s\n", percentDiffDuration(meanWorst, meanWorstAlt))
-
-	// 7. Get the best case performance data using etrace
-	meanBestAlt, stdDevBestAlt, err := performanceData("--hot", snapName)
+	conns, err := snaps.CurrentConnections(snapName)
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	fmt.Printf("best case performance with %s compression:\n", x.CompressionMethod)
-	fmt.Printf("\taverage time to display: %s\n", meanBestAlt)
-	fmt.Printf("\tstandard deviation for time to display: %s\n", stdDevBestAlt)
-	fmt.Printf("\taverage time to display percent change: %s\n", percentDiffDuration(meanBest, meanBestAlt))
-
-	// 8. Calculate the percent change in filesize between the two versions
-	st, err = os.Stat(altCompSnapFile)
-	if err != nil {
-		return err
+	contentInterfaceDependencySnapsMap := map[string]bool{}
+	for _, conn := range conns {
+		switch conn.SlotSnap {
+		case "system", snapName:
+			continue
+		default:
+			contentInterfaceDependencySnapsMap[conn.SlotSnap] = true
+		}
 	}
-	altSz := quantity.Size(st.Size())
-	fmt.Printf("%s snap size: %s (change of %s)\n", x.CompressionMethod, altSz.IECString(), percentDiffSz(origSz, altSz))
 
-	return nil
+	contentInterfaceDependencySnaps := make([]string, 0, len(contentInterfaceDependencySnapsMap))
+	for snap := range contentInterfaceDependencySnapsMap {
+		contentInterfaceDependencySnaps = append(contentInterfaceDependencySnaps, snap)
+	}
+	return contentInterfaceDependencySnaps, nil
 }
 
 func percentDiffDuration(d1, d2 time.Duration) string {
@@ -336,33 +442,28 @@ func percentDiffSz(sz1, sz2 quantity.Size) string {
 
 func meanAndStdDevForRuns(runs ExecOutputResult) (time.Duration, time.Duration, error) {
 	// analyze the TimeToDisplay field for all the runs
-	count := float64(len(runs.Runs))
-	var mean float64
+	samples := make([]time.Duration, 0, len(runs.Runs))
 	for _, run := range runs.Runs {
 		if run.TimeToDisplay == 0 {
 			// this is unexpected
 			return 0, 0, fmt.Errorf("error: run produced time of exactly 0")
 		}
 
-		mean += float64(run.TimeToDisplay)
-	}
-	mean = mean / count
-
-	sumDiffSq := float64(0)
-	for _, run := range runs.Runs {
-		diff := float64(run.TimeToDisplay) - mean
-		sumDiffSq += (diff * diff)
+		samples = append(samples, run.TimeToDisplay)
 	}
-	stdDev := time.Duration(math.Sqrt(sumDiffSq / count))
+	mean, stdDev := meanAndStdDev(samples)
+	return mean, stdDev, nil
+}
 
-	return time.Duration(mean), stdDev, nil
+// meanAndStdDev returns the mean and the population standard deviation of the
+// samples.
+func meanAndStdDev(samples []time.Duration) (time.Duration, time.Duration) {
+	stats := analysis.Compute(samples)
+	return stats.Mean, stats.StdDev
 }
 
 func performanceData(mode, snapName string) (man, stdDev time.Duration, err error) {
 	runs := "10"
-	if mode == "--hot" {
-		runs = "11"
-	}
 
 	// TODO: just call the right functions from this same process, this is a bit
 	// unfortunate to call ourself externally like this
@@ -374,6 +475,7 @@ func performanceData(mode, snapName string) (man, stdDev time.Duration, err erro
 		"--cmd-stderr=/dev/null", // we don't want any stderr output
 		"--cmd-stdout=/dev/null", // we don't want any stdout output
 		"--no-trace",             // we don't want to trace for best performance
+		"--no-compare",           // we compare the results ourselves
 		snapName,
 	}
 
@@ -397,16 +499,15 @@ func performanceData(mode, snapName string) (man, stdDev time.Duration, err erro
 
 	// parse the output as json
 	var execOutputJSON ExecOutputResult
-	if err := json.Unmarshal(out, &execOutputJSON); err != nil {
+	legacy, err := schema.Downgrade(out)
+	if err == nil {
+		err = json.Unmarshal(legacy, &execOutputJSON)
+	}
+	if err != nil {
 		return 0, 0, fmt.Errorf("error getting results from sub-etrace process: %v (full output is %s)", err, string(out))
 	}
 
 	// TODO: actually handle errors in the result here
 
-	if mode == "--hot" {
-		// discard the first run as it may have been a "cold" one
-		execOutputJSON.Runs = execOutputJSON.Runs[1:]
-	}
-
 	return meanAndStdDevForRuns(execOutputJSON)
 }
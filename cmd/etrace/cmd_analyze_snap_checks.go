@@ -0,0 +1,357 @@
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/anonymouse64/etrace/internal/baseline"
+	"github.com/anonymouse64/etrace/internal/squashfs"
+
+	// TODO: eliminate this dependency
+	"github.com/snapcore/snapd/gadget/quantity"
+)
+
+// analysisCheck is a named check analyze-snap runs for a snap
+type analysisCheck struct {
+	name string
+	// static checks only look at the snap without measuring it, so they are
+	// run concurrently with each other
+	static bool
+	// launches is whether the check launches the snap, which needs it to be
+	// installed, or needs the results of such checks, so it can't be run with
+	// --sandboxed
+	launches bool
+	// sandboxedDefault is whether the check is only run by default with
+	// --sandboxed, instead of the checks launching the snap
+	sandboxedDefault bool
+	// original runs the check for the snap as it is
+	original func(a *snapAnalysis, w io.Writer) error
+	// repacked, if set, runs the check again for the snap repacked with the
+	// compression method to compare with, after all the checks were run for
+	// the snap as it is
+	repacked func(a *snapAnalysis, w io.Writer) error
+}
+
+// analysisChecks are all the checks in the order they are run, new checks
+// are added here
+var analysisChecks = []*analysisCheck{
+	{
+		name:     "size",
+		static:   true,
+		original: checkSize,
+		repacked: checkRepackedSize,
+	},
+	{
+		name:     "compression",
+		static:   true,
+		original: checkCompression,
+	},
+	{
+		name:     "content-deps",
+		static:   true,
+		original: checkContentDeps,
+	},
+	{
+		name:     "payload",
+		static:   true,
+		original: checkPayload,
+	},
+	{
+		name:             "throughput",
+		sandboxedDefault: true,
+		original:         checkThroughput,
+		repacked:         checkRepackedThroughput,
+	},
+	{
+		name:     "cold",
+		launches: true,
+		original: checkCold,
+		repacked: checkRepackedCold,
+	},
+	{
+		name:     "hot",
+		launches: true,
+		original: checkHot,
+		repacked: checkRepackedHot,
+	},
+	{
+		name:     "baseline",
+		launches: true,
+		original: checkBaseline,
+	},
+}
+
+// selectChecks returns the checks in the comma separated list in the order
+// they are run, or the default ones if the list is empty.
+func selectChecks(list string, sandboxed bool) ([]*analysisCheck, error) {
+	if list == "" {
+		var checks []*analysisCheck
+		for _, check := range analysisChecks {
+			if check.launches && sandboxed {
+				continue
+			}
+			if check.sandboxedDefault && !sandboxed {
+				continue
+			}
+			checks = append(checks, check)
+		}
+		return checks, nil
+	}
+
+	selected := make(map[string]bool)
+	for _, name := range strings.Split(list, ",") {
+		selected[strings.TrimSpace(name)] = true
+	}
+	var checks []*analysisCheck
+	for _, check := range analysisChecks {
+		if !selected[check.name] {
+			continue
+		}
+		if check.launches && sandboxed {
+			return nil, fmt.Errorf("cannot run check %s with --sandboxed, it launches the snap", check.name)
+		}
+		checks = append(checks, check)
+		delete(selected, check.name)
+	}
+	if len(selected) != 0 {
+		unknown := make([]string, 0, len(selected))
+		for name := range selected {
+			unknown = append(unknown, name)
+		}
+		sort.Strings(unknown)
+		known := make([]string, 0, len(analysisChecks))
+		for _, check := range analysisChecks {
+			known = append(known, check.name)
+		}
+		return nil, fmt.Errorf("unknown checks %s, available checks are %s", strings.Join(unknown, ", "), strings.Join(known, ", "))
+	}
+	return checks, nil
+}
+
+func fileSize(path string) (quantity.Size, error) {
+	st, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return quantity.Size(st.Size()), nil
+}
+
+func checkSize(a *snapAnalysis, w io.Writer) error {
+	size, err := fileSize(a.snapFile)
+	if err != nil {
+		return err
+	}
+	a.size = size
+	fmt.Fprintf(w, "original snap size: %s\n", size.IECString())
+	return nil
+}
+
+func checkRepackedSize(a *snapAnalysis, w io.Writer) error {
+	// calculate the percent change in filesize between the two versions
+	altSz, err := fileSize(a.altFile)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%s snap size: %s (change of %s)\n", a.altCompression, altSz.IECString(), percentDiffSz(a.size, altSz))
+	a.sizeChange = percentChange(float64(a.size), float64(altSz))
+	return nil
+}
+
+func checkCompression(a *snapAnalysis, w io.Writer) error {
+	fmt.Fprintf(w, "original compression format is %s\n", a.compression)
+	return nil
+}
+
+func checkContentDeps(a *snapAnalysis, w io.Writer) error {
+	deps, err := contentSnapDependencies(a.snapName, a.installed)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "content snap slot dependencies: %+v\n", deps)
+	return nil
+}
+
+// gdkPixbufLoaders matches the directories of gdk-pixbuf loaders, whose
+// loaders.cache is next to them
+var gdkPixbufLoaders = regexp.MustCompile(`(^|/)gdk-pixbuf-2\.0/[^/]+/loaders/[^/]+\.so$`)
+
+func checkPayload(a *snapAnalysis, w io.Writer) error {
+	files, err := squashfs.Files(a.snapFile)
+	if err != nil {
+		return err
+	}
+	paths := make(map[string]bool, len(files))
+	loaders := make(map[string]bool)
+	for _, f := range files {
+		paths[f.Path] = true
+		if strings.HasPrefix(f.Path, "usr/share/locale/") {
+			a.localeBytes += f.Size
+		}
+		if gdkPixbufLoaders.MatchString(f.Path) {
+			loaders[path.Dir(f.Path)] = true
+		}
+	}
+	for dir := range loaders {
+		if !paths[path.Join(path.Dir(dir), "loaders.cache")] {
+			a.loadersWithoutCache = append(a.loadersWithoutCache, dir)
+		}
+	}
+	sort.Strings(a.loadersWithoutCache)
+
+	localeSz := quantity.Size(a.localeBytes)
+	fmt.Fprintf(w, "locale data: %s uncompressed\n", localeSz.IECString())
+	fmt.Fprintf(w, "gdk-pixbuf loaders without loaders.cache: %+v\n", a.loadersWithoutCache)
+	return nil
+}
+
+func printThroughput(w io.Writer, t *squashfs.Throughput) {
+	read := quantity.Size(t.Bytes)
+	fmt.Fprintf(w, "\ttime to read %s: %s\n", read.IECString(), t.Time)
+	fmt.Fprintf(w, "\tthroughput: %.2f MiB/s\n", t.MiBPerSecond())
+}
+
+func checkThroughput(a *snapAnalysis, w io.Writer) error {
+	t, err := readThroughput(a.snapFile)
+	if err != nil {
+		return err
+	}
+	a.throughput = t
+	fmt.Fprintf(w, "read throughput:\n")
+	printThroughput(w, t)
+	return nil
+}
+
+func checkRepackedThroughput(a *snapAnalysis, w io.Writer) error {
+	t, err := readThroughput(a.altFile)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "read throughput with %s compression:\n", a.altCompression)
+	printThroughput(w, t)
+	fmt.Fprintf(w, "\ttime to read percent change: %s\n", percentDiffDuration(a.throughput.Time, t.Time))
+	a.readChange = percentChange(float64(a.throughput.Time), float64(t.Time))
+	return nil
+}
+
+func checkCold(a *snapAnalysis, w io.Writer) error {
+	var err error
+	a.meanWorst, a.stdDevWorst, err = performanceData("--cold", a.snapName)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "worst case performance:\n")
+	fmt.Fprintf(w, "\taverage time to display: %s\n", a.meanWorst)
+	fmt.Fprintf(w, "\tstandard deviation for time to display: %s\n", a.stdDevWorst)
+	return nil
+}
+
+func checkRepackedCold(a *snapAnalysis, w io.Writer) error {
+	meanWorstAlt, stdDevWorstAlt, err := performanceData("--cold", a.snapName)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "worst case performance with %s compression:\n", a.altCompression)
+	fmt.Fprintf(w, "\taverage time to display: %s\n", meanWorstAlt)
+	fmt.Fprintf(w, "\tstandard deviation for time to display: %s\n", stdDevWorstAlt)
+	fmt.Fprintf(w, "\taverage time to display percent change: %s\n", percentDiffDuration(a.meanWorst, meanWorstAlt))
+	a.coldChange = percentChange(float64(a.meanWorst), float64(meanWorstAlt))
+	return nil
+}
+
+func checkHot(a *snapAnalysis, w io.Writer) error {
+	var err error
+	a.meanBest, a.stdDevBest, err = performanceData("--hot", a.snapName)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "best case performance:\n")
+	fmt.Fprintf(w, "\taverage time to display: %s\n", a.meanBest)
+	fmt.Fprintf(w, "\tstandard deviation for time to display: %s\n", a.stdDevBest)
+	return nil
+}
+
+func checkRepackedHot(a *snapAnalysis, w io.Writer) error {
+	meanBestAlt, stdDevBestAlt, err := performanceData("--hot", a.snapName)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "best case performance with %s compression:\n", a.altCompression)
+	fmt.Fprintf(w, "\taverage time to display: %s\n", meanBestAlt)
+	fmt.Fprintf(w, "\tstandard deviation for time to display: %s\n", stdDevBestAlt)
+	fmt.Fprintf(w, "\taverage time to display percent change: %s\n", percentDiffDuration(a.meanBest, meanBestAlt))
+	a.hotChange = percentChange(float64(a.meanBest), float64(meanBestAlt))
+	return nil
+}
+
+func checkBaseline(a *snapAnalysis, w io.Writer) error {
+	if a.meanWorst == 0 && a.meanBest == 0 {
+		return fmt.Errorf("the cold or hot check needs to be run too")
+	}
+	files, err := squashfs.Files(a.snapFile)
+	if err != nil {
+		return err
+	}
+	e := baseline.Entry{
+		Snap:        a.snapName,
+		Kind:        baseline.DetectKind(files),
+		Hardware:    a.hardwareClass,
+		Compression: a.compression,
+		Cold:        a.meanWorst,
+		Hot:         a.meanBest,
+	}
+
+	db := baseline.Reference()
+	if a.baselineFile != "" {
+		db, err = baseline.Load(a.baselineFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	fmt.Fprintf(w, "compared with the baseline as a %s snap:\n", e.Kind)
+	for _, mode := range []struct {
+		name string
+		cold bool
+	}{
+		{"cold start", true},
+		{"hot start", false},
+	} {
+		percent, compared := db.Percentile(e, mode.cold)
+		if compared < baseline.MinCompared {
+			fmt.Fprintf(w, "\t%s: %d comparable %s snaps in the baseline, at least %d are needed\n", mode.name, compared, e.Kind, baseline.MinCompared)
+			continue
+		}
+		fmt.Fprintf(w, "\t%s is slower than %.0f%% of %d comparable %s snaps\n", mode.name, percent, compared, e.Kind)
+	}
+
+	if a.updateBaseline {
+		db.Add(e)
+		if err := db.Save(a.baselineFile); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "\tadded to the baseline in %s\n", a.baselineFile)
+	}
+	return nil
+}
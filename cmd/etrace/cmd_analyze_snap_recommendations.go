@@ -0,0 +1,135 @@
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	// TODO: eliminate this dependency
+	"github.com/snapcore/snapd/gadget/quantity"
+)
+
+// localeThreshold is how much locale data a snap needs to ship for removing
+// the unneeded locales to be recommended
+const localeThreshold = 10 * 1024 * 1024
+
+// findings are what the checks of analyze-snap found which the
+// recommendations are derived from
+type findings struct {
+	// altCompression is the compression method the snap was repacked with,
+	// it is empty if no other compression method is compared
+	altCompression string
+	// the percent changes measured for the snap repacked with altCompression,
+	// which are nil if the check measuring them wasn't run
+	coldChange, hotChange, readChange, sizeChange *float64
+
+	// localeBytes is the uncompressed size of the locale data in the snap
+	localeBytes int64
+	// loadersWithoutCache are the directories of gdk-pixbuf loaders in the
+	// snap without a loaders.cache
+	loadersWithoutCache []string
+}
+
+// Recommendation is a change to the packaging of a snap with its estimated
+// impact
+type Recommendation struct {
+	Change string
+	// Impact is the estimated impact for humans
+	Impact string
+	// the estimated percent changes, which are only set if they were measured
+	ColdStartChange *float64 `json:",omitempty"`
+	HotStartChange  *float64 `json:",omitempty"`
+	ReadTimeChange  *float64 `json:",omitempty"`
+	SizeChange      *float64 `json:",omitempty"`
+	// RemovedBytes is the uncompressed size of the files the change removes
+	RemovedBytes int64 `json:",omitempty"`
+}
+
+func (r Recommendation) String() string {
+	return fmt.Sprintf("%s: %s", r.Change, r.Impact)
+}
+
+func percentChange(old, new float64) *float64 {
+	change := 100 * (new - old) / old
+	return &change
+}
+
+// recommend returns the recommendations derived from the findings, the most
+// impactful first.
+func recommend(f *findings) []Recommendation {
+	var recs []Recommendation
+	if r := recommendCompression(f); r != nil {
+		recs = append(recs, *r)
+	}
+	for _, dir := range f.loadersWithoutCache {
+		recs = append(recs, Recommendation{
+			Change: fmt.Sprintf("ship %s", path.Join(path.Dir(dir), "loaders.cache")),
+			Impact: fmt.Sprintf("gdk-pixbuf doesn't need to load all the loaders in %s at startup to find the image formats they support", dir),
+		})
+	}
+	if f.localeBytes > localeThreshold {
+		localeSz := quantity.Size(f.localeBytes)
+		recs = append(recs, Recommendation{
+			Change:       "remove the locale data of unneeded languages",
+			Impact:       fmt.Sprintf("up to %s uncompressed", localeSz.IECString()),
+			RemovedBytes: f.localeBytes,
+		})
+	}
+	return recs
+}
+
+// recommendCompression recommends switching to the compression method the
+// snap was repacked with if it made the snap start faster when launched cold,
+// or read faster if it wasn't launched.
+func recommendCompression(f *findings) *Recommendation {
+	if f.altCompression == "" {
+		return nil
+	}
+	startup := f.coldChange
+	if startup == nil {
+		startup = f.readChange
+	}
+	if startup == nil || *startup >= 0 {
+		return nil
+	}
+
+	var impacts []string
+	for _, change := range []struct {
+		name  string
+		value *float64
+	}{
+		{"cold start", f.coldChange},
+		{"hot start", f.hotChange},
+		{"read time", f.readChange},
+		{"size", f.sizeChange},
+	} {
+		if change.value != nil {
+			impacts = append(impacts, fmt.Sprintf("%+.2f%% %s", *change.value, change.name))
+		}
+	}
+	return &Recommendation{
+		Change:          fmt.Sprintf("switch to %s compression", f.altCompression),
+		Impact:          strings.Join(impacts, ", "),
+		ColdStartChange: f.coldChange,
+		HotStartChange:  f.hotChange,
+		ReadTimeChange:  f.readChange,
+		SizeChange:      f.sizeChange,
+	}
+}
@@ -69,3 +69,83 @@ func (p *analyzeSnapTestSuite) TestMeanAndStdDevForRuns(c *C) {
 	}
 
 }
+
+func (p *analyzeSnapTestSuite) TestSelectChecks(c *C) {
+	tt := []struct {
+		list      string
+		sandboxed bool
+		exp       []string
+		expErr    string
+	}{
+		{
+			exp: []string{"size", "compression", "content-deps", "payload", "cold", "hot", "baseline"},
+		},
+		{
+			sandboxed: true,
+			exp:       []string{"size", "compression", "content-deps", "payload", "throughput"},
+		},
+		{
+			// the checks are run in their order, not the one of the list
+			list: "hot, size",
+			exp:  []string{"size", "hot"},
+		},
+		{
+			list: "throughput",
+			exp:  []string{"throughput"},
+		},
+		{
+			list:      "size,cold",
+			sandboxed: true,
+			expErr:    "cannot run check cold with --sandboxed, it launches the snap",
+		},
+		{
+			list:   "size,warm,lukewarm",
+			expErr: "unknown checks lukewarm, warm, available checks are size, compression, content-deps, payload, throughput, cold, hot, baseline",
+		},
+	}
+
+	for _, t := range tt {
+		names, err := main.SelectChecks(t.list, t.sandboxed)
+		if t.expErr != "" {
+			c.Check(err, ErrorMatches, t.expErr)
+			continue
+		}
+		c.Assert(err, IsNil)
+		c.Check(names, DeepEquals, t.exp)
+	}
+}
+
+func float(f float64) *float64 { return &f }
+
+func (p *analyzeSnapTestSuite) TestRecommend(c *C) {
+	recs := main.Recommend(main.Findings{
+		AltCompression:      "lzo",
+		ColdChange:          float(-38),
+		HotChange:           float(1.5),
+		SizeChange:          float(12),
+		LocaleBytes:         85 * 1024 * 1024,
+		LoadersWithoutCache: []string{"usr/lib/x86_64-linux-gnu/gdk-pixbuf-2.0/2.10.0/loaders"},
+	})
+	c.Assert(recs, HasLen, 3)
+	c.Check(recs[0].String(), Equals, "switch to lzo compression: -38.00% cold start, +1.50% hot start, +12.00% size")
+	c.Check(*recs[0].ColdStartChange, Equals, float64(-38))
+	c.Check(recs[0].ReadTimeChange, IsNil)
+	c.Check(recs[1].Change, Equals, "ship usr/lib/x86_64-linux-gnu/gdk-pixbuf-2.0/2.10.0/loaders.cache")
+	c.Check(recs[2].String(), Matches, "remove the locale data of unneeded languages: up to .* uncompressed")
+	c.Check(recs[2].RemovedBytes, Equals, int64(85*1024*1024))
+
+	// the read time is used when the snap wasn't launched
+	recs = main.Recommend(main.Findings{
+		AltCompression: "lzo",
+		ReadChange:     float(-20),
+		SizeChange:     float(12),
+	})
+	c.Assert(recs, HasLen, 1)
+	c.Check(recs[0].String(), Equals, "switch to lzo compression: -20.00% read time, +12.00% size")
+
+	// slower starts, little locale data and no repacking have nothing to
+	// recommend
+	c.Check(main.Recommend(main.Findings{AltCompression: "lzo", ColdChange: float(5), ReadChange: float(-20)}), HasLen, 0)
+	c.Check(main.Recommend(main.Findings{LocaleBytes: 1024}), HasLen, 0)
+	c.Check(main.Recommend(main.Findings{ColdChange: float(-38)}), HasLen, 0)
+}
@@ -0,0 +1,176 @@
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/anonymouse64/etrace/analysis"
+	"github.com/anonymouse64/etrace/internal/ci"
+)
+
+type cmdCI struct {
+	ArtifactsDir string `long:"artifacts-dir" default:"etrace-artifacts" description:"Directory to write the results of the measurements and the report to"`
+
+	Args struct {
+		Expectations string `description:"YAML file with the expectations of the program" required:"yes"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+// ciDefaultRuns is how many times the program is started to measure its start
+// time if the expectations don't say
+const ciDefaultRuns = 5
+
+// etraceArgs returns the arguments for running the etrace subcommand on the
+// program of the expectations, writing the JSON output to the given file.
+func etraceArgs(e *ci.Expectations, subcmd, output string, extra ...string) []string {
+	args := []string{subcmd,
+		"--json",
+		"--output-file=" + output,
+		"--cmd-stdout=/dev/null",
+		"--cmd-stderr=/dev/null",
+	}
+	if e.UseSnapRun {
+		args = append(args, "--use-snap-run")
+	}
+	if e.WindowName != "" {
+		args = append(args, "--window-name="+e.WindowName)
+	}
+	if e.WindowClass != "" {
+		args = append(args, "--class-name="+e.WindowClass)
+	}
+	if e.WindowClassName != "" {
+		args = append(args, "--window-class-name="+e.WindowClassName)
+	}
+	if e.NoWindowWait {
+		args = append(args, "--no-window-wait")
+	}
+	args = append(args, extra...)
+	args = append(args, "--")
+	return append(args, e.Command...)
+}
+
+// runEtrace runs etrace again with the given arguments.
+func runEtrace(args []string) error {
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(self, args...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+func (x *cmdCI) checkStart(e *ci.Expectations, name, mode string, max time.Duration) ci.Outcome {
+	runs := e.Runs
+	if runs == 0 {
+		runs = ciDefaultRuns
+	}
+	output := filepath.Join(x.ArtifactsDir, mode+".json")
+	args := etraceArgs(e, "exec", output,
+		"--"+mode,
+		"--no-trace",
+		"--no-compare",
+		"--repeat="+strconv.FormatUint(uint64(runs), 10),
+	)
+	if err := runEtrace(args); err != nil {
+		return ci.Outcome{Expectation: name, Message: fmt.Sprintf("cannot measure the start time: %v", err)}
+	}
+	res, err := analysis.LoadFile(output)
+	if err != nil {
+		return ci.Outcome{Expectation: name, Message: err.Error()}
+	}
+	return ci.CheckStart(name, max, res)
+}
+
+func (x *cmdCI) checkFiles(e *ci.Expectations) []ci.Outcome {
+	output := filepath.Join(x.ArtifactsDir, "files.json")
+	fail := func(err error) []ci.Outcome {
+		return []ci.Outcome{{Expectation: "files", Message: err.Error()}}
+	}
+	if err := runEtrace(etraceArgs(e, "file", output)); err != nil {
+		return fail(fmt.Errorf("cannot trace the files: %v", err))
+	}
+	res, err := ci.LoadFileResult(output)
+	if err != nil {
+		return fail(err)
+	}
+	return e.CheckFiles(res)
+}
+
+func (x *cmdCI) Execute(args []string) error {
+	e, err := ci.Read(x.Args.Expectations)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(x.ArtifactsDir, 0755); err != nil {
+		return err
+	}
+
+	var outcomes []ci.Outcome
+	if e.MaxColdStart != 0 {
+		outcomes = append(outcomes, x.checkStart(e, "max-cold-start", "cold", e.MaxColdStart))
+	}
+	if e.MaxHotStart != 0 {
+		outcomes = append(outcomes, x.checkStart(e, "max-hot-start", "hot", e.MaxHotStart))
+	}
+	if e.NeedsFileTrace() {
+		outcomes = append(outcomes, x.checkFiles(e)...)
+	}
+	if len(outcomes) == 0 {
+		return fmt.Errorf("cannot use expectations %s: nothing is expected", x.Args.Expectations)
+	}
+
+	failed := 0
+	var report strings.Builder
+	for _, o := range outcomes {
+		if !o.Passed {
+			failed++
+		}
+		fmt.Fprintln(&report, o)
+	}
+	reportJSON, err := json.MarshalIndent(outcomes, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(x.ArtifactsDir, "report.txt"), []byte(report.String()), 0644); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(x.ArtifactsDir, "report.json"), reportJSON, 0644); err != nil {
+		return err
+	}
+	if currentCmd.JSONOutput {
+		fmt.Println(string(reportJSON))
+	} else {
+		fmt.Print(report.String())
+	}
+
+	if failed != 0 {
+		return fmt.Errorf("%d of %d expectations failed", failed, len(outcomes))
+	}
+	return nil
+}
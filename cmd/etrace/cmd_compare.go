@@ -0,0 +1,270 @@
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/anonymouse64/etrace/analysis"
+	"github.com/anonymouse64/etrace/internal/schema"
+)
+
+type cmdCompare struct {
+	Runs        uint     `short:"n" long:"runs" default:"10" description:"Number of times to run each command"`
+	Hot         bool     `long:"hot" description:"Compare hot runs, discarding the first run of each command which may be a cold one"`
+	Snap        string   `long:"snap" description:"Snap to compare two channels of, the command is run with each of --base-channel and --new-channel installed"`
+	BaseChannel string   `long:"base-channel" description:"Channel of --snap to measure as the baseline"`
+	NewChannel  string   `long:"new-channel" description:"Channel of --snap to compare with the baseline"`
+	ExecArgs    []string `long:"exec-arg" description:"Extra argument of the etrace exec measurements of both commands, can be specified multiple times"`
+
+	Args struct {
+		Cmds []string `description:"The baseline command and the command to compare with it, separated by -- if they have arguments, or the command to run with both channels of --snap, the snap itself by default"`
+	} `positional-args:"yes"`
+}
+
+// CompareSide is the measurement of one of the compared commands
+type CompareSide struct {
+	Command []string
+	Channel string `json:",omitempty"`
+	// TimesToDisplay are the times to display of the runs
+	TimesToDisplay []time.Duration
+	analysis.Stats
+}
+
+// CompareResult is the comparison of the times to display of a command with
+// the ones of a baseline
+type CompareResult struct {
+	// SchemaVersion is the version of the JSON encoding of the result, see
+	// --schema-version
+	SchemaVersion int `json:",omitempty"`
+	Base          CompareSide
+	New           CompareSide
+	// Delta is how much longer the new command took to display on average
+	Delta time.Duration
+	// Change is Delta as a percentage of the mean of the baseline
+	Change float64
+	// Significant is whether the change is larger than the noise of the
+	// runs, according to Welch's t-test
+	Significant bool
+}
+
+// MarshalJSON encodes the result in its version of the schema.
+func (r CompareResult) MarshalJSON() ([]byte, error) {
+	type result CompareResult
+	if r.SchemaVersion < schema.Latest {
+		return json.Marshal(result(r))
+	}
+	return json.Marshal(struct {
+		result
+		Base  interface{}
+		New   interface{}
+		Delta schema.Duration
+	}{result(r), r.Base.structured(), r.New.structured(), schema.NewDuration(r.Delta)})
+}
+
+// structured returns the side as encoded since version 2 of the schema.
+func (s CompareSide) structured() interface{} {
+	type plain CompareSide
+	return struct {
+		plain
+		analysis.StructuredStats
+		TimesToDisplay []schema.Duration
+	}{plain(s), s.Stats.Structured(), schema.Durations(s.TimesToDisplay)}
+}
+
+// splitCommands returns the baseline and new commands of the arguments, which
+// are separated by -- or are single words.
+func splitCommands(args []string) (base, new []string, err error) {
+	for i, arg := range args {
+		if arg == "--" {
+			base, new = args[:i], args[i+1:]
+			if len(base) == 0 || len(new) == 0 {
+				break
+			}
+			return base, new, nil
+		}
+	}
+	if len(args) == 2 && args[0] != "--" && args[1] != "--" {
+		return args[:1], args[1:], nil
+	}
+	return nil, nil, fmt.Errorf("cannot compare without two commands, separate them with --")
+}
+
+// compareArgs returns the arguments of the etrace exec measurement of a
+// command, writing the JSON output to the given file.
+func (x *cmdCompare) compareArgs(command []string, output string) []string {
+	args := []string{"exec",
+		"--json",
+		"--output-file=" + output,
+		"--cmd-stdout=/dev/null",
+		"--cmd-stderr=/dev/null",
+		"--no-compare",
+		"--repeat=" + strconv.FormatUint(uint64(x.Runs), 10),
+	}
+	if x.Hot {
+		args = append(args, "--hot")
+	}
+	if currentCmd.RunThroughSnap {
+		args = append(args, "--use-snap-run")
+	}
+	if currentCmd.WindowName != "" {
+		args = append(args, "--window-name="+currentCmd.WindowName)
+	}
+	if currentCmd.WindowClass != "" {
+		args = append(args, "--class-name="+currentCmd.WindowClass)
+	}
+	if currentCmd.WindowClassName != "" {
+		args = append(args, "--window-class-name="+currentCmd.WindowClassName)
+	}
+	if currentCmd.NoWindowWait {
+		args = append(args, "--no-window-wait")
+	}
+	args = append(args, x.ExecArgs...)
+	args = append(args, "--")
+	return append(args, command...)
+}
+
+// measure installs the channel of the snap if there is one and measures the
+// times to display of the command.
+func (x *cmdCompare) measure(side *CompareSide, output string) error {
+	if side.Channel != "" {
+		cmd := exec.Command("snap", "refresh", "--channel="+side.Channel, x.Snap)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("cannot refresh %s to %s: %v (%s)", x.Snap, side.Channel, err, out)
+		}
+	}
+	if err := runEtrace(x.compareArgs(side.Command, output)); err != nil {
+		return fmt.Errorf("cannot measure %v: %v", side.Command, err)
+	}
+	res, err := analysis.LoadFile(output)
+	if err != nil {
+		return err
+	}
+	for _, err := range res.Errors() {
+		log.Printf("warning: %s", err)
+	}
+	side.TimesToDisplay = res.TimesToDisplay()
+	if len(side.TimesToDisplay) < 2 {
+		return fmt.Errorf("cannot compare %v with less than 2 successful runs", side.Command)
+	}
+	side.Stats = analysis.Compute(side.TimesToDisplay)
+	return nil
+}
+
+func (x *cmdCompare) Execute(args []string) error {
+	if x.Runs < 2 {
+		return fmt.Errorf("cannot compare with less than 2 runs of each command")
+	}
+	if err := checkSignOutput(); err != nil {
+		return err
+	}
+
+	var base, new CompareSide
+	if x.Snap != "" {
+		if x.BaseChannel == "" || x.NewChannel == "" {
+			return fmt.Errorf("cannot compare the channels of --snap without --base-channel and --new-channel")
+		}
+		command := x.Args.Cmds
+		if len(command) == 0 {
+			command = []string{x.Snap}
+		}
+		base = CompareSide{Command: command, Channel: x.BaseChannel}
+		new = CompareSide{Command: command, Channel: x.NewChannel}
+	} else {
+		if x.BaseChannel != "" || x.NewChannel != "" {
+			return fmt.Errorf("cannot use --base-channel or --new-channel without --snap")
+		}
+		baseCmd, newCmd, err := splitCommands(x.Args.Cmds)
+		if err != nil {
+			return err
+		}
+		base = CompareSide{Command: baseCmd}
+		new = CompareSide{Command: newCmd}
+	}
+
+	tmpDir, err := ioutil.TempDir("", "etrace-compare")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+	if err := x.measure(&base, filepath.Join(tmpDir, "base.json")); err != nil {
+		return err
+	}
+	if err := x.measure(&new, filepath.Join(tmpDir, "new.json")); err != nil {
+		return err
+	}
+
+	cmp := analysis.Compare(base.TimesToDisplay, new.TimesToDisplay)
+	res := CompareResult{
+		SchemaVersion: currentCmd.SchemaVersion,
+		Base:          base,
+		New:           new,
+		Delta:         new.Mean - base.Mean,
+		Change:        cmp.Change,
+		Significant:   cmp.Significant,
+	}
+
+	outputs, err := openOutputs(false)
+	if err != nil {
+		return err
+	}
+	defer outputs.Close()
+	if err := outputs.Write(res); err != nil {
+		return err
+	}
+	if outputs.HasText() {
+		displayComparison(outputs.Text, res)
+	}
+	return signOutput()
+}
+
+// displayComparison shows the statistics of both commands and how they
+// compare.
+func displayComparison(w io.Writer, res CompareResult) {
+	label := func(side CompareSide) string {
+		if side.Channel != "" {
+			return side.Channel
+		}
+		return strings.Join(side.Command, " ")
+	}
+	fmt.Fprintln(w, "Time to display:")
+	wtab := tabWriterGeneric(w)
+	fmt.Fprintln(wtab, "\t\tRuns\tMean\tStdDev\tMedian\tMin\tMax\tCommand")
+	for _, side := range []struct {
+		name string
+		CompareSide
+	}{{"base", res.Base}, {"new", res.New}} {
+		fmt.Fprintf(wtab, "\t%s\t%d\t%v\t%v\t%v\t%v\t%v\t%s\n", side.name, side.N, side.Mean, side.StdDev, side.Median, side.Min, side.Max, label(side.CompareSide))
+	}
+	wtab.Flush()
+	verdict := "significant"
+	if !res.Significant {
+		verdict = "within noise"
+	}
+	fmt.Fprintf(w, "Change: %+v (%+.1f%%), %s\n", res.Delta, res.Change, verdict)
+}
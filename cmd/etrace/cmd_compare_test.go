@@ -0,0 +1,83 @@
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main_test
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/anonymouse64/etrace/analysis"
+	main "github.com/anonymouse64/etrace/cmd/etrace"
+
+	. "gopkg.in/check.v1"
+)
+
+type compareTestSuite struct{}
+
+var _ = Suite(&compareTestSuite{})
+
+func (s *compareTestSuite) TestSplitCommands(c *C) {
+	for _, t := range []struct {
+		args      []string
+		base, new []string
+	}{
+		{[]string{"gedit", "gnome-text-editor"}, []string{"gedit"}, []string{"gnome-text-editor"}},
+		{[]string{"firefox", "--new-instance", "--", "firefox-nightly"}, []string{"firefox", "--new-instance"}, []string{"firefox-nightly"}},
+	} {
+		base, new, err := main.SplitCommands(t.args)
+		c.Assert(err, IsNil)
+		c.Check(base, DeepEquals, t.base)
+		c.Check(new, DeepEquals, t.new)
+	}
+
+	for _, args := range [][]string{
+		nil,
+		{"gedit"},
+		{"gedit", "--"},
+		{"--", "gedit"},
+		{"gedit", "foo", "kate"},
+	} {
+		_, _, err := main.SplitCommands(args)
+		c.Check(err, ErrorMatches, "cannot compare without two commands, separate them with --", Commentf("%q", args))
+	}
+}
+
+func (s *compareTestSuite) TestDisplayComparison(c *C) {
+	ms := time.Millisecond
+	res := main.CompareResult{
+		Base:        main.CompareSide{Command: []string{"foo"}, Channel: "stable", Stats: analysis.Compute([]time.Duration{100 * ms, 120 * ms})},
+		New:         main.CompareSide{Command: []string{"foo"}, Channel: "edge", Stats: analysis.Compute([]time.Duration{80 * ms, 90 * ms})},
+		Delta:       -25 * ms,
+		Change:      -22.7,
+		Significant: true,
+	}
+	var buf bytes.Buffer
+	main.DisplayComparison(&buf, res)
+	c.Check(buf.String(), Equals, `Time to display:
+           Runs  Mean   StdDev  Median  Min    Max    Command
+     base  2     110ms  10ms    110ms   100ms  120ms  stable
+     new   2     85ms   5ms     85ms    80ms   90ms   edge
+Change: -25ms (-22.7%), significant
+`)
+
+	res.New.Channel, res.Base.Channel = "", ""
+	res.Significant = false
+	buf.Reset()
+	main.DisplayComparison(&buf, res)
+	c.Check(buf.String(), Matches, `(?s).*  foo\n.*Change: -25ms \(-22.7%\), within noise\n`)
+}
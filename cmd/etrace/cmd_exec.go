@@ -23,30 +23,332 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"log"
 	"math"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"runtime"
+	"sort"
 	"strings"
 	"syscall"
+	"text/tabwriter"
 	"time"
 
+	"github.com/anonymouse64/etrace/analysis"
+	"github.com/anonymouse64/etrace/internal/cgroup"
 	"github.com/anonymouse64/etrace/internal/commands"
 	"golang.org/x/net/context"
 
+	"github.com/anonymouse64/etrace/internal/apparmor"
+	"github.com/anonymouse64/etrace/internal/blockdev"
+	"github.com/anonymouse64/etrace/internal/capture"
+	"github.com/anonymouse64/etrace/internal/crash"
+	"github.com/anonymouse64/etrace/internal/drawn"
+	"github.com/anonymouse64/etrace/internal/drm"
+	"github.com/anonymouse64/etrace/internal/electron"
 	"github.com/anonymouse64/etrace/internal/files"
+	"github.com/anonymouse64/etrace/internal/fontcache"
+	"github.com/anonymouse64/etrace/internal/freshhome"
+	"github.com/anonymouse64/etrace/internal/history"
+	"github.com/anonymouse64/etrace/internal/hwbench"
+	"github.com/anonymouse64/etrace/internal/marks"
+	"github.com/anonymouse64/etrace/internal/mountns"
+	"github.com/anonymouse64/etrace/internal/proccon"
+	"github.com/anonymouse64/etrace/internal/proctree"
 	"github.com/anonymouse64/etrace/internal/profiling"
+	"github.com/anonymouse64/etrace/internal/recipe"
+	"github.com/anonymouse64/etrace/internal/redact"
+	"github.com/anonymouse64/etrace/internal/runner"
+	"github.com/anonymouse64/etrace/internal/schema"
+	"github.com/anonymouse64/etrace/internal/session"
+	"github.com/anonymouse64/etrace/internal/sessionbus"
+	"github.com/anonymouse64/etrace/internal/shadercache"
+	"github.com/anonymouse64/etrace/internal/sinks"
 	"github.com/anonymouse64/etrace/internal/snaps"
+	"github.com/anonymouse64/etrace/internal/statecheck"
 	"github.com/anonymouse64/etrace/internal/strace"
+	"github.com/anonymouse64/etrace/internal/sysstat"
+	"github.com/anonymouse64/etrace/internal/thermal"
+	"github.com/anonymouse64/etrace/internal/timechart"
 	"github.com/anonymouse64/etrace/internal/xdotool"
 )
 
 // ExecOutputResult is the result of running a command with various information
 // encoded in it
 type ExecOutputResult struct {
-	Runs []Execution
+	// SchemaVersion is the version of the JSON encoding of the result, see
+	// --schema-version
+	SchemaVersion int `json:",omitempty"`
+	Runs          []Execution
+	CrossCheck    *CrossCheck `json:",omitempty"`
+	// Hardware is the speed of the machine the runs were done on
+	Hardware *hwbench.Benchmark `json:",omitempty"`
+	// Profile is the measurement profile selected with --profile
+	Profile string `json:",omitempty"`
+	// Previous compares the times to display with the previous measurement
+	// of the same command and profile, unless --no-compare is used
+	Previous *PreviousComparison `json:",omitempty"`
+	// Dispersion is how much the times to display of the runs varied, it is
+	// only included with several runs
+	Dispersion *Dispersion `json:",omitempty"`
+	// Summary is the statistics of the times of the runs without errors, so
+	// that they don't need to be computed from the runs
+	Summary *analysis.Summary `json:",omitempty"`
+	// Device is the device profile the runs were tuned for
+	Device string `json:",omitempty"`
+	// Storage is the class of storage the program is on, like sd-card or
+	// nvme, if it is known
+	Storage string `json:",omitempty"`
+	// Mounts are the mounts of the mount namespace of the program in the
+	// first run which recorded them, they are only recorded with --mount-ns
+	Mounts []string `json:",omitempty"`
+	// Revisions are the revisions of the snap, its base and the snaps
+	// providing content to it before the runs, by snap name, they are only
+	// recorded with --use-snap-run
+	Revisions map[string]string `json:",omitempty"`
+
+	// table is the table of the tabular outputs, see --table
+	table string
+}
+
+// Dispersion is how much the times to display of the runs without errors
+// varied, to tell whether the result can be trusted
+type Dispersion struct {
+	analysis.Stats
+	// LowConfidence is whether the variation is above --max-variation
+	LowConfidence bool
+	// Causes are the likely causes of the variation of a low confidence
+	// result
+	Causes []string `json:",omitempty"`
+}
+
+// structured returns the dispersion as encoded since version 2 of the schema.
+func (d *Dispersion) structured() interface{} {
+	type plain Dispersion
+	return struct {
+		analysis.StructuredStats
+		plain
+	}{d.Stats.Structured(), plain(*d)}
+}
+
+// PreviousComparison compares the times to display of the runs with the ones
+// of the previous measurement of the same command and profile
+type PreviousComparison struct {
+	// Measured is when the previous measurement was done
+	Measured time.Time
+	analysis.Comparison
+	// MountsAdded and MountsRemoved are how the mounts of the mount
+	// namespace of the program changed since the previous measurement, they
+	// are only compared with --mount-ns
+	MountsAdded   []string `json:",omitempty"`
+	MountsRemoved []string `json:",omitempty"`
+	// RevisionChanges are the snaps whose revisions changed since the
+	// previous measurement, which are the likely cause of a regression
+	RevisionChanges []snaps.RevisionChange `json:",omitempty"`
+}
+
+// structured returns the comparison as encoded since version 2 of the schema.
+func (p *PreviousComparison) structured() interface{} {
+	type plain PreviousComparison
+	return struct {
+		plain
+		Base analysis.StructuredStats
+		New  analysis.StructuredStats
+	}{plain(*p), p.Base.Structured(), p.New.Structured()}
+}
+
+// MarshalJSON encodes the result in its version of the schema.
+func (r ExecOutputResult) MarshalJSON() ([]byte, error) {
+	type result ExecOutputResult
+	if r.SchemaVersion < schema.Latest {
+		return json.Marshal(result(r))
+	}
+	v := struct {
+		result
+		Runs       []structuredExecution
+		CrossCheck interface{} `json:",omitempty"`
+		Previous   interface{} `json:",omitempty"`
+		Dispersion interface{} `json:",omitempty"`
+		Summary    interface{} `json:",omitempty"`
+	}{result: result(r)}
+	if r.Runs != nil {
+		v.Runs = make([]structuredExecution, 0, len(r.Runs))
+		for _, run := range r.Runs {
+			v.Runs = append(v.Runs, run.structured())
+		}
+	}
+	if r.CrossCheck != nil {
+		v.CrossCheck = r.CrossCheck.structured()
+	}
+	if r.Previous != nil {
+		v.Previous = r.Previous.structured()
+	}
+	if r.Dispersion != nil {
+		v.Dispersion = r.Dispersion.structured()
+	}
+	if r.Summary != nil {
+		v.Summary = r.Summary.Structured()
+	}
+	return json.Marshal(v)
+}
+
+// tableExecs is the --table of the programs executed
+const tableExecs = "execs"
+
+// Table returns the main times of each run as a table, or the programs
+// executed during each run with --table=execs.
+func (r ExecOutputResult) Table() sinks.Table {
+	if r.table == tableExecs {
+		return r.execsTable()
+	}
+	table := sinks.Table{
+		Name: "runs",
+		Columns: []string{
+			"run",
+			"profile",
+			"time_to_display",
+			"time_to_run",
+			"normalized_time_to_display",
+			"namespace_setup_time",
+			"font_cache_time",
+			"errors",
+		},
+	}
+	for i, run := range r.Runs {
+		table.Rows = append(table.Rows, []interface{}{
+			i + 1,
+			r.Profile,
+			run.TimeToDisplay.Seconds(),
+			run.TimeToRun.Seconds(),
+			run.NormalizedTimeToDisplay.Seconds(),
+			run.NamespaceSetupTime.Seconds(),
+			run.FontCacheTime.Seconds(),
+			strings.Join(run.Errors, "; "),
+		})
+	}
+	return table
+}
+
+// execsTable returns the programs executed during each run as a table, with
+// their times in seconds since the first program of the run was executed.
+func (r ExecOutputResult) execsTable() sinks.Table {
+	table := sinks.Table{
+		Name:    "execs",
+		Columns: []string{"run", "pid", "start", "stop", "elapsed", "exe"},
+	}
+	for i, run := range r.Runs {
+		if run.ExecveTiming == nil {
+			continue
+		}
+		var first time.Time
+		for _, rt := range run.ExecveTiming.ExeRuntimes {
+			if first.IsZero() || rt.Start.Before(first) {
+				first = rt.Start
+			}
+		}
+		for _, rt := range run.ExecveTiming.ExeRuntimes {
+			start := rt.Start.Sub(first)
+			table.Rows = append(table.Rows, []interface{}{
+				i + 1,
+				rt.Pid,
+				start.Seconds(),
+				(start + rt.TotalSec).Seconds(),
+				rt.TotalSec.Seconds(),
+				rt.Exe,
+			})
+		}
+	}
+	return table
+}
+
+// WriteTraceEvents writes the programs executed during each run, and when
+// the run reached its milestones, as a timeline in the Chrome trace event
+// format. Every run is a process of the trace, starting when the first
+// program was executed.
+func (r ExecOutputResult) WriteTraceEvents(w io.Writer) error {
+	charts := make([]*timechart.Chart, 0, len(r.Runs))
+	for i, run := range r.Runs {
+		charts = append(charts, runTimechart(fmt.Sprintf("run %d", i+1), run))
+	}
+	return timechart.WriteAll(w, charts)
+}
+
+// WriteFoldedStacks writes the programs executed as folded stacks, one line
+// per chain of programs which led to a program with the mean of its time over
+// the traced runs in microseconds, for flamegraph.pl and speedscope.
+func (r ExecOutputResult) WriteFoldedStacks(w io.Writer) error {
+	durations := make(map[string]time.Duration)
+	traced := 0
+	for _, run := range r.Runs {
+		if run.ExecveTiming == nil {
+			continue
+		}
+		traced++
+		for _, s := range run.ExecveTiming.FoldedStacks() {
+			durations[strings.Join(s.Stack, ";")] += s.Duration
+		}
+	}
+	stacks := make([]string, 0, len(durations))
+	for stack := range durations {
+		stacks = append(stacks, stack)
+	}
+	sort.Strings(stacks)
+	for _, stack := range stacks {
+		mean := durations[stack] / time.Duration(traced)
+		if _, err := fmt.Fprintf(w, "%s %d\n", stack, mean.Microseconds()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runTimechart returns the timechart of the programs executed during the run
+// and of its milestones.
+func runTimechart(name string, run Execution) *timechart.Chart {
+	var start time.Time
+	var runtimes []strace.ExeRuntime
+	if run.ExecveTiming != nil {
+		runtimes = run.ExecveTiming.ExeRuntimes
+	}
+	for _, rt := range runtimes {
+		if start.IsZero() || rt.Start.Before(start) {
+			start = rt.Start
+		}
+	}
+	chart := timechart.New(start)
+	chart.Name = name
+	for _, rt := range runtimes {
+		chart.Program(rt.Pid, rt.Exe, rt.Start, rt.TotalSec)
+	}
+	for _, milestone := range run.Milestones {
+		chart.Mark(milestone.Name, start.Add(milestone.Time))
+	}
+	return chart
+}
+
+// RunRecord is a run written to the ndjson outputs as soon as it is done
+type RunRecord struct {
+	SchemaVersion int `json:",omitempty"`
+	// Run is the number of the run, starting at 1
+	Run int
+	Execution
+}
+
+// MarshalJSON encodes the record in its version of the schema.
+func (r RunRecord) MarshalJSON() ([]byte, error) {
+	if r.SchemaVersion < schema.Latest {
+		type record RunRecord
+		return json.Marshal(record(r))
+	}
+	return json.Marshal(struct {
+		SchemaVersion int `json:",omitempty"`
+		Run           int
+		structuredExecution
+	}{r.SchemaVersion, r.Run, r.Execution.structured()})
 }
 
 // Execution represents a single run
@@ -54,52 +356,414 @@ type Execution struct {
 	ExecveTiming  *strace.ExecveTiming `json:",omitempty"`
 	TimeToDisplay time.Duration        `json:",omitempty"`
 	TimeToRun     time.Duration        `json:",omitempty"`
-	Errors        []string             `json:",omitempty"`
+	// NormalizedTimeToDisplay is how long the startup would take on the
+	// reference machine of --hw-benchmark
+	NormalizedTimeToDisplay time.Duration `json:",omitempty"`
+	// NamespaceSetupTime is the time snap-confine spent constructing the
+	// snap's namespace, it is only measured with --discard-snap-ns
+	NamespaceSetupTime time.Duration `json:",omitempty"`
+	// FontCacheTime is the total time spent running fc-cache to generate font
+	// caches
+	FontCacheTime time.Duration `json:",omitempty"`
+	// ShaderCacheGrowth is how many bytes the GPU shader caches grew by during
+	// the run, which is when the program compiled new shaders, it is only
+	// measured with --shader-cache
+	ShaderCacheGrowth int64 `json:",omitempty"`
+	// CriticalPath is the chain of programs which gated the time to display,
+	// it is only known when tracing with strace
+	CriticalPath strace.CriticalPath `json:",omitempty"`
+	// TruncatedTrace is whether the trace stopped in snap-confine before the
+	// app of the snap ran, so the programs it executed are missing
+	TruncatedTrace bool `json:",omitempty"`
+	// ElectronProcesses is the time spent by each type of Electron or Chromium
+	// process, it is only measured with --electron
+	ElectronProcesses []electron.ProcessType `json:",omitempty"`
+	Milestones        []Milestone            `json:",omitempty"`
+	// Windows is when each new window appeared, in the order they appeared,
+	// up to when the main window appeared
+	Windows []WindowTime `json:",omitempty"`
+	Marks   []marks.Mark `json:",omitempty"`
+	// Samples is the resource usage of the process tree over time, it is only
+	// measured with --tracer=proc-sample
+	Samples []proctree.Sample `json:",omitempty"`
+	// Scheduling is how long the threads of the process tree ran and waited
+	// for a cpu during startup, it is only measured with --sched-latency
+	Scheduling *proctree.SchedStat `json:",omitempty"`
+	// Hooks is how long each snap hook run while reinstalling the snap took,
+	// it is only measured with --hook-times
+	Hooks []snaps.HookTime `json:",omitempty"`
+	// Connections is how long snapd took to automatically connect each
+	// interface while reinstalling the snap, it is only measured with
+	// --connection-times
+	Connections []snaps.ConnectionTime `json:",omitempty"`
+	// SquashfsMount is how long mounting the squashfs of the snap took while
+	// reinstalling the snap, it is only measured with --mount-times
+	SquashfsMount *SquashfsMount `json:",omitempty"`
+	// SnapdTasks is how long snapd spent doing each task of the change
+	// reinstalling the snap, from its debug timings, it is only measured with
+	// --trace-snapd
+	SnapdTasks []snaps.TaskTimings `json:",omitempty"`
+	// Refreshes is the snapd changes refreshing the snap, its base or snapd
+	// while the run was done, which make the results of the run invalid, they
+	// are only watched for with --use-snap-run
+	Refreshes []string `json:",omitempty"`
+	// Daemonized is the names of the processes which were still running when
+	// the program exited, they are only waited for with --wait-daemonized
+	Daemonized []string `json:",omitempty"`
+	// Thermal is the cpu frequency, temperature and throttling at the start
+	// and end of the run, it is only recorded with --thermal
+	Thermal *thermal.Telemetry `json:",omitempty"`
+	// CoolDown is how long etrace waited for the machine to cool down before
+	// the run with --cool-down
+	CoolDown time.Duration `json:",omitempty"`
+	// CachePriming is what was read into the page cache before the run with
+	// --prime-cache
+	CachePriming *profiling.CachePriming `json:",omitempty"`
+	// MountNamespace is the mount namespace of the program once it started,
+	// it is only recorded with --mount-ns
+	MountNamespace *MountNamespace `json:",omitempty"`
+	// Crash is how the program crashed during the run, if it did
+	Crash *crash.Crash `json:",omitempty"`
+	// AppArmorDenials are the operations AppArmor denied any program during
+	// the run, they are only recorded with --apparmor-denials
+	AppArmorDenials []apparmor.Denial `json:",omitempty"`
+	// Diagnostics is how long etrace took to parse the trace, it is only
+	// known when tracing with strace
+	Diagnostics *Diagnostics `json:",omitempty"`
+	Errors      []string     `json:",omitempty"`
+}
+
+// plainExecution is an Execution without its methods
+type plainExecution Execution
+
+// structuredExecution is an Execution as encoded since version 2 of the schema
+type structuredExecution struct {
+	plainExecution
+	ExecveTiming            interface{}      `json:",omitempty"`
+	TimeToDisplay           *schema.Duration `json:",omitempty"`
+	TimeToRun               *schema.Duration `json:",omitempty"`
+	NormalizedTimeToDisplay *schema.Duration `json:",omitempty"`
+	NamespaceSetupTime      *schema.Duration `json:",omitempty"`
+	FontCacheTime           *schema.Duration `json:",omitempty"`
+	CriticalPath            interface{}      `json:",omitempty"`
+	ElectronProcesses       []interface{}    `json:",omitempty"`
+	Milestones              []interface{}    `json:",omitempty"`
+	Windows                 []interface{}    `json:",omitempty"`
+	Marks                   []interface{}    `json:",omitempty"`
+	Samples                 []interface{}    `json:",omitempty"`
+	Scheduling              interface{}      `json:",omitempty"`
+	Hooks                   []interface{}    `json:",omitempty"`
+	Connections             []interface{}    `json:",omitempty"`
+	SquashfsMount           interface{}      `json:",omitempty"`
+	SnapdTasks              []interface{}    `json:",omitempty"`
+	CoolDown                *schema.Duration `json:",omitempty"`
+	CachePriming            interface{}      `json:",omitempty"`
+	AppArmorDenials         []interface{}    `json:",omitempty"`
+	Diagnostics             interface{}      `json:",omitempty"`
+}
+
+// structured returns the run as encoded since version 2 of the schema.
+func (e Execution) structured() structuredExecution {
+	v := structuredExecution{
+		plainExecution:          plainExecution(e),
+		TimeToDisplay:           schema.OptionalDuration(e.TimeToDisplay),
+		TimeToRun:               schema.OptionalDuration(e.TimeToRun),
+		NormalizedTimeToDisplay: schema.OptionalDuration(e.NormalizedTimeToDisplay),
+		NamespaceSetupTime:      schema.OptionalDuration(e.NamespaceSetupTime),
+		FontCacheTime:           schema.OptionalDuration(e.FontCacheTime),
+		CoolDown:                schema.OptionalDuration(e.CoolDown),
+	}
+	if e.ExecveTiming != nil {
+		v.ExecveTiming = e.ExecveTiming.Structured()
+	}
+	if len(e.CriticalPath) != 0 {
+		v.CriticalPath = e.CriticalPath.Structured()
+	}
+	for _, t := range e.ElectronProcesses {
+		v.ElectronProcesses = append(v.ElectronProcesses, t.Structured())
+	}
+	for _, m := range e.Milestones {
+		v.Milestones = append(v.Milestones, m.structured())
+	}
+	for _, w := range e.Windows {
+		v.Windows = append(v.Windows, w.structured())
+	}
+	for _, m := range e.Marks {
+		v.Marks = append(v.Marks, m.Structured())
+	}
+	for _, s := range e.Samples {
+		v.Samples = append(v.Samples, s.Structured())
+	}
+	if e.Scheduling != nil {
+		v.Scheduling = e.Scheduling.Structured()
+	}
+	for _, h := range e.Hooks {
+		v.Hooks = append(v.Hooks, h.Structured())
+	}
+	for _, c := range e.Connections {
+		v.Connections = append(v.Connections, c.Structured())
+	}
+	if e.SquashfsMount != nil {
+		v.SquashfsMount = e.SquashfsMount.structured()
+	}
+	for _, t := range e.SnapdTasks {
+		v.SnapdTasks = append(v.SnapdTasks, t.Structured())
+	}
+	if e.CachePriming != nil {
+		v.CachePriming = e.CachePriming.Structured()
+	}
+	for _, d := range e.AppArmorDenials {
+		v.AppArmorDenials = append(v.AppArmorDenials, d.Structured())
+	}
+	if e.Diagnostics != nil {
+		v.Diagnostics = e.Diagnostics.structured()
+	}
+	return v
+}
+
+// Names of the milestones measured by etrace itself, phase marks from the
+// program are also milestones with the name of the mark
+const (
+	// MilestoneFirstWindow is when the first new visible window of any kind
+	// appeared, such as a splash screen
+	MilestoneFirstWindow = "first-window"
+	// MilestoneMainWindow is when the window matching the window
+	// specification appeared, the same as TimeToDisplay
+	MilestoneMainWindow = "main-window"
+	// MilestoneExit is when the program exited if etrace waited for it to exit
+	MilestoneExit = "exit"
+	// MilestoneQuiescent is when the process tree stopped executing new
+	// programs and its cpu usage settled after the main window appeared
+	MilestoneQuiescent = "quiescent"
+	// MilestoneInputReady is when the main thread of the program owning the
+	// main window started waiting for events in its main loop
+	MilestoneInputReady = "input-ready"
+	// MilestoneRendererReady is when the first renderer of an Electron or
+	// Chromium app was live, it is only measured with --electron
+	MilestoneRendererReady = "renderer-ready"
+	// MilestoneFullyDrawn is when the content of the main window last changed
+	// before it stopped changing, it is only measured with --wait-drawn
+	MilestoneFullyDrawn = "fully-drawn"
+	// MilestoneFirstFrame is when GNOME Shell presented the first frame of the
+	// main window, it is only measured with --first-frame
+	MilestoneFirstFrame = "first-frame"
+	// MilestoneFirstCommit is when a DRM device first showed a framebuffer it
+	// didn't show before the program started, the same as TimeToDisplay, it
+	// is only measured with --drm
+	MilestoneFirstCommit = "first-commit"
+	// MilestoneDisplayConnection is when a process first connected to the
+	// X11 or Wayland display server, it is only measured with
+	// --display-connection
+	MilestoneDisplayConnection = "display-connection"
+)
+
+// Milestone is a named point in time during a run, relative to the start of
+// the program
+type Milestone struct {
+	Name string
+	Time time.Duration
+}
+
+// structured returns the milestone as encoded since version 2 of the schema.
+func (m Milestone) structured() interface{} {
+	type plain Milestone
+	return struct {
+		plain
+		Time schema.Duration
+	}{plain(m), schema.NewDuration(m.Time)}
+}
+
+// SquashfsMount is how long mounting the squashfs of a snap took while it was
+// installed
+type SquashfsMount struct {
+	// Task is how long the mount-snap task of snapd took, which includes
+	// setting up the loop device
+	Task time.Duration `json:",omitempty"`
+	// Mounted is how long after the installation started the squashfs was
+	// mounted
+	Mounted time.Duration `json:",omitempty"`
+	// Device is the loop device the squashfs was mounted from
+	Device string `json:",omitempty"`
+}
+
+// structured returns the mount as encoded since version 2 of the schema.
+func (m *SquashfsMount) structured() interface{} {
+	type plain SquashfsMount
+	return struct {
+		plain
+		Task    *schema.Duration `json:",omitempty"`
+		Mounted *schema.Duration `json:",omitempty"`
+	}{plain(*m), schema.OptionalDuration(m.Task), schema.OptionalDuration(m.Mounted)}
+}
+
+// MountNamespace is the mount namespace of the program during a run
+type MountNamespace struct {
+	// Hash is the same for runs whose mount namespaces had the same mounts
+	Hash string
+	// Added and Removed are how the mounts changed since the first run which
+	// recorded them
+	Added   []string `json:",omitempty"`
+	Removed []string `json:",omitempty"`
+}
+
+// mountPollInterval is how often the mounts are polled with --mount-times
+const mountPollInterval = 5 * time.Millisecond
+
+// WindowTime is when a window appeared during a run, relative to the start of
+// the program
+type WindowTime struct {
+	ID   string
+	Time time.Duration
+	// Main is whether the window matched the window specification
+	Main bool `json:",omitempty"`
+}
+
+// structured returns the window time as encoded since version 2 of the schema.
+func (w WindowTime) structured() interface{} {
+	type plain WindowTime
+	return struct {
+		plain
+		Time schema.Duration
+	}{plain(w), schema.NewDuration(w.Time)}
 }
 
 type cmdExec struct {
 	NoTrace           bool `short:"t" long:"no-trace" description:"Don't trace the process, just time the total execution"`
 	CleanSnapUserData bool `long:"clean-snap-user-data" description:"Delete snap user data before executing and restore after execution"`
+	FreshHome         bool `long:"fresh-home" description:"Point HOME and the XDG base directories at a new empty directory for each run, which is removed afterwards"`
 	ReinstallSnap     bool `long:"reinstall-snap" description:"Reinstall the snap before executing, restoring any existing interface connections for the snap"`
+	HookTimes         bool `long:"hook-times" description:"Measure how long each snap hook run while reinstalling the snap with --reinstall-snap takes, requires root"`
+	ConnectionTimes   bool `long:"connection-times" description:"Report how long snapd takes to automatically connect each interface while reinstalling the snap with --reinstall-snap"`
+	MountTimes        bool `long:"mount-times" description:"Report how long mounting the squashfs of the snap takes while reinstalling the snap with --reinstall-snap"`
+	TraceSnapd        bool `long:"trace-snapd" description:"Report how long snapd spends doing each task, like generating security profiles, while reinstalling the snap with --reinstall-snap"`
 	Repeat            uint `short:"n" long:"repeat" description:"Number of times to repeat each task"`
+	PhaseMarks        bool `long:"phase-marks" description:"Record named phase marks the program writes to the fifo in $ETRACE_MARK"`
+	KeepLeftovers     bool `long:"keep-leftovers" description:"Don't kill the processes left over from the program after each run"`
+	WaitDaemonized    bool `long:"wait-daemonized" description:"With --no-window-wait, also wait for the processes the program forked into the background to exit, or for the program to write the ready phase mark"`
+	Cgroup            bool `long:"cgroup" description:"Run each run in its own cgroup to find all of its processes, requires root and cgroup v2"`
+	MaxExecs          uint `long:"max-execs" description:"Abort the runs if the program executes more than this many programs, 0 means no limit"`
+	MaxTraceSize      uint `long:"max-trace-size" description:"Abort the runs if the strace log of a run grows beyond this many MiB, 0 means no limit"`
+	Session           bool `long:"session" description:"Ask for sudo once and keep it and the strace fifo set up across the runs, attaching strace to the program of each run before starting the clock instead of measuring strace starting it"`
+
+	CPULimit    float64 `long:"cpu-limit" description:"Limit each run to this many CPUs worth of time with --cgroup, like 0.5 for half of a single CPU, 0 means no limit"`
+	MemoryLimit uint    `long:"memory-limit" description:"Limit the memory of each run to this many MiB with --cgroup, reclaiming or swapping out memory beyond it, 0 means no limit"`
+
+	OnRefresh     string `long:"on-refresh" default:"annotate" choice:"annotate" choice:"abort" description:"What to do when the snap, its base or snapd is refreshed during a run with --use-snap-run, annotate reports the refresh with the run, abort also stops doing further runs"`
+	HoldRefreshes bool   `long:"hold-refreshes" description:"Hold the refreshes of the snap, its base and snapd while measuring with --use-snap-run"`
+
+	OnTruncatedTrace string `long:"on-truncated-trace" default:"annotate" choice:"annotate" choice:"privileged" description:"What to do when the trace of a snap stopped in snap-confine before its app ran, which happens when strace can't follow snap-confine as the current user, annotate reports it with the run, privileged runs it again and traces the next runs with --privileged"`
 
-	ColdWorstCase bool `long:"cold" description:"Use set of options for worst case, cold cache, etc performance"`
-	HotBestCase   bool `long:"hot" description:"Use set of options for best case, hot cache, etc performance"`
+	Tracer         string `long:"tracer" default:"strace" choice:"strace" choice:"proc-sample" choice:"proc-connector" description:"How to trace the process, proc-sample samples the CPU, I/O and memory usage of the process tree from /proc instead of tracing syscalls, proc-connector times program executions from kernel process events without ptrace"`
+	SampleInterval string `long:"sample-interval" default:"50ms" description:"How often to sample the process tree with --tracer=proc-sample or --sched-latency"`
+	SchedLatency   bool   `long:"sched-latency" description:"Sample the scheduling statistics of the program to report how long it waited for a CPU during startup"`
+	BlockedTime    bool   `long:"blocked-time" description:"Also trace the futex, poll and wait system calls with their durations to report how long the threads of each program were blocked in them"`
+	DisplayConnect bool   `long:"display-connection" description:"Also trace the connections to sockets to report when each program first connected to the X11 or Wayland display server"`
+	Flat           bool   `long:"flat" description:"Show the programs executed in the order they started instead of as a tree of the processes forking them, without tracing the forks"`
+	Thermal        bool   `long:"thermal" description:"Record the CPU frequency and temperature at the start and end of each run and the throttling in between"`
+	HWBenchmark    bool   `long:"hw-benchmark" description:"Benchmark the disk and CPU before the runs and report startup times normalized to a reference machine, to compare results from different machines"`
+
+	FontCache   string `long:"font-cache" choice:"delete" choice:"generate" description:"Delete or generate the fontconfig caches before each run"`
+	ShaderCache string `long:"shader-cache" choice:"clear" choice:"preserve" description:"Clear the GPU shader caches before each run, or preserve them so each run starts with the caches from before the first run"`
+	PrimeCache  bool   `long:"prime-cache" description:"Before each run, read the squashfs of the snap with --use-snap-run and the files of --prime-files into the page cache, which --hot does"`
+	PrimeFiles  string `long:"prime-files" description:"Capture recorded with etrace file --record whose accessed files --prime-cache also reads into the page cache"`
+
+	WaitQuiescent   bool    `long:"wait-quiescent" description:"After the window appears, wait until the process tree stops executing new programs and its CPU usage settles"`
+	QuiescentWindow string  `long:"quiescent-window" default:"2s" description:"How long the process tree must be settled for with --wait-quiescent"`
+	QuiescentCPU    float64 `long:"quiescent-cpu" default:"5" description:"Percentage of a single CPU the process tree must stay below with --wait-quiescent"`
+
+	WaitInputReady   bool   `long:"wait-input-ready" description:"After the window appears, wait until the main thread of the program owning it waits for events in its main loop, when it handles input right away"`
+	InputReadyWindow string `long:"input-ready-window" default:"100ms" description:"How long the main thread must wait for events for with --wait-input-ready"`
+	InputProbe       bool   `long:"input-probe" description:"With --wait-input-ready, then activate the window, press Shift and wait for the main thread to read and handle the key press, with xdotool for --window-tool=xdotool and ydotool otherwise"`
+
+	WaitDrawn     bool   `long:"wait-drawn" description:"After the window appears, take screenshots of it until its content stops changing to measure when it was fully drawn"`
+	DrawnInterval string `long:"drawn-interval" default:"100ms" description:"How often to take screenshots of the window with --wait-drawn"`
+	DrawnWindow   string `long:"drawn-window" default:"1s" description:"How long the window content must stay the same for with --wait-drawn"`
+
+	FirstFrame bool `long:"first-frame" description:"On GNOME, record when the first frame of the main window was presented by the compositor, through the Eval D-Bus method of GNOME Shell which needs unsafe mode"`
+
+	RunToExit        bool   `long:"run-to-exit" description:"After the window appears, let the program run until it exits by itself instead of closing its window, to measure both the time to display and the time to run"`
+	RunToExitTimeout string `long:"run-to-exit-timeout" default:"10m" description:"How long to let the program run for with --run-to-exit before closing its window and killing it. Set to empty string to use no timeout"`
+
+	DRM bool `long:"drm" description:"With --no-window-wait, measure the time to display as when the program first showed something through DRM/KMS, for kiosk programs without X11 or Wayland, it needs root to read debugfs"`
+
+	MountNs bool `long:"mount-ns" description:"Record the mounts of the mount namespace of the program once its window appeared, and report how they changed between runs and since the previous measurement"`
+
+	Electron          bool `long:"electron" description:"Use the Electron/Chromium profile, waiting for the first renderer via the remote debugging port and reporting the time of each type of process"`
+	ElectronDebugPort int  `long:"electron-debug-port" description:"Remote debugging port to use with --electron instead of the default one"`
+
+	MaxVariation float64 `long:"max-variation" default:"10" description:"Percentage of the mean the standard deviation of the times to display of the runs may be before the result is marked as low-confidence"`
+
+	NoCompare bool `long:"no-compare" description:"Don't compare the result with the previous measurement of the same command and profile, nor keep it for the next one"`
+	History   uint `long:"history" default:"10" description:"How many of the last results of each command and profile to load to compare with, 0 loads all of them, all the results are kept for the history subcommand"`
+
+	CrashDir string `long:"crash-dir" description:"Save the core dumps of the program crashing during a run to this directory, collected with coredumpctl"`
+
+	AppArmorDenials bool `long:"apparmor-denials" description:"Record the operations AppArmor denied during each run, read from the journal or the log of auditd, which needs to be root or in the adm group"`
+
+	CrossCheck          bool    `long:"cross-check" description:"Also run the snap once with snap run --trace-exec and compare its exec timings with etrace's"`
+	CrossCheckTolerance float64 `long:"cross-check-tolerance" default:"25" description:"Percentage difference in exec timings to flag as a discrepancy with --cross-check"`
+
+	SelfProfile string `long:"self-profile" description:"Write pprof CPU and heap profiles of etrace to cpu.pprof and heap.pprof in this directory, with the parsing of the traces labeled etrace=parse, and show how long the parsing took"`
+	Table       string `long:"table" default:"runs" choice:"runs" choice:"execs" description:"Table written to the csv and sqlite outputs, runs has a row with the times of each run and execs a row for each program executed during each run"`
+
+	Profile       string `long:"profile" choice:"cold" choice:"hot" choice:"first-run" choice:"low-end" description:"Use the set of options of a named measurement profile, cold for cold caches, hot for warm caches, first-run for the first run after installing and low-end for a cold start on a slow machine"`
+	ColdWorstCase bool   `long:"cold" description:"Use set of options for worst case, cold cache, etc performance, like --profile=cold with a single run by default"`
+	HotBestCase   bool   `long:"hot" description:"Use set of options for best case, hot cache, etc performance, like --profile=hot with a single run by default"`
+	Warmup        bool   `long:"warmup" description:"Run the program once before the runs and discard that run, which --hot and --profile=hot do"`
+
+	Device   string  `long:"device" default:"auto" choice:"auto" choice:"desktop" choice:"arm" choice:"raspberry-pi" description:"Tune the measurements for a class of hardware, arm and raspberry-pi use a longer --window-timeout, fewer runs for the profiles and a --cool-down, auto detects the device"`
+	CoolDown float64 `long:"cool-down" description:"Before each run after the first, wait until the temperature of the machine is at most this many degrees Celsius"`
 
 	Args struct {
 		Cmd []string `description:"Command to run" required:"yes"`
 	} `positional-args:"yes" required:"yes"`
 }
 
-type straceResult struct {
-	timings *strace.ExecveTiming
-	err     error
+const (
+	// tracerProcSample is the --tracer which samples /proc instead of tracing
+	tracerProcSample = "proc-sample"
+	// tracerProcConnector is the --tracer which times executions from the
+	// kernel's process events connector instead of tracing
+	tracerProcConnector = "proc-connector"
+)
+
+// drmPollInterval is how often to check the DRM state for the first commit
+// with --drm
+const drmPollInterval = 10 * time.Millisecond
+
+// procConnectorExitTimeout is how long to wait for the process tree to exit
+// after the run before the remaining programs are counted as still running
+const procConnectorExitTimeout = time.Second
+
+type newWindowsResult struct {
+	appeared []xdotool.WindowAppearance
+	err      error
+}
+
+type rendererResult struct {
+	ready time.Duration
+	err   error
 }
 
 func (x *cmdExec) Execute(args []string) error {
 	if currentCmd.RunThroughFlatpak && currentCmd.RunThroughSnap {
 		return fmt.Errorf("cannot run through both flatpak and snap at same time")
 	}
+	configureStrace()
 
 	if x.ColdWorstCase && x.HotBestCase {
 		return fmt.Errorf("cannot run both hot and cold at same time")
 	}
 
 	// handle meta options which override other options
-	if x.ColdWorstCase {
-		x.CleanSnapUserData = true
-		x.ReinstallSnap = true
-
-		// also for the global command
-		currentCmd.KeepVMCaches = false
-		currentCmd.DiscardSnapNs = true
-	} else if x.HotBestCase {
-		x.CleanSnapUserData = false
-		x.ReinstallSnap = false
-
-		// also for the global command
-		currentCmd.KeepVMCaches = true
-		currentCmd.DiscardSnapNs = false
+	if err := x.applyProfile(x.applyDevice()); err != nil {
+		return err
+	}
+	if (x.CPULimit != 0 || x.MemoryLimit != 0) && !x.Cgroup {
+		return fmt.Errorf("cannot use --cpu-limit or --memory-limit without --cgroup")
+	}
+	if x.CPULimit < 0 {
+		return fmt.Errorf("invalid setting for --cpu-limit (%v): must not be negative", x.CPULimit)
 	}
 
 	if currentCmd.SilentProgram {
@@ -107,32 +771,322 @@ func (x *cmdExec) Execute(args []string) error {
 		currentCmd.ProgramStdoutLog = "/dev/null"
 	}
 
-	// check the output file
-	w := os.Stdout
-	if currentCmd.OutputFile != "" {
-		// TODO: add option for appending?
-		// if the file already exists, delete it and open a new file
-		file, err := files.EnsureExistsAndOpen(currentCmd.OutputFile, true)
+	// open the outputs, the text output is written while measuring
+	outputs, err := openOutputs(true)
+	if err != nil {
+		return err
+	}
+	defer outputs.Close()
+	w := outputs.Text
+
+	if !currentCmd.NoWindowWait {
+		if err := checkWindowTool(); err != nil {
+			return err
+		}
+	}
+	defer closeWindowTool()
+
+	redactor, err := resultRedactor()
+	if err != nil {
+		return err
+	}
+	if err := checkSignOutput(); err != nil {
+		return err
+	}
+
+	snap := ""
+	if currentCmd.RunThroughSnap {
+		snap = x.Args.Cmd[0]
+	}
+	if err := emitRecipe(snap); err != nil {
+		return err
+	}
+
+	var sampleInterval time.Duration
+	if x.Tracer == tracerProcSample {
+		if x.NoTrace {
+			return fmt.Errorf("cannot use --tracer=%s with --no-trace", tracerProcSample)
+		}
+		// the process is sampled instead of traced with strace
+		x.NoTrace = true
+	}
+	if x.Tracer == tracerProcSample || x.SchedLatency {
+		sampleInterval, err = time.ParseDuration(x.SampleInterval)
+		if err != nil {
+			return fmt.Errorf("invalid setting for --sample-interval (%q): %v", x.SampleInterval, err)
+		}
+	}
+	if x.Tracer == tracerProcConnector {
+		if x.NoTrace {
+			return fmt.Errorf("cannot use --tracer=%s with --no-trace", tracerProcConnector)
+		}
+		if os.Geteuid() != 0 {
+			return fmt.Errorf("cannot use --tracer=%s without root", tracerProcConnector)
+		}
+		// executions are timed from process events instead of strace
+		x.NoTrace = true
+	}
+	if currentCmd.Record != "" && x.NoTrace {
+		return fmt.Errorf("cannot use --record without tracing with strace")
+	}
+	if (x.MaxExecs != 0 || x.MaxTraceSize != 0) && x.NoTrace {
+		return fmt.Errorf("cannot use --max-execs or --max-trace-size without tracing with strace")
+	}
+	if x.SelfProfile != "" {
+		if x.NoTrace {
+			return fmt.Errorf("cannot use --self-profile without tracing with strace")
+		}
+		prof, err := startSelfProfile(x.SelfProfile)
+		if err != nil {
+			return fmt.Errorf("cannot profile etrace: %v", err)
+		}
+		defer func() {
+			if err := prof.stop(); err != nil {
+				log.Printf("warning: cannot write the profiles of etrace: %v", err)
+			}
+		}()
+	}
+	if x.FreshHome && currentCmd.RunThroughSnap {
+		// snap run points HOME at the user data of the snap in the real home
+		// from the user database, so snaps can't be given another home
+		return fmt.Errorf("cannot use --fresh-home with --use-snap-run, use --clean-snap-user-data to start snaps without their user data instead")
+	}
+	if currentCmd.Privileged && x.NoTrace {
+		return fmt.Errorf("cannot use --privileged without tracing with strace")
+	}
+	if x.Session {
+		if x.NoTrace {
+			return fmt.Errorf("cannot use --session without tracing with strace")
+		}
+		if currentCmd.Privileged {
+			return fmt.Errorf("cannot use --session with --privileged, strace attaches to the program running as the current user")
+		}
+	}
+	if x.OnTruncatedTrace == "privileged" {
+		if x.NoTrace {
+			return fmt.Errorf("cannot use --on-truncated-trace=privileged without tracing with strace")
+		}
+		if x.Session {
+			return fmt.Errorf("cannot use --on-truncated-trace=privileged with --session, strace attaches to the program running as the current user")
+		}
+	}
+	var primeFiles []string
+	if x.PrimeCache && !currentCmd.KeepVMCaches {
+		return fmt.Errorf("cannot use --prime-cache while freeing the VM caches before each run, use --keep-vm-caches")
+	}
+	if x.PrimeFiles != "" {
+		if !x.PrimeCache {
+			return fmt.Errorf("cannot use --prime-files without --prime-cache")
+		}
+		c, err := capture.ReadFile(x.PrimeFiles)
 		if err != nil {
+			return fmt.Errorf("cannot read --prime-files capture: %v", err)
+		}
+		primeFiles = c.AccessedPaths()
+	}
+	if x.BlockedTime && x.NoTrace {
+		return fmt.Errorf("cannot use --blocked-time without tracing with strace")
+	}
+	if x.DisplayConnect && x.NoTrace {
+		return fmt.Errorf("cannot use --display-connection without tracing with strace")
+	}
+	warnPrivileged()
+
+	if x.ConnectionTimes && !x.ReinstallSnap {
+		return fmt.Errorf("cannot use --connection-times without --reinstall-snap")
+	}
+	if x.MountTimes && !x.ReinstallSnap {
+		return fmt.Errorf("cannot use --mount-times without --reinstall-snap")
+	}
+	if x.TraceSnapd && !x.ReinstallSnap {
+		return fmt.Errorf("cannot use --trace-snapd without --reinstall-snap")
+	}
+	if x.HookTimes {
+		if !x.ReinstallSnap {
+			return fmt.Errorf("cannot use --hook-times without --reinstall-snap")
+		}
+		if os.Geteuid() != 0 {
+			return fmt.Errorf("cannot use --hook-times without root")
+		}
+	}
+
+	if x.CrashDir != "" {
+		if err := os.MkdirAll(x.CrashDir, 0755); err != nil {
 			return err
 		}
-		w = file
+		// the core dumps of the programs are limited like the ones of etrace
+		if err := crash.RaiseCoreLimit(); err != nil {
+			return fmt.Errorf("cannot raise core dump size limit: %v", err)
+		}
 	}
 
-	if !currentCmd.NoWindowWait {
-		// check if we are running on X11, if not then bail because we don't
-		// support graphical window waiting on wayland yet
-		sessionType := os.Getenv("XDG_SESSION_TYPE")
-		if strings.TrimSpace(strings.ToLower(sessionType)) != "x11" {
-			return fmt.Errorf("error: graphical session type %s is unsupported, only x11 is supported", sessionType)
+	if x.WaitDaemonized && !currentCmd.NoWindowWait {
+		return fmt.Errorf("cannot use --wait-daemonized without --no-window-wait")
+	}
+
+	var quiescentWindow time.Duration
+	if x.WaitQuiescent {
+		if currentCmd.NoWindowWait {
+			return fmt.Errorf("cannot use --wait-quiescent with --no-window-wait")
+		}
+		var err error
+		quiescentWindow, err = time.ParseDuration(x.QuiescentWindow)
+		if err != nil {
+			return fmt.Errorf("invalid setting for --quiescent-window (%q): %v", x.QuiescentWindow, err)
+		}
+	}
+
+	var inputReadyWindow time.Duration
+	if x.WaitInputReady {
+		if currentCmd.NoWindowWait {
+			return fmt.Errorf("cannot use --wait-input-ready with --no-window-wait")
+		}
+		var err error
+		inputReadyWindow, err = time.ParseDuration(x.InputReadyWindow)
+		if err != nil {
+			return fmt.Errorf("invalid setting for --input-ready-window (%q): %v", x.InputReadyWindow, err)
+		}
+		if x.InputProbe && !x.NoTrace {
+			// the probe stops the main thread with ptrace, which strace
+			// already uses
+			return fmt.Errorf("cannot use --input-probe when tracing with strace")
+		}
+	} else if x.InputProbe {
+		return fmt.Errorf("cannot use --input-probe without --wait-input-ready")
+	}
+
+	var drawnInterval, drawnWindow time.Duration
+	var capturer drawn.Capturer
+	if x.WaitDrawn {
+		if currentCmd.NoWindowWait {
+			return fmt.Errorf("cannot use --wait-drawn with --no-window-wait")
+		}
+		var err error
+		drawnInterval, err = time.ParseDuration(x.DrawnInterval)
+		if err != nil {
+			return fmt.Errorf("invalid setting for --drawn-interval (%q): %v", x.DrawnInterval, err)
+		}
+		drawnWindow, err = time.ParseDuration(x.DrawnWindow)
+		if err != nil {
+			return fmt.Errorf("invalid setting for --drawn-window (%q): %v", x.DrawnWindow, err)
+		}
+		capturer, err = drawn.ForTool(windowToolName())
+		if err != nil {
+			return fmt.Errorf("cannot use --wait-drawn: %v", err)
+		}
+	}
+
+	if x.DRM {
+		if !currentCmd.NoWindowWait {
+			return fmt.Errorf("cannot use --drm without --no-window-wait")
+		}
+		if x.WaitDaemonized {
+			return fmt.Errorf("cannot use --drm with --wait-daemonized")
+		}
+	}
+
+	if x.RunToExit && currentCmd.NoWindowWait {
+		return fmt.Errorf("cannot use --run-to-exit with --no-window-wait, which always runs the program until it exits")
+	}
+	runToExitTimeout := time.Duration(math.MaxInt64)
+	if x.RunToExit && x.RunToExitTimeout != "" {
+		runToExitTimeout, err = time.ParseDuration(x.RunToExitTimeout)
+		if err != nil {
+			return fmt.Errorf("invalid setting for --run-to-exit-timeout (%q): %v", x.RunToExitTimeout, err)
+		}
+	}
+
+	if x.FirstFrame && currentCmd.NoWindowWait {
+		return fmt.Errorf("cannot use --first-frame with --no-window-wait")
+	}
+
+	if x.MountNs && currentCmd.NoWindowWait && !x.DRM {
+		return fmt.Errorf("cannot use --mount-ns with --no-window-wait, unless with --drm")
+	}
+
+	// the exec timings to compare come from strace or from the process events
+	// with --tracer=proc-connector, which both set --no-trace above
+	debugPort := x.ElectronDebugPort
+	if debugPort == 0 {
+		debugPort = electron.DefaultDebuggingPort
+	}
+
+	if x.CrossCheck {
+		if !currentCmd.RunThroughSnap {
+			return fmt.Errorf("cannot use --cross-check without --use-snap-run")
+		}
+		if x.NoTrace && x.Tracer != tracerProcConnector {
+			return fmt.Errorf("cannot use --cross-check without exec timings from --tracer=strace or --tracer=proc-connector")
+		}
+	}
+
+	windowWaitTimeout := time.Duration(math.MaxInt64)
+	if currentCmd.WindowWaitGlobalTimeout != "" {
+		duration, err := time.ParseDuration(currentCmd.WindowWaitGlobalTimeout)
+		if err != nil {
+			return err
 		}
+		windowWaitTimeout = duration
 	}
 
-	outRes := ExecOutputResult{}
+	// the caches in the snap's user data are only relevant when running a
+	// snap
+	cacheSnapName := ""
+	if currentCmd.RunThroughSnap {
+		cacheSnapName, _ = snaps.SplitSnapApp(x.Args.Cmd[0])
+	}
+
+	// refreshes of the snap, its base or snapd during the runs make their
+	// results invalid
+	var watchedSnaps []string
+	if currentCmd.RunThroughSnap {
+		snapName, _ := snaps.SplitSnapApp(x.Args.Cmd[0])
+		watchedSnaps = []string{snapName, "snapd"}
+		base, err := snaps.Base(snapName)
+		if err != nil {
+			// refreshes of the snap and of snapd are still detected
+			log.Printf("warning: cannot get base of snap %s, its refreshes are not detected: %v", snapName, err)
+		} else if base != "" {
+			watchedSnaps = append(watchedSnaps, base)
+		}
+	} else if x.HoldRefreshes {
+		return fmt.Errorf("cannot use --hold-refreshes without --use-snap-run")
+	}
+	if x.HoldRefreshes {
+		if err := snaps.HoldRefreshes(watchedSnaps); err != nil {
+			return err
+		}
+		defer func() {
+			if err := snaps.UnholdRefreshes(watchedSnaps); err != nil {
+				log.Printf("warning: %v", err)
+			}
+		}()
+	}
+
+	outRes := ExecOutputResult{
+		SchemaVersion: currentCmd.SchemaVersion,
+		Profile:       x.Profile,
+		Device:        x.Device,
+		Storage:       programStorage(),
+		table:         x.Table,
+	}
+	// the revisions are kept with the measurement to tell which snap changed
+	// when it is compared with the next one
+	if currentCmd.RunThroughSnap {
+		revisions, err := snaps.Revisions(x.Args.Cmd[0])
+		if err != nil {
+			log.Printf("warning: cannot get the revisions of the snaps of %s: %v", x.Args.Cmd[0], err)
+		}
+		outRes.Revisions = revisions
+	}
 	max := uint(1)
 	if x.Repeat > 0 {
 		max = x.Repeat
 	}
+	// the warm-up run only fills the caches and isn't part of the result
+	if x.Warmup {
+		max++
+	}
 
 	// first if we are operating on a snap, then use snap save to save the data
 	// into a snapshot before running anything
@@ -207,413 +1161,2328 @@ func (x *cmdExec) Execute(args []string) error {
 		}
 	}
 
-	for i := uint(0); i < max; i++ {
-		// if we were supposed to reinstall the snap before the test, do that
-		// first
-		if x.ReinstallSnap {
-			var isClassic, isDevmode, isJailmode, isUnaliased bool
-			snapName := x.Args.Cmd[0]
-
-			// save interface connections
-			conns, err := snaps.CurrentConnections(snapName)
-			if err != nil {
-				return err
-			}
-
-			// get the current snap file for the installed snap
-			rev, err := snaps.Revision(snapName)
-			if err != nil {
-				return err
-			}
-
-			snapFileName := fmt.Sprintf("%s_%s.snap", snapName, rev)
-			tmpSnap := filepath.Join("/tmp/", snapFileName)
-			snapFileSrc := filepath.Join("/var/lib/snapd/snaps", snapFileName)
+	// save the shader caches so they can be restored before every run
+	var shaderCacheSnapshot *shadercache.Snapshot
+	if x.ShaderCache == shadercache.ModePreserve {
+		var err error
+		shaderCacheSnapshot, err = shadercache.Save(cacheSnapName)
+		if err != nil {
+			return fmt.Errorf("cannot save shader caches: %v", err)
+		}
+		defer shaderCacheSnapshot.Release()
+	}
 
-			cpCmd := exec.Command("cp", snapFileSrc, tmpSnap)
-			err = commands.AddSudoIfNeeded(cpCmd)
-			if err != nil {
-				return fmt.Errorf("failed to add sudo to command: %v", err)
-			}
-			cpOut, err := cpCmd.CombinedOutput()
-			if err != nil {
-				return fmt.Errorf("failed to copy snap %s: %v (%s)", snapFileSrc, err, string(cpOut))
-			}
+	limits := strace.Limits{
+		MaxExecs: int(x.MaxExecs),
+		MaxSize:  int64(x.MaxTraceSize) * 1024 * 1024,
+	}
+	if x.HWBenchmark {
+		// benchmark the disk the user's files are on rather than /tmp, which
+		// may be in memory
+		dir, err := os.UserCacheDir()
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		outRes.Hardware, err = hwbench.Run(dir)
+		if err != nil {
+			return fmt.Errorf("cannot benchmark the hardware: %v", err)
+		}
+		if outputs.HasText() {
+			fmt.Fprintf(w, "Hardware: %.0f MB/s sequential disk read, %.1f single core CPU score\n",
+				outRes.Hardware.DiskReadMBps,
+				outRes.Hardware.CPUScore,
+			)
+		}
+	}
 
-			// get the install options for the snap
-			infoOut, err := exec.Command("snap", "info", snapName).CombinedOutput()
-			if err != nil {
-				return fmt.Errorf("failed to get snap info for snap %s: %v (%s)", snapName, err, string(infoOut))
-			}
+	if outputs.HasText() && outRes.Device != deviceDesktop {
+		fmt.Fprintf(w, "Device: %s", outRes.Device)
+		if outRes.Storage != "" {
+			fmt.Fprintf(w, ", %s storage", outRes.Storage)
+		}
+		fmt.Fprintln(w)
+	}
+
+	// sudo and the strace fifo are set up once for all the runs
+	var sess *session.Session
+	if x.Session {
+		sess, err = session.Start()
+		if err != nil {
+			return err
+		}
+		defer sess.Close()
+	}
 
-			s := bufio.NewScanner(bytes.NewReader(infoOut))
+	// the load of the system before the runs tells whether something else
+	// was competing with the program, it is only a hint so errors are ignored
+	loadBefore, _ := sysstat.LoadAverage()
+
+	m := &execMeasurement{
+		outputs:             outputs,
+		w:                   w,
+		redactor:            redactor,
+		outRes:              &outRes,
+		sess:                sess,
+		limits:              limits,
+		primeFiles:          primeFiles,
+		debugPort:           debugPort,
+		capturer:            capturer,
+		windowWaitTimeout:   windowWaitTimeout,
+		runToExitTimeout:    runToExitTimeout,
+		sampleInterval:      sampleInterval,
+		quiescentWindow:     quiescentWindow,
+		inputReadyWindow:    inputReadyWindow,
+		drawnInterval:       drawnInterval,
+		drawnWindow:         drawnWindow,
+		cacheSnapName:       cacheSnapName,
+		shaderCacheSnapshot: shaderCacheSnapshot,
+		watchedSnaps:        watchedSnaps,
+	}
+	// what each run sets up is released once it is over
+	defer m.cleanup.release()
 
-			for s.Scan() {
-				line := s.Text()
-				if strings.HasPrefix(line, "installed:") {
-					fields := strings.Fields(line)
-					if len(fields) != 5 {
-						return fmt.Errorf("unexpected snap info output: snap info installed line does not have 5 fields")
-					}
+	for i := uint(0); i < max; i++ {
+		warmup := x.Warmup && i == 0
 
-					// we only care about the last field, the options which will
-					// be comma delimited
-					for _, opt := range strings.Split(fields[4], ",") {
-						switch opt {
-						case "try":
-							return fmt.Errorf("snap %s is installed as a try snap, etrace does not yet support reinstalling try snaps", snapName)
-						case "classic":
-							isClassic = true
-						case "devmode":
-							isDevmode = true
-						case "jailmode":
-							isJailmode = true
-						case "isUnaliased":
-							isUnaliased = true
-						case "disabled":
-							return fmt.Errorf("snap %s is disabled, refusing to remove and reinstall, please enable first with snap enable", snapName)
-						case "blocked":
-							// TODO: what should one do about a blocked snap?
-							// return fmt.Errorf("snap %s is blocked, please see warnings from snap info to proceed", snapName)
-						case "broken":
-							return fmt.Errorf("snap %s is broken, please fix before continuing", snapName)
-						}
-					}
+		r := &execRun{index: i}
+		if err := x.setupRun(m, r); err != nil {
+			return err
+		}
+		if err := x.traceRun(m, r); err != nil {
+			return err
+		}
+		if err := x.waitRun(m, r); err != nil {
+			return err
+		}
+		x.closeRun(m, r)
+		if err := x.collectRun(m, r); err != nil {
+			return err
+		}
+		run := x.redactRun(m, r)
+
+		// strace as root can follow snap-confine, so the run is done again
+		// traced as root
+		if r.truncatedTrace && !r.aborted && !currentCmd.Privileged && x.OnTruncatedTrace == "privileged" {
+			log.Println("warning: the trace stopped in snap-confine before the app ran, running again with --privileged")
+			currentCmd.Privileged = true
+			warnPrivileged()
+			resetErrors()
+			m.cleanup.release()
+			// i wraps around for the first run, it is incremented back to
+			// the same run
+			i--
+			continue
+		}
+
+		if warmup {
+			if outputs.HasText() {
+				fmt.Fprintln(w, "Discarded warm-up run:", run.TimeToDisplay.Seconds())
+			}
+			// the errors of the warm-up run aren't part of any run, so they
+			// are shown instead, unless they were already
+			if !currentCmd.ShowErrors {
+				for _, e := range run.Errors {
+					log.Printf("warning: warm-up run: %s", e)
 				}
 			}
-
-			// now remove the snap
-			removeCmd := exec.Command("snap", "remove", snapName)
-			if err := commands.AddSudoIfNeeded(removeCmd); err != nil {
-				return fmt.Errorf("failed to add sudo if needed: %v", err)
+			resetErrors()
+			m.cleanup.release()
+			if r.aborted {
+				break
 			}
+			continue
+		}
 
-			removeOut, err := removeCmd.CombinedOutput()
-			if err != nil {
-				return fmt.Errorf("failed to remove snap %s: %v (%s)", snapName, err, string(removeOut))
-			}
+		// add the run to our result
+		outRes.Runs = append(outRes.Runs, run)
+		record := RunRecord{SchemaVersion: currentCmd.SchemaVersion, Run: len(outRes.Runs), Execution: run}
+		if err := outputs.WriteRecord(record); err != nil {
+			return err
+		}
 
-			// TODO: defer something to go back to the original state of the
-			// snap here if we get interrupted
+		if outputs.HasText() {
+			displayExecution(w, run)
+		}
 
-			// now reinstall the snap
-			installCmd := exec.Command("snap", "install", tmpSnap)
-			if isClassic {
-				installCmd.Args = append(installCmd.Args, "--classic")
-			}
-			if isJailmode {
-				installCmd.Args = append(installCmd.Args, "--jailmode")
-			}
-			if isDevmode {
-				installCmd.Args = append(installCmd.Args, "--devmode")
-			}
-			if isUnaliased {
-				installCmd.Args = append(installCmd.Args, "--unaliased")
-			}
+		resetErrors()
+		m.cleanup.release()
 
-			// if the snap revision number doesn't consist of just numbers, it
-			// is a dangerous unasserted revision and needs --dangerous
-			if !regexp.MustCompile("^[0-9]+$").Match([]byte(rev)) {
-				installCmd.Args = append(installCmd.Args, "--dangerous")
-			}
+		// the program misbehaves, so the next runs would be aborted too, or
+		// the snap changed under us
+		if r.aborted {
+			break
+		}
+	}
 
-			err = commands.AddSudoIfNeeded(installCmd)
-			if err != nil {
-				return fmt.Errorf("failed to add sudo if needed: %v", err)
-			}
-			_, err = installCmd.CombinedOutput()
-			if err != nil {
-				return fmt.Errorf("failed to install snap using command %v: %v", installCmd.Args, err)
-			}
+	if x.CrossCheck {
+		report, err := x.runSnapTraceExec(windowWaitTimeout)
+		if err != nil {
+			return fmt.Errorf("cannot cross-check with snap run --trace-exec: %w", err)
+		}
+		// the programs of the runs were redacted already, so the ones of
+		// the report need to be too for them to match
+		for i := range report.Execs {
+			report.Execs[i].Exe = redactor.Path(report.Execs[i].Exe)
+		}
+		outRes.CrossCheck = crossCheckTimings(report, outRes.Runs, x.CrossCheckTolerance)
+		if outputs.HasText() {
+			outRes.CrossCheck.Display(tabWriterGeneric(w))
+		}
+	}
 
-			// restore the interface connections
-			for _, conn := range conns {
-				err := snaps.ApplyConnection(conn)
-				if err != nil {
-					return fmt.Errorf("failed to restore connections for snap %s: %v", snapName, err)
-				}
-			}
+	outRes.Summary = runsSummary(outRes.Runs)
+	outRes.Dispersion = runsDispersion(outRes.Runs, x.MaxVariation, loadBefore, runtime.NumCPU())
+	if d := outRes.Dispersion; d != nil && d.LowConfidence {
+		if outputs.HasText() {
+			displayLowConfidence(w, d, x.MaxVariation)
+		} else {
+			displayLowConfidence(os.Stderr, d, x.MaxVariation)
 		}
+	}
 
-		// run the prepare script if it's available
-		if currentCmd.PrepareScript != "" {
-			err := profiling.RunScript(currentCmd.PrepareScript, currentCmd.PrepareScriptArgs)
-			if err != nil {
-				logError(fmt.Errorf("running prepare script: %w", err))
-			}
+	if !x.NoCompare {
+		outRes.Previous, err = x.compareWithPrevious(outRes.Runs, outRes.Profile, outRes.Mounts, outRes.Revisions)
+		if err != nil {
+			log.Printf("warning: cannot compare with the previous measurement: %v", err)
+		}
+		if outRes.Previous != nil && outputs.HasText() {
+			displayPreviousComparison(w, outRes.Previous)
+		}
+	}
+
+	if err := outputs.Write(outRes); err != nil {
+		return err
+	}
+
+	return signOutput()
+}
+
+// execMeasurement is what the runs of a measurement share
+type execMeasurement struct {
+	outputs  *sinks.Outputs
+	w        io.Writer
+	redactor *redact.Redactor
+	outRes   *ExecOutputResult
+	// sess is the session of strace shared by the runs, if any
+	sess *session.Session
+	// cleanup is what the current run set up, which is released once it is
+	// over
+	cleanup runCleanup
+
+	limits     strace.Limits
+	primeFiles []string
+	debugPort  int
+	capturer   drawn.Capturer
+
+	windowWaitTimeout time.Duration
+	runToExitTimeout  time.Duration
+	sampleInterval    time.Duration
+	quiescentWindow   time.Duration
+	inputReadyWindow  time.Duration
+	drawnInterval     time.Duration
+	drawnWindow       time.Duration
+
+	// cacheSnapName is the snap whose font and shader caches are prepared
+	// before each run, if any
+	cacheSnapName       string
+	shaderCacheSnapshot *shadercache.Snapshot
+	// watchedSnaps are the snaps whose refreshes make the runs invalid
+	watchedSnaps []string
+
+	// warnedTruncated is whether the warning about a trace stopping in
+	// snap-confine was shown already
+	warnedTruncated bool
+}
+
+// execRun is the state of a run, which goes through setupRun, traceRun,
+// waitRun, closeRun, collectRun and redactRun in that order.
+type execRun struct {
+	index    uint
+	runID    string
+	runStart time.Time
+	coolDown time.Duration
+	// state is the state of the paths of --check-state before the run
+	state     statecheck.State
+	targetCmd []string
+
+	// what reinstalling the snap before the run measured
+	hooks         []snaps.HookTime
+	connections   []snaps.ConnectionTime
+	squashfsMount *SquashfsMount
+	snapdTasks    []snaps.TaskTimings
+
+	shaderCacheSize int64
+	cachePriming    *profiling.CachePriming
+	thermalStart    thermal.Reading
+
+	group    *cgroup.Group
+	runProcs *runner.Run
+	// runCtx is canceled when the run is aborted because its trace exceeded
+	// its limits
+	runCtx   context.Context
+	abortRun context.CancelFunc
+
+	cmd          *exec.Cmd
+	stderrOffset int64
+	tr           *runner.Trace
+	gate         *session.Gate
+	tracer       *session.Tracer
+	connListener *proccon.Listener
+	markListener *marks.Listener
+	bus          *sessionbus.Bus
+	home         *freshhome.Home
+
+	xtool         xdotool.Xtooler
+	windowspec    xdotool.Window
+	existingWids  []string
+	wids          []string
+	tryXToolClose bool
+
+	frameWatcher *xdotool.FrameWatcher
+	drmWatcher   *drm.Watcher
+	watcher      *crash.Watcher
+	crashCtx     context.Context
+	crashSignal  syscall.Signal
+	sampler      *proctree.Sampler
+	schedSampler *proctree.SchedSampler
+
+	newWindowsCh     chan newWindowsResult
+	newWindowsCancel context.CancelFunc
+	rendererCh       chan rendererResult
+	cancelRenderer   context.CancelFunc
+
+	start      time.Time
+	startup    time.Duration
+	exited     time.Duration
+	waited     bool
+	committed  bool
+	daemonized []string
+	mounts     []string
+	milestones []Milestone
+	windows    []WindowTime
+	scheduling *proctree.SchedStat
+	renderers  *electron.ProcessType
+	samples    []proctree.Sample
+	runMarks   []marks.Mark
+
+	slg            *strace.ExecveTiming
+	criticalPath   strace.CriticalPath
+	truncatedTrace bool
+	diagnostics    *Diagnostics
+	refreshes      []string
+	telemetry      *thermal.Telemetry
+	denials        []apparmor.Denial
+	runCrash       *crash.Crash
+	shaderGrowth   int64
+
+	// aborted is whether the next runs are not done, as the program
+	// misbehaves or the snap changed under us
+	aborted bool
+}
+
+// setupRun gets everything into the state the program is run in and sets up
+// its command.
+func (x *cmdExec) setupRun(m *execMeasurement, r *execRun) error {
+	// boards without fans get slower as they heat up over the runs
+	if r.index != 0 && x.CoolDown != 0 {
+		var cooled bool
+		r.coolDown, cooled = thermal.CoolDown(x.CoolDown, coolDownTimeout)
+		if !cooled {
+			log.Printf("warning: the machine did not cool down to %.0f C in %v", x.CoolDown, coolDownTimeout)
+		}
+		if m.outputs.HasText() && r.coolDown != 0 {
+			fmt.Fprintf(m.w, "Waited %v for the machine to cool down\n", r.coolDown.Round(time.Millisecond))
 		}
+	}
+
+	r.runStart = time.Now()
 
-		// handle if the command should be run through `snap run`
-		targetCmd := x.Args.Cmd
-		if currentCmd.RunThroughSnap {
-			targetCmd = append([]string{"snap", "run"}, targetCmd...)
-		} else if currentCmd.RunThroughFlatpak {
-			targetCmd = append([]string{"flatpak", "run"}, targetCmd...)
+	// if we were supposed to reinstall the snap before the test, do that
+	// first
+	if x.ReinstallSnap {
+		if err := x.reinstallSnap(m, r); err != nil {
+			return err
 		}
+	}
 
-		doneCh := make(chan straceResult, 1)
-		var slg *strace.ExecveTiming
-		var cmd *exec.Cmd
-		var fw *os.File
-		if !x.NoTrace {
-			// setup private tmp dir with strace fifo
-			straceTmp, err := ioutil.TempDir("", "exec-trace")
-			if err != nil {
-				return err
-			}
-			defer os.RemoveAll(straceTmp)
-			straceLog := filepath.Join(straceTmp, "strace.fifo")
-			if err := syscall.Mkfifo(straceLog, 0640); err != nil {
+	// run the prepare script if it's available
+	r.state = runPrepareScript()
+
+	// get the font and shader caches into the requested state
+	switch x.FontCache {
+	case fontcache.ModeDelete:
+		if err := fontcache.Delete(m.cacheSnapName); err != nil {
+			return fmt.Errorf("cannot delete font caches: %v", err)
+		}
+	case fontcache.ModeGenerate:
+		if err := fontcache.Generate(m.cacheSnapName); err != nil {
+			logError(err)
+		}
+	}
+	switch x.ShaderCache {
+	case shadercache.ModeClear:
+		if err := shadercache.Clear(m.cacheSnapName); err != nil {
+			return fmt.Errorf("cannot clear shader caches: %v", err)
+		}
+	case shadercache.ModePreserve:
+		if err := m.shaderCacheSnapshot.Restore(); err != nil {
+			return fmt.Errorf("cannot restore shader caches: %v", err)
+		}
+	}
+	// the caches grow when the program compiles new shaders
+	if x.ShaderCache != "" {
+		var err error
+		r.shaderCacheSize, err = shadercache.Size(m.cacheSnapName)
+		if err != nil {
+			return fmt.Errorf("cannot get size of shader caches: %v", err)
+		}
+	}
+
+	// handle if the command should be run through `snap run`
+	r.targetCmd = x.Args.Cmd
+	if x.Electron {
+		// enable the remote debugging protocol to find out when the first
+		// renderer is live, copying so we don't modify the original args
+		r.targetCmd = append(append([]string{}, r.targetCmd...), electron.DebuggingArg(m.debugPort))
+	}
+	if currentCmd.RunThroughSnap {
+		r.targetCmd = append([]string{"snap", "run"}, r.targetCmd...)
+	} else if currentCmd.RunThroughFlatpak {
+		r.targetCmd = append([]string{"flatpak", "run"}, r.targetCmd...)
+	}
+
+	r.runID = fmt.Sprintf("%d-%d", os.Getpid(), r.index)
+	if x.Cgroup {
+		group, err := cgroup.New("etrace-" + r.runID)
+		if err != nil {
+			return err
+		}
+		r.group = group
+		m.cleanup.add(func() { group.Remove() })
+		if x.CPULimit != 0 {
+			if err := group.SetCPULimit(x.CPULimit); err != nil {
 				return err
 			}
-			// ensure we have one writer on the fifo so that if strace fails
-			// nothing blocks
-			fw, err = os.OpenFile(straceLog, os.O_RDWR, 0640)
-			if err != nil {
+		}
+		if x.MemoryLimit != 0 {
+			if err := group.SetMemoryLimit(uint64(x.MemoryLimit) << 20); err != nil {
 				return err
 			}
-			defer fw.Close()
+		}
+	}
+
+	r.runProcs = &runner.Run{ID: r.runID, Group: r.group}
+
+	// the run is aborted when the trace exceeds its limits
+	r.runCtx, r.abortRun = context.WithCancel(context.Background())
+	m.cleanup.add(r.abortRun)
 
-			// read strace data from fifo async
-			go func() {
-				timing, err := strace.TraceExecveTimings(straceLog, -1)
-				doneCh <- straceResult{timings: timing, err: err}
-				close(doneCh)
-			}()
+	return x.runCommand(m, r)
+}
+
+// runCommand sets up the command of the run, under strace unless not tracing.
+func (x *cmdExec) runCommand(m *execMeasurement, r *execRun) error {
+	if !x.NoTrace {
+		runProcs, abortRun := r.runProcs, r.abortRun
+		opts := runner.TraceOptions{
+			Scope:  strace.Scope(currentCmd.TraceScope),
+			Exec:   x.straceOptions(),
+			Limits: m.limits,
+			Parse:  parseWithProfile,
+			Exceeded: func() error {
+				err := runProcs.Kill()
+				abortRun()
+				return err
+			},
+		}
+		if m.sess != nil {
+			// every run reuses the fifo of the session
+			opts.Log = m.sess.StraceLog()
+		}
+		tr, err := runner.StartTrace(opts)
+		if err != nil {
+			return err
+		}
+		r.tr = tr
+		m.cleanup.add(tr.Remove)
 
-			cmd, err = strace.TraceExecCommand(straceLog, targetCmd...)
+		if m.sess != nil {
+			// the program waits for strace to attach to it
+			cmd, gate, err := session.GatedCommand(r.targetCmd[0], r.targetCmd[1:]...)
 			if err != nil {
 				return err
 			}
+			r.cmd, r.gate = cmd, gate
+			m.cleanup.add(func() { gate.Close() })
 		} else {
-			// Don't setup tracing, so just use exec.Command directly
-			// x.Args.Cmd (and thus targetCmd) is guaranteed to be at least one
-			// element given that it is a required argument
-			prog := targetCmd[0]
-			var args []string
-			// setup args if there's more than 1
-			if len(targetCmd) > 1 {
-				args = targetCmd[1:]
-			}
-			cmd = exec.Command(prog, args...)
-		}
-
-		cmd.Stdin = os.Stdin
-		// redirect all output from the child process to the log files if they exist
-		// otherwise just to this process's stdout, etc.
-
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		if currentCmd.ProgramStdoutLog != "" {
-			f, err := files.EnsureExistsAndOpen(currentCmd.ProgramStdoutLog, false)
+			r.cmd, err = tr.Command(currentCmd.Privileged, r.targetCmd...)
 			if err != nil {
 				return err
 			}
-			defer f.Close()
-			cmd.Stdout = f
 		}
-		if currentCmd.ProgramStderrLog != "" {
-			f, err := files.EnsureExistsAndOpen(currentCmd.ProgramStderrLog, false)
-			if err != nil {
-				return err
-			}
-			defer f.Close()
-			cmd.Stderr = f
+	} else {
+		// Don't setup tracing, so just use exec.Command directly
+		// x.Args.Cmd (and thus targetCmd) is guaranteed to be at least one
+		// element given that it is a required argument
+		prog := r.targetCmd[0]
+		var args []string
+		// setup args if there's more than 1
+		if len(r.targetCmd) > 1 {
+			args = r.targetCmd[1:]
 		}
+		r.cmd = exec.Command(prog, args...)
+	}
+	cmd := r.cmd
 
-		if currentCmd.DiscardSnapNs {
-			if !currentCmd.RunThroughSnap {
-				// check if the command provided resolves to /snap/bin/<exec>,
-				// otherwise fail
-				bin, err := exec.LookPath(x.Args.Cmd[0])
-				// this regexp also handles the cross distro case of
-				// /var/lib/snapd/snap/bin/<exec> too
-				snapBinRegexp := regexp.MustCompile(`.*\/snap\/bin$`)
-				if err != nil || !snapBinRegexp.MatchString(filepath.Dir(bin)) {
-					return errors.New("cannot use --discard-snap-ns without --use-snap-run or a command that resolves to /snap/bin/<cmd>")
-				}
-			}
-			// the name of the snap in this case is the first argument
-			err := snaps.DiscardSnapNs(x.Args.Cmd[0])
-			if err != nil {
-				return err
+	cmd.Stdin = os.Stdin
+	// redirect all output from the child process to the log files if they exist
+	// otherwise just to this process's stdout, etc.
+
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if currentCmd.ProgramStdoutLog != "" {
+		f, err := files.EnsureExistsAndOpen(currentCmd.ProgramStdoutLog, false)
+		if err != nil {
+			return err
+		}
+		m.cleanup.add(func() { f.Close() })
+		cmd.Stdout = f
+	}
+	if currentCmd.ProgramStderrLog != "" {
+		f, err := files.EnsureExistsAndOpen(currentCmd.ProgramStderrLog, false)
+		if err != nil {
+			return err
+		}
+		m.cleanup.add(func() { f.Close() })
+		cmd.Stderr = f
+		// what the program writes to the log is appended, which is
+		// read back if it crashes
+		r.stderrOffset, err = f.Seek(0, io.SeekEnd)
+		if err != nil {
+			return err
+		}
+	}
+
+	if currentCmd.DiscardSnapNs {
+		if !currentCmd.RunThroughSnap {
+			// check if the command provided resolves to /snap/bin/<exec>,
+			// otherwise fail
+			bin, err := exec.LookPath(x.Args.Cmd[0])
+			// this regexp also handles the cross distro case of
+			// /var/lib/snapd/snap/bin/<exec> too
+			snapBinRegexp := regexp.MustCompile(`.*\/snap\/bin$`)
+			if err != nil || !snapBinRegexp.MatchString(filepath.Dir(bin)) {
+				return errors.New("cannot use --discard-snap-ns without --use-snap-run or a command that resolves to /snap/bin/<cmd>")
 			}
 		}
+		// the name of the snap in this case is the first argument
+		err := snaps.DiscardSnapNs(x.Args.Cmd[0])
+		if err != nil {
+			return err
+		}
+	}
+
+	r.xtool = windowTool()
+	r.tryXToolClose = true
+	r.windowspec = x.windowSpec()
+
+	// without a cgroup, mark all the processes of the run so that the
+	// ones left over after it can be found, even if they daemonized
+	cmd.Env = os.Environ()
+	r.runProcs.Prepare(cmd)
+
+	// setup the fifo for the program to write phase marks to
+	if x.PhaseMarks {
+		var err error
+		r.markListener, err = newMarkListener(x.Args.Cmd[0])
+		if err != nil {
+			return err
+		}
+		cmd.Env = append(cmd.Env, r.markListener.Env())
+	}
+
+	// give the run its own session bus, which is stopped with the
+	// services it activated once the run is over
+	if currentCmd.PrivateSessionBus {
+		bus, err := sessionbus.Start()
+		if err != nil {
+			return err
+		}
+		r.bus = bus
+		m.cleanup.add(func() { bus.Stop() })
+		cmd.Env = append(cmd.Env, bus.Env())
+	}
+
+	// start each run like a new user would, the real home is never
+	// written to
+	if x.FreshHome {
+		home, err := freshhome.New()
+		if err != nil {
+			return err
+		}
+		r.home = home
+		m.cleanup.add(func() { home.Remove() })
+		cmd.Env = append(cmd.Env, home.Env()...)
+	}
+	return nil
+}
 
-		windowWaitTimeout := time.Duration(math.MaxInt64)
-		if currentCmd.WindowWaitGlobalTimeout != "" {
-			duration, err := time.ParseDuration(currentCmd.WindowWaitGlobalTimeout)
+// traceRun starts the program, traced unless not tracing, along with what
+// watches it while it starts up.
+func (x *cmdExec) traceRun(m *execMeasurement, r *execRun) error {
+	var err error
+	// before running the final command, free the caches to get most
+	// accurate timing
+	if !currentCmd.KeepVMCaches {
+		if err := profiling.FreeCaches(); err != nil {
+			return err
+		}
+	}
+	// or fill them with the same files before every run
+	if x.PrimeCache {
+		if paths := x.primePaths(m.primeFiles); len(paths) != 0 {
+			r.cachePriming, err = profiling.PrimeCaches(paths)
 			if err != nil {
 				return err
 			}
-			windowWaitTimeout = duration
 		}
+	}
 
-		xtool := xdotool.MakeXDoTool()
+	// get the windows which already exist so that we can tell when the
+	// first new window appears
+	if !currentCmd.NoWindowWait {
+		r.existingWids, err = r.xtool.VisibleWindowIDs()
+		if err != nil {
+			logError(fmt.Errorf("listing existing windows: %w", err))
+		}
+		if currentCmd.WindowNewOnly {
+			r.windowspec.Exclude = r.existingWids
+		}
+	}
 
-		tryXToolClose := true
-		var wids []string
+	if x.Thermal {
+		r.thermalStart = thermal.Read()
+	}
 
-		windowspec := xdotool.Window{}
-		// check which opts are defined
-		if currentCmd.WindowClass != "" {
-			// prefer window class from option
-			windowspec.Class = currentCmd.WindowClass
-		} else if currentCmd.WindowName != "" {
-			// then window name
-			windowspec.Name = currentCmd.WindowName
-		} else if currentCmd.WindowClassName != "" {
-			// then window class name
-			windowspec.ClassName = currentCmd.WindowClassName
-		} else {
-			// finally fall back to base cmd as the class or classname
-			if currentCmd.RunThroughFlatpak {
-				// for flatpak apps, we can use the name of the app (i.e.
-				// org.gabmus.whatip) as the classname consistently
-				windowspec.ClassName = x.Args.Cmd[0]
-			} else {
-				// note we use the original command and note the processed targetCmd
-				// because for example when measuring a snap, we invoke etrace like
-				// so:
-				// $ ./etrace run --use-snap chromium
-				// where targetCmd becomes []string{"snap","run","chromium"}
-				// but we still want to use "chromium" as the windowspec class
-				windowspec.Class = filepath.Base(x.Args.Cmd[0])
-			}
+	// frames presented by the compositor are only recorded for the windows
+	// created after this
+	if x.FirstFrame {
+		r.frameWatcher, err = xdotool.WatchFirstFrames()
+		if err != nil {
+			return err
 		}
+	}
 
-		// before running the final command, free the caches to get most
-		// accurate timing
-		if !currentCmd.KeepVMCaches {
-			if err := profiling.FreeCaches(); err != nil {
-				return err
-			}
+	// kiosk programs show their first frame on a display instead of in a
+	// window
+	if x.DRM {
+		r.drmWatcher, err = drm.Watch()
+		if err != nil {
+			return err
 		}
+	}
 
-		// start running the command
-		start := time.Now()
+	cmd := r.cmd
+	// with --session, strace attaches to the program held back by the
+	// gate before the clock starts, so starting it isn't measured
+	if r.gate != nil {
 		if err := cmd.Start(); err != nil {
 			return err
 		}
+		if err := r.runProcs.Started(cmd.Process.Pid); err != nil {
+			cmd.Process.Kill()
+			return err
+		}
+		r.tracer, err = m.sess.Attach(cmd.Process.Pid, strace.Scope(currentCmd.TraceScope), x.straceOptions())
+		if err != nil {
+			return err
+		}
+	}
 
-		if !currentCmd.NoWindowWait {
-			ctx, cancel := context.WithTimeout(context.Background(), windowWaitTimeout)
-			defer cancel()
-			// now wait until the window appears
-			var err error
-			wids, err = xtool.WaitForWindow(ctx, windowspec)
-			if errors.Is(err, context.DeadlineExceeded) {
-				// we timed out waiting for the process, just kill the main
-				// command and return an error
-				if err := cmd.Process.Kill(); err != nil {
-					logError(err)
-				}
-				return err
-			} else if err != nil {
-				logError(fmt.Errorf("waiting for window appearance: %w", err))
-				// if we don't get the wid properly then we can't try closing
-				tryXToolClose = false
-			}
+	// start running the command
+	r.start = time.Now()
+	start := r.start
+	if r.markListener != nil {
+		r.markListener.Start(start)
+	}
+	// subscribe to process events before the command starts so that
+	// none of its events are missed
+	if x.Tracer == tracerProcConnector {
+		r.connListener, err = proccon.Listen()
+		if err != nil {
+			return err
+		}
+		m.cleanup.add(r.connListener.Close)
+	}
+	if r.gate != nil {
+		err = r.gate.Release()
+	} else {
+		err = cmd.Start()
+	}
+	if err != nil {
+		return err
+	}
+	// the command held back by the gate was moved into the cgroup
+	// already
+	if r.gate == nil {
+		if err := r.runProcs.Started(cmd.Process.Pid); err != nil {
+			cmd.Process.Kill()
+			return err
 		}
+	}
+	if r.connListener != nil {
+		r.connListener.Start(cmd.Process.Pid)
+	}
 
-		if currentCmd.NoWindowWait || len(wids) == 0 {
-			// if we aren't waiting on the window class, then just wait for the
-			// command to return
-			if err := cmd.Wait(); err != nil {
-				logError(fmt.Errorf("waiting for command: %w", err))
+	// the window of a program which crashed will never appear, so a crash
+	// ends the wait for it right away
+	watcher := crash.Watch(cmd.Process.Pid)
+	r.watcher = watcher
+	crashCtx, crashCancel := context.WithCancel(r.runCtx)
+	r.crashCtx = crashCtx
+	m.cleanup.add(crashCancel)
+	go func() {
+		select {
+		case <-watcher.Done():
+			if _, crashed := watcher.Crashed(); crashed {
+				crashCancel()
 			}
+		case <-crashCtx.Done():
 		}
+	}()
 
-		// save the startup time
-		startup := time.Since(start)
+	if x.Tracer == tracerProcSample {
+		r.sampler = proctree.NewSampler(cmd.Process.Pid, m.sampleInterval)
+		r.sampler.Start(start)
+	}
+	if x.SchedLatency {
+		// the program is started by sudo and strace when traced, unless
+		// strace attaches to it
+		traced := !x.NoTrace && r.gate == nil
+		r.schedSampler = proctree.NewSchedSampler(r.runProcs.ProgramPids(cmd.Process.Pid, traced), m.sampleInterval)
+		r.schedSampler.Start()
+	}
 
-		// now get the pids before closing the window so we can gracefully try
-		// closing the windows before forcibly killing them later
-		if tryXToolClose {
-			pids := make([]int, len(wids))
-			for i, wid := range wids {
-				pid, err := xtool.PidForWindowID(wid)
-				if err != nil {
-					logError(fmt.Errorf("getting pid for wid %s: %w", wid, err))
-					break
-				}
-				pids[i] = pid
-			}
+	// in the background, watch for new windows of any kind to appear, the
+	// first of which may be a splash screen before the main window
+	newWindowsCtx, newWindowsCancel := context.WithTimeout(context.Background(), m.windowWaitTimeout)
+	r.newWindowsCancel = newWindowsCancel
+	m.cleanup.add(newWindowsCancel)
+	if !currentCmd.NoWindowWait {
+		newWindowsCh := make(chan newWindowsResult, 1)
+		r.newWindowsCh = newWindowsCh
+		xtool, existingWids := r.xtool, r.existingWids
+		go func() {
+			var res newWindowsResult
+			res.appeared, res.err = xdotool.WatchNewWindows(newWindowsCtx, xtool, existingWids)
+			newWindowsCh <- res
+		}()
+	}
 
-			// close the windows
-			for _, wid := range wids {
-				if err := xtool.CloseWindowID(wid); err != nil {
-					logError(fmt.Errorf("closing window: %w", err))
-				}
-			}
+	// in the background, wait for the first renderer to be live
+	r.cancelRenderer = func() {}
+	if x.Electron {
+		rendererCh := make(chan rendererResult, 1)
+		r.rendererCh = rendererCh
+		var rendererCtx context.Context
+		rendererCtx, r.cancelRenderer = context.WithTimeout(r.runCtx, m.windowWaitTimeout)
+		m.cleanup.add(r.cancelRenderer)
+		debugPort := m.debugPort
+		go func() {
+			err := electron.WaitForRenderer(rendererCtx, debugPort)
+			rendererCh <- rendererResult{ready: time.Since(start), err: err}
+		}()
+	}
+	return nil
+}
 
-			// kill the app pids in case x fails to close the window
-			for _, pid := range pids {
-				// FindProcess always succeeds on unix
-				proc, _ := os.FindProcess(pid)
-				if err := proc.Signal(os.Kill); err != nil {
-					// if the process already exited then try wmctrl
-					if !strings.Contains(err.Error(), "process already finished") {
-						logError(fmt.Errorf("killing window process pid %d: %w", pid, err))
-					}
-				}
+// waitRun waits until the program displayed its window, or exited when not
+// waiting for a window, and then for the milestones after it.
+func (x *cmdExec) waitRun(m *execMeasurement, r *execRun) error {
+	cmd, watcher, start := r.cmd, r.watcher, r.start
+	if !currentCmd.NoWindowWait {
+		ctx, cancel := context.WithTimeout(r.crashCtx, m.windowWaitTimeout)
+		// now wait until the window appears
+		var err error
+		var ignored bool
+		r.wids, ignored, err = xdotool.WaitForProgramWindow(ctx, r.xtool, r.windowspec, r.existingWids)
+		cancel()
+		if ignored {
+			log.Println(ignoredWindowsWarning)
+		}
+		if r.runCtx.Err() != nil {
+			// the run was aborted, the reason is reported below
+			r.tryXToolClose = false
+			r.wids = nil
+		} else if _, crashed := watcher.Crashed(); crashed && err != nil {
+			// the crash is reported below
+			r.tryXToolClose = false
+		} else if errors.Is(err, context.DeadlineExceeded) {
+			// we timed out waiting for the process, just kill the main
+			// command and return an error
+			if err := cmd.Process.Kill(); err != nil {
+				logError(err)
 			}
+			return err
+		} else if err != nil {
+			logError(fmt.Errorf("waiting for window appearance: %w", err))
+			// if we don't get the wid properly then we can't try closing
+			r.tryXToolClose = false
 		}
+	}
+	wids := r.wids
 
-		if !x.NoTrace {
-			// ensure we close the fifo here so that the strace.TraceExecCommand()
-			// helper gets a EOF from the fifo (i.e. all writers must be closed
-			// for this)
-			fw.Close()
+	// the program is still running once its window appeared
+	if x.MountNs && len(wids) != 0 {
+		r.mounts = readMountNamespace(r.runProcs)
+	}
 
-			// wait for strace reader
-			straceRes := <-doneCh
-			if straceRes.err == nil {
-				slg = straceRes.timings
-				// make a new tabwriter to stderr
-				if !currentCmd.JSONOutput {
-					wtab := tabWriterGeneric(w)
-					slg.Display(wtab, nil)
-				}
-			} else {
-				logError(fmt.Errorf("cannot extract runtime data: %w", straceRes.err))
-				return straceRes.err
+	var end time.Time
+	if r.drmWatcher != nil {
+		ctx, cancel := context.WithTimeout(r.crashCtx, m.windowWaitTimeout)
+		var err error
+		_, end, err = r.drmWatcher.WaitCommit(ctx, drmPollInterval)
+		cancel()
+		if err != nil && r.runCtx.Err() == nil {
+			if _, crashed := watcher.Crashed(); !crashed {
+				logError(fmt.Errorf("waiting for first DRM commit: %w", err))
 			}
 		}
-
-		if currentCmd.RestoreScript != "" {
-			err := profiling.RunScript(currentCmd.RestoreScript, currentCmd.RestoreScriptArgs)
-			if err != nil {
-				logError(fmt.Errorf("running restore script: %w", err))
+		r.committed = err == nil
+		if x.MountNs && r.committed {
+			r.mounts = readMountNamespace(r.runProcs)
+		}
+		// kiosk programs keep running, so stop them like closing the
+		// window of desktop programs, the program may have exited
+		// already
+		cmd.Process.Signal(syscall.SIGTERM)
+		r.waited = true
+		if err := cmd.Wait(); err != nil && r.runCtx.Err() == nil {
+			if sig, crashed := crash.FromWaitError(err); crashed {
+				r.crashSignal = sig
 			}
 		}
-
-		run := Execution{
-			ExecveTiming:  slg,
-			TimeToDisplay: startup,
-			Errors:        errs,
+	} else if currentCmd.NoWindowWait && x.WaitDaemonized {
+		// the program may exit right away after forking into the
+		// background, so wait for all the processes of the run
+		ctx, cancel := context.WithTimeout(r.runCtx, m.windowWaitTimeout)
+		var err error
+		end, r.daemonized, err = waitDaemonized(ctx, cmd, r.runProcs, r.markListener)
+		cancel()
+		// waitDaemonized waits for the command in the background
+		r.waited = true
+		if err != nil && r.runCtx.Err() == nil {
+			logError(fmt.Errorf("waiting for processes forked into the background: %w", err))
 		}
-
-		// if we're not tracing then just use startup time as time to run
-		if x.NoTrace {
-			run.TimeToRun = startup
-		} else {
-			run.TimeToRun = slg.TotalTime
+	} else if currentCmd.NoWindowWait || len(wids) == 0 {
+		// if we aren't waiting on the window class, then just wait for the
+		// command to return
+		r.waited = true
+		if err := cmd.Wait(); err != nil && r.runCtx.Err() == nil {
+			if sig, crashed := crash.FromWaitError(err); crashed {
+				r.crashSignal = sig
+			} else {
+				logError(fmt.Errorf("waiting for command: %w", err))
+			}
 		}
+	}
 
-		// add the run to our result
-		outRes.Runs = append(outRes.Runs, run)
+	// save the startup time
+	r.startup = time.Since(start)
+	if !end.IsZero() {
+		r.startup = end.Sub(start)
+	}
+	startup := r.startup
 
-		if !currentCmd.JSONOutput {
-			fmt.Fprintln(w, "Total startup time:", startup.Seconds())
+	if r.schedSampler != nil {
+		var err error
+		r.scheduling, err = r.schedSampler.Stop()
+		if err != nil {
+			logError(fmt.Errorf("sampling scheduling statistics: %w", err))
 		}
+	}
 
-		resetErrors()
+	if r.newWindowsCh != nil {
+		r.newWindowsCancel()
+		res := <-r.newWindowsCh
+		if res.err != nil {
+			logError(fmt.Errorf("watching for new windows: %w", res.err))
+		}
+		r.windows = windowTimes(res.appeared, wids, start, startup)
+		if len(r.windows) != 0 {
+			r.milestones = append(r.milestones, Milestone{Name: MilestoneFirstWindow, Time: r.windows[0].Time})
+		}
+	}
+	if len(wids) != 0 {
+		r.milestones = append(r.milestones, Milestone{Name: MilestoneMainWindow, Time: startup})
+	} else if r.committed {
+		r.milestones = append(r.milestones, Milestone{Name: MilestoneFirstCommit, Time: startup})
+	} else {
+		r.milestones = append(r.milestones, Milestone{Name: MilestoneExit, Time: startup})
 	}
 
-	if currentCmd.JSONOutput {
-		json.NewEncoder(w).Encode(outRes)
+	// the main loop of the program is often busy for a while after its
+	// window appeared, so the program isn't responsive yet
+	if x.WaitInputReady && len(wids) != 0 {
+		pid, err := r.xtool.PidForWindowID(wids[0])
+		if err == nil {
+			ctx, cancel := context.WithTimeout(context.Background(), m.windowWaitTimeout)
+			var ready time.Time
+			ready, err = proctree.WaitInputReady(ctx, pid, m.inputReadyWindow)
+			if err == nil && x.InputProbe {
+				ready, err = probeInput(ctx, r.xtool, pid, wids[0])
+			}
+			cancel()
+			if err == nil {
+				r.milestones = append(r.milestones, Milestone{Name: MilestoneInputReady, Time: ready.Sub(start)})
+			}
+		}
+		if err != nil {
+			logError(fmt.Errorf("waiting for program to be ready for input: %w", err))
+		}
 	}
 
-	return nil
+	// the renderer may become live after the window appeared, so wait for
+	// it before closing the window, but not for long as the app may not
+	// use the remote debugging port or have exited without a renderer
+	if r.rendererCh != nil {
+		var res rendererResult
+		select {
+		case res = <-r.rendererCh:
+		case <-time.After(rendererWaitTimeout):
+			r.cancelRenderer()
+			<-r.rendererCh
+			res.err = fmt.Errorf("no renderer was live %v after the window appeared or the program exited", rendererWaitTimeout)
+		}
+		if res.err != nil {
+			logError(fmt.Errorf("waiting for first renderer: %w", res.err))
+		} else {
+			r.milestones = append(r.milestones, Milestone{Name: MilestoneRendererReady, Time: res.ready})
+		}
+		// the renderers are forked from the zygote without an exec, so
+		// they are only seen while they run
+		pids, err := r.runProcs.ProgramPids(cmd.Process.Pid, !x.NoTrace && r.gate == nil)()
+		if err != nil {
+			logError(fmt.Errorf("finding the renderers: %w", err))
+		} else {
+			r.renderers = electron.Renderers(pids)
+		}
+	}
+
+	// the window is usually visible before its first frame is presented
+	if r.frameWatcher != nil {
+		if len(wids) != 0 {
+			ctx, cancel := context.WithTimeout(context.Background(), m.windowWaitTimeout)
+			frame, err := r.frameWatcher.WaitFirstFrame(ctx, r.windowspec)
+			cancel()
+			if err != nil {
+				logError(fmt.Errorf("waiting for first frame: %w", err))
+			} else {
+				r.milestones = append(r.milestones, Milestone{Name: MilestoneFirstFrame, Time: frame.Time.Sub(start)})
+			}
+		}
+		if err := r.frameWatcher.Stop(); err != nil {
+			logError(err)
+		}
+	}
+
+	// wait for the content of the window to stop changing, a window is
+	// often mapped long before the program finished drawing into it
+	if x.WaitDrawn && len(wids) != 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), m.windowWaitTimeout)
+		drawnAt, err := drawn.WaitDrawn(ctx, m.capturer, wids[0], m.drawnInterval, m.drawnWindow)
+		cancel()
+		if err != nil {
+			logError(fmt.Errorf("waiting for window to be fully drawn: %w", err))
+		} else {
+			r.milestones = append(r.milestones, Milestone{Name: MilestoneFullyDrawn, Time: drawnAt.Sub(start)})
+		}
+	}
+
+	// wait for the process tree to settle down after the window appeared
+	if x.WaitQuiescent && len(wids) != 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), m.windowWaitTimeout)
+		settled, err := proctree.WaitQuiescent(ctx, cmd.Process.Pid, m.quiescentWindow, x.QuiescentCPU)
+		cancel()
+		if err != nil {
+			logError(fmt.Errorf("waiting for process tree to be quiescent: %w", err))
+		} else {
+			r.milestones = append(r.milestones, Milestone{Name: MilestoneQuiescent, Time: settled.Sub(start)})
+		}
+	}
+	return nil
+}
+
+// closeRun closes the windows of the program, or lets it exit by itself with
+// --run-to-exit, and stops all that is left of the run.
+func (x *cmdExec) closeRun(m *execMeasurement, r *execRun) {
+	// let the program finish the work it does after its window
+	// appeared, its windows are gone once it exited
+	if x.RunToExit && len(r.wids) != 0 {
+		if err := waitExit(r.runCtx, r.watcher.Done(), m.runToExitTimeout); err == nil {
+			r.exited = time.Since(r.start)
+			r.milestones = append(r.milestones, Milestone{Name: MilestoneExit, Time: r.exited})
+			r.tryXToolClose = false
+		} else if r.runCtx.Err() == nil {
+			logError(fmt.Errorf("waiting for program to exit: %w", err))
+		}
+	}
+
+	if r.sampler != nil {
+		r.samples = r.sampler.Stop()
+	}
+
+	if r.tryXToolClose {
+		closeWindows(r.xtool, r.wids)
+	}
+
+	// leftover processes such as daemons would otherwise affect the next
+	// runs, the command is given time to exit after its windows were
+	// closed
+	if !x.KeepLeftovers {
+		killLeftovers(r.runProcs, r.cmd.Process.Pid, r.watcher.Done())
+	}
+	if !r.waited {
+		select {
+		case <-r.watcher.Done():
+			r.cmd.Wait()
+		default:
+		}
+	}
+	if r.bus != nil {
+		if err := r.bus.Stop(); err != nil {
+			logError(fmt.Errorf("stopping private session bus: %w", err))
+		}
+	}
+	if r.home != nil {
+		if err := r.home.Remove(); err != nil {
+			logError(fmt.Errorf("removing fresh home: %w", err))
+		}
+	}
+}
+
+// collectRun collects what was measured of the run once the program is gone,
+// starting with its trace.
+func (x *cmdExec) collectRun(m *execMeasurement, r *execRun) error {
+	start, startup := r.start, r.startup
+	if r.connListener != nil {
+		var err error
+		r.slg, err = r.connListener.Stop(procConnectorExitTimeout)
+		if err != nil {
+			logError(fmt.Errorf("cannot extract runtime data: %w", err))
+			return err
+		}
+		m.redactor.ExecveTiming(r.slg)
+	}
+
+	if r.markListener != nil {
+		r.runMarks = r.markListener.Stop()
+		os.Remove(filepath.Dir(r.markListener.Path()))
+		for _, mark := range r.runMarks {
+			r.milestones = append(r.milestones, Milestone{Name: mark.Name, Time: mark.Offset})
+		}
+	}
+	if !x.NoTrace {
+		// wait for strace reader
+		parseWaitStart := time.Now()
+		straceRes := r.tr.Wait()
+		if straceRes.ExceededErr != nil {
+			logError(straceRes.ExceededErr)
+		}
+		if r.tracer != nil {
+			// strace exits once the program did, unless the run was
+			// aborted while it was still tracing it
+			if straceRes.Err != nil {
+				r.tracer.Stop()
+			}
+			if err := r.tracer.Wait(); err != nil && straceRes.Err == nil {
+				logError(err)
+			}
+		}
+		r.diagnostics = &Diagnostics{
+			ParseTime: straceRes.ParseTime,
+			ParseWait: time.Since(parseWaitStart),
+		}
+		if x.SelfProfile != "" && m.outputs.HasText() {
+			fmt.Fprintf(m.w, "Trace parsing time: %v (waited %v after the run)\n", r.diagnostics.ParseTime.Seconds(), r.diagnostics.ParseWait.Seconds())
+		}
+		var limitErr *strace.LimitError
+		if errors.As(straceRes.Err, &limitErr) {
+			logError(fmt.Errorf("run aborted: %w", straceRes.Err))
+			r.aborted = true
+		} else if straceRes.Err == nil {
+			if err := recordCapture(straceRes.Capture, r.index, r.wids, start.Add(startup)); err != nil {
+				return err
+			}
+			r.slg = straceRes.Timing
+			m.redactor.ExecveTiming(r.slg)
+			r.criticalPath = r.slg.CriticalPath(start.Add(startup))
+			if connected := r.slg.FirstDisplayConnection(); !connected.IsZero() {
+				r.milestones = append(r.milestones, Milestone{Name: MilestoneDisplayConnection, Time: connected.Sub(start)})
+			}
+			// strace stopping early isn't an error of its own, so it
+			// is only seen in what the trace is missing
+			if r.slg.StoppedInConfinement() {
+				r.truncatedTrace = true
+				logError(fmt.Errorf("the trace stopped in snap-confine before the app ran"))
+				if !currentCmd.Privileged && x.OnTruncatedTrace == "annotate" && !m.warnedTruncated {
+					log.Println(truncatedTraceWarning)
+					m.warnedTruncated = true
+				}
+			}
+		} else {
+			logError(fmt.Errorf("cannot extract runtime data: %w", straceRes.Err))
+			return straceRes.Err
+		}
+	}
+	x.displayTrace(m, r)
+
+	sort.SliceStable(r.milestones, func(i, j int) bool {
+		return r.milestones[i].Time < r.milestones[j].Time
+	})
+
+	// the whole process tree has exited when the cgroup is empty
+	if r.group != nil && !x.KeepLeftovers {
+		ctx, cancel := context.WithTimeout(context.Background(), cgroupExitTimeout)
+		err := r.group.WaitEmpty(ctx)
+		cancel()
+		if err != nil {
+			logError(fmt.Errorf("waiting for the processes of the run to exit: %w", err))
+		} else if err := r.group.Remove(); err != nil {
+			logError(fmt.Errorf("removing cgroup of the run: %w", err))
+		}
+	}
+
+	runRestoreScript(r.state)
+
+	if m.watchedSnaps != nil {
+		changes, err := snaps.Refreshes(m.watchedSnaps, r.runStart, time.Now())
+		if err != nil {
+			logError(fmt.Errorf("watching for snap refreshes: %w", err))
+		}
+		for _, change := range changes {
+			r.refreshes = append(r.refreshes, change.Summary)
+			logError(fmt.Errorf("snap refreshed during the run: %s", change.Summary))
+		}
+		if len(changes) != 0 && x.OnRefresh == "abort" {
+			r.aborted = true
+		}
+	}
+
+	if x.Thermal {
+		r.telemetry = thermal.Between(r.thermalStart, thermal.Read())
+	}
+
+	if x.AppArmorDenials {
+		var err error
+		r.denials, err = apparmor.Denials(start, time.Now())
+		if err != nil {
+			logError(fmt.Errorf("collecting AppArmor denials: %w", err))
+		}
+	}
+
+	if sig, crashed := r.watcher.Crashed(); crashed {
+		r.crashSignal = sig
+	}
+	if r.crashSignal != 0 {
+		r.runCrash = x.collectCrash(r.crashSignal, start, r.runID, r.stderrOffset)
+	}
+
+	if x.ShaderCache != "" {
+		size, err := shadercache.Size(m.cacheSnapName)
+		if err != nil {
+			logError(fmt.Errorf("cannot get size of shader caches: %w", err))
+		} else if size > r.shaderCacheSize {
+			r.shaderGrowth = size - r.shaderCacheSize
+		}
+	}
+	return nil
+}
+
+// redactRun redacts what was collected of the run and returns it as an
+// execution.
+func (x *cmdExec) redactRun(m *execMeasurement, r *execRun) Execution {
+	redactor := m.redactor
+	for i := range r.denials {
+		r.denials[i].Name = redactor.Path(r.denials[i].Name)
+	}
+	if r.runCrash != nil {
+		r.runCrash.Core = redactor.Path(r.runCrash.Core)
+		redactor.Strings(r.runCrash.Stderr)
+	}
+	// the daemonized processes may be named after their programs
+	redactor.Strings(r.daemonized)
+
+	run := Execution{
+		ExecveTiming:  r.slg,
+		TimeToDisplay: r.startup,
+		CriticalPath:  r.criticalPath,
+		Milestones:    r.milestones,
+		Windows:       r.windows,
+		Marks:         r.runMarks,
+		Samples:       r.samples,
+		Scheduling:    r.scheduling,
+		Hooks:         r.hooks,
+		Connections:   r.connections,
+		SquashfsMount: r.squashfsMount,
+		SnapdTasks:    r.snapdTasks,
+		Refreshes:     r.refreshes,
+		Daemonized:    r.daemonized,
+		Thermal:       r.telemetry,
+		CoolDown:      r.coolDown,
+		CachePriming:  r.cachePriming,
+		Crash:         r.runCrash,
+		Diagnostics:   r.diagnostics,
+	}
+	run.TruncatedTrace = r.truncatedTrace
+	run.AppArmorDenials = r.denials
+	run.ShaderCacheGrowth = r.shaderGrowth
+	if r.mounts != nil {
+		run.MountNamespace = &MountNamespace{Hash: mountns.Hash(r.mounts)}
+		// the mounts kept for the next runs and the next measurement, and
+		// how they changed, are all redacted
+		redactor.Strings(r.mounts)
+		if m.outRes.Mounts == nil {
+			m.outRes.Mounts = r.mounts
+		} else {
+			run.MountNamespace.Added, run.MountNamespace.Removed = mountns.Diff(m.outRes.Mounts, r.mounts)
+		}
+	}
+
+	// if we're not tracing then just use startup time as time to run,
+	// or when the program exited with --run-to-exit
+	if r.slg == nil {
+		run.TimeToRun = r.startup
+		if r.exited != 0 {
+			run.TimeToRun = r.exited
+		}
+	} else {
+		run.TimeToRun = r.slg.TotalTime
+		if x.Electron {
+			run.ElectronProcesses = electron.Breakdown(r.slg.ExeRuntimes)
+		}
+		for _, rt := range r.slg.ExeRuntimes {
+			if fontcache.IsFontCacheExe(rt.Exe) {
+				run.FontCacheTime += rt.TotalSec
+			}
+		}
+		// the namespace was only constructed from scratch if it was
+		// discarded first
+		if currentCmd.DiscardSnapNs {
+			if nsSetup, ok := r.slg.NamespaceSetupTime(); ok {
+				run.NamespaceSetupTime = nsSetup
+			} else {
+				logError(fmt.Errorf("cannot find snap-confine namespace setup in trace"))
+			}
+		}
+	}
+
+	if x.Electron {
+		run.ElectronProcesses = electron.WithRenderers(run.ElectronProcesses, r.renderers)
+	}
+
+	// the errors are only redacted once all of them were logged
+	redactor.Strings(errs)
+	run.Errors = errs
+
+	if m.outRes.Hardware != nil {
+		// the caches were freed before the run unless keeping them
+		run.NormalizedTimeToDisplay = m.outRes.Hardware.Normalize(r.startup, !currentCmd.KeepVMCaches)
+	}
+	return run
+}
+
+// displayTrace shows the trace of the run once it was redacted.
+func (x *cmdExec) displayTrace(m *execMeasurement, r *execRun) {
+	if r.slg == nil || !m.outputs.HasText() {
+		return
+	}
+	wtab := tabWriterGeneric(m.w)
+	r.slg.Display(wtab, &strace.DisplayOptions{Flat: x.Flat})
+	r.criticalPath.Display(wtab)
+	wtab.Flush()
+}
+
+// reinstallSnap removes the snap and installs it again from the same file,
+// measuring what was asked of the install.
+func (x *cmdExec) reinstallSnap(m *execMeasurement, r *execRun) error {
+	var isClassic, isDevmode, isJailmode, isUnaliased bool
+	snapName := x.Args.Cmd[0]
+
+	// save interface connections
+	conns, err := snaps.CurrentConnections(snapName)
+	if err != nil {
+		return err
+	}
+
+	// get the current snap file for the installed snap
+	rev, err := snaps.Revision(snapName)
+	if err != nil {
+		return err
+	}
+
+	snapFileName := fmt.Sprintf("%s_%s.snap", snapName, rev)
+	tmpSnap := filepath.Join("/tmp/", snapFileName)
+	snapFileSrc := filepath.Join("/var/lib/snapd/snaps", snapFileName)
+
+	cpCmd := exec.Command("cp", snapFileSrc, tmpSnap)
+	err = commands.AddSudoIfNeeded(cpCmd)
+	if err != nil {
+		return fmt.Errorf("failed to add sudo to command: %v", err)
+	}
+	cpOut, err := cpCmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to copy snap %s: %v (%s)", snapFileSrc, err, string(cpOut))
+	}
+
+	// get the install options for the snap
+	infoOut, err := exec.Command("snap", "info", snapName).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to get snap info for snap %s: %v (%s)", snapName, err, string(infoOut))
+	}
+
+	s := bufio.NewScanner(bytes.NewReader(infoOut))
+
+	for s.Scan() {
+		line := s.Text()
+		if strings.HasPrefix(line, "installed:") {
+			fields := strings.Fields(line)
+			if len(fields) != 5 {
+				return fmt.Errorf("unexpected snap info output: snap info installed line does not have 5 fields")
+			}
+
+			// we only care about the last field, the options which will
+			// be comma delimited
+			for _, opt := range strings.Split(fields[4], ",") {
+				switch opt {
+				case "try":
+					return fmt.Errorf("snap %s is installed as a try snap, etrace does not yet support reinstalling try snaps", snapName)
+				case "classic":
+					isClassic = true
+				case "devmode":
+					isDevmode = true
+				case "jailmode":
+					isJailmode = true
+				case "isUnaliased":
+					isUnaliased = true
+				case "disabled":
+					return fmt.Errorf("snap %s is disabled, refusing to remove and reinstall, please enable first with snap enable", snapName)
+				case "blocked":
+					// TODO: what should one do about a blocked snap?
+					// return fmt.Errorf("snap %s is blocked, please see warnings from snap info to proceed", snapName)
+				case "broken":
+					return fmt.Errorf("snap %s is broken, please fix before continuing", snapName)
+				}
+			}
+		}
+	}
+
+	// now remove the snap
+	removeCmd := exec.Command("snap", "remove", snapName)
+	if err := commands.AddSudoIfNeeded(removeCmd); err != nil {
+		return fmt.Errorf("failed to add sudo if needed: %v", err)
+	}
+
+	removeOut, err := removeCmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to remove snap %s: %v (%s)", snapName, err, string(removeOut))
+	}
+
+	// TODO: defer something to go back to the original state of the
+	// snap here if we get interrupted
+
+	// the hooks are run by snapd, so follow the programs it executes
+	// while the snap is installed and its connections are restored
+	var hookListener *proccon.Listener
+	if x.HookTimes {
+		snapdPid, err := snaps.DaemonPid()
+		if err != nil {
+			return err
+		}
+		hookListener, err = proccon.Listen()
+		if err != nil {
+			return err
+		}
+		m.cleanup.add(hookListener.Close)
+		hookListener.Start(snapdPid)
+	}
+
+	// now reinstall the snap
+	installCmd := exec.Command("snap", "install", tmpSnap)
+	if isClassic {
+		installCmd.Args = append(installCmd.Args, "--classic")
+	}
+	if isJailmode {
+		installCmd.Args = append(installCmd.Args, "--jailmode")
+	}
+	if isDevmode {
+		installCmd.Args = append(installCmd.Args, "--devmode")
+	}
+	if isUnaliased {
+		installCmd.Args = append(installCmd.Args, "--unaliased")
+	}
+
+	// if the snap revision number doesn't consist of just numbers, it
+	// is a dangerous unasserted revision and needs --dangerous
+	if !regexp.MustCompile("^[0-9]+$").Match([]byte(rev)) {
+		installCmd.Args = append(installCmd.Args, "--dangerous")
+	}
+
+	err = commands.AddSudoIfNeeded(installCmd)
+	if err != nil {
+		return fmt.Errorf("failed to add sudo if needed: %v", err)
+	}
+
+	// snapd mounts the squashfs in the mount namespace of the host,
+	// which is shared with ours
+	var mountWatcher *blockdev.MountWatcher
+	if x.MountTimes {
+		mountWatcher, err = blockdev.WatchMounts(filepath.Join("/snap", snapName), mountPollInterval)
+		if err != nil {
+			logError(fmt.Errorf("measuring squashfs mount: %w", err))
+		}
+	}
+	installStart := time.Now()
+	_, err = installCmd.CombinedOutput()
+	var mount blockdev.Mount
+	var mountedAt time.Time
+	mounted := false
+	if mountWatcher != nil {
+		mount, mountedAt, mounted = mountWatcher.Stop()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to install snap using command %v: %v", installCmd.Args, err)
+	}
+
+	// the interfaces are connected automatically as part of the
+	// change installing the snap, which also mounted it
+	if x.ConnectionTimes || x.MountTimes || x.TraceSnapd {
+		change, err := snaps.LastChange(snapName, "install-snap")
+		if err != nil {
+			logError(fmt.Errorf("reading the change installing the snap: %w", err))
+		} else {
+			if x.ConnectionTimes {
+				r.connections = snaps.ConnectionTimes(change)
+			}
+			if x.MountTimes {
+				r.squashfsMount = &SquashfsMount{}
+				if t, ok := snaps.MountTime(change); ok {
+					r.squashfsMount.Task = t
+				} else {
+					logError(fmt.Errorf("cannot find the mount-snap task of the change installing the snap"))
+				}
+			}
+			if x.TraceSnapd {
+				r.snapdTasks, err = snaps.ChangeTimings(change.ID)
+				if err != nil {
+					logError(fmt.Errorf("reading the snapd timings of the change installing the snap: %w", err))
+				}
+			}
+		}
+	}
+	if mounted {
+		if r.squashfsMount == nil {
+			r.squashfsMount = &SquashfsMount{}
+		}
+		r.squashfsMount.Mounted = mountedAt.Sub(installStart)
+		r.squashfsMount.Device = mount.Source
+	}
+
+	// restore the interface connections
+	for _, conn := range conns {
+		err := snaps.ApplyConnection(conn)
+		if err != nil {
+			return fmt.Errorf("failed to restore connections for snap %s: %v", snapName, err)
+		}
+	}
+
+	if hookListener != nil {
+		// snapd keeps running, so don't wait for it to exit
+		timing, err := hookListener.Stop(0)
+		if err != nil {
+			logError(fmt.Errorf("measuring snap hooks: %w", err))
+		} else {
+			r.hooks = snaps.HookTimes(timing)
+		}
+	}
+	return nil
+}
+
+// displayExecution shows what was measured of a run.
+func displayExecution(w io.Writer, run Execution) {
+	for _, milestone := range run.Milestones {
+		fmt.Fprintf(w, "Milestone %s: %v\n", milestone.Name, milestone.Time.Seconds())
+	}
+	if len(run.Daemonized) != 0 {
+		fmt.Fprintf(w, "Processes forked into the background: %s\n", strings.Join(run.Daemonized, ", "))
+	}
+	if len(run.Windows) > 1 {
+		wtab := tabWriterGeneric(w)
+		fmt.Fprintf(wtab, "%d windows appeared:\n", len(run.Windows))
+		fmt.Fprintf(wtab, "\tWindow\tTime\tMain\n")
+		for _, win := range run.Windows {
+			fmt.Fprintf(wtab, "\t%s\t%v\t%t\n", win.ID, win.Time.Seconds(), win.Main)
+		}
+		wtab.Flush()
+	}
+	if len(run.Samples) != 0 {
+		wtab := tabWriterGeneric(w)
+		fmt.Fprintf(wtab, "%d samples of the process tree:\n", len(run.Samples))
+		fmt.Fprintf(wtab, "\tTime\tProcesses\tCPU %%\tRead (bytes)\tWritten (bytes)\tPSS (bytes)\n")
+		for _, sample := range run.Samples {
+			fmt.Fprintf(wtab, "\t%v\t%d\t%.1f\t%d\t%d\t%d\n",
+				sample.Time.Seconds(),
+				sample.Processes,
+				sample.CPUPercent,
+				sample.ReadBytes,
+				sample.WriteBytes,
+				sample.PSSBytes,
+			)
+		}
+		wtab.Flush()
+	}
+	if run.Scheduling != nil {
+		fmt.Fprintf(w, "Scheduling during startup: %v running, %v waiting for a CPU (%d processes, %d threads)\n",
+			run.Scheduling.RunTime.Seconds(),
+			run.Scheduling.WaitTime.Seconds(),
+			run.Scheduling.Processes,
+			run.Scheduling.Threads,
+		)
+	}
+	for _, conn := range run.Connections {
+		fmt.Fprintf(w, "Interface connection %s to %s: %v\n", conn.Plug, conn.Slot, conn.Time.Seconds())
+	}
+	if m := run.SquashfsMount; m != nil {
+		if m.Task != 0 {
+			fmt.Fprintln(w, "Squashfs mount task:", m.Task.Seconds())
+		}
+		if m.Mounted != 0 {
+			fmt.Fprintf(w, "Squashfs mounted from %s after: %v\n", m.Device, m.Mounted.Seconds())
+		}
+	}
+	if len(run.AppArmorDenials) != 0 {
+		wtab := tabWriterGeneric(w)
+		fmt.Fprintf(wtab, "%d AppArmor denials:\n", len(run.AppArmorDenials))
+		fmt.Fprintf(wtab, "\tTime\tProfile\tProgram\tOperation\tName\tDenied\n")
+		for _, d := range run.AppArmorDenials {
+			fmt.Fprintf(wtab, "\t%v\t%s\t%s\t%s\t%s\t%s\n", d.Time.Seconds(), d.Profile, d.Comm, d.Operation, d.Name, d.DeniedMask)
+		}
+		wtab.Flush()
+	}
+	if ns := run.MountNamespace; ns != nil {
+		fmt.Fprintln(w, "Mount namespace:", ns.Hash)
+		displayMountChanges(w, "the first run", ns.Added, ns.Removed)
+	}
+	for _, hook := range run.Hooks {
+		fmt.Fprintf(w, "Snap hook %s: %v\n", hook.Hook, hook.Time.Seconds())
+	}
+	for _, task := range run.SnapdTasks {
+		fmt.Fprintf(w, "snapd task %s (%s): %v\n", task.Kind, task.Summary, task.DoingTime.Seconds())
+		for _, t := range task.Timings {
+			fmt.Fprintf(w, "  %s%s: %v\n", strings.Repeat("  ", t.Level), t.Summary, t.Duration.Seconds())
+		}
+	}
+	if p := run.CachePriming; p != nil {
+		fmt.Fprintf(w, "Primed the page cache with %d files (%d bytes) in %v\n", p.Files, p.Bytes, p.Time.Seconds())
+	}
+	if run.Thermal != nil {
+		fmt.Fprintf(w, "CPU frequency: %.0f MHz at start, %.0f MHz at end\n", run.Thermal.Start.FrequencyMHz, run.Thermal.End.FrequencyMHz)
+		fmt.Fprintf(w, "CPU temperature: %.1f C at start, %.1f C at end\n", run.Thermal.Start.TemperatureC, run.Thermal.End.TemperatureC)
+		if run.Thermal.ThrottleEvents != 0 {
+			fmt.Fprintln(w, "CPU throttle events:", run.Thermal.ThrottleEvents)
+		}
+	}
+	if run.Crash != nil {
+		fmt.Fprintln(w, "Program crashed with", run.Crash.Signal)
+		if run.Crash.Core != "" {
+			fmt.Fprintln(w, "Core dump saved to", run.Crash.Core)
+		}
+		for _, line := range run.Crash.Stderr {
+			fmt.Fprintln(w, "  stderr:", line)
+		}
+	}
+	for _, pt := range run.ElectronProcesses {
+		if pt.Type == electron.RendererType && pt.TotalTime == 0 {
+			fmt.Fprintf(w, "Electron %s processes: %d (%v CPU)\n", pt.Type, pt.Count, pt.CPUTime)
+		} else {
+			fmt.Fprintf(w, "Electron %s processes: %d (%v total)\n", pt.Type, pt.Count, pt.TotalTime)
+		}
+	}
+	if run.FontCacheTime != 0 {
+		fmt.Fprintln(w, "Font cache generation time:", run.FontCacheTime.Seconds())
+	}
+	if run.ShaderCacheGrowth != 0 {
+		fmt.Fprintf(w, "Shader caches grew by: %d bytes\n", run.ShaderCacheGrowth)
+	}
+	if run.NamespaceSetupTime != 0 {
+		fmt.Fprintln(w, "Namespace setup time:", run.NamespaceSetupTime.Seconds())
+	}
+	fmt.Fprintln(w, "Total startup time:", run.TimeToDisplay.Seconds())
+	if run.NormalizedTimeToDisplay != 0 {
+		fmt.Fprintln(w, "Normalized startup time:", run.NormalizedTimeToDisplay.Seconds())
+	}
+}
+
+// programStorage returns the class of storage the program is run from, which
+// is where the snap files are for snaps.
+func programStorage() string {
+	mounts, err := blockdev.ReadMounts()
+	if err != nil {
+		return ""
+	}
+	dir := "/usr"
+	if currentCmd.RunThroughSnap {
+		dir = "/var/lib/snapd/snaps"
+	}
+	m, ok := blockdev.Find(mounts, dir)
+	if !ok {
+		return ""
+	}
+	return blockdev.StorageClass(m)
+}
+
+// minConfidentRuns is the number of runs below which a high variation is also
+// blamed on too few runs
+const minConfidentRuns = 5
+
+// runsSummary returns the statistics of the times to display and the times to
+// run of the runs without errors, or nil if there are no such runs.
+func runsSummary(runs []Execution) *analysis.Summary {
+	var display, total []time.Duration
+	for _, run := range runs {
+		if len(run.Errors) != 0 {
+			continue
+		}
+		if run.TimeToDisplay != 0 {
+			display = append(display, run.TimeToDisplay)
+		}
+		if run.TimeToRun != 0 {
+			total = append(total, run.TimeToRun)
+		}
+	}
+	if len(display) == 0 && len(total) == 0 {
+		return nil
+	}
+	var s analysis.Summary
+	if len(display) != 0 {
+		d := analysis.Describe(display)
+		s.TimeToDisplay = &d
+	}
+	if len(total) != 0 {
+		d := analysis.Describe(total)
+		s.TimeToRun = &d
+	}
+	return &s
+}
+
+// runsDispersion returns how much the times to display of the runs without
+// errors varied, or nil if there are less than 2 of them. When the variation
+// is above the maximum, the likely causes are found from the telemetry of the
+// runs and the load average of the system before them.
+func runsDispersion(runs []Execution, maxVariation, load float64, cpus int) *Dispersion {
+	var times []time.Duration
+	thermalMeasured := false
+	throttled := 0
+	for _, run := range runs {
+		if run.Thermal != nil {
+			thermalMeasured = true
+			if run.Thermal.ThrottleEvents != 0 {
+				throttled++
+			}
+		}
+		if run.TimeToDisplay != 0 && len(run.Errors) == 0 {
+			times = append(times, run.TimeToDisplay)
+		}
+	}
+	if len(times) < 2 {
+		return nil
+	}
+
+	d := &Dispersion{Stats: analysis.Compute(times)}
+	if d.Variation <= maxVariation {
+		return d
+	}
+	d.LowConfidence = true
+	if throttled != 0 {
+		d.Causes = append(d.Causes, fmt.Sprintf("the CPU was throttled during %d of the runs, let the machine cool down or pin its frequency", throttled))
+	}
+	if load > float64(cpus)/2 {
+		d.Causes = append(d.Causes, fmt.Sprintf("the system was busy, with a load average of %.2f on %d CPUs before the runs", load, cpus))
+	}
+	if d.N > 2 && times[0] > d.Median*3/2 {
+		d.Causes = append(d.Causes, fmt.Sprintf("the first run was %.0f%% slower than the median, the caches were probably still warming up", 100*float64(times[0]-d.Median)/float64(d.Median)))
+	}
+	if d.N < minConfidentRuns {
+		d.Causes = append(d.Causes, fmt.Sprintf("too few runs, use --repeat with at least %d runs", minConfidentRuns))
+	}
+	if !thermalMeasured {
+		d.Causes = append(d.Causes, "the CPU may have been throttled, check with --thermal")
+	}
+	return d
+}
+
+// displayLowConfidence warns that the runs varied too much for the result to
+// be trusted.
+func displayLowConfidence(w io.Writer, d *Dispersion, maxVariation float64) {
+	fmt.Fprintf(w, "WARNING: the times to display of the runs vary by %.1f%% of the mean, more than the %.1f%% of --max-variation, the result has low confidence\n",
+		d.Variation,
+		maxVariation,
+	)
+	fmt.Fprintln(w, "Likely causes:")
+	for _, cause := range d.Causes {
+		fmt.Fprintln(w, "  -", cause)
+	}
+}
+
+// compareWithPrevious compares the times to display of the runs without errors
+// with the previous measurement of the same command and profile, and keeps
+// them for the next one.
+func (x *cmdExec) compareWithPrevious(runs []Execution, profile string, mounts []string, revisions map[string]string) (*PreviousComparison, error) {
+	var times, runTimes []time.Duration
+	for _, run := range runs {
+		if run.TimeToDisplay != 0 && len(run.Errors) == 0 {
+			times = append(times, run.TimeToDisplay)
+			if run.TimeToRun != 0 {
+				runTimes = append(runTimes, run.TimeToRun)
+			}
+		}
+	}
+	if len(times) == 0 {
+		return nil, nil
+	}
+
+	// the same command run differently isn't comparable
+	command := x.Args.Cmd
+	switch {
+	case currentCmd.RunThroughSnap:
+		command = append([]string{"snap", "run"}, command...)
+	case currentCmd.RunThroughFlatpak:
+		command = append([]string{"flatpak", "run"}, command...)
+	}
+	dir, err := history.Dir()
+	if err != nil {
+		return nil, err
+	}
+	h, err := history.Load(dir, command, profile, int(x.History))
+	if err != nil {
+		return nil, err
+	}
+	var cmp *PreviousComparison
+	if prev := h.Previous(); prev != nil {
+		cmp = &PreviousComparison{
+			Measured:   prev.Time,
+			Comparison: analysis.Compare(prev.TimesToDisplay, times),
+		}
+		// the mounts are only compared if both measurements recorded them
+		if prev.Mounts != nil && mounts != nil {
+			cmp.MountsAdded, cmp.MountsRemoved = mountns.Diff(prev.Mounts, mounts)
+		}
+		if prev.Revisions != nil && revisions != nil {
+			cmp.RevisionChanges = snaps.RevisionChanges(prev.Revisions, revisions)
+		}
+	}
+	return cmp, h.Add(history.Entry{
+		Time:           time.Now(),
+		TimesToDisplay: times,
+		TimesToRun:     runTimes,
+		Kernel:         recipe.HostFacts().Kernel,
+		Mounts:         mounts,
+		Revisions:      revisions,
+	})
+}
+
+// displayPreviousComparison shows how the mean time to display changed since
+// the previous measurement.
+func displayPreviousComparison(w io.Writer, cmp *PreviousComparison) {
+	noise := ""
+	if cmp.Base.N > 1 && cmp.New.N > 1 && !cmp.Significant {
+		noise = ", within the noise"
+	}
+	fmt.Fprintf(w, "Compared to the previous measurement on %s: %v -> %v (%+.1f%%%s)\n",
+		cmp.Measured.Format("2006-01-02 15:04"),
+		cmp.Base.Mean.Seconds(),
+		cmp.New.Mean.Seconds(),
+		cmp.Change,
+		noise,
+	)
+	if len(cmp.RevisionChanges) != 0 {
+		var changes []string
+		for _, change := range cmp.RevisionChanges {
+			old, new := change.Old, change.New
+			if old == "" {
+				old = "none"
+			}
+			if new == "" {
+				new = "none"
+			}
+			changes = append(changes, fmt.Sprintf("%s %s -> %s", change.Snap, old, new))
+		}
+		if cmp.Significant && cmp.Change > 0 {
+			fmt.Fprintf(w, "The regression is likely caused by the snap revisions which changed: %s\n", strings.Join(changes, ", "))
+		} else {
+			fmt.Fprintf(w, "Snap revisions changed: %s\n", strings.Join(changes, ", "))
+		}
+	}
+	displayMountChanges(w, "the previous measurement", cmp.MountsAdded, cmp.MountsRemoved)
+}
+
+// displayMountChanges shows the mounts of the mount namespace of the program
+// which were added and removed since the given point.
+func displayMountChanges(w io.Writer, since string, added, removed []string) {
+	if len(added) == 0 && len(removed) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "Mounts changed since %s:\n", since)
+	for _, m := range added {
+		fmt.Fprintln(w, "  +", m)
+	}
+	for _, m := range removed {
+		fmt.Fprintln(w, "  -", m)
+	}
+}
+
+// crashStderrLines is how many of the last lines the program wrote to stderr
+// are kept when it crashes
+const crashStderrLines = 20
+
+// collectCrash collects what is needed to debug the program crashing with the
+// signal during the run with the ID, which started at the given time. The
+// stderr log of the program had the size of the offset when the run started.
+func (x *cmdExec) collectCrash(sig syscall.Signal, start time.Time, runID string, stderrOffset int64) *crash.Crash {
+	c := crash.New(sig)
+	logError(fmt.Errorf("program crashed with %s", c.Signal))
+	if stderrLog := currentCmd.ProgramStderrLog; stderrLog != "" && stderrLog != os.DevNull {
+		lines, err := crash.Tail(stderrLog, stderrOffset, crashStderrLines)
+		if err != nil {
+			logError(fmt.Errorf("reading stderr of crashed program: %w", err))
+		}
+		c.Stderr = lines
+	}
+	if x.CrashDir != "" {
+		path := filepath.Join(x.CrashDir, "core-"+runID)
+		if err := crash.SaveCore(start, path); err != nil {
+			logError(err)
+		} else {
+			c.Core = path
+		}
+	}
+	return c
+}
+
+// CrossCheck compares the exec timings measured by etrace with those measured
+// by snap run --trace-exec
+type CrossCheck struct {
+	SnapTotalTime   time.Duration
+	EtraceTotalTime time.Duration
+	Execs           []CrossCheckExec
+	Discrepancies   []string `json:",omitempty"`
+}
+
+// structured returns the cross check as encoded since version 2 of the schema.
+func (c *CrossCheck) structured() interface{} {
+	type plain CrossCheck
+	v := struct {
+		plain
+		SnapTotalTime   schema.Duration
+		EtraceTotalTime schema.Duration
+		Execs           []interface{}
+	}{
+		plain:           plain(*c),
+		SnapTotalTime:   schema.NewDuration(c.SnapTotalTime),
+		EtraceTotalTime: schema.NewDuration(c.EtraceTotalTime),
+	}
+	if c.Execs != nil {
+		v.Execs = make([]interface{}, 0, len(c.Execs))
+		for _, e := range c.Execs {
+			v.Execs = append(v.Execs, e.structured())
+		}
+	}
+	return v
+}
+
+// CrossCheckExec is the time of one of the slowest exec calls reported by snap
+// run --trace-exec together with the time etrace measured for it, averaged
+// over all runs
+type CrossCheckExec struct {
+	Exe        string
+	SnapTime   time.Duration
+	EtraceTime time.Duration `json:",omitempty"`
+}
+
+// structured returns the exec as encoded since version 2 of the schema.
+func (e CrossCheckExec) structured() interface{} {
+	type plain CrossCheckExec
+	return struct {
+		plain
+		SnapTime   schema.Duration
+		EtraceTime *schema.Duration `json:",omitempty"`
+	}{plain(e), schema.NewDuration(e.SnapTime), schema.OptionalDuration(e.EtraceTime)}
+}
+
+// crossCheckMinDiff is the minimum absolute difference for a discrepancy, since
+// snap run --trace-exec only reports milliseconds, short execs would otherwise
+// always be flagged
+const crossCheckMinDiff = 10 * time.Millisecond
+
+func isDiscrepancy(d1, d2 time.Duration, tolerance float64) bool {
+	diff := d2 - d1
+	if diff < 0 {
+		diff = -diff
+	}
+	if diff < crossCheckMinDiff {
+		return false
+	}
+	// snap run --trace-exec reports execs shorter than a millisecond as 0,
+	// any difference above the minimum is then a discrepancy
+	if d1 == 0 {
+		return true
+	}
+	return 100*float64(diff)/float64(d1) > tolerance
+}
+
+// crossCheckDiff shows the difference between the timings as a percentage, or
+// as a duration when snap run --trace-exec reported 0.
+func crossCheckDiff(d1, d2 time.Duration) string {
+	if d1 == 0 {
+		return fmt.Sprintf("+%v", d2)
+	}
+	return percentDiffDuration(d1, d2)
+}
+
+// crossCheckTimings compares the report from snap run --trace-exec with the
+// timings etrace measured for all runs.
+func crossCheckTimings(report *snaps.TraceExecReport, runs []Execution, tolerance float64) *CrossCheck {
+	cc := &CrossCheck{SnapTotalTime: report.TotalTime}
+
+	traced := 0
+	for _, run := range runs {
+		if run.ExecveTiming != nil {
+			cc.EtraceTotalTime += run.ExecveTiming.TotalTime
+			traced++
+		}
+	}
+	if traced == 0 {
+		cc.Discrepancies = append(cc.Discrepancies, "no runs were traced by etrace")
+		return cc
+	}
+	cc.EtraceTotalTime /= time.Duration(traced)
+
+	for _, snapExec := range report.Execs {
+		ccExec := CrossCheckExec{Exe: snapExec.Exe, SnapTime: snapExec.Time}
+		// use the slowest exec of the same program in each run, since that is
+		// what snap run --trace-exec reports
+		seen := 0
+		for _, run := range runs {
+			if run.ExecveTiming == nil {
+				continue
+			}
+			slowest := time.Duration(-1)
+			for _, rt := range run.ExecveTiming.ExeRuntimes {
+				if rt.Exe == snapExec.Exe && rt.TotalSec > slowest {
+					slowest = rt.TotalSec
+				}
+			}
+			if slowest != -1 {
+				ccExec.EtraceTime += slowest
+				seen++
+			}
+		}
+		if seen == 0 {
+			cc.Discrepancies = append(cc.Discrepancies, fmt.Sprintf("%s was not seen by etrace", snapExec.Exe))
+		} else {
+			ccExec.EtraceTime /= time.Duration(seen)
+			if isDiscrepancy(ccExec.SnapTime, ccExec.EtraceTime, tolerance) {
+				cc.Discrepancies = append(cc.Discrepancies, fmt.Sprintf(
+					"%s took %v with snap run --trace-exec but %v with etrace (%s)",
+					snapExec.Exe,
+					ccExec.SnapTime,
+					ccExec.EtraceTime,
+					crossCheckDiff(ccExec.SnapTime, ccExec.EtraceTime),
+				))
+			}
+		}
+		cc.Execs = append(cc.Execs, ccExec)
+	}
+
+	if isDiscrepancy(cc.SnapTotalTime, cc.EtraceTotalTime, tolerance) {
+		cc.Discrepancies = append(cc.Discrepancies, fmt.Sprintf(
+			"total time was %v with snap run --trace-exec but %v with etrace (%s)",
+			cc.SnapTotalTime,
+			cc.EtraceTotalTime,
+			crossCheckDiff(cc.SnapTotalTime, cc.EtraceTotalTime),
+		))
+	}
+
+	return cc
+}
+
+// Display shows the cross-check results
+func (cc *CrossCheck) Display(w *tabwriter.Writer) {
+	fmt.Fprintf(w, "Cross-check with snap run --trace-exec:\n")
+	fmt.Fprintf(w, "\tExec\tsnap run --trace-exec\tetrace\n")
+	for _, e := range cc.Execs {
+		etraceTime := "-"
+		if e.EtraceTime != 0 {
+			etraceTime = e.EtraceTime.String()
+		}
+		fmt.Fprintf(w, "\t%s\t%v\t%s\n", e.Exe, e.SnapTime, etraceTime)
+	}
+	fmt.Fprintf(w, "\tTotal time\t%v\t%v\n", cc.SnapTotalTime, cc.EtraceTotalTime)
+	w.Flush()
+	for _, d := range cc.Discrepancies {
+		fmt.Fprintf(w, "Discrepancy: %s\n", d)
+	}
+	w.Flush()
+}
+
+// runSnapTraceExec runs the snap once with snap run --trace-exec the same way
+// etrace runs it and returns the report from snapd.
+func (x *cmdExec) runSnapTraceExec(windowWaitTimeout time.Duration) (*snaps.TraceExecReport, error) {
+	cmd := exec.Command("snap", append([]string{"run", "--trace-exec"}, x.Args.Cmd...)...)
+	// the report is written to stderr together with any output from the snap
+	var stderr bytes.Buffer
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = ioutil.Discard
+	cmd.Stderr = &stderr
+
+	if currentCmd.DiscardSnapNs {
+		if err := snaps.DiscardSnapNs(x.Args.Cmd[0]); err != nil {
+			return nil, err
+		}
+	}
+	if !currentCmd.KeepVMCaches {
+		if err := profiling.FreeCaches(); err != nil {
+			return nil, err
+		}
+	}
+
+	xtool := windowTool()
+	windowspec := x.windowSpec()
+	var existingWids []string
+	if !currentCmd.NoWindowWait {
+		var err error
+		existingWids, err = xtool.VisibleWindowIDs()
+		if err != nil {
+			logError(fmt.Errorf("listing existing windows: %w", err))
+		}
+		if currentCmd.WindowNewOnly {
+			windowspec.Exclude = existingWids
+		}
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	if !currentCmd.NoWindowWait {
+		ctx, cancel := context.WithTimeout(context.Background(), windowWaitTimeout)
+		defer cancel()
+		wids, ignored, err := xdotool.WaitForProgramWindow(ctx, xtool, windowspec, existingWids)
+		if ignored {
+			log.Println(ignoredWindowsWarning)
+		}
+		if err != nil {
+			if err := cmd.Process.Kill(); err != nil {
+				logError(err)
+			}
+			return nil, err
+		}
+		closeWindows(xtool, wids)
+	}
+
+	// the snap being killed when closing the window is expected, the report
+	// is still written
+	if err := cmd.Wait(); err != nil {
+		logError(fmt.Errorf("waiting for snap run --trace-exec: %w", err))
+	}
+
+	return snaps.ParseTraceExecReport(stderr.Bytes())
+}
+
+// newMarkListener creates a phase mark listener with the fifo in a directory
+// that the program will be able to write to.
+func newMarkListener(snapName string) (*marks.Listener, error) {
+	dir := os.TempDir()
+	// snaps have a private /tmp, so use the snap's private runtime dir which
+	// is visible both inside and outside of the snap's mount namespace
+	if runtimeDir := os.Getenv("XDG_RUNTIME_DIR"); currentCmd.RunThroughSnap && runtimeDir != "" {
+		dir = filepath.Join(runtimeDir, "snap."+snapName)
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+	}
+	markTmp, err := ioutil.TempDir(dir, "etrace-marks")
+	if err != nil {
+		return nil, err
+	}
+	l, err := marks.NewListener(markTmp)
+	if err != nil {
+		os.RemoveAll(markTmp)
+		return nil, err
+	}
+	return l, nil
+}
+
+// windowTimes returns when each of the new windows appeared relative to the
+// start, marking the main windows with the given IDs. The main windows appeared
+// at the latest at startup, when they were found.
+func windowTimes(appeared []xdotool.WindowAppearance, mainWids []string, start time.Time, startup time.Duration) []WindowTime {
+	main := make(map[string]bool, len(mainWids))
+	for _, wid := range mainWids {
+		main[wid] = true
+	}
+	var windows []WindowTime
+	for _, a := range appeared {
+		t := a.Time.Sub(start)
+		if t > startup && len(mainWids) != 0 {
+			if !main[a.ID] {
+				// noticed after the main window appeared
+				continue
+			}
+			t = startup
+		}
+		windows = append(windows, WindowTime{ID: a.ID, Time: t, Main: main[a.ID]})
+		delete(main, a.ID)
+	}
+	// the main windows the watcher didn't notice before it was stopped
+	for _, wid := range mainWids {
+		if main[wid] {
+			windows = append(windows, WindowTime{ID: wid, Time: startup, Main: true})
+		}
+	}
+	sort.SliceStable(windows, func(i, j int) bool {
+		return windows[i].Time < windows[j].Time
+	})
+	return windows
+}
+
+// ignoredWindowsWarning is shown when the only windows matching the window
+// specification were open before the program was started
+const ignoredWindowsWarning = "warning: ignoring the windows matching the window specification which were open before the program was started, waiting for a new one (see --window-new-only)"
+
+// truncatedTraceWarning is shown when the trace of a snap stopped in
+// snap-confine while tracing as the current user
+const truncatedTraceWarning = "warning: the trace stopped in snap-confine before the app ran, strace can't follow its setuid transition as the current user on some kernels, trace as root with --privileged or use --on-truncated-trace=privileged"
+
+// straceOptions returns what strace traces besides the execve syscalls.
+func (x *cmdExec) straceOptions() strace.ExecOptions {
+	return strace.ExecOptions{
+		Forks:    !x.Flat,
+		Waits:    x.BlockedTime,
+		Connects: x.DisplayConnect,
+	}
+}
+
+// windowSpec returns the specification of the window to wait for.
+func (x *cmdExec) windowSpec() xdotool.Window {
+	// the window must match all the attributes specified with options
+	windowspec := xdotool.Window{
+		Class:     currentCmd.WindowClass,
+		Name:      currentCmd.WindowName,
+		ClassName: currentCmd.WindowClassName,
+	}
+	if windowspec.Class == "" && windowspec.Name == "" && windowspec.ClassName == "" {
+		// otherwise fall back to base cmd as the class or classname
+		if currentCmd.RunThroughFlatpak {
+			// for flatpak apps, we can use the name of the app (i.e.
+			// org.gabmus.whatip) as the classname consistently
+			windowspec.ClassName = x.Args.Cmd[0]
+		} else {
+			// note we use the original command and note the processed targetCmd
+			// because for example when measuring a snap, we invoke etrace like
+			// so:
+			// $ ./etrace run --use-snap chromium
+			// where targetCmd becomes []string{"snap","run","chromium"}
+			// but we still want to use "chromium" as the windowspec class
+			windowspec.Class = filepath.Base(x.Args.Cmd[0])
+		}
+	}
+	windowspec.ActiveWorkspace = currentCmd.WindowActiveWorkspace
+	return windowspec
+}
+
+// cgroupExitTimeout is how long to wait for all the processes in the cgroup of
+// a run to exit after the leftovers were killed
+var cgroupExitTimeout = 5 * time.Second
+
+// daemonizedPollInterval is how often to check if the processes forked into
+// the background exited with --wait-daemonized
+var daemonizedPollInterval = 50 * time.Millisecond
+
+// rendererWaitTimeout is how long the first renderer of an Electron or Chromium
+// app has to be live once its window appeared, or once it exited with
+// --no-window-wait
+var rendererWaitTimeout = 5 * time.Second
+
+// readMountNamespace returns the mounts of the mount namespace of the program
+// of the run, or nil if they cannot be read.
+func readMountNamespace(runProcs *runner.Run) []string {
+	procs, err := runProcs.Processes()
+	if err != nil {
+		logError(fmt.Errorf("finding the processes of the run: %w", err))
+		return nil
+	}
+	pids := make([]int, 0, len(procs))
+	for _, proc := range procs {
+		pids = append(pids, proc.Pid)
+	}
+	pid, err := mountns.Find(pids)
+	if err != nil {
+		logError(fmt.Errorf("finding the mount namespace of the program: %w", err))
+		return nil
+	}
+	mounts, err := mountns.Read(pid)
+	if err != nil {
+		logError(fmt.Errorf("reading the mount namespace of the program: %w", err))
+		return nil
+	}
+	return mounts
+}
+
+// probeInput activates the window and presses Shift, and returns when the main
+// thread of the process owning it handled the key press.
+func probeInput(ctx context.Context, xtool xdotool.Xtooler, pid int, wid string) (time.Time, error) {
+	// the key press goes to the focused window
+	if err := xtool.ActivateWindowID(wid); err != nil {
+		return time.Time{}, err
+	}
+	handled, err := proctree.ProbeInput(ctx, pid, func() error {
+		return xdotool.PressShift(inputTool())
+	})
+	if err != nil {
+		return time.Time{}, fmt.Errorf("key press was not handled: %w", err)
+	}
+	return handled, nil
+}
+
+// readyMark is the phase mark which ends the wait for processes forked into the
+// background with --wait-daemonized
+const readyMark = "ready"
+
+// waitDaemonized waits for the command and then for all the processes of the
+// run to exit, which includes the ones the command forked into the background,
+// or for the program to write the ready mark. It returns when that happened and
+// the names of the processes which were still running when the command exited.
+func waitDaemonized(ctx context.Context, cmd *exec.Cmd, runProcs *runner.Run, markListener *marks.Listener) (time.Time, []string, error) {
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+	cmdDone := false
+	var daemonized []string
+	for {
+		if markListener != nil {
+			if mark, ok := markListener.Find(readyMark); ok {
+				return mark.Time, daemonized, nil
+			}
+		}
+		if !cmdDone {
+			select {
+			case err := <-exited:
+				cmdDone = true
+				if err != nil && ctx.Err() == nil {
+					logError(fmt.Errorf("waiting for command: %w", err))
+				}
+			default:
+			}
+		}
+		if cmdDone {
+			procs, err := runProcs.Processes()
+			if err != nil {
+				return time.Time{}, daemonized, err
+			}
+			if len(procs) == 0 {
+				return time.Now(), daemonized, nil
+			}
+			if daemonized == nil {
+				seen := make(map[string]bool)
+				for _, proc := range procs {
+					if !seen[proc.Comm] {
+						seen[proc.Comm] = true
+						daemonized = append(daemonized, proc.Comm)
+					}
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return time.Time{}, daemonized, ctx.Err()
+		case <-time.After(daemonizedPollInterval):
+		}
+	}
+}
+
+// runCleanup is what to release once a run is over, which deferring would
+// only release once all the runs are over.
+type runCleanup []func()
+
+func (c *runCleanup) add(f func()) {
+	*c = append(*c, f)
+}
+
+// release releases what was added, in the reverse order like deferred calls.
+func (c *runCleanup) release() {
+	for i := len(*c) - 1; i >= 0; i-- {
+		(*c)[i]()
+	}
+	*c = nil
+}
+
+// waitExit waits for the program to exit by itself, until done is closed, for
+// up to timeout. The program is left running if it didn't, for its windows to
+// be closed and its processes killed like when it isn't waited for.
+func waitExit(ctx context.Context, done <-chan struct{}, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// killLeftovers kills the processes of the run which are still running after
+// the grace period, except for the command with the given pid, and logs the
+// ones it killed.
+func killLeftovers(runProcs *runner.Run, main int, done <-chan struct{}) {
+	leftovers, err := runProcs.KillLeftovers(main, done)
+	if err != nil {
+		logError(err)
+	}
+	if len(leftovers) == 0 {
+		return
+	}
+	names := make([]string, 0, len(leftovers))
+	for _, proc := range leftovers {
+		names = append(names, fmt.Sprintf("%s (%d)", proc.Comm, proc.Pid))
+	}
+	logError(fmt.Errorf("killed processes left over from the run: %s", strings.Join(names, ", ")))
+}
+
+// primePaths returns the files to read into the page cache before each run,
+// the squashfs of the snap when running it through snap run followed by the
+// given files. The snap is looked up for each run as it may be refreshed.
+func (x *cmdExec) primePaths(files []string) []string {
+	var paths []string
+	if currentCmd.RunThroughSnap {
+		snapName := x.Args.Cmd[0]
+		rev, err := snaps.Revision(snapName)
+		if err != nil {
+			logError(fmt.Errorf("cannot find the revision of snap %s to prime the page cache: %w", snapName, err))
+		} else {
+			paths = append(paths, filepath.Join("/var/lib/snapd/snaps", fmt.Sprintf("%s_%s.snap", snapName, rev)))
+		}
+	}
+	return append(paths, files...)
+}
+
+// closeWindows closes the windows and kills the processes that own them.
+func closeWindows(xtool xdotool.Xtooler, wids []string) {
+	if err := runner.CloseWindows(xtool, wids); err != nil {
+		logError(err)
+	}
 }
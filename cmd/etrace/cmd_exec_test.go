@@ -0,0 +1,594 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/anonymouse64/etrace/analysis"
+	main "github.com/anonymouse64/etrace/cmd/etrace"
+	"github.com/anonymouse64/etrace/internal/marks"
+	"github.com/anonymouse64/etrace/internal/runner"
+	"github.com/anonymouse64/etrace/internal/snaps"
+	"github.com/anonymouse64/etrace/internal/strace"
+	"github.com/anonymouse64/etrace/internal/thermal"
+	"github.com/anonymouse64/etrace/internal/xdotool"
+
+	. "gopkg.in/check.v1"
+)
+
+type execTestSuite struct{}
+
+var _ = Suite(&execTestSuite{})
+
+func (p *execTestSuite) TestCrossCheckTimings(c *C) {
+	report := &snaps.TraceExecReport{
+		Execs: []snaps.TraceExecTiming{
+			{Exe: "snap-update-ns", Time: 100 * time.Millisecond},
+			{Exe: "/snap/app/x1/bin/app", Time: 1 * time.Second},
+			{Exe: "/usr/bin/true", Time: 1 * time.Millisecond},
+			{Exe: "/usr/bin/missing", Time: 50 * time.Millisecond},
+		},
+		TotalTime: 1200 * time.Millisecond,
+	}
+	runs := []main.Execution{
+		{
+			ExecveTiming: &strace.ExecveTiming{
+				TotalTime: 1100 * time.Millisecond,
+				ExeRuntimes: []strace.ExeRuntime{
+					{Exe: "snap-update-ns", TotalSec: 90 * time.Millisecond},
+					{Exe: "snap-update-ns", TotalSec: 5 * time.Millisecond},
+					{Exe: "/snap/app/x1/bin/app", TotalSec: 2 * time.Second},
+					{Exe: "/usr/bin/true", TotalSec: 4 * time.Millisecond},
+				},
+			},
+		},
+		{
+			ExecveTiming: &strace.ExecveTiming{
+				TotalTime: 1300 * time.Millisecond,
+				ExeRuntimes: []strace.ExeRuntime{
+					{Exe: "snap-update-ns", TotalSec: 110 * time.Millisecond},
+					{Exe: "/snap/app/x1/bin/app", TotalSec: 2 * time.Second},
+				},
+			},
+		},
+		// untraced runs are ignored
+		{},
+	}
+
+	cc := main.CrossCheckTimings(report, runs, 25)
+	c.Assert(cc.SnapTotalTime, Equals, 1200*time.Millisecond)
+	c.Assert(cc.EtraceTotalTime, Equals, 1200*time.Millisecond)
+	c.Assert(cc.Execs, DeepEquals, []main.CrossCheckExec{
+		{Exe: "snap-update-ns", SnapTime: 100 * time.Millisecond, EtraceTime: 100 * time.Millisecond},
+		{Exe: "/snap/app/x1/bin/app", SnapTime: 1 * time.Second, EtraceTime: 2 * time.Second},
+		{Exe: "/usr/bin/true", SnapTime: 1 * time.Millisecond, EtraceTime: 4 * time.Millisecond},
+		{Exe: "/usr/bin/missing", SnapTime: 50 * time.Millisecond},
+	})
+	c.Assert(cc.Discrepancies, DeepEquals, []string{
+		"/snap/app/x1/bin/app took 1s with snap run --trace-exec but 2s with etrace (+100.00%)",
+		"/usr/bin/missing was not seen by etrace",
+	})
+}
+
+func (p *execTestSuite) TestCrossCheckTimingsZeroSnapTime(c *C) {
+	report := &snaps.TraceExecReport{
+		Execs: []snaps.TraceExecTiming{
+			{Exe: "/usr/bin/fast", Time: 0},
+			{Exe: "/usr/bin/slow", Time: 0},
+		},
+	}
+	runs := []main.Execution{{
+		ExecveTiming: &strace.ExecveTiming{
+			TotalTime: 30 * time.Millisecond,
+			ExeRuntimes: []strace.ExeRuntime{
+				{Exe: "/usr/bin/fast", TotalSec: 2 * time.Millisecond},
+				{Exe: "/usr/bin/slow", TotalSec: 20 * time.Millisecond},
+			},
+		},
+	}}
+
+	cc := main.CrossCheckTimings(report, runs, 25)
+	c.Assert(cc.Discrepancies, DeepEquals, []string{
+		"/usr/bin/slow took 0s with snap run --trace-exec but 20ms with etrace (+20ms)",
+		"total time was 0s with snap run --trace-exec but 30ms with etrace (+30ms)",
+	})
+}
+
+func (p *execTestSuite) TestCrossCheckTimingsNoTracedRuns(c *C) {
+	report := &snaps.TraceExecReport{TotalTime: time.Second}
+	cc := main.CrossCheckTimings(report, []main.Execution{{}}, 25)
+	c.Assert(cc.Discrepancies, DeepEquals, []string{"no runs were traced by etrace"})
+}
+
+func (p *execTestSuite) TestWindowTimes(c *C) {
+	start := time.Now()
+	appeared := []xdotool.WindowAppearance{
+		{ID: "1", Time: start.Add(100 * time.Millisecond)},
+		{ID: "2", Time: start.Add(300 * time.Millisecond)},
+		// noticed after the main window was found
+		{ID: "3", Time: start.Add(600 * time.Millisecond)},
+		{ID: "4", Time: start.Add(700 * time.Millisecond)},
+	}
+	windows := main.WindowTimes(appeared, []string{"2", "4", "5"}, start, 500*time.Millisecond)
+	c.Assert(windows, DeepEquals, []main.WindowTime{
+		{ID: "1", Time: 100 * time.Millisecond},
+		{ID: "2", Time: 300 * time.Millisecond, Main: true},
+		{ID: "4", Time: 500 * time.Millisecond, Main: true},
+		{ID: "5", Time: 500 * time.Millisecond, Main: true},
+	})
+
+	// without a main window all the new windows are kept
+	windows = main.WindowTimes(appeared[:3], nil, start, time.Second)
+	c.Assert(windows, DeepEquals, []main.WindowTime{
+		{ID: "1", Time: 100 * time.Millisecond},
+		{ID: "2", Time: 300 * time.Millisecond},
+		{ID: "3", Time: 600 * time.Millisecond},
+	})
+}
+
+func (p *execTestSuite) TestWaitDaemonized(c *C) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// the shell exits right away, leaving sleep in the background
+	cmd := exec.Command("sh", "-c", "sleep 0.3 & exit 0")
+	cmd.Env = append(os.Environ(), "ETRACE_RUN=test-daemon")
+	start := time.Now()
+	c.Assert(cmd.Start(), IsNil)
+	end, daemonized, err := main.WaitDaemonized(ctx, cmd, &runner.Run{ID: "test-daemon"}, nil)
+	c.Assert(err, IsNil)
+	c.Check(end.Sub(start) >= 300*time.Millisecond, Equals, true)
+	c.Check(daemonized, DeepEquals, []string{"sleep"})
+}
+
+func (p *execTestSuite) TestWaitDaemonizedReady(c *C) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	l, err := marks.NewListener(c.MkDir())
+	c.Assert(err, IsNil)
+	start := time.Now()
+	l.Start(start)
+	defer l.Stop()
+
+	// the daemon would run much longer, but it reports it's ready
+	cmd := exec.Command("sh", "-c", `sleep 10 & echo ready > "$ETRACE_MARK"`)
+	cmd.Env = append(os.Environ(), "ETRACE_RUN=test-ready", l.Env())
+	c.Assert(cmd.Start(), IsNil)
+	run := &runner.Run{ID: "test-ready"}
+	defer run.Kill()
+	end, _, err := main.WaitDaemonized(ctx, cmd, run, l)
+	c.Assert(err, IsNil)
+	mark, ok := l.Find("ready")
+	c.Assert(ok, Equals, true)
+	c.Check(end, Equals, mark.Time)
+	c.Check(end.Sub(start) < 5*time.Second, Equals, true)
+}
+
+func (p *execTestSuite) TestWaitExit(c *C) {
+	cmd := exec.Command("sleep", "0.1")
+	c.Assert(cmd.Start(), IsNil)
+	done := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(done)
+	}()
+	c.Check(main.WaitExit(context.Background(), done, 10*time.Second), IsNil)
+}
+
+func (p *execTestSuite) TestWaitExitTimeout(c *C) {
+	// the program keeps running past the timeout
+	cmd := exec.Command("sh", "-c", "sleep 10; exit 0")
+	cmd.Env = append(os.Environ(), "ETRACE_RUN=test-run-to-exit")
+	c.Assert(cmd.Start(), IsNil)
+	done := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(done)
+	}()
+	start := time.Now()
+	err := main.WaitExit(context.Background(), done, 100*time.Millisecond)
+	c.Check(err, Equals, context.DeadlineExceeded)
+	c.Check(time.Since(start) < 5*time.Second, Equals, true)
+
+	// and is killed with what it started like when it isn't waited for
+	run := &runner.Run{ID: "test-run-to-exit", ExitTimeout: 100 * time.Millisecond}
+	main.KillLeftovers(run, cmd.Process.Pid, done)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		c.Fatal("program not killed")
+	}
+	procs, err := run.Processes()
+	c.Assert(err, IsNil)
+	c.Check(procs, HasLen, 0)
+}
+
+func (p *execTestSuite) TestWaitExitAborted(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c.Check(main.WaitExit(ctx, make(chan struct{}), 10*time.Second), Equals, context.Canceled)
+}
+
+func (p *execTestSuite) TestApplyProfile(c *C) {
+	opts, err := main.ApplyProfile(main.ProfileOptions{Profile: "cold"})
+	c.Assert(err, IsNil)
+	c.Check(opts, DeepEquals, main.ProfileOptions{
+		Profile:           "cold",
+		Repeat:            10,
+		CleanSnapUserData: true,
+		ReinstallSnap:     true,
+		DiscardSnapNs:     true,
+	})
+
+	opts, err = main.ApplyProfile(main.ProfileOptions{Profile: "first-run", Repeat: 2})
+	c.Assert(err, IsNil)
+	c.Check(opts, DeepEquals, main.ProfileOptions{
+		Profile:           "first-run",
+		Repeat:            2,
+		CleanSnapUserData: true,
+		ReinstallSnap:     true,
+		FreshHome:         true,
+		FontCache:         "delete",
+		DiscardSnapNs:     true,
+	})
+
+	// snaps can't be given another home, they start without their user data
+	opts, err = main.ApplyProfile(main.ProfileOptions{Profile: "first-run", RunThroughSnap: true})
+	c.Assert(err, IsNil)
+	c.Check(opts.FreshHome, Equals, false)
+	c.Check(opts.CleanSnapUserData, Equals, true)
+
+	// the limits can be changed
+	opts, err = main.ApplyProfile(main.ProfileOptions{Profile: "low-end", CPULimit: 0.5})
+	c.Assert(err, IsNil)
+	c.Check(opts.Cgroup, Equals, true)
+	c.Check(opts.CPULimit, Equals, 0.5)
+	c.Check(opts.MemoryLimit, Equals, uint(2048))
+
+	// --hot keeps doing a single measured run, after a discarded one
+	opts, err = main.ApplyProfile(main.ProfileOptions{Hot: true})
+	c.Assert(err, IsNil)
+	c.Check(opts, DeepEquals, main.ProfileOptions{
+		Profile:      "hot",
+		Hot:          true,
+		PrimeCache:   true,
+		Warmup:       true,
+		KeepVMCaches: true,
+	})
+
+	opts, err = main.ApplyProfile(main.ProfileOptions{})
+	c.Assert(err, IsNil)
+	c.Check(opts, DeepEquals, main.ProfileOptions{})
+
+	_, err = main.ApplyProfile(main.ProfileOptions{Profile: "hot", Cold: true})
+	c.Check(err, ErrorMatches, "cannot use --cold with --profile=hot")
+
+	// the device profile caps the runs of the profile, but not --repeat
+	opts, err = main.ApplyProfile(main.ProfileOptions{Profile: "cold", MaxRepeat: 3})
+	c.Assert(err, IsNil)
+	c.Check(opts.Repeat, Equals, uint(3))
+	opts, err = main.ApplyProfile(main.ProfileOptions{Profile: "cold", Repeat: 8, MaxRepeat: 3})
+	c.Assert(err, IsNil)
+	c.Check(opts.Repeat, Equals, uint(8))
+}
+
+func (p *execTestSuite) TestApplyDevice(c *C) {
+	model := filepath.Join(c.MkDir(), "model")
+	c.Assert(ioutil.WriteFile(model, []byte("Raspberry Pi 4 Model B Rev 1.4\x00"), 0644), IsNil)
+	restore := main.MockDeviceTreeModel(model)
+	defer restore()
+
+	device, timeout, coolDown := main.ApplyDevice("auto", "60s", 0)
+	c.Check(device, Equals, "raspberry-pi")
+	c.Check(timeout, Equals, "5m0s")
+	c.Check(coolDown, Equals, 60.0)
+
+	// options which were specified are kept
+	device, timeout, coolDown = main.ApplyDevice("arm", "2m", 70)
+	c.Check(device, Equals, "arm")
+	c.Check(timeout, Equals, "2m")
+	c.Check(coolDown, Equals, 70.0)
+
+	device, timeout, coolDown = main.ApplyDevice("desktop", "60s", 0)
+	c.Check(device, Equals, "desktop")
+	c.Check(timeout, Equals, "60s")
+	c.Check(coolDown, Equals, 0.0)
+}
+
+func (p *execTestSuite) TestExecOutputResultTable(c *C) {
+	res := main.ExecOutputResult{
+		Profile: "cold",
+		Runs: []main.Execution{
+			{TimeToDisplay: 1500 * time.Millisecond, NamespaceSetupTime: 100 * time.Millisecond},
+			{TimeToRun: 2 * time.Second, Errors: []string{"one", "two"}},
+		},
+	}
+	table := res.Table()
+	c.Check(table.Name, Equals, "runs")
+	c.Check(table.Columns, DeepEquals, []string{
+		"run",
+		"profile",
+		"time_to_display",
+		"time_to_run",
+		"normalized_time_to_display",
+		"namespace_setup_time",
+		"font_cache_time",
+		"errors",
+	})
+	c.Check(table.Rows, DeepEquals, [][]interface{}{
+		{1, "cold", 1.5, 0.0, 0.0, 0.1, 0.0, ""},
+		{2, "cold", 0.0, 2.0, 0.0, 0.0, 0.0, "one; two"},
+	})
+}
+
+func (p *execTestSuite) TestExecOutputResultExecsTable(c *C) {
+	start := time.Unix(1542815326, 0)
+	res := main.WithTable(main.ExecOutputResult{
+		Runs: []main.Execution{
+			{
+				ExecveTiming: &strace.ExecveTiming{ExeRuntimes: []strace.ExeRuntime{
+					{Start: start, Exe: "/usr/bin/launcher", TotalSec: 100 * time.Millisecond, Pid: 100},
+					{Start: start.Add(100 * time.Millisecond), Exe: "/usr/bin/app", TotalSec: 900 * time.Millisecond, Pid: 100},
+				}},
+			},
+			// runs without tracing have no programs
+			{TimeToRun: time.Second},
+			{
+				ExecveTiming: &strace.ExecveTiming{ExeRuntimes: []strace.ExeRuntime{
+					{Start: start.Add(time.Minute), Exe: "/usr/bin/launcher", TotalSec: 250 * time.Millisecond, Pid: 200},
+				}},
+			},
+		},
+	}, "execs")
+	table := res.Table()
+	c.Check(table.Name, Equals, "execs")
+	c.Check(table.Columns, DeepEquals, []string{"run", "pid", "start", "stop", "elapsed", "exe"})
+	c.Check(table.Rows, DeepEquals, [][]interface{}{
+		{1, 100, 0.0, 0.1, 0.1, "/usr/bin/launcher"},
+		{1, 100, 0.1, 1.0, 0.9, "/usr/bin/app"},
+		{3, 200, 0.0, 0.25, 0.25, "/usr/bin/launcher"},
+	})
+}
+
+func (p *execTestSuite) TestExecOutputResultTraceEvents(c *C) {
+	start := time.Unix(1542815326, 0)
+	res := main.ExecOutputResult{
+		Runs: []main.Execution{
+			{
+				ExecveTiming: &strace.ExecveTiming{ExeRuntimes: []strace.ExeRuntime{
+					{Start: start.Add(100 * time.Millisecond), Exe: "/usr/bin/app", TotalSec: 900 * time.Millisecond, Pid: 100},
+					{Start: start, Exe: "/usr/bin/launcher", TotalSec: 100 * time.Millisecond, Pid: 100},
+				}},
+				Milestones: []main.Milestone{{Name: "main-window", Time: 500 * time.Millisecond}},
+			},
+			// runs without tracing only have their milestones
+			{Milestones: []main.Milestone{{Name: "main-window", Time: 600 * time.Millisecond}}},
+		},
+	}
+	var buf bytes.Buffer
+	c.Assert(res.WriteTraceEvents(&buf), IsNil)
+
+	var trace struct {
+		TraceEvents []map[string]interface{} `json:"traceEvents"`
+	}
+	c.Assert(json.Unmarshal(buf.Bytes(), &trace), IsNil)
+	c.Check(trace.TraceEvents, DeepEquals, []map[string]interface{}{
+		{"name": "process_name", "ph": "M", "ts": 0.0, "pid": 1.0, "tid": 0.0, "args": map[string]interface{}{"name": "Programs (run 1)"}},
+		{"name": "thread_name", "ph": "M", "ts": 0.0, "pid": 1.0, "tid": 100.0, "args": map[string]interface{}{"name": "app"}},
+		{"name": "process_name", "ph": "M", "ts": 0.0, "pid": 3.0, "tid": 0.0, "args": map[string]interface{}{"name": "Programs (run 2)"}},
+		{"name": "launcher", "ph": "X", "ts": 0.0, "dur": 1e5, "pid": 1.0, "tid": 100.0, "args": map[string]interface{}{"exe": "/usr/bin/launcher"}},
+		{"name": "app", "ph": "X", "ts": 1e5, "dur": 9e5, "pid": 1.0, "tid": 100.0, "args": map[string]interface{}{"exe": "/usr/bin/app"}},
+		{"name": "main-window", "ph": "i", "ts": 5e5, "pid": 1.0, "tid": 0.0, "s": "g"},
+		{"name": "main-window", "ph": "i", "ts": 6e5, "pid": 3.0, "tid": 0.0, "s": "g"},
+	})
+}
+
+func (p *execTestSuite) TestExecOutputResultFoldedStacks(c *C) {
+	start := time.Unix(1542815326, 0)
+	run := func(app time.Duration) main.Execution {
+		return main.Execution{ExecveTiming: &strace.ExecveTiming{ExeRuntimes: []strace.ExeRuntime{
+			{Start: start, Exe: "/usr/lib/snapd/snap-confine", TotalSec: 100 * time.Millisecond, Pid: 100},
+			{Start: start.Add(100 * time.Millisecond), Exe: "/usr/lib/snapd/snap-exec", TotalSec: 50 * time.Millisecond, Pid: 100},
+			{Start: start.Add(150 * time.Millisecond), Exe: "/snap/app/1/bin/app", TotalSec: app, Pid: 100},
+		}}}
+	}
+	res := main.ExecOutputResult{
+		Runs: []main.Execution{
+			run(800 * time.Millisecond),
+			run(1200 * time.Millisecond),
+			// runs without tracing are not part of the mean
+			{TimeToRun: time.Second},
+		},
+	}
+	var buf bytes.Buffer
+	c.Assert(res.WriteFoldedStacks(&buf), IsNil)
+	c.Check(buf.String(), Equals, `snap-confine 100000
+snap-confine;snap-exec 50000
+snap-confine;snap-exec;app 1000000
+`)
+
+	buf.Reset()
+	c.Assert(main.ExecOutputResult{}.WriteFoldedStacks(&buf), IsNil)
+	c.Check(buf.String(), Equals, "")
+}
+
+func (p *execTestSuite) TestRunRecordJSON(c *C) {
+	record := main.RunRecord{
+		SchemaVersion: 2,
+		Run:           3,
+		Execution:     main.Execution{TimeToDisplay: 1500 * time.Millisecond},
+	}
+	out, err := json.Marshal(record)
+	c.Assert(err, IsNil)
+	c.Check(string(out), Equals, `{"SchemaVersion":2,"Run":3,"TimeToDisplay":{"ns":1500000000,"text":"1.5s"}}`)
+
+	record.SchemaVersion = 0
+	out, err = json.Marshal(record)
+	c.Assert(err, IsNil)
+	c.Check(string(out), Equals, `{"Run":3,"TimeToDisplay":1500000000}`)
+}
+
+func (p *execTestSuite) TestExecOutputResultJSON(c *C) {
+	start := time.Date(2021, 7, 26, 10, 0, 0, 0, time.UTC)
+	res := main.ExecOutputResult{
+		SchemaVersion: 2,
+		Runs: []main.Execution{{
+			ExecveTiming: &strace.ExecveTiming{
+				TotalTime:   2 * time.Second,
+				ExeRuntimes: []strace.ExeRuntime{{Start: start, Exe: "app", TotalSec: time.Second, Blocked: time.Millisecond}},
+			},
+			TimeToDisplay: 1500 * time.Millisecond,
+			Milestones:    []main.Milestone{{Name: "window", Time: time.Second}},
+		}},
+		Dispersion: &main.Dispersion{
+			Stats:         analysis.Stats{N: 1, Mean: time.Second},
+			LowConfidence: true,
+		},
+	}
+	out, err := json.Marshal(res)
+	c.Assert(err, IsNil)
+	c.Check(string(out), Equals, `{"SchemaVersion":2,"Runs":[{"ExecveTiming":{"TotalTime":{"ns":2000000000,"text":"2s"},"ExeRuntimes":[{"Start":"2021-07-26T10:00:00Z","Exe":"app","TotalSec":{"ns":1000000000,"text":"1s"},"Blocked":{"ns":1000000,"text":"1ms"}}]},"TimeToDisplay":{"ns":1500000000,"text":"1.5s"},"Milestones":[{"Name":"window","Time":{"ns":1000000000,"text":"1s"}}]}],"Dispersion":{"N":1,"Mean":{"ns":1000000000,"text":"1s"},"StdDev":{"ns":0,"text":"0s"},"Median":{"ns":0,"text":"0s"},"Min":{"ns":0,"text":"0s"},"Max":{"ns":0,"text":"0s"},"Variation":0,"LowConfidence":true}}`)
+
+	res.SchemaVersion = 1
+	out, err = json.Marshal(res)
+	c.Assert(err, IsNil)
+	c.Check(string(out), Equals, `{"SchemaVersion":1,"Runs":[{"ExecveTiming":{"TotalTime":2000000000,"ExeRuntimes":[{"Start":"2021-07-26T10:00:00Z","Exe":"app","TotalSec":1000000000,"Blocked":1000000}]},"TimeToDisplay":1500000000,"Milestones":[{"Name":"window","Time":1000000000}]}],"Dispersion":{"N":1,"Mean":1000000000,"StdDev":0,"Median":0,"Min":0,"Max":0,"Variation":0,"LowConfidence":true}}`)
+}
+
+func (p *execTestSuite) TestCompareWithPrevious(c *C) {
+	old := os.Getenv("XDG_STATE_HOME")
+	defer os.Setenv("XDG_STATE_HOME", old)
+	os.Setenv("XDG_STATE_HOME", c.MkDir())
+
+	first := []main.Execution{
+		{TimeToDisplay: 2 * time.Second},
+		{TimeToDisplay: 2100 * time.Millisecond},
+		// runs with errors are not kept
+		{TimeToDisplay: 10 * time.Second, Errors: []string{"boom"}},
+	}
+	cmp, err := main.CompareWithPrevious([]string{"gedit"}, first, "cold", []string{"/ squashfs /dev/loop /", "/usr/share/fonts squashfs /dev/loop /fonts"}, map[string]string{"gedit": "12", "core20": "1405"}, 10)
+	c.Assert(err, IsNil)
+	c.Check(cmp, IsNil)
+
+	second := []main.Execution{
+		{TimeToDisplay: 1 * time.Second},
+		{TimeToDisplay: 1100 * time.Millisecond},
+	}
+	cmp, err = main.CompareWithPrevious([]string{"gedit"}, second, "cold", []string{"/ squashfs /dev/loop /", "/usr/share/icons squashfs /dev/loop /icons"}, map[string]string{"gedit": "12", "core20": "1601"}, 10)
+	c.Assert(err, IsNil)
+	c.Assert(cmp, NotNil)
+	c.Check(cmp.Base.Mean, Equals, 2050*time.Millisecond)
+	c.Check(cmp.New.Mean, Equals, 1050*time.Millisecond)
+	c.Check(cmp.Significant, Equals, true)
+	c.Check(cmp.Measured.IsZero(), Equals, false)
+	c.Check(cmp.MountsAdded, DeepEquals, []string{"/usr/share/icons squashfs /dev/loop /icons"})
+	c.Check(cmp.MountsRemoved, DeepEquals, []string{"/usr/share/fonts squashfs /dev/loop /fonts"})
+	c.Check(cmp.RevisionChanges, DeepEquals, []snaps.RevisionChange{{Snap: "core20", Old: "1405", New: "1601"}})
+
+	// other profiles are compared separately
+	cmp, err = main.CompareWithPrevious([]string{"gedit"}, second, "hot", nil, nil, 10)
+	c.Assert(err, IsNil)
+	c.Check(cmp, IsNil)
+}
+
+func (p *execTestSuite) TestRunsSummary(c *C) {
+	runs := []main.Execution{
+		{TimeToDisplay: 1000 * time.Millisecond, TimeToRun: 2000 * time.Millisecond},
+		{TimeToDisplay: 1200 * time.Millisecond, TimeToRun: 2400 * time.Millisecond},
+		{TimeToDisplay: 1100 * time.Millisecond},
+		// runs with errors are not counted
+		{TimeToDisplay: 10 * time.Second, TimeToRun: 20 * time.Second, Errors: []string{"boom"}},
+	}
+	s := main.RunsSummary(runs)
+	c.Assert(s, NotNil)
+	c.Assert(s.TimeToDisplay, NotNil)
+	c.Check(s.TimeToDisplay.N, Equals, 3)
+	c.Check(s.TimeToDisplay.Mean, Equals, 1100*time.Millisecond)
+	c.Check(s.TimeToDisplay.Median, Equals, 1100*time.Millisecond)
+	c.Check(s.TimeToDisplay.Min, Equals, 1000*time.Millisecond)
+	c.Check(s.TimeToDisplay.Max, Equals, 1200*time.Millisecond)
+	c.Check(s.TimeToDisplay.P90, Equals, 1200*time.Millisecond)
+	c.Check(s.TimeToDisplay.P99, Equals, 1200*time.Millisecond)
+	c.Assert(s.TimeToRun, NotNil)
+	c.Check(s.TimeToRun.N, Equals, 2)
+	c.Check(s.TimeToRun.Mean, Equals, 2200*time.Millisecond)
+
+	// without a window, only the times to run are known
+	s = main.RunsSummary([]main.Execution{{TimeToRun: time.Second}})
+	c.Assert(s, NotNil)
+	c.Check(s.TimeToDisplay, IsNil)
+	c.Check(s.TimeToRun.N, Equals, 1)
+
+	c.Check(main.RunsSummary(runs[3:]), IsNil)
+	c.Check(main.RunsSummary(nil), IsNil)
+}
+
+func (p *execTestSuite) TestRunsDispersion(c *C) {
+	quiet := []main.Execution{
+		{TimeToDisplay: 1000 * time.Millisecond},
+		{TimeToDisplay: 1020 * time.Millisecond},
+		{TimeToDisplay: 980 * time.Millisecond},
+	}
+	d := main.RunsDispersion(quiet, 10, 0.1, 4)
+	c.Assert(d, NotNil)
+	c.Check(d.N, Equals, 3)
+	c.Check(d.Mean, Equals, time.Second)
+	c.Check(d.LowConfidence, Equals, false)
+	c.Check(d.Causes, HasLen, 0)
+
+	// a single run has no dispersion
+	c.Check(main.RunsDispersion(quiet[:1], 10, 0.1, 4), IsNil)
+
+	noisy := []main.Execution{
+		{TimeToDisplay: 3 * time.Second, Thermal: &thermal.Telemetry{}},
+		{TimeToDisplay: 1 * time.Second, Thermal: &thermal.Telemetry{ThrottleEvents: 2}},
+		{TimeToDisplay: 1200 * time.Millisecond, Thermal: &thermal.Telemetry{}},
+		// runs with errors are not counted
+		{TimeToDisplay: 10 * time.Second, Errors: []string{"boom"}},
+	}
+	d = main.RunsDispersion(noisy, 10, 3, 4)
+	c.Assert(d, NotNil)
+	c.Check(d.N, Equals, 3)
+	c.Check(d.LowConfidence, Equals, true)
+	c.Check(d.Causes, DeepEquals, []string{
+		"the CPU was throttled during 1 of the runs, let the machine cool down or pin its frequency",
+		"the system was busy, with a load average of 3.00 on 4 CPUs before the runs",
+		"the first run was 150% slower than the median, the caches were probably still warming up",
+		"too few runs, use --repeat with at least 5 runs",
+	})
+
+	for i := range noisy {
+		noisy[i].Thermal = nil
+	}
+	d = main.RunsDispersion(noisy[1:], 5, 0.1, 4)
+	c.Assert(d, NotNil)
+	c.Check(d.LowConfidence, Equals, true)
+	c.Check(d.Causes, DeepEquals, []string{
+		"too few runs, use --repeat with at least 5 runs",
+		"the CPU may have been throttled, check with --thermal",
+	})
+}
@@ -0,0 +1,43 @@
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"os"
+
+	"github.com/anonymouse64/etrace/internal/explore"
+)
+
+type cmdExplore struct {
+	Args struct {
+		Results string `description:"JSON results of etrace exec or etrace file" required:"yes"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+func (x *cmdExplore) Execute(args []string) error {
+	f, err := os.Open(x.Args.Results)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	res, err := explore.Load(f)
+	if err != nil {
+		return err
+	}
+	return explore.New(res, os.Stdout).Run(os.Stdin)
+}
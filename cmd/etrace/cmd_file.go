@@ -18,22 +18,42 @@
 package main
 
 import (
+	"encoding/csv"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"log"
 	"math"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/anonymouse64/etrace/internal/blockdev"
 	"github.com/anonymouse64/etrace/internal/files"
+	"github.com/anonymouse64/etrace/internal/fontcache"
+	"github.com/anonymouse64/etrace/internal/jvm"
+	"github.com/anonymouse64/etrace/internal/manifest"
+	"github.com/anonymouse64/etrace/internal/mountns"
+	"github.com/anonymouse64/etrace/internal/parquet"
+	"github.com/anonymouse64/etrace/internal/plugins"
+	"github.com/anonymouse64/etrace/internal/proctree"
 	"github.com/anonymouse64/etrace/internal/profiling"
+	"github.com/anonymouse64/etrace/internal/pyimports"
+	"github.com/anonymouse64/etrace/internal/schema"
+	"github.com/anonymouse64/etrace/internal/sessionbus"
+	"github.com/anonymouse64/etrace/internal/shadercache"
+	"github.com/anonymouse64/etrace/internal/sinks"
 	"github.com/anonymouse64/etrace/internal/snaps"
+	"github.com/anonymouse64/etrace/internal/squashfs"
 	"github.com/anonymouse64/etrace/internal/strace"
+	"github.com/anonymouse64/etrace/internal/sysstat"
+	"github.com/anonymouse64/etrace/internal/timechart"
 	"github.com/anonymouse64/etrace/internal/xdotool"
 	"golang.org/x/net/context"
 )
@@ -44,6 +64,16 @@ type cmdFile struct {
 	ProgramRegex         string   `long:"program-regex" description:"Regular expression of programs whose file accesses should be returned"`
 	IncludeSnapdPrograms bool     `long:"include-snapd-programs" description:"Include snapd programs whose file accesses match in the list of files accessed"`
 	ShowPrograms         bool     `long:"show-programs" description:"Show programs that accessed the files"`
+	Timeline             bool     `long:"timeline" description:"Show the number of file accesses and bytes of files accessed while each program was running"`
+	Format               string   `long:"format" choice:"parquet" choice:"csv" description:"Output every individual file access in the given format instead, requires --output-file"`
+	DeviceReads          bool     `long:"device-reads" description:"Show how many bytes were read from the files of each block device, like the loop device of the snap or the partition of the home directory"`
+	DecompressionCost    bool     `long:"decompression-cost" description:"Estimate how much of the startup is spent decompressing the files accessed from the snap, requires --use-snap-run"`
+	AssertNoAccess       []string `long:"assert-no-access" description:"Fail if the program accesses a path matching this glob, where ** also matches across directories, can be specified multiple times"`
+	ExpectedFiles        string   `long:"expected-files" description:"Compare the files accessed with the ones in this JSON manifest and fail if they differ"`
+	UpdateExpectedFiles  bool     `long:"update-expected-files" description:"Write the files accessed to the manifest of --expected-files instead of comparing them"`
+	Timechart            string   `long:"timechart" description:"Write a timechart of the programs executed, their file accesses and the CPU usage and I/O wait of the system to this file in the Chrome trace event format, which can be opened with Perfetto"`
+	SyscallClasses       []string `long:"syscall-class" choice:"file" choice:"net" choice:"ipc" choice:"process" description:"Only trace the system calls of this class instead of all of them, file, net, ipc or process, which makes the trace of big programs much smaller, can be specified multiple times"`
+	ShaderCache          string   `long:"shader-cache" choice:"clear" description:"Clear the GPU shader caches before the run, to see the shaders compiled on a first run"`
 
 	Args struct {
 		Cmd []string `description:"Command to run" required:"yes"`
@@ -53,28 +83,181 @@ type cmdFile struct {
 // FileOutputResult is the result of running a command with various information
 // encoded in it
 type FileOutputResult struct {
+	// SchemaVersion is the version of the JSON encoding of the result, see
+	// --schema-version
+	SchemaVersion int                 `json:",omitempty"`
 	ExecvePaths   *strace.ExecvePaths `json:",omitempty"`
 	TimeToDisplay time.Duration       `json:",omitempty"`
-	Errors        []string            `json:",omitempty"`
+	// ShaderCachePhase is when the GPU shader caches were accessed, which is
+	// when shaders were being compiled or loaded from the caches
+	ShaderCachePhase *strace.AccessPhase `json:",omitempty"`
+	// FontCacheWrites is when the fontconfig caches were written, which is
+	// when any program generated them, not only fc-cache
+	FontCacheWrites *strace.AccessPhase `json:",omitempty"`
+	// JVM is the startup breakdown of the JVM if one was launched
+	JVM *jvm.Launch `json:",omitempty"`
+	// PythonImports is the import cost of each python package, sorted by the
+	// number of file accesses
+	PythonImports []pyimports.PackageCost `json:",omitempty"`
+	// PythonBytecodeWrites is the cost of python failing to write its
+	// bytecode caches
+	PythonBytecodeWrites *pyimports.BytecodeWriteFailures `json:",omitempty"`
+	// PluginScans is the cost of scanning Qt, GTK and GStreamer plugin
+	// directories
+	PluginScans []plugins.Scan `json:",omitempty"`
+	// Timeline is the file I/O during the execution of each program, it is
+	// only included with --timeline
+	Timeline []strace.ExecPhase `json:",omitempty"`
+	// DeviceReads is the bytes read from the files of each block device, it
+	// is only included with --device-reads
+	DeviceReads []blockdev.DeviceReads `json:",omitempty"`
+	// Decompression is the estimated cost of decompressing the files
+	// accessed from the snap, it is only included with --decompression-cost
+	Decompression *squashfs.Cost `json:",omitempty"`
+	// AccessViolations are the accesses of paths forbidden with
+	// --assert-no-access
+	AccessViolations []AccessViolation `json:",omitempty"`
+	// ExpectedFiles is how the files accessed differ from the manifest of
+	// --expected-files
+	ExpectedFiles *manifest.Diff `json:",omitempty"`
+	Errors        []string       `json:",omitempty"`
+}
+
+// MarshalJSON encodes the result in its version of the schema.
+func (r FileOutputResult) MarshalJSON() ([]byte, error) {
+	type result FileOutputResult
+	if r.SchemaVersion < schema.Latest {
+		return json.Marshal(result(r))
+	}
+	v := struct {
+		result
+		ExecvePaths          interface{}      `json:",omitempty"`
+		TimeToDisplay        *schema.Duration `json:",omitempty"`
+		ShaderCachePhase     interface{}      `json:",omitempty"`
+		FontCacheWrites      interface{}      `json:",omitempty"`
+		JVM                  interface{}      `json:",omitempty"`
+		PythonBytecodeWrites interface{}      `json:",omitempty"`
+		PluginScans          []interface{}    `json:",omitempty"`
+		Timeline             []interface{}    `json:",omitempty"`
+		Decompression        interface{}      `json:",omitempty"`
+	}{
+		result:        result(r),
+		TimeToDisplay: schema.OptionalDuration(r.TimeToDisplay),
+	}
+	if r.ExecvePaths != nil {
+		v.ExecvePaths = r.ExecvePaths.Structured()
+	}
+	if r.ShaderCachePhase != nil {
+		v.ShaderCachePhase = r.ShaderCachePhase.Structured()
+	}
+	if r.FontCacheWrites != nil {
+		v.FontCacheWrites = r.FontCacheWrites.Structured()
+	}
+	if r.JVM != nil {
+		v.JVM = r.JVM.Structured()
+	}
+	if r.PythonBytecodeWrites != nil {
+		v.PythonBytecodeWrites = r.PythonBytecodeWrites.Structured()
+	}
+	for _, scan := range r.PluginScans {
+		v.PluginScans = append(v.PluginScans, scan.Structured())
+	}
+	for _, phase := range r.Timeline {
+		v.Timeline = append(v.Timeline, phase.Structured())
+	}
+	if r.Decompression != nil {
+		v.Decompression = r.Decompression.Structured()
+	}
+	return json.Marshal(v)
+}
+
+// Table returns the files accessed as a table.
+func (r FileOutputResult) Table() sinks.Table {
+	table := sinks.Table{
+		Name:    "files",
+		Columns: []string{"path", "size", "program"},
+	}
+	if r.ExecvePaths == nil {
+		return table
+	}
+	for _, f := range r.ExecvePaths.AllFiles {
+		table.Rows = append(table.Rows, []interface{}{f.Path, f.Size, f.Program})
+	}
+	return table
+}
+
+// WriteTraceEvents writes the programs executed and the files they accessed
+// as a timeline in the Chrome trace event format, like --timechart without
+// the usage of the system.
+func (r FileOutputResult) WriteTraceEvents(w io.Writer) error {
+	var start time.Time
+	if r.ExecvePaths != nil {
+		start = r.ExecvePaths.Start
+	}
+	return fileTimechart(start, r.TimeToDisplay, r.TimeToDisplay != 0, r.ExecvePaths, nil).Write(w)
+}
+
+// AccessViolation is an access of a path matching a glob of --assert-no-access
+type AccessViolation struct {
+	Path    string
+	Program string
+	Glob    string
+}
+
+// accessViolations returns the first access of each path matching any of the
+// globs.
+func accessViolations(e *strace.ExecvePaths, globs []*files.Glob) []AccessViolation {
+	var violations []AccessViolation
+	seen := make(map[string]bool)
+	for _, f := range e.AllFiles {
+		if seen[f.Path] {
+			continue
+		}
+		for _, glob := range globs {
+			if glob.Match(f.Path) {
+				seen[f.Path] = true
+				violations = append(violations, AccessViolation{
+					Path:    f.Path,
+					Program: f.Program,
+					Glob:    glob.String(),
+				})
+				break
+			}
+		}
+	}
+	return violations
+}
+
+func accessViolationsError(violations []AccessViolation) error {
+	if len(violations) == 0 {
+		return nil
+	}
+	return fmt.Errorf("the program accessed %d paths forbidden with --assert-no-access", len(violations))
+}
+
+func expectedFilesError(diff *manifest.Diff) error {
+	if diff == nil || diff.Empty() {
+		return nil
+	}
+	return fmt.Errorf("the files accessed differ from --expected-files, %d added and %d removed", len(diff.Added), len(diff.Removed))
 }
 
 func (x *cmdFile) Execute(args []string) error {
 	if currentCmd.RunThroughFlatpak {
 		return fmt.Errorf("file tracing with flatpak not yet supported")
 	}
+	configureStrace()
 	if currentCmd.SilentProgram {
 		currentCmd.ProgramStderrLog = "/dev/null"
 		currentCmd.ProgramStdoutLog = "/dev/null"
 	}
 
 	if !currentCmd.NoWindowWait {
-		// check if we are running on X11, if not then bail because we don't
-		// support graphical window waiting on wayland yet
-		sessionType := os.Getenv("XDG_SESSION_TYPE")
-		if strings.TrimSpace(strings.ToLower(sessionType)) != "x11" {
-			return fmt.Errorf("error: graphical session type %s is unsupported, only x11 is supported", sessionType)
+		if err := checkWindowTool(); err != nil {
+			return err
 		}
 	}
+	defer closeWindowTool()
 
 	// check if the snap is installed first if --use-snap-run is specified
 	if currentCmd.RunThroughSnap {
@@ -84,26 +267,82 @@ func (x *cmdFile) Execute(args []string) error {
 		}
 	}
 
-	// check the output file
-	w := os.Stdout
-	if currentCmd.OutputFile != "" {
-		// TODO: add option for appending?
-		// if the file already exists, delete it and open a new file
-		file, err := files.EnsureExistsAndOpen(currentCmd.OutputFile, true)
+	if x.Format != "" && currentCmd.OutputFile == "" {
+		return fmt.Errorf("cannot use --format without --output-file")
+	}
+	if x.DecompressionCost && !currentCmd.RunThroughSnap {
+		return fmt.Errorf("cannot use --decompression-cost without --use-snap-run")
+	}
+	forbidden := make([]*files.Glob, 0, len(x.AssertNoAccess))
+	for _, pattern := range x.AssertNoAccess {
+		glob, err := files.NewGlob(pattern)
 		if err != nil {
 			return err
 		}
-		w = file
+		forbidden = append(forbidden, glob)
+	}
+	if x.UpdateExpectedFiles && x.ExpectedFiles == "" {
+		return fmt.Errorf("cannot use --update-expected-files without --expected-files")
+	}
+	var expected *manifest.Manifest
+	if x.ExpectedFiles != "" && !x.UpdateExpectedFiles {
+		m, err := manifest.Read(x.ExpectedFiles)
+		if err != nil {
+			return fmt.Errorf("cannot read expected files: %w", err)
+		}
+		expected = m
 	}
 
-	// run the prepare script if it's available
-	if currentCmd.PrepareScript != "" {
-		err := profiling.RunScript(currentCmd.PrepareScript, currentCmd.PrepareScriptArgs)
+	redactor, err := resultRedactor()
+	if err != nil {
+		return err
+	}
+	if err := checkSignOutput(); err != nil {
+		return err
+	}
+	warnPrivileged()
+
+	snap := ""
+	if currentCmd.RunThroughSnap {
+		snap = x.Args.Cmd[0]
+	}
+	if err := emitRecipe(snap); err != nil {
+		return err
+	}
+
+	// open the outputs, unless every file access is written to the output
+	// file in another format instead
+	var w io.Writer
+	var outputs *sinks.Outputs
+	if x.Format != "" {
+		file, err := files.EnsureExistsAndOpen(currentCmd.OutputFile, true)
 		if err != nil {
-			logError(fmt.Errorf("running prepare script: %w", err))
+			return err
 		}
+		defer file.Close()
+		w = file
+	} else {
+		// the file accesses are not folded in stacks of programs
+		specs, err := outputSpecs()
+		if err != nil {
+			return err
+		}
+		for _, spec := range specs {
+			if spec.Format == sinks.FormatFolded {
+				return fmt.Errorf("cannot write the file accesses in %s format", sinks.FormatFolded)
+			}
+		}
+		outputs, err = openOutputs(true)
+		if err != nil {
+			return err
+		}
+		defer outputs.Close()
+		w = outputs.Text
 	}
 
+	// run the prepare script if it's available
+	state := runPrepareScript()
+
 	// handle if the command should be run through `snap run`
 	targetCmd := x.Args.Cmd
 	if currentCmd.RunThroughSnap {
@@ -125,7 +364,10 @@ func (x *cmdFile) Execute(args []string) error {
 		return err
 	}
 
-	cmd, err = strace.TraceFilesCommand(straceLog, targetCmd...)
+	if err := strace.SetSyscallClasses(x.SyscallClasses); err != nil {
+		return err
+	}
+	cmd, err = strace.TraceFilesCommand(straceLog, currentCmd.Privileged, targetCmd...)
 	if err != nil {
 		return err
 	}
@@ -251,24 +493,19 @@ func (x *cmdFile) Execute(args []string) error {
 		windowWaitTimeout = duration
 	}
 
-	xtool := xdotool.MakeXDoTool()
+	xtool := windowTool()
 
 	tryXToolClose := true
 	var wids []string
 
-	windowspec := xdotool.Window{}
-	// check which opts are defined
-	if currentCmd.WindowClass != "" {
-		// prefer window class from option
-		windowspec.Class = currentCmd.WindowClass
-	} else if currentCmd.WindowName != "" {
-		// then window name
-		windowspec.Name = currentCmd.WindowName
-	} else if currentCmd.WindowClassName != "" {
-		// then window class name
-		windowspec.ClassName = currentCmd.WindowClassName
-	} else {
-		// finally fall back to base cmd as the class
+	// the window must match all the attributes specified with options
+	windowspec := xdotool.Window{
+		Class:     currentCmd.WindowClass,
+		Name:      currentCmd.WindowName,
+		ClassName: currentCmd.WindowClassName,
+	}
+	if windowspec.Class == "" && windowspec.Name == "" && windowspec.ClassName == "" {
+		// otherwise fall back to base cmd as the class
 		// note we use the original command and note the processed targetCmd
 		// because for example when measuring a snap, we invoke etrace like so:
 		// $ ./etrace run --use-snap chromium
@@ -276,6 +513,30 @@ func (x *cmdFile) Execute(args []string) error {
 		// but we still want to use "chromium" as the windowspec class
 		windowspec.Class = filepath.Base(x.Args.Cmd[0])
 	}
+	windowspec.ActiveWorkspace = currentCmd.WindowActiveWorkspace
+	var existingWids []string
+	if !currentCmd.NoWindowWait {
+		existingWids, err = xtool.VisibleWindowIDs()
+		if err != nil {
+			logError(fmt.Errorf("listing existing windows: %w", err))
+		}
+		if currentCmd.WindowNewOnly {
+			// ignore the windows which exist before the command is started
+			windowspec.Exclude = existingWids
+		}
+	}
+
+	if x.ShaderCache == shadercache.ModeClear {
+		// the caches in the snap's user data are only relevant when
+		// running a snap
+		cacheSnapName := ""
+		if currentCmd.RunThroughSnap {
+			cacheSnapName, _ = snaps.SplitSnapApp(x.Args.Cmd[0])
+		}
+		if err := shadercache.Clear(cacheSnapName); err != nil {
+			return fmt.Errorf("cannot clear shader caches: %v", err)
+		}
+	}
 
 	// before running the final command, free the caches to get most accurate
 	// timing
@@ -285,12 +546,54 @@ func (x *cmdFile) Execute(args []string) error {
 		}
 	}
 
+	// the reads of the snap's files go through its loop device
+	var snapRev, loop string
+	var loopStart uint64
+	if x.DecompressionCost {
+		snapRev, err = snaps.Revision(x.Args.Cmd[0])
+		if err != nil {
+			return err
+		}
+		loop, err = squashfs.LoopDevice(filepath.Join("/snap", x.Args.Cmd[0], snapRev))
+		if err == nil {
+			loopStart, err = squashfs.LoopCPUTicks(loop)
+		}
+		if err != nil {
+			logError(fmt.Errorf("measuring loop device cpu time: %w", err))
+			loop = ""
+		}
+	}
+
+	if currentCmd.PrivateSessionBus {
+		bus, err := sessionbus.Start()
+		if err != nil {
+			return err
+		}
+		defer bus.Stop()
+		cmd.Env = append(os.Environ(), bus.Env())
+	}
+
+	// the system is sampled to tell when the program was waiting for the
+	// rest of the system
+	var sysSampler *sysstat.Sampler
+	if x.Timechart != "" {
+		sysSampler = sysstat.NewSampler(timechartSampleInterval)
+	}
+
 	// start running the command
 	start := time.Now()
+	if sysSampler != nil {
+		sysSampler.Start(start)
+	}
 	if err := cmd.Start(); err != nil {
 		return err
 	}
 
+	// the sizes of the accessed files are looked up in the mount namespace of
+	// the program, which has to be opened while the program still runs
+	root := watchProgramRoot(cmd.Process.Pid)
+	defer root.Close()
+
 	if currentCmd.NoWindowWait {
 		// if we aren't waiting on the window class, then just wait for the
 		// command to return
@@ -299,7 +602,11 @@ func (x *cmdFile) Execute(args []string) error {
 		ctx, cancel := context.WithTimeout(context.Background(), windowWaitTimeout)
 		defer cancel()
 		// now wait until the window appears
-		wids, err = xtool.WaitForWindow(ctx, windowspec)
+		var ignored bool
+		wids, ignored, err = xdotool.WaitForProgramWindow(ctx, xtool, windowspec, existingWids)
+		if ignored {
+			log.Println(ignoredWindowsWarning)
+		}
 		if errors.Is(err, context.DeadlineExceeded) {
 			// we timed out waiting for the process, just kill the main
 			// command and return an error
@@ -317,67 +624,198 @@ func (x *cmdFile) Execute(args []string) error {
 	// save the startup time
 	startup := time.Since(start)
 
-	// now get the pids before closing the window so we can gracefully try
-	// closing the windows before forcibly killing them later
-	if tryXToolClose {
-		pids := make([]int, len(wids))
-		for i, wid := range wids {
-			pid, err := xtool.PidForWindowID(wid)
-			if err != nil {
-				logError(fmt.Errorf("getting pid for wid %s: %w", wid, err))
-				break
-			}
-			pids[i] = pid
-		}
+	var sysSamples []sysstat.Sample
+	if sysSampler != nil {
+		sysSamples = sysSampler.Stop()
+	}
 
-		// close the windows
-		for _, wid := range wids {
-			if err := xtool.CloseWindowID(wid); err != nil {
-				logError(fmt.Errorf("closing window: %w", err))
-			}
+	var loopCPUTime time.Duration
+	if loop != "" {
+		loopEnd, err := squashfs.LoopCPUTicks(loop)
+		if err != nil {
+			logError(fmt.Errorf("measuring loop device cpu time: %w", err))
+		} else if loopEnd > loopStart {
+			loopCPUTime = squashfs.TicksDuration(loopEnd - loopStart)
 		}
+	}
 
-		// kill the app pids in case x fails to close the window
-		for _, pid := range pids {
-			// FindProcess always succeeds on unix
-			proc, _ := os.FindProcess(pid)
-			if err := proc.Signal(os.Kill); err != nil {
-				// if the process already exited then try wmctrl
-				if !strings.Contains(err.Error(), "process already finished") {
-					logError(fmt.Errorf("killing window process pid %d: %w", pid, err))
-				}
-			}
-		}
+	sizes := files.NewSizes(root.Path())
+
+	if tryXToolClose {
+		closeWindows(xtool, wids)
 	}
 
 	// parse the strace log
-	execFiles, err := strace.TraceExecveWithFiles(
-		straceLog,
-		fileRegex,
-		programRegex,
-		excludeListProgramPatterns,
-	)
+	var execFiles *strace.ExecvePaths
+	capt, err := strace.CaptureExecveWithFiles(straceLog, strace.Scope(currentCmd.TraceScope))
+	if err == nil {
+		if err := recordCapture(capt, 0, wids, start.Add(startup)); err != nil {
+			return err
+		}
+		execFiles, err = strace.ExecvePathsFromCapture(
+			capt,
+			fileRegex,
+			programRegex,
+			excludeListProgramPatterns,
+		)
+	}
 	if err != nil {
 		logError(fmt.Errorf("cannot extract runtime data: %w", err))
 	}
 
-	if currentCmd.RestoreScript != "" {
-		err := profiling.RunScript(currentCmd.RestoreScript, currentCmd.RestoreScriptArgs)
+	// the forbidden paths are checked against all the files, not only the
+	// ones matching the regular expressions
+	var violations []AccessViolation
+	if len(forbidden) != 0 && execFiles != nil {
+		matchAll := regexp.MustCompile(".*")
+		allFiles, err := strace.ExecvePathsFromCapture(capt, matchAll, matchAll, excludeListProgramPatterns)
 		if err != nil {
-			logError(fmt.Errorf("running restore script: %w", err))
+			logError(fmt.Errorf("cannot check forbidden paths: %w", err))
+		} else {
+			violations = accessViolations(allFiles, forbidden)
 		}
 	}
 
-	// output the result either in JSON or using the execve files result
-	// Display() method
-	if currentCmd.JSONOutput {
-		outRes := FileOutputResult{
-			TimeToDisplay: startup,
-			Errors:        errs,
-			ExecvePaths:   execFiles,
+	runRestoreScript(state)
+
+	var shaderCachePhase, fontCacheWrites *strace.AccessPhase
+	var jvmLaunch *jvm.Launch
+	var pythonImports []pyimports.PackageCost
+	var bytecodeWrites *pyimports.BytecodeWriteFailures
+	var pluginScans []plugins.Scan
+	var timeline []strace.ExecPhase
+	if execFiles != nil {
+		shaderCachePhase = execFiles.AccessPhase(shadercache.IsShaderCachePath)
+		fontCacheWrites = execFiles.WritePhase(fontcache.IsFontCachePath)
+		jvmLaunch = jvm.Analyze(execFiles)
+		pythonImports = pyimports.Summarize(execFiles, sizes)
+		bytecodeWrites = pyimports.BytecodeWrites(execFiles)
+		pluginScans = plugins.Scans(execFiles)
+		if x.Timeline {
+			timeline = execFiles.Timeline(sizes)
 		}
-		json.NewEncoder(w).Encode(outRes)
-	} else {
+	}
+
+	var deviceReads []blockdev.DeviceReads
+	if x.DeviceReads && execFiles != nil {
+		mounts, err := blockdev.ReadMounts()
+		if err != nil {
+			logError(fmt.Errorf("reading mounts: %w", err))
+		} else {
+			deviceReads = blockdev.Reads(mounts, execFiles.ReadBytes())
+		}
+	}
+
+	var decompression *squashfs.Cost
+	if x.DecompressionCost && execFiles != nil {
+		decompression, err = x.decompressionCost(execFiles, snapRev, startup)
+		if err != nil {
+			logError(fmt.Errorf("estimating decompression cost: %w", err))
+		} else {
+			decompression.LoopCPUTime = loopCPUTime
+		}
+	}
+
+	// get the sizes of the accessed files before the paths are rewritten
+	var records []strace.AccessRecord
+	if x.Format != "" && execFiles != nil {
+		records = execFiles.AccessRecords(sizes)
+	}
+
+	// rewrite the paths in the results so they can be shared
+	redactor.ExecvePaths(execFiles)
+	redactor.Strings(errs)
+	for i := range violations {
+		violations[i].Path = redactor.Path(violations[i].Path)
+		violations[i].Program = redactor.Path(violations[i].Program)
+	}
+	for i := range records {
+		records[i].Path = redactor.Path(records[i].Path)
+		records[i].Program = redactor.Path(records[i].Program)
+	}
+
+	// the manifest is of the redacted paths so that it doesn't depend on the
+	// user it was recorded by
+	var filesDiff *manifest.Diff
+	if x.ExpectedFiles != "" && execFiles != nil {
+		paths := make([]string, 0, len(execFiles.AllFiles))
+		for _, f := range execFiles.AllFiles {
+			paths = append(paths, f.Path)
+		}
+		accessed := manifest.New(paths)
+		if x.UpdateExpectedFiles {
+			if err := accessed.Write(x.ExpectedFiles); err != nil {
+				return fmt.Errorf("cannot write expected files: %w", err)
+			}
+		} else {
+			filesDiff = expected.Compare(accessed)
+		}
+	}
+	for i := range timeline {
+		timeline[i].Exe = redactor.Path(timeline[i].Exe)
+	}
+	for i := range deviceReads {
+		deviceReads[i].BackingFile = redactor.Path(deviceReads[i].BackingFile)
+		for j := range deviceReads[i].Mounts {
+			deviceReads[i].Mounts[j] = redactor.Path(deviceReads[i].Mounts[j])
+		}
+	}
+	if jvmLaunch != nil {
+		jvmLaunch.Exe = redactor.Path(jvmLaunch.Exe)
+		jvmLaunch.JavaHome = redactor.Path(jvmLaunch.JavaHome)
+		for i := range jvmLaunch.ClassDataArchives {
+			jvmLaunch.ClassDataArchives[i].Path = redactor.Path(jvmLaunch.ClassDataArchives[i].Path)
+		}
+	}
+
+	if x.Timechart != "" {
+		chart := fileTimechart(start, startup, len(wids) != 0, execFiles, sysSamples)
+		if err := writeTimechart(x.Timechart, chart); err != nil {
+			return err
+		}
+	}
+
+	if x.Format != "" {
+		write := writeAccessRecordsParquet
+		if x.Format == formatCSV {
+			write = writeAccessRecordsCSV
+		}
+		if err := write(w, records); err != nil {
+			return err
+		}
+		if err := signOutput(); err != nil {
+			return err
+		}
+		if err := accessViolationsError(violations); err != nil {
+			return err
+		}
+		return expectedFilesError(filesDiff)
+	}
+
+	// output the result to the structured outputs and using the execve files
+	// result Display() method to the text ones
+	outRes := FileOutputResult{
+		SchemaVersion:    currentCmd.SchemaVersion,
+		TimeToDisplay:    startup,
+		Errors:           errs,
+		ExecvePaths:      execFiles,
+		ShaderCachePhase: shaderCachePhase,
+		FontCacheWrites:  fontCacheWrites,
+		JVM:              jvmLaunch,
+		PythonImports:    pythonImports,
+
+		PythonBytecodeWrites: bytecodeWrites,
+		PluginScans:          pluginScans,
+		Timeline:             timeline,
+		DeviceReads:          deviceReads,
+		Decompression:        decompression,
+		AccessViolations:     violations,
+		ExpectedFiles:        filesDiff,
+	}
+	if err := outputs.Write(outRes); err != nil {
+		return err
+	}
+	if outputs.HasText() {
 		// make a new tabwriter to stderr
 		wtab := tabWriterGeneric(w)
 		opts := &strace.DisplayOptions{}
@@ -385,8 +823,409 @@ func (x *cmdFile) Execute(args []string) error {
 			opts.NoDisplayPrograms = true
 		}
 		execFiles.Display(wtab, opts)
+		wtab.Flush()
+
+		if shaderCachePhase != nil {
+			fmt.Fprintf(w, "Shader cache accessed from %v to %v (%d accesses)\n",
+				shaderCachePhase.Start.Seconds(),
+				shaderCachePhase.End.Seconds(),
+				shaderCachePhase.Accesses,
+			)
+		}
+		if fontCacheWrites != nil {
+			fmt.Fprintf(w, "Font cache written from %v to %v (%d writes)\n",
+				fontCacheWrites.Start.Seconds(),
+				fontCacheWrites.End.Seconds(),
+				fontCacheWrites.Accesses,
+			)
+		}
+
+		if decompression != nil {
+			fmt.Fprintf(w, "Decompressing the %d files (%d bytes) accessed from the %s compressed snap takes about %v, %.1f%% of the startup time\n",
+				decompression.Files,
+				decompression.Bytes,
+				decompression.Compression,
+				decompression.DecompressTime.Seconds(),
+				decompression.StartupPercent,
+			)
+			if decompression.LoopCPUTime != 0 {
+				fmt.Fprintln(w, "Loop device CPU time:", decompression.LoopCPUTime.Seconds())
+			}
+		}
+
+		if jvmLaunch != nil {
+			fmt.Fprintf(w, "JVM %s started at %v\n", jvmLaunch.Exe, jvmLaunch.Start.Seconds())
+			fmt.Fprintf(w, "JVM init time: %v\n", jvmLaunch.InitTime)
+			fmt.Fprintf(w, "JVM application time: %v\n", jvmLaunch.AppTime)
+			if len(jvmLaunch.ClassDataArchives) == 0 {
+				fmt.Fprintln(w, "No class data sharing archives used")
+			}
+			for _, a := range jvmLaunch.ClassDataArchives {
+				kind := "default"
+				if a.App {
+					kind = "application"
+				}
+				fmt.Fprintf(w, "Used %s class data sharing archive %s\n", kind, a.Path)
+			}
+		}
+
+		if len(pythonImports) != 0 {
+			fmt.Fprintln(wtab, "Python import cost:")
+			fmt.Fprintln(wtab, "\tPackage\tAccesses\tFiles\tBytes\tDirectories")
+			for _, pkg := range pythonImports {
+				fmt.Fprintf(wtab, "\t%s\t%d\t%d\t%d\t%d\n", pkg.Package, pkg.Accesses, pkg.Files, pkg.Bytes, pkg.Dirs)
+			}
+			wtab.Flush()
+		}
+
+		if bytecodeWrites != nil {
+			fmt.Fprintf(w, "Python failed to write bytecode caches %d times for %d modules, recompiling every launch costs about %v\n",
+				bytecodeWrites.FailedWrites,
+				bytecodeWrites.Modules,
+				bytecodeWrites.RecompileTime,
+			)
+			fmt.Fprintf(w, "Recommendation: %s\n", pyimports.BytecodeRecommendation)
+		}
+
+		if len(pluginScans) != 0 {
+			fmt.Fprintln(wtab, "Plugin scans:")
+			fmt.Fprintln(wtab, "\tKind\tStart\tEnd\tAccesses\tFiles\tCache")
+			for _, scan := range pluginScans {
+				cache := "-"
+				switch {
+				case scan.Rebuilt:
+					cache = scan.Cache + " rebuilt"
+				case scan.CachePresent:
+					cache = scan.Cache + " present"
+				case scan.Cache != "":
+					cache = scan.Cache + " missing"
+				}
+				fmt.Fprintf(wtab, "\t%s\t%v\t%v\t%d\t%d\t%s\n",
+					scan.Kind,
+					scan.Start.Seconds(),
+					scan.End.Seconds(),
+					scan.Accesses,
+					scan.Files,
+					cache,
+				)
+			}
+			wtab.Flush()
+		}
+
+		if len(timeline) != 0 {
+			displayTimeline(wtab, timeline)
+			wtab.Flush()
+		}
+
+		if len(deviceReads) != 0 {
+			displayDeviceReads(wtab, deviceReads)
+			wtab.Flush()
+		}
+
+		for _, v := range violations {
+			fmt.Fprintf(w, "Forbidden access: %s accessed %s, which matches %s\n", v.Program, v.Path, v.Glob)
+		}
+
+		if filesDiff != nil {
+			for _, path := range filesDiff.Added {
+				fmt.Fprintf(w, "Unexpected file accessed: %s\n", path)
+			}
+			for _, path := range filesDiff.Removed {
+				fmt.Fprintf(w, "Expected file not accessed: %s\n", path)
+			}
+		}
+	}
+
+	if err := signOutput(); err != nil {
+		return err
+	}
+	if err := accessViolationsError(violations); err != nil {
+		return err
+	}
+	return expectedFilesError(filesDiff)
+}
+
+// programRootPollInterval is how often the processes of the program are
+// checked for having entered their own mount namespace
+var programRootPollInterval = 50 * time.Millisecond
+
+// programRoot is the root directory of the mount namespace of a program, which
+// is opened while the program runs so that the files it accessed can still be
+// looked up in it after it exited.
+type programRoot struct {
+	// started is the root of the program right after it started
+	started *os.File
+	// entered is the root of the mount namespace the program or its
+	// descendants entered, like the one of a snap
+	entered *os.File
+	pid     int
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// watchProgramRoot opens the root directory of the process with the given pid
+// right after it started, and then the one of the mount namespace it or its
+// descendants enter while it runs.
+func watchProgramRoot(pid int) *programRoot {
+	r := &programRoot{pid: pid, stop: make(chan struct{}), done: make(chan struct{})}
+	dir, err := os.Open(filepath.Join("/proc", strconv.Itoa(pid), "root"))
+	if err != nil {
+		logError(fmt.Errorf("opening the root directory of the program: %w", err))
+	}
+	r.started = dir
+	go func() {
+		defer close(r.done)
+		for !r.enter() {
+			select {
+			case <-r.stop:
+				return
+			case <-time.After(programRootPollInterval):
+			}
+		}
+	}()
+	return r
+}
 
+// enter opens the root directory of the first process of the program which
+// is in a different mount namespace than etrace, if there is one, and returns
+// whether it did or the program is gone.
+func (r *programRoot) enter() bool {
+	tree, err := proctree.Snapshot(r.pid)
+	if err != nil {
+		return true
+	}
+	pids := make([]int, 0, len(tree.Processes))
+	for _, proc := range tree.Processes {
+		pids = append(pids, proc.Pid)
+	}
+	nsPid, ok, err := mountns.Entered(pids)
+	if err != nil || !ok {
+		return err != nil
+	}
+	dir, err := os.Open(filepath.Join("/proc", strconv.Itoa(nsPid), "root"))
+	if err != nil {
+		// the process exited in the meantime
+		return false
+	}
+	r.entered = dir
+	return true
+}
+
+// Path stops watching the program and returns the root directory as a path
+// which stays valid after the program exits, until Close. It falls back to
+// etrace's root if it couldn't be opened.
+func (r *programRoot) Path() string {
+	select {
+	case <-r.stop:
+	default:
+		close(r.stop)
+		<-r.done
+		// the program may have entered it since it was last checked
+		if r.entered == nil {
+			r.enter()
+		}
+	}
+	for _, dir := range []*os.File{r.entered, r.started} {
+		if dir != nil {
+			return filepath.Join("/proc/self/fd", strconv.Itoa(int(dir.Fd())))
+		}
 	}
+	return "/"
+}
 
+// Close closes the root directory.
+func (r *programRoot) Close() {
+	r.Path()
+	for _, dir := range []*os.File{r.entered, r.started} {
+		if dir != nil {
+			dir.Close()
+		}
+	}
+}
+
+// displayTimeline shows the file I/O of each program in a table.
+func displayTimeline(w io.Writer, timeline []strace.ExecPhase) {
+	fmt.Fprintln(w, "File I/O timeline:")
+	fmt.Fprintln(w, "\tStart\tProgram\tRuntime\tFile ops\tFiles\tBytes")
+	for _, phase := range timeline {
+		fmt.Fprintf(w, "\t%v\t%s\t%v\t%d\t%d\t%d\n",
+			phase.Start.Seconds(),
+			phase.Exe,
+			phase.RunDuration,
+			phase.FileOps,
+			phase.Files,
+			phase.Bytes,
+		)
+	}
+}
+
+// displayDeviceReads shows the bytes read from each block device in a table.
+func displayDeviceReads(w io.Writer, reads []blockdev.DeviceReads) {
+	fmt.Fprintln(w, "Reads by device:")
+	fmt.Fprintln(w, "\tDevice\tFilesystem\tMounts\tFiles\tBytes")
+	for _, dev := range reads {
+		source := dev.Source
+		if dev.BackingFile != "" {
+			source += " (" + dev.BackingFile + ")"
+		}
+		fmt.Fprintf(w, "\t%s\t%s\t%s\t%d\t%d\n",
+			source,
+			dev.FSType,
+			strings.Join(dev.Mounts, ", "),
+			dev.Files,
+			dev.Bytes,
+		)
+	}
+}
+
+// The formats of --format
+const (
+	formatParquet = "parquet"
+	formatCSV     = "csv"
+)
+
+// timechartSampleInterval is how often the system is sampled for --timechart
+const timechartSampleInterval = 50 * time.Millisecond
+
+// fileTimechart returns the timechart of the programs executed and the files
+// they accessed, along with the usage of the system sampled during the run.
+func fileTimechart(start time.Time, startup time.Duration, window bool, e *strace.ExecvePaths, samples []sysstat.Sample) *timechart.Chart {
+	chart := timechart.New(start)
+	if e != nil {
+		for _, proc := range e.Processes {
+			chart.Program(proc.Pid(), proc.Exe, proc.Start, proc.RunDuration)
+			for _, access := range proc.PathAccesses {
+				chart.FileAccess(proc.Pid(), access.Path, access.Syscall, access.Time)
+			}
+		}
+	}
+	for _, sample := range samples {
+		chart.SystemUsage(start.Add(sample.Time), sample.CPUPercent, sample.IOWaitPercent)
+	}
+	if window {
+		chart.Mark(MilestoneMainWindow, start.Add(startup))
+	}
+	return chart
+}
+
+// writeTimechart writes the timechart to the file.
+func writeTimechart(path string, chart *timechart.Chart) error {
+	f, err := files.EnsureExistsAndOpen(path, true)
+	if err != nil {
+		return err
+	}
+	if err := chart.Write(f); err != nil {
+		f.Close()
+		return fmt.Errorf("cannot write timechart: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := files.ChownToSudoUser(path); err != nil {
+		log.Printf("warning: cannot change owner of %s: %v", path, err)
+	}
 	return nil
 }
+
+// parquetRowGroupRows is how many access records are written in each row
+// group of the parquet table
+var parquetRowGroupRows = 64 * 1024
+
+// writeAccessRecordsParquet writes the file access records as a parquet table
+// with a row per access.
+func writeAccessRecordsParquet(w io.Writer, records []strace.AccessRecord) error {
+	pw := parquet.NewWriter(w)
+	for start := 0; ; start += parquetRowGroupRows {
+		end := start + parquetRowGroupRows
+		if end > len(records) {
+			end = len(records)
+		}
+		group := records[start:end]
+		pids := make([]int64, len(group))
+		times := make([]time.Time, len(group))
+		syscalls := make([]string, len(group))
+		paths := make([]string, len(group))
+		programs := make([]string, len(group))
+		sizes := make([]int64, len(group))
+		for i, r := range group {
+			pids[i] = int64(r.Pid)
+			times[i] = r.Time
+			syscalls[i] = r.Syscall
+			paths[i] = r.Path
+			programs[i] = r.Program
+			sizes[i] = r.Size
+		}
+		err := pw.WriteRowGroup(
+			parquet.Int64Column("pid", pids),
+			parquet.TimestampColumn("time", times),
+			parquet.StringColumn("syscall", syscalls),
+			parquet.StringColumn("path", paths),
+			parquet.StringColumn("program", programs),
+			parquet.Int64Column("size", sizes),
+		)
+		if err != nil {
+			return err
+		}
+		// a table without records still has a row group
+		if end == len(records) {
+			break
+		}
+	}
+	return pw.Close()
+}
+
+// writeAccessRecordsCSV writes the file access records as comma separated
+// values with a header line and a row per access, with the times as Unix
+// times in seconds.
+func writeAccessRecordsCSV(w io.Writer, records []strace.AccessRecord) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"pid", "time", "syscall", "path", "program", "size"}); err != nil {
+		return err
+	}
+	for _, r := range records {
+		err := cw.Write([]string{
+			strconv.Itoa(r.Pid),
+			strconv.FormatFloat(float64(r.Time.UnixNano())/1e9, 'f', 6, 64),
+			r.Syscall,
+			r.Path,
+			r.Program,
+			strconv.FormatInt(r.Size, 10),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// decompressionCost estimates the cost of decompressing the files accessed from
+// the snap at the given revision by extracting them from the snap again.
+func (x *cmdFile) decompressionCost(execFiles *strace.ExecvePaths, rev string, startup time.Duration) (*squashfs.Cost, error) {
+	snapName := x.Args.Cmd[0]
+	snapFile := filepath.Join("/var/lib/snapd/snaps", fmt.Sprintf("%s_%s.snap", snapName, rev))
+	compression, err := squashfs.Compression(snapFile)
+	if err != nil {
+		return nil, err
+	}
+	paths, size := squashfs.AccessedFiles(execFiles,
+		filepath.Join("/snap", snapName, rev),
+		filepath.Join("/snap", snapName, "current"),
+	)
+	cost := &squashfs.Cost{
+		Compression: compression,
+		Files:       len(paths),
+		Bytes:       size,
+	}
+	if len(paths) == 0 {
+		return cost, nil
+	}
+	cost.DecompressTime, err = squashfs.ExtractTime(snapFile, paths)
+	if err != nil {
+		return nil, err
+	}
+	if startup > 0 {
+		cost.StartupPercent = 100 * float64(cost.DecompressTime) / float64(startup)
+	}
+	return cost, nil
+}
@@ -0,0 +1,117 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	main "github.com/anonymouse64/etrace/cmd/etrace"
+	"github.com/anonymouse64/etrace/internal/files"
+	"github.com/anonymouse64/etrace/internal/strace"
+
+	. "gopkg.in/check.v1"
+)
+
+type fileTestSuite struct{}
+
+var _ = Suite(&fileTestSuite{})
+
+func (s *fileTestSuite) TestAccessViolations(c *C) {
+	var globs []*files.Glob
+	for _, pattern := range []string{"/etc/passwd", "/home/**"} {
+		glob, err := files.NewGlob(pattern)
+		c.Assert(err, IsNil)
+		globs = append(globs, glob)
+	}
+	e := &strace.ExecvePaths{
+		AllFiles: []strace.CommonFileInfo{
+			{Path: "/snap/foo/1/bin/foo", Program: "/snap/foo/1/bin/foo"},
+			{Path: "/etc/passwd", Program: "/usr/bin/getent"},
+			{Path: "/home/user/.config/foo.conf", Program: "/snap/foo/1/bin/foo"},
+			// only the first access of a path is reported
+			{Path: "/etc/passwd", Program: "/snap/foo/1/bin/foo"},
+		},
+	}
+	c.Check(main.AccessViolations(e, globs), DeepEquals, []main.AccessViolation{
+		{Path: "/etc/passwd", Program: "/usr/bin/getent", Glob: "/etc/passwd"},
+		{Path: "/home/user/.config/foo.conf", Program: "/snap/foo/1/bin/foo", Glob: "/home/**"},
+	})
+	c.Check(main.AccessViolations(e, nil), HasLen, 0)
+}
+
+func (s *fileTestSuite) TestWriteAccessRecordsCSV(c *C) {
+	start := time.Unix(1542815326, 0)
+	records := []strace.AccessRecord{
+		{Pid: 100, Time: start, Syscall: "openat", Path: "/etc/passwd", Program: "/usr/bin/getent", Size: 2048},
+		// paths with commas are quoted
+		{Pid: 101, Time: start.Add(1500 * time.Microsecond), Syscall: "stat", Path: "/home/user/a,b", Program: "/snap/foo/1/bin/foo", Size: -1},
+	}
+	var buf bytes.Buffer
+	c.Assert(main.WriteAccessRecordsCSV(&buf, records), IsNil)
+	c.Check(buf.String(), Equals, `pid,time,syscall,path,program,size
+100,1542815326.000000,openat,/etc/passwd,/usr/bin/getent,2048
+101,1542815326.001500,stat,"/home/user/a,b",/snap/foo/1/bin/foo,-1
+`)
+}
+
+func (p *fileTestSuite) TestWatchProgramRoot(c *C) {
+	cmd := exec.Command("sleep", "0.1")
+	c.Assert(cmd.Start(), IsNil)
+	root := main.WatchProgramRoot(cmd.Process.Pid)
+	defer root.Close()
+	c.Assert(cmd.Wait(), IsNil)
+
+	// the root opened when the program started is still there once it exited
+	path := root.Path()
+	c.Check(path, Matches, `/proc/self/fd/[0-9]+`)
+	_, err := ioutil.ReadDir(path)
+	c.Check(err, IsNil)
+	c.Check(root.Path(), Equals, path)
+}
+
+func (p *fileTestSuite) TestWatchProgramRootEntered(c *C) {
+	if err := exec.Command("unshare", "-m", "true").Run(); err != nil {
+		c.Skip("cannot make mount namespaces")
+	}
+	// the program enters its own mount namespace with a file only it sees,
+	// like snap-confine does
+	cmd := exec.Command("sh", "-c", `sleep 0.1; exec unshare -m sh -c 'mount -t tmpfs tmpfs /mnt && touch /mnt/only-here && sleep 10'`)
+	c.Assert(cmd.Start(), IsNil)
+	defer cmd.Wait()
+	defer cmd.Process.Kill()
+	root := main.WatchProgramRoot(cmd.Process.Pid)
+	defer root.Close()
+
+	// the mount namespace is found while the program runs
+	for i := 0; ; i++ {
+		time.Sleep(100 * time.Millisecond)
+		if _, err := os.Stat("/proc/" + strconv.Itoa(cmd.Process.Pid) + "/root/mnt/only-here"); err == nil {
+			break
+		}
+		c.Assert(i < 50, Equals, true)
+	}
+	time.Sleep(200 * time.Millisecond)
+	_, err := os.Stat(filepath.Join(root.Path(), "mnt/only-here"))
+	c.Check(err, IsNil)
+}
@@ -0,0 +1,99 @@
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/anonymouse64/etrace/internal/history"
+)
+
+type cmdHistory struct {
+	Show cmdHistoryShow `command:"show" description:"Show the trend of the startup time of a snap or program across its measurements"`
+}
+
+type cmdHistoryShow struct {
+	Profile string `long:"profile" description:"Only show the measurements with this measurement profile"`
+
+	Args struct {
+		Name string `description:"The snap, flatpak application or program to show the measurements of" required:"yes"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+func (x *cmdHistoryShow) Execute(args []string) error {
+	dir, err := history.Dir()
+	if err != nil {
+		return err
+	}
+	histories, err := history.List(dir)
+	if err != nil {
+		return err
+	}
+	var trend []history.TrendEntry
+	for _, e := range history.Trend(histories, x.Args.Name) {
+		if x.Profile == "" || e.Profile == x.Profile {
+			trend = append(trend, e)
+		}
+	}
+	if len(trend) == 0 {
+		return fmt.Errorf("cannot find any measurement of %s in %s", x.Args.Name, dir)
+	}
+	displayTrend(os.Stdout, trend)
+	return nil
+}
+
+// displayTrend shows a table of the measurements of a trend, with the mean
+// times in seconds.
+func displayTrend(w io.Writer, trend []history.TrendEntry) {
+	wtab := tabWriterGeneric(w)
+	fmt.Fprintln(wtab, "Date\tCommand\tProfile\tRevision\tKernel\tRuns\tTime to display\tStd dev\tTime to run\tChange")
+	for _, e := range trend {
+		profile, revision, kernel, toRun, change := e.Profile, e.Revision, e.Kernel, "-", "-"
+		if profile == "" {
+			profile = "-"
+		}
+		if revision == "" {
+			revision = "-"
+		}
+		if kernel == "" {
+			kernel = "-"
+		}
+		if e.TimeToRun.N != 0 {
+			toRun = fmt.Sprint(e.TimeToRun.Mean.Seconds())
+		}
+		if e.HasChange {
+			change = fmt.Sprintf("%+.1f%%", e.Change)
+		}
+		fmt.Fprintf(wtab, "%s\t%s\t%s\t%s\t%s\t%d\t%v\t%v\t%s\t%s\n",
+			e.Time.Local().Format("2006-01-02 15:04"),
+			strings.Join(e.Command, " "),
+			profile,
+			revision,
+			kernel,
+			e.TimeToDisplay.N,
+			e.TimeToDisplay.Mean.Seconds(),
+			e.TimeToDisplay.StdDev.Seconds(),
+			toRun,
+			change,
+		)
+	}
+	wtab.Flush()
+}
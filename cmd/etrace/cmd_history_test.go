@@ -0,0 +1,62 @@
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main_test
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/anonymouse64/etrace/analysis"
+	main "github.com/anonymouse64/etrace/cmd/etrace"
+	"github.com/anonymouse64/etrace/internal/history"
+
+	. "gopkg.in/check.v1"
+)
+
+type historyTestSuite struct{}
+
+var _ = Suite(&historyTestSuite{})
+
+func (s *historyTestSuite) TestDisplayTrend(c *C) {
+	measured := time.Date(2021, 7, 1, 12, 0, 0, 0, time.Local)
+	var buf bytes.Buffer
+	main.DisplayTrend(&buf, []history.TrendEntry{
+		{
+			Time:          measured,
+			Command:       []string{"snap", "run", "gedit"},
+			Profile:       "cold",
+			Revision:      "12",
+			Kernel:        "5.11.0-25-generic",
+			TimeToDisplay: analysis.Compute([]time.Duration{2 * time.Second, 2 * time.Second}),
+		},
+		{
+			Time:          measured.Add(26 * time.Hour),
+			Command:       []string{"snap", "run", "gedit"},
+			Profile:       "cold",
+			Revision:      "13",
+			TimeToDisplay: analysis.Compute([]time.Duration{time.Second, 2 * time.Second}),
+			TimeToRun:     analysis.Compute([]time.Duration{3 * time.Second}),
+			Change:        -25,
+			HasChange:     true,
+		},
+	})
+	c.Check(buf.String(), Equals, ""+
+		"Date              Command         Profile  Revision  Kernel             Runs  Time to display  Std dev  Time to run  Change\n"+
+		"2021-07-01 12:00  snap run gedit  cold     12        5.11.0-25-generic  2     2                0        -            -\n"+
+		"2021-07-02 14:00  snap run gedit  cold     13        -                  2     1.5              0.5      3            -25.0%\n")
+}
@@ -0,0 +1,286 @@
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/anonymouse64/etrace/internal/capture"
+	"github.com/anonymouse64/etrace/internal/files"
+	"github.com/anonymouse64/etrace/internal/schema"
+	"github.com/anonymouse64/etrace/internal/strace"
+)
+
+type cmdReplay struct {
+	FileRegex    string `long:"file-regex" description:"Regular expression of files to return, if empty all files are returned"`
+	ProgramRegex string `long:"program-regex" description:"Regular expression of programs whose file accesses should be returned"`
+	ShowPrograms bool   `long:"show-programs" description:"Show programs that accessed the files"`
+	Timeline     bool   `long:"timeline" description:"Show the number of file accesses and bytes of files accessed while each program was running"`
+	NoCache      bool   `long:"no-cache" description:"Parse strace logs again instead of reusing the captures cached when they were parsed before"`
+
+	Args struct {
+		Captures []string `description:"Capture files recorded with --record, or strace logs" required:"yes"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+// parsedLogsDir returns the directory where the captures of the strace logs
+// which were parsed are cached.
+var parsedLogsDir = func() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "etrace", "parsed-logs"), nil
+}
+
+// logChecksum returns the sha256 checksum of the strace log.
+func logChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// readCapture reads a capture recorded with --record, or parses a strace log
+// into one. The captures of strace logs are cached by the checksum of the log
+// and the trace scope, so that analyzing the same log again with other
+// filters doesn't parse it again.
+func readCapture(path string, scope strace.Scope, useCache bool) (*capture.Capture, error) {
+	c, err := capture.ReadFile(path)
+	if err != capture.ErrNotCapture {
+		return c, err
+	}
+	if !useCache {
+		return strace.CaptureLogFile(path, scope)
+	}
+
+	sum, err := logChecksum(path)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := parsedLogsDir()
+	if err != nil {
+		return nil, err
+	}
+	cached := filepath.Join(dir, fmt.Sprintf("%s-%s.etrace", sum, scope))
+	// a cached capture which can't be read is parsed again
+	if c, err := capture.ReadFile(cached); err == nil {
+		return c, nil
+	}
+
+	c, err = strace.CaptureLogFile(path, scope)
+	if err != nil {
+		return nil, err
+	}
+	if err := cacheCapture(cached, c); err != nil {
+		log.Printf("warning: cannot cache the capture of %s: %v", path, err)
+	}
+	return c, nil
+}
+
+// cacheCapture writes the capture to the cache, atomically so that an
+// interrupted write is never read back.
+func cacheCapture(path string, c *capture.Capture) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), ".parsing-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := capture.Write(f, c); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// ReplayResult is the result of analyzing a recorded capture
+type ReplayResult struct {
+	// SchemaVersion is the version of the JSON encoding of the result, see
+	// --schema-version
+	SchemaVersion int `json:",omitempty"`
+	Capture       string
+	ExecveTiming  *strace.ExecveTiming `json:",omitempty"`
+	// TimeToDisplay is when the first window appeared, if any did
+	TimeToDisplay time.Duration `json:",omitempty"`
+	// CriticalPath is the chain of programs which gated the time to
+	// display, or the whole execution if no window appeared
+	CriticalPath strace.CriticalPath `json:",omitempty"`
+	// ExecvePaths are the files accessed, captures recorded with the exec
+	// subcommand don't include them
+	ExecvePaths *strace.ExecvePaths `json:",omitempty"`
+	Timeline    []strace.ExecPhase  `json:",omitempty"`
+}
+
+// MarshalJSON encodes the result in its version of the schema.
+func (r ReplayResult) MarshalJSON() ([]byte, error) {
+	type result ReplayResult
+	if r.SchemaVersion < schema.Latest {
+		return json.Marshal(result(r))
+	}
+	v := struct {
+		result
+		ExecveTiming  interface{}      `json:",omitempty"`
+		TimeToDisplay *schema.Duration `json:",omitempty"`
+		CriticalPath  interface{}      `json:",omitempty"`
+		ExecvePaths   interface{}      `json:",omitempty"`
+		Timeline      []interface{}    `json:",omitempty"`
+	}{
+		result:        result(r),
+		TimeToDisplay: schema.OptionalDuration(r.TimeToDisplay),
+	}
+	if r.ExecveTiming != nil {
+		v.ExecveTiming = r.ExecveTiming.Structured()
+	}
+	if len(r.CriticalPath) != 0 {
+		v.CriticalPath = r.CriticalPath.Structured()
+	}
+	if r.ExecvePaths != nil {
+		v.ExecvePaths = r.ExecvePaths.Structured()
+	}
+	for _, phase := range r.Timeline {
+		v.Timeline = append(v.Timeline, phase.Structured())
+	}
+	return json.Marshal(v)
+}
+
+func (x *cmdReplay) Execute(args []string) error {
+	redactor, err := resultRedactor()
+	if err != nil {
+		return err
+	}
+	if err := checkSignOutput(); err != nil {
+		return err
+	}
+
+	outputs, err := openOutputs(false)
+	if err != nil {
+		return err
+	}
+	defer outputs.Close()
+	w := outputs.Text
+
+	all := regexp.MustCompile(".*")
+	fileRegex, programRegex := all, all
+	if x.FileRegex != "" {
+		fileRegex, err = regexp.Compile(x.FileRegex)
+		if err != nil {
+			return fmt.Errorf("invalid setting for --file-regex (%q): %v", x.FileRegex, err)
+		}
+	}
+	if x.ProgramRegex != "" {
+		programRegex, err = regexp.Compile(x.ProgramRegex)
+		if err != nil {
+			return fmt.Errorf("invalid setting for --program-regex (%q): %v", x.ProgramRegex, err)
+		}
+	}
+
+	results := make([]ReplayResult, 0, len(x.Args.Captures))
+	for _, path := range x.Args.Captures {
+		c, err := readCapture(path, strace.Scope(currentCmd.TraceScope), !x.NoCache)
+		if err != nil {
+			return fmt.Errorf("cannot read %s: %v", path, err)
+		}
+		res := ReplayResult{
+			SchemaVersion: currentCmd.SchemaVersion,
+			Capture:       path,
+			ExecveTiming:  strace.ExecveTimingFromCapture(c, -1),
+		}
+		hasOpens := false
+		for _, ev := range c.Events {
+			switch ev.Kind {
+			case capture.Window:
+				if res.TimeToDisplay == 0 {
+					res.TimeToDisplay = ev.Time.Sub(c.Start)
+				}
+			case capture.Open:
+				hasOpens = true
+			}
+		}
+		if hasOpens {
+			res.ExecvePaths, err = strace.ExecvePathsFromCapture(c, fileRegex, programRegex, nil)
+			if err != nil {
+				return err
+			}
+			if x.Timeline {
+				// the program isn't running anymore, so the files are
+				// looked up in etrace's mount namespace
+				res.Timeline = res.ExecvePaths.Timeline(files.NewSizes("/"))
+			}
+		}
+
+		redactor.ExecveTiming(res.ExecveTiming)
+		var until time.Time
+		if res.TimeToDisplay != 0 {
+			until = c.Start.Add(res.TimeToDisplay)
+		}
+		res.CriticalPath = res.ExecveTiming.CriticalPath(until)
+		redactor.ExecvePaths(res.ExecvePaths)
+		for i := range res.Timeline {
+			res.Timeline[i].Exe = redactor.Path(res.Timeline[i].Exe)
+		}
+		results = append(results, res)
+	}
+
+	if err := outputs.Write(results); err != nil {
+		return err
+	}
+
+	for _, res := range results {
+		fmt.Fprintf(w, "%s:\n", res.Capture)
+		wtab := tabWriterGeneric(w)
+		res.ExecveTiming.Display(wtab, nil)
+		res.CriticalPath.Display(wtab)
+		wtab.Flush()
+		if res.TimeToDisplay != 0 {
+			fmt.Fprintln(w, "Time to display: ", res.TimeToDisplay)
+		}
+		if res.ExecvePaths != nil {
+			wtab := tabWriterGeneric(w)
+			res.ExecvePaths.Display(wtab, &strace.DisplayOptions{NoDisplayPrograms: !x.ShowPrograms})
+			wtab.Flush()
+		}
+		if len(res.Timeline) != 0 {
+			wtab := tabWriterGeneric(w)
+			displayTimeline(wtab, res.Timeline)
+			wtab.Flush()
+		}
+	}
+	return signOutput()
+}
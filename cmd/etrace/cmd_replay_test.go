@@ -0,0 +1,115 @@
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	main "github.com/anonymouse64/etrace/cmd/etrace"
+	"github.com/anonymouse64/etrace/internal/capture"
+	"github.com/anonymouse64/etrace/internal/strace"
+
+	. "gopkg.in/check.v1"
+)
+
+type replayTestSuite struct{}
+
+var _ = Suite(&replayTestSuite{})
+
+var replayLog = `100 1574886785.000000 execve("/usr/bin/app", ["app"], 0x1566008 /* 69 vars */) = 0
+100 1574886785.001000 openat(AT_FDCWD, "/etc/app.conf", O_RDONLY|O_CLOEXEC) = 3</etc/app.conf>
+100 1574886785.010000 +++ exited with 0 +++
+`
+
+func capturePaths(c *capture.Capture) []string {
+	var paths []string
+	for _, ev := range c.Events {
+		if ev.Path != "" {
+			paths = append(paths, ev.Path)
+		}
+	}
+	return paths
+}
+
+func (s *replayTestSuite) TestReadCaptureCachesParsedLogs(c *C) {
+	cacheDir := c.MkDir()
+	defer main.MockParsedLogsDir(cacheDir)()
+
+	log := filepath.Join(c.MkDir(), "strace.log")
+	c.Assert(ioutil.WriteFile(log, []byte(replayLog), 0644), IsNil)
+
+	capt, err := main.ReadCapture(log, strace.ScopeAll, true)
+	c.Assert(err, IsNil)
+	c.Check(capturePaths(capt), DeepEquals, []string{"/usr/bin/app", "/usr/bin/app", "/etc/app.conf"})
+	cached, err := filepath.Glob(filepath.Join(cacheDir, "*-all.etrace"))
+	c.Assert(err, IsNil)
+	c.Assert(cached, HasLen, 1)
+
+	// the log isn't parsed again while it is the same
+	capt.Events = capt.Events[:1]
+	c.Assert(capture.WriteFile(cached[0], capt), IsNil)
+	capt, err = main.ReadCapture(log, strace.ScopeAll, true)
+	c.Assert(err, IsNil)
+	c.Check(capturePaths(capt), DeepEquals, []string{"/usr/bin/app"})
+
+	// unless the cache isn't used
+	capt, err = main.ReadCapture(log, strace.ScopeAll, false)
+	c.Assert(err, IsNil)
+	c.Check(capturePaths(capt), HasLen, 3)
+
+	// a cached capture which can't be read is replaced
+	c.Assert(ioutil.WriteFile(cached[0], []byte("garbage"), 0644), IsNil)
+	capt, err = main.ReadCapture(log, strace.ScopeAll, true)
+	c.Assert(err, IsNil)
+	c.Check(capturePaths(capt), HasLen, 3)
+	capt, err = capture.ReadFile(cached[0])
+	c.Assert(err, IsNil)
+	c.Check(capturePaths(capt), HasLen, 3)
+
+	// another log or scope is cached separately
+	c.Assert(ioutil.WriteFile(log, []byte(strings.Replace(replayLog, "785.010000", "785.020000", 1)), 0644), IsNil)
+	_, err = main.ReadCapture(log, strace.ScopeAll, true)
+	c.Assert(err, IsNil)
+	_, err = main.ReadCapture(log, strace.ScopeFirstExec, true)
+	c.Assert(err, IsNil)
+	cached, err = filepath.Glob(filepath.Join(cacheDir, "*.etrace"))
+	c.Assert(err, IsNil)
+	c.Check(cached, HasLen, 3)
+}
+
+func (s *replayTestSuite) TestReadCaptureRecorded(c *C) {
+	cacheDir := c.MkDir()
+	defer main.MockParsedLogsDir(cacheDir)()
+
+	log := filepath.Join(c.MkDir(), "strace.log")
+	c.Assert(ioutil.WriteFile(log, []byte(replayLog), 0644), IsNil)
+	capt, err := main.ReadCapture(log, strace.ScopeAll, false)
+	c.Assert(err, IsNil)
+
+	// recorded captures are read as they are and not cached
+	recorded := filepath.Join(c.MkDir(), "app.etrace")
+	c.Assert(capture.WriteFile(recorded, capt), IsNil)
+	read, err := main.ReadCapture(recorded, strace.ScopeAll, true)
+	c.Assert(err, IsNil)
+	c.Check(capturePaths(read), DeepEquals, capturePaths(capt))
+	cached, err := filepath.Glob(filepath.Join(cacheDir, "*"))
+	c.Assert(err, IsNil)
+	c.Check(cached, HasLen, 0)
+}
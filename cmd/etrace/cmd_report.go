@@ -0,0 +1,66 @@
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/anonymouse64/etrace/internal/files"
+	"github.com/anonymouse64/etrace/internal/report"
+)
+
+type cmdReport struct {
+	Title string `long:"title" default:"etrace report" description:"The title of the report"`
+
+	Args struct {
+		Files []string `description:"JSON results of etrace exec or etrace file" required:"yes"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+func (x *cmdReport) Execute(args []string) error {
+	results := make([]*report.Result, 0, len(x.Args.Files))
+	for _, file := range x.Args.Files {
+		res, err := loadReportResult(file)
+		if err != nil {
+			return err
+		}
+		results = append(results, res)
+	}
+
+	var w io.Writer = os.Stdout
+	if currentCmd.OutputFile != "" {
+		f, err := files.EnsureExistsAndOpen(currentCmd.OutputFile, true)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	return report.Write(w, x.Title, results)
+}
+
+func loadReportResult(file string) (*report.Result, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return report.Load(f, filepath.Base(file))
+}
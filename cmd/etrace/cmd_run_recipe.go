@@ -0,0 +1,75 @@
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"fmt"
+	"log"
+
+	flags "github.com/jessevdk/go-flags"
+
+	"github.com/anonymouse64/etrace/internal/recipe"
+)
+
+type cmdRunRecipe struct {
+	Args struct {
+		Recipe string `description:"Recipe file written with --emit-recipe" required:"yes"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+func (x *cmdRunRecipe) Execute(args []string) error {
+	r, err := recipe.Read(x.Args.Recipe)
+	if err != nil {
+		return err
+	}
+	for _, arg := range r.Args {
+		if arg == "run-recipe" {
+			return fmt.Errorf("cannot run recipe %s: it runs another recipe", x.Args.Recipe)
+		}
+	}
+
+	// the measurement is still run on a different machine, but the numbers
+	// may not be comparable
+	for _, diff := range r.Differences() {
+		log.Printf("warning: %s", diff)
+	}
+
+	if err := r.Apply(); err != nil {
+		return err
+	}
+
+	// parse the recorded arguments into options of their own so that no
+	// options of this invocation leak into the measurement, they are only the
+	// current options while the recorded command runs, since this invocation
+	// is still being parsed. The errors are printed by the outer parser
+	var recipeCmd Command
+	recipeParser := flags.NewParser(&recipeCmd, flags.HelpFlag|flags.PassDoubleDash)
+	recipeParser.CommandHandler = func(cmd flags.Commander, args []string) error {
+		if cmd == nil {
+			return nil
+		}
+		outer := currentCmd
+		currentCmd = recipeCmd
+		defer func() {
+			currentCmd = outer
+		}()
+		return cmd.Execute(args)
+	}
+	_, err = recipeParser.ParseArgs(r.Args)
+	return err
+}
@@ -0,0 +1,52 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main_test
+
+import (
+	main "github.com/anonymouse64/etrace/cmd/etrace"
+
+	. "gopkg.in/check.v1"
+)
+
+type runRecipeTestSuite struct{}
+
+var _ = Suite(&runRecipeTestSuite{})
+
+func (p *runRecipeTestSuite) TestRecipeArgs(c *C) {
+	tt := []struct {
+		args []string
+		exp  []string
+	}{
+		{
+			[]string{"--emit-recipe=r.yaml", "exec", "-s", "chromium"},
+			[]string{"exec", "-s", "chromium"},
+		},
+		{
+			[]string{"exec", "--emit-recipe", "r.yaml", "--json", "chromium"},
+			[]string{"exec", "--json", "chromium"},
+		},
+		{
+			// arguments of the measured command are kept as is
+			[]string{"exec", "--", "prog", "--emit-recipe", "x"},
+			[]string{"exec", "--", "prog", "--emit-recipe", "x"},
+		},
+	}
+	for _, t := range tt {
+		c.Check(main.RecipeArgs(t.args), DeepEquals, t.exp)
+	}
+}
@@ -0,0 +1,198 @@
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/anonymouse64/etrace/internal/schema"
+	"github.com/anonymouse64/etrace/internal/strace"
+)
+
+type cmdSelftest struct {
+	Runs         uint    `short:"n" long:"runs" default:"10" description:"Number of times to run the command with and without tracing"`
+	MaxVariation float64 `long:"max-variation" default:"10" description:"Percentage of the mean the standard deviation of the untraced runs may be for the system to be considered quiet"`
+
+	Args struct {
+		Cmd []string `description:"Trivial command to measure, /bin/true by default"`
+	} `positional-args:"yes"`
+}
+
+// SelftestTimes is the statistics of the times of a set of runs
+type SelftestTimes struct {
+	Mean   time.Duration
+	StdDev time.Duration
+	// Variation is the standard deviation as a percentage of the mean
+	Variation float64
+}
+
+// SelftestResult is the result of measuring a trivial command with and without
+// tracing
+type SelftestResult struct {
+	// SchemaVersion is the version of the JSON encoding of the result, see
+	// --schema-version
+	SchemaVersion int `json:",omitempty"`
+	Command       []string
+	Untraced      SelftestTimes
+	Traced        SelftestTimes
+	// Overhead is how much longer the command took to run under strace
+	Overhead time.Duration
+	// Quiet is whether the variation of the untraced runs is small enough to
+	// trust measurements
+	Quiet bool
+}
+
+// MarshalJSON encodes the result in its version of the schema.
+func (r SelftestResult) MarshalJSON() ([]byte, error) {
+	type result SelftestResult
+	if r.SchemaVersion < schema.Latest {
+		return json.Marshal(result(r))
+	}
+	return json.Marshal(struct {
+		result
+		Untraced interface{}
+		Traced   interface{}
+		Overhead schema.Duration
+	}{result(r), r.Untraced.structured(), r.Traced.structured(), schema.NewDuration(r.Overhead)})
+}
+
+// structured returns the times as encoded since version 2 of the schema.
+func (t SelftestTimes) structured() interface{} {
+	type plain SelftestTimes
+	return struct {
+		plain
+		Mean   schema.Duration
+		StdDev schema.Duration
+	}{plain(t), schema.NewDuration(t.Mean), schema.NewDuration(t.StdDev)}
+}
+
+func selftestStats(samples []time.Duration) SelftestTimes {
+	mean, stdDev := meanAndStdDev(samples)
+	times := SelftestTimes{Mean: mean, StdDev: stdDev}
+	if mean != 0 {
+		times.Variation = 100 * float64(stdDev) / float64(mean)
+	}
+	return times
+}
+
+// timeCommand runs the command to completion and returns how long it took.
+func timeCommand(cmd *exec.Cmd) (time.Duration, error) {
+	start := time.Now()
+	if err := cmd.Run(); err != nil {
+		return 0, fmt.Errorf("cannot run %v: %v", cmd.Args, err)
+	}
+	return time.Since(start), nil
+}
+
+func (x *cmdSelftest) Execute(args []string) error {
+	if x.Runs < 2 {
+		return fmt.Errorf("cannot measure variance with less than 2 runs")
+	}
+	configureStrace()
+	if err := checkSignOutput(); err != nil {
+		return err
+	}
+
+	targetCmd := x.Args.Cmd
+	if len(targetCmd) == 0 {
+		if currentCmd.RunThroughSnap {
+			return fmt.Errorf("cannot use --use-snap-run without a snap to run")
+		}
+		targetCmd = []string{"/bin/true"}
+	}
+	if currentCmd.RunThroughSnap {
+		targetCmd = append([]string{"snap", "run"}, targetCmd...)
+	}
+
+	straceTmp, err := ioutil.TempDir("", "selftest")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(straceTmp)
+	straceLog := filepath.Join(straceTmp, "strace.log")
+
+	// run once first so that the caches are warm for all measured runs
+	if _, err := timeCommand(exec.Command(targetCmd[0], targetCmd[1:]...)); err != nil {
+		return err
+	}
+
+	// alternate between the untraced and traced runs so that any noise
+	// affects both equally
+	var untraced, traced []time.Duration
+	for i := uint(0); i < x.Runs; i++ {
+		d, err := timeCommand(exec.Command(targetCmd[0], targetCmd[1:]...))
+		if err != nil {
+			return err
+		}
+		untraced = append(untraced, d)
+
+		cmd, err := strace.TraceExecCommand(straceLog, false, strace.ScopeAll, strace.ExecOptions{}, targetCmd...)
+		if err != nil {
+			return err
+		}
+		d, err = timeCommand(cmd)
+		if err != nil {
+			return err
+		}
+		traced = append(traced, d)
+	}
+
+	res := SelftestResult{
+		SchemaVersion: currentCmd.SchemaVersion,
+		Command:       targetCmd,
+		Untraced:      selftestStats(untraced),
+		Traced:        selftestStats(traced),
+	}
+	res.Overhead = res.Traced.Mean - res.Untraced.Mean
+	res.Quiet = res.Untraced.Variation <= x.MaxVariation
+
+	outputs, err := openOutputs(false)
+	if err != nil {
+		return err
+	}
+	defer outputs.Close()
+	w := outputs.Text
+
+	if err := outputs.Write(res); err != nil {
+		return err
+	}
+	if outputs.HasText() {
+		fmt.Fprintf(w, "%d runs of %v:\n", x.Runs, targetCmd)
+		wtab := tabWriterGeneric(w)
+		fmt.Fprintln(wtab, "\tTracing\tMean\tStdDev\tVariation")
+		fmt.Fprintf(wtab, "\tnone\t%v\t%v\t%.1f%%\n", res.Untraced.Mean, res.Untraced.StdDev, res.Untraced.Variation)
+		fmt.Fprintf(wtab, "\tstrace\t%v\t%v\t%.1f%%\n", res.Traced.Mean, res.Traced.StdDev, res.Traced.Variation)
+		wtab.Flush()
+		fmt.Fprintln(w, "Tracer overhead: ", res.Overhead)
+	}
+
+	if err := signOutput(); err != nil {
+		return err
+	}
+	if !res.Quiet {
+		return fmt.Errorf("system is too noisy, the variation of %.1f%% is above %.1f%%", res.Untraced.Variation, x.MaxVariation)
+	}
+	fmt.Fprintln(w, "System is quiet enough for measurements")
+	return nil
+}
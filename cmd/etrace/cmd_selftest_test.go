@@ -0,0 +1,47 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main_test
+
+import (
+	"time"
+
+	main "github.com/anonymouse64/etrace/cmd/etrace"
+
+	. "gopkg.in/check.v1"
+)
+
+type selftestTestSuite struct{}
+
+var _ = Suite(&selftestTestSuite{})
+
+func (p *selftestTestSuite) TestSelftestStats(c *C) {
+	times := main.SelftestStats([]time.Duration{
+		8 * time.Millisecond,
+		10 * time.Millisecond,
+		12 * time.Millisecond,
+		10 * time.Millisecond,
+	})
+	c.Check(times.Mean, Equals, 10*time.Millisecond)
+	// sqrt(8/4) ms
+	c.Check(times.StdDev, Equals, time.Duration(1414213))
+	c.Check(times.Variation > 14.14 && times.Variation < 14.15, Equals, true)
+
+	// all runs took as long
+	times = main.SelftestStats([]time.Duration{time.Millisecond, time.Millisecond})
+	c.Check(times, Equals, main.SelftestTimes{Mean: time.Millisecond})
+}
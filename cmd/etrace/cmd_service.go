@@ -0,0 +1,280 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/anonymouse64/etrace/internal/profiling"
+	"github.com/anonymouse64/etrace/internal/readiness"
+	"github.com/anonymouse64/etrace/internal/schema"
+	"github.com/anonymouse64/etrace/internal/snaps"
+)
+
+type cmdService struct {
+	Repeat        uint     `short:"n" long:"repeat" default:"1" description:"Number of times to restart the services"`
+	Ready         []string `long:"ready" description:"Probe to wait for after the services are active, specified as tcp:HOST:PORT, unix:PATH, file:PATH or an http or https URL, can be specified multiple times"`
+	ProbeInterval string   `long:"probe-interval" default:"20ms" description:"How often to check whether the services are active and the probes are ready"`
+	Timeout       string   `long:"timeout" default:"2m" description:"How long to wait for the services to start and be ready in each run"`
+
+	Args struct {
+		Services []string `description:"Snaps or snap.app services to measure" required:"yes"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+// ServiceRun is the startup of the services in one run
+type ServiceRun struct {
+	// SnapdTime is how long the snapd change starting the services took,
+	// which is until systemd reported them as started
+	SnapdTime time.Duration
+	// TimeToActive is how long after the start was requested all the
+	// services were active
+	TimeToActive time.Duration
+	// TimeToReady is how long after the start was requested all the probes
+	// were ready, which is TimeToActive without probes
+	TimeToReady time.Duration
+	// Probes is how long after the start was requested each probe was ready,
+	// in the order of --ready
+	Probes []time.Duration `json:",omitempty"`
+	Errors []string        `json:",omitempty"`
+}
+
+// ServiceResult is the result of measuring the startup of snap services
+type ServiceResult struct {
+	// SchemaVersion is the version of the JSON encoding of the result, see
+	// --schema-version
+	SchemaVersion int `json:",omitempty"`
+	Services      []string
+	Probes        []string `json:",omitempty"`
+	Runs          []ServiceRun
+}
+
+// MarshalJSON encodes the result in its version of the schema.
+func (r ServiceResult) MarshalJSON() ([]byte, error) {
+	type result ServiceResult
+	if r.SchemaVersion < schema.Latest {
+		return json.Marshal(result(r))
+	}
+	v := struct {
+		result
+		Runs []interface{}
+	}{result: result(r)}
+	if r.Runs != nil {
+		v.Runs = make([]interface{}, 0, len(r.Runs))
+		for _, run := range r.Runs {
+			v.Runs = append(v.Runs, run.structured())
+		}
+	}
+	return json.Marshal(v)
+}
+
+// structured returns the run as encoded since version 2 of the schema.
+func (r ServiceRun) structured() interface{} {
+	type plain ServiceRun
+	return struct {
+		plain
+		SnapdTime    schema.Duration
+		TimeToActive schema.Duration
+		TimeToReady  schema.Duration
+		Probes       []schema.Duration `json:",omitempty"`
+	}{plain(r), schema.NewDuration(r.SnapdTime), schema.NewDuration(r.TimeToActive), schema.NewDuration(r.TimeToReady), schema.Durations(r.Probes)}
+}
+
+// runServiceAction does the action on the services through snapd and waits
+// for it to be done.
+func runServiceAction(action string, names []string, timeout time.Duration) (*snaps.Change, error) {
+	id, err := snaps.ServiceAction(action, names)
+	if err != nil {
+		return nil, fmt.Errorf("cannot %s %s: %v", action, strings.Join(names, ", "), err)
+	}
+	change, err := snaps.WaitChange(id, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("cannot %s %s: %v", action, strings.Join(names, ", "), err)
+	}
+	return change, nil
+}
+
+// waitActive polls snapd until all the services are active and returns how
+// long after start that was.
+func waitActive(ctx context.Context, names []string, start time.Time, interval time.Duration) (time.Duration, error) {
+	for {
+		services, err := snaps.Services(names)
+		if err != nil {
+			return 0, err
+		}
+		var inactive []string
+		for _, s := range services {
+			if !s.Active {
+				inactive = append(inactive, s.FullName())
+			}
+		}
+		if len(inactive) == 0 {
+			return time.Since(start), nil
+		}
+		select {
+		case <-ctx.Done():
+			return 0, fmt.Errorf("%s not active: %v", strings.Join(inactive, ", "), ctx.Err())
+		case <-time.After(interval):
+		}
+	}
+}
+
+// measureServiceStart stops the services, then starts them and measures how
+// long they take to be active and ready.
+func (x *cmdService) measureServiceStart(probes []readiness.Probe, interval, timeout time.Duration) (ServiceRun, error) {
+	var run ServiceRun
+	if _, err := runServiceAction("stop", x.Args.Services, timeout); err != nil {
+		return run, err
+	}
+	if !currentCmd.KeepVMCaches {
+		if err := profiling.FreeCaches(); err != nil {
+			return run, err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	start := time.Now()
+	change, err := runServiceAction("start", x.Args.Services, timeout)
+	if err != nil {
+		return run, err
+	}
+	run.SnapdTime = change.ReadyTime.Sub(change.SpawnTime)
+
+	run.TimeToActive, err = waitActive(ctx, x.Args.Services, start, interval)
+	if err != nil {
+		run.Errors = append(run.Errors, err.Error())
+		return run, nil
+	}
+	run.TimeToReady = run.TimeToActive
+	if len(probes) != 0 {
+		run.Probes, err = readiness.Wait(ctx, probes, start, interval)
+		if err != nil {
+			run.Errors = append(run.Errors, err.Error())
+			return run, nil
+		}
+		for _, t := range run.Probes {
+			if t > run.TimeToReady {
+				run.TimeToReady = t
+			}
+		}
+	}
+	return run, nil
+}
+
+func (x *cmdService) Execute(args []string) error {
+	if x.Repeat == 0 {
+		return fmt.Errorf("invalid setting for --repeat: must be at least 1")
+	}
+	interval, err := time.ParseDuration(x.ProbeInterval)
+	if err != nil {
+		return fmt.Errorf("invalid setting for --probe-interval (%q): %v", x.ProbeInterval, err)
+	}
+	timeout, err := time.ParseDuration(x.Timeout)
+	if err != nil {
+		return fmt.Errorf("invalid setting for --timeout (%q): %v", x.Timeout, err)
+	}
+	var probes []readiness.Probe
+	for _, spec := range x.Ready {
+		p, err := readiness.Parse(spec)
+		if err != nil {
+			return err
+		}
+		probes = append(probes, p)
+	}
+	if err := checkSignOutput(); err != nil {
+		return err
+	}
+
+	// the services which weren't running are stopped again at the end
+	services, err := snaps.Services(x.Args.Services)
+	if err != nil {
+		return err
+	}
+	var inactive []string
+	for _, s := range services {
+		if !s.Active {
+			inactive = append(inactive, s.FullName())
+		}
+	}
+	if len(inactive) != 0 {
+		defer func() {
+			if _, err := runServiceAction("stop", inactive, timeout); err != nil {
+				log.Printf("warning: %v", err)
+			}
+		}()
+	}
+
+	outputs, err := openOutputs(false)
+	if err != nil {
+		return err
+	}
+	defer outputs.Close()
+	w := outputs.Text
+
+	res := ServiceResult{
+		SchemaVersion: currentCmd.SchemaVersion,
+		Services:      x.Args.Services,
+	}
+	for _, p := range probes {
+		res.Probes = append(res.Probes, p.String())
+	}
+	for i := uint(0); i < x.Repeat; i++ {
+		run, err := x.measureServiceStart(probes, interval, timeout)
+		if err != nil {
+			return err
+		}
+		if currentCmd.ShowErrors {
+			for _, e := range run.Errors {
+				log.Println(e)
+			}
+		}
+		res.Runs = append(res.Runs, run)
+	}
+
+	if err := outputs.Write(res); err != nil {
+		return err
+	}
+	if outputs.HasText() {
+		fmt.Fprintf(w, "%d starts of %s:\n", x.Repeat, strings.Join(x.Args.Services, ", "))
+		wtab := tabWriterGeneric(w)
+		fmt.Fprint(wtab, "\tRun\tSnapd\tActive\tReady")
+		for _, p := range res.Probes {
+			fmt.Fprintf(wtab, "\t%s", p)
+		}
+		fmt.Fprintln(wtab, "\tErrors")
+		for i, run := range res.Runs {
+			fmt.Fprintf(wtab, "\t%d\t%v\t%v\t%v", i+1, run.SnapdTime, run.TimeToActive, run.TimeToReady)
+			for j := range res.Probes {
+				t := time.Duration(0)
+				if j < len(run.Probes) {
+					t = run.Probes[j]
+				}
+				fmt.Fprintf(wtab, "\t%v", t)
+			}
+			fmt.Fprintf(wtab, "\t%d\n", len(run.Errors))
+		}
+		wtab.Flush()
+	}
+	return signOutput()
+}
@@ -0,0 +1,48 @@
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/anonymouse64/etrace/internal/signing"
+)
+
+type cmdVerify struct {
+	PublicKey string `long:"public-key" required:"yes" description:"The minisign public key, or the path to the public key file, to verify the signatures with"`
+
+	Args struct {
+		Files []string `description:"Result files to verify, the signatures are read from <file>.minisig" required:"yes"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+func (x *cmdVerify) Execute(args []string) error {
+	failed := 0
+	for _, file := range x.Args.Files {
+		if err := signing.Verify(x.PublicKey, file); err != nil {
+			fmt.Println(err)
+			failed++
+			continue
+		}
+		fmt.Printf("%s: signature verified\n", file)
+	}
+	if failed != 0 {
+		return fmt.Errorf("%d of %d result files failed verification", failed, len(x.Args.Files))
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/anonymouse64/etrace/analysis"
+)
+
+type cmdWatch struct {
+	SnapFile  string `long:"snap-file" description:"Snap file to install with --dangerous and measure again whenever it changes"`
+	SourceDir string `long:"source-dir" description:"Directory to watch for changes, it is installed with snap try if it's an unpacked snap"`
+	Interval  string `long:"interval" default:"2s" description:"How often to check for changes"`
+
+	Args struct {
+		Measurement []string `description:"Arguments of the etrace exec measurement to run on every change" required:"yes"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+// fingerprint returns a hash of the names, sizes and modification times of the
+// files under the paths, which changes whenever any of them changes.
+func fingerprint(paths []string) (uint64, error) {
+	h := fnv.New64a()
+	for _, path := range paths {
+		err := filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, "%s\x00%d\x00%d\x00", p, info.Size(), info.ModTime().UnixNano())
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return h.Sum64(), nil
+}
+
+// waitForChange polls the paths until their fingerprint is different from
+// the given one and then stays the same for an interval, so that a snap which
+// is still being written is not measured.
+func waitForChange(paths []string, last uint64, interval time.Duration) uint64 {
+	for {
+		time.Sleep(interval)
+		fp, err := fingerprint(paths)
+		if err != nil {
+			// the file may be in the middle of being replaced
+			continue
+		}
+		if fp == last {
+			continue
+		}
+		for {
+			time.Sleep(interval)
+			settled, err := fingerprint(paths)
+			if err == nil && settled == fp {
+				return fp
+			}
+			fp = settled
+		}
+	}
+}
+
+// watchDelta describes the measurement compared with the previous one.
+func watchDelta(prev, cur []time.Duration) string {
+	c := analysis.Compare(prev, cur)
+	desc := fmt.Sprintf("time to display %v ± %v over %d runs", c.New.Mean, c.New.StdDev, c.New.N)
+	if len(prev) == 0 {
+		return desc
+	}
+	desc += fmt.Sprintf(", %+v (%+.1f%%) vs previous", c.New.Mean-c.Base.Mean, c.Change)
+	if !c.Significant {
+		desc += " (within noise)"
+	}
+	return desc
+}
+
+func (x *cmdWatch) install() error {
+	var cmd *exec.Cmd
+	switch {
+	case x.SnapFile != "":
+		cmd = exec.Command("snap", "install", "--dangerous", x.SnapFile)
+	case x.SourceDir != "":
+		if _, err := os.Stat(filepath.Join(x.SourceDir, "meta", "snap.yaml")); err != nil {
+			// just sources, which are deployed by something else
+			return nil
+		}
+		cmd = exec.Command("snap", "try", x.SourceDir)
+	default:
+		return nil
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("cannot install %s: %v (%s)", cmd.Args[len(cmd.Args)-1], err, out)
+	}
+	return nil
+}
+
+// measure runs the measurement and returns the times to display of its runs.
+func (x *cmdWatch) measure(output string) ([]time.Duration, error) {
+	args := append([]string{}, x.Args.Measurement[:1]...)
+	args = append(args, "--json", "--output-file="+output)
+	args = append(args, x.Args.Measurement[1:]...)
+	if err := runEtrace(args); err != nil {
+		return nil, err
+	}
+	res, err := analysis.LoadFile(output)
+	if err != nil {
+		return nil, err
+	}
+	for _, err := range res.Errors() {
+		log.Printf("warning: %s", err)
+	}
+	return res.TimesToDisplay(), nil
+}
+
+func (x *cmdWatch) Execute(args []string) error {
+	if x.SnapFile == "" && x.SourceDir == "" {
+		return fmt.Errorf("cannot watch without --snap-file or --source-dir")
+	}
+	if x.Args.Measurement[0] != "exec" {
+		return fmt.Errorf("cannot watch %s measurements, only exec ones", x.Args.Measurement[0])
+	}
+	interval, err := time.ParseDuration(x.Interval)
+	if err != nil {
+		return fmt.Errorf("invalid --interval: %v", err)
+	}
+	var paths []string
+	for _, path := range []string{x.SnapFile, x.SourceDir} {
+		if path != "" {
+			paths = append(paths, path)
+		}
+	}
+
+	tmpDir, err := ioutil.TempDir("", "etrace-watch")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+	output := filepath.Join(tmpDir, "result.json")
+
+	fp, err := fingerprint(paths)
+	if err != nil {
+		return err
+	}
+	var prev []time.Duration
+	for n := 1; ; n++ {
+		// a broken build is reported and waited out like any other change
+		if err := x.install(); err != nil {
+			log.Printf("warning: %v", err)
+		} else if times, err := x.measure(output); err != nil {
+			log.Printf("warning: measurement %d failed: %v", n, err)
+		} else {
+			fmt.Printf("[%s] measurement %d: %s\n", time.Now().Format("15:04:05"), n, watchDelta(prev, times))
+			prev = times
+		}
+		fmt.Fprintln(os.Stderr, "waiting for changes...")
+		fp = waitForChange(paths, fp, interval)
+	}
+}
@@ -0,0 +1,76 @@
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	main "github.com/anonymouse64/etrace/cmd/etrace"
+
+	. "gopkg.in/check.v1"
+)
+
+type watchTestSuite struct{}
+
+var _ = Suite(&watchTestSuite{})
+
+func (s *watchTestSuite) TestFingerprint(c *C) {
+	dir := c.MkDir()
+	file := filepath.Join(dir, "foo.snap")
+	c.Assert(ioutil.WriteFile(file, []byte("foo"), 0644), IsNil)
+	c.Assert(os.Mkdir(filepath.Join(dir, "src"), 0755), IsNil)
+	paths := []string{file, filepath.Join(dir, "src")}
+
+	fp, err := main.Fingerprint(paths)
+	c.Assert(err, IsNil)
+	again, err := main.Fingerprint(paths)
+	c.Assert(err, IsNil)
+	c.Check(again, Equals, fp)
+
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "src", "main.c"), nil, 0644), IsNil)
+	added, err := main.Fingerprint(paths)
+	c.Assert(err, IsNil)
+	c.Check(added, Not(Equals), fp)
+
+	later := time.Now().Add(time.Hour)
+	c.Assert(os.Chtimes(file, later, later), IsNil)
+	touched, err := main.Fingerprint(paths)
+	c.Assert(err, IsNil)
+	c.Check(touched, Not(Equals), added)
+
+	_, err = main.Fingerprint([]string{filepath.Join(dir, "missing")})
+	c.Check(err, NotNil)
+}
+
+func (s *watchTestSuite) TestWatchDelta(c *C) {
+	ms := func(ds ...int) []time.Duration {
+		var times []time.Duration
+		for _, d := range ds {
+			times = append(times, time.Duration(d)*time.Millisecond)
+		}
+		return times
+	}
+	c.Check(main.WatchDelta(nil, ms(100, 100)), Equals, "time to display 100ms ± 0s over 2 runs")
+	c.Check(main.WatchDelta(ms(100, 102, 98), ms(80, 81, 79)), Equals,
+		"time to display 80ms ± 816.496µs over 3 runs, -20ms (-20.0%) vs previous")
+	c.Check(main.WatchDelta(ms(100, 150, 50), ms(90, 140, 40)), Equals,
+		"time to display 90ms ± 40.824829ms over 3 runs, -10ms (-10.0%) vs previous (within noise)")
+}
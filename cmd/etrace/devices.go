@@ -0,0 +1,100 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Device profiles which can be selected with --device
+const (
+	deviceAuto        = "auto"
+	deviceDesktop     = "desktop"
+	deviceARM         = "arm"
+	deviceRaspberryPi = "raspberry-pi"
+)
+
+// deviceProfile tunes the measurements for a class of hardware, so that
+// measuring on slow boards works without tweaking every option
+type deviceProfile struct {
+	// windowTimeout replaces the default --window-timeout, as programs take
+	// much longer to start on slow boards
+	windowTimeout time.Duration
+	// maxRepeat caps the number of runs of the measurement profiles
+	maxRepeat uint
+	// coolDownC is the --cool-down if it isn't specified, as boards without
+	// fans throttle after a few runs
+	coolDownC float64
+}
+
+var deviceProfiles = map[string]deviceProfile{
+	deviceDesktop: {},
+	deviceARM: {
+		windowTimeout: 3 * time.Minute,
+		maxRepeat:     5,
+		coolDownC:     65,
+	},
+	deviceRaspberryPi: {
+		windowTimeout: 5 * time.Minute,
+		maxRepeat:     3,
+		coolDownC:     60,
+	},
+}
+
+// defaultWindowTimeout is the default of --window-timeout, which device
+// profiles replace
+const defaultWindowTimeout = "60s"
+
+// coolDownTimeout is the longest to wait for the machine to cool down between
+// runs
+const coolDownTimeout = 5 * time.Minute
+
+// deviceTreeModel has the model of boards described by a device tree
+var deviceTreeModel = "/proc/device-tree/model"
+
+// detectDevice returns the device profile which suits the machine.
+func detectDevice() string {
+	model, _ := ioutil.ReadFile(deviceTreeModel)
+	if strings.Contains(string(model), "Raspberry Pi") {
+		return deviceRaspberryPi
+	}
+	if runtime.GOARCH == "arm" || runtime.GOARCH == "arm64" {
+		return deviceARM
+	}
+	return deviceDesktop
+}
+
+// applyDevice sets the options of the device profile selected with --device,
+// or detected, which are not specified, and returns the profile.
+func (x *cmdExec) applyDevice() deviceProfile {
+	if x.Device == "" || x.Device == deviceAuto {
+		x.Device = detectDevice()
+	}
+	device := deviceProfiles[x.Device]
+	// also for the global command
+	if device.windowTimeout != 0 && currentCmd.WindowWaitGlobalTimeout == defaultWindowTimeout {
+		currentCmd.WindowWaitGlobalTimeout = device.windowTimeout.String()
+	}
+	if x.CoolDown == 0 {
+		x.CoolDown = device.coolDownC
+	}
+	return device
+}
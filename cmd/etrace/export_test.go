@@ -18,4 +18,188 @@ package main
 
 var (
 	MeanAndStdDevForRuns = meanAndStdDevForRuns
+	CrossCheckTimings    = crossCheckTimings
+	SelftestStats        = selftestStats
+	WindowTimes          = windowTimes
+	AccessViolations     = accessViolations
+	RunsDispersion       = runsDispersion
+	RunsSummary          = runsSummary
 )
+
+var RecipeArgs = recipeArgs
+
+var WriteAccessRecordsCSV = writeAccessRecordsCSV
+
+type ProgramRoot = programRoot
+
+var WatchProgramRoot = watchProgramRoot
+
+var DisplayTrend = displayTrend
+
+var (
+	SplitCommands     = splitCommands
+	DisplayComparison = displayComparison
+)
+
+var ParseWithProfile = parseWithProfile
+
+var ReadCapture = readCapture
+
+// WithTable returns the result with the table of the tabular outputs set like
+// with --table.
+func WithTable(r ExecOutputResult, table string) ExecOutputResult {
+	r.table = table
+	return r
+}
+
+func MockParsedLogsDir(dir string) (restore func()) {
+	old := parsedLogsDir
+	parsedLogsDir = func() (string, error) {
+		return dir, nil
+	}
+	return func() {
+		parsedLogsDir = old
+	}
+}
+
+// SelfProfile starts the profiles of --self-profile and returns the function
+// writing them.
+func SelfProfile(dir string) (stop func() error, err error) {
+	p, err := startSelfProfile(dir)
+	if err != nil {
+		return nil, err
+	}
+	return p.stop, nil
+}
+
+var WaitDaemonized = waitDaemonized
+
+var (
+	WaitExit      = waitExit
+	KillLeftovers = killLeftovers
+)
+
+func MockDeviceTreeModel(new string) (restore func()) {
+	old := deviceTreeModel
+	deviceTreeModel = new
+	return func() {
+		deviceTreeModel = old
+	}
+}
+
+// ApplyDevice applies the device profile and returns the device, window
+// timeout and cool-down it selected.
+func ApplyDevice(device, windowTimeout string, coolDown float64) (string, string, float64) {
+	oldTimeout := currentCmd.WindowWaitGlobalTimeout
+	defer func() {
+		currentCmd.WindowWaitGlobalTimeout = oldTimeout
+	}()
+	currentCmd.WindowWaitGlobalTimeout = windowTimeout
+	x := &cmdExec{Device: device, CoolDown: coolDown}
+	x.applyDevice()
+	return x.Device, currentCmd.WindowWaitGlobalTimeout, x.CoolDown
+}
+
+// SelectChecks returns the names of the checks analyze-snap selects.
+func SelectChecks(list string, sandboxed bool) ([]string, error) {
+	checks, err := selectChecks(list, sandboxed)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(checks))
+	for _, check := range checks {
+		names = append(names, check.name)
+	}
+	return names, nil
+}
+
+type Findings struct {
+	AltCompression                                string
+	ColdChange, HotChange, ReadChange, SizeChange *float64
+	LocaleBytes                                   int64
+	LoadersWithoutCache                           []string
+}
+
+func Recommend(f Findings) []Recommendation {
+	return recommend(&findings{
+		altCompression:      f.AltCompression,
+		coldChange:          f.ColdChange,
+		hotChange:           f.HotChange,
+		readChange:          f.ReadChange,
+		sizeChange:          f.SizeChange,
+		localeBytes:         f.LocaleBytes,
+		loadersWithoutCache: f.LoadersWithoutCache,
+	})
+}
+
+var (
+	Fingerprint = fingerprint
+	WatchDelta  = watchDelta
+)
+
+// ProfileOptions is the exec options set by measurement profiles.
+type ProfileOptions struct {
+	Profile           string
+	Cold, Hot         bool
+	Repeat            uint
+	CleanSnapUserData bool
+	ReinstallSnap     bool
+	FreshHome         bool
+	FontCache         string
+	PrimeCache        bool
+	Warmup            bool
+	KeepVMCaches      bool
+	DiscardSnapNs     bool
+	Cgroup            bool
+	CPULimit          float64
+	MemoryLimit       uint
+	// MaxRepeat is the cap of the device profile on the runs
+	MaxRepeat uint
+	// RunThroughSnap is whether the command is run with --use-snap-run
+	RunThroughSnap bool
+}
+
+// ApplyProfile applies the profile selected in the options to them.
+func ApplyProfile(opts ProfileOptions) (ProfileOptions, error) {
+	oldKeep, oldDiscard, oldSnapRun := currentCmd.KeepVMCaches, currentCmd.DiscardSnapNs, currentCmd.RunThroughSnap
+	defer func() {
+		currentCmd.KeepVMCaches, currentCmd.DiscardSnapNs, currentCmd.RunThroughSnap = oldKeep, oldDiscard, oldSnapRun
+	}()
+	currentCmd.RunThroughSnap = opts.RunThroughSnap
+	x := &cmdExec{
+		Profile:       opts.Profile,
+		ColdWorstCase: opts.Cold,
+		HotBestCase:   opts.Hot,
+		Repeat:        opts.Repeat,
+		CPULimit:      opts.CPULimit,
+		MemoryLimit:   opts.MemoryLimit,
+	}
+	if err := x.applyProfile(deviceProfile{maxRepeat: opts.MaxRepeat}); err != nil {
+		return ProfileOptions{}, err
+	}
+	return ProfileOptions{
+		Profile:           x.Profile,
+		Cold:              x.ColdWorstCase,
+		Hot:               x.HotBestCase,
+		Repeat:            x.Repeat,
+		CleanSnapUserData: x.CleanSnapUserData,
+		ReinstallSnap:     x.ReinstallSnap,
+		FreshHome:         x.FreshHome,
+		FontCache:         x.FontCache,
+		PrimeCache:        x.PrimeCache,
+		Warmup:            x.Warmup,
+		KeepVMCaches:      currentCmd.KeepVMCaches,
+		DiscardSnapNs:     currentCmd.DiscardSnapNs,
+		Cgroup:            x.Cgroup,
+		CPULimit:          x.CPULimit,
+		MemoryLimit:       x.MemoryLimit,
+	}, nil
+}
+
+// CompareWithPrevious compares the runs of the command with the previous
+// measurement of it with the profile.
+func CompareWithPrevious(cmd []string, runs []Execution, profile string, mounts []string, revisions map[string]string, last uint) (*PreviousComparison, error) {
+	x := &cmdExec{History: last}
+	x.Args.Cmd = cmd
+	return x.compareWithPrevious(runs, profile, mounts, revisions)
+}
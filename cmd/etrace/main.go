@@ -24,11 +24,24 @@ import (
 	"log"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 	"syscall"
 	"text/tabwriter"
+	"time"
 
 	flags "github.com/jessevdk/go-flags"
+
+	"github.com/anonymouse64/etrace/internal/capture"
+	"github.com/anonymouse64/etrace/internal/files"
+	"github.com/anonymouse64/etrace/internal/profiling"
+	"github.com/anonymouse64/etrace/internal/recipe"
+	"github.com/anonymouse64/etrace/internal/redact"
+	"github.com/anonymouse64/etrace/internal/signing"
+	"github.com/anonymouse64/etrace/internal/sinks"
+	"github.com/anonymouse64/etrace/internal/statecheck"
+	"github.com/anonymouse64/etrace/internal/strace"
+	"github.com/anonymouse64/etrace/internal/xdotool"
 )
 
 // Command is the command for the runner
@@ -36,12 +49,24 @@ type Command struct {
 	File                    cmdFile        `command:"file" description:"Trace files accessed from a program"`
 	Exec                    cmdExec        `command:"exec" description:"Trace the program executions from a program"`
 	AnalyzeSnap             cmdAnalyzeSnap `command:"analyze-snap" description:"Analyze a snap for performance data"`
+	Verify                  cmdVerify      `command:"verify" description:"Verify the signatures of result files"`
+	Replay                  cmdReplay      `command:"replay" description:"Analyze traces recorded with --record"`
+	RunRecipe               cmdRunRecipe   `command:"run-recipe" description:"Run a measurement again from a recipe written with --emit-recipe"`
+	Selftest                cmdSelftest    `command:"selftest" description:"Check that the system is quiet enough for measurements"`
+	CI                      cmdCI          `command:"ci" description:"Check a program against the expectations of a QA suite"`
+	Watch                   cmdWatch       `command:"watch" description:"Measure a snap again whenever it changes"`
+	Compare                 cmdCompare     `command:"compare" description:"Compare the startup of two commands, or of two channels of a snap"`
+	Service                 cmdService     `command:"service" description:"Measure how long the services of snaps take to start and be ready through snapd, without a desktop session"`
+	Explore                 cmdExplore     `command:"explore" description:"Browse the processes and file accesses of results interactively"`
+	Report                  cmdReport      `command:"report" description:"Write an HTML report of result files"`
+	History                 cmdHistory     `command:"history" description:"Show the measurements kept to compare with the previous one"`
 	ShowErrors              bool           `short:"e" long:"errors" description:"Show errors as they happen"`
 	WindowName              string         `short:"w" long:"window-name" description:"Window name to wait for"`
 	PrepareScript           string         `short:"p" long:"prepare-script" description:"Script to run to prepare a run"`
 	PrepareScriptArgs       []string       `long:"prepare-script-args" description:"Args to provide to the prepare script"`
 	RestoreScript           string         `short:"r" long:"restore-script" description:"Script to run to restore after a run"`
 	RestoreScriptArgs       []string       `long:"restore-script-args" description:"Args to provide to the restore script"`
+	CheckState              []string       `long:"check-state" description:"Record a checksum of this path before the prepare script runs and report it as drift if it differs after the restore script ran, can be specified multiple times"`
 	KeepVMCaches            bool           `short:"v" long:"keep-vm-caches" description:"Don't free VM caches before executing"`
 	WindowClass             string         `short:"c" long:"class-name" description:"Window class to use with xdotool instead of the the first Command"`
 	WindowClassName         string         `long:"window-class-name" description:"Window class name to use with xdotool"`
@@ -53,8 +78,23 @@ type Command struct {
 	SilentProgram           bool           `long:"silent" description:"Silence all program output"`
 	JSONOutput              bool           `short:"j" long:"json" description:"Output results in JSON"`
 	OutputFile              string         `short:"o" long:"output-file" description:"A file to output the results (empty string means stdout)"`
+	Outputs                 []string       `long:"output" description:"Write the results in a format to a file, specified as FORMAT=PATH where FORMAT is text, json, ndjson, csv, sqlite, trace-event or folded and a PATH of - is stdout, instead of --json and --output-file, can be specified multiple times"`
 	NoWindowWait            bool           `long:"no-window-wait" description:"Don't wait for the window to appear, just run until the program exits"`
 	WindowWaitGlobalTimeout string         `long:"window-timeout" default:"60s" description:"Global timeout for waiting for windows to appear. Set to empty string to use no timeout"`
+	WindowActiveWorkspace   bool           `long:"window-active-workspace" description:"Only match windows on the active workspace"`
+	WindowNewOnly           bool           `long:"window-new-only" description:"Only match windows which appeared after the program was started, ignoring pre-existing windows of the same class"`
+	CloseFallbacks          []string       `long:"close-fallback" default:"wmctrl" choice:"wmctrl" choice:"xkill" choice:"none" description:"Tool to close windows with when xdotool fails to, can be specified multiple times to try several in turn"`
+	WindowTool              string         `long:"window-tool" default:"auto" choice:"auto" choice:"xdotool" choice:"kwin" choice:"sway" choice:"gnome-shell" description:"Tool to use for waiting for and closing windows, auto detects the best one for the session"`
+	RedactHome              bool           `long:"redact-home" description:"Replace home directories in paths and errors in the results with $HOME"`
+	RewritePaths            []string       `long:"rewrite-path" description:"Rewrite paths under FROM to be under TO instead in the results, specified as FROM=TO"`
+	SignKey                 string         `long:"sign-key" description:"Sign the output file with this minisign secret key, writing the signature to <output-file>.minisig"`
+	EmitRecipe              string         `long:"emit-recipe" description:"Write a YAML recipe with the command, flags, environment, snap revisions and host facts of the measurement to this file, to reproduce it with etrace run-recipe"`
+	Record                  string         `long:"record" description:"Record the trace of each run to this file in etrace's capture format to analyze it again later with etrace replay, runs after the first have the run number appended"`
+	SchemaVersion           int            `long:"schema-version" default:"1" choice:"1" choice:"2" description:"Version of the JSON output, 1 encodes durations as nanoseconds and 2 as objects with the nanoseconds and the duration as text"`
+	TraceScope              string         `long:"trace-scope" default:"all" choice:"all" choice:"first-exec" choice:"direct-children" description:"Processes to keep in the trace, first-exec keeps only the programs executed by the initial process and direct-children also the processes it forks itself"`
+	PrivateSessionBus       bool           `long:"private-session-bus" description:"Run the program with a throwaway D-Bus session bus started for each run instead of the bus of the user session, so that the services it activates don't depend on the state of the session"`
+	Privileged              bool           `long:"privileged" description:"Trace the program as root instead of as the current user, so that setuid programs and programs elevating with pkexec or sudo are traced too. The program runs with full root privileges, so only use this with trusted programs"`
+	ExcludeSyscalls         []string       `long:"exclude-syscalls" description:"System calls not to trace with strace, separated by commas, instead of the default ones which make strace hang that strace knows on the architecture, none traces all system calls, can be specified multiple times"`
 }
 
 // The current input command
@@ -120,7 +160,11 @@ func main() {
 	}
 
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	started := time.Now()
 	_, err = parser.Parse()
+	if currentCmd.Privileged {
+		fixOutputOwnership(started)
+	}
 	if err != nil {
 		os.Exit(1)
 	}
@@ -143,3 +187,345 @@ func logError(err error) {
 		log.Println(err)
 	}
 }
+
+// runPrepareScript records the state of the paths of --check-state and runs
+// the prepare script, if there is one. The state is nil if no paths are
+// checked.
+func runPrepareScript() statecheck.State {
+	var state statecheck.State
+	if len(currentCmd.CheckState) != 0 {
+		var err error
+		state, err = statecheck.Record(currentCmd.CheckState)
+		if err != nil {
+			logError(err)
+		}
+	}
+	if currentCmd.PrepareScript != "" {
+		err := profiling.RunScript(currentCmd.PrepareScript, currentCmd.PrepareScriptArgs)
+		if err != nil {
+			logError(fmt.Errorf("running prepare script: %w", err))
+		}
+	}
+	return state
+}
+
+// runRestoreScript runs the restore script, if there is one, and reports the
+// paths of --check-state which are not back in the state they were in before
+// the prepare script ran, since the next runs would start from a different
+// state.
+func runRestoreScript(before statecheck.State) {
+	if currentCmd.RestoreScript != "" {
+		err := profiling.RunScript(currentCmd.RestoreScript, currentCmd.RestoreScriptArgs)
+		if err != nil {
+			logError(fmt.Errorf("running restore script: %w", err))
+		}
+	}
+	if before == nil {
+		return
+	}
+	now, err := statecheck.Record(currentCmd.CheckState)
+	if err != nil {
+		logError(err)
+		return
+	}
+	for _, drift := range before.Drift(now) {
+		logError(fmt.Errorf("state drift: %s", drift))
+	}
+}
+
+// resultRedactor returns the redactor to apply to the results before they are
+// output, as specified by --redact-home and --rewrite-path.
+func resultRedactor() (*redact.Redactor, error) {
+	rules := make([]redact.Rule, 0, len(currentCmd.RewritePaths))
+	for _, s := range currentCmd.RewritePaths {
+		rule, err := redact.ParseRule(s)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	// the home directory is only used if it is not under /home already
+	home, _ := os.UserHomeDir()
+	return redact.New(rules, currentCmd.RedactHome, home), nil
+}
+
+// windowToolName returns the tool to use for windows as specified by
+// --window-tool.
+func windowToolName() string {
+	if currentCmd.WindowTool == "" || currentCmd.WindowTool == "auto" {
+		return xdotool.DetectTool()
+	}
+	return currentCmd.WindowTool
+}
+
+// checkWindowTool checks that the tool to use for windows works with the
+// current session.
+func checkWindowTool() error {
+	switch windowToolName() {
+	case xdotool.ToolXDoTool:
+		// xdotool only works on X11
+		sessionType := os.Getenv("XDG_SESSION_TYPE")
+		if strings.TrimSpace(strings.ToLower(sessionType)) != "x11" {
+			return fmt.Errorf("error: graphical session type %s is unsupported by xdotool, only x11 is supported (see --window-tool)", sessionType)
+		}
+	case xdotool.ToolSway:
+		if os.Getenv("SWAYSOCK") == "" {
+			return fmt.Errorf("error: cannot use sway for windows without $SWAYSOCK")
+		}
+	case xdotool.ToolGnomeShell:
+		if err := xdotool.CheckGnomeShell(); err != nil {
+			return fmt.Errorf("error: cannot use gnome-shell for windows: %v", err)
+		}
+	}
+	return nil
+}
+
+// windowTool returns the tool to use for windows.
+func windowTool() xdotool.Xtooler {
+	switch windowToolName() {
+	case xdotool.ToolKWin:
+		return xdotool.MakeKWinTool()
+	case xdotool.ToolSway:
+		return xdotool.MakeSwayTool(os.Getenv("SWAYSOCK"))
+	case xdotool.ToolGnomeShell:
+		return xdotool.MakeGnomeShellTool()
+	default:
+		return withCloseFallbacks(xdotool.MakeXDoTool())
+	}
+}
+
+// closeWindowTool unloads what the window tool loaded into the compositor to
+// follow its windows.
+func closeWindowTool() {
+	if err := xdotool.Close(); err != nil {
+		logError(fmt.Errorf("closing the window tool: %w", err))
+	}
+}
+
+// inputTool returns the tool to send input to the windows of the window tool
+// with.
+func inputTool() string {
+	if windowToolName() == xdotool.ToolXDoTool {
+		return xdotool.InputXDoTool
+	}
+	// the compositors don't use X11 window IDs
+	return xdotool.InputYDoTool
+}
+
+// withCloseFallbacks adds the tools specified by --close-fallback to close
+// windows with when the given tool fails to.
+func withCloseFallbacks(xtool xdotool.Xtooler) xdotool.Xtooler {
+	var closers []string
+	for _, closer := range currentCmd.CloseFallbacks {
+		if closer != "none" {
+			closers = append(closers, closer)
+		}
+	}
+	withFallbacks, err := xdotool.WithFallbackClosers(xtool, closers)
+	if err != nil {
+		logError(err)
+		return xtool
+	}
+	return withFallbacks
+}
+
+// configureStrace sets the system calls not to trace as specified by
+// --exclude-syscalls.
+func configureStrace() {
+	if len(currentCmd.ExcludeSyscalls) == 0 {
+		return
+	}
+	var names []string
+	for _, arg := range currentCmd.ExcludeSyscalls {
+		for _, name := range strings.Split(arg, ",") {
+			name = strings.TrimSpace(name)
+			if name != "" && name != "none" {
+				names = append(names, name)
+			}
+		}
+	}
+	strace.SetExcludedSyscalls(names)
+}
+
+// warnPrivileged warns that the program will run as root if --privileged was
+// specified.
+func warnPrivileged() {
+	if currentCmd.Privileged {
+		log.Println("warning: --privileged was specified, the program will run as root")
+	}
+}
+
+// fixOutputOwnership gives the files written by etrace back to the user who ran
+// it with sudo, since with --privileged they are written as root, along with
+// the files the program wrote to the home of that user since etrace started.
+func fixOutputOwnership(started time.Time) {
+	paths := []string{
+		currentCmd.OutputFile,
+		currentCmd.ProgramStdoutLog,
+		currentCmd.ProgramStderrLog,
+		currentCmd.EmitRecipe,
+	}
+	if currentCmd.OutputFile != "" {
+		paths = append(paths, signing.SignatureFile(currentCmd.OutputFile))
+	}
+	if specs, err := outputSpecs(); err == nil {
+		for _, spec := range specs {
+			if spec.Path != sinks.Stdout {
+				paths = append(paths, spec.Path, signing.SignatureFile(spec.Path))
+			}
+		}
+	}
+	if currentCmd.Record != "" {
+		// the runs after the first have the run number appended
+		runs, _ := filepath.Glob(currentCmd.Record + ".[0-9]*")
+		paths = append(paths, currentCmd.Record)
+		paths = append(paths, runs...)
+	}
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		if err := files.ChownToSudoUser(path); err != nil {
+			log.Printf("warning: cannot change owner of %s: %v", path, err)
+		}
+	}
+	// the program keeps the environment, so it used the home of the user
+	// when sudo kept it
+	if home := os.Getenv("HOME"); home != "" {
+		if err := files.ChownTreeToSudoUser(home, started); err != nil {
+			log.Printf("warning: cannot change owner of the files written to %s: %v", home, err)
+		}
+	}
+}
+
+// outputSpecs returns the outputs to write the results to, as specified with
+// --output or with the older --json and --output-file.
+func outputSpecs() ([]sinks.Spec, error) {
+	if len(currentCmd.Outputs) == 0 {
+		spec := sinks.Spec{Format: sinks.FormatText, Path: sinks.Stdout}
+		if currentCmd.JSONOutput {
+			spec.Format = sinks.FormatJSON
+		}
+		if currentCmd.OutputFile != "" {
+			spec.Path = currentCmd.OutputFile
+		}
+		return []sinks.Spec{spec}, nil
+	}
+	if currentCmd.JSONOutput || currentCmd.OutputFile != "" {
+		return nil, fmt.Errorf("cannot use --output with --json or --output-file")
+	}
+	specs := make([]sinks.Spec, 0, len(currentCmd.Outputs))
+	for _, s := range currentCmd.Outputs {
+		spec, err := sinks.ParseSpec(s)
+		if err != nil {
+			return nil, err
+		}
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
+// openOutputs opens the outputs to write the results to, csv and sqlite are
+// only allowed for tabular results.
+func openOutputs(tabular bool) (*sinks.Outputs, error) {
+	specs, err := outputSpecs()
+	if err != nil {
+		return nil, err
+	}
+	return sinks.Open(specs, tabular)
+}
+
+// outputFiles returns the files the results are written to which can be
+// signed, which are all of them except for stdout and the SQLite databases
+// which keep the results of previous measurements too.
+func outputFiles() []string {
+	specs, err := outputSpecs()
+	if err != nil {
+		return nil
+	}
+	var paths []string
+	for _, spec := range specs {
+		if spec.Path != sinks.Stdout && spec.Format != sinks.FormatSQLite {
+			paths = append(paths, spec.Path)
+		}
+	}
+	return paths
+}
+
+// checkSignOutput checks that the output can be signed if --sign-key was
+// specified.
+func checkSignOutput() error {
+	if currentCmd.SignKey != "" && len(outputFiles()) == 0 {
+		return fmt.Errorf("cannot use --sign-key without --output-file or an --output to a file")
+	}
+	return nil
+}
+
+// signOutput signs the output files if --sign-key was specified.
+func signOutput() error {
+	if currentCmd.SignKey == "" {
+		return nil
+	}
+	for _, path := range outputFiles() {
+		if err := signing.Sign(currentCmd.SignKey, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordCapture writes the capture of a run to the file specified with
+// --record, adding the windows which appeared at the given time.
+func recordCapture(c *capture.Capture, run uint, wids []string, windowTime time.Time) error {
+	if currentCmd.Record == "" {
+		return nil
+	}
+	for _, wid := range wids {
+		c.Events = append(c.Events, capture.Event{
+			Kind:   capture.Window,
+			Time:   windowTime,
+			Window: wid,
+		})
+	}
+	path := currentCmd.Record
+	if run > 0 {
+		path = fmt.Sprintf("%s.%d", path, run+1)
+	}
+	if err := capture.WriteFile(path, c); err != nil {
+		return fmt.Errorf("cannot record trace: %v", err)
+	}
+	return nil
+}
+
+// recipeArgs returns the arguments etrace was run with without --emit-recipe,
+// so that running the recipe doesn't overwrite it.
+func recipeArgs(args []string) []string {
+	out := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "--":
+			return append(out, args[i:]...)
+		case args[i] == "--emit-recipe":
+			// skip the value too
+			i++
+			continue
+		case strings.HasPrefix(args[i], "--emit-recipe="):
+			continue
+		}
+		out = append(out, args[i])
+	}
+	return out
+}
+
+// emitRecipe writes the recipe of the current measurement if --emit-recipe was
+// specified, snap is the snap being measured if any.
+func emitRecipe(snap string) error {
+	if currentCmd.EmitRecipe == "" {
+		return nil
+	}
+	r := recipe.New(recipeArgs(os.Args[1:]), snap)
+	if err := recipe.Write(currentCmd.EmitRecipe, r); err != nil {
+		return fmt.Errorf("cannot write recipe: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// measurementProfile is a named combination of exec options for measuring a
+// program in a particular situation, so that everyone measuring for example
+// cold starts measures them the same way
+type measurementProfile struct {
+	// cold is whether the runs start cold, with the VM caches dropped, the
+	// snap namespace discarded and the snap reinstalled with clean user data,
+	// otherwise all of them are kept
+	cold bool
+	// freshHome is whether the runs start with an empty home directory and
+	// no font or shader caches, like the first run after installing
+	freshHome bool
+	// primeCache is whether the snap is read into the page cache before
+	// each run, so that hot runs don't depend on a cold first run
+	primeCache bool
+	// warmup is whether the program is run once before the runs without
+	// measuring it, so that its own files are cached too
+	warmup bool
+	// repeat is the number of runs if --repeat isn't specified
+	repeat uint
+	// cpus and memoryMiB limit the runs to the resources of a slower
+	// machine, 0 means no limit
+	cpus      float64
+	memoryMiB uint
+}
+
+// measurementProfiles are the profiles which can be selected with --profile
+var measurementProfiles = map[string]measurementProfile{
+	"cold": {
+		cold:   true,
+		repeat: 10,
+	},
+	"hot": {
+		repeat:     10,
+		primeCache: true,
+		warmup:     true,
+	},
+	"first-run": {
+		cold:      true,
+		freshHome: true,
+		// reinstalling the snap and generating the caches is slow
+		repeat: 5,
+	},
+	"low-end": {
+		cold:      true,
+		repeat:    10,
+		cpus:      1,
+		memoryMiB: 2048,
+	},
+}
+
+// profileNames returns the names of the profiles in order.
+func profileNames() []string {
+	names := make([]string, 0, len(measurementProfiles))
+	for name := range measurementProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// applyProfile sets the options of the profile selected with --profile, or
+// with the older --cold and --hot which keep doing a single run by default.
+// The options of the profile override the ones specified, except for the
+// number of runs and the resource limits. The number of runs is capped by the
+// device profile.
+func (x *cmdExec) applyProfile(device deviceProfile) error {
+	name := x.Profile
+	repeat := name != ""
+	for _, legacy := range []struct {
+		set  bool
+		name string
+	}{{x.ColdWorstCase, "cold"}, {x.HotBestCase, "hot"}} {
+		if !legacy.set {
+			continue
+		}
+		if name != "" && name != legacy.name {
+			return fmt.Errorf("cannot use --%s with --profile=%s", legacy.name, name)
+		}
+		name = legacy.name
+	}
+	if name == "" {
+		return nil
+	}
+	profile, ok := measurementProfiles[name]
+	if !ok {
+		return fmt.Errorf("unknown profile %q, available profiles are %s", name, strings.Join(profileNames(), ", "))
+	}
+	x.Profile = name
+
+	x.CleanSnapUserData = profile.cold
+	x.ReinstallSnap = profile.cold
+	// also for the global command
+	currentCmd.KeepVMCaches = !profile.cold
+	currentCmd.DiscardSnapNs = profile.cold
+
+	if profile.primeCache {
+		x.PrimeCache = true
+	}
+	if profile.warmup {
+		x.Warmup = true
+	}
+	if profile.freshHome {
+		// snaps start without their user data with --clean-snap-user-data
+		// instead, which the profiles of cold runs use
+		x.FreshHome = !currentCmd.RunThroughSnap
+		x.FontCache = "delete"
+		x.ShaderCache = "clear"
+	}
+	if x.Repeat == 0 && repeat {
+		x.Repeat = profile.repeat
+		if device.maxRepeat != 0 && x.Repeat > device.maxRepeat {
+			x.Repeat = device.maxRepeat
+		}
+	}
+	if profile.cpus != 0 || profile.memoryMiB != 0 {
+		// the limits are applied to the cgroup of each run
+		x.Cgroup = true
+		if x.CPULimit == 0 {
+			x.CPULimit = profile.cpus
+		}
+		if x.MemoryLimit == 0 {
+			x.MemoryLimit = profile.memoryMiB
+		}
+	}
+	return nil
+}
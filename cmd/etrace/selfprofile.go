@@ -0,0 +1,127 @@
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"syscall"
+	"time"
+
+	"github.com/anonymouse64/etrace/internal/schema"
+)
+
+// Diagnostics is about etrace itself rather than the program, to tell when
+// etrace is the bottleneck of the measurements
+type Diagnostics struct {
+	// ParseTime is the CPU time etrace spent parsing the trace of the run,
+	// while the program ran and after
+	ParseTime time.Duration
+	// ParseWait is how long the results of the run waited for the parsing
+	// of the trace to finish after the program was done
+	ParseWait time.Duration
+}
+
+// structured returns the diagnostics as encoded since version 2 of the schema.
+func (d *Diagnostics) structured() interface{} {
+	return struct {
+		ParseTime schema.Duration
+		ParseWait schema.Duration
+	}{schema.NewDuration(d.ParseTime), schema.NewDuration(d.ParseWait)}
+}
+
+// parseProfileLabel is the pprof label of the parsing in the profiles of
+// --self-profile, so that they can be focused on it with
+// go tool pprof -tagfocus=etrace=parse
+var parseProfileLabel = pprof.Labels("etrace", "parse")
+
+// rusageThread is RUSAGE_THREAD, which the syscall package doesn't have
+const rusageThread = 1
+
+// threadCPUTime returns the CPU time used by the calling thread.
+func threadCPUTime() (time.Duration, error) {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(rusageThread, &ru); err != nil {
+		return 0, err
+	}
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano()), nil
+}
+
+// parseWithProfile runs the parsing function with the pprof label of the
+// parsing and returns the CPU time it used. The goroutine is locked to its
+// thread in the meantime so that the CPU time of the thread is the one of the
+// parsing.
+func parseWithProfile(parse func()) time.Duration {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	before, err := threadCPUTime()
+	pprof.Do(context.Background(), parseProfileLabel, func(context.Context) {
+		parse()
+	})
+	after, err2 := threadCPUTime()
+	if err != nil || err2 != nil {
+		return 0
+	}
+	return after - before
+}
+
+// selfProfile is the pprof profiles of etrace written with --self-profile
+type selfProfile struct {
+	dir string
+	cpu *os.File
+}
+
+// startSelfProfile starts the CPU profile of etrace, written to cpu.pprof in
+// the directory, which is created if needed.
+func startSelfProfile(dir string) (*selfProfile, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.Create(filepath.Join(dir, "cpu.pprof"))
+	if err != nil {
+		return nil, err
+	}
+	if err := pprof.StartCPUProfile(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &selfProfile{dir: dir, cpu: f}, nil
+}
+
+// stop stops the CPU profile and writes the heap profile to heap.pprof.
+func (p *selfProfile) stop() error {
+	pprof.StopCPUProfile()
+	if err := p.cpu.Close(); err != nil {
+		return err
+	}
+	f, err := os.Create(filepath.Join(p.dir, "heap.pprof"))
+	if err != nil {
+		return err
+	}
+	// the heap profile is up to date as of the last garbage collection
+	runtime.GC()
+	if err := pprof.WriteHeapProfile(f); err != nil {
+		f.Close()
+		return fmt.Errorf("cannot write heap profile: %v", err)
+	}
+	return f.Close()
+}
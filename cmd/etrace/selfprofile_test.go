@@ -0,0 +1,59 @@
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main_test
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	main "github.com/anonymouse64/etrace/cmd/etrace"
+
+	. "gopkg.in/check.v1"
+)
+
+type selfProfileTestSuite struct{}
+
+var _ = Suite(&selfProfileTestSuite{})
+
+func (s *selfProfileTestSuite) TestParseWithProfile(c *C) {
+	// busy parsing uses CPU time
+	busy := main.ParseWithProfile(func() {
+		for end := time.Now().Add(50 * time.Millisecond); time.Now().Before(end); {
+		}
+	})
+	c.Check(busy > 10*time.Millisecond, Equals, true, Commentf("%v", busy))
+
+	// waiting for the trace doesn't
+	idle := main.ParseWithProfile(func() {
+		time.Sleep(50 * time.Millisecond)
+	})
+	c.Check(idle < 10*time.Millisecond, Equals, true, Commentf("%v", idle))
+}
+
+func (s *selfProfileTestSuite) TestSelfProfile(c *C) {
+	dir := filepath.Join(c.MkDir(), "profiles")
+	stop, err := main.SelfProfile(dir)
+	c.Assert(err, IsNil)
+	c.Assert(stop(), IsNil)
+	for _, name := range []string{"cpu.pprof", "heap.pprof"} {
+		fi, err := os.Stat(filepath.Join(dir, name))
+		c.Assert(err, IsNil)
+		c.Check(fi.Size() > 0, Equals, true, Commentf(name))
+	}
+}
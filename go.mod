@@ -3,10 +3,11 @@ module github.com/anonymouse64/etrace
 go 1.13
 
 require (
+	github.com/godbus/dbus v4.1.0+incompatible
 	github.com/jessevdk/go-flags v1.4.1-0.20180927143258-7309ec74f752
 	github.com/kr/pretty v0.1.0 // indirect
 	github.com/snapcore/snapd v0.0.0-20210726143858-26a7ab7b6a92
 	golang.org/x/net v0.0.0-20210405180319-a5a99cb37ef4
 	gopkg.in/check.v1 v1.0.0-20190902080502-41f04d3bba15
-	gopkg.in/yaml.v2 v2.4.0 // indirect
+	gopkg.in/yaml.v2 v2.4.0
 )
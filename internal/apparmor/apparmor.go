@@ -0,0 +1,200 @@
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package apparmor collects the operations AppArmor denied during a run, which
+// both slow programs down, as they fall back to something else or retry, and
+// explain the file accesses missing from their traces.
+package apparmor
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/anonymouse64/etrace/internal/schema"
+)
+
+var (
+	journalctl = "journalctl"
+	// auditLog is the log of auditd, which receives the audit messages
+	// instead of the kernel log when it runs
+	auditLog = "/var/log/audit/audit.log"
+)
+
+// Denial is an operation AppArmor denied a program
+type Denial struct {
+	// Time is when the operation was denied, relative to the start of the
+	// run
+	Time time.Duration
+	// Operation is what was denied, like open or exec
+	Operation string
+	// Profile is the AppArmor profile of the program, like snap.foo.foo
+	Profile string
+	// Name is the path or the resource the operation was on
+	Name string `json:",omitempty"`
+	// Comm is the name of the program
+	Comm string `json:",omitempty"`
+	Pid  int    `json:",omitempty"`
+	// DeniedMask is the access which was denied, like r or w
+	DeniedMask string `json:",omitempty"`
+}
+
+// Structured returns the denial as encoded since version 2 of the schema.
+func (d Denial) Structured() interface{} {
+	type plain Denial
+	return struct {
+		plain
+		Time schema.Duration
+	}{plain(d), schema.NewDuration(d.Time)}
+}
+
+// auditRE matches the timestamp of an audit message, like
+// audit(1626869123.456:789)
+var auditRE = regexp.MustCompile(`audit\(([0-9]+\.[0-9]+):[0-9]+\)`)
+
+// fieldRE matches the fields of an audit message, whose values are quoted
+// when they may contain spaces
+var fieldRE = regexp.MustCompile(`([a-z_]+)=("[^"]*"|[^ ]+)`)
+
+// Denials returns the denials AppArmor logged between start and end, relative
+// to start. They are read from the kernel and audit messages of the journal,
+// or from the log of auditd on systems without journald, reading either needs
+// to be root or in the adm group on most systems.
+func Denials(start, end time.Time) ([]Denial, error) {
+	if _, err := exec.LookPath(journalctl); err == nil {
+		return journalDenials(start, end)
+	}
+	f, err := os.Open(auditLog)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read AppArmor denials without journalctl: %v", err)
+	}
+	defer f.Close()
+	return parseDenials(f, start, end)
+}
+
+func journalDenials(start, end time.Time) ([]Denial, error) {
+	// the journal is only filtered to the second, the timestamps of the
+	// messages themselves are precise
+	cmd := exec.Command(journalctl,
+		"--no-pager",
+		"--quiet",
+		"--output=short-unix",
+		fmt.Sprintf("--since=@%d", start.Unix()),
+		fmt.Sprintf("--until=@%d", end.Unix()+1),
+		"_TRANSPORT=kernel", "+", "_TRANSPORT=audit",
+	)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("cannot read AppArmor denials from the journal: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return parseDenials(bytes.NewReader(out), start, end)
+}
+
+// parseDenials parses the denials between start and end from the lines of
+// the journal or of the log of auditd.
+func parseDenials(r io.Reader, start, end time.Time) ([]Denial, error) {
+	var denials []Denial
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 1024*1024)
+	for s.Scan() {
+		line := s.Text()
+		if !strings.Contains(line, `apparmor="DENIED"`) {
+			continue
+		}
+		at, ok := messageTime(line)
+		if !ok || at.Before(start) || at.After(end) {
+			continue
+		}
+		d := Denial{Time: at.Sub(start)}
+		for _, m := range fieldRE.FindAllStringSubmatch(line, -1) {
+			value := strings.Trim(m[2], `"`)
+			switch m[1] {
+			case "operation":
+				d.Operation = value
+			case "profile":
+				d.Profile = value
+			case "name":
+				d.Name = value
+			case "comm":
+				d.Comm = value
+			case "pid":
+				d.Pid, _ = strconv.Atoi(value)
+			case "denied_mask":
+				d.DeniedMask = value
+			}
+		}
+		if isDuplicate(denials, d) {
+			continue
+		}
+		denials = append(denials, d)
+	}
+	return denials, s.Err()
+}
+
+// duplicateWindow is how close the same denial logged twice is
+const duplicateWindow = 100 * time.Millisecond
+
+// isDuplicate returns whether the denial was already seen, journald gets the
+// same denial both from the kernel log and from the audit subsystem when
+// auditd doesn't run, timestamped slightly differently.
+func isDuplicate(denials []Denial, d Denial) bool {
+	for i := len(denials) - 1; i >= 0 && d.Time-denials[i].Time < duplicateWindow; i-- {
+		seen := denials[i]
+		seen.Time = d.Time
+		if seen == d {
+			return true
+		}
+	}
+	return false
+}
+
+// messageTime returns the time of an audit message, from its audit()
+// timestamp or else from the timestamp of the journal line.
+func messageTime(line string) (time.Time, bool) {
+	stamp := ""
+	if m := auditRE.FindStringSubmatch(line); m != nil {
+		stamp = m[1]
+	} else if fields := strings.Fields(line); len(fields) != 0 {
+		stamp = fields[0]
+	}
+	// parsing the fraction as nanoseconds keeps it exact
+	secs, frac := stamp, ""
+	if i := strings.IndexByte(stamp, '.'); i != -1 {
+		secs, frac = stamp[:i], stamp[i+1:]
+	}
+	if len(frac) > 9 {
+		frac = frac[:9]
+	}
+	sec, err := strconv.ParseInt(secs, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	nsec, err := strconv.ParseInt(frac+strings.Repeat("0", 9-len(frac)), 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(sec, nsec), true
+}
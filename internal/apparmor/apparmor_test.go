@@ -0,0 +1,94 @@
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package apparmor_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/anonymouse64/etrace/internal/apparmor"
+
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type apparmorTestSuite struct{}
+
+var _ = check.Suite(&apparmorTestSuite{})
+
+const journal = `1626869122.900000 host kernel: audit: type=1400 audit(1626869122.900:10): apparmor="DENIED" operation="open" profile="snap.foo.foo" name="/etc/before" pid=41 comm="foo" requested_mask="r" denied_mask="r" fsuid=1000 ouid=0
+1626869123.250000 host kernel: audit: type=1400 audit(1626869123.250:11): apparmor="DENIED" operation="open" profile="snap.foo.foo" name="/etc/machine id" pid=42 comm="foo" requested_mask="r" denied_mask="r" fsuid=1000 ouid=0
+1626869123.252000 host audit[42]: AVC apparmor="DENIED" operation="open" profile="snap.foo.foo" name="/etc/machine id" pid=42 comm="foo" requested_mask="r" denied_mask="r" fsuid=1000 ouid=0
+1626869123.300000 host kernel: usb 1-1: new high-speed USB device number 3
+1626869123.400000 host kernel: audit: type=1400 audit(1626869123.400:12): apparmor="ALLOWED" operation="open" profile="snap.bar.bar" name="/etc/hosts" pid=43 comm="bar"
+1626869123.500000 host audit[44]: AVC apparmor="DENIED" operation="exec" profile="snap.foo.foo" name="/usr/bin/helper" pid=44 comm="foo" requested_mask="x" denied_mask="x"
+1626869125.000000 host kernel: audit: type=1400 audit(1626869125.000:13): apparmor="DENIED" operation="open" profile="snap.foo.foo" name="/etc/after" pid=42 comm="foo" denied_mask="r"
+`
+
+func (p *apparmorTestSuite) TestDenialsJournal(c *check.C) {
+	dir := c.MkDir()
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "journal"), []byte(journal), 0644), check.IsNil)
+	argsLog := filepath.Join(dir, "args")
+	journalctl := filepath.Join(dir, "journalctl")
+	c.Assert(ioutil.WriteFile(journalctl, []byte("#!/bin/sh\necho \"$@\" > "+argsLog+"\ncat "+filepath.Join(dir, "journal")+"\n"), 0755), check.IsNil)
+	defer apparmor.MockJournalctl(journalctl)()
+
+	start := time.Unix(1626869123, 0)
+	denials, err := apparmor.Denials(start, start.Add(time.Second))
+	c.Assert(err, check.IsNil)
+	// only the denials during the run are kept, once
+	c.Check(denials, check.DeepEquals, []apparmor.Denial{
+		{Time: 250 * time.Millisecond, Operation: "open", Profile: "snap.foo.foo", Name: "/etc/machine id", Comm: "foo", Pid: 42, DeniedMask: "r"},
+		{Time: 500 * time.Millisecond, Operation: "exec", Profile: "snap.foo.foo", Name: "/usr/bin/helper", Comm: "foo", Pid: 44, DeniedMask: "x"},
+	})
+	args, err := ioutil.ReadFile(argsLog)
+	c.Assert(err, check.IsNil)
+	c.Check(string(args), check.Equals, "--no-pager --quiet --output=short-unix --since=@1626869123 --until=@1626869125 _TRANSPORT=kernel + _TRANSPORT=audit\n")
+}
+
+func (p *apparmorTestSuite) TestDenialsJournalError(c *check.C) {
+	journalctl := filepath.Join(c.MkDir(), "journalctl")
+	c.Assert(ioutil.WriteFile(journalctl, []byte("#!/bin/sh\necho 'No journal files were opened due to insufficient permissions.' >&2\nexit 1\n"), 0755), check.IsNil)
+	defer apparmor.MockJournalctl(journalctl)()
+
+	_, err := apparmor.Denials(time.Now(), time.Now())
+	c.Check(err, check.ErrorMatches, "cannot read AppArmor denials from the journal: exit status 1: No journal files were opened due to insufficient permissions.")
+}
+
+func (p *apparmorTestSuite) TestDenialsAuditLog(c *check.C) {
+	defer apparmor.MockJournalctl("/no/journalctl")()
+	auditLog := filepath.Join(c.MkDir(), "audit.log")
+	c.Assert(ioutil.WriteFile(auditLog, []byte(`type=AVC msg=audit(1626869123.125:11): apparmor="DENIED" operation="open" profile="snap.foo.foo" name="/etc/foo" pid=42 comm="foo" requested_mask="r" denied_mask="r" fsuid=1000 ouid=0
+type=SYSCALL msg=audit(1626869123.125:11): arch=c000003e syscall=257 success=no exit=-13
+`), 0644), check.IsNil)
+	defer apparmor.MockAuditLog(auditLog)()
+
+	start := time.Unix(1626869123, 0)
+	denials, err := apparmor.Denials(start, start.Add(time.Second))
+	c.Assert(err, check.IsNil)
+	c.Check(denials, check.DeepEquals, []apparmor.Denial{
+		{Time: 125 * time.Millisecond, Operation: "open", Profile: "snap.foo.foo", Name: "/etc/foo", Comm: "foo", Pid: 42, DeniedMask: "r"},
+	})
+
+	defer apparmor.MockAuditLog("/no/audit.log")()
+	_, err = apparmor.Denials(start, start.Add(time.Second))
+	c.Check(err, check.ErrorMatches, "cannot read AppArmor denials without journalctl: open /no/audit.log: no such file or directory")
+}
@@ -0,0 +1,159 @@
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package baseline has reference measurements of snaps, to put the
+// measurements of other snaps in context.
+package baseline
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/anonymouse64/etrace/internal/squashfs"
+)
+
+// Kinds of apps, snaps are only compared with snaps of the same kind
+const (
+	KindElectron = "electron"
+	KindGTK      = "gtk"
+	KindQt       = "qt"
+	KindOther    = "other"
+)
+
+// Entry is a reference measurement of a snap
+type Entry struct {
+	Snap string `yaml:"snap"`
+	Kind string `yaml:"kind"`
+	// Hardware is the class of hardware the snap was measured on
+	Hardware    string `yaml:"hardware,omitempty"`
+	Compression string `yaml:"compression,omitempty"`
+	// Cold and Hot are the mean times to display of launching the snap cold
+	// and hot
+	Cold time.Duration `yaml:"cold,omitempty"`
+	Hot  time.Duration `yaml:"hot,omitempty"`
+}
+
+// Database is a set of reference measurements
+type Database struct {
+	Entries []Entry `yaml:"entries"`
+}
+
+// Reference returns the reference measurements shipped with etrace.
+func Reference() *Database {
+	db := &Database{Entries: make([]Entry, len(reference))}
+	copy(db.Entries, reference)
+	return db
+}
+
+// MinCompared is how many comparable snaps a percentile is computed from at
+// least, as being slower than a percentage of fewer snaps doesn't tell much.
+const MinCompared = 5
+
+// Load reads a database from the given YAML file, if the file doesn't exist
+// the reference measurements are returned, so that it can be updated with Add
+// and Save.
+func Load(path string) (*Database, error) {
+	out, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return Reference(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var db Database
+	if err := yaml.UnmarshalStrict(out, &db); err != nil {
+		return nil, fmt.Errorf("cannot parse baseline %s: %v", path, err)
+	}
+	return &db, nil
+}
+
+// Save writes the database as YAML to the given file.
+func (db *Database) Save(path string) error {
+	out, err := yaml.Marshal(db)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, out, 0644)
+}
+
+// Add adds the measurement to the database, replacing any measurement of the
+// same snap on the same class of hardware.
+func (db *Database) Add(e Entry) {
+	for i, old := range db.Entries {
+		if old.Snap == e.Snap && old.Hardware == e.Hardware {
+			db.Entries[i] = e
+			return
+		}
+	}
+	db.Entries = append(db.Entries, e)
+}
+
+// Percentile returns the percentage of the other snaps of the same kind,
+// measured on the same class of hardware if it's not empty, which started
+// faster than the given time, and how many snaps were compared with. The
+// measurements are cold starts if cold is true and hot ones otherwise.
+func (db *Database) Percentile(e Entry, cold bool) (percent float64, compared int) {
+	faster := 0
+	for _, ref := range db.Entries {
+		if ref.Snap == e.Snap || ref.Kind != e.Kind {
+			continue
+		}
+		if e.Hardware != "" && ref.Hardware != e.Hardware {
+			continue
+		}
+		refTime, t := ref.Hot, e.Hot
+		if cold {
+			refTime, t = ref.Cold, e.Cold
+		}
+		if refTime == 0 || t == 0 {
+			continue
+		}
+		compared++
+		if refTime < t {
+			faster++
+		}
+	}
+	if compared == 0 {
+		return 0, 0
+	}
+	return 100 * float64(faster) / float64(compared), compared
+}
+
+// DetectKind returns the kind of app from the files of a snap.
+func DetectKind(files []squashfs.File) string {
+	kind := KindOther
+	for _, f := range files {
+		base := f.Path[strings.LastIndex(f.Path, "/")+1:]
+		switch {
+		case base == "app.asar" || base == "electron.asar" || base == "chrome_100_percent.pak":
+			// electron apps usually ship gtk too
+			return KindElectron
+		case strings.HasPrefix(base, "libQt5Core.so") || strings.HasPrefix(base, "libQt6Core.so"):
+			kind = KindQt
+		case strings.HasPrefix(base, "libgtk-3.so") || strings.HasPrefix(base, "libgtk-4.so"):
+			if kind == KindOther {
+				kind = KindGTK
+			}
+		}
+	}
+	return kind
+}
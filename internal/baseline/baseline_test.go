@@ -0,0 +1,123 @@
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package baseline_test
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/anonymouse64/etrace/internal/baseline"
+	"github.com/anonymouse64/etrace/internal/squashfs"
+
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type baselineTestSuite struct{}
+
+var _ = check.Suite(&baselineTestSuite{})
+
+func (s *baselineTestSuite) TestReference(c *check.C) {
+	db := baseline.Reference()
+	c.Assert(db.Entries, check.Not(check.HasLen), 0)
+	for _, e := range db.Entries {
+		c.Check(e.Snap, check.Not(check.Equals), "")
+		c.Check(e.Kind, check.Not(check.Equals), "")
+		c.Check(e.Cold > e.Hot && e.Hot > 0, check.Equals, true, check.Commentf("%s", e.Snap))
+	}
+
+	// the shipped measurements are not modified through the copy
+	db.Entries[0].Snap = "foo"
+	c.Check(baseline.Reference().Entries[0].Snap, check.Not(check.Equals), "foo")
+}
+
+func (s *baselineTestSuite) TestLoadSave(c *check.C) {
+	path := filepath.Join(c.MkDir(), "baseline.yaml")
+
+	// a missing database starts from the reference measurements
+	db, err := baseline.Load(path)
+	c.Assert(err, check.IsNil)
+	c.Check(db, check.DeepEquals, baseline.Reference())
+
+	e := baseline.Entry{
+		Snap:     "foo",
+		Kind:     baseline.KindGTK,
+		Hardware: "laptop",
+		Cold:     3 * time.Second,
+		Hot:      500 * time.Millisecond,
+	}
+	db.Add(e)
+	c.Assert(db.Save(path), check.IsNil)
+
+	db, err = baseline.Load(path)
+	c.Assert(err, check.IsNil)
+	c.Check(db.Entries, check.HasLen, len(baseline.Reference().Entries)+1)
+	c.Check(db.Entries[len(db.Entries)-1], check.DeepEquals, e)
+
+	// the same snap on the same hardware is replaced
+	e.Cold = 2 * time.Second
+	db.Add(e)
+	c.Check(db.Entries, check.HasLen, len(baseline.Reference().Entries)+1)
+	c.Check(db.Entries[len(db.Entries)-1].Cold, check.Equals, 2*time.Second)
+}
+
+func (s *baselineTestSuite) TestPercentile(c *check.C) {
+	db := &baseline.Database{Entries: []baseline.Entry{
+		{Snap: "a", Kind: baseline.KindElectron, Hardware: "desktop", Cold: 2 * time.Second, Hot: time.Second},
+		{Snap: "b", Kind: baseline.KindElectron, Hardware: "desktop", Cold: 4 * time.Second, Hot: 2 * time.Second},
+		{Snap: "c", Kind: baseline.KindElectron, Hardware: "laptop", Cold: 6 * time.Second},
+		{Snap: "d", Kind: baseline.KindGTK, Hardware: "desktop", Cold: time.Second},
+		// the measured snap itself is not compared with
+		{Snap: "e", Kind: baseline.KindElectron, Hardware: "desktop", Cold: time.Second},
+	}}
+	e := baseline.Entry{Snap: "e", Kind: baseline.KindElectron, Cold: 5 * time.Second, Hot: 1500 * time.Millisecond}
+
+	percent, compared := db.Percentile(e, true)
+	c.Check(compared, check.Equals, 3)
+	c.Check(percent, check.Equals, 100*2/float64(3))
+
+	// only snaps with hot measurements are compared
+	percent, compared = db.Percentile(e, false)
+	c.Check(compared, check.Equals, 2)
+	c.Check(percent, check.Equals, float64(50))
+
+	e.Hardware = "desktop"
+	percent, compared = db.Percentile(e, true)
+	c.Check(compared, check.Equals, 2)
+	c.Check(percent, check.Equals, float64(100))
+
+	e.Kind = baseline.KindQt
+	_, compared = db.Percentile(e, true)
+	c.Check(compared, check.Equals, 0)
+}
+
+func (s *baselineTestSuite) TestDetectKind(c *check.C) {
+	files := func(paths ...string) []squashfs.File {
+		var files []squashfs.File
+		for _, p := range paths {
+			files = append(files, squashfs.File{Path: p})
+		}
+		return files
+	}
+	c.Check(baseline.DetectKind(files("bin/foo", "usr/lib/libgtk-3.so.0", "opt/foo/resources/app.asar")), check.Equals, baseline.KindElectron)
+	c.Check(baseline.DetectKind(files("usr/lib/libgtk-3.so.0", "usr/lib/libQt5Core.so.5")), check.Equals, baseline.KindQt)
+	c.Check(baseline.DetectKind(files("usr/lib/libgtk-3.so.0")), check.Equals, baseline.KindGTK)
+	c.Check(baseline.DetectKind(files("bin/foo")), check.Equals, baseline.KindOther)
+}
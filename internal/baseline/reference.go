@@ -0,0 +1,46 @@
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package baseline
+
+import "time"
+
+// reference are the reference measurements shipped with etrace, the hardware
+// classes are "desktop" for desktops and high end laptops, "laptop" for
+// typical laptops and "low-end" for low end laptops and single board
+// computers, measurements without a class were taken on unknown hardware and
+// are only compared with when no class is given. New measurements are added
+// with analyze-snap --update-baseline.
+var reference = []Entry{
+	{
+		// the analyze-snap example in the README
+		Snap:        "1password",
+		Kind:        KindElectron,
+		Hardware:    "desktop",
+		Compression: "xz",
+		Cold:        14021772885 * time.Nanosecond,
+		Hot:         1096632064 * time.Nanosecond,
+	},
+	{
+		// the exec --cold and --hot examples in the README
+		Snap:        "gnome-calculator",
+		Kind:        KindGTK,
+		Compression: "xz",
+		Cold:        4169633359 * time.Nanosecond,
+		Hot:         1054272336 * time.Nanosecond,
+	},
+}
@@ -0,0 +1,265 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package blockdev attributes file reads to the block devices backing the
+// files, so that reads of a snap's squashfs can be told apart from reads of the
+// home directory.
+package blockdev
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	mountInfoPath = "/proc/self/mountinfo"
+	sysBlock      = "/sys/block"
+)
+
+// Mount is a mounted filesystem
+type Mount struct {
+	// Device is the major:minor number of the device of the filesystem
+	Device string
+	// Point is where the filesystem is mounted
+	Point  string
+	FSType string
+	// Source is the mounted device, like /dev/loop3, or the name of virtual
+	// filesystems
+	Source string
+}
+
+// unescape undoes the octal escaping of spaces and other special characters in
+// the paths of mountinfo.
+func unescape(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if v, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(v))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// ReadMounts reads the mounts of the mount namespace etrace runs in.
+func ReadMounts() ([]Mount, error) {
+	f, err := os.Open(mountInfoPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// lines look like:
+	// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+	// see proc(5) for the meaning of the fields
+	var mounts []Mount
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		sep := -1
+		for i, field := range fields {
+			if field == "-" {
+				sep = i
+				break
+			}
+		}
+		if sep < 5 || len(fields) < sep+3 {
+			return nil, fmt.Errorf("cannot parse mountinfo line %q", s.Text())
+		}
+		mounts = append(mounts, Mount{
+			Device: fields[2],
+			Point:  unescape(fields[4]),
+			FSType: fields[sep+1],
+			Source: unescape(fields[sep+2]),
+		})
+	}
+	return mounts, s.Err()
+}
+
+// Find returns the mount a path is on, which is the last mount of the
+// longest mount point containing the path since later mounts hide earlier
+// ones.
+func Find(mounts []Mount, path string) (Mount, bool) {
+	var found Mount
+	best := -1
+	for _, m := range mounts {
+		if m.Point != "/" && path != m.Point && !strings.HasPrefix(path, m.Point+"/") {
+			continue
+		}
+		if len(m.Point) >= best {
+			found, best = m, len(m.Point)
+		}
+	}
+	return found, best != -1
+}
+
+// MountWatcher polls the mounts for a new mount under a directory
+type MountWatcher struct {
+	dir      string
+	existing map[string]bool
+	interval time.Duration
+
+	stop  chan struct{}
+	done  chan struct{}
+	mount Mount
+	at    time.Time
+	found bool
+}
+
+// WatchMounts starts polling the mounts every interval for a filesystem to be
+// mounted on the directory or under it, ignoring the ones already mounted.
+func WatchMounts(dir string, interval time.Duration) (*MountWatcher, error) {
+	mounts, err := ReadMounts()
+	if err != nil {
+		return nil, err
+	}
+	w := &MountWatcher{
+		dir:      filepath.Clean(dir),
+		existing: make(map[string]bool),
+		interval: interval,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	for _, m := range mounts {
+		if w.under(m.Point) {
+			w.existing[m.Point] = true
+		}
+	}
+	go w.poll()
+	return w, nil
+}
+
+func (w *MountWatcher) under(point string) bool {
+	return point == w.dir || strings.HasPrefix(point, w.dir+"/")
+}
+
+func (w *MountWatcher) poll() {
+	defer close(w.done)
+	for {
+		// mounts which can't be read are polled again
+		mounts, _ := ReadMounts()
+		for _, m := range mounts {
+			if w.under(m.Point) && !w.existing[m.Point] {
+				w.mount, w.at, w.found = m, time.Now(), true
+				return
+			}
+		}
+		select {
+		case <-w.stop:
+			return
+		case <-time.After(w.interval):
+		}
+	}
+}
+
+// Stop stops polling and returns the new mount and when it was seen, if any
+// appeared.
+func (w *MountWatcher) Stop() (Mount, time.Time, bool) {
+	close(w.stop)
+	<-w.done
+	return w.mount, w.at, w.found
+}
+
+// DeviceReads is how much was read from the files of a device
+type DeviceReads struct {
+	// Device is the major:minor number of the device
+	Device string
+	Source string
+	FSType string
+	// BackingFile is the file backing loop devices, like the snap file of a
+	// mounted snap
+	BackingFile string `json:",omitempty"`
+	// Mounts are the mount points of the device the files were read from
+	Mounts []string
+	// Files is the number of files read from
+	Files int
+	Bytes int64
+}
+
+// backingFile returns the file backing a loop device, or an empty string for
+// other devices.
+func backingFile(source string) string {
+	if !strings.HasPrefix(source, "/dev/loop") {
+		return ""
+	}
+	out, err := ioutil.ReadFile(filepath.Join(sysBlock, filepath.Base(source), "loop/backing_file"))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// Reads aggregates the bytes read from each path by the device the path is
+// on, sorted by the bytes read. Paths which aren't on any mount are not
+// counted.
+func Reads(mounts []Mount, bytesRead map[string]int64) []DeviceReads {
+	byDevice := make(map[string]*DeviceReads)
+	devMounts := make(map[string]map[string]bool)
+	for path, n := range bytesRead {
+		if n == 0 {
+			continue
+		}
+		m, ok := Find(mounts, path)
+		if !ok {
+			continue
+		}
+		dev := byDevice[m.Device]
+		if dev == nil {
+			dev = &DeviceReads{
+				Device:      m.Device,
+				Source:      m.Source,
+				FSType:      m.FSType,
+				BackingFile: backingFile(m.Source),
+			}
+			byDevice[m.Device] = dev
+			devMounts[m.Device] = make(map[string]bool)
+		}
+		if !devMounts[m.Device][m.Point] {
+			devMounts[m.Device][m.Point] = true
+			dev.Mounts = append(dev.Mounts, m.Point)
+		}
+		dev.Files++
+		dev.Bytes += n
+	}
+
+	reads := make([]DeviceReads, 0, len(byDevice))
+	for _, dev := range byDevice {
+		sort.Strings(dev.Mounts)
+		reads = append(reads, *dev)
+	}
+	sort.Slice(reads, func(i, j int) bool {
+		if reads[i].Bytes != reads[j].Bytes {
+			return reads[i].Bytes > reads[j].Bytes
+		}
+		return reads[i].Device < reads[j].Device
+	})
+	return reads
+}
@@ -0,0 +1,182 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package blockdev_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/anonymouse64/etrace/internal/blockdev"
+
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type blockdevTestSuite struct{}
+
+var _ = check.Suite(&blockdevTestSuite{})
+
+const mountInfo = `25 1 259:2 / / rw,relatime shared:1 - ext4 /dev/nvme0n1p2 rw
+26 25 0:5 / /proc rw,nosuid,nodev,noexec,relatime shared:12 - proc proc rw
+27 25 259:3 / /home rw,relatime shared:2 - ext4 /dev/nvme0n1p3 rw
+28 25 7:3 / /snap/app/12 ro,nodev,relatime shared:3 - squashfs /dev/loop3 ro
+29 25 7:4 / /snap/core20/1 ro,nodev,relatime shared:4 - squashfs /dev/loop4 ro
+30 27 259:3 /data /home/user/my\040data rw,relatime shared:2 - ext4 /dev/nvme0n1p3 rw
+`
+
+func mockSystem(c *check.C) (restore func()) {
+	dir := c.MkDir()
+	info := filepath.Join(dir, "mountinfo")
+	c.Assert(ioutil.WriteFile(info, []byte(mountInfo), 0644), check.IsNil)
+	restoreMountInfo := blockdev.MockMountInfoPath(info)
+
+	sys := filepath.Join(dir, "sys/block")
+	c.Assert(os.MkdirAll(filepath.Join(sys, "loop3/loop"), 0755), check.IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(sys, "loop3/loop/backing_file"), []byte("/var/lib/snapd/snaps/app_12.snap\n"), 0644), check.IsNil)
+	restoreSysBlock := blockdev.MockSysBlock(sys)
+	return func() {
+		restoreMountInfo()
+		restoreSysBlock()
+	}
+}
+
+func (s *blockdevTestSuite) TestReadMounts(c *check.C) {
+	defer mockSystem(c)()
+
+	mounts, err := blockdev.ReadMounts()
+	c.Assert(err, check.IsNil)
+	c.Assert(mounts, check.HasLen, 6)
+	c.Check(mounts[3], check.DeepEquals, blockdev.Mount{
+		Device: "7:3",
+		Point:  "/snap/app/12",
+		FSType: "squashfs",
+		Source: "/dev/loop3",
+	})
+	// escaped spaces are unescaped
+	c.Check(mounts[5].Point, check.Equals, "/home/user/my data")
+}
+
+func (s *blockdevTestSuite) TestReadMountsError(c *check.C) {
+	info := filepath.Join(c.MkDir(), "mountinfo")
+	c.Assert(ioutil.WriteFile(info, []byte("25 1 259:2 / /\n"), 0644), check.IsNil)
+	defer blockdev.MockMountInfoPath(info)()
+
+	_, err := blockdev.ReadMounts()
+	c.Assert(err, check.ErrorMatches, `cannot parse mountinfo line "25 1 259:2 / /"`)
+}
+
+func (s *blockdevTestSuite) TestFind(c *check.C) {
+	defer mockSystem(c)()
+	mounts, err := blockdev.ReadMounts()
+	c.Assert(err, check.IsNil)
+
+	for _, t := range []struct {
+		path, point string
+	}{
+		{"/usr/lib/libc.so.6", "/"},
+		{"/home/user/.config/app.conf", "/home"},
+		{"/home/user/my data/file", "/home/user/my data"},
+		{"/snap/app/12", "/snap/app/12"},
+		{"/snap/app/12/bin/app", "/snap/app/12"},
+		// only whole path components match
+		{"/snap/app/123/bin/app", "/"},
+	} {
+		m, ok := blockdev.Find(mounts, t.path)
+		c.Assert(ok, check.Equals, true)
+		c.Check(m.Point, check.Equals, t.point, check.Commentf(t.path))
+	}
+
+	_, ok := blockdev.Find(nil, "/usr/lib/libc.so.6")
+	c.Check(ok, check.Equals, false)
+}
+
+func (s *blockdevTestSuite) TestReads(c *check.C) {
+	defer mockSystem(c)()
+	mounts, err := blockdev.ReadMounts()
+	c.Assert(err, check.IsNil)
+
+	reads := blockdev.Reads(mounts, map[string]int64{
+		"/snap/app/12/bin/app":           1000,
+		"/snap/app/12/lib/libapp.so":     3000,
+		"/home/user/.config/app.conf":    100,
+		"/home/user/my data/file":        200,
+		"/usr/lib/x86_64-linux-gnu/libc": 500,
+		// files which were only opened are not counted
+		"/snap/core20/1/usr/lib/libm.so": 0,
+	})
+	c.Check(reads, check.DeepEquals, []blockdev.DeviceReads{{
+		Device:      "7:3",
+		Source:      "/dev/loop3",
+		FSType:      "squashfs",
+		BackingFile: "/var/lib/snapd/snaps/app_12.snap",
+		Mounts:      []string{"/snap/app/12"},
+		Files:       2,
+		Bytes:       4000,
+	}, {
+		Device: "259:2",
+		Source: "/dev/nvme0n1p2",
+		FSType: "ext4",
+		Mounts: []string{"/"},
+		Files:  1,
+		Bytes:  500,
+	}, {
+		Device: "259:3",
+		Source: "/dev/nvme0n1p3",
+		FSType: "ext4",
+		Mounts: []string{"/home", "/home/user/my data"},
+		Files:  2,
+		Bytes:  300,
+	}})
+}
+
+func (s *blockdevTestSuite) TestWatchMounts(c *check.C) {
+	info := filepath.Join(c.MkDir(), "mountinfo")
+	c.Assert(ioutil.WriteFile(info, []byte(mountInfo), 0644), check.IsNil)
+	defer blockdev.MockMountInfoPath(info)()
+
+	w, err := blockdev.WatchMounts("/snap/app", time.Millisecond)
+	c.Assert(err, check.IsNil)
+	time.Sleep(10 * time.Millisecond)
+
+	// the new revision of the snap is mounted
+	mounted := mountInfo + "31 25 7:5 / /snap/app/13 ro,nodev,relatime shared:5 - squashfs /dev/loop5 ro\n"
+	before := time.Now()
+	c.Assert(ioutil.WriteFile(info, []byte(mounted), 0644), check.IsNil)
+	time.Sleep(50 * time.Millisecond)
+
+	m, at, ok := w.Stop()
+	c.Assert(ok, check.Equals, true)
+	c.Check(m.Point, check.Equals, "/snap/app/13")
+	c.Check(m.Source, check.Equals, "/dev/loop5")
+	c.Check(at.Before(before.Add(-time.Millisecond)), check.Equals, false)
+}
+
+func (s *blockdevTestSuite) TestWatchMountsNothingMounted(c *check.C) {
+	defer mockSystem(c)()
+
+	// the revision already mounted is not new
+	w, err := blockdev.WatchMounts("/snap/app", time.Millisecond)
+	c.Assert(err, check.IsNil)
+	time.Sleep(10 * time.Millisecond)
+	_, _, ok := w.Stop()
+	c.Check(ok, check.Equals, false)
+}
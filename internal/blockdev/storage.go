@@ -0,0 +1,104 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package blockdev
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// sysDevBlock has the block devices by their major:minor number
+var sysDevBlock = "/sys/dev/block"
+
+// Classes of storage, which differ a lot in speed
+const (
+	StorageSDCard  = "sd-card"
+	StorageEMMC    = "emmc"
+	StorageUSB     = "usb"
+	StorageNVMe    = "nvme"
+	StorageSSD     = "ssd"
+	StorageHDD     = "hdd"
+	StorageVirtual = "virtual"
+)
+
+// StorageClass returns the class of the storage the filesystem is on, or an
+// empty string if it isn't known, i.e. for virtual filesystems.
+func StorageClass(m Mount) string {
+	dir, err := filepath.EvalSymlinks(filepath.Join(sysDevBlock, m.Device))
+	if err != nil {
+		return ""
+	}
+	return storageClassOf(dir, 0)
+}
+
+// storageClassOf returns the class of the storage of the block device with
+// the sysfs directory, following device mapper and RAID devices to the first
+// device they are built on.
+func storageClassOf(dir string, depth int) string {
+	if _, err := os.Stat(filepath.Join(dir, "partition")); err == nil {
+		// the partition is in the directory of its disk
+		dir = filepath.Dir(dir)
+	}
+	if depth < 4 {
+		if slaves, _ := ioutil.ReadDir(filepath.Join(dir, "slaves")); len(slaves) != 0 {
+			slave, err := filepath.EvalSymlinks(filepath.Join(dir, "slaves", slaves[0].Name()))
+			if err != nil {
+				return ""
+			}
+			return storageClassOf(slave, depth+1)
+		}
+	}
+
+	name := filepath.Base(dir)
+	switch {
+	case strings.Contains(dir, "/usb"):
+		return StorageUSB
+	case strings.HasPrefix(name, "mmcblk"):
+		// the type of the card is SD, MMC for eMMC or SDIO
+		out, _ := ioutil.ReadFile(filepath.Join(dir, "device/type"))
+		if strings.TrimSpace(string(out)) == "MMC" {
+			return StorageEMMC
+		}
+		return StorageSDCard
+	case strings.HasPrefix(name, "nvme"):
+		return StorageNVMe
+	case strings.HasPrefix(name, "vd") || strings.HasPrefix(name, "xvd"):
+		return StorageVirtual
+	case strings.HasPrefix(name, "sd") || strings.HasPrefix(name, "hd"):
+		rotational, ok := readString(filepath.Join(dir, "queue/rotational"))
+		if !ok {
+			return ""
+		}
+		if rotational == "1" {
+			return StorageHDD
+		}
+		return StorageSSD
+	}
+	return ""
+}
+
+// readString reads a file containing a single value.
+func readString(path string) (string, bool) {
+	out, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", false
+	}
+	return strings.TrimSpace(string(out)), true
+}
@@ -0,0 +1,90 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package blockdev_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/anonymouse64/etrace/internal/blockdev"
+
+	"gopkg.in/check.v1"
+)
+
+type storageTestSuite struct {
+	sys string
+}
+
+var _ = check.Suite(&storageTestSuite{})
+
+func (s *storageTestSuite) SetUpTest(c *check.C) {
+	s.sys = c.MkDir()
+}
+
+// mockDevice adds the block device at the sysfs path with the major:minor
+// number and the files under it.
+func (s *storageTestSuite) mockDevice(c *check.C, device, path string, files map[string]string) {
+	dir := filepath.Join(s.sys, "devices", path)
+	c.Assert(os.MkdirAll(dir, 0755), check.IsNil)
+	for name, content := range files {
+		c.Assert(os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755), check.IsNil)
+		c.Assert(ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644), check.IsNil)
+	}
+	if device != "" {
+		c.Assert(os.MkdirAll(filepath.Join(s.sys, "dev/block"), 0755), check.IsNil)
+		c.Assert(os.Symlink(dir, filepath.Join(s.sys, "dev/block", device)), check.IsNil)
+	}
+}
+
+func (s *storageTestSuite) TestStorageClass(c *check.C) {
+	restore := blockdev.MockSysDevBlock(filepath.Join(s.sys, "dev/block"))
+	defer restore()
+
+	s.mockDevice(c, "", "platform/mmc0/block/mmcblk0", map[string]string{"device/type": "SD\n"})
+	s.mockDevice(c, "179:2", "platform/mmc0/block/mmcblk0/mmcblk0p2", map[string]string{"partition": "2\n"})
+	s.mockDevice(c, "", "platform/mmc1/block/mmcblk1", map[string]string{"device/type": "MMC\n"})
+	s.mockDevice(c, "179:33", "platform/mmc1/block/mmcblk1/mmcblk1p1", map[string]string{"partition": "1\n"})
+	s.mockDevice(c, "8:1", "pci0000:00/usb2/2-1/host0/block/sda/sda1", map[string]string{"partition": "1\n"})
+	s.mockDevice(c, "8:17", "pci0000:00/ata1/host1/block/sdb/sdb1", map[string]string{"partition": "1\n"})
+	s.mockDevice(c, "", "pci0000:00/ata1/host1/block/sdb", map[string]string{"queue/rotational": "1\n"})
+	s.mockDevice(c, "8:32", "pci0000:00/ata2/host2/block/sdc", map[string]string{"queue/rotational": "0\n"})
+	s.mockDevice(c, "259:2", "pci0000:00/nvme/nvme0/nvme0n1/nvme0n1p2", map[string]string{"partition": "2\n"})
+	s.mockDevice(c, "252:1", "pci0000:00/virtio1/block/vda/vda1", map[string]string{"partition": "1\n"})
+	// an encrypted filesystem on the nvme disk
+	s.mockDevice(c, "253:0", "virtual/block/dm-0", nil)
+	c.Assert(os.MkdirAll(filepath.Join(s.sys, "devices/virtual/block/dm-0/slaves"), 0755), check.IsNil)
+	c.Assert(os.Symlink(filepath.Join(s.sys, "devices/pci0000:00/nvme/nvme0/nvme0n1/nvme0n1p2"), filepath.Join(s.sys, "devices/virtual/block/dm-0/slaves/nvme0n1p2")), check.IsNil)
+
+	for _, t := range []struct {
+		device, class string
+	}{
+		{"179:2", blockdev.StorageSDCard},
+		{"179:33", blockdev.StorageEMMC},
+		{"8:1", blockdev.StorageUSB},
+		{"8:17", blockdev.StorageHDD},
+		{"8:32", blockdev.StorageSSD},
+		{"259:2", blockdev.StorageNVMe},
+		{"252:1", blockdev.StorageVirtual},
+		{"253:0", blockdev.StorageNVMe},
+		// tmpfs and other virtual filesystems
+		{"0:25", ""},
+	} {
+		c.Check(blockdev.StorageClass(blockdev.Mount{Device: t.device}), check.Equals, t.class, check.Commentf("%s", t.device))
+	}
+}
@@ -0,0 +1,437 @@
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package capture implements a compact binary format for the events of a
+// traced execution, so that a trace can be recorded once and analyzed many
+// times without parsing the raw trace again.
+package capture
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/anonymouse64/etrace/internal/schema"
+)
+
+// Kind is the kind of an event
+type Kind uint8
+
+const (
+	// kindEnd marks the end of the capture and is never returned as an event
+	kindEnd Kind = iota
+	// Exec is a process executing a program
+	Exec
+	// Exit is a process exiting
+	Exit
+	// Open is a process accessing a path
+	Open
+	// Signal is a process being killed by a signal
+	Signal
+	// Window is a window of the execution appearing
+	Window
+	// Wait is a process waiting in a blocking system call
+	Wait
+	// Fork is a process forking a new process
+	Fork
+	// Connect is a process connecting to the display server
+	Connect
+)
+
+func (k Kind) String() string {
+	switch k {
+	case Exec:
+		return "exec"
+	case Exit:
+		return "exit"
+	case Open:
+		return "open"
+	case Signal:
+		return "signal"
+	case Window:
+		return "window"
+	case Wait:
+		return "wait"
+	case Fork:
+		return "fork"
+	case Connect:
+		return "connect"
+	}
+	return fmt.Sprintf("kind %d", uint8(k))
+}
+
+// CPUTime is the CPU time a process used
+type CPUTime struct {
+	User   time.Duration
+	System time.Duration
+}
+
+// Structured returns the CPU time as encoded since version 2 of the schema.
+func (t *CPUTime) Structured() interface{} {
+	return struct {
+		User   schema.Duration
+		System schema.Duration
+	}{schema.NewDuration(t.User), schema.NewDuration(t.System)}
+}
+
+// Event is a single event of a traced execution. Only the fields relevant to
+// the kind of the event are recorded.
+type Event struct {
+	Kind Kind
+	Time time.Time
+	Pid  int
+	// Path is the program executed for exec events, the path accessed for
+	// open events and the socket connected to for connect events
+	Path string
+	// Args is the argument vector of exec events
+	Args []string
+	// Syscall is the syscall which accessed the path for open events and
+	// the syscall the process waited in for wait events
+	Syscall string
+	// Errno is the error for open events which failed to create the path, it
+	// is empty if the access succeeded
+	Errno string
+	// Bytes is the number of bytes read for open events of syscalls reading
+	// from the path
+	Bytes int64
+	// Signal is the signal which killed the process for signal events
+	Signal string
+	// Window is the ID of the window for window events
+	Window string
+	// CPU is the CPU time the process used for exit events, if it is known
+	CPU *CPUTime
+	// Duration is how long the process waited for wait events
+	Duration time.Duration
+	// Child is the new process for fork events
+	Child int
+}
+
+// Capture is all the events of a traced execution
+type Capture struct {
+	Start  time.Time
+	End    time.Time
+	Events []Event
+}
+
+// AccessedPaths returns the paths the open events accessed successfully, in
+// the order they were first accessed.
+func (c *Capture) AccessedPaths() []string {
+	seen := make(map[string]bool)
+	var paths []string
+	for _, ev := range c.Events {
+		if ev.Kind != Open || ev.Errno != "" || seen[ev.Path] {
+			continue
+		}
+		seen[ev.Path] = true
+		paths = append(paths, ev.Path)
+	}
+	return paths
+}
+
+// magic identifies capture files, the byte after it is the version of the
+// format
+var magic = []byte("ETRACE\x00")
+
+// version is the current format
+const version = 1
+
+// Writer writes events in the capture format as they happen
+type Writer struct {
+	w    *bufio.Writer
+	last time.Time
+	buf  []byte
+}
+
+// NewWriter writes the header of a capture of an execution started at the
+// given time and returns a writer for its events.
+func NewWriter(w io.Writer, start time.Time) (*Writer, error) {
+	cw := &Writer{w: bufio.NewWriter(w), last: start}
+	cw.buf = append(cw.buf, magic...)
+	cw.buf = append(cw.buf, version)
+	cw.varint(start.UnixNano())
+	if _, err := cw.w.Write(cw.buf); err != nil {
+		return nil, err
+	}
+	return cw, nil
+}
+
+func (cw *Writer) varint(v int64) {
+	var b [binary.MaxVarintLen64]byte
+	cw.buf = append(cw.buf, b[:binary.PutVarint(b[:], v)]...)
+}
+
+func (cw *Writer) uvarint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	cw.buf = append(cw.buf, b[:binary.PutUvarint(b[:], v)]...)
+}
+
+func (cw *Writer) string(s string) {
+	cw.uvarint(uint64(len(s)))
+	cw.buf = append(cw.buf, s...)
+}
+
+// record starts a new record with the fields common to all events, times are
+// encoded as the difference from the previous record to keep them small.
+func (cw *Writer) record(kind Kind, t time.Time, pid int) {
+	cw.buf = append(cw.buf[:0], byte(kind))
+	cw.varint(int64(t.Sub(cw.last)))
+	cw.uvarint(uint64(pid))
+	cw.last = t
+}
+
+// Write writes a single event.
+func (cw *Writer) Write(ev Event) error {
+	cw.record(ev.Kind, ev.Time, ev.Pid)
+	switch ev.Kind {
+	case Exec:
+		cw.string(ev.Path)
+		cw.uvarint(uint64(len(ev.Args)))
+		for _, arg := range ev.Args {
+			cw.string(arg)
+		}
+	case Exit:
+		// the CPU time is prefixed by whether it is known
+		if ev.CPU == nil {
+			cw.uvarint(0)
+		} else {
+			cw.uvarint(1)
+			cw.uvarint(uint64(ev.CPU.User))
+			cw.uvarint(uint64(ev.CPU.System))
+		}
+	case Open:
+		cw.string(ev.Syscall)
+		cw.string(ev.Path)
+		cw.string(ev.Errno)
+		cw.uvarint(uint64(ev.Bytes))
+	case Signal:
+		cw.string(ev.Signal)
+	case Window:
+		cw.string(ev.Window)
+	case Wait:
+		cw.string(ev.Syscall)
+		cw.uvarint(uint64(ev.Duration))
+	case Fork:
+		cw.uvarint(uint64(ev.Child))
+	case Connect:
+		cw.string(ev.Path)
+	default:
+		return fmt.Errorf("cannot write event of unknown %v", ev.Kind)
+	}
+	_, err := cw.w.Write(cw.buf)
+	return err
+}
+
+// Close writes the end of an execution which ended at the given time and
+// flushes the capture. It does not close the underlying writer.
+func (cw *Writer) Close(end time.Time) error {
+	cw.record(kindEnd, end, 0)
+	if _, err := cw.w.Write(cw.buf); err != nil {
+		return err
+	}
+	return cw.w.Flush()
+}
+
+// Write writes a whole capture.
+func Write(w io.Writer, c *Capture) error {
+	cw, err := NewWriter(w, c.Start)
+	if err != nil {
+		return err
+	}
+	for _, ev := range c.Events {
+		if err := cw.Write(ev); err != nil {
+			return err
+		}
+	}
+	return cw.Close(c.End)
+}
+
+// WriteFile writes a whole capture to the given file.
+func WriteFile(path string, c *Capture) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := Write(f, c); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// maxStringLen protects against allocating huge strings for corrupt captures
+const maxStringLen = 1 << 20
+
+type reader struct {
+	r    *bufio.Reader
+	last time.Time
+}
+
+func (cr *reader) strings(fields ...*string) error {
+	for _, f := range fields {
+		n, err := binary.ReadUvarint(cr.r)
+		if err != nil {
+			return err
+		}
+		if n > maxStringLen {
+			return fmt.Errorf("string of %d bytes is too long", n)
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(cr.r, b); err != nil {
+			return err
+		}
+		*f = string(b)
+	}
+	return nil
+}
+
+func (cr *reader) cpuTime() (*CPUTime, error) {
+	known, err := binary.ReadUvarint(cr.r)
+	if err != nil || known == 0 {
+		return nil, err
+	}
+	user, err := binary.ReadUvarint(cr.r)
+	if err != nil {
+		return nil, err
+	}
+	system, err := binary.ReadUvarint(cr.r)
+	if err != nil {
+		return nil, err
+	}
+	return &CPUTime{User: time.Duration(user), System: time.Duration(system)}, nil
+}
+
+func (cr *reader) event() (Event, error) {
+	var ev Event
+	kind, err := cr.r.ReadByte()
+	if err != nil {
+		return ev, err
+	}
+	ev.Kind = Kind(kind)
+	delta, err := binary.ReadVarint(cr.r)
+	if err != nil {
+		return ev, err
+	}
+	ev.Time = cr.last.Add(time.Duration(delta))
+	cr.last = ev.Time
+	pid, err := binary.ReadUvarint(cr.r)
+	if err != nil {
+		return ev, err
+	}
+	ev.Pid = int(pid)
+
+	switch ev.Kind {
+	case kindEnd:
+	case Exit:
+		ev.CPU, err = cr.cpuTime()
+	case Exec:
+		if err := cr.strings(&ev.Path); err != nil {
+			return ev, err
+		}
+		n, err := binary.ReadUvarint(cr.r)
+		if err != nil {
+			return ev, err
+		}
+		// every argument takes at least a byte
+		if n > maxStringLen {
+			return ev, fmt.Errorf("%d arguments are too many", n)
+		}
+		if n > 0 {
+			ev.Args = make([]string, n)
+			for i := range ev.Args {
+				if err := cr.strings(&ev.Args[i]); err != nil {
+					return ev, err
+				}
+			}
+		}
+	case Open:
+		err = cr.strings(&ev.Syscall, &ev.Path, &ev.Errno)
+		if err == nil {
+			var n uint64
+			n, err = binary.ReadUvarint(cr.r)
+			ev.Bytes = int64(n)
+		}
+	case Signal:
+		err = cr.strings(&ev.Signal)
+	case Window:
+		err = cr.strings(&ev.Window)
+	case Wait:
+		if err = cr.strings(&ev.Syscall); err == nil {
+			var d uint64
+			d, err = binary.ReadUvarint(cr.r)
+			ev.Duration = time.Duration(d)
+		}
+	case Fork:
+		var child uint64
+		child, err = binary.ReadUvarint(cr.r)
+		ev.Child = int(child)
+	case Connect:
+		err = cr.strings(&ev.Path)
+	default:
+		err = fmt.Errorf("unknown event %v", ev.Kind)
+	}
+	return ev, err
+}
+
+// ErrNotCapture is returned when reading something other than a capture
+var ErrNotCapture = errors.New("not an etrace capture")
+
+// Read reads a whole capture.
+func Read(r io.Reader) (*Capture, error) {
+	cr := &reader{r: bufio.NewReader(r)}
+	header := make([]byte, len(magic)+1)
+	if _, err := io.ReadFull(cr.r, header); err != nil || !bytes.Equal(header[:len(magic)], magic) {
+		return nil, ErrNotCapture
+	}
+	if v := header[len(magic)]; v != version {
+		return nil, fmt.Errorf("unsupported capture version %d", v)
+	}
+	start, err := binary.ReadVarint(cr.r)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read capture header: %v", err)
+	}
+	c := &Capture{Start: time.Unix(0, start)}
+	cr.last = c.Start
+	for {
+		ev, err := cr.event()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, errors.New("capture is truncated")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot read capture event %d: %v", len(c.Events), err)
+		}
+		if ev.Kind == kindEnd {
+			c.End = ev.Time
+			return c, nil
+		}
+		c.Events = append(c.Events, ev)
+	}
+}
+
+// ReadFile reads a whole capture from the given file.
+func ReadFile(path string) (*Capture, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Read(f)
+}
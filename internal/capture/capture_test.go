@@ -0,0 +1,139 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package capture_test
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/anonymouse64/etrace/internal/capture"
+
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type captureTestSuite struct{}
+
+var _ = check.Suite(&captureTestSuite{})
+
+var start = time.Unix(1542815326, 0)
+
+func at(us int) time.Time {
+	return start.Add(time.Duration(us) * time.Microsecond)
+}
+
+var testCapture = &capture.Capture{
+	Start: start,
+	End:   at(500000),
+	Events: []capture.Event{
+		{Kind: capture.Exec, Time: at(0), Pid: 100, Path: "/usr/bin/snap", Args: []string{"snap", "run", "app"}},
+		{Kind: capture.Open, Time: at(10), Pid: 100, Syscall: "openat", Path: "/etc/ld.so.cache"},
+		{Kind: capture.Open, Time: at(20), Pid: 100, Syscall: "mkdir", Path: "/snap/app/x1/__pycache__", Errno: "EROFS"},
+		{Kind: capture.Open, Time: at(30), Pid: 100, Syscall: "read", Path: "/etc/ld.so.cache", Bytes: 4096},
+		{Kind: capture.Exec, Time: at(200000), Pid: 101, Path: "/bin/true"},
+		// events aren't necessarily in order
+		{Kind: capture.Exit, Time: at(150000), Pid: 101, CPU: &capture.CPUTime{User: 20 * time.Millisecond, System: 10 * time.Millisecond}},
+		{Kind: capture.Exit, Time: at(300000), Pid: 102},
+		{Kind: capture.Window, Time: at(400000), Window: "1234567"},
+		{Kind: capture.Wait, Time: at(420000), Pid: 100, Syscall: "futex", Duration: 250 * time.Millisecond},
+		{Kind: capture.Fork, Time: at(430000), Pid: 100, Child: 103},
+		{Kind: capture.Connect, Time: at(440000), Pid: 103, Path: "@/tmp/.X11-unix/X0"},
+		{Kind: capture.Signal, Time: at(450000), Pid: 100, Signal: "SIGKILL"},
+	},
+}
+
+func (s *captureTestSuite) TestRoundTrip(c *check.C) {
+	var buf bytes.Buffer
+	c.Assert(capture.Write(&buf, testCapture), check.IsNil)
+
+	read, err := capture.Read(&buf)
+	c.Assert(err, check.IsNil)
+	c.Check(read.Start.Equal(testCapture.Start), check.Equals, true)
+	c.Check(read.End.Equal(testCapture.End), check.Equals, true)
+	c.Assert(read.Events, check.HasLen, len(testCapture.Events))
+	for i, ev := range read.Events {
+		exp := testCapture.Events[i]
+		c.Check(ev.Time.Equal(exp.Time), check.Equals, true, check.Commentf("event %d", i))
+		ev.Time = exp.Time
+		c.Check(ev, check.DeepEquals, exp, check.Commentf("event %d", i))
+	}
+}
+
+func (s *captureTestSuite) TestFile(c *check.C) {
+	path := filepath.Join(c.MkDir(), "capture")
+	c.Assert(capture.WriteFile(path, testCapture), check.IsNil)
+
+	read, err := capture.ReadFile(path)
+	c.Assert(err, check.IsNil)
+	c.Check(read.Events, check.HasLen, len(testCapture.Events))
+}
+
+func (s *captureTestSuite) TestCompact(c *check.C) {
+	var buf bytes.Buffer
+	cw, err := capture.NewWriter(&buf, start)
+	c.Assert(err, check.IsNil)
+	before := buf.Len()
+	for i := 0; i < 100; i++ {
+		c.Assert(cw.Write(capture.Event{Kind: capture.Exit, Time: at(i), Pid: 100}), check.IsNil)
+	}
+	c.Assert(cw.Close(at(100)), check.IsNil)
+	// kind, time delta, pid and whether the CPU time is known all fit in a
+	// byte or two
+	c.Check(buf.Len()-before < 600, check.Equals, true)
+}
+
+func (s *captureTestSuite) TestReadErrors(c *check.C) {
+	_, err := capture.Read(bytes.NewBufferString("not a capture"))
+	c.Check(err, check.ErrorMatches, "not an etrace capture")
+
+	var buf bytes.Buffer
+	c.Assert(capture.Write(&buf, testCapture), check.IsNil)
+	data := buf.Bytes()
+
+	_, err = capture.Read(bytes.NewReader(data[:len(data)-2]))
+	c.Check(err, check.ErrorMatches, "capture is truncated")
+
+	// an unknown kind of event
+	corrupt := append([]byte(nil), data...)
+	// the first event follows the magic and the 9 byte start time
+	corrupt[len("ETRACE\x00\x01")+9] = 42
+	_, err = capture.Read(bytes.NewReader(corrupt))
+	c.Check(err, check.ErrorMatches, "cannot read capture event 0: unknown event kind 42")
+
+	// a capture of a later version
+	corrupt = append([]byte(nil), data...)
+	corrupt[len("ETRACE\x00")] = 2
+	_, err = capture.Read(bytes.NewReader(corrupt))
+	c.Check(err, check.ErrorMatches, "unsupported capture version 2")
+}
+
+func (s *captureTestSuite) TestAccessedPaths(c *check.C) {
+	// failed accesses are skipped and each path is only returned once
+	c.Check(testCapture.AccessedPaths(), check.DeepEquals, []string{"/etc/ld.so.cache"})
+	c.Check((&capture.Capture{}).AccessedPaths(), check.HasLen, 0)
+}
+
+func (s *captureTestSuite) TestWriteUnknownKind(c *check.C) {
+	cw, err := capture.NewWriter(&bytes.Buffer{}, start)
+	c.Assert(err, check.IsNil)
+	err = cw.Write(capture.Event{Kind: 42})
+	c.Check(err, check.ErrorMatches, "cannot write event of unknown kind 42")
+}
@@ -0,0 +1,261 @@
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package cgroup manages transient cgroup v2 groups to run programs in, so that
+// all of their descendants can be found and killed, even ones which daemonized.
+package cgroup
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	procSelf = "/proc/self"
+
+	// pollInterval is how often to check if a group is empty
+	pollInterval = 10 * time.Millisecond
+)
+
+// parentName is the name of the group the groups of etrace are created in,
+// which has the controllers they need enabled without changing the groups
+// etrace doesn't own.
+const parentName = "etrace"
+
+// Group is a transient cgroup
+type Group struct {
+	path string
+}
+
+// mountPoint returns where the cgroup v2 hierarchy is mounted, which is
+// /sys/fs/cgroup on unified systems and usually /sys/fs/cgroup/unified on
+// hybrid ones.
+func mountPoint() (string, error) {
+	f, err := os.Open(filepath.Join(procSelf, "mountinfo"))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		// the filesystem type follows the separator after the optional fields
+		fields := strings.Fields(s.Text())
+		for i, field := range fields {
+			if field == "-" && i+1 < len(fields) && fields[i+1] == "cgroup2" && len(fields) > 4 {
+				return fields[4], nil
+			}
+		}
+	}
+	if err := s.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("cgroup v2 is not mounted")
+}
+
+// currentGroup returns the path of the cgroup v2 group of the current process
+// relative to the mount point.
+func currentGroup() (string, error) {
+	out, err := ioutil.ReadFile(filepath.Join(procSelf, "cgroup"))
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		// the cgroup v2 hierarchy always has the ID 0 and no controllers
+		if strings.HasPrefix(line, "0::") {
+			return strings.TrimPrefix(line, "0::"), nil
+		}
+	}
+	return "", fmt.Errorf("current process is not in a cgroup v2 group")
+}
+
+// New creates a group with the given name in the group of etrace, which is
+// created next to the group of the current process if it doesn't exist yet.
+func New(name string) (*Group, error) {
+	if strings.Contains(name, "/") || name == "" || name == "." || name == ".." {
+		return nil, fmt.Errorf("cannot create cgroup: invalid name %q", name)
+	}
+	mount, err := mountPoint()
+	if err != nil {
+		return nil, fmt.Errorf("cannot create cgroup: %v", err)
+	}
+	current, err := currentGroup()
+	if err != nil {
+		return nil, fmt.Errorf("cannot create cgroup: %v", err)
+	}
+	// a group with processes can't have child groups with controllers
+	// enabled, so the group of etrace is a sibling of the current one,
+	// which other runs of etrace may have created already
+	parent := filepath.Join(mount, filepath.Dir(current), parentName)
+	if err := os.Mkdir(parent, 0755); err != nil && !os.IsExist(err) {
+		return nil, fmt.Errorf("cannot create cgroup: %v", err)
+	}
+	path := filepath.Join(parent, name)
+	if err := os.Mkdir(path, 0755); err != nil {
+		return nil, fmt.Errorf("cannot create cgroup: %v", err)
+	}
+	return &Group{path: path}, nil
+}
+
+// Path returns the path of the group.
+func (g *Group) Path() string {
+	return g.path
+}
+
+// Add moves the process with the given pid into the group, which the
+// processes it starts afterwards are in too.
+func (g *Group) Add(pid int) error {
+	procs := filepath.Join(g.path, "cgroup.procs")
+	if err := ioutil.WriteFile(procs, []byte(strconv.Itoa(pid)), 0644); err != nil {
+		return fmt.Errorf("cannot add pid %d to cgroup: %v", pid, err)
+	}
+	return nil
+}
+
+// cpuPeriod is the period in microseconds the cpu time of a group with a cpu
+// limit is accounted over
+const cpuPeriod = 100000
+
+// enableController enables the controller for the groups in the group of
+// etrace if it isn't already, which fails if the group the group of etrace is
+// in doesn't enable it, as etrace only changes the groups it created.
+func (g *Group) enableController(name string) error {
+	parent := filepath.Dir(g.path)
+	control := filepath.Join(parent, "cgroup.subtree_control")
+	out, err := ioutil.ReadFile(control)
+	if err == nil {
+		for _, enabled := range strings.Fields(string(out)) {
+			if enabled == name {
+				return nil
+			}
+		}
+	}
+	out, err = ioutil.ReadFile(filepath.Join(parent, "cgroup.controllers"))
+	if err != nil {
+		return err
+	}
+	available := false
+	for _, controller := range strings.Fields(string(out)) {
+		if controller == name {
+			available = true
+		}
+	}
+	if !available {
+		return fmt.Errorf("%s controller is not enabled for %s", name, filepath.Dir(parent))
+	}
+	return ioutil.WriteFile(control, []byte("+"+name), 0644)
+}
+
+// SetCPULimit limits the processes of the group to the given number of CPUs
+// worth of time, like 0.5 for half of a single CPU.
+func (g *Group) SetCPULimit(cpus float64) error {
+	if cpus <= 0 {
+		return fmt.Errorf("cannot limit cpu of cgroup: invalid number of cpus %v", cpus)
+	}
+	if err := g.enableController("cpu"); err != nil {
+		return fmt.Errorf("cannot enable cpu controller: %v", err)
+	}
+	quota := int64(cpus * cpuPeriod)
+	limit := fmt.Sprintf("%d %d", quota, cpuPeriod)
+	if err := ioutil.WriteFile(filepath.Join(g.path, "cpu.max"), []byte(limit), 0644); err != nil {
+		return fmt.Errorf("cannot limit cpu of cgroup: %v", err)
+	}
+	return nil
+}
+
+// SetMemoryLimit limits the memory of the processes of the group to the given
+// number of bytes, beyond which they are reclaimed or swapped out.
+func (g *Group) SetMemoryLimit(bytes uint64) error {
+	if err := g.enableController("memory"); err != nil {
+		return fmt.Errorf("cannot enable memory controller: %v", err)
+	}
+	// memory.high throttles the processes like a machine with less memory
+	// would, while memory.max would kill them instead
+	limit := strconv.FormatUint(bytes, 10)
+	if err := ioutil.WriteFile(filepath.Join(g.path, "memory.high"), []byte(limit), 0644); err != nil {
+		return fmt.Errorf("cannot limit memory of cgroup: %v", err)
+	}
+	return nil
+}
+
+// Pids returns the pids of the processes in the group.
+func (g *Group) Pids() ([]int, error) {
+	out, err := ioutil.ReadFile(filepath.Join(g.path, "cgroup.procs"))
+	if err != nil {
+		return nil, err
+	}
+	var pids []int
+	for _, line := range strings.Fields(string(out)) {
+		pid, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pid in cgroup.procs: %v", err)
+		}
+		pids = append(pids, pid)
+	}
+	return pids, nil
+}
+
+// Populated returns whether there are any processes in the group.
+func (g *Group) Populated() (bool, error) {
+	out, err := ioutil.ReadFile(filepath.Join(g.path, "cgroup.events"))
+	if err != nil {
+		return false, err
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if kv := strings.Fields(line); len(kv) == 2 && kv[0] == "populated" {
+			return kv[1] == "1", nil
+		}
+	}
+	return false, fmt.Errorf("cannot find populated in cgroup.events")
+}
+
+// WaitEmpty waits until all the processes in the group have exited.
+func (g *Group) WaitEmpty(ctx context.Context) error {
+	for {
+		populated, err := g.Populated()
+		if err != nil {
+			return err
+		}
+		if !populated {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// Remove removes the group, which must be empty, and the group of etrace if no
+// other run of etrace has groups in it. Removing a group which was already
+// removed does nothing.
+func (g *Group) Remove() error {
+	if err := os.Remove(g.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	// the group of etrace can't be removed while other runs of etrace
+	// have groups in it, which remove it when they are done
+	os.Remove(filepath.Dir(g.path))
+	return nil
+}
@@ -0,0 +1,174 @@
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package cgroup_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/anonymouse64/etrace/internal/cgroup"
+
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type cgroupTestSuite struct {
+	procSelf string
+	mount    string
+	restore  func()
+}
+
+var _ = check.Suite(&cgroupTestSuite{})
+
+func (s *cgroupTestSuite) SetUpTest(c *check.C) {
+	s.procSelf = c.MkDir()
+	s.mount = c.MkDir()
+	s.restore = cgroup.MockProcSelf(s.procSelf)
+
+	mountinfo := fmt.Sprintf(`25 30 0:23 / /sys rw,nosuid,nodev,noexec,relatime shared:7 - sysfs sysfs rw
+34 25 0:29 / /sys/fs/cgroup ro,nosuid,nodev,noexec shared:9 - tmpfs tmpfs ro,mode=755
+35 34 0:30 / %s rw,nosuid,nodev,noexec,relatime shared:10 - cgroup2 cgroup2 rw,nsdelegate
+`, s.mount)
+	c.Assert(ioutil.WriteFile(filepath.Join(s.procSelf, "mountinfo"), []byte(mountinfo), 0644), check.IsNil)
+	cgroups := "12:memory:/user.slice/user-1000.slice/session-2.scope\n0::/user.slice/user-1000.slice/session-2.scope\n"
+	c.Assert(ioutil.WriteFile(filepath.Join(s.procSelf, "cgroup"), []byte(cgroups), 0644), check.IsNil)
+	c.Assert(os.MkdirAll(filepath.Join(s.mount, "user.slice/user-1000.slice/session-2.scope"), 0755), check.IsNil)
+}
+
+func (s *cgroupTestSuite) TearDownTest(c *check.C) {
+	s.restore()
+}
+
+func (s *cgroupTestSuite) TestNew(c *check.C) {
+	g, err := cgroup.New("etrace-1-0")
+	c.Assert(err, check.IsNil)
+	// the group is created in the group of etrace next to the current one
+	parent := filepath.Join(s.mount, "user.slice/user-1000.slice/etrace")
+	path := filepath.Join(parent, "etrace-1-0")
+	c.Assert(g.Path(), check.Equals, path)
+	info, err := os.Stat(path)
+	c.Assert(err, check.IsNil)
+	c.Assert(info.IsDir(), check.Equals, true)
+
+	// the group of etrace is shared with the other groups
+	other, err := cgroup.New("etrace-1-1")
+	c.Assert(err, check.IsNil)
+	c.Assert(other.Path(), check.Equals, filepath.Join(parent, "etrace-1-1"))
+
+	c.Assert(g.Add(42), check.IsNil)
+	out, err := ioutil.ReadFile(filepath.Join(path, "cgroup.procs"))
+	c.Assert(err, check.IsNil)
+	c.Check(string(out), check.Equals, "42")
+	c.Assert(os.Remove(filepath.Join(path, "cgroup.procs")), check.IsNil)
+
+	c.Assert(g.Remove(), check.IsNil)
+	_, err = os.Stat(path)
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+	// the group of etrace is kept while it has other groups
+	_, err = os.Stat(parent)
+	c.Assert(err, check.IsNil)
+	// removing again does nothing
+	c.Assert(g.Remove(), check.IsNil)
+
+	// the last group removes the group of etrace
+	c.Assert(other.Remove(), check.IsNil)
+	_, err = os.Stat(parent)
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+
+	_, err = cgroup.New("../etrace-1-0")
+	c.Assert(err, check.ErrorMatches, `cannot create cgroup: invalid name "../etrace-1-0"`)
+}
+
+func (s *cgroupTestSuite) TestLimits(c *check.C) {
+	g, err := cgroup.New("etrace-1-0")
+	c.Assert(err, check.IsNil)
+	parent := filepath.Join(s.mount, "user.slice/user-1000.slice/etrace")
+	c.Assert(ioutil.WriteFile(filepath.Join(parent, "cgroup.controllers"), []byte("cpu io memory pids\n"), 0644), check.IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(parent, "cgroup.subtree_control"), []byte("cpu io\n"), 0644), check.IsNil)
+
+	c.Assert(g.SetCPULimit(1.5), check.IsNil)
+	out, err := ioutil.ReadFile(filepath.Join(g.Path(), "cpu.max"))
+	c.Assert(err, check.IsNil)
+	c.Check(string(out), check.Equals, "150000 100000")
+
+	c.Assert(g.SetMemoryLimit(512<<20), check.IsNil)
+	out, err = ioutil.ReadFile(filepath.Join(g.Path(), "memory.high"))
+	c.Assert(err, check.IsNil)
+	c.Check(string(out), check.Equals, "536870912")
+	// only the controller which wasn't enabled yet was enabled
+	out, err = ioutil.ReadFile(filepath.Join(parent, "cgroup.subtree_control"))
+	c.Assert(err, check.IsNil)
+	c.Check(string(out), check.Equals, "+memory")
+
+	c.Check(g.SetCPULimit(0), check.ErrorMatches, "cannot limit cpu of cgroup: invalid number of cpus 0")
+
+	// the controllers of the groups etrace didn't create aren't changed
+	c.Assert(ioutil.WriteFile(filepath.Join(parent, "cgroup.controllers"), []byte("io pids\n"), 0644), check.IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(parent, "cgroup.subtree_control"), []byte("io\n"), 0644), check.IsNil)
+	c.Check(g.SetMemoryLimit(512<<20), check.ErrorMatches, "cannot enable memory controller: memory controller is not enabled for .*/user.slice/user-1000.slice")
+}
+
+func (s *cgroupTestSuite) TestNewNoCgroup2(c *check.C) {
+	c.Assert(ioutil.WriteFile(filepath.Join(s.procSelf, "mountinfo"), []byte("25 30 0:23 / /sys rw shared:7 - sysfs sysfs rw\n"), 0644), check.IsNil)
+	_, err := cgroup.New("etrace-1-0")
+	c.Assert(err, check.ErrorMatches, "cannot create cgroup: cgroup v2 is not mounted")
+}
+
+func (s *cgroupTestSuite) TestNewNotInGroup(c *check.C) {
+	c.Assert(ioutil.WriteFile(filepath.Join(s.procSelf, "cgroup"), []byte("12:memory:/\n"), 0644), check.IsNil)
+	_, err := cgroup.New("etrace-1-0")
+	c.Assert(err, check.ErrorMatches, "cannot create cgroup: current process is not in a cgroup v2 group")
+}
+
+func (s *cgroupTestSuite) TestPidsAndWaitEmpty(c *check.C) {
+	g, err := cgroup.New("etrace-1-0")
+	c.Assert(err, check.IsNil)
+	defer g.Remove()
+	procs := filepath.Join(g.Path(), "cgroup.procs")
+	events := filepath.Join(g.Path(), "cgroup.events")
+	c.Assert(ioutil.WriteFile(procs, []byte("10\n11\n"), 0644), check.IsNil)
+	c.Assert(ioutil.WriteFile(events, []byte("populated 1\nfrozen 0\n"), 0644), check.IsNil)
+
+	pids, err := g.Pids()
+	c.Assert(err, check.IsNil)
+	c.Assert(pids, check.DeepEquals, []int{10, 11})
+
+	populated, err := g.Populated()
+	c.Assert(err, check.IsNil)
+	c.Assert(populated, check.Equals, true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	c.Assert(g.WaitEmpty(ctx), check.Equals, context.DeadlineExceeded)
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		ioutil.WriteFile(events+".tmp", []byte("populated 0\nfrozen 0\n"), 0644)
+		os.Rename(events+".tmp", events)
+	}()
+	c.Assert(g.WaitEmpty(context.Background()), check.IsNil)
+
+	os.Remove(procs)
+	os.Remove(events)
+}
@@ -0,0 +1,183 @@
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package ci checks the measurements of a program against the expectations of
+// a QA suite like spread or checkbox.
+package ci
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/anonymouse64/etrace/analysis"
+	"github.com/anonymouse64/etrace/internal/files"
+	"github.com/anonymouse64/etrace/internal/schema"
+)
+
+// Expectations are what a program is expected to do when it starts
+type Expectations struct {
+	// Command is the command to measure
+	Command []string `yaml:"command"`
+	// UseSnapRun runs the command through snap run
+	UseSnapRun bool `yaml:"use-snap-run,omitempty"`
+	// Runs is how many times to start the program to measure its start time
+	Runs uint `yaml:"runs,omitempty"`
+
+	// the window to wait for, the class defaults to the command like with
+	// etrace exec
+	WindowName      string `yaml:"window-name,omitempty"`
+	WindowClass     string `yaml:"class-name,omitempty"`
+	WindowClassName string `yaml:"window-class-name,omitempty"`
+	NoWindowWait    bool   `yaml:"no-window-wait,omitempty"`
+
+	// MaxColdStart and MaxHotStart are the maximum mean time to display
+	MaxColdStart time.Duration `yaml:"max-cold-start,omitempty"`
+	MaxHotStart  time.Duration `yaml:"max-hot-start,omitempty"`
+	// MaxFiles is the maximum number of files the program may access
+	MaxFiles int `yaml:"max-files,omitempty"`
+	// ForbiddenPaths are globs of paths the program must not access, where **
+	// matches across directories
+	ForbiddenPaths []string `yaml:"forbidden-paths,omitempty"`
+}
+
+// Read reads the expectations from the given YAML file.
+func Read(path string) (*Expectations, error) {
+	out, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var e Expectations
+	if err := yaml.UnmarshalStrict(out, &e); err != nil {
+		return nil, fmt.Errorf("cannot parse expectations %s: %v", path, err)
+	}
+	if len(e.Command) == 0 {
+		return nil, fmt.Errorf("cannot use expectations %s: no command", path)
+	}
+	for _, pattern := range e.ForbiddenPaths {
+		if _, err := files.NewGlob(pattern); err != nil {
+			return nil, fmt.Errorf("cannot use expectations %s: %v", path, err)
+		}
+	}
+	return &e, nil
+}
+
+// NeedsFileTrace returns whether the files the program accesses need to be
+// traced to check the expectations.
+func (e *Expectations) NeedsFileTrace() bool {
+	return e.MaxFiles != 0 || len(e.ForbiddenPaths) != 0
+}
+
+// Outcome is the outcome of checking an expectation
+type Outcome struct {
+	Expectation string
+	Passed      bool
+	Message     string
+}
+
+func (o Outcome) String() string {
+	status := "PASS"
+	if !o.Passed {
+		status = "FAIL"
+	}
+	return fmt.Sprintf("%s: %s: %s", status, o.Expectation, o.Message)
+}
+
+// CheckStart checks the result of etrace exec against the maximum start time.
+func CheckStart(name string, max time.Duration, res *analysis.Result) Outcome {
+	stats := analysis.Compute(res.TimesToDisplay())
+	o := Outcome{Expectation: name}
+	switch {
+	case stats.N == 0:
+		o.Message = "no run displayed a window"
+		if errs := res.Errors(); len(errs) != 0 {
+			o.Message += fmt.Sprintf(" (%s)", errs[0])
+		}
+	case stats.Mean > max:
+		o.Message = fmt.Sprintf("mean %v over %d runs is over %v", stats.Mean, stats.N, max)
+	default:
+		o.Passed = true
+		o.Message = fmt.Sprintf("mean %v over %d runs", stats.Mean, stats.N)
+	}
+	return o
+}
+
+// FileResult is the part of the JSON output of etrace file the expectations
+// are checked against
+type FileResult struct {
+	ExecvePaths *struct {
+		AllFiles []struct {
+			Path    string
+			Program string
+		}
+	}
+}
+
+// LoadFileResult reads the JSON output of etrace file.
+func LoadFileResult(path string) (*FileResult, error) {
+	out, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var res FileResult
+	legacy, err := schema.Downgrade(out)
+	if err == nil {
+		err = json.Unmarshal(legacy, &res)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode etrace file result %s: %v", path, err)
+	}
+	if res.ExecvePaths == nil {
+		return nil, fmt.Errorf("etrace file result %s has no files", path)
+	}
+	return &res, nil
+}
+
+// CheckFiles checks the result of etrace file against the expectations for
+// the files the program accesses.
+func (e *Expectations) CheckFiles(res *FileResult) []Outcome {
+	var outcomes []Outcome
+	if e.MaxFiles != 0 {
+		o := Outcome{
+			Expectation: "max-files",
+			Message:     fmt.Sprintf("%d files accessed, at most %d expected", len(res.ExecvePaths.AllFiles), e.MaxFiles),
+		}
+		o.Passed = len(res.ExecvePaths.AllFiles) <= e.MaxFiles
+		outcomes = append(outcomes, o)
+	}
+	for _, pattern := range e.ForbiddenPaths {
+		// the patterns were validated when reading the expectations
+		glob, _ := files.NewGlob(pattern)
+		o := Outcome{
+			Expectation: "forbidden-paths",
+			Passed:      true,
+			Message:     fmt.Sprintf("nothing matching %s was accessed", pattern),
+		}
+		for _, f := range res.ExecvePaths.AllFiles {
+			if glob.Match(f.Path) {
+				o.Passed = false
+				o.Message = fmt.Sprintf("%s accessed %s, which matches %s", f.Program, f.Path, pattern)
+				break
+			}
+		}
+		outcomes = append(outcomes, o)
+	}
+	return outcomes
+}
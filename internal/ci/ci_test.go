@@ -0,0 +1,116 @@
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package ci_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/anonymouse64/etrace/analysis"
+	"github.com/anonymouse64/etrace/internal/ci"
+
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type ciTestSuite struct{}
+
+var _ = check.Suite(&ciTestSuite{})
+
+func (s *ciTestSuite) TestRead(c *check.C) {
+	path := filepath.Join(c.MkDir(), "expectations.yaml")
+	c.Assert(ioutil.WriteFile(path, []byte(`command: [foo, --bar]
+use-snap-run: true
+runs: 3
+max-cold-start: 3s
+max-files: 500
+forbidden-paths:
+- /etc/passwd
+- /home/*/.ssh/**
+`), 0644), check.IsNil)
+	e, err := ci.Read(path)
+	c.Assert(err, check.IsNil)
+	c.Check(e, check.DeepEquals, &ci.Expectations{
+		Command:        []string{"foo", "--bar"},
+		UseSnapRun:     true,
+		Runs:           3,
+		MaxColdStart:   3 * time.Second,
+		MaxFiles:       500,
+		ForbiddenPaths: []string{"/etc/passwd", "/home/*/.ssh/**"},
+	})
+	c.Check(e.NeedsFileTrace(), check.Equals, true)
+
+	c.Assert(ioutil.WriteFile(path, []byte("max-files: 1\n"), 0644), check.IsNil)
+	_, err = ci.Read(path)
+	c.Check(err, check.ErrorMatches, "cannot use expectations .*: no command")
+
+	c.Assert(ioutil.WriteFile(path, []byte("command: [foo]\nmax-cold: 1s\n"), 0644), check.IsNil)
+	_, err = ci.Read(path)
+	c.Check(err, check.ErrorMatches, "(?s)cannot parse expectations .*field max-cold not found.*")
+
+	c.Assert(ioutil.WriteFile(path, []byte("command: [foo]\nforbidden-paths: ['/etc/[a']\n"), 0644), check.IsNil)
+	_, err = ci.Read(path)
+	c.Check(err, check.ErrorMatches, "cannot use expectations .*: invalid glob .*")
+}
+
+func (s *ciTestSuite) TestCheckStart(c *check.C) {
+	res, err := analysis.Load(strings.NewReader(`{"Runs": [{"TimeToDisplay": 1000000000}, {"TimeToDisplay": 2000000000}]}`))
+	c.Assert(err, check.IsNil)
+
+	o := ci.CheckStart("max-cold-start", 2*time.Second, res)
+	c.Check(o.String(), check.Equals, "PASS: max-cold-start: mean 1.5s over 2 runs")
+	o = ci.CheckStart("max-cold-start", time.Second, res)
+	c.Check(o.String(), check.Equals, "FAIL: max-cold-start: mean 1.5s over 2 runs is over 1s")
+
+	res, err = analysis.Load(strings.NewReader(`{"Runs": [{"Errors": ["timed out waiting for window"]}]}`))
+	c.Assert(err, check.IsNil)
+	o = ci.CheckStart("max-hot-start", time.Second, res)
+	c.Check(o.String(), check.Equals, "FAIL: max-hot-start: no run displayed a window (timed out waiting for window)")
+}
+
+func (s *ciTestSuite) TestCheckFiles(c *check.C) {
+	path := filepath.Join(c.MkDir(), "files.json")
+	c.Assert(ioutil.WriteFile(path, []byte(`{"ExecvePaths": {"AllFiles": [
+		{"Path": "/snap/foo/1/bin/foo", "Program": "foo"},
+		{"Path": "/home/user/.ssh/id_rsa", "Program": "foo-helper"}
+	]}}`), 0644), check.IsNil)
+	res, err := ci.LoadFileResult(path)
+	c.Assert(err, check.IsNil)
+
+	e := &ci.Expectations{
+		MaxFiles:       1,
+		ForbiddenPaths: []string{"/etc/passwd", "/home/*/.ssh/**"},
+	}
+	var outcomes []string
+	for _, o := range e.CheckFiles(res) {
+		outcomes = append(outcomes, o.String())
+	}
+	c.Check(outcomes, check.DeepEquals, []string{
+		"FAIL: max-files: 2 files accessed, at most 1 expected",
+		"PASS: forbidden-paths: nothing matching /etc/passwd was accessed",
+		"FAIL: forbidden-paths: foo-helper accessed /home/user/.ssh/id_rsa, which matches /home/*/.ssh/**",
+	})
+
+	c.Assert(ioutil.WriteFile(path, []byte(`{"Errors": ["failed"]}`), 0644), check.IsNil)
+	_, err = ci.LoadFileResult(path)
+	c.Check(err, check.ErrorMatches, "etrace file result .* has no files")
+}
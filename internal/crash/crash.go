@@ -0,0 +1,247 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package crash finds programs crashing during a run and collects what is
+// needed to debug the crash, so that crashes which only happen now and then
+// while measuring can be investigated.
+package crash
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+var (
+	// coredumpctl is the command to retrieve core dumps from
+	// systemd-coredump with
+	coredumpctl = "coredumpctl"
+
+	// coreTimeout is how long to wait for systemd-coredump to collect the
+	// core dump of a crash, which takes a while for large programs
+	coreTimeout = 10 * time.Second
+	// corePollInterval is how often to check for the core dump
+	corePollInterval = 500 * time.Millisecond
+)
+
+// Crash is a program being killed by a signal which dumps core by default
+type Crash struct {
+	// Signal is the name of the signal, like SIGSEGV
+	Signal string
+	// Core is where the core dump was saved to, it is only saved with
+	// --crash-dir
+	Core string `json:",omitempty"`
+	// Stderr is the last lines the program wrote to stderr, they are only
+	// collected if stderr is logged to a file
+	Stderr []string `json:",omitempty"`
+}
+
+// crashSignals are the signals whose default action is to dump core, which
+// are the ones programs crash with, unlike the ones etrace kills them with
+var crashSignals = map[syscall.Signal]string{
+	syscall.SIGABRT: "SIGABRT",
+	syscall.SIGBUS:  "SIGBUS",
+	syscall.SIGFPE:  "SIGFPE",
+	syscall.SIGILL:  "SIGILL",
+	syscall.SIGQUIT: "SIGQUIT",
+	syscall.SIGSEGV: "SIGSEGV",
+	syscall.SIGSYS:  "SIGSYS",
+	syscall.SIGTRAP: "SIGTRAP",
+	syscall.SIGXCPU: "SIGXCPU",
+	syscall.SIGXFSZ: "SIGXFSZ",
+}
+
+// IsCrash returns whether a program killed by the signal crashed.
+func IsCrash(sig syscall.Signal) bool {
+	_, ok := crashSignals[sig]
+	return ok
+}
+
+// New returns the crash of a program killed by the signal.
+func New(sig syscall.Signal) *Crash {
+	name, ok := crashSignals[sig]
+	if !ok {
+		name = fmt.Sprintf("signal %d", sig)
+	}
+	return &Crash{Signal: name}
+}
+
+// FromWaitError returns the signal of the error of waiting for a command if it
+// crashed.
+func FromWaitError(err error) (syscall.Signal, bool) {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return 0, false
+	}
+	status, ok := exitErr.Sys().(syscall.WaitStatus)
+	if !ok || !status.Signaled() || !IsCrash(status.Signal()) {
+		return 0, false
+	}
+	return status.Signal(), true
+}
+
+const (
+	pPID    = 1
+	wEXITED = 0x4
+	wNOWAIT = 0x1000000
+
+	// the si_code of children killed by a signal, with and without dumping
+	// core
+	cldKilled = 2
+	cldDumped = 3
+)
+
+// Watcher watches a child process for crashing without reaping it, so that it
+// can still be waited for as usual
+type Watcher struct {
+	done chan struct{}
+	sig  syscall.Signal
+}
+
+// Watch starts watching the child process with the pid.
+func Watch(pid int) *Watcher {
+	w := &Watcher{done: make(chan struct{})}
+	go func() {
+		defer close(w.done)
+		sig, err := waitSignal(pid)
+		if err == nil && IsCrash(sig) {
+			w.sig = sig
+		}
+	}()
+	return w
+}
+
+// waitSignal waits for the child process to exit without reaping it and
+// returns the signal it was killed with, if any.
+func waitSignal(pid int) (syscall.Signal, error) {
+	var info [128]byte
+	for {
+		_, _, errno := syscall.Syscall6(syscall.SYS_WAITID, pPID, uintptr(pid), uintptr(unsafe.Pointer(&info[0])), wEXITED|wNOWAIT, 0, 0)
+		if errno == syscall.EINTR {
+			continue
+		}
+		if errno != 0 {
+			// the process was reaped already
+			return 0, errno
+		}
+		break
+	}
+	// siginfo_t starts with the int si_signo, si_errno and si_code, followed
+	// by a union aligned like a pointer starting with si_pid, si_uid and
+	// si_status
+	code := *(*int32)(unsafe.Pointer(&info[8]))
+	align := unsafe.Sizeof(uintptr(0))
+	union := (12 + align - 1) &^ (align - 1)
+	status := *(*int32)(unsafe.Pointer(&info[union+8]))
+	if code != cldKilled && code != cldDumped {
+		return 0, nil
+	}
+	return syscall.Signal(status), nil
+}
+
+// Done is closed once the process exited.
+func (w *Watcher) Done() <-chan struct{} {
+	return w.done
+}
+
+// Crashed returns the signal the process crashed with, if it exited already
+// and crashed.
+func (w *Watcher) Crashed() (syscall.Signal, bool) {
+	select {
+	case <-w.done:
+		return w.sig, w.sig != 0
+	default:
+		return 0, false
+	}
+}
+
+// RaiseCoreLimit raises the limit of the size of core dumps of etrace and the
+// programs it runs to the maximum allowed, since it is often 0.
+func RaiseCoreLimit() error {
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_CORE, &limit); err != nil {
+		return err
+	}
+	limit.Cur = limit.Max
+	return syscall.Setrlimit(syscall.RLIMIT_CORE, &limit)
+}
+
+// SaveCore saves the latest core dump collected by systemd-coredump since the
+// given time to the path, waiting for it to be collected.
+func SaveCore(since time.Time, path string) error {
+	deadline := time.Now().Add(coreTimeout)
+	for {
+		cmd := exec.Command(coredumpctl, "--no-pager", fmt.Sprintf("--since=@%d", since.Unix()), "dump", "-o", path)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		err := cmd.Run()
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("cannot save core dump: %v (%s)", err, strings.TrimSpace(stderr.String()))
+		}
+		time.Sleep(corePollInterval)
+	}
+}
+
+// tailBytes is how much of the end of a file is read to find its last lines
+const tailBytes = 64 * 1024
+
+// Tail returns the last lines of the file written after the offset.
+func Tail(path string, offset int64, lines int) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	partial := false
+	if info.Size()-offset > tailBytes {
+		offset = info.Size() - tailBytes
+		partial = true
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, f); err != nil {
+		return nil, err
+	}
+	all := strings.Split(strings.TrimRight(buf.String(), "\n"), "\n")
+	if partial {
+		// the first line was cut off
+		all = all[1:]
+	}
+	if len(all) == 0 || len(all) == 1 && all[0] == "" {
+		return nil, nil
+	}
+	if len(all) > lines {
+		all = all[len(all)-lines:]
+	}
+	return all, nil
+}
@@ -0,0 +1,139 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package crash_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/anonymouse64/etrace/internal/crash"
+
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type crashTestSuite struct{}
+
+var _ = check.Suite(&crashTestSuite{})
+
+func (s *crashTestSuite) TestWatchCrash(c *check.C) {
+	// don't leave a core behind
+	cmd := exec.Command("sh", "-c", "ulimit -c 0; kill -SEGV $$")
+	c.Assert(cmd.Start(), check.IsNil)
+	w := crash.Watch(cmd.Process.Pid)
+	select {
+	case <-w.Done():
+	case <-time.After(5 * time.Second):
+		c.Fatal("process did not exit")
+	}
+	sig, ok := w.Crashed()
+	c.Check(ok, check.Equals, true)
+	c.Check(sig, check.Equals, syscall.SIGSEGV)
+	c.Check(crash.New(sig), check.DeepEquals, &crash.Crash{Signal: "SIGSEGV"})
+
+	// the process can still be waited for
+	err := cmd.Wait()
+	sig, ok = crash.FromWaitError(err)
+	c.Check(ok, check.Equals, true)
+	c.Check(sig, check.Equals, syscall.SIGSEGV)
+}
+
+func (s *crashTestSuite) TestWatchNoCrash(c *check.C) {
+	for _, script := range []string{"exit 3", "kill -TERM $$"} {
+		cmd := exec.Command("sh", "-c", script)
+		c.Assert(cmd.Start(), check.IsNil)
+		w := crash.Watch(cmd.Process.Pid)
+		<-w.Done()
+		_, ok := w.Crashed()
+		c.Check(ok, check.Equals, false, check.Commentf(script))
+		err := cmd.Wait()
+		c.Check(err, check.NotNil)
+		_, ok = crash.FromWaitError(err)
+		c.Check(ok, check.Equals, false, check.Commentf(script))
+	}
+}
+
+func (s *crashTestSuite) TestCrashedRunning(c *check.C) {
+	cmd := exec.Command("sleep", "10")
+	c.Assert(cmd.Start(), check.IsNil)
+	defer cmd.Wait()
+	defer cmd.Process.Kill()
+	w := crash.Watch(cmd.Process.Pid)
+	_, ok := w.Crashed()
+	c.Check(ok, check.Equals, false)
+}
+
+func (s *crashTestSuite) TestNewUnknownSignal(c *check.C) {
+	c.Check(crash.New(syscall.SIGTERM).Signal, check.Equals, fmt.Sprintf("signal %d", syscall.SIGTERM))
+}
+
+func (s *crashTestSuite) TestSaveCore(c *check.C) {
+	dir := c.MkDir()
+	mock := filepath.Join(dir, "coredumpctl")
+	script := "#!/bin/sh\necho \"$@\" > " + filepath.Join(dir, "args") + "\n"
+	c.Assert(ioutil.WriteFile(mock, []byte(script), 0755), check.IsNil)
+	restore := crash.MockCoredumpctl(mock)
+	defer restore()
+
+	core := filepath.Join(dir, "core")
+	c.Assert(crash.SaveCore(time.Unix(1700000000, 0), core), check.IsNil)
+	args, err := ioutil.ReadFile(filepath.Join(dir, "args"))
+	c.Assert(err, check.IsNil)
+	c.Check(string(args), check.Equals, "--no-pager --since=@1700000000 dump -o "+core+"\n")
+
+	restore = crash.MockCoreTimeout(50*time.Millisecond, 10*time.Millisecond)
+	defer restore()
+	script = "#!/bin/sh\necho 'No coredumps found.' >&2\nexit 1\n"
+	c.Assert(ioutil.WriteFile(mock, []byte(script), 0755), check.IsNil)
+	err = crash.SaveCore(time.Unix(1700000000, 0), core)
+	c.Check(err, check.ErrorMatches, `cannot save core dump: exit status 1 \(No coredumps found.\)`)
+}
+
+func (s *crashTestSuite) TestTail(c *check.C) {
+	path := filepath.Join(c.MkDir(), "stderr.log")
+	before := "output of an earlier run\n"
+	c.Assert(ioutil.WriteFile(path, []byte(before+"one\ntwo\nthree\n"), 0644), check.IsNil)
+
+	lines, err := crash.Tail(path, int64(len(before)), 2)
+	c.Assert(err, check.IsNil)
+	c.Check(lines, check.DeepEquals, []string{"two", "three"})
+	lines, err = crash.Tail(path, int64(len(before)), 10)
+	c.Assert(err, check.IsNil)
+	c.Check(lines, check.DeepEquals, []string{"one", "two", "three"})
+
+	// nothing was written by the run
+	info, err := ioutil.ReadFile(path)
+	c.Assert(err, check.IsNil)
+	lines, err = crash.Tail(path, int64(len(info)), 10)
+	c.Assert(err, check.IsNil)
+	c.Check(lines, check.HasLen, 0)
+
+	// only the end of long output is read
+	long := strings.Repeat("x", 70*1024) + "\nlast\n"
+	c.Assert(ioutil.WriteFile(path, []byte(long), 0644), check.IsNil)
+	lines, err = crash.Tail(path, 0, 10)
+	c.Assert(err, check.IsNil)
+	c.Check(lines, check.DeepEquals, []string{"last"})
+}
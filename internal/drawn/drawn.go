@@ -0,0 +1,101 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package drawn finds when the content of a window stops changing by taking
+// screenshots of it, which approximates when the window was fully drawn
+// rather than just mapped, like reportFullyDrawn on Android.
+package drawn
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/anonymouse64/etrace/internal/xdotool"
+)
+
+var (
+	// xwd dumps X11 windows
+	xwd = "xwd"
+	// grim takes screenshots on wlroots compositors like sway
+	grim = "grim"
+)
+
+// Capturer takes a screenshot of the window with the ID
+type Capturer func(wid string) ([]byte, error)
+
+// run returns the output of the command.
+func run(name string, args ...string) ([]byte, error) {
+	cmd := exec.Command(name, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("cannot take screenshot with %s: %v (%s)", name, err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// ForTool returns the capturer to use with the tool used for windows.
+func ForTool(tool string) (Capturer, error) {
+	switch tool {
+	case xdotool.ToolXDoTool:
+		return func(wid string) ([]byte, error) {
+			return run(xwd, "-silent", "-id", wid)
+		}, nil
+	case xdotool.ToolSway:
+		// grim can't capture a single window, so the whole screen is
+		// compared instead
+		return func(wid string) ([]byte, error) {
+			return run(grim, "-t", "ppm", "-")
+		}, nil
+	default:
+		return nil, fmt.Errorf("cannot take screenshots of windows with %s", tool)
+	}
+}
+
+// WaitDrawn takes a screenshot of the window every interval until its content
+// did not change for the stable duration and returns when the content last
+// changed, which is when the first screenshot with the final content was taken.
+func WaitDrawn(ctx context.Context, capture Capturer, wid string, interval, stable time.Duration) (time.Time, error) {
+	var last [sha256.Size]byte
+	var changed time.Time
+	for {
+		taken := time.Now()
+		img, err := capture(wid)
+		if err != nil {
+			return time.Time{}, err
+		}
+		sum := sha256.Sum256(img)
+		if changed.IsZero() || sum != last {
+			last = sum
+			changed = taken
+		} else if taken.Sub(changed) >= stable {
+			return changed, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return time.Time{}, ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
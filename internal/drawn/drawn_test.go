@@ -0,0 +1,103 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package drawn_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/anonymouse64/etrace/internal/drawn"
+	"github.com/anonymouse64/etrace/internal/xdotool"
+
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type drawnTestSuite struct{}
+
+var _ = check.Suite(&drawnTestSuite{})
+
+func (s *drawnTestSuite) TestWaitDrawn(c *check.C) {
+	frames := []string{"splash", "empty", "half", "full"}
+	n := 0
+	var fullTaken time.Time
+	capture := func(wid string) ([]byte, error) {
+		c.Check(wid, check.Equals, "42")
+		if n >= len(frames)-1 {
+			if fullTaken.IsZero() {
+				fullTaken = time.Now()
+			}
+			return []byte(frames[len(frames)-1]), nil
+		}
+		n++
+		return []byte(frames[n-1]), nil
+	}
+	before := time.Now()
+	drawnAt, err := drawn.WaitDrawn(context.Background(), capture, "42", time.Millisecond, 20*time.Millisecond)
+	c.Assert(err, check.IsNil)
+	// the window was drawn when the full frame was first captured
+	c.Check(drawnAt.After(before), check.Equals, true)
+	c.Check(drawnAt.After(fullTaken), check.Equals, false)
+	c.Check(fullTaken.Sub(drawnAt) < 10*time.Millisecond, check.Equals, true)
+}
+
+func (s *drawnTestSuite) TestWaitDrawnTimeout(c *check.C) {
+	n := 0
+	capture := func(wid string) ([]byte, error) {
+		n++
+		return []byte(fmt.Sprint(n)), nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := drawn.WaitDrawn(ctx, capture, "42", time.Millisecond, time.Second)
+	c.Check(err, check.Equals, context.DeadlineExceeded)
+}
+
+func (s *drawnTestSuite) TestWaitDrawnError(c *check.C) {
+	capture := func(wid string) ([]byte, error) {
+		return nil, fmt.Errorf("boom")
+	}
+	_, err := drawn.WaitDrawn(context.Background(), capture, "42", time.Millisecond, time.Second)
+	c.Check(err, check.ErrorMatches, "boom")
+}
+
+func (s *drawnTestSuite) TestForTool(c *check.C) {
+	dir := c.MkDir()
+	mock := filepath.Join(dir, "xwd")
+	c.Assert(ioutil.WriteFile(mock, []byte("#!/bin/sh\necho \"$@\"\n"), 0755), check.IsNil)
+	restore := drawn.MockXWD(mock)
+	defer restore()
+
+	capture, err := drawn.ForTool(xdotool.ToolXDoTool)
+	c.Assert(err, check.IsNil)
+	img, err := capture("42")
+	c.Assert(err, check.IsNil)
+	c.Check(string(img), check.Equals, "-silent -id 42\n")
+
+	c.Assert(ioutil.WriteFile(mock, []byte("#!/bin/sh\necho 'BadWindow' >&2\nexit 1\n"), 0755), check.IsNil)
+	_, err = capture("42")
+	c.Check(err, check.ErrorMatches, `cannot take screenshot with .*/xwd: exit status 1 \(BadWindow\)`)
+
+	_, err = drawn.ForTool(xdotool.ToolKWin)
+	c.Check(err, check.ErrorMatches, "cannot take screenshots of windows with kwin")
+}
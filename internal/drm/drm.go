@@ -0,0 +1,163 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package drm finds when a program first showed something on a display it
+// drives directly through DRM/KMS, like kiosk programs without X11 or a
+// Wayland compositor, from the atomic state the kernel exposes in debugfs.
+package drm
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// debugfsDRI has a directory for each DRM device with its atomic state
+var debugfsDRI = "/sys/kernel/debug/dri"
+
+// Scanout is a framebuffer shown by a plane of a device
+type Scanout struct {
+	// Device is the DRM device, like 0 for card0
+	Device string
+	// Plane is the name of the plane, like plane-0
+	Plane string
+	// CRTC is the name of the CRTC the plane is on
+	CRTC string
+	// FB is the id of the framebuffer
+	FB int
+	// Owner is the name of the process which allocated the framebuffer
+	Owner string
+}
+
+// parseState returns the planes of the atomic state which are on a CRTC and
+// show a framebuffer.
+func parseState(device string, f *os.File) ([]Scanout, error) {
+	var scanouts []Scanout
+	var cur *Scanout
+	done := func() {
+		if cur != nil && cur.FB != 0 && cur.CRTC != "" && cur.CRTC != "(null)" {
+			scanouts = append(scanouts, *cur)
+		}
+		cur = nil
+	}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "\t") {
+			done()
+			// plane[31]: plane-0
+			if strings.HasPrefix(line, "plane[") {
+				if i := strings.Index(line, ": "); i != -1 {
+					cur = &Scanout{Device: device, Plane: line[i+2:]}
+				}
+			}
+			continue
+		}
+		if cur == nil {
+			continue
+		}
+		field := strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(field, "crtc="):
+			cur.CRTC = strings.TrimPrefix(field, "crtc=")
+		case strings.HasPrefix(field, "fb="):
+			cur.FB, _ = strconv.Atoi(strings.TrimPrefix(field, "fb="))
+		case strings.HasPrefix(field, "allocated by = "):
+			cur.Owner = strings.TrimPrefix(field, "allocated by = ")
+		}
+	}
+	done()
+	return scanouts, scanner.Err()
+}
+
+// Scanouts returns the framebuffers shown by all the DRM devices.
+func Scanouts() ([]Scanout, error) {
+	states, err := filepath.Glob(filepath.Join(debugfsDRI, "*", "state"))
+	if err != nil {
+		return nil, err
+	}
+	if len(states) == 0 {
+		return nil, fmt.Errorf("cannot find DRM state in %s: is debugfs mounted and etrace running as root?", debugfsDRI)
+	}
+	var scanouts []Scanout
+	for _, state := range states {
+		f, err := os.Open(state)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read DRM state: %v", err)
+		}
+		device := filepath.Base(filepath.Dir(state))
+		s, err := parseState(device, f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("cannot read DRM state: %v", err)
+		}
+		scanouts = append(scanouts, s...)
+	}
+	return scanouts, nil
+}
+
+// Watcher finds framebuffers which are shown after it was created
+type Watcher struct {
+	shown map[Scanout]bool
+}
+
+// key identifies what is shown regardless of who allocated it.
+func key(s Scanout) Scanout {
+	s.Owner = ""
+	return s
+}
+
+// Watch records what the DRM devices show, so that the next commit showing
+// something else can be found.
+func Watch() (*Watcher, error) {
+	scanouts, err := Scanouts()
+	if err != nil {
+		return nil, err
+	}
+	w := &Watcher{shown: make(map[Scanout]bool)}
+	for _, s := range scanouts {
+		w.shown[key(s)] = true
+	}
+	return w, nil
+}
+
+// WaitCommit polls the DRM state until a plane shows a framebuffer it didn't
+// show when the watcher was created, which is the first atomic commit of the
+// program, and returns it with when it was found.
+func (w *Watcher) WaitCommit(ctx context.Context, interval time.Duration) (Scanout, time.Time, error) {
+	for {
+		scanouts, err := Scanouts()
+		if err != nil {
+			return Scanout{}, time.Time{}, err
+		}
+		for _, s := range scanouts {
+			if !w.shown[key(s)] {
+				return s, time.Now(), nil
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return Scanout{}, time.Time{}, ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
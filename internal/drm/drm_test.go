@@ -0,0 +1,107 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package drm_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/anonymouse64/etrace/internal/drm"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type drmSuite struct {
+	dir string
+}
+
+var _ = Suite(&drmSuite{})
+
+func (s *drmSuite) SetUpTest(c *C) {
+	s.dir = c.MkDir()
+	c.Assert(os.MkdirAll(filepath.Join(s.dir, "0"), 0755), IsNil)
+}
+
+// writeState writes the atomic state of the device with the given
+// framebuffer on its primary plane, 0 for none.
+func (s *drmSuite) writeState(c *C, fb string, owner string) {
+	state := `plane[31]: plane-0
+	crtc=crtc-0
+	fb=` + fb + `
+		allocated by = ` + owner + `
+		refcount=2
+		format=XR24 little-endian (0x34325258)
+	crtc-pos=1920x1080+0+0
+plane[40]: plane-1
+	crtc=(null)
+	fb=0
+crtc[51]: crtc-0
+	enable=1
+	active=1
+connector[60]: HDMI-A-1
+	crtc=crtc-0
+`
+	path := filepath.Join(s.dir, "0", "state")
+	c.Assert(ioutil.WriteFile(path+".new", []byte(state), 0644), IsNil)
+	c.Assert(os.Rename(path+".new", path), IsNil)
+}
+
+func (s *drmSuite) TestScanouts(c *C) {
+	restore := drm.MockDebugfsDRI(s.dir)
+	defer restore()
+	s.writeState(c, "98", "kiosk")
+
+	scanouts, err := drm.Scanouts()
+	c.Assert(err, IsNil)
+	c.Check(scanouts, DeepEquals, []drm.Scanout{
+		{Device: "0", Plane: "plane-0", CRTC: "crtc-0", FB: 98, Owner: "kiosk"},
+	})
+
+	restore = drm.MockDebugfsDRI(c.MkDir())
+	defer restore()
+	_, err = drm.Scanouts()
+	c.Check(err, ErrorMatches, "cannot find DRM state in .*: is debugfs mounted and etrace running as root\\?")
+}
+
+func (s *drmSuite) TestWaitCommit(c *C) {
+	restore := drm.MockDebugfsDRI(s.dir)
+	defer restore()
+	s.writeState(c, "98", "plymouthd")
+
+	w, err := drm.Watch()
+	c.Assert(err, IsNil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	_, _, err = w.WaitCommit(ctx, time.Millisecond)
+	cancel()
+	c.Check(err, Equals, context.DeadlineExceeded)
+
+	s.writeState(c, "102", "kiosk")
+	start := time.Now()
+	scanout, at, err := w.WaitCommit(context.Background(), time.Millisecond)
+	c.Assert(err, IsNil)
+	c.Check(scanout.FB, Equals, 102)
+	c.Check(scanout.Owner, Equals, "kiosk")
+	c.Check(at.Before(start), Equals, false)
+}
@@ -0,0 +1,275 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package electron
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/anonymouse64/etrace/internal/proctree"
+	"github.com/anonymouse64/etrace/internal/schema"
+	"github.com/anonymouse64/etrace/internal/strace"
+)
+
+// DefaultDebuggingPort is the default port to ask the browser to listen on for
+// the remote debugging protocol
+const DefaultDebuggingPort = 9222
+
+// BrowserType is the process type for the main browser process, which is the
+// only Chromium process started without a --type argument
+const BrowserType = "browser"
+
+// RendererType is the process type for the renderers, which the zygote forks
+// without an exec
+const RendererType = "renderer"
+
+var (
+	procCmdline = proctree.Cmdline
+	procStat    = proctree.Stat
+)
+
+// probeInterval is how often to probe the remote debugging port
+var probeInterval = 50 * time.Millisecond
+
+// DebuggingArg returns the argument to provide to an Electron or Chromium app
+// to enable the remote debugging protocol on the given port.
+func DebuggingArg(port int) string {
+	return fmt.Sprintf("--remote-debugging-port=%d", port)
+}
+
+type target struct {
+	Type string `json:"type"`
+	URL  string `json:"url"`
+}
+
+// WaitForRenderer waits until the browser listening on the remote debugging
+// port reports a page target, which means that the first renderer is live.
+func WaitForRenderer(ctx context.Context, port int) error {
+	url := fmt.Sprintf("http://127.0.0.1:%d/json/list", port)
+	for {
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+		// the browser may not be listening yet, so just keep trying
+		if err == nil {
+			var targets []target
+			err = json.NewDecoder(resp.Body).Decode(&targets)
+			resp.Body.Close()
+			if err == nil {
+				for _, t := range targets {
+					if t.Type == "page" {
+						return nil
+					}
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(probeInterval):
+		}
+	}
+}
+
+// ProcessType is the breakdown of the executions of a single type of Chromium
+// process
+type ProcessType struct {
+	Type      string
+	Count     int
+	TotalTime time.Duration
+	// CPUTime is the CPU time used by the renderers until they were counted,
+	// since they are not exec'd their TotalTime is unknown
+	CPUTime time.Duration `json:",omitempty"`
+}
+
+// Structured returns the process type as encoded since version 2 of the
+// schema.
+func (t ProcessType) Structured() interface{} {
+	type plain ProcessType
+	return struct {
+		plain
+		TotalTime schema.Duration
+		CPUTime   *schema.Duration `json:",omitempty"`
+	}{plain(t), schema.NewDuration(t.TotalTime), schema.OptionalDuration(t.CPUTime)}
+}
+
+// knownTypes are the --type arguments Chromium executes itself again with
+var knownTypes = map[string]bool{
+	"zygote":           true,
+	"renderer":         true,
+	"gpu-process":      true,
+	"utility":          true,
+	"broker":           true,
+	"ppapi":            true,
+	"ppapi-broker":     true,
+	"nacl-loader":      true,
+	"crashpad-handler": true,
+}
+
+// processType returns the Chromium process type from the args of an exec, or
+// the empty string if there is no such argument or the type is not one of
+// Chromium's.
+func processType(args []string) string {
+	// the zygote's children rewrite their arguments as a single one, other
+	// arguments with spaces are left alone so that e.g. sh -c "... --type=x"
+	// doesn't look like a Chromium process
+	if len(args) == 1 {
+		args = strings.Fields(args[0])
+	}
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "--type=") {
+			typ := strings.TrimPrefix(arg, "--type=")
+			if !knownTypes[typ] {
+				return ""
+			}
+			return typ
+		}
+	}
+	return ""
+}
+
+// Breakdown recognizes the Chromium multi-process exec pattern, where the
+// browser process executes itself again with a --type argument for the zygote,
+// gpu-process, utility, etc. processes, and returns the time spent by each
+// type of process. Renderers are forked from the zygote without an exec so are
+// accounted to the zygote. The browser processes are identified as the execs
+// without any --type argument of the same program as the typed execs of their
+// descendants, and only the typed execs descending from a browser process are
+// counted. It returns nil if the pattern is not found.
+func Breakdown(runtimes []strace.ExeRuntime) []ProcessType {
+	parents := make(map[int]int)
+	for _, rt := range runtimes {
+		if rt.Parent != 0 {
+			parents[rt.Pid] = rt.Parent
+		}
+	}
+	// browserOf returns the index of the browser exec among the ancestors of
+	// the given typed exec, or -1 if there is none
+	browserOf := func(typed strace.ExeRuntime) int {
+		seen := make(map[int]bool)
+		for pid := typed.Parent; pid != 0 && !seen[pid]; pid = parents[pid] {
+			seen[pid] = true
+			for i, rt := range runtimes {
+				if rt.Pid == pid && rt.Exe == typed.Exe && processType(rt.Args) == "" {
+					return i
+				}
+			}
+		}
+		return -1
+	}
+
+	byType := make(map[string]*ProcessType)
+	count := func(typ string, rt strace.ExeRuntime) {
+		pt, ok := byType[typ]
+		if !ok {
+			pt = &ProcessType{Type: typ}
+			byType[typ] = pt
+		}
+		pt.Count++
+		pt.TotalTime += rt.TotalSec
+	}
+	browsers := make(map[int]bool)
+	for _, rt := range runtimes {
+		typ := processType(rt.Args)
+		if typ == "" {
+			continue
+		}
+		browser := browserOf(rt)
+		if browser == -1 {
+			continue
+		}
+		if !browsers[browser] {
+			browsers[browser] = true
+			count(BrowserType, runtimes[browser])
+		}
+		count(typ, rt)
+	}
+	if len(byType) == 0 {
+		return nil
+	}
+
+	types := make([]ProcessType, 0, len(byType))
+	for _, pt := range byType {
+		types = append(types, *pt)
+	}
+	sortTypes(types)
+	return types
+}
+
+// sortTypes sorts the browser first, then the rest by name.
+func sortTypes(types []ProcessType) {
+	sort.Slice(types, func(i, j int) bool {
+		if types[i].Type == BrowserType || types[j].Type == BrowserType {
+			return types[i].Type == BrowserType
+		}
+		return types[i].Type < types[j].Type
+	})
+}
+
+// Renderers returns the renderers among the processes with the given pids with
+// the CPU time they used so far, since the renderers are forked from the zygote
+// they can only be told apart from their arguments while they run. It returns
+// nil if there are no renderers.
+func Renderers(pids []int) *ProcessType {
+	renderers := &ProcessType{Type: RendererType}
+	for _, pid := range pids {
+		args, err := procCmdline(pid)
+		if err != nil || processType(args) != RendererType {
+			// the process may have exited
+			continue
+		}
+		proc, err := procStat(pid)
+		if err != nil {
+			continue
+		}
+		renderers.Count++
+		renderers.CPUTime += proc.CPUTime()
+	}
+	if renderers.Count == 0 {
+		return nil
+	}
+	return renderers
+}
+
+// WithRenderers adds the renderers to the breakdown of the exec'd processes,
+// replacing the count of exec'd renderers, which are among the running ones.
+func WithRenderers(types []ProcessType, renderers *ProcessType) []ProcessType {
+	if renderers == nil {
+		return types
+	}
+	for i := range types {
+		if types[i].Type == RendererType {
+			if renderers.Count > types[i].Count {
+				types[i].Count = renderers.Count
+			}
+			types[i].CPUTime = renderers.CPUTime
+			return types
+		}
+	}
+	types = append(types, *renderers)
+	sortTypes(types)
+	return types
+}
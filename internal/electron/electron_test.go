@@ -0,0 +1,153 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package electron_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/anonymouse64/etrace/internal/electron"
+	"github.com/anonymouse64/etrace/internal/proctree"
+	"github.com/anonymouse64/etrace/internal/strace"
+
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type electronTestSuite struct{}
+
+var _ = check.Suite(&electronTestSuite{})
+
+func (p *electronTestSuite) TestBreakdown(c *check.C) {
+	chrome := "/snap/chromium/1/usr/lib/chromium-browser/chrome"
+	runtimes := []strace.ExeRuntime{
+		{Exe: "/usr/bin/snap", TotalSec: 100 * time.Millisecond, Pid: 100},
+		{Exe: chrome, Args: []string{"chrome"}, TotalSec: 2 * time.Second, Pid: 100},
+		{Exe: chrome, Args: []string{"chrome", "--type=zygote", "--no-zygote-sandbox"}, TotalSec: 1500 * time.Millisecond, Pid: 101, Parent: 100},
+		{Exe: chrome, Args: []string{"chrome", "--type=zygote"}, TotalSec: 1400 * time.Millisecond, Pid: 102, Parent: 100},
+		// forked by another child of the browser
+		{Exe: chrome, Args: []string{"chrome", "--type=gpu-process"}, TotalSec: 800 * time.Millisecond, Pid: 104, Parent: 103},
+		{Exe: "/bin/true", TotalSec: time.Millisecond, Pid: 103, Parent: 100},
+		// not Chromium types, nor processes of the browser
+		{Exe: "/usr/bin/xdg-settings", Args: []string{"xdg-settings", "--type=foo"}, TotalSec: 10 * time.Millisecond, Pid: 105, Parent: 100},
+		{Exe: "/bin/sh", Args: []string{"sh", "-c", "chrome --type=renderer"}, TotalSec: 10 * time.Millisecond, Pid: 106, Parent: 100},
+		{Exe: chrome, Args: []string{"chrome", "--type=utility"}, TotalSec: 10 * time.Millisecond, Pid: 200},
+	}
+	c.Assert(electron.Breakdown(runtimes), check.DeepEquals, []electron.ProcessType{
+		{Type: "browser", Count: 1, TotalTime: 2 * time.Second},
+		{Type: "gpu-process", Count: 1, TotalTime: 800 * time.Millisecond},
+		{Type: "zygote", Count: 2, TotalTime: 2900 * time.Millisecond},
+	})
+
+	c.Assert(electron.Breakdown(runtimes[:2]), check.IsNil)
+	c.Assert(electron.Breakdown(runtimes[5:]), check.IsNil)
+}
+
+func (p *electronTestSuite) TestRenderers(c *check.C) {
+	cmdlines := map[int][]string{
+		10: {"/opt/app/app"},
+		11: {"/opt/app/app", "--type=zygote"},
+		12: {"/opt/app/app --type=renderer --lang=en"},
+		13: {"/opt/app/app", "--type=renderer"},
+		// exited after its arguments were read
+		14: {"/opt/app/app", "--type=renderer"},
+	}
+	r := electron.MockProc(func(pid int) ([]string, error) {
+		args, ok := cmdlines[pid]
+		if !ok {
+			return nil, fmt.Errorf("no such process")
+		}
+		return args, nil
+	}, func(pid int) (proctree.Process, error) {
+		if pid == 14 {
+			return proctree.Process{}, fmt.Errorf("no such process")
+		}
+		return proctree.Process{Pid: pid, CPUTicks: 10 * uint64(pid)}, nil
+	})
+	defer r()
+
+	renderers := electron.Renderers([]int{10, 11, 12, 13, 14, 15})
+	c.Assert(renderers, check.DeepEquals, &electron.ProcessType{Type: "renderer", Count: 2, CPUTime: 2500 * time.Millisecond})
+	c.Assert(electron.Renderers([]int{10, 11}), check.IsNil)
+
+	types := []electron.ProcessType{
+		{Type: "browser", Count: 1, TotalTime: 2 * time.Second},
+		{Type: "zygote", Count: 2, TotalTime: 2900 * time.Millisecond},
+	}
+	c.Assert(electron.WithRenderers(types, renderers), check.DeepEquals, []electron.ProcessType{
+		{Type: "browser", Count: 1, TotalTime: 2 * time.Second},
+		{Type: "renderer", Count: 2, CPUTime: 2500 * time.Millisecond},
+		{Type: "zygote", Count: 2, TotalTime: 2900 * time.Millisecond},
+	})
+	c.Assert(electron.WithRenderers(types, nil), check.DeepEquals, types)
+
+	// renderers exec'd with --no-zygote are among the running ones
+	execd := []electron.ProcessType{{Type: "renderer", Count: 1, TotalTime: time.Second}}
+	c.Assert(electron.WithRenderers(execd, renderers), check.DeepEquals, []electron.ProcessType{
+		{Type: "renderer", Count: 2, TotalTime: time.Second, CPUTime: 2500 * time.Millisecond},
+	})
+}
+
+func (p *electronTestSuite) TestWaitForRenderer(c *check.C) {
+	r := electron.MockProbeInterval(time.Millisecond)
+	defer r()
+
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.URL.Path, check.Equals, "/json/list")
+		requests++
+		switch requests {
+		case 1:
+			w.WriteHeader(500)
+		case 2:
+			fmt.Fprintln(w, `[{"type": "service_worker", "url": "chrome://x"}]`)
+		default:
+			fmt.Fprintln(w, `[{"type": "page", "url": "file:///app/index.html"}]`)
+		}
+	}))
+	defer srv.Close()
+	port := srv.Listener.Addr().(*net.TCPAddr).Port
+
+	c.Assert(electron.WaitForRenderer(context.Background(), port), check.IsNil)
+	c.Assert(requests, check.Equals, 3)
+}
+
+func (p *electronTestSuite) TestWaitForRendererTimeout(c *check.C) {
+	r := electron.MockProbeInterval(time.Millisecond)
+	defer r()
+
+	// nothing is listening on this port anymore
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	c.Assert(electron.WaitForRenderer(ctx, port), check.Equals, context.DeadlineExceeded)
+}
+
+func (p *electronTestSuite) TestDebuggingArg(c *check.C) {
+	c.Assert(electron.DebuggingArg(9222), check.Equals, "--remote-debugging-port=9222")
+}
@@ -0,0 +1,40 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package electron
+
+import (
+	"time"
+
+	"github.com/anonymouse64/etrace/internal/proctree"
+)
+
+func MockProbeInterval(new time.Duration) (restore func()) {
+	old := probeInterval
+	probeInterval = new
+	return func() {
+		probeInterval = old
+	}
+}
+
+func MockProc(cmdline func(pid int) ([]string, error), stat func(pid int) (proctree.Process, error)) (restore func()) {
+	oldCmdline, oldStat := procCmdline, procStat
+	procCmdline, procStat = cmdline, stat
+	return func() {
+		procCmdline, procStat = oldCmdline, oldStat
+	}
+}
@@ -0,0 +1,322 @@
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package explore browses the processes and file accesses in the JSON results
+// of etrace interactively.
+package explore
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/anonymouse64/etrace/internal/schema"
+	"github.com/anonymouse64/etrace/internal/strace"
+)
+
+// Access is a file access of a process
+type Access struct {
+	// Time is relative to the start of the process
+	Time    time.Duration
+	Path    string
+	Syscall string
+}
+
+// Process is a program executed during a run
+type Process struct {
+	// Run is the run the process was executed in, starting at 1
+	Run  int
+	Exe  string
+	Args []string
+	// Start is relative to the start of the run
+	Start    time.Duration
+	Duration time.Duration
+	Accesses []Access
+}
+
+// Results are the processes of all the runs in a result file
+type Results struct {
+	Processes []Process
+}
+
+// results decodes both the results of etrace exec and of etrace file
+type results struct {
+	Runs []struct {
+		ExecveTiming *strace.ExecveTiming
+	}
+	ExecvePaths *strace.ExecvePaths
+}
+
+// Load reads the JSON results of etrace exec or etrace file.
+func Load(r io.Reader) (*Results, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	legacy, err := schema.Downgrade(data)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode etrace result: %v", err)
+	}
+	var res results
+	if err := json.Unmarshal(legacy, &res); err != nil {
+		return nil, fmt.Errorf("cannot decode etrace result: %v", err)
+	}
+	out := &Results{}
+	for i, run := range res.Runs {
+		if run.ExecveTiming == nil || len(run.ExecveTiming.ExeRuntimes) == 0 {
+			continue
+		}
+		start := run.ExecveTiming.ExeRuntimes[0].Start
+		for _, rt := range run.ExecveTiming.ExeRuntimes {
+			if rt.Start.Before(start) {
+				start = rt.Start
+			}
+		}
+		for _, rt := range run.ExecveTiming.ExeRuntimes {
+			out.Processes = append(out.Processes, Process{
+				Run:      i + 1,
+				Exe:      rt.Exe,
+				Args:     rt.Args,
+				Start:    rt.Start.Sub(start),
+				Duration: rt.TotalSec,
+			})
+		}
+	}
+	if res.ExecvePaths != nil {
+		for _, p := range res.ExecvePaths.Processes {
+			proc := Process{
+				Run:      1,
+				Exe:      p.Exe,
+				Start:    p.Start.Sub(res.ExecvePaths.Start),
+				Duration: p.RunDuration,
+			}
+			for _, a := range p.PathAccesses {
+				proc.Accesses = append(proc.Accesses, Access{
+					Time:    a.Time.Sub(p.Start),
+					Path:    a.Path,
+					Syscall: a.Syscall,
+				})
+			}
+			out.Processes = append(out.Processes, proc)
+		}
+	}
+	if len(out.Processes) == 0 {
+		return nil, fmt.Errorf("cannot explore etrace result: no processes were traced")
+	}
+	return out, nil
+}
+
+// sortKeys are how the processes can be sorted, the start and the executable
+// are sorted in ascending order and the rest in descending order
+var sortKeys = map[string]func(a, b *Process) bool{
+	"start": func(a, b *Process) bool {
+		if a.Run != b.Run {
+			return a.Run < b.Run
+		}
+		return a.Start < b.Start
+	},
+	"duration": func(a, b *Process) bool { return a.Duration > b.Duration },
+	"files":    func(a, b *Process) bool { return len(a.Accesses) > len(b.Accesses) },
+	"exe":      func(a, b *Process) bool { return a.Exe < b.Exe },
+}
+
+const help = `Commands:
+  list                  list the processes
+  filter [REGEX]        only list the processes whose executable matches, or all of them without a regex
+  run [N]               only list the processes of run N, or of all the runs without a number
+  sort KEY              sort the processes by start, duration, files or exe
+  show N                show process N
+  files N [REGEX]       list the files process N accessed, only the ones matching the regex if given
+  help                  show this help
+  quit                  exit
+`
+
+// Explorer browses the processes of results with commands
+type Explorer struct {
+	res    *Results
+	out    io.Writer
+	filter *regexp.Regexp
+	run    int
+	sortBy string
+	// view is the indices of the processes which are listed, in order
+	view []int
+}
+
+// New returns an explorer of the results writing to out.
+func New(res *Results, out io.Writer) *Explorer {
+	e := &Explorer{res: res, out: out, sortBy: "start"}
+	e.update()
+	return e
+}
+
+// update recomputes the listed processes.
+func (e *Explorer) update() {
+	e.view = e.view[:0]
+	for i := range e.res.Processes {
+		p := &e.res.Processes[i]
+		if e.run != 0 && p.Run != e.run {
+			continue
+		}
+		if e.filter != nil && !e.filter.MatchString(p.Exe) {
+			continue
+		}
+		e.view = append(e.view, i)
+	}
+	less := sortKeys[e.sortBy]
+	sort.SliceStable(e.view, func(i, j int) bool {
+		return less(&e.res.Processes[e.view[i]], &e.res.Processes[e.view[j]])
+	})
+}
+
+// process returns the process with the number it was listed with.
+func (e *Explorer) process(arg string) (*Process, error) {
+	n, err := strconv.Atoi(arg)
+	if err != nil || n < 1 || n > len(e.view) {
+		return nil, fmt.Errorf("no process %s, there are %d listed", arg, len(e.view))
+	}
+	return &e.res.Processes[e.view[n-1]], nil
+}
+
+func (e *Explorer) list() {
+	w := tabwriter.NewWriter(e.out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "#\tRun\tStart\tDuration\tFiles\tExe")
+	for n, i := range e.view {
+		p := &e.res.Processes[i]
+		fmt.Fprintf(w, "%d\t%d\t%v\t%v\t%d\t%s\n", n+1, p.Run, p.Start, p.Duration, len(p.Accesses), p.Exe)
+	}
+	w.Flush()
+}
+
+func (e *Explorer) show(p *Process) {
+	fmt.Fprintf(e.out, "Exe:      %s\n", p.Exe)
+	if len(p.Args) != 0 {
+		fmt.Fprintf(e.out, "Args:     %s\n", strings.Join(p.Args, " "))
+	}
+	fmt.Fprintf(e.out, "Run:      %d\n", p.Run)
+	fmt.Fprintf(e.out, "Start:    %v\n", p.Start)
+	fmt.Fprintf(e.out, "Duration: %v\n", p.Duration)
+	unique := make(map[string]bool)
+	for _, a := range p.Accesses {
+		unique[a.Path] = true
+	}
+	fmt.Fprintf(e.out, "Files:    %d accesses of %d files\n", len(p.Accesses), len(unique))
+}
+
+func (e *Explorer) files(p *Process, re *regexp.Regexp) {
+	w := tabwriter.NewWriter(e.out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "Time\tSyscall\tPath")
+	for _, a := range p.Accesses {
+		if re != nil && !re.MatchString(a.Path) {
+			continue
+		}
+		fmt.Fprintf(w, "%v\t%s\t%s\n", a.Time, a.Syscall, a.Path)
+	}
+	w.Flush()
+}
+
+// Do runs a command, it returns true if the command was to quit.
+func (e *Explorer) Do(line string) (quit bool, err error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return false, nil
+	}
+	cmd, args := fields[0], fields[1:]
+	switch cmd {
+	case "list", "ls":
+		e.list()
+	case "filter":
+		e.filter = nil
+		if len(args) != 0 {
+			if e.filter, err = regexp.Compile(args[0]); err != nil {
+				return false, fmt.Errorf("invalid filter: %v", err)
+			}
+		}
+		e.update()
+		e.list()
+	case "run":
+		e.run = 0
+		if len(args) != 0 {
+			if e.run, err = strconv.Atoi(args[0]); err != nil {
+				return false, fmt.Errorf("invalid run %q", args[0])
+			}
+		}
+		e.update()
+		e.list()
+	case "sort":
+		if len(args) == 0 || sortKeys[args[0]] == nil {
+			return false, fmt.Errorf("cannot sort: use start, duration, files or exe")
+		}
+		e.sortBy = args[0]
+		e.update()
+		e.list()
+	case "show", "files":
+		if len(args) == 0 {
+			return false, fmt.Errorf("%s needs the number of a process", cmd)
+		}
+		p, err := e.process(args[0])
+		if err != nil {
+			return false, err
+		}
+		if cmd == "show" {
+			e.show(p)
+			break
+		}
+		var re *regexp.Regexp
+		if len(args) > 1 {
+			if re, err = regexp.Compile(args[1]); err != nil {
+				return false, fmt.Errorf("invalid regex: %v", err)
+			}
+		}
+		e.files(p, re)
+	case "help", "?":
+		fmt.Fprint(e.out, help)
+	case "quit", "exit", "q":
+		return true, nil
+	default:
+		return false, fmt.Errorf("unknown command %q, see help", cmd)
+	}
+	return false, nil
+}
+
+// Run reads commands from in until it ends or a command is to quit, errors of
+// the commands are written to the output.
+func (e *Explorer) Run(in io.Reader) error {
+	e.list()
+	s := bufio.NewScanner(in)
+	for {
+		fmt.Fprint(e.out, "etrace> ")
+		if !s.Scan() {
+			fmt.Fprintln(e.out)
+			return s.Err()
+		}
+		quit, err := e.Do(s.Text())
+		if err != nil {
+			fmt.Fprintf(e.out, "error: %v\n", err)
+		}
+		if quit {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,140 @@
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package explore_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/anonymouse64/etrace/internal/explore"
+
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type exploreTestSuite struct{}
+
+var _ = check.Suite(&exploreTestSuite{})
+
+const execResult = `{"Runs": [
+	{"ExecveTiming": {"TotalTime": 3000000000, "ExeRuntimes": [
+		{"Start": "2021-07-26T10:00:00.5Z", "Exe": "/snap/foo/1/bin/foo", "Args": ["foo", "--bar"], "TotalSec": 2000000000},
+		{"Start": "2021-07-26T10:00:00Z", "Exe": "/usr/bin/snap", "TotalSec": 500000000}
+	]}},
+	{"ExecveTiming": {"TotalTime": 1000000000, "ExeRuntimes": [
+		{"Start": "2021-07-26T11:00:00Z", "Exe": "/usr/bin/snap", "TotalSec": 1000000000}
+	]}}
+]}`
+
+const fileResult = `{"ExecvePaths": {
+	"Start": "2021-07-26T10:00:00Z",
+	"Processes": [
+		{"Start": "2021-07-26T10:00:00Z", "Exe": "/usr/bin/snap", "RunDuration": 1000000000, "PathAccesses": [
+			{"Time": "2021-07-26T10:00:00.1Z", "Path": "/etc/ld.so.cache", "Syscall": "openat"}
+		]},
+		{"Start": "2021-07-26T10:00:01Z", "Exe": "/snap/foo/1/bin/foo", "RunDuration": 2000000000, "PathAccesses": [
+			{"Time": "2021-07-26T10:00:01.5Z", "Path": "/etc/ld.so.cache", "Syscall": "openat"},
+			{"Time": "2021-07-26T10:00:01.6Z", "Path": "/snap/foo/1/lib/libfoo.so", "Syscall": "openat"},
+			{"Time": "2021-07-26T10:00:01.7Z", "Path": "/etc/ld.so.cache", "Syscall": "stat"}
+		]}
+	]
+}}`
+
+func (s *exploreTestSuite) TestLoadExec(c *check.C) {
+	res, err := explore.Load(strings.NewReader(execResult))
+	c.Assert(err, check.IsNil)
+	c.Check(res.Processes, check.DeepEquals, []explore.Process{
+		{Run: 1, Exe: "/snap/foo/1/bin/foo", Args: []string{"foo", "--bar"}, Start: 500000000, Duration: 2000000000},
+		{Run: 1, Exe: "/usr/bin/snap", Start: 0, Duration: 500000000},
+		{Run: 2, Exe: "/usr/bin/snap", Start: 0, Duration: 1000000000},
+	})
+
+	_, err = explore.Load(strings.NewReader(`{"Runs": []}`))
+	c.Check(err, check.ErrorMatches, "cannot explore etrace result: no processes were traced")
+	_, err = explore.Load(strings.NewReader(`garbage`))
+	c.Check(err, check.ErrorMatches, "cannot decode etrace result: .*")
+}
+
+func (s *exploreTestSuite) TestCommands(c *check.C) {
+	res, err := explore.Load(strings.NewReader(fileResult))
+	c.Assert(err, check.IsNil)
+	var out bytes.Buffer
+	e := explore.New(res, &out)
+
+	do := func(line string) string {
+		out.Reset()
+		quit, err := e.Do(line)
+		c.Assert(err, check.IsNil)
+		c.Check(quit, check.Equals, false)
+		return out.String()
+	}
+
+	c.Check(do("sort files"), check.Equals, `#  Run  Start  Duration  Files  Exe
+1  1    1s     2s        3      /snap/foo/1/bin/foo
+2  1    0s     1s        1      /usr/bin/snap
+`)
+	c.Check(do("filter ^/usr"), check.Equals, `#  Run  Start  Duration  Files  Exe
+1  1    0s     1s        1      /usr/bin/snap
+`)
+	do("filter")
+	c.Check(do("show 1"), check.Equals, `Exe:      /snap/foo/1/bin/foo
+Run:      1
+Start:    1s
+Duration: 2s
+Files:    3 accesses of 2 files
+`)
+	c.Check(do("files 1 ld.so"), check.Equals, `Time   Syscall  Path
+500ms  openat   /etc/ld.so.cache
+700ms  stat     /etc/ld.so.cache
+`)
+	c.Check(do(""), check.Equals, "")
+
+	for _, t := range []struct {
+		line, err string
+	}{
+		{"show 3", "no process 3, there are 2 listed"},
+		{"files", "files needs the number of a process"},
+		{"sort size", "cannot sort: use start, duration, files or exe"},
+		{"filter (", "invalid filter: .*"},
+		{"frobnicate", `unknown command "frobnicate", see help`},
+	} {
+		_, err := e.Do(t.line)
+		c.Check(err, check.ErrorMatches, t.err, check.Commentf(t.line))
+	}
+
+	quit, err := e.Do("quit")
+	c.Check(err, check.IsNil)
+	c.Check(quit, check.Equals, true)
+}
+
+func (s *exploreTestSuite) TestRun(c *check.C) {
+	res, err := explore.Load(strings.NewReader(execResult))
+	c.Assert(err, check.IsNil)
+	var out bytes.Buffer
+	c.Assert(explore.New(res, &out).Run(strings.NewReader("run 2\nbogus\nquit\nlist\n")), check.IsNil)
+	c.Check(out.String(), check.Equals, `#  Run  Start  Duration  Files  Exe
+1  1    0s     500ms     0      /usr/bin/snap
+2  1    500ms  2s        0      /snap/foo/1/bin/foo
+3  2    0s     1s        0      /usr/bin/snap
+etrace> #  Run  Start  Duration  Files  Exe
+1  2    0s     1s        0      /usr/bin/snap
+etrace> error: unknown command "bogus", see help
+etrace> `)
+}
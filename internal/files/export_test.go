@@ -0,0 +1,48 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package files
+
+import "os"
+
+// MockGeteuid mocks the effective uid of the current process
+func MockGeteuid(euid int) (restore func()) {
+	old := osGeteuid
+	osGeteuid = func() int { return euid }
+	return func() { osGeteuid = old }
+}
+
+// MockChown mocks changing the owner of files
+func MockChown(f func(name string, uid, gid int) error) (restore func()) {
+	old := osChown
+	osChown = f
+	return func() { osChown = old }
+}
+
+// MockLchown mocks changing the owner of files without following symlinks
+func MockLchown(f func(name string, uid, gid int) error) (restore func()) {
+	old := osLchown
+	osLchown = f
+	return func() { osLchown = old }
+}
+
+// MockFileOwner mocks the uid of the owner of files
+func MockFileOwner(f func(info os.FileInfo) int) (restore func()) {
+	old := fileOwner
+	fileOwner = f
+	return func() { fileOwner = old }
+}
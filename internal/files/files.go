@@ -17,7 +17,26 @@
 
 package files
 
-import "os"
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+var (
+	osGeteuid = os.Geteuid
+	osChown   = os.Chown
+	osLchown  = os.Lchown
+	fileOwner = func(info os.FileInfo) int {
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			return int(st.Uid)
+		}
+		return -1
+	}
+)
 
 func fileExistsQ(fname string) bool {
 	info, err := os.Stat(fname)
@@ -59,3 +78,78 @@ func EnsureFileIsDeleted(fname string) error {
 	}
 	return nil
 }
+
+// sudoUser returns the uid and gid of the user who ran etrace with sudo, ok is
+// false if etrace is not running as root through sudo.
+func sudoUser() (uid, gid int, ok bool, err error) {
+	if osGeteuid() != 0 {
+		return 0, 0, false, nil
+	}
+	uidStr, gidStr := os.Getenv("SUDO_UID"), os.Getenv("SUDO_GID")
+	if uidStr == "" || gidStr == "" {
+		return 0, 0, false, nil
+	}
+	uid, err = strconv.Atoi(uidStr)
+	if err != nil {
+		return 0, 0, false, fmt.Errorf("invalid $SUDO_UID %q", uidStr)
+	}
+	gid, err = strconv.Atoi(gidStr)
+	if err != nil {
+		return 0, 0, false, fmt.Errorf("invalid $SUDO_GID %q", gidStr)
+	}
+	return uid, gid, true, nil
+}
+
+// ChownToSudoUser changes the owner of the file to the user who ran etrace with
+// sudo, so that files written as root can be used by that user afterwards.
+// Nothing is done if etrace is not running as root through sudo or if the file
+// doesn't exist.
+func ChownToSudoUser(fname string) error {
+	uid, gid, ok, err := sudoUser()
+	if err != nil || !ok {
+		return err
+	}
+	if err := osChown(fname, uid, gid); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// ChownTreeToSudoUser changes the owner of the files and directories under dir
+// which were changed since the given time and aren't owned by the user who ran
+// etrace with sudo to that user, so that the files a program running as root
+// wrote to the home of the user can be used by that user afterwards. Symlinks
+// are not followed. Nothing is done if etrace is not running as root through
+// sudo or if dir isn't owned by that user, like when it is the home of root.
+func ChownTreeToSudoUser(dir string, since time.Time) error {
+	uid, gid, ok, err := sudoUser()
+	if err != nil || !ok {
+		return err
+	}
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	if fileOwner(info) != uid {
+		return nil
+	}
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// the file was removed since its directory was read
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if fileOwner(info) == uid {
+			return nil
+		}
+		if st, ok := info.Sys().(*syscall.Stat_t); !ok || time.Unix(st.Ctim.Unix()).Before(since) {
+			return nil
+		}
+		if err := osLchown(path, uid, gid); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	})
+}
@@ -18,10 +18,13 @@
 package files_test
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/anonymouse64/etrace/internal/files"
 
@@ -156,3 +159,175 @@ func (p *filesTestSuite) TestEnsureExistAndOpenExists(c *check.C) {
 		}
 	}
 }
+
+func (p *filesTestSuite) TestChownToSudoUser(c *check.C) {
+	var chowned []string
+	restore := files.MockChown(func(name string, uid, gid int) error {
+		chowned = append(chowned, fmt.Sprintf("%s %d:%d", name, uid, gid))
+		return nil
+	})
+	defer restore()
+
+	os.Setenv("SUDO_UID", "1000")
+	defer os.Unsetenv("SUDO_UID")
+	os.Setenv("SUDO_GID", "1001")
+	defer os.Unsetenv("SUDO_GID")
+
+	// nothing is done when not running as root
+	restore = files.MockGeteuid(1000)
+	c.Assert(files.ChownToSudoUser("/some/file"), check.IsNil)
+	c.Check(chowned, check.HasLen, 0)
+	restore()
+
+	restore = files.MockGeteuid(0)
+	defer restore()
+	c.Assert(files.ChownToSudoUser("/some/file"), check.IsNil)
+	c.Check(chowned, check.DeepEquals, []string{"/some/file 1000:1001"})
+
+	// nor when not running through sudo
+	os.Unsetenv("SUDO_UID")
+	c.Assert(files.ChownToSudoUser("/other/file"), check.IsNil)
+	c.Check(chowned, check.HasLen, 1)
+
+	os.Setenv("SUDO_UID", "bob")
+	c.Assert(files.ChownToSudoUser("/other/file"), check.ErrorMatches, `invalid \$SUDO_UID "bob"`)
+}
+
+func (p *filesTestSuite) TestChownToSudoUserMissingFile(c *check.C) {
+	restore := files.MockGeteuid(0)
+	defer restore()
+	os.Setenv("SUDO_UID", "1000")
+	defer os.Unsetenv("SUDO_UID")
+	os.Setenv("SUDO_GID", "1000")
+	defer os.Unsetenv("SUDO_GID")
+
+	c.Assert(files.ChownToSudoUser(filepath.Join(c.MkDir(), "missing")), check.IsNil)
+}
+
+func (p *filesTestSuite) TestChownTreeToSudoUser(c *check.C) {
+	home := c.MkDir()
+	c.Assert(ioutil.WriteFile(filepath.Join(home, "old-root-file"), nil, 0644), check.IsNil)
+	time.Sleep(10 * time.Millisecond)
+	since := time.Now()
+	// the times of files are only updated at every clock tick
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(os.MkdirAll(filepath.Join(home, ".config", "app"), 0755), check.IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(home, ".config", "app", "root-file"), nil, 0644), check.IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(home, ".config", "user-file"), nil, 0644), check.IsNil)
+	c.Assert(os.Symlink("/etc/passwd", filepath.Join(home, ".config", "root-link")), check.IsNil)
+
+	// the program running as root wrote the files with root in their name
+	// and the app directory, while the home is the one of the sudo user
+	restore := files.MockFileOwner(func(info os.FileInfo) int {
+		if strings.Contains(info.Name(), "root") || info.Name() == "app" {
+			return 0
+		}
+		return 1000
+	})
+	defer restore()
+	var chowned []string
+	restore = files.MockLchown(func(name string, uid, gid int) error {
+		rel, err := filepath.Rel(home, name)
+		c.Assert(err, check.IsNil)
+		chowned = append(chowned, fmt.Sprintf("%s %d:%d", rel, uid, gid))
+		return nil
+	})
+	defer restore()
+
+	os.Setenv("SUDO_UID", "1000")
+	defer os.Unsetenv("SUDO_UID")
+	os.Setenv("SUDO_GID", "1001")
+	defer os.Unsetenv("SUDO_GID")
+
+	// nothing is done when not running as root
+	restore = files.MockGeteuid(1000)
+	c.Assert(files.ChownTreeToSudoUser(home, since), check.IsNil)
+	c.Check(chowned, check.HasLen, 0)
+	restore()
+
+	restore = files.MockGeteuid(0)
+	defer restore()
+	c.Assert(files.ChownTreeToSudoUser(home, since), check.IsNil)
+	c.Check(chowned, check.DeepEquals, []string{
+		".config/app 1000:1001",
+		".config/app/root-file 1000:1001",
+		".config/root-link 1000:1001",
+	})
+
+	// nor when the home isn't the one of the sudo user
+	chowned = nil
+	os.Setenv("SUDO_UID", "1002")
+	c.Assert(files.ChownTreeToSudoUser(home, since), check.IsNil)
+	c.Check(chowned, check.HasLen, 0)
+}
+
+func (p *filesTestSuite) TestGlob(c *check.C) {
+	tt := []struct {
+		pattern string
+		path    string
+		match   bool
+	}{
+		{"/etc/passwd", "/etc/passwd", true},
+		{"/etc/passwd", "/etc/passwd-", false},
+		{"/home/*/.ssh/*", "/home/user/.ssh/id_rsa", true},
+		{"/home/*/.ssh/*", "/home/user/foo/.ssh/id_rsa", false},
+		{"/home/**", "/home/user/.ssh/id_rsa", true},
+		{"/home/**/id_rsa", "/home/user/.ssh/id_rsa", true},
+		{"/dev/tty?", "/dev/tty1", true},
+		{"/dev/tty?", "/dev/tty10", false},
+		{"/dev/tty[0-9]", "/dev/tty1", true},
+		{"/dev/tty[!0-9]", "/dev/tty1", false},
+		{"/usr/lib/libc.so.6", "/usr/lib/libcXso.6", false},
+	}
+	for _, t := range tt {
+		g, err := files.NewGlob(t.pattern)
+		c.Assert(err, check.IsNil)
+		c.Check(g.Match(t.path), check.Equals, t.match, check.Commentf("%s %s", t.pattern, t.path))
+		c.Check(g.String(), check.Equals, t.pattern)
+	}
+
+	_, err := files.NewGlob("/dev/tty[0-9")
+	c.Check(err, check.ErrorMatches, `invalid glob "/dev/tty\[0-9": unterminated character class`)
+}
+
+func (p *filesTestSuite) TestSizes(c *check.C) {
+	root := c.MkDir()
+	write := func(path string, size int) {
+		c.Assert(os.MkdirAll(filepath.Dir(filepath.Join(root, path)), 0755), check.IsNil)
+		c.Assert(ioutil.WriteFile(filepath.Join(root, path), make([]byte, size), 0644), check.IsNil)
+	}
+	write("usr/lib/libfoo.so.1", 100)
+	write("etc/alternatives/foo", 10)
+	// absolute symlinks resolve inside the root and not on the host
+	c.Assert(os.Symlink("/etc/alternatives/foo", filepath.Join(root, "usr/lib/foo")), check.IsNil)
+	c.Assert(os.Symlink("libfoo.so.1", filepath.Join(root, "usr/lib/libfoo.so")), check.IsNil)
+	c.Assert(os.Symlink("../..", filepath.Join(root, "usr/lib/up")), check.IsNil)
+	c.Assert(os.Symlink("loop", filepath.Join(root, "loop")), check.IsNil)
+
+	sizes := files.NewSizes(root)
+	for _, t := range []struct {
+		path string
+		size int64
+		ok   bool
+	}{
+		{path: "/usr/lib/libfoo.so.1", size: 100, ok: true},
+		{path: "/usr/lib/libfoo.so", size: 100, ok: true},
+		{path: "/usr/lib/foo", size: 10, ok: true},
+		{path: "/usr/lib/up/usr/lib/foo", size: 10, ok: true},
+		{path: "/usr/lib/../../../usr/lib/libfoo.so.1", size: 100, ok: true},
+		// directories aren't counted
+		{path: "/usr/lib", size: -1},
+		{path: "/does/not/exist", size: -1},
+		{path: "/loop", size: -1},
+	} {
+		size, ok := sizes.Size(t.path)
+		c.Check(size, check.Equals, t.size, check.Commentf(t.path))
+		c.Check(ok, check.Equals, t.ok, check.Commentf(t.path))
+	}
+
+	// the sizes are looked up once
+	c.Assert(os.Remove(filepath.Join(root, "usr/lib/libfoo.so.1")), check.IsNil)
+	size, ok := sizes.Size("/usr/lib/libfoo.so.1")
+	c.Check(size, check.Equals, int64(100))
+	c.Check(ok, check.Equals, true)
+}
@@ -0,0 +1,107 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package files
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxSymlinks is how many symlinks are followed when resolving a path before
+// giving up, like ELOOP in path_resolution(7)
+const maxSymlinks = 40
+
+// Sizes looks up the sizes of the files accessed by a traced program as the
+// program saw them, which for a snap is in its mount namespace rather than
+// etrace's.
+type Sizes struct {
+	root  string
+	known map[string]int64
+}
+
+// NewSizes returns Sizes which resolves paths inside the given root, like
+// /proc/<pid>/root of a process of the program, or / for etrace's own mount
+// namespace.
+func NewSizes(root string) *Sizes {
+	return &Sizes{
+		root:  root,
+		known: make(map[string]int64),
+	}
+}
+
+// Size returns the size of the regular file at the path, or false if the path
+// isn't a regular file, like a directory, or doesn't exist anymore.
+func (s *Sizes) Size(path string) (int64, bool) {
+	size, ok := s.known[path]
+	if !ok {
+		size = -1
+		if resolved, err := s.resolve(path); err == nil {
+			if info, err := os.Stat(resolved); err == nil && info.Mode().IsRegular() {
+				size = info.Size()
+			}
+		}
+		s.known[path] = size
+	}
+	return size, size != -1
+}
+
+// resolve returns the path under the root the path resolves to, following
+// symlinks inside the root, since following absolute symlinks under
+// /proc/<pid>/root would escape to etrace's root.
+func (s *Sizes) resolve(path string) (string, error) {
+	var resolved []string
+	remaining := strings.Split(path, "/")
+	followed := 0
+	for len(remaining) != 0 {
+		name := remaining[0]
+		remaining = remaining[1:]
+		switch name {
+		case "", ".":
+			continue
+		case "..":
+			if len(resolved) != 0 {
+				resolved = resolved[:len(resolved)-1]
+			}
+			continue
+		}
+		current := filepath.Join(s.root, filepath.Join(append(resolved, name)...))
+		info, err := os.Lstat(current)
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			resolved = append(resolved, name)
+			continue
+		}
+		followed++
+		if followed > maxSymlinks {
+			return "", fmt.Errorf("too many levels of symbolic links in %q", path)
+		}
+		target, err := os.Readlink(current)
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(target) {
+			resolved = nil
+		}
+		remaining = append(strings.Split(target, "/"), remaining...)
+	}
+	return filepath.Join(s.root, filepath.Join(resolved...)), nil
+}
@@ -0,0 +1,119 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package fontcache
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+)
+
+// Modes for handling the font caches between runs
+const (
+	// ModeDelete deletes the font caches before each run so that each run
+	// pays the full cost of generating them
+	ModeDelete = "delete"
+	// ModeGenerate generates the font caches before each run so that no run
+	// pays the cost of generating them
+	ModeGenerate = "generate"
+)
+
+var userHomeDir = os.UserHomeDir
+
+// helper function to make testing easier
+var execCommandCombinedOutput = func(prog string, args ...string) ([]byte, error) {
+	return exec.Command(prog, args...).CombinedOutput()
+}
+
+// fcCacheRE matches fc-cache as well as the versioned fc-cache-v6, etc.
+// programs that the snapcraft desktop helpers use
+var fcCacheRE = regexp.MustCompile(`^fc-cache(-v[0-9]+)?$`)
+
+// IsFontCacheExe returns whether the executable generates font caches.
+func IsFontCacheExe(exe string) bool {
+	return fcCacheRE.MatchString(filepath.Base(exe))
+}
+
+// fontCacheDirRE matches the paths inside the fontconfig cache directories of
+// users, including those in the user data of snaps, and of the system
+var fontCacheDirRE = regexp.MustCompile(`(^|/)(\.cache|var/cache)/fontconfig(/|$)`)
+
+// IsFontCachePath returns whether the path is inside of a fontconfig cache
+// directory.
+func IsFontCachePath(path string) bool {
+	return fontCacheDirRE.MatchString(path)
+}
+
+// CacheDirs returns the fontconfig cache directories of the current user that
+// exist, including those in the user data of the snap if snapName is not empty.
+func CacheDirs(snapName string) ([]string, error) {
+	home, err := userHomeDir()
+	if err != nil {
+		return nil, err
+	}
+	patterns := []string{filepath.Join(home, ".cache", "fontconfig")}
+	if snapName != "" {
+		// both the revisioned and common snap user data dirs
+		patterns = append(patterns, filepath.Join(home, "snap", snapName, "*", ".cache", "fontconfig"))
+	}
+	var dirs []string
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("internal error: pattern %q is invalid: %v", pattern, err)
+		}
+		for _, m := range matches {
+			if info, err := os.Stat(m); err == nil && info.IsDir() {
+				dirs = append(dirs, m)
+			}
+		}
+	}
+	return dirs, nil
+}
+
+// Delete deletes the fontconfig cache directories of the current user,
+// including those in the user data of the snap if snapName is not empty.
+func Delete(snapName string) error {
+	dirs, err := CacheDirs(snapName)
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Generate generates the fontconfig caches of the current user with fc-cache,
+// running it inside the snap's environment if snapName is not empty so that
+// the snap's own caches are generated.
+func Generate(snapName string) error {
+	prog, args := "fc-cache", []string(nil)
+	if snapName != "" {
+		prog, args = "snap", []string{"run", "--shell", snapName, "-c", "fc-cache"}
+	}
+	out, err := execCommandCombinedOutput(prog, args...)
+	if err != nil {
+		return fmt.Errorf("failed to generate font caches: %v (%s)", err, string(out))
+	}
+	return nil
+}
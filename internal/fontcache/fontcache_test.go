@@ -0,0 +1,118 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package fontcache_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/anonymouse64/etrace/internal/fontcache"
+
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type fontcacheTestSuite struct {
+	home string
+}
+
+var _ = check.Suite(&fontcacheTestSuite{})
+
+func (p *fontcacheTestSuite) SetUpTest(c *check.C) {
+	p.home = c.MkDir()
+}
+
+func (p *fontcacheTestSuite) TestIsFontCacheExe(c *check.C) {
+	for exe, exp := range map[string]bool{
+		"/usr/bin/fc-cache":                           true,
+		"/snap/gnome-3-38-2004/1/usr/bin/fc-cache":    true,
+		"/snap/app/x1/bin/fc-cache-v7":                true,
+		"/usr/bin/fc-list":                            false,
+		"/snap/app/x1/usr/bin/fc-cache-wrapper-thing": false,
+	} {
+		c.Check(fontcache.IsFontCacheExe(exe), check.Equals, exp, check.Commentf(exe))
+	}
+}
+
+func (p *fontcacheTestSuite) TestIsFontCachePath(c *check.C) {
+	for path, exp := range map[string]bool{
+		"/home/user/.cache/fontconfig":                              true,
+		"/home/user/.cache/fontconfig/abc-le64.cache-7":             true,
+		"/home/user/snap/app/x1/.cache/fontconfig/abc-le64.cache-7": true,
+		"/var/cache/fontconfig/abc-le64.cache-7":                    true,
+		"/home/user/.cache/fontconfig-other/abc":                    false,
+		"/home/user/.cache/mesa_shader_cache/index":                 false,
+		"/snap/app/x1/etc/fonts/conf.d/65-nonlatin.conf":            false,
+	} {
+		c.Check(fontcache.IsFontCachePath(path), check.Equals, exp, check.Commentf(path))
+	}
+}
+
+func (p *fontcacheTestSuite) TestCacheDirsAndDelete(c *check.C) {
+	r := fontcache.MockUserHomeDir(p.home)
+	defer r()
+
+	hostCache := filepath.Join(p.home, ".cache", "fontconfig")
+	snapCache := filepath.Join(p.home, "snap", "test-snap", "x1", ".cache", "fontconfig")
+	snapCommonCache := filepath.Join(p.home, "snap", "test-snap", "common", ".cache", "fontconfig")
+	otherSnapCache := filepath.Join(p.home, "snap", "other-snap", "common", ".cache", "fontconfig")
+	for _, dir := range []string{hostCache, snapCache, snapCommonCache, otherSnapCache} {
+		c.Assert(os.MkdirAll(dir, 0755), check.IsNil)
+	}
+
+	dirs, err := fontcache.CacheDirs("")
+	c.Assert(err, check.IsNil)
+	c.Assert(dirs, check.DeepEquals, []string{hostCache})
+
+	dirs, err = fontcache.CacheDirs("test-snap")
+	c.Assert(err, check.IsNil)
+	c.Assert(dirs, check.DeepEquals, []string{hostCache, snapCommonCache, snapCache})
+
+	c.Assert(fontcache.Delete("test-snap"), check.IsNil)
+	for _, dir := range []string{hostCache, snapCache, snapCommonCache} {
+		_, err := os.Stat(dir)
+		c.Check(os.IsNotExist(err), check.Equals, true, check.Commentf(dir))
+	}
+	// other snaps are left alone
+	_, err = os.Stat(otherSnapCache)
+	c.Assert(err, check.IsNil)
+}
+
+func (p *fontcacheTestSuite) TestGenerate(c *check.C) {
+	var calls [][]string
+	r := fontcache.MockExecCommand(func(prog string, args ...string) ([]byte, error) {
+		calls = append(calls, append([]string{prog}, args...))
+		if len(calls) == 3 {
+			return []byte("fc-cache: not found"), fmt.Errorf("exit status 127")
+		}
+		return nil, nil
+	})
+	defer r()
+
+	c.Assert(fontcache.Generate(""), check.IsNil)
+	c.Assert(fontcache.Generate("test-snap"), check.IsNil)
+	c.Assert(fontcache.Generate("test-snap"), check.ErrorMatches, `failed to generate font caches: exit status 127 \(fc-cache: not found\)`)
+	c.Assert(calls, check.DeepEquals, [][]string{
+		{"fc-cache"},
+		{"snap", "run", "--shell", "test-snap", "-c", "fc-cache"},
+		{"snap", "run", "--shell", "test-snap", "-c", "fc-cache"},
+	})
+}
@@ -0,0 +1,85 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package freshhome sets up throwaway home directories, so that programs can
+// be measured starting like they would for a new user.
+package freshhome
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// xdgDirs are the XDG base directories pointed into the home, relative to it
+var xdgDirs = []struct {
+	env, dir string
+}{
+	{"XDG_CONFIG_HOME", ".config"},
+	{"XDG_CACHE_HOME", ".cache"},
+	{"XDG_DATA_HOME", ".local/share"},
+	{"XDG_STATE_HOME", ".local/state"},
+}
+
+// Home is a throwaway home directory
+type Home struct {
+	dir string
+}
+
+// New creates a new empty home directory with the XDG base directories.
+func New() (*Home, error) {
+	dir, err := ioutil.TempDir("", "etrace-home")
+	if err != nil {
+		return nil, err
+	}
+	for _, xdg := range xdgDirs {
+		if err := os.MkdirAll(filepath.Join(dir, xdg.dir), 0700); err != nil {
+			os.RemoveAll(dir)
+			return nil, err
+		}
+	}
+	return &Home{dir: dir}, nil
+}
+
+// Dir returns the path of the home directory.
+func (h *Home) Dir() string {
+	return h.dir
+}
+
+// Env returns the environment variables pointing programs at the home
+// directory. X11 programs find their authorization in the home unless
+// XAUTHORITY is set, so it is pointed at the one of the real home if needed.
+func (h *Home) Env() []string {
+	env := []string{"HOME=" + h.dir}
+	for _, xdg := range xdgDirs {
+		env = append(env, xdg.env+"="+filepath.Join(h.dir, xdg.dir))
+	}
+	if os.Getenv("XAUTHORITY") == "" {
+		if realHome, err := os.UserHomeDir(); err == nil {
+			xauth := filepath.Join(realHome, ".Xauthority")
+			if _, err := os.Stat(xauth); err == nil {
+				env = append(env, "XAUTHORITY="+xauth)
+			}
+		}
+	}
+	return env
+}
+
+// Remove removes the home directory and everything the program wrote to it.
+func (h *Home) Remove() error {
+	return os.RemoveAll(h.dir)
+}
@@ -0,0 +1,74 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package freshhome_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/anonymouse64/etrace/internal/freshhome"
+
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type freshhomeTestSuite struct{}
+
+var _ = check.Suite(&freshhomeTestSuite{})
+
+func (p *freshhomeTestSuite) TestHome(c *check.C) {
+	realHome := c.MkDir()
+	c.Assert(ioutil.WriteFile(filepath.Join(realHome, ".Xauthority"), nil, 0600), check.IsNil)
+	oldHome, oldXauth := os.Getenv("HOME"), os.Getenv("XAUTHORITY")
+	defer func() {
+		os.Setenv("HOME", oldHome)
+		os.Setenv("XAUTHORITY", oldXauth)
+	}()
+	os.Setenv("HOME", realHome)
+	os.Setenv("XAUTHORITY", "")
+
+	h, err := freshhome.New()
+	c.Assert(err, check.IsNil)
+	dir := h.Dir()
+	c.Check(dir, check.Not(check.Equals), realHome)
+	entries, err := ioutil.ReadDir(dir)
+	c.Assert(err, check.IsNil)
+	c.Check(entries, check.HasLen, 3)
+
+	c.Check(h.Env(), check.DeepEquals, []string{
+		"HOME=" + dir,
+		"XDG_CONFIG_HOME=" + filepath.Join(dir, ".config"),
+		"XDG_CACHE_HOME=" + filepath.Join(dir, ".cache"),
+		"XDG_DATA_HOME=" + filepath.Join(dir, ".local/share"),
+		"XDG_STATE_HOME=" + filepath.Join(dir, ".local/state"),
+		// X11 programs still find their authorization
+		"XAUTHORITY=" + filepath.Join(realHome, ".Xauthority"),
+	})
+
+	// an explicit authorization is kept as it is
+	os.Setenv("XAUTHORITY", "/run/user/1000/xauth")
+	c.Check(h.Env(), check.HasLen, 5)
+
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, ".config", "app.conf"), nil, 0600), check.IsNil)
+	c.Assert(h.Remove(), check.IsNil)
+	_, err = os.Stat(dir)
+	c.Check(os.IsNotExist(err), check.Equals, true)
+}
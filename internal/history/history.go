@@ -0,0 +1,276 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package history keeps the results of measuring each command, so that a new
+// measurement can be compared with the previous one of the same command and
+// the trend of its startup time can be followed. The results of a command are
+// appended to a file with a line of JSON per result, so that results are never
+// rewritten nor lost when several measurements end at the same time.
+package history
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/anonymouse64/etrace/analysis"
+)
+
+var userHomeDir = os.UserHomeDir
+
+// Dir returns the directory the results are kept in, under $XDG_STATE_HOME.
+func Dir() (string, error) {
+	state := os.Getenv("XDG_STATE_HOME")
+	if state == "" {
+		home, err := userHomeDir()
+		if err != nil {
+			return "", err
+		}
+		state = filepath.Join(home, ".local", "state")
+	}
+	return filepath.Join(state, "etrace", "history"), nil
+}
+
+// Entry is the result of a measurement
+type Entry struct {
+	// Time is when the measurement was done
+	Time time.Time
+	// TimesToDisplay are the times to display of the runs of the measurement
+	TimesToDisplay []time.Duration
+	// TimesToRun are the times to run of the runs of the measurement, they
+	// are only known when the program was traced or ran until it exited
+	TimesToRun []time.Duration `json:",omitempty"`
+	// Kernel is the release of the kernel the measurement was done on
+	Kernel string `json:",omitempty"`
+	// Mounts are the mounts of the mount namespace of the program, they are
+	// only recorded with --mount-ns
+	Mounts []string `json:",omitempty"`
+	// Revisions are the revisions of the snap, its base and the snaps
+	// providing content to it, by snap name, they are only recorded for
+	// snaps run with --use-snap-run
+	Revisions map[string]string `json:",omitempty"`
+}
+
+// History is the results of measuring a command with a profile
+type History struct {
+	Command []string
+	Profile string
+	// Entries are sorted from the oldest to the newest
+	Entries []Entry
+
+	path string
+}
+
+// record is a line of the file of a history, which has the command and the
+// profile too so that every line stands on its own
+type record struct {
+	Command []string
+	Profile string `json:",omitempty"`
+	Entry
+}
+
+// key returns the name of the file of the history of the command and profile.
+func key(command []string, profile string) string {
+	sum := sha256.Sum256([]byte(strings.Join(append([]string{profile}, command...), "\x00")))
+	return hex.EncodeToString(sum[:8]) + ".jsonl"
+}
+
+// read reads the history in the file, keeping only the given number of the
+// last results if it isn't 0. Lines which were cut short, by a measurement
+// interrupted while its result was added, are left out.
+func read(path string, last int) (*History, error) {
+	out, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	h := &History{path: path}
+	for i, line := range bytes.Split(out, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		var r record
+		err := json.Unmarshal(line, &r)
+		if _, ok := err.(*json.SyntaxError); ok {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse history %s: line %d: %v", path, i+1, err)
+		}
+		h.Command, h.Profile = r.Command, r.Profile
+		h.Entries = append(h.Entries, r.Entry)
+	}
+	if last > 0 && len(h.Entries) > last {
+		h.Entries = h.Entries[len(h.Entries)-last:]
+	}
+	return h, nil
+}
+
+// Load returns the given number of the last results of the command measured
+// with the profile from the directory, or all of them if it is 0. The history
+// is empty if the command was never measured.
+func Load(dir string, command []string, profile string, last int) (*History, error) {
+	path := filepath.Join(dir, key(command, profile))
+	h, err := read(path, last)
+	if os.IsNotExist(err) {
+		h, err = &History{path: path}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	h.Command, h.Profile = command, profile
+	return h, nil
+}
+
+// Previous returns the result of the last measurement, or nil if there is none.
+func (h *History) Previous() *Entry {
+	if len(h.Entries) == 0 {
+		return nil
+	}
+	return &h.Entries[len(h.Entries)-1]
+}
+
+// Add adds the result of a new measurement to the history, appending it to the
+// file of the history in a single write.
+func (h *History) Add(e Entry) error {
+	line, err := json.Marshal(record{Command: h.Command, Profile: h.Profile, Entry: e})
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if err := os.MkdirAll(filepath.Dir(h.path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(h.path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	// the result of an interrupted measurement is ended so that it doesn't
+	// run into this one
+	last := make([]byte, 1)
+	if info, err := f.Stat(); err == nil && info.Size() > 0 {
+		if _, err := f.ReadAt(last, info.Size()-1); err == nil && last[0] != '\n' {
+			line = append([]byte("\n"), line...)
+		}
+	}
+	if _, err := f.Write(line); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	h.Entries = append(h.Entries, e)
+	return nil
+}
+
+// List returns the histories of all the commands and profiles in the
+// directory, with all of their results.
+func List(dir string) ([]*History, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+	var histories []*History
+	for _, path := range paths {
+		h, err := read(path, 0)
+		if err != nil {
+			return nil, err
+		}
+		if len(h.Entries) != 0 {
+			histories = append(histories, h)
+		}
+	}
+	return histories, nil
+}
+
+// Name returns the name of what the command measured, which is the snap for
+// snap run, the application for flatpak run and else the program.
+func (h *History) Name() string {
+	if len(h.Command) == 0 {
+		return ""
+	}
+	if len(h.Command) > 2 && h.Command[1] == "run" {
+		switch h.Command[0] {
+		case "snap":
+			// snap run takes snap.app names
+			return strings.SplitN(h.Command[2], ".", 2)[0]
+		case "flatpak":
+			return h.Command[2]
+		}
+	}
+	return filepath.Base(h.Command[0])
+}
+
+// TrendEntry is a measurement of a trend
+type TrendEntry struct {
+	Time    time.Time
+	Command []string
+	Profile string
+	// Revision is the revision of the snap, it is only known for snaps run
+	// with snap run
+	Revision string
+	Kernel   string
+	// TimeToDisplay and TimeToRun are the statistics of the runs
+	TimeToDisplay analysis.Stats
+	TimeToRun     analysis.Stats
+	// Change is the percentage the mean time to display changed by since the
+	// previous measurement of the same command and profile, which is only
+	// known if there is one
+	Change    float64
+	HasChange bool
+}
+
+// Trend returns the measurements of the commands with the given name from the
+// histories, from the oldest to the newest.
+func Trend(histories []*History, name string) []TrendEntry {
+	var trend []TrendEntry
+	for _, h := range histories {
+		if h.Name() != name {
+			continue
+		}
+		var prev time.Duration
+		for _, e := range h.Entries {
+			te := TrendEntry{
+				Time:          e.Time,
+				Command:       h.Command,
+				Profile:       h.Profile,
+				Revision:      e.Revisions[name],
+				Kernel:        e.Kernel,
+				TimeToDisplay: analysis.Compute(e.TimesToDisplay),
+				TimeToRun:     analysis.Compute(e.TimesToRun),
+			}
+			if prev != 0 {
+				te.Change = 100 * float64(te.TimeToDisplay.Mean-prev) / float64(prev)
+				te.HasChange = true
+			}
+			prev = te.TimeToDisplay.Mean
+			trend = append(trend, te)
+		}
+	}
+	sort.SliceStable(trend, func(i, j int) bool {
+		return trend[i].Time.Before(trend[j].Time)
+	})
+	return trend
+}
@@ -0,0 +1,209 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package history_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/anonymouse64/etrace/internal/history"
+
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type historyTestSuite struct{}
+
+var _ = check.Suite(&historyTestSuite{})
+
+func (s *historyTestSuite) TestDir(c *check.C) {
+	restore := history.MockUserHomeDir(func() (string, error) { return "/home/user", nil })
+	defer restore()
+	old := os.Getenv("XDG_STATE_HOME")
+	defer os.Setenv("XDG_STATE_HOME", old)
+
+	os.Setenv("XDG_STATE_HOME", "")
+	dir, err := history.Dir()
+	c.Assert(err, check.IsNil)
+	c.Check(dir, check.Equals, "/home/user/.local/state/etrace/history")
+
+	os.Setenv("XDG_STATE_HOME", "/tmp/state")
+	dir, err = history.Dir()
+	c.Assert(err, check.IsNil)
+	c.Check(dir, check.Equals, "/tmp/state/etrace/history")
+}
+
+func (s *historyTestSuite) TestLoadAdd(c *check.C) {
+	dir := c.MkDir()
+	h, err := history.Load(dir, []string{"gedit"}, "cold", 2)
+	c.Assert(err, check.IsNil)
+	c.Check(h.Previous(), check.IsNil)
+
+	measured := time.Date(2021, 7, 1, 12, 0, 0, 0, time.UTC)
+	for i := 1; i <= 3; i++ {
+		c.Assert(h.Add(history.Entry{
+			Time:           measured.Add(time.Duration(i) * time.Hour),
+			TimesToDisplay: []time.Duration{time.Duration(i) * time.Second},
+		}), check.IsNil)
+	}
+	c.Check(h.Previous().TimesToDisplay, check.DeepEquals, []time.Duration{3 * time.Second})
+
+	// only the last 2 are loaded
+	h, err = history.Load(dir, []string{"gedit"}, "cold", 2)
+	c.Assert(err, check.IsNil)
+	c.Check(h.Command, check.DeepEquals, []string{"gedit"})
+	c.Check(h.Profile, check.Equals, "cold")
+	c.Assert(h.Entries, check.HasLen, 2)
+	c.Check(h.Entries[0].TimesToDisplay, check.DeepEquals, []time.Duration{2 * time.Second})
+	c.Check(h.Previous().Time.Equal(measured.Add(3*time.Hour)), check.Equals, true)
+	c.Check(h.Previous().TimesToDisplay, check.DeepEquals, []time.Duration{3 * time.Second})
+
+	// but all of them are kept
+	h, err = history.Load(dir, []string{"gedit"}, "cold", 0)
+	c.Assert(err, check.IsNil)
+	c.Assert(h.Entries, check.HasLen, 3)
+	c.Check(h.Entries[0].TimesToDisplay, check.DeepEquals, []time.Duration{time.Second})
+
+	// other profiles and commands have their own history
+	h, err = history.Load(dir, []string{"gedit"}, "hot", 2)
+	c.Assert(err, check.IsNil)
+	c.Check(h.Previous(), check.IsNil)
+	h, err = history.Load(dir, []string{"gedit", "--new-window"}, "cold", 2)
+	c.Assert(err, check.IsNil)
+	c.Check(h.Previous(), check.IsNil)
+}
+
+func (s *historyTestSuite) TestAddAfterInterrupted(c *check.C) {
+	dir := c.MkDir()
+	h, err := history.Load(dir, []string{"gedit"}, "", 0)
+	c.Assert(err, check.IsNil)
+	measured := time.Date(2021, 7, 1, 12, 0, 0, 0, time.UTC)
+	c.Assert(h.Add(history.Entry{Time: measured, TimesToDisplay: []time.Duration{time.Second}}), check.IsNil)
+
+	// a measurement was interrupted while its result was added
+	paths, err := filepath.Glob(filepath.Join(dir, "*.jsonl"))
+	c.Assert(err, check.IsNil)
+	c.Assert(paths, check.HasLen, 1)
+	f, err := os.OpenFile(paths[0], os.O_WRONLY|os.O_APPEND, 0644)
+	c.Assert(err, check.IsNil)
+	_, err = f.WriteString(`{"Command":["gedit"],"Time":"2021-07`)
+	c.Assert(err, check.IsNil)
+	c.Assert(f.Close(), check.IsNil)
+
+	c.Assert(h.Add(history.Entry{Time: measured.Add(time.Hour), TimesToDisplay: []time.Duration{2 * time.Second}}), check.IsNil)
+
+	h, err = history.Load(dir, []string{"gedit"}, "", 0)
+	c.Assert(err, check.IsNil)
+	c.Assert(h.Entries, check.HasLen, 2)
+	c.Check(h.Entries[0].TimesToDisplay, check.DeepEquals, []time.Duration{time.Second})
+	c.Check(h.Entries[1].TimesToDisplay, check.DeepEquals, []time.Duration{2 * time.Second})
+
+	// other errors are still reported
+	c.Assert(ioutil.WriteFile(paths[0], []byte(`{"Command":"gedit"}`+"\n"), 0644), check.IsNil)
+	_, err = history.Load(dir, []string{"gedit"}, "", 0)
+	c.Check(err, check.ErrorMatches, `cannot parse history .*\.jsonl: line 1: json: cannot unmarshal string .*`)
+}
+
+func (s *historyTestSuite) TestName(c *check.C) {
+	for _, t := range []struct {
+		command []string
+		name    string
+	}{
+		{[]string{"snap", "run", "gedit"}, "gedit"},
+		{[]string{"snap", "run", "gnome-calculator.gnome-calculator", "--help"}, "gnome-calculator"},
+		{[]string{"flatpak", "run", "org.gnome.gedit"}, "org.gnome.gedit"},
+		{[]string{"/usr/bin/gedit", "--new-window"}, "gedit"},
+		{[]string{"snap"}, "snap"},
+	} {
+		h := &history.History{Command: t.command}
+		c.Check(h.Name(), check.Equals, t.name, check.Commentf("%q", t.command))
+	}
+}
+
+func (s *historyTestSuite) TestListTrend(c *check.C) {
+	dir := c.MkDir()
+	measured := time.Date(2021, 7, 1, 12, 0, 0, 0, time.UTC)
+	add := func(command []string, profile string, entries ...history.Entry) {
+		h, err := history.Load(dir, command, profile, 0)
+		c.Assert(err, check.IsNil)
+		for _, e := range entries {
+			c.Assert(h.Add(e), check.IsNil)
+		}
+	}
+	add([]string{"snap", "run", "gedit"}, "cold",
+		history.Entry{
+			Time:           measured,
+			TimesToDisplay: []time.Duration{2 * time.Second, 2 * time.Second},
+			Revisions:      map[string]string{"gedit": "12", "core20": "1405"},
+			Kernel:         "5.11.0-25-generic",
+		},
+		history.Entry{
+			Time:           measured.Add(2 * time.Hour),
+			TimesToDisplay: []time.Duration{time.Second, 2 * time.Second},
+			TimesToRun:     []time.Duration{3 * time.Second},
+			Revisions:      map[string]string{"gedit": "13", "core20": "1405"},
+			Kernel:         "5.11.0-27-generic",
+		},
+	)
+	add([]string{"snap", "run", "gedit"}, "hot", history.Entry{
+		Time:           measured.Add(time.Hour),
+		TimesToDisplay: []time.Duration{time.Second},
+	})
+	add([]string{"firefox"}, "", history.Entry{
+		Time:           measured,
+		TimesToDisplay: []time.Duration{time.Second},
+	})
+
+	histories, err := history.List(dir)
+	c.Assert(err, check.IsNil)
+	c.Assert(histories, check.HasLen, 3)
+
+	trend := history.Trend(histories, "gedit")
+	c.Assert(trend, check.HasLen, 3)
+	// the measurements of all the profiles are sorted by time
+	c.Check(trend[0].Profile, check.Equals, "cold")
+	c.Check(trend[0].Command, check.DeepEquals, []string{"snap", "run", "gedit"})
+	c.Check(trend[0].Revision, check.Equals, "12")
+	c.Check(trend[0].Kernel, check.Equals, "5.11.0-25-generic")
+	c.Check(trend[0].TimeToDisplay.N, check.Equals, 2)
+	c.Check(trend[0].TimeToDisplay.Mean, check.Equals, 2*time.Second)
+	c.Check(trend[0].TimeToRun.N, check.Equals, 0)
+	c.Check(trend[0].HasChange, check.Equals, false)
+	c.Check(trend[1].Profile, check.Equals, "hot")
+	c.Check(trend[1].HasChange, check.Equals, false)
+	// the changes are since the previous measurement with the same profile
+	c.Check(trend[2].Profile, check.Equals, "cold")
+	c.Check(trend[2].Revision, check.Equals, "13")
+	c.Check(trend[2].TimeToDisplay.Mean, check.Equals, 1500*time.Millisecond)
+	c.Check(trend[2].TimeToRun.Mean, check.Equals, 3*time.Second)
+	c.Check(trend[2].HasChange, check.Equals, true)
+	c.Check(trend[2].Change, check.Equals, -25.0)
+
+	c.Check(history.Trend(histories, "firefox"), check.HasLen, 1)
+	c.Check(history.Trend(histories, "gimp"), check.HasLen, 0)
+}
+
+func (s *historyTestSuite) TestListEmpty(c *check.C) {
+	histories, err := history.List(filepath.Join(c.MkDir(), "missing"))
+	c.Assert(err, check.IsNil)
+	c.Check(histories, check.HasLen, 0)
+}
@@ -0,0 +1,141 @@
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package hwbench runs a quick benchmark of the disk and CPU, so that startup
+// times measured on different machines can be compared.
+package hwbench
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"time"
+
+	"github.com/anonymouse64/etrace/internal/profiling"
+)
+
+// The speed of the reference machine startup times are normalized to, which
+// is roughly a mid range laptop with an SSD.
+const (
+	ReferenceDiskReadMBps = 500
+	ReferenceCPUScore     = 100
+)
+
+var (
+	// diskBenchSize is how much is written and read back to measure the disk
+	diskBenchSize = 64 * 1024 * 1024
+	// cpuBenchTime is how long the CPU benchmark runs for
+	cpuBenchTime = 500 * time.Millisecond
+
+	freeCaches = profiling.FreeCaches
+)
+
+// Benchmark is the speed of the machine
+type Benchmark struct {
+	// DiskReadMBps is the sequential read throughput of the disk in MB/s
+	DiskReadMBps float64
+	// CPUScore is the throughput of compressing data on a single core in
+	// MB/s
+	CPUScore float64
+}
+
+// Run benchmarks the disk the directory is on and a single CPU core. Reading
+// from the disk needs freeing the caches, which needs root.
+func Run(dir string) (*Benchmark, error) {
+	disk, err := diskReadMBps(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &Benchmark{
+		DiskReadMBps: disk,
+		CPUScore:     cpuScore(),
+	}, nil
+}
+
+func diskReadMBps(dir string) (float64, error) {
+	f, err := ioutil.TempFile(dir, "etrace-hwbench")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	// random data so that compressing filesystems don't skew the result
+	block := make([]byte, 1024*1024)
+	rand.New(rand.NewSource(1)).Read(block)
+	for written := 0; written < diskBenchSize; written += len(block) {
+		if _, err := f.Write(block); err != nil {
+			return 0, err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		return 0, err
+	}
+	if err := freeCaches(); err != nil {
+		return 0, err
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	n, err := io.CopyBuffer(ioutil.Discard, f, block)
+	if err != nil {
+		return 0, err
+	}
+	return float64(n) / 1e6 / time.Since(start).Seconds(), nil
+}
+
+// cpuScore compresses the same text over and over for cpuBenchTime, which is
+// closer to the branchy code apps run at startup than a hash or a tight loop.
+func cpuScore() float64 {
+	var text bytes.Buffer
+	for i := 0; text.Len() < 1024*1024; i++ {
+		text.WriteString("etrace measures how long it takes for programs to start ")
+		text.WriteString(time.Duration(i * 7919).String())
+	}
+	zw, _ := flate.NewWriter(ioutil.Discard, flate.DefaultCompression)
+	compressed := 0
+	start := time.Now()
+	for time.Since(start) < cpuBenchTime {
+		zw.Reset(ioutil.Discard)
+		zw.Write(text.Bytes())
+		zw.Close()
+		compressed += text.Len()
+	}
+	return float64(compressed) / 1e6 / time.Since(start).Seconds()
+}
+
+// Normalize returns how long the startup time would be on the reference
+// machine. Hot starts are mostly bound by the CPU, while cold starts are
+// bound by both the CPU and reading from the disk. This is only a rough
+// estimate, but it makes startup times measured on very different machines
+// comparable.
+func (b *Benchmark) Normalize(d time.Duration, cold bool) time.Duration {
+	if b.CPUScore <= 0 || b.DiskReadMBps <= 0 {
+		return 0
+	}
+	factor := b.CPUScore / ReferenceCPUScore
+	if cold {
+		factor = math.Sqrt(factor * b.DiskReadMBps / ReferenceDiskReadMBps)
+	}
+	return time.Duration(float64(d) * factor)
+}
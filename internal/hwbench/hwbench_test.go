@@ -0,0 +1,67 @@
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package hwbench_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/anonymouse64/etrace/internal/hwbench"
+
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type hwbenchTestSuite struct{}
+
+var _ = check.Suite(&hwbenchTestSuite{})
+
+func (s *hwbenchTestSuite) TestRun(c *check.C) {
+	defer hwbench.MockBenchSizes(2*1024*1024, 10*time.Millisecond)()
+	freed := 0
+	defer hwbench.MockFreeCaches(func() error {
+		freed++
+		return nil
+	})()
+
+	b, err := hwbench.Run(c.MkDir())
+	c.Assert(err, check.IsNil)
+	c.Check(freed, check.Equals, 1)
+	c.Check(b.DiskReadMBps > 0, check.Equals, true)
+	c.Check(b.CPUScore > 0, check.Equals, true)
+}
+
+func (s *hwbenchTestSuite) TestNormalize(c *check.C) {
+	reference := &hwbench.Benchmark{
+		DiskReadMBps: hwbench.ReferenceDiskReadMBps,
+		CPUScore:     hwbench.ReferenceCPUScore,
+	}
+	c.Check(reference.Normalize(time.Second, true), check.Equals, time.Second)
+	c.Check(reference.Normalize(time.Second, false), check.Equals, time.Second)
+
+	// a machine with a twice as fast CPU and a four times slower disk
+	b := &hwbench.Benchmark{
+		DiskReadMBps: hwbench.ReferenceDiskReadMBps / 4,
+		CPUScore:     hwbench.ReferenceCPUScore * 2,
+	}
+	c.Check(b.Normalize(time.Second, false), check.Equals, 2*time.Second)
+	c.Check(b.Normalize(time.Second, true).Round(time.Millisecond), check.Equals, 707*time.Millisecond)
+
+	c.Check((&hwbench.Benchmark{}).Normalize(time.Second, true), check.Equals, time.Duration(0))
+}
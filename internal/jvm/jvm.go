@@ -0,0 +1,140 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package jvm
+
+import (
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/anonymouse64/etrace/internal/schema"
+	"github.com/anonymouse64/etrace/internal/strace"
+)
+
+// ClassDataArchive is a class data sharing archive used by the JVM
+type ClassDataArchive struct {
+	Path string
+	// App is whether the archive is an application class data sharing
+	// archive, as opposed to the default archive shipped with the JVM
+	App bool
+}
+
+// Launch is the startup breakdown of a JVM launch
+type Launch struct {
+	Exe      string
+	JavaHome string
+	// Start is when the java program was executed, relative to the start of
+	// the trace
+	Start time.Duration
+	// InitTime is the time from executing java until the first class or jar
+	// of the application was accessed
+	InitTime time.Duration
+	// AppTime is the rest of the runtime of the java program
+	AppTime           time.Duration
+	ClassDataArchives []ClassDataArchive `json:",omitempty"`
+}
+
+// Structured returns the launch as encoded since version 2 of the schema.
+func (l *Launch) Structured() interface{} {
+	type plain Launch
+	return struct {
+		plain
+		Start    schema.Duration
+		InitTime schema.Duration
+		AppTime  schema.Duration
+	}{plain(*l), schema.NewDuration(l.Start), schema.NewDuration(l.InitTime), schema.NewDuration(l.AppTime)}
+}
+
+// IsJavaExe returns whether the program is the java launcher.
+func IsJavaExe(exe string) bool {
+	return filepath.Base(exe) == "java"
+}
+
+// javaHome returns the java home that the given libjvm.so belongs to, which is
+// for example:
+// /usr/lib/jvm/java-11-openjdk-amd64/lib/server/libjvm.so
+// /usr/lib/jvm/java-8-openjdk-amd64/jre/lib/amd64/server/libjvm.so
+// or the empty string if the path is not a libjvm.so.
+func javaHome(path string) string {
+	if filepath.Base(path) != "libjvm.so" {
+		return ""
+	}
+	i := strings.LastIndex(path, "/lib/")
+	if i == -1 {
+		return ""
+	}
+	return path[:i]
+}
+
+func isAppClassPath(path string) bool {
+	return strings.HasSuffix(path, ".jar") || strings.HasSuffix(path, ".class")
+}
+
+// Analyze recognizes the launch of a JVM as the java program loading
+// libjvm.so, and returns the breakdown of the time spent initializing the JVM
+// vs running the application, which starts when the first class or jar
+// outside of the java home is accessed. It returns nil if no JVM was launched.
+func Analyze(e *strace.ExecvePaths) *Launch {
+	for _, proc := range e.Processes {
+		if !IsJavaExe(proc.Exe) {
+			continue
+		}
+		var launch *Launch
+		var appStart time.Time
+		seenArchives := make(map[string]bool)
+		for _, access := range proc.PathAccesses {
+			if launch == nil {
+				home := javaHome(access.Path)
+				if home == "" {
+					continue
+				}
+				launch = &Launch{
+					Exe:      proc.Exe,
+					JavaHome: home,
+					Start:    proc.Start.Sub(e.Start),
+				}
+			}
+			inJavaHome := strings.HasPrefix(access.Path, launch.JavaHome+"/")
+			switch {
+			case strings.HasSuffix(access.Path, ".jsa"):
+				if !seenArchives[access.Path] {
+					seenArchives[access.Path] = true
+					launch.ClassDataArchives = append(launch.ClassDataArchives, ClassDataArchive{
+						Path: access.Path,
+						App:  !inJavaHome,
+					})
+				}
+			case appStart.IsZero() && !inJavaHome && isAppClassPath(access.Path):
+				appStart = access.Time
+			}
+		}
+		if launch == nil {
+			// the launcher may execute another java, which then loads the JVM
+			continue
+		}
+		end := proc.Start.Add(proc.RunDuration)
+		if appStart.IsZero() {
+			launch.InitTime = proc.RunDuration
+		} else {
+			launch.InitTime = appStart.Sub(proc.Start)
+			launch.AppTime = end.Sub(appStart)
+		}
+		return launch
+	}
+	return nil
+}
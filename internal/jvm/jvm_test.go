@@ -0,0 +1,116 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package jvm_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/anonymouse64/etrace/internal/jvm"
+	"github.com/anonymouse64/etrace/internal/strace"
+
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type jvmTestSuite struct{}
+
+var _ = check.Suite(&jvmTestSuite{})
+
+func (p *jvmTestSuite) TestIsJavaExe(c *check.C) {
+	c.Check(jvm.IsJavaExe("/usr/lib/jvm/java-11-openjdk-amd64/bin/java"), check.Equals, true)
+	c.Check(jvm.IsJavaExe("/snap/foo/1/usr/bin/java"), check.Equals, true)
+	c.Check(jvm.IsJavaExe("/usr/bin/javac"), check.Equals, false)
+}
+
+func (p *jvmTestSuite) TestAnalyze(c *check.C) {
+	start := time.Unix(1000, 0)
+	at := func(ms int) time.Time { return start.Add(time.Duration(ms) * time.Millisecond) }
+	home := "/snap/foo/1/usr/lib/jvm/java-11-openjdk-amd64"
+	e := &strace.ExecvePaths{
+		Start: start,
+		Processes: []strace.ProcessRuntime{
+			{
+				Start:       at(0),
+				Exe:         "/usr/bin/snap",
+				RunDuration: 100 * time.Millisecond,
+			},
+			{
+				Start:       at(100),
+				Exe:         home + "/bin/java",
+				RunDuration: 2 * time.Second,
+				PathAccesses: []strace.PathAccess{
+					{Time: at(110), Path: "/snap/foo/1/app/lib/early.jar"},
+					{Time: at(120), Path: home + "/lib/server/libjvm.so"},
+					{Time: at(130), Path: home + "/lib/server/classes.jsa"},
+					{Time: at(140), Path: home + "/lib/server/classes.jsa"},
+					{Time: at(300), Path: home + "/lib/modules"},
+					{Time: at(600), Path: "/snap/foo/1/app/lib/app.jar"},
+					{Time: at(610), Path: "/snap/foo/1/app/app.jsa"},
+					{Time: at(700), Path: "/snap/foo/1/app/lib/other.jar"},
+				},
+			},
+		},
+	}
+	c.Assert(jvm.Analyze(e), check.DeepEquals, &jvm.Launch{
+		Exe:      home + "/bin/java",
+		JavaHome: home,
+		Start:    100 * time.Millisecond,
+		InitTime: 500 * time.Millisecond,
+		AppTime:  1500 * time.Millisecond,
+		ClassDataArchives: []jvm.ClassDataArchive{
+			{Path: home + "/lib/server/classes.jsa"},
+			{Path: "/snap/foo/1/app/app.jsa", App: true},
+		},
+	})
+}
+
+func (p *jvmTestSuite) TestAnalyzeJava8NoApp(c *check.C) {
+	start := time.Unix(1000, 0)
+	home := "/usr/lib/jvm/java-8-openjdk-amd64/jre"
+	e := &strace.ExecvePaths{
+		Start: start,
+		Processes: []strace.ProcessRuntime{
+			{
+				Start:       start,
+				Exe:         "/usr/bin/java",
+				RunDuration: time.Second,
+				PathAccesses: []strace.PathAccess{
+					{Time: start.Add(time.Millisecond), Path: home + "/lib/amd64/server/libjvm.so"},
+					{Time: start.Add(2 * time.Millisecond), Path: home + "/lib/rt.jar"},
+				},
+			},
+		},
+	}
+	c.Assert(jvm.Analyze(e), check.DeepEquals, &jvm.Launch{
+		Exe:      "/usr/bin/java",
+		JavaHome: home,
+		InitTime: time.Second,
+	})
+}
+
+func (p *jvmTestSuite) TestAnalyzeNoJVM(c *check.C) {
+	e := &strace.ExecvePaths{
+		Processes: []strace.ProcessRuntime{
+			{Exe: "/usr/bin/java", PathAccesses: []strace.PathAccess{{Path: "/etc/ld.so.cache"}}},
+			{Exe: "/bin/sh"},
+		},
+	}
+	c.Assert(jvm.Analyze(e), check.IsNil)
+}
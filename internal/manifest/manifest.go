@@ -0,0 +1,118 @@
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package manifest stores the set of files a program accesses, so that
+// changes to it can be caught.
+package manifest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+)
+
+// Manifest is the set of files a program accessed
+type Manifest struct {
+	Files []string
+}
+
+// snapRevisionPath matches the revision in the paths of snap mounts, which
+// changes with every refresh
+var snapRevisionPath = regexp.MustCompile(`^/snap/([^/]+)/x?[0-9]+(/|$)`)
+
+// normalize returns the path with the revision of a snap replaced by current.
+func normalize(path string) string {
+	return snapRevisionPath.ReplaceAllString(path, "/snap/$1/current$2")
+}
+
+// New returns the manifest of the accessed files.
+func New(paths []string) *Manifest {
+	seen := make(map[string]bool, len(paths))
+	m := &Manifest{Files: []string{}}
+	for _, p := range paths {
+		p = normalize(p)
+		if !seen[p] {
+			seen[p] = true
+			m.Files = append(m.Files, p)
+		}
+	}
+	sort.Strings(m.Files)
+	return m
+}
+
+// Read reads a manifest from the given JSON file.
+func Read(path string) (*Manifest, error) {
+	out, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m Manifest
+	if err := json.Unmarshal(out, &m); err != nil {
+		return nil, fmt.Errorf("cannot parse manifest %s: %v", path, err)
+	}
+	for i, p := range m.Files {
+		m.Files[i] = normalize(p)
+	}
+	sort.Strings(m.Files)
+	return &m, nil
+}
+
+// Write writes the manifest as JSON to the given file.
+func (m *Manifest) Write(path string) error {
+	out, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(out, '\n'), 0644)
+}
+
+// Diff is how the accessed files differ from a manifest
+type Diff struct {
+	// Added are the files which were accessed but are not in the manifest
+	Added []string `json:",omitempty"`
+	// Removed are the files in the manifest which were not accessed
+	Removed []string `json:",omitempty"`
+}
+
+// Empty returns whether the accessed files are the ones in the manifest.
+func (d *Diff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0
+}
+
+// Compare returns how the files in the other manifest differ from this one.
+func (m *Manifest) Compare(other *Manifest) *Diff {
+	d := &Diff{}
+	expected := make(map[string]bool, len(m.Files))
+	for _, p := range m.Files {
+		expected[p] = true
+	}
+	accessed := make(map[string]bool, len(other.Files))
+	for _, p := range other.Files {
+		accessed[p] = true
+		if !expected[p] {
+			d.Added = append(d.Added, p)
+		}
+	}
+	for _, p := range m.Files {
+		if !accessed[p] {
+			d.Removed = append(d.Removed, p)
+		}
+	}
+	return d
+}
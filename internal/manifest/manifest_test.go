@@ -0,0 +1,74 @@
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package manifest_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/anonymouse64/etrace/internal/manifest"
+
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type manifestTestSuite struct{}
+
+var _ = check.Suite(&manifestTestSuite{})
+
+func (s *manifestTestSuite) TestNew(c *check.C) {
+	m := manifest.New([]string{
+		"/usr/lib/libfoo.so",
+		"/snap/foo/123/bin/foo",
+		"/snap/foo/x1/bin/foo",
+		"/snap/foo/current/usr/share/foo",
+		"/snap/foo/123",
+		"/snap/foo/123abc/bar",
+	})
+	c.Check(m.Files, check.DeepEquals, []string{
+		"/snap/foo/123abc/bar",
+		"/snap/foo/current",
+		"/snap/foo/current/bin/foo",
+		"/snap/foo/current/usr/share/foo",
+		"/usr/lib/libfoo.so",
+	})
+}
+
+func (s *manifestTestSuite) TestWriteReadCompare(c *check.C) {
+	path := filepath.Join(c.MkDir(), "manifest.json")
+	c.Assert(manifest.New([]string{"/snap/foo/1/bin/foo", "/etc/foo.conf", "/usr/lib/libold.so"}).Write(path), check.IsNil)
+
+	m, err := manifest.Read(path)
+	c.Assert(err, check.IsNil)
+	c.Check(m.Files, check.DeepEquals, []string{"/etc/foo.conf", "/snap/foo/current/bin/foo", "/usr/lib/libold.so"})
+
+	// a new revision of the snap accessing a new library
+	d := m.Compare(manifest.New([]string{"/snap/foo/2/bin/foo", "/etc/foo.conf", "/usr/lib/libnew.so"}))
+	c.Check(d, check.DeepEquals, &manifest.Diff{
+		Added:   []string{"/usr/lib/libnew.so"},
+		Removed: []string{"/usr/lib/libold.so"},
+	})
+	c.Check(d.Empty(), check.Equals, false)
+	c.Check(m.Compare(m).Empty(), check.Equals, true)
+
+	c.Assert(ioutil.WriteFile(path, []byte("garbage"), 0644), check.IsNil)
+	_, err = manifest.Read(path)
+	c.Check(err, check.ErrorMatches, "cannot parse manifest .*")
+}
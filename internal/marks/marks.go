@@ -0,0 +1,158 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package marks
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/anonymouse64/etrace/internal/schema"
+)
+
+// EnvVar is the environment variable set for the traced program with the path
+// of the fifo that phase marks should be written to. Each line written to the
+// fifo is recorded as a mark with that name, i.e. from a shell script:
+//
+//	echo "main-window" > "$ETRACE_MARK"
+const EnvVar = "ETRACE_MARK"
+
+// stopSentinel is written to the fifo by the listener itself to stop reading,
+// it can't be confused with a mark as programs have no reason to write NUL
+const stopSentinel = "\x00"
+
+// Mark is a named timestamp reported by the traced program
+type Mark struct {
+	Name string
+	Time time.Time
+	// Offset is the time the mark was received relative to the start of the
+	// program
+	Offset time.Duration
+}
+
+// Structured returns the mark as encoded since version 2 of the schema.
+func (m Mark) Structured() interface{} {
+	type plain Mark
+	return struct {
+		plain
+		Offset schema.Duration
+	}{plain(m), schema.NewDuration(m.Offset)}
+}
+
+// Listener reads phase marks from a fifo while the traced program runs
+type Listener struct {
+	fifo  string
+	f     *os.File
+	start time.Time
+
+	// mu protects marks, which are read while the program runs
+	mu    sync.Mutex
+	marks []Mark
+
+	started bool
+	exit    chan struct{}
+}
+
+// NewListener creates a fifo in the specified directory for a traced program to
+// write phase marks to.
+func NewListener(dir string) (*Listener, error) {
+	fifo := filepath.Join(dir, "etrace-mark.fifo")
+	if err := syscall.Mkfifo(fifo, 0600); err != nil {
+		return nil, err
+	}
+	// open the fifo read-write so that opening doesn't block waiting for a
+	// writer and so that we never see EOF when the program closes its end
+	// after writing a mark
+	f, err := os.OpenFile(fifo, os.O_RDWR, 0600)
+	if err != nil {
+		os.Remove(fifo)
+		return nil, err
+	}
+	return &Listener{
+		fifo: fifo,
+		f:    f,
+		exit: make(chan struct{}),
+	}, nil
+}
+
+// Path returns the path of the fifo that marks should be written to.
+func (l *Listener) Path() string {
+	return l.fifo
+}
+
+// Env returns the environment variable assignment to provide to the traced
+// program.
+func (l *Listener) Env() string {
+	return EnvVar + "=" + l.fifo
+}
+
+// Start starts recording marks, with offsets relative to the given start time.
+func (l *Listener) Start(start time.Time) {
+	l.start = start
+	l.started = true
+	go func() {
+		defer close(l.exit)
+		s := bufio.NewScanner(l.f)
+		for s.Scan() {
+			now := time.Now()
+			if s.Text() == stopSentinel {
+				return
+			}
+			name := strings.TrimSpace(s.Text())
+			if name == "" {
+				continue
+			}
+			l.mu.Lock()
+			l.marks = append(l.marks, Mark{
+				Name:   name,
+				Time:   now,
+				Offset: now.Sub(l.start),
+			})
+			l.mu.Unlock()
+		}
+	}()
+}
+
+// Find returns the first mark with the name recorded so far.
+func (l *Listener) Find(name string) (Mark, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, m := range l.marks {
+		if m.Name == name {
+			return m, true
+		}
+	}
+	return Mark{}, false
+}
+
+// Stop stops recording marks, removes the fifo and returns all the marks that
+// were recorded.
+func (l *Listener) Stop() []Mark {
+	// wake up the reader, any marks written before this are still in order
+	// ahead of the sentinel in the fifo
+	if _, err := l.f.Write([]byte(stopSentinel + "\n")); err == nil && l.started {
+		<-l.exit
+	}
+	l.f.Close()
+	os.Remove(l.fifo)
+	return l.marks
+}
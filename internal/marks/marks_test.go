@@ -0,0 +1,83 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package marks_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/anonymouse64/etrace/internal/marks"
+
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type marksTestSuite struct{}
+
+var _ = check.Suite(&marksTestSuite{})
+
+func (p *marksTestSuite) TestListener(c *check.C) {
+	dir := c.MkDir()
+	l, err := marks.NewListener(dir)
+	c.Assert(err, check.IsNil)
+	c.Assert(l.Path(), check.Equals, filepath.Join(dir, "etrace-mark.fifo"))
+	c.Assert(l.Env(), check.Equals, "ETRACE_MARK="+l.Path())
+
+	start := time.Now()
+	l.Start(start)
+
+	// write some marks like a program would, opening and closing the fifo each
+	// time
+	for _, name := range []string{"splash", "", "main-window\n", "  idle  "} {
+		f, err := os.OpenFile(l.Path(), os.O_WRONLY, 0)
+		c.Assert(err, check.IsNil)
+		_, err = f.WriteString(name + "\n")
+		c.Assert(err, check.IsNil)
+		c.Assert(f.Close(), check.IsNil)
+	}
+
+	// the marks can be found while the program is still running
+	var idle marks.Mark
+	for i := 0; i < 100 && idle.Name == ""; i++ {
+		idle, _ = l.Find("idle")
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Check(idle.Name, check.Equals, "idle")
+	_, found := l.Find("missing")
+	c.Check(found, check.Equals, false)
+
+	res := l.Stop()
+	c.Assert(res, check.HasLen, 3)
+	for i, name := range []string{"splash", "main-window", "idle"} {
+		c.Check(res[i].Name, check.Equals, name)
+		c.Check(res[i].Offset, check.Equals, res[i].Time.Sub(start))
+	}
+
+	// the fifo is cleaned up
+	_, err = os.Stat(l.Path())
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+}
+
+func (p *marksTestSuite) TestListenerStopWithoutStart(c *check.C) {
+	l, err := marks.NewListener(c.MkDir())
+	c.Assert(err, check.IsNil)
+	c.Assert(l.Stop(), check.HasLen, 0)
+}
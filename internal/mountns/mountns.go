@@ -0,0 +1,149 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package mountns records the mounts of the mount namespace a program runs in,
+// so that changes to the content interfaces or layouts of a snap, which change
+// both its performance and the paths it accesses, don't go unnoticed.
+package mountns
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var procRoot = "/proc"
+
+// loop devices are numbered in the order they were set up, which changes
+// every time a snap is installed
+var loopDeviceRE = regexp.MustCompile(`^/dev/loop[0-9]+$`)
+
+// parseMountInfo returns the mounts of a mountinfo file in order, each as its
+// mount point, filesystem type, source and the root of the mount in the
+// filesystem, with the paths escaped like in mountinfo.
+func parseMountInfo(content string) ([]string, error) {
+	// lines look like:
+	// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+	// see proc(5) for the meaning of the fields
+	var mounts []string
+	s := bufio.NewScanner(strings.NewReader(content))
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		sep := -1
+		for i, field := range fields {
+			if field == "-" {
+				sep = i
+				break
+			}
+		}
+		if sep < 5 || len(fields) < sep+3 {
+			return nil, fmt.Errorf("cannot parse mountinfo line %q", s.Text())
+		}
+		source := fields[sep+2]
+		if loopDeviceRE.MatchString(source) {
+			source = "/dev/loop"
+		}
+		mounts = append(mounts, strings.Join([]string{fields[4], fields[sep+1], source, fields[3]}, " "))
+	}
+	return mounts, s.Err()
+}
+
+// Read returns the mounts of the mount namespace of the process in the order
+// they were mounted, see parseMountInfo for how each mount is described. The
+// mounts don't include the mount ids or device numbers, which change on every
+// boot.
+func Read(pid int) ([]string, error) {
+	content, err := ioutil.ReadFile(filepath.Join(procRoot, strconv.Itoa(pid), "mountinfo"))
+	if err != nil {
+		return nil, err
+	}
+	return parseMountInfo(string(content))
+}
+
+// Find returns the first of the processes which is in a different mount
+// namespace than etrace, like the processes of a snap are, or the first of the
+// processes if they are all in the same mount namespace as etrace.
+func Find(pids []int) (int, error) {
+	if len(pids) == 0 {
+		return 0, fmt.Errorf("no process to read the mount namespace of")
+	}
+	pid, ok, err := Entered(pids)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return pids[0], nil
+	}
+	return pid, nil
+}
+
+// Entered returns the first of the processes which is in a different mount
+// namespace than etrace, and false if none of them entered one yet.
+func Entered(pids []int) (pid int, ok bool, err error) {
+	self, err := os.Readlink(filepath.Join(procRoot, "self", "ns", "mnt"))
+	if err != nil {
+		return 0, false, err
+	}
+	for _, pid := range pids {
+		ns, err := os.Readlink(filepath.Join(procRoot, strconv.Itoa(pid), "ns", "mnt"))
+		if err != nil {
+			// the process may have exited
+			continue
+		}
+		if ns != self {
+			return pid, true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+// Hash returns a short hash of the mounts, which is the same for mount
+// namespaces with the same mounts in the same order.
+func Hash(mounts []string) string {
+	sum := sha256.Sum256([]byte(strings.Join(mounts, "\n")))
+	return hex.EncodeToString(sum[:8])
+}
+
+// Diff returns the mounts which are in new but not in old, and the ones which
+// are in old but not in new.
+func Diff(old, new []string) (added, removed []string) {
+	count := make(map[string]int, len(old))
+	for _, m := range old {
+		count[m]++
+	}
+	for _, m := range new {
+		if count[m] > 0 {
+			count[m]--
+			continue
+		}
+		added = append(added, m)
+	}
+	for _, m := range old {
+		if count[m] > 0 {
+			count[m]--
+			removed = append(removed, m)
+		}
+	}
+	return added, removed
+}
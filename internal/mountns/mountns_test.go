@@ -0,0 +1,107 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package mountns_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/anonymouse64/etrace/internal/mountns"
+
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type mountnsTestSuite struct{}
+
+var _ = check.Suite(&mountnsTestSuite{})
+
+const mountInfo = `25 1 7:3 / / ro,nodev,relatime master:1 - squashfs /dev/loop3 ro
+26 25 259:2 /home /home rw,relatime master:2 - ext4 /dev/nvme0n1p2 rw
+27 25 7:5 / /snap/gnome-3-38-2004/99 ro,nodev,relatime master:3 - squashfs /dev/loop5 ro
+28 25 7:5 /usr/share/fonts /snap/app/12/gnome-platform ro,nodev,relatime master:3 - squashfs /dev/loop5 ro
+29 26 259:2 /home/user/my\040data /home/user/data rw,relatime master:2 - ext4 /dev/nvme0n1p2 rw
+`
+
+func (s *mountnsTestSuite) TestParseMountInfo(c *check.C) {
+	mounts, err := mountns.ParseMountInfo(mountInfo)
+	c.Assert(err, check.IsNil)
+	c.Check(mounts, check.DeepEquals, []string{
+		"/ squashfs /dev/loop /",
+		"/home ext4 /dev/nvme0n1p2 /home",
+		"/snap/gnome-3-38-2004/99 squashfs /dev/loop /",
+		"/snap/app/12/gnome-platform squashfs /dev/loop /usr/share/fonts",
+		`/home/user/data ext4 /dev/nvme0n1p2 /home/user/my\040data`,
+	})
+
+	_, err = mountns.ParseMountInfo("25 1 7:3 / /\n")
+	c.Check(err, check.ErrorMatches, `cannot parse mountinfo line "25 1 7:3 / /"`)
+}
+
+func (s *mountnsTestSuite) TestReadAndFind(c *check.C) {
+	proc := c.MkDir()
+	defer mountns.MockProcRoot(proc)()
+	for pid, ns := range map[string]string{"self": "mnt:[1]", "10": "mnt:[1]", "11": "mnt:[2]"} {
+		c.Assert(os.MkdirAll(filepath.Join(proc, pid, "ns"), 0755), check.IsNil)
+		c.Assert(os.Symlink(ns, filepath.Join(proc, pid, "ns/mnt")), check.IsNil)
+	}
+	c.Assert(ioutil.WriteFile(filepath.Join(proc, "11/mountinfo"), []byte(mountInfo), 0644), check.IsNil)
+
+	// processes in the mount namespace of etrace are skipped, as are the
+	// ones which exited
+	pid, err := mountns.Find([]int{9, 10, 11})
+	c.Assert(err, check.IsNil)
+	c.Check(pid, check.Equals, 11)
+	pid, err = mountns.Find([]int{10})
+	c.Assert(err, check.IsNil)
+	c.Check(pid, check.Equals, 10)
+	_, err = mountns.Find(nil)
+	c.Check(err, check.ErrorMatches, "no process to read the mount namespace of")
+
+	pid, ok, err := mountns.Entered([]int{9, 10, 11})
+	c.Assert(err, check.IsNil)
+	c.Check(ok, check.Equals, true)
+	c.Check(pid, check.Equals, 11)
+	_, ok, err = mountns.Entered([]int{9, 10})
+	c.Assert(err, check.IsNil)
+	c.Check(ok, check.Equals, false)
+
+	mounts, err := mountns.Read(11)
+	c.Assert(err, check.IsNil)
+	c.Check(mounts, check.HasLen, 5)
+}
+
+func (s *mountnsTestSuite) TestHashAndDiff(c *check.C) {
+	old := []string{"/ squashfs /dev/loop /", "/home ext4 /dev/sda1 /home", "/usr/lib/foo squashfs /dev/loop /"}
+	new := []string{"/ squashfs /dev/loop /", "/usr/lib/foo squashfs /dev/loop /", "/usr/share/foo squashfs /dev/loop /share"}
+
+	c.Check(mountns.Hash(old), check.Equals, mountns.Hash(append([]string{}, old...)))
+	c.Check(mountns.Hash(old), check.Not(check.Equals), mountns.Hash(new))
+	c.Check(mountns.Hash(old), check.HasLen, 16)
+
+	added, removed := mountns.Diff(old, new)
+	c.Check(added, check.DeepEquals, []string{"/usr/share/foo squashfs /dev/loop /share"})
+	c.Check(removed, check.DeepEquals, []string{"/home ext4 /dev/sda1 /home"})
+
+	added, removed = mountns.Diff(old, old)
+	c.Check(added, check.IsNil)
+	c.Check(removed, check.IsNil)
+}
@@ -0,0 +1,320 @@
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package parquet implements a minimal writer of Apache Parquet files, with
+// required, uncompressed and plain encoded columns, which is all that is needed
+// to export flat tables of trace records. The rows are written in row groups,
+// so that big tables don't have to be held in memory all at once.
+package parquet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+const magic = "PAR1"
+
+// physical types from the parquet format
+const (
+	typeInt64     = 2
+	typeByteArray = 6
+)
+
+// converted types from the parquet format
+const (
+	convertedUTF8            = 0
+	convertedTimestampMicros = 10
+)
+
+const (
+	encodingPlain  = 0
+	encodingRLE    = 3
+	pageTypeData   = 0
+	codecNone      = 0
+	repetitionReqd = 0
+	formatVersion  = 1
+	createdBy      = "etrace"
+)
+
+// maxPageSize is the most values a data page holds, in bytes. The columns
+// are split into as many pages as needed, as the sizes of the pages are 32-bit
+// in their headers.
+var maxPageSize = 1 << 20
+
+// Column is a single named column of values
+type Column struct {
+	name      string
+	typ       int32
+	converted int32
+	data      []byte
+	// ends are where each value ends in data
+	ends []int
+}
+
+// Int64Column returns a column of 64-bit integers.
+func Int64Column(name string, values []int64) Column {
+	var buf bytes.Buffer
+	ends := make([]int, len(values))
+	for i, v := range values {
+		binary.Write(&buf, binary.LittleEndian, v)
+		ends[i] = buf.Len()
+	}
+	return Column{name: name, typ: typeInt64, converted: -1, data: buf.Bytes(), ends: ends}
+}
+
+// TimestampColumn returns a column of timestamps, which are stored with
+// microsecond precision.
+func TimestampColumn(name string, values []time.Time) Column {
+	micros := make([]int64, len(values))
+	for i, t := range values {
+		micros[i] = t.UnixNano() / int64(time.Microsecond)
+	}
+	col := Int64Column(name, micros)
+	col.converted = convertedTimestampMicros
+	return col
+}
+
+// StringColumn returns a column of UTF-8 strings.
+func StringColumn(name string, values []string) Column {
+	var buf bytes.Buffer
+	ends := make([]int, len(values))
+	for i, v := range values {
+		binary.Write(&buf, binary.LittleEndian, uint32(len(v)))
+		buf.WriteString(v)
+		ends[i] = buf.Len()
+	}
+	return Column{name: name, typ: typeByteArray, converted: convertedUTF8, data: buf.Bytes(), ends: ends}
+}
+
+// pages returns the data of the column split into pages of at most
+// maxPageSize bytes, with the number of values of each.
+func (col *Column) pages() (pages [][]byte, numValues []int, err error) {
+	start, first := 0, 0
+	for i, end := range col.ends {
+		if end-start <= maxPageSize {
+			continue
+		}
+		if i > first {
+			pages = append(pages, col.data[start:col.ends[i-1]])
+			numValues = append(numValues, i-first)
+			start, first = col.ends[i-1], i
+		}
+		if end-start > maxPageSize {
+			return nil, nil, fmt.Errorf("value %d of column %q is bigger than a page", i, col.name)
+		}
+	}
+	// there is always a page, even without values
+	pages = append(pages, col.data[start:])
+	numValues = append(numValues, len(col.ends)-first)
+	return pages, numValues, nil
+}
+
+// columnChunk is where a column of a row group was written
+type columnChunk struct {
+	numValues int
+	offset    int64
+	size      int64
+}
+
+// rowGroup is where a row group was written
+type rowGroup struct {
+	numRows int
+	size    int64
+	columns []columnChunk
+}
+
+// Writer writes a parquet file to an io.Writer one row group at a time.
+type Writer struct {
+	w   io.Writer
+	off int64
+	// schema is the columns of the first row group, without their values
+	schema    []Column
+	rowGroups []rowGroup
+	numRows   int64
+	err       error
+}
+
+// NewWriter returns a Writer writing a parquet file to w, which is complete
+// once the Writer is closed.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+func (w *Writer) write(b []byte) {
+	if w.err != nil {
+		return
+	}
+	n, err := w.w.Write(b)
+	w.off += int64(n)
+	w.err = err
+}
+
+// WriteRowGroup writes the columns as the next row group. All columns must
+// have the same number of values, which is the number of rows of the group,
+// and the same names and types as in the first row group.
+func (w *Writer) WriteRowGroup(cols ...Column) error {
+	if w.err != nil {
+		return w.err
+	}
+	if len(cols) == 0 {
+		return fmt.Errorf("cannot write parquet file without columns")
+	}
+	numRows := len(cols[0].ends)
+	for _, col := range cols {
+		if len(col.ends) != numRows {
+			return fmt.Errorf("column %q has %d values, expected %d", col.name, len(col.ends), numRows)
+		}
+	}
+	if w.schema == nil {
+		for _, col := range cols {
+			w.schema = append(w.schema, Column{name: col.name, typ: col.typ, converted: col.converted})
+		}
+	} else {
+		if len(cols) != len(w.schema) {
+			return fmt.Errorf("row group has %d columns, expected %d", len(cols), len(w.schema))
+		}
+		for i, col := range cols {
+			if s := w.schema[i]; col.name != s.name || col.typ != s.typ || col.converted != s.converted {
+				return fmt.Errorf("column %d is %q, expected %q of the same type", i, col.name, s.name)
+			}
+		}
+	}
+	pages := make([][][]byte, len(cols))
+	numValues := make([][]int, len(cols))
+	for i := range cols {
+		var err error
+		pages[i], numValues[i], err = cols[i].pages()
+		if err != nil {
+			return err
+		}
+	}
+
+	if w.off == 0 {
+		w.write([]byte(magic))
+	}
+	// write the data pages of each column, keeping track of where each
+	// column chunk starts and how big it is for the footer
+	group := rowGroup{numRows: numRows, columns: make([]columnChunk, len(cols))}
+	for i := range cols {
+		chunk := columnChunk{numValues: numRows, offset: w.off}
+		for j, page := range pages[i] {
+			header := &thriftWriter{}
+			header.i32Field(1, pageTypeData)
+			header.i32Field(2, int32(len(page)))
+			header.i32Field(3, int32(len(page)))
+			header.structField(5)
+			header.i32Field(1, int32(numValues[i][j]))
+			header.i32Field(2, encodingPlain)
+			header.i32Field(3, encodingRLE)
+			header.i32Field(4, encodingRLE)
+			header.structEnd()
+			header.structEnd()
+			w.write(header.Bytes())
+			w.write(page)
+		}
+		chunk.size = w.off - chunk.offset
+		group.size += chunk.size
+		group.columns[i] = chunk
+	}
+	if w.err != nil {
+		return w.err
+	}
+	w.rowGroups = append(w.rowGroups, group)
+	w.numRows += int64(numRows)
+	return nil
+}
+
+// Close writes the footer of the file, after all the row groups.
+func (w *Writer) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.schema == nil {
+		return fmt.Errorf("cannot write parquet file without columns")
+	}
+
+	// the FileMetaData footer
+	meta := &thriftWriter{}
+	meta.i32Field(1, formatVersion)
+	meta.listField(2, thriftStruct, len(w.schema)+1)
+	// the root of the schema
+	meta.listStructBegin()
+	meta.binaryField(4, "schema")
+	meta.i32Field(5, int32(len(w.schema)))
+	meta.structEnd()
+	for _, col := range w.schema {
+		meta.listStructBegin()
+		meta.i32Field(1, col.typ)
+		meta.i32Field(3, repetitionReqd)
+		meta.binaryField(4, col.name)
+		if col.converted != -1 {
+			meta.i32Field(6, col.converted)
+		}
+		meta.structEnd()
+	}
+	meta.i64Field(3, w.numRows)
+	meta.listField(4, thriftStruct, len(w.rowGroups))
+	for _, group := range w.rowGroups {
+		meta.listStructBegin()
+		meta.listField(1, thriftStruct, len(w.schema))
+		for i, col := range w.schema {
+			chunk := group.columns[i]
+			meta.listStructBegin()
+			meta.i64Field(2, chunk.offset)
+			meta.structField(3)
+			meta.i32Field(1, col.typ)
+			meta.listField(2, thriftI32, 1)
+			meta.varint(zigzag(encodingPlain))
+			meta.listField(3, thriftBinary, 1)
+			meta.binary(col.name)
+			meta.i32Field(4, codecNone)
+			meta.i64Field(5, int64(chunk.numValues))
+			meta.i64Field(6, chunk.size)
+			meta.i64Field(7, chunk.size)
+			meta.i64Field(9, chunk.offset)
+			meta.structEnd()
+			meta.structEnd()
+		}
+		meta.i64Field(2, group.size)
+		meta.i64Field(3, int64(group.numRows))
+		meta.structEnd()
+	}
+	meta.binaryField(6, createdBy)
+	meta.structEnd()
+
+	footer := meta.Bytes()
+	w.write(footer)
+	var size [4]byte
+	binary.LittleEndian.PutUint32(size[:], uint32(len(footer)))
+	w.write(size[:])
+	w.write([]byte(magic))
+	return w.err
+}
+
+// Write writes the columns as a parquet file with a single row group to w.
+// All columns must have the same number of values, which is the number of
+// rows in the file.
+func Write(w io.Writer, cols ...Column) error {
+	pw := NewWriter(w)
+	if err := pw.WriteRowGroup(cols...); err != nil {
+		return err
+	}
+	return pw.Close()
+}
@@ -0,0 +1,277 @@
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package parquet_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/anonymouse64/etrace/internal/parquet"
+
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type parquetTestSuite struct{}
+
+var _ = check.Suite(&parquetTestSuite{})
+
+// thriftReader decodes the structures of the thrift compact protocol into
+// maps of the field ids to their values
+type thriftReader struct {
+	b   []byte
+	pos int
+}
+
+func (r *thriftReader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.b[r.pos:])
+	r.pos += n
+	return v
+}
+
+func (r *thriftReader) int() int64 {
+	v := r.uvarint()
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+func (r *thriftReader) value(typ byte) interface{} {
+	switch typ {
+	case 5, 6:
+		return r.int()
+	case 8:
+		n := int(r.uvarint())
+		r.pos += n
+		return string(r.b[r.pos-n : r.pos])
+	case 9:
+		header := r.b[r.pos]
+		r.pos++
+		size := int(header >> 4)
+		if size == 15 {
+			size = int(r.uvarint())
+		}
+		list := make([]interface{}, size)
+		for i := range list {
+			list[i] = r.value(header & 0xf)
+		}
+		return list
+	case 12:
+		return r.structure()
+	}
+	panic("unexpected thrift type")
+}
+
+func (r *thriftReader) structure() map[int16]interface{} {
+	fields := make(map[int16]interface{})
+	var last int16
+	for {
+		header := r.b[r.pos]
+		r.pos++
+		if header == 0 {
+			return fields
+		}
+		if delta := int16(header >> 4); delta != 0 {
+			last += delta
+		} else {
+			last = int16(r.int())
+		}
+		fields[last] = r.value(header & 0xf)
+	}
+}
+
+// parquetFile is what was read back from a parquet file
+type parquetFile struct {
+	names     []string
+	numRows   int64
+	rowGroups int
+	pages     int
+	values    map[string][]interface{}
+}
+
+// readParquet reads the columns of a parquet file back from its footer and
+// data pages.
+func readParquet(c *check.C, out []byte) *parquetFile {
+	c.Assert(string(out[:4]), check.Equals, "PAR1")
+	c.Assert(string(out[len(out)-4:]), check.Equals, "PAR1")
+	footerLen := int(binary.LittleEndian.Uint32(out[len(out)-8:]))
+	r := &thriftReader{b: out[len(out)-8-footerLen : len(out)-8]}
+	meta := r.structure()
+	c.Assert(r.pos, check.Equals, footerLen)
+	c.Assert(meta[1], check.Equals, int64(1))
+	c.Assert(meta[6], check.Equals, "etrace")
+
+	f := &parquetFile{numRows: meta[3].(int64), values: make(map[string][]interface{})}
+	schema := meta[2].([]interface{})
+	c.Assert(schema[0].(map[int16]interface{})[5], check.Equals, int64(len(schema)-1))
+	types := make(map[string]int64)
+	for _, elem := range schema[1:] {
+		field := elem.(map[int16]interface{})
+		name := field[4].(string)
+		f.names = append(f.names, name)
+		types[name] = field[1].(int64)
+	}
+
+	var rows int64
+	for _, group := range meta[4].([]interface{}) {
+		group := group.(map[int16]interface{})
+		f.rowGroups++
+		var groupSize int64
+		for _, chunk := range group[1].([]interface{}) {
+			chunkMeta := chunk.(map[int16]interface{})[3].(map[int16]interface{})
+			name := chunkMeta[3].([]interface{})[0].(string)
+			offset, size := chunkMeta[9].(int64), chunkMeta[6].(int64)
+			groupSize += size
+			// the data pages fill the column chunk
+			var numValues int64
+			pages := &thriftReader{b: out[offset : offset+size]}
+			for pages.pos < len(pages.b) {
+				header := pages.structure()
+				f.pages++
+				c.Assert(header[1], check.Equals, int64(0))
+				data := pages.b[pages.pos : pages.pos+int(header[3].(int64))]
+				pages.pos += len(data)
+				n := header[5].(map[int16]interface{})[1].(int64)
+				numValues += n
+				for i := int64(0); i < n; i++ {
+					if types[name] == 2 {
+						f.values[name] = append(f.values[name], int64(binary.LittleEndian.Uint64(data)))
+						data = data[8:]
+					} else {
+						l := binary.LittleEndian.Uint32(data)
+						f.values[name] = append(f.values[name], string(data[4:4+l]))
+						data = data[4+l:]
+					}
+				}
+				c.Assert(data, check.HasLen, 0)
+			}
+			c.Assert(numValues, check.Equals, chunkMeta[5].(int64))
+			c.Assert(numValues, check.Equals, group[3].(int64))
+		}
+		c.Assert(groupSize, check.Equals, group[2].(int64))
+		rows += group[3].(int64)
+	}
+	c.Assert(rows, check.Equals, f.numRows)
+	return f
+}
+
+func (p *parquetTestSuite) TestWrite(c *check.C) {
+	var buf bytes.Buffer
+	err := parquet.Write(&buf,
+		parquet.Int64Column("pid", []int64{42, 43}),
+		parquet.TimestampColumn("time", []time.Time{time.Unix(1, 0), time.Unix(2, 500000)}),
+		parquet.StringColumn("path", []string{"/etc/hosts", "/usr/lib/libc.so.6"}),
+	)
+	c.Assert(err, check.IsNil)
+
+	f := readParquet(c, buf.Bytes())
+	c.Check(f.names, check.DeepEquals, []string{"pid", "time", "path"})
+	c.Check(f.numRows, check.Equals, int64(2))
+	c.Check(f.rowGroups, check.Equals, 1)
+	c.Check(f.pages, check.Equals, 3)
+	c.Check(f.values, check.DeepEquals, map[string][]interface{}{
+		"pid":  {int64(42), int64(43)},
+		"time": {int64(1000000), int64(2000500)},
+		"path": {"/etc/hosts", "/usr/lib/libc.so.6"},
+	})
+}
+
+func (p *parquetTestSuite) TestWriterRowGroups(c *check.C) {
+	// pages hold two pids or two of the short paths
+	defer parquet.MockMaxPageSize(16)()
+
+	var buf bytes.Buffer
+	w := parquet.NewWriter(&buf)
+	c.Assert(w.WriteRowGroup(
+		parquet.Int64Column("pid", []int64{1, 2, 3}),
+		parquet.StringColumn("path", []string{"/etc", "/usr", "/var"}),
+	), check.IsNil)
+	// the first row group is written right away
+	written := buf.Len()
+	c.Check(written > 4, check.Equals, true)
+	c.Assert(w.WriteRowGroup(
+		parquet.Int64Column("pid", []int64{4}),
+		parquet.StringColumn("path", []string{"/tmp/a/b"}),
+	), check.IsNil)
+	c.Check(buf.Len() > written, check.Equals, true)
+	// a row group without rows is fine
+	c.Assert(w.WriteRowGroup(
+		parquet.Int64Column("pid", nil),
+		parquet.StringColumn("path", nil),
+	), check.IsNil)
+	c.Assert(w.Close(), check.IsNil)
+
+	f := readParquet(c, buf.Bytes())
+	c.Check(f.numRows, check.Equals, int64(4))
+	c.Check(f.rowGroups, check.Equals, 3)
+	// the columns of the first row group take two pages each
+	c.Check(f.pages, check.Equals, 8)
+	c.Check(f.values, check.DeepEquals, map[string][]interface{}{
+		"pid":  {int64(1), int64(2), int64(3), int64(4)},
+		"path": {"/etc", "/usr", "/var", "/tmp/a/b"},
+	})
+}
+
+func (p *parquetTestSuite) TestWriterValueTooBig(c *check.C) {
+	defer parquet.MockMaxPageSize(16)()
+
+	var buf bytes.Buffer
+	w := parquet.NewWriter(&buf)
+	err := w.WriteRowGroup(parquet.StringColumn("path", []string{"/etc", "/usr/share/applications"}))
+	c.Check(err, check.ErrorMatches, `value 1 of column "path" is bigger than a page`)
+	c.Check(buf.Len(), check.Equals, 0)
+}
+
+func (p *parquetTestSuite) TestWriterMismatchedRowGroups(c *check.C) {
+	w := parquet.NewWriter(&bytes.Buffer{})
+	c.Assert(w.WriteRowGroup(parquet.Int64Column("pid", []int64{1}), parquet.StringColumn("path", []string{"/etc"})), check.IsNil)
+
+	err := w.WriteRowGroup(parquet.Int64Column("pid", []int64{1}))
+	c.Check(err, check.ErrorMatches, "row group has 1 columns, expected 2")
+	err = w.WriteRowGroup(parquet.Int64Column("pid", []int64{1}), parquet.Int64Column("path", []int64{1}))
+	c.Check(err, check.ErrorMatches, `column 1 is "path", expected "path" of the same type`)
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(b []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func (p *parquetTestSuite) TestWriterError(c *check.C) {
+	w := parquet.NewWriter(failingWriter{})
+	err := w.WriteRowGroup(parquet.Int64Column("pid", []int64{1}))
+	c.Check(err, check.ErrorMatches, "disk full")
+	c.Check(w.Close(), check.ErrorMatches, "disk full")
+}
+
+func (p *parquetTestSuite) TestWriteMismatchedColumns(c *check.C) {
+	var buf bytes.Buffer
+	err := parquet.Write(&buf,
+		parquet.Int64Column("pid", []int64{42, 43}),
+		parquet.StringColumn("path", []string{"/etc/hosts"}),
+	)
+	c.Assert(err, check.ErrorMatches, `column "path" has 1 values, expected 2`)
+
+	err = parquet.Write(&buf)
+	c.Assert(err, check.ErrorMatches, "cannot write parquet file without columns")
+
+	c.Check(parquet.NewWriter(&buf).Close(), check.ErrorMatches, "cannot write parquet file without columns")
+}
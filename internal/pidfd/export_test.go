@@ -0,0 +1,32 @@
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package pidfd
+
+// MockNoPidfd makes the pidfd syscalls fail like on kernels without them.
+func MockNoPidfd() (restore func()) {
+	oldOpen, oldSend := sysPidfdOpen, sysPidfdSendSignal
+	// syscall numbers no kernel has
+	sysPidfdOpen, sysPidfdSendSignal = 100000, 100001
+	return func() {
+		sysPidfdOpen, sysPidfdSendSignal = oldOpen, oldSend
+	}
+}
+
+func (p *Process) Fd() int {
+	return p.fd
+}
@@ -0,0 +1,91 @@
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package pidfd signals processes through pidfds, which refer to a process
+// rather than to its pid, so that a process which exited is never mistaken
+// for a new one which got the same pid.
+package pidfd
+
+import (
+	"syscall"
+)
+
+// the syscalls were added after the syscall package was frozen, they have the
+// same numbers on all architectures and can be mocked to test kernels without
+// them
+var (
+	sysPidfdOpen       uintptr = 434
+	sysPidfdSendSignal uintptr = 424
+)
+
+// Process is a process referred to by a pidfd
+type Process struct {
+	Pid int
+	// fd is the pidfd of the process, or -1 if the kernel doesn't support
+	// pidfds
+	fd int
+}
+
+// Open returns the process with the given pid, which it keeps referring to
+// after it exited. It fails with syscall.ESRCH if the process doesn't exist.
+// On kernels before 5.3 without pidfds, the process is referred to by its pid,
+// which may be reused.
+func Open(pid int) (*Process, error) {
+	fd, _, errno := syscall.Syscall(sysPidfdOpen, uintptr(pid), 0, 0)
+	switch errno {
+	case 0:
+		// pidfds are always close-on-exec
+		return &Process{Pid: pid, fd: int(fd)}, nil
+	case syscall.ENOSYS:
+		// check that the process exists like pidfd_open() does
+		if err := syscall.Kill(pid, 0); err == syscall.ESRCH {
+			return nil, err
+		}
+		return &Process{Pid: pid, fd: -1}, nil
+	}
+	return nil, errno
+}
+
+// Signal sends the signal to the process. It fails with syscall.ESRCH if the
+// process exited, even if another process got its pid since.
+func (p *Process) Signal(sig syscall.Signal) error {
+	if p.fd == -1 {
+		return syscall.Kill(p.Pid, sig)
+	}
+	_, _, errno := syscall.Syscall6(sysPidfdSendSignal, uintptr(p.fd), uintptr(sig), 0, 0, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// Kill kills the process right away, a process which exited already is not an
+// error.
+func (p *Process) Kill() error {
+	if err := p.Signal(syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+		return err
+	}
+	return nil
+}
+
+// Close releases the pidfd of the process.
+func (p *Process) Close() error {
+	if p.fd == -1 {
+		return nil
+	}
+	return syscall.Close(p.fd)
+}
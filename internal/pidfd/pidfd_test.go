@@ -0,0 +1,76 @@
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package pidfd_test
+
+import (
+	"os/exec"
+	"syscall"
+	"testing"
+
+	"github.com/anonymouse64/etrace/internal/pidfd"
+
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type pidfdTestSuite struct{}
+
+var _ = check.Suite(&pidfdTestSuite{})
+
+func (s *pidfdTestSuite) testKill(c *check.C) {
+	cmd := exec.Command("sleep", "60")
+	c.Assert(cmd.Start(), check.IsNil)
+	proc, err := pidfd.Open(cmd.Process.Pid)
+	c.Assert(err, check.IsNil)
+	defer proc.Close()
+	c.Check(proc.Pid, check.Equals, cmd.Process.Pid)
+
+	c.Assert(proc.Kill(), check.IsNil)
+	err = cmd.Wait()
+	c.Assert(err, check.NotNil)
+	status := cmd.ProcessState.Sys().(syscall.WaitStatus)
+	c.Check(status.Signal(), check.Equals, syscall.SIGKILL)
+
+	// the process was reaped
+	c.Check(proc.Kill(), check.IsNil)
+	c.Check(proc.Signal(syscall.SIGTERM), check.Equals, syscall.ESRCH)
+	_, err = pidfd.Open(cmd.Process.Pid)
+	c.Check(err, check.Equals, syscall.ESRCH)
+}
+
+func (s *pidfdTestSuite) TestKill(c *check.C) {
+	proc, err := pidfd.Open(syscall.Getpid())
+	c.Assert(err, check.IsNil)
+	if proc.Fd() == -1 {
+		c.Skip("the kernel doesn't support pidfds")
+	}
+	c.Check(proc.Close(), check.IsNil)
+	s.testKill(c)
+}
+
+func (s *pidfdTestSuite) TestKillWithoutPidfd(c *check.C) {
+	restore := pidfd.MockNoPidfd()
+	defer restore()
+
+	proc, err := pidfd.Open(syscall.Getpid())
+	c.Assert(err, check.IsNil)
+	c.Check(proc.Fd(), check.Equals, -1)
+	c.Check(proc.Close(), check.IsNil)
+	s.testKill(c)
+}
@@ -0,0 +1,141 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package plugins
+
+import (
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/anonymouse64/etrace/internal/schema"
+	"github.com/anonymouse64/etrace/internal/strace"
+)
+
+type kind struct {
+	name string
+	// dirRE matches paths inside of the plugin directories
+	dirRE *regexp.Regexp
+	// cacheName and cacheRE describe the cache which avoids scanning the
+	// plugin directories, if there is one
+	cacheName string
+	cacheRE   *regexp.Regexp
+	// scanner is the program executed to rebuild the cache, if there is one
+	scanner string
+}
+
+var kinds = []kind{
+	{
+		name:  "qt-plugins",
+		dirRE: regexp.MustCompile(`/qt[56]/plugins/|/plugins/(platforms|imageformats|platforminputcontexts|platformthemes|xcbglintegrations)/`),
+	},
+	{
+		name:      "gtk-modules",
+		dirRE:     regexp.MustCompile(`/gtk-[234]\.0/(modules|[0-9.]+/immodules)/`),
+		cacheName: "immodules.cache",
+		cacheRE:   regexp.MustCompile(`/immodules\.cache$`),
+	},
+	{
+		name:      "gio-modules",
+		dirRE:     regexp.MustCompile(`/gio/modules/`),
+		cacheName: "giomodule.cache",
+		cacheRE:   regexp.MustCompile(`/giomodule\.cache$`),
+	},
+	{
+		name:      "gdk-pixbuf-loaders",
+		dirRE:     regexp.MustCompile(`/gdk-pixbuf-2\.0/[0-9.]+/loaders/`),
+		cacheName: "loaders.cache",
+		cacheRE:   regexp.MustCompile(`/gdk-pixbuf-2\.0/[0-9.]+/loaders\.cache$`),
+	},
+	{
+		name:      "gstreamer-plugins",
+		dirRE:     regexp.MustCompile(`/lib/(.*/)?gstreamer-1\.0/`),
+		cacheName: "gstreamer registry",
+		cacheRE:   regexp.MustCompile(`/gstreamer-1\.0/registry\.[^/]+\.bin$`),
+		scanner:   "gst-plugin-scanner",
+	},
+}
+
+// Scan is the cost of scanning a single kind of plugin directory
+type Scan struct {
+	// Kind is the kind of plugins, i.e. qt-plugins or gstreamer-plugins
+	Kind string
+	// Start and End are the span of time during which the plugin directories
+	// were accessed, relative to the start of the trace
+	Start    time.Duration
+	End      time.Duration
+	Accesses int
+	// Files is the number of unique paths accessed in the plugin directories
+	Files int
+	// Cache is the name of the cache which avoids scanning the plugin
+	// directories, it is empty if there is no such cache
+	Cache string `json:",omitempty"`
+	// CachePresent is whether the cache was accessed
+	CachePresent bool `json:",omitempty"`
+	// Rebuilt is whether the cache was rebuilt by executing a scanner
+	Rebuilt bool `json:",omitempty"`
+}
+
+// Structured returns the scan as encoded since version 2 of the schema.
+func (s Scan) Structured() interface{} {
+	type plain Scan
+	return struct {
+		plain
+		Start schema.Duration
+		End   schema.Duration
+	}{plain(s), schema.NewDuration(s.Start), schema.NewDuration(s.End)}
+}
+
+// Scans detects the scanning of Qt, GTK, GIO, gdk-pixbuf and GStreamer plugin
+// directories and returns the cost of each kind of scan that happened, as well
+// as whether the caches that avoid these scans were present.
+func Scans(e *strace.ExecvePaths) []Scan {
+	var scans []Scan
+	for _, k := range kinds {
+		isPlugin := func(path string) bool {
+			return k.dirRE.MatchString(path) && (k.cacheRE == nil || !k.cacheRE.MatchString(path))
+		}
+		phase := e.AccessPhase(isPlugin)
+		if phase == nil {
+			continue
+		}
+		scan := Scan{
+			Kind:     k.name,
+			Start:    phase.Start,
+			End:      phase.End,
+			Accesses: phase.Accesses,
+			Cache:    k.cacheName,
+		}
+		files := make(map[string]bool)
+		for _, proc := range e.Processes {
+			if k.scanner != "" && filepath.Base(proc.Exe) == k.scanner {
+				scan.Rebuilt = true
+			}
+			for _, access := range proc.PathAccesses {
+				switch {
+				case isPlugin(access.Path):
+					files[access.Path] = true
+				case k.cacheRE != nil && k.cacheRE.MatchString(access.Path):
+					scan.CachePresent = true
+				}
+			}
+		}
+		scan.Files = len(files)
+		scans = append(scans, scan)
+	}
+	return scans
+}
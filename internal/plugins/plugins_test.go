@@ -0,0 +1,92 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package plugins_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/anonymouse64/etrace/internal/plugins"
+	"github.com/anonymouse64/etrace/internal/strace"
+
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type pluginsTestSuite struct{}
+
+var _ = check.Suite(&pluginsTestSuite{})
+
+func (p *pluginsTestSuite) TestScans(c *check.C) {
+	start := time.Unix(1000, 0)
+	at := func(ms int) time.Time { return start.Add(time.Duration(ms) * time.Millisecond) }
+	lib := "/snap/foo/1/usr/lib/x86_64-linux-gnu"
+	e := &strace.ExecvePaths{
+		Start: start,
+		Processes: []strace.ProcessRuntime{
+			{
+				Exe: "/snap/foo/1/usr/bin/foo",
+				PathAccesses: []strace.PathAccess{
+					{Time: at(10), Path: lib + "/qt5/plugins/platforms"},
+					{Time: at(12), Path: lib + "/qt5/plugins/platforms/libqxcb.so"},
+					{Time: at(20), Path: lib + "/qt5/plugins/platforms/libqxcb.so"},
+					{Time: at(30), Path: lib + "/gdk-pixbuf-2.0/2.10.0/loaders.cache"},
+					{Time: at(31), Path: lib + "/gdk-pixbuf-2.0/2.10.0/loaders/libpixbufloader-png.so"},
+					{Time: at(40), Path: lib + "/gstreamer-1.0/libgstcoreelements.so"},
+					{Time: at(100), Path: lib + "/gstreamer-1.0/libgstvideo4linux2.so"},
+					{Time: at(110), Path: "/home/user/snap/foo/1/.cache/gstreamer-1.0/registry.x86_64.bin"},
+					{Time: at(120), Path: "/usr/share/icons/index.theme"},
+				},
+			},
+			{
+				Exe: lib + "/gstreamer1.0/gstreamer-1.0/gst-plugin-scanner",
+			},
+		},
+	}
+	c.Assert(plugins.Scans(e), check.DeepEquals, []plugins.Scan{
+		{
+			Kind:     "qt-plugins",
+			Start:    10 * time.Millisecond,
+			End:      20 * time.Millisecond,
+			Accesses: 3,
+			Files:    2,
+		},
+		{
+			Kind:         "gdk-pixbuf-loaders",
+			Start:        31 * time.Millisecond,
+			End:          31 * time.Millisecond,
+			Accesses:     1,
+			Files:        1,
+			Cache:        "loaders.cache",
+			CachePresent: true,
+		},
+		{
+			Kind:         "gstreamer-plugins",
+			Start:        40 * time.Millisecond,
+			End:          100 * time.Millisecond,
+			Accesses:     2,
+			Files:        2,
+			Cache:        "gstreamer registry",
+			CachePresent: true,
+			Rebuilt:      true,
+		},
+	})
+
+	c.Assert(plugins.Scans(&strace.ExecvePaths{}), check.IsNil)
+}
@@ -0,0 +1,383 @@
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package proccon builds exec timings from the fork, exec and exit events of
+// the kernel's process events connector, which doesn't use ptrace at all and
+// so works for programs that misbehave under strace.
+package proccon
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/anonymouse64/etrace/internal/strace"
+)
+
+// constants from linux/connector.h and linux/cn_proc.h
+const (
+	netlinkConnector  = 11
+	cnIdxProc         = 1
+	cnValProc         = 1
+	procCnMcastListen = 1
+	procCnMcastIgnore = 2
+
+	procEventFork = 0x00000001
+	procEventExec = 0x00000002
+	procEventExit = 0x80000000
+
+	nlmsgHdrLen = 16
+	cnMsgLen    = 20
+	// what, cpu and timestamp_ns come before the event data
+	procEventHdrLen = 16
+)
+
+var procRoot = "/proc"
+
+// EventKind is the kind of a process event
+type EventKind int
+
+const (
+	// EventFork is a new process or thread
+	EventFork EventKind = iota
+	// EventExec is a process executing a new program
+	EventExec
+	// EventExit is a process or thread exiting
+	EventExit
+)
+
+// Event is a single process event. For fork events, ParentTgid is the process
+// which forked.
+type Event struct {
+	Kind       EventKind
+	Time       time.Time
+	Pid        int
+	Tgid       int
+	ParentTgid int
+}
+
+// parseEvent parses a proc_event from the data of a connector message, the
+// timestamp of which is converted to a time with toTime. Events which are not
+// fork, exec or exit events are ignored and returned as nil.
+func parseEvent(data []byte, toTime func(ns uint64) time.Time) (*Event, error) {
+	if len(data) < procEventHdrLen {
+		return nil, fmt.Errorf("proc event too short: %d bytes", len(data))
+	}
+	what := binary.LittleEndian.Uint32(data[0:])
+	ts := binary.LittleEndian.Uint64(data[8:])
+	body := data[procEventHdrLen:]
+	u32 := func(i int) int {
+		return int(binary.LittleEndian.Uint32(body[4*i:]))
+	}
+	ev := &Event{Time: toTime(ts)}
+	switch what {
+	case procEventFork:
+		if len(body) < 16 {
+			return nil, fmt.Errorf("fork event too short: %d bytes", len(body))
+		}
+		ev.Kind = EventFork
+		ev.ParentTgid = u32(1)
+		ev.Pid = u32(2)
+		ev.Tgid = u32(3)
+	case procEventExec, procEventExit:
+		if len(body) < 8 {
+			return nil, fmt.Errorf("exec or exit event too short: %d bytes", len(body))
+		}
+		ev.Kind = EventExec
+		if what == procEventExit {
+			ev.Kind = EventExit
+		}
+		ev.Pid = u32(0)
+		ev.Tgid = u32(1)
+	default:
+		return nil, nil
+	}
+	return ev, nil
+}
+
+type exeStart struct {
+	start time.Time
+	exe   string
+	args  []string
+}
+
+// Tracker keeps track of the programs executed by a process and all of its
+// descendants from their process events
+type Tracker struct {
+	root     int
+	tracked  map[int]bool
+	parents  map[int]int
+	running  map[int]exeStart
+	runtimes []strace.ExeRuntime
+	start    time.Time
+	end      time.Time
+}
+
+// NewTracker returns a tracker of the process tree rooted at the given pid.
+func NewTracker(root int) *Tracker {
+	return &Tracker{
+		root:    root,
+		tracked: map[int]bool{root: true},
+		parents: make(map[int]int),
+		running: make(map[int]exeStart),
+	}
+}
+
+// readExe returns the program and arguments the process is executing.
+func readExe(pid int) (string, []string) {
+	dir := filepath.Join(procRoot, strconv.Itoa(pid))
+	exe, err := os.Readlink(filepath.Join(dir, "exe"))
+	if err != nil {
+		exe = ""
+	}
+	var args []string
+	if cmdline, err := ioutil.ReadFile(filepath.Join(dir, "cmdline")); err == nil {
+		args = strings.Split(strings.TrimSuffix(string(cmdline), "\x00"), "\x00")
+	}
+	if exe == "" && len(args) != 0 {
+		exe = args[0]
+	}
+	return exe, args
+}
+
+func (t *Tracker) finish(pid int, end time.Time) {
+	if rt, ok := t.running[pid]; ok {
+		t.runtimes = append(t.runtimes, strace.ExeRuntime{
+			Start:    rt.start,
+			Exe:      rt.exe,
+			Args:     rt.args,
+			TotalSec: end.Sub(rt.start),
+			Pid:      pid,
+			Parent:   t.parents[pid],
+		})
+		delete(t.running, pid)
+	}
+}
+
+// Handle updates the tracker with a process event.
+func (t *Tracker) Handle(ev *Event) {
+	switch ev.Kind {
+	case EventFork:
+		// only new processes are interesting, not new threads
+		if t.tracked[ev.ParentTgid] && ev.Pid == ev.Tgid {
+			t.tracked[ev.Tgid] = true
+			t.parents[ev.Tgid] = ev.ParentTgid
+		}
+		return
+	case EventExec:
+		if !t.tracked[ev.Tgid] {
+			return
+		}
+		if t.start.IsZero() {
+			t.start = ev.Time
+		}
+		// like with execve() under strace, the previous program of the
+		// process ends when it executes a new one
+		t.finish(ev.Tgid, ev.Time)
+		exe, args := readExe(ev.Tgid)
+		t.running[ev.Tgid] = exeStart{start: ev.Time, exe: exe, args: args}
+	case EventExit:
+		// threads exiting don't end the program
+		if !t.tracked[ev.Tgid] || ev.Pid != ev.Tgid {
+			return
+		}
+		t.finish(ev.Tgid, ev.Time)
+		delete(t.tracked, ev.Tgid)
+	}
+	t.end = ev.Time
+}
+
+// Done returns whether all tracked processes have exited.
+func (t *Tracker) Done() bool {
+	return len(t.tracked) == 0
+}
+
+// Timing returns the exec timings of all programs executed, programs which are
+// still running are counted as ending at the given time.
+func (t *Tracker) Timing(now time.Time) *strace.ExecveTiming {
+	for pid := range t.running {
+		t.finish(pid, now)
+		t.end = now
+	}
+	timing := &strace.ExecveTiming{ExeRuntimes: t.runtimes}
+	if !t.start.IsZero() {
+		timing.TotalTime = t.end.Sub(t.start)
+	}
+	return timing
+}
+
+// monotonicNow returns the current time of CLOCK_MONOTONIC, which is the clock
+// of the event timestamps.
+func monotonicNow() (uint64, error) {
+	var ts syscall.Timespec
+	const clockMonotonic = 1
+	if _, _, errno := syscall.Syscall(syscall.SYS_CLOCK_GETTIME, clockMonotonic, uintptr(unsafe.Pointer(&ts)), 0); errno != 0 {
+		return 0, errno
+	}
+	return uint64(ts.Nano()), nil
+}
+
+// Listener receives process events from the kernel
+type Listener struct {
+	fd      int
+	tracker *Tracker
+	// offset converts monotonic event timestamps to the wall clock
+	offset time.Time
+	stop   chan struct{}
+	exit   chan struct{}
+	// done is closed once all tracked processes have exited
+	done      chan struct{}
+	err       error
+	closeOnce sync.Once
+}
+
+// Listen subscribes to process events, which needs CAP_NET_ADMIN. Events
+// which happen after this are buffered until Start is called.
+func Listen() (*Listener, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, netlinkConnector)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open process events connector: %v", err)
+	}
+	addr := &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: cnIdxProc, Pid: uint32(os.Getpid())}
+	if err := syscall.Bind(fd, addr); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("cannot bind process events connector: %v", err)
+	}
+	// wake up the reader regularly to check if it should stop
+	tv := syscall.NsecToTimeval(int64(100 * time.Millisecond))
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	if err := sendOp(fd, procCnMcastListen); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("cannot subscribe to process events: %v", err)
+	}
+
+	mono, err := monotonicNow()
+	if err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	return &Listener{
+		fd:     fd,
+		offset: time.Now().Add(-time.Duration(mono)),
+		stop:   make(chan struct{}),
+		exit:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}, nil
+}
+
+// sendOp sends a multicast op to the process events connector.
+func sendOp(fd int, op uint32) error {
+	msg := make([]byte, nlmsgHdrLen+cnMsgLen+4)
+	binary.LittleEndian.PutUint32(msg[0:], uint32(len(msg)))
+	binary.LittleEndian.PutUint16(msg[4:], syscall.NLMSG_DONE)
+	binary.LittleEndian.PutUint32(msg[12:], uint32(os.Getpid()))
+	cn := msg[nlmsgHdrLen:]
+	binary.LittleEndian.PutUint32(cn[0:], cnIdxProc)
+	binary.LittleEndian.PutUint32(cn[4:], cnValProc)
+	binary.LittleEndian.PutUint16(cn[16:], 4)
+	binary.LittleEndian.PutUint32(cn[cnMsgLen:], op)
+	return syscall.Sendto(fd, msg, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK})
+}
+
+// Start starts tracking the process tree rooted at the given pid.
+func (l *Listener) Start(root int) {
+	l.tracker = NewTracker(root)
+	toTime := func(ns uint64) time.Time {
+		return l.offset.Add(time.Duration(ns))
+	}
+	go func() {
+		defer close(l.exit)
+		buf := make([]byte, os.Getpagesize())
+		for {
+			select {
+			case <-l.stop:
+				return
+			default:
+			}
+			n, _, err := syscall.Recvfrom(l.fd, buf, 0)
+			if err == syscall.EAGAIN || err == syscall.EINTR {
+				continue
+			}
+			if err != nil {
+				l.err = err
+				return
+			}
+			msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+			if err != nil {
+				l.err = err
+				return
+			}
+			for _, msg := range msgs {
+				if len(msg.Data) < cnMsgLen {
+					continue
+				}
+				ev, err := parseEvent(msg.Data[cnMsgLen:], toTime)
+				if err != nil {
+					l.err = err
+					return
+				}
+				if ev == nil {
+					continue
+				}
+				l.tracker.Handle(ev)
+				if l.tracker.Done() {
+					close(l.done)
+					return
+				}
+			}
+		}
+	}()
+}
+
+// Close stops listening without waiting for the tracked processes, it can be
+// called more than once.
+func (l *Listener) Close() {
+	l.closeOnce.Do(func() {
+		close(l.stop)
+		if l.tracker != nil {
+			<-l.exit
+		}
+		sendOp(l.fd, procCnMcastIgnore)
+		syscall.Close(l.fd)
+	})
+}
+
+// Stop waits up to the timeout for all the tracked processes to exit, stops
+// listening and returns the exec timings.
+func (l *Listener) Stop(timeout time.Duration) (*strace.ExecveTiming, error) {
+	select {
+	case <-l.done:
+	case <-l.exit:
+	case <-time.After(timeout):
+	}
+	l.Close()
+	if l.err != nil {
+		return nil, fmt.Errorf("cannot read process events: %v", l.err)
+	}
+	return l.tracker.Timing(time.Now()), nil
+}
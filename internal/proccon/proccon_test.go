@@ -0,0 +1,160 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package proccon_test
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/anonymouse64/etrace/internal/proccon"
+	"github.com/anonymouse64/etrace/internal/strace"
+
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type procconTestSuite struct {
+	procDir string
+	restore func()
+}
+
+var _ = check.Suite(&procconTestSuite{})
+
+func (p *procconTestSuite) SetUpTest(c *check.C) {
+	p.procDir = c.MkDir()
+	p.restore = proccon.MockProcRoot(p.procDir)
+}
+
+func (p *procconTestSuite) TearDownTest(c *check.C) {
+	p.restore()
+}
+
+func (p *procconTestSuite) mockProc(c *check.C, pid int, exe string, args ...string) {
+	dir := filepath.Join(p.procDir, fmt.Sprint(pid))
+	c.Assert(os.MkdirAll(dir, 0755), check.IsNil)
+	os.Remove(filepath.Join(dir, "exe"))
+	c.Assert(os.Symlink(exe, filepath.Join(dir, "exe")), check.IsNil)
+	cmdline := ""
+	for _, arg := range args {
+		cmdline += arg + "\x00"
+	}
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "cmdline"), []byte(cmdline), 0644), check.IsNil)
+}
+
+func event(what uint32, ts uint64, data ...uint32) []byte {
+	b := make([]byte, 16+4*len(data))
+	binary.LittleEndian.PutUint32(b[0:], what)
+	binary.LittleEndian.PutUint64(b[8:], ts)
+	for i, d := range data {
+		binary.LittleEndian.PutUint32(b[16+4*i:], d)
+	}
+	return b
+}
+
+var base = time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func toTime(ns uint64) time.Time {
+	return base.Add(time.Duration(ns))
+}
+
+func (p *procconTestSuite) TestParseEvent(c *check.C) {
+	tt := []struct {
+		data []byte
+		ev   *proccon.Event
+	}{
+		{
+			event(0x1, 10, 100, 100, 101, 101),
+			&proccon.Event{Kind: proccon.EventFork, Time: toTime(10), ParentTgid: 100, Pid: 101, Tgid: 101},
+		},
+		{
+			event(0x2, 20, 101, 101),
+			&proccon.Event{Kind: proccon.EventExec, Time: toTime(20), Pid: 101, Tgid: 101},
+		},
+		{
+			event(0x80000000, 30, 102, 101, 0, 17),
+			&proccon.Event{Kind: proccon.EventExit, Time: toTime(30), Pid: 102, Tgid: 101},
+		},
+		// uid change events are ignored
+		{event(0x4, 40, 101, 101, 0, 0), nil},
+	}
+	for _, t := range tt {
+		ev, err := proccon.ParseEvent(t.data, toTime)
+		c.Assert(err, check.IsNil)
+		c.Assert(ev, check.DeepEquals, t.ev)
+	}
+}
+
+func (p *procconTestSuite) TestParseEventTooShort(c *check.C) {
+	_, err := proccon.ParseEvent([]byte{1, 0, 0}, toTime)
+	c.Assert(err, check.ErrorMatches, "proc event too short: 3 bytes")
+
+	_, err = proccon.ParseEvent(event(0x1, 10, 100), toTime)
+	c.Assert(err, check.ErrorMatches, "fork event too short: 4 bytes")
+}
+
+func (p *procconTestSuite) TestTracker(c *check.C) {
+	at := func(ms int) time.Time {
+		return base.Add(time.Duration(ms) * time.Millisecond)
+	}
+	t := proccon.NewTracker(100)
+
+	p.mockProc(c, 100, "/bin/sh", "sh", "-c", "true")
+	t.Handle(&proccon.Event{Kind: proccon.EventExec, Time: at(0), Pid: 100, Tgid: 100})
+	// an unrelated process is ignored
+	p.mockProc(c, 200, "/bin/other", "other")
+	t.Handle(&proccon.Event{Kind: proccon.EventFork, Time: at(1), ParentTgid: 1, Pid: 200, Tgid: 200})
+	t.Handle(&proccon.Event{Kind: proccon.EventExec, Time: at(2), Pid: 200, Tgid: 200})
+	// a thread of the root doesn't add a process
+	t.Handle(&proccon.Event{Kind: proccon.EventFork, Time: at(3), ParentTgid: 100, Pid: 102, Tgid: 100})
+	t.Handle(&proccon.Event{Kind: proccon.EventExit, Time: at(4), Pid: 102, Tgid: 100})
+
+	t.Handle(&proccon.Event{Kind: proccon.EventFork, Time: at(5), ParentTgid: 100, Pid: 101, Tgid: 101})
+	p.mockProc(c, 101, "/usr/bin/true", "true")
+	t.Handle(&proccon.Event{Kind: proccon.EventExec, Time: at(10), Pid: 101, Tgid: 101})
+	t.Handle(&proccon.Event{Kind: proccon.EventExit, Time: at(30), Pid: 101, Tgid: 101})
+	c.Assert(t.Done(), check.Equals, false)
+
+	// the root executes a new program
+	p.mockProc(c, 100, "/usr/bin/sleep", "sleep", "1")
+	t.Handle(&proccon.Event{Kind: proccon.EventExec, Time: at(40), Pid: 100, Tgid: 100})
+
+	timing := t.Timing(at(100))
+	c.Assert(timing, check.DeepEquals, &strace.ExecveTiming{
+		TotalTime: 100 * time.Millisecond,
+		ExeRuntimes: []strace.ExeRuntime{
+			{Start: at(10), Exe: "/usr/bin/true", Args: []string{"true"}, TotalSec: 20 * time.Millisecond, Pid: 101, Parent: 100},
+			{Start: at(0), Exe: "/bin/sh", Args: []string{"sh", "-c", "true"}, TotalSec: 40 * time.Millisecond, Pid: 100},
+			{Start: at(40), Exe: "/usr/bin/sleep", Args: []string{"sleep", "1"}, TotalSec: 60 * time.Millisecond, Pid: 100},
+		},
+	})
+}
+
+func (p *procconTestSuite) TestTrackerDone(c *check.C) {
+	t := proccon.NewTracker(100)
+	t.Handle(&proccon.Event{Kind: proccon.EventFork, Time: base, ParentTgid: 100, Pid: 101, Tgid: 101})
+	t.Handle(&proccon.Event{Kind: proccon.EventExit, Time: base, Pid: 100, Tgid: 100})
+	c.Assert(t.Done(), check.Equals, false)
+	t.Handle(&proccon.Event{Kind: proccon.EventExit, Time: base, Pid: 101, Tgid: 101})
+	c.Assert(t.Done(), check.Equals, true)
+}
@@ -0,0 +1,84 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package proctree
+
+import "time"
+
+var ParseStat = parseStat
+
+func MockProcRoot(new string) (restore func()) {
+	old := procRoot
+	procRoot = new
+	return func() {
+		procRoot = old
+	}
+}
+
+func MockSampleInterval(new time.Duration) (restore func()) {
+	old := sampleInterval
+	sampleInterval = new
+	return func() {
+		sampleInterval = old
+	}
+}
+
+var (
+	ParseKeyValues = parseKeyValues
+	ReadUsage      = readUsage
+	SampleBetween  = sampleBetween
+)
+
+type Usage = usage
+
+func NewUsage(t time.Time, processes int, cpuTicks, read, write, pss uint64) *Usage {
+	return &usage{time: t, processes: processes, cpuTicks: cpuTicks, read: read, write: write, pss: pss}
+}
+
+var ParseSchedStat = parseSchedStat
+
+func MockReadyInterval(new time.Duration) (restore func()) {
+	old := readyInterval
+	readyInterval = new
+	return func() {
+		readyInterval = old
+	}
+}
+
+type UnixSocket = unixSocket
+
+func NewUnixSocket(name string, peer, queued uint32) UnixSocket {
+	return unixSocket{name: name, peer: peer, queued: queued}
+}
+
+var ParseUnixDiagMsg = parseUnixDiagMsg
+
+func MockUnixSockets(f func() (map[uint32]UnixSocket, error)) (restore func()) {
+	old := unixSockets
+	unixSockets = f
+	return func() {
+		unixSockets = old
+	}
+}
+
+func MockFreezeThread(f func(tid int) (thaw func() error, err error)) (restore func()) {
+	old := freezeThread
+	freezeThread = f
+	return func() {
+		freezeThread = old
+	}
+}
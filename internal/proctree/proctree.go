@@ -0,0 +1,294 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package proctree
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var procRoot = "/proc"
+
+// clockTicks is the number of clock ticks per second that the cpu times in
+// /proc/<pid>/stat are measured in, this is USER_HZ which is 100 on all
+// architectures that matter to us
+var clockTicks = 100.0
+
+// sampleInterval is how often the process tree is sampled while waiting for it
+// to become quiescent
+var sampleInterval = 100 * time.Millisecond
+
+// Process is a single process in a process tree
+type Process struct {
+	Pid  int
+	PPid int
+	Comm string
+	// CPUTicks is the user and system time of the process and all of its
+	// children that it waited on, in clock ticks
+	CPUTicks uint64
+	// StartTime is when the process started in clock ticks since boot,
+	// which tells apart processes which got the same pid
+	StartTime uint64
+}
+
+// CPUTime returns the user and system time of the process and all of its
+// children that it waited on.
+func (p Process) CPUTime() time.Duration {
+	return time.Duration(float64(p.CPUTicks) / clockTicks * float64(time.Second))
+}
+
+// Tree is a snapshot of a process and all of its descendants
+type Tree struct {
+	Time      time.Time
+	Processes []Process
+}
+
+// CPUTicks returns the total cpu time in clock ticks of all processes in the
+// tree.
+func (t *Tree) CPUTicks() uint64 {
+	total := uint64(0)
+	for _, p := range t.Processes {
+		total += p.CPUTicks
+	}
+	return total
+}
+
+// parseStat parses the contents of a /proc/<pid>/stat file
+func parseStat(stat string) (Process, error) {
+	// the comm field is in parens and may contain spaces and parens itself,
+	// so split around the last closing paren
+	lparen := strings.IndexByte(stat, '(')
+	rparen := strings.LastIndexByte(stat, ')')
+	if lparen == -1 || rparen == -1 || rparen < lparen {
+		return Process{}, fmt.Errorf("invalid stat format: %q", stat)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(stat[:lparen]))
+	if err != nil {
+		return Process{}, fmt.Errorf("invalid pid in stat: %v", err)
+	}
+	// fields after the comm start with the state, which is field 3
+	fields := strings.Fields(stat[rparen+1:])
+	if len(fields) < 20 {
+		return Process{}, fmt.Errorf("invalid stat format: not enough fields")
+	}
+	ppid, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return Process{}, fmt.Errorf("invalid ppid in stat: %v", err)
+	}
+	// utime, stime, cutime and cstime are fields 14 through 17
+	ticks := uint64(0)
+	for _, f := range fields[11:15] {
+		n, err := strconv.ParseInt(f, 10, 64)
+		if err != nil {
+			return Process{}, fmt.Errorf("invalid cpu time in stat: %v", err)
+		}
+		if n > 0 {
+			ticks += uint64(n)
+		}
+	}
+	// starttime is field 22
+	startTime, err := strconv.ParseUint(fields[19], 10, 64)
+	if err != nil {
+		return Process{}, fmt.Errorf("invalid start time in stat: %v", err)
+	}
+	return Process{
+		Pid:       pid,
+		PPid:      ppid,
+		Comm:      stat[lparen+1 : rparen],
+		CPUTicks:  ticks,
+		StartTime: startTime,
+	}, nil
+}
+
+// Stat returns the process with the given pid.
+func Stat(pid int) (Process, error) {
+	stat, err := ioutil.ReadFile(filepath.Join(procRoot, strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return Process{}, err
+	}
+	return parseStat(string(stat))
+}
+
+// Cmdline returns the arguments of the process with the given pid. Processes
+// which rewrite their arguments, like Chromium's zygote children, may have all
+// of them in a single argument separated by spaces.
+func Cmdline(pid int) ([]string, error) {
+	cmdline, err := ioutil.ReadFile(filepath.Join(procRoot, strconv.Itoa(pid), "cmdline"))
+	if err != nil {
+		return nil, err
+	}
+	cmdline = bytes.TrimRight(cmdline, "\x00")
+	if len(cmdline) == 0 {
+		// kernel threads and zombies have no arguments
+		return nil, nil
+	}
+	return strings.Split(string(cmdline), "\x00"), nil
+}
+
+// Snapshot returns the process with the given pid and all of its descendants.
+func Snapshot(root int) (*Tree, error) {
+	now := time.Now()
+	dirs, err := ioutil.ReadDir(procRoot)
+	if err != nil {
+		return nil, err
+	}
+	byPid := make(map[int]Process)
+	children := make(map[int][]int)
+	for _, dir := range dirs {
+		pid, err := strconv.Atoi(dir.Name())
+		if err != nil {
+			// not a process directory
+			continue
+		}
+		stat, err := ioutil.ReadFile(filepath.Join(procRoot, dir.Name(), "stat"))
+		if err != nil {
+			// the process may have exited since we listed the directory
+			continue
+		}
+		proc, err := parseStat(string(stat))
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse stat for pid %d: %v", pid, err)
+		}
+		byPid[pid] = proc
+		children[proc.PPid] = append(children[proc.PPid], pid)
+	}
+
+	rootProc, ok := byPid[root]
+	if !ok {
+		return nil, fmt.Errorf("process %d does not exist", root)
+	}
+	tree := &Tree{Time: now}
+	queue := []Process{rootProc}
+	for len(queue) != 0 {
+		proc := queue[0]
+		queue = queue[1:]
+		tree.Processes = append(tree.Processes, proc)
+		for _, child := range children[proc.Pid] {
+			queue = append(queue, byPid[child])
+		}
+	}
+	return tree, nil
+}
+
+// WithEnv returns the processes which have the given environment variable set
+// to the given value. Unlike the parent of a process, the environment is
+// inherited by all descendants, even ones which daemonized and were reparented.
+// Processes whose environment can't be read are skipped.
+func WithEnv(name, value string) ([]Process, error) {
+	dirs, err := ioutil.ReadDir(procRoot)
+	if err != nil {
+		return nil, err
+	}
+	want := []byte(name + "=" + value)
+	var procs []Process
+	for _, dir := range dirs {
+		if _, err := strconv.Atoi(dir.Name()); err != nil {
+			// not a process directory
+			continue
+		}
+		environ, err := ioutil.ReadFile(filepath.Join(procRoot, dir.Name(), "environ"))
+		if err != nil {
+			continue
+		}
+		found := false
+		for _, kv := range bytes.Split(environ, []byte{0}) {
+			if bytes.Equal(kv, want) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			continue
+		}
+		stat, err := ioutil.ReadFile(filepath.Join(procRoot, dir.Name(), "stat"))
+		if err != nil {
+			// the process exited since we read its environment
+			continue
+		}
+		proc, err := parseStat(string(stat))
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse stat for pid %s: %v", dir.Name(), err)
+		}
+		procs = append(procs, proc)
+	}
+	return procs, nil
+}
+
+// WaitQuiescent waits until the process tree rooted at the given pid has not
+// started any new processes or executed any new programs and has used less
+// than the given percentage of a single cpu for the whole duration of window.
+// It returns the time that the process tree became quiescent, which is the
+// start of that window.
+func WaitQuiescent(ctx context.Context, root int, window time.Duration, cpuPercent float64) (time.Time, error) {
+	// processes are identified by their pid and name, so that a process
+	// executing a new program is also noticed
+	seen := make(map[string]bool)
+	var lastNew time.Time
+	var samples []*Tree
+	for {
+		tree, err := Snapshot(root)
+		if err != nil {
+			return time.Time{}, err
+		}
+		for _, p := range tree.Processes {
+			key := fmt.Sprintf("%d/%s", p.Pid, p.Comm)
+			if !seen[key] {
+				seen[key] = true
+				lastNew = tree.Time
+			}
+		}
+		samples = append(samples, tree)
+
+		// find the latest sample at least window ago
+		idx := -1
+		for i, s := range samples {
+			if tree.Time.Sub(s.Time) < window {
+				break
+			}
+			idx = i
+		}
+		if idx != -1 {
+			from := samples[idx]
+			elapsed := tree.Time.Sub(from.Time).Seconds()
+			ticks := float64(0)
+			// the cpu time of processes which exited and weren't waited on is
+			// lost, so the total can go down
+			if now, then := tree.CPUTicks(), from.CPUTicks(); now > then {
+				ticks = float64(now - then)
+			}
+			usage := 100 * ticks / clockTicks / elapsed
+			if !from.Time.Before(lastNew) && usage < cpuPercent {
+				return from.Time, nil
+			}
+			// we don't need any samples before this one anymore
+			samples = samples[idx:]
+		}
+
+		select {
+		case <-ctx.Done():
+			return time.Time{}, ctx.Err()
+		case <-time.After(sampleInterval):
+		}
+	}
+}
@@ -0,0 +1,197 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package proctree_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/anonymouse64/etrace/internal/proctree"
+
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type proctreeTestSuite struct {
+	procDir string
+}
+
+var _ = check.Suite(&proctreeTestSuite{})
+
+func (p *proctreeTestSuite) SetUpTest(c *check.C) {
+	p.procDir = c.MkDir()
+}
+
+func (p *proctreeTestSuite) mockProc(c *check.C, pid, ppid int, comm string, utime int) {
+	dir := filepath.Join(p.procDir, fmt.Sprint(pid))
+	c.Assert(os.MkdirAll(dir, 0755), check.IsNil)
+	stat := fmt.Sprintf("%d (%s) S %d %d %d 0 -1 4194304 100 0 0 0 %d 2 0 0 20 0 1 0 100 0 0\n", pid, comm, ppid, pid, pid, utime)
+	// write atomically as the stat file may be read concurrently
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "stat.tmp"), []byte(stat), 0644), check.IsNil)
+	c.Assert(os.Rename(filepath.Join(dir, "stat.tmp"), filepath.Join(dir, "stat")), check.IsNil)
+}
+
+func (p *proctreeTestSuite) TestParseStat(c *check.C) {
+	proc, err := proctree.ParseStat("1234 (some (weird) prog) S 1 1234 1234 0 -1 4194304 100 0 0 0 10 5 3 2 20 0 1 0 100 0 0\n")
+	c.Assert(err, check.IsNil)
+	c.Assert(proc, check.Equals, proctree.Process{
+		Pid:       1234,
+		PPid:      1,
+		Comm:      "some (weird) prog",
+		CPUTicks:  20,
+		StartTime: 100,
+	})
+
+	_, err = proctree.ParseStat("1234 prog S 1")
+	c.Assert(err, check.ErrorMatches, "invalid stat format: .*")
+	_, err = proctree.ParseStat("1234 (prog) S 1")
+	c.Assert(err, check.ErrorMatches, "invalid stat format: not enough fields")
+}
+
+func (p *proctreeTestSuite) TestCPUTime(c *check.C) {
+	c.Check(proctree.Process{CPUTicks: 150}.CPUTime(), check.Equals, 1500*time.Millisecond)
+}
+
+func (p *proctreeTestSuite) TestCmdline(c *check.C) {
+	r := proctree.MockProcRoot(p.procDir)
+	defer r()
+
+	for pid, cmdline := range map[int]string{
+		10: "/opt/app/app\x00--type=zygote\x00",
+		11: "/opt/app/app --type=renderer --lang=en",
+		12: "",
+	} {
+		p.mockProc(c, pid, 1, "app", 1)
+		c.Assert(ioutil.WriteFile(filepath.Join(p.procDir, fmt.Sprint(pid), "cmdline"), []byte(cmdline), 0644), check.IsNil)
+	}
+
+	args, err := proctree.Cmdline(10)
+	c.Assert(err, check.IsNil)
+	c.Check(args, check.DeepEquals, []string{"/opt/app/app", "--type=zygote"})
+	args, err = proctree.Cmdline(11)
+	c.Assert(err, check.IsNil)
+	c.Check(args, check.DeepEquals, []string{"/opt/app/app --type=renderer --lang=en"})
+	args, err = proctree.Cmdline(12)
+	c.Assert(err, check.IsNil)
+	c.Check(args, check.IsNil)
+	_, err = proctree.Cmdline(13)
+	c.Check(err, check.NotNil)
+}
+
+func (p *proctreeTestSuite) TestSnapshot(c *check.C) {
+	r := proctree.MockProcRoot(p.procDir)
+	defer r()
+
+	p.mockProc(c, 1, 0, "init", 100)
+	p.mockProc(c, 10, 1, "app", 5)
+	p.mockProc(c, 11, 10, "helper", 3)
+	p.mockProc(c, 12, 11, "sub helper", 1)
+	p.mockProc(c, 20, 1, "unrelated", 50)
+	// not a process dir
+	c.Assert(os.MkdirAll(filepath.Join(p.procDir, "sys"), 0755), check.IsNil)
+
+	tree, err := proctree.Snapshot(10)
+	c.Assert(err, check.IsNil)
+	c.Assert(tree.Processes, check.HasLen, 3)
+	for i, comm := range []string{"app", "helper", "sub helper"} {
+		c.Check(tree.Processes[i].Comm, check.Equals, comm)
+	}
+	c.Assert(tree.CPUTicks(), check.Equals, uint64(2*3+5+3+1))
+
+	_, err = proctree.Snapshot(30)
+	c.Assert(err, check.ErrorMatches, "process 30 does not exist")
+}
+
+func (p *proctreeTestSuite) TestWithEnv(c *check.C) {
+	r := proctree.MockProcRoot(p.procDir)
+	defer r()
+
+	p.mockProc(c, 1, 0, "init", 100)
+	p.mockProc(c, 10, 1, "app", 5)
+	p.mockProc(c, 11, 1, "daemon", 3)
+	p.mockProc(c, 12, 1, "other run", 1)
+	p.mockProc(c, 13, 1, "exited", 1)
+	for pid, environ := range map[int]string{
+		10: "HOME=/root\x00ETRACE_RUN=1-0\x00",
+		11: "ETRACE_RUN=1-0\x00PATH=/usr/bin\x00",
+		12: "ETRACE_RUN=1-01\x00",
+	} {
+		c.Assert(ioutil.WriteFile(filepath.Join(p.procDir, fmt.Sprint(pid), "environ"), []byte(environ), 0644), check.IsNil)
+	}
+	c.Assert(os.Remove(filepath.Join(p.procDir, "13", "stat")), check.IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(p.procDir, "13", "environ"), []byte("ETRACE_RUN=1-0\x00"), 0644), check.IsNil)
+
+	procs, err := proctree.WithEnv("ETRACE_RUN", "1-0")
+	c.Assert(err, check.IsNil)
+	c.Assert(procs, check.HasLen, 2)
+	c.Check(procs[0].Comm, check.Equals, "app")
+	c.Check(procs[1].Comm, check.Equals, "daemon")
+}
+
+func (p *proctreeTestSuite) TestWaitQuiescent(c *check.C) {
+	r := proctree.MockProcRoot(p.procDir)
+	defer r()
+	r = proctree.MockSampleInterval(time.Millisecond)
+	defer r()
+
+	p.mockProc(c, 10, 1, "app", 5)
+
+	start := time.Now()
+	settled, err := proctree.WaitQuiescent(context.Background(), 10, 20*time.Millisecond, 5)
+	c.Assert(err, check.IsNil)
+	// nothing changed so the tree was quiescent from the first sample
+	c.Assert(settled.Sub(start) < 20*time.Millisecond, check.Equals, true)
+}
+
+func (p *proctreeTestSuite) TestWaitQuiescentBusy(c *check.C) {
+	r := proctree.MockProcRoot(p.procDir)
+	defer r()
+	r = proctree.MockSampleInterval(time.Millisecond)
+	defer r()
+
+	p.mockProc(c, 10, 1, "app", 0)
+
+	// keep the process tree busy by adding cpu time and new children
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 1; ; i++ {
+			select {
+			case <-stop:
+				return
+			case <-time.After(2 * time.Millisecond):
+			}
+			p.mockProc(c, 10, 1, "app", i*100)
+			p.mockProc(c, 10+i, 10, "child", 0)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := proctree.WaitQuiescent(ctx, 10, 20*time.Millisecond, 5)
+	close(stop)
+	<-done
+	c.Assert(err, check.Equals, context.DeadlineExceeded)
+}
@@ -0,0 +1,241 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+package proctree
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// readyInterval is how often the main thread is sampled while waiting for it
+// to be ready for input, which only reads two small files of /proc
+var readyInterval = 10 * time.Millisecond
+
+// eventWaits are the kernel functions a thread sleeps in while it waits for
+// events with poll, epoll or select, which is what the main loops of toolkits
+// do when they have nothing else to do
+var eventWaits = map[string]bool{
+	"do_epoll_wait":         true,
+	"ep_poll":               true,
+	"do_sys_poll":           true,
+	"do_poll":               true,
+	"poll_schedule_timeout": true,
+	"do_select":             true,
+	"core_sys_select":       true,
+}
+
+// waitingForEvents returns whether the main thread of the process is sleeping
+// while waiting for events.
+func waitingForEvents(pid int) (bool, error) {
+	taskDir := filepath.Join(procRoot, strconv.Itoa(pid), "task", strconv.Itoa(pid))
+	stat, err := ioutil.ReadFile(filepath.Join(taskDir, "stat"))
+	if err != nil {
+		return false, err
+	}
+	// the state is the first field after the comm
+	rparen := strings.LastIndexByte(string(stat), ')')
+	if rparen == -1 {
+		return false, fmt.Errorf("invalid stat format: %q", stat)
+	}
+	fields := strings.Fields(string(stat[rparen+1:]))
+	if len(fields) == 0 {
+		return false, fmt.Errorf("invalid stat format: %q", stat)
+	}
+	if fields[0] != "S" {
+		return false, nil
+	}
+	wchan, err := ioutil.ReadFile(filepath.Join(taskDir, "wchan"))
+	if err != nil {
+		return false, err
+	}
+	return eventWaits[strings.TrimSpace(string(wchan))], nil
+}
+
+// WaitInputReady waits until the main thread of the process with the given pid
+// has been waiting for events for the whole duration of window, when its main
+// loop would handle input right away. It returns the time that the thread
+// started waiting, which is accurate to how often it is sampled.
+func WaitInputReady(ctx context.Context, pid int, window time.Duration) (time.Time, error) {
+	var since time.Time
+	for {
+		now := time.Now()
+		waiting, err := waitingForEvents(pid)
+		if err != nil {
+			return time.Time{}, err
+		}
+		switch {
+		case !waiting:
+			since = time.Time{}
+		case since.IsZero():
+			since = now
+		}
+		if !since.IsZero() && now.Sub(since) >= window {
+			return since, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return time.Time{}, ctx.Err()
+		case <-time.After(readyInterval):
+		}
+	}
+}
+
+// ptrace requests missing from the syscall package
+const (
+	ptraceSeize     = 0x4206
+	ptraceInterrupt = 0x4207
+)
+
+func ptrace(request, tid int, data uintptr) error {
+	_, _, errno := syscall.Syscall6(syscall.SYS_PTRACE, uintptr(request), uintptr(tid), 0, data, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// freezeThread stops the thread with the given tid with ptrace, which unlike
+// SIGSTOP doesn't stop the other threads of its process nor notify its
+// parent, and returns a function resuming it.
+var freezeThread = func(tid int) (thaw func() error, err error) {
+	stopped := make(chan error)
+	resume := make(chan struct{})
+	resumed := make(chan error)
+	go func() {
+		// all the ptrace requests must come from the thread which attached
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+		if err := ptrace(ptraceSeize, tid, 0); err != nil {
+			stopped <- err
+			return
+		}
+		var status syscall.WaitStatus
+		err := ptrace(ptraceInterrupt, tid, 0)
+		if err == nil {
+			_, err = syscall.Wait4(tid, &status, syscall.WALL, nil)
+			for err == syscall.EINTR {
+				_, err = syscall.Wait4(tid, &status, syscall.WALL, nil)
+			}
+		}
+		if err == nil && !status.Stopped() {
+			err = fmt.Errorf("thread exited")
+		}
+		if err != nil {
+			ptrace(syscall.PTRACE_DETACH, tid, 0)
+			stopped <- err
+			return
+		}
+		// the thread may have stopped for a signal before it was
+		// interrupted, which must still be delivered
+		var sig syscall.Signal
+		if status.StopSignal() != syscall.SIGTRAP {
+			sig = status.StopSignal()
+		}
+		stopped <- nil
+		<-resume
+		resumed <- ptrace(syscall.PTRACE_DETACH, tid, uintptr(sig))
+	}()
+	if err := <-stopped; err != nil {
+		return nil, err
+	}
+	return func() error {
+		close(resume)
+		return <-resumed
+	}, nil
+}
+
+// ProbeInput checks that the main thread of the process with the given pid
+// handles the input sent by press, and returns when it did. The main thread is
+// stopped while the input is sent, so that the input is seen waiting to be
+// read from the connection of the process to the display server, and once it
+// is resumed the input was handled when nothing is left to read from the
+// connection and the thread waits for events again. The input must be sent to
+// a window of the process, and only the main thread may read from the
+// connection to the display server.
+func ProbeInput(ctx context.Context, pid int, press func() error) (time.Time, error) {
+	sockets, err := displaySockets(pid)
+	if err != nil {
+		return time.Time{}, err
+	}
+	thaw, err := freezeThread(pid)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("cannot stop the main thread of process %d: %v", pid, err)
+	}
+	frozen := true
+	defer func() {
+		if frozen {
+			thaw()
+		}
+	}()
+
+	before, err := queuedBytes(sockets)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if err := press(); err != nil {
+		return time.Time{}, err
+	}
+	for {
+		queued, err := queuedBytes(sockets)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if queued > before {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return time.Time{}, fmt.Errorf("input never reached the program: %w", ctx.Err())
+		case <-time.After(readyInterval):
+		}
+	}
+
+	frozen = false
+	if err := thaw(); err != nil {
+		return time.Time{}, fmt.Errorf("cannot resume the main thread of process %d: %v", pid, err)
+	}
+	for {
+		now := time.Now()
+		queued, err := queuedBytes(sockets)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if queued == 0 {
+			waiting, err := waitingForEvents(pid)
+			if err != nil {
+				return time.Time{}, err
+			}
+			if waiting {
+				return now, nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return time.Time{}, fmt.Errorf("input was not handled: %w", ctx.Err())
+		case <-time.After(readyInterval):
+		}
+	}
+}
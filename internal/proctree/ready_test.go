@@ -0,0 +1,244 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+package proctree_test
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"gopkg.in/check.v1"
+
+	"github.com/anonymouse64/etrace/internal/proctree"
+)
+
+func (p *proctreeTestSuite) mockMainThread(c *check.C, pid int, state, wchan string) {
+	dir := filepath.Join(p.procDir, fmt.Sprint(pid), "task", fmt.Sprint(pid))
+	c.Assert(os.MkdirAll(dir, 0755), check.IsNil)
+	stat := fmt.Sprintf("%d (app) %s 1 %d %d 0 -1 4194304 100 0 0 0 5 2 0 0 20 0 1 0 100 0 0\n", pid, state, pid, pid)
+	// write atomically as the files may be read concurrently
+	for name, content := range map[string]string{"stat": stat, "wchan": wchan} {
+		c.Assert(ioutil.WriteFile(filepath.Join(dir, name+".tmp"), []byte(content), 0644), check.IsNil)
+		c.Assert(os.Rename(filepath.Join(dir, name+".tmp"), filepath.Join(dir, name)), check.IsNil)
+	}
+}
+
+func (p *proctreeTestSuite) TestWaitInputReady(c *check.C) {
+	r := proctree.MockProcRoot(p.procDir)
+	defer r()
+	r = proctree.MockReadyInterval(time.Millisecond)
+	defer r()
+
+	// the main thread is busy at first, then sleeps in something else than
+	// its main loop, and then waits for events
+	p.mockMainThread(c, 10, "R", "0")
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		p.mockMainThread(c, 10, "S", "futex_wait_queue")
+		time.Sleep(10 * time.Millisecond)
+		p.mockMainThread(c, 10, "S", "do_epoll_wait")
+	}()
+
+	start := time.Now()
+	ready, err := proctree.WaitInputReady(context.Background(), 10, 20*time.Millisecond)
+	c.Assert(err, check.IsNil)
+	c.Check(ready.Sub(start) >= 20*time.Millisecond, check.Equals, true)
+	c.Check(time.Since(ready) >= 20*time.Millisecond, check.Equals, true)
+}
+
+func (p *proctreeTestSuite) TestWaitInputReadyBusy(c *check.C) {
+	r := proctree.MockProcRoot(p.procDir)
+	defer r()
+	r = proctree.MockReadyInterval(time.Millisecond)
+	defer r()
+
+	// the main thread keeps waking up from its main loop
+	p.mockMainThread(c, 10, "S", "do_sys_poll")
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			case <-time.After(5 * time.Millisecond):
+			}
+			if i%2 == 0 {
+				p.mockMainThread(c, 10, "R", "0")
+			} else {
+				p.mockMainThread(c, 10, "S", "do_sys_poll")
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := proctree.WaitInputReady(ctx, 10, 20*time.Millisecond)
+	close(stop)
+	<-done
+	c.Assert(err, check.Equals, context.DeadlineExceeded)
+
+	_, err = proctree.WaitInputReady(context.Background(), 20, 20*time.Millisecond)
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+}
+
+// mockDisplayConnection mocks the process with the given pid being connected
+// to the X server and to the session bus, and returns a function setting how
+// many bytes are waiting to be read from its connection to the X server.
+func (p *proctreeTestSuite) mockDisplayConnection(c *check.C, pid int) (setQueued func(uint32), restore func()) {
+	fdDir := filepath.Join(p.procDir, fmt.Sprint(pid), "fd")
+	c.Assert(os.MkdirAll(fdDir, 0755), check.IsNil)
+	for fd, target := range map[string]string{"3": "socket:[100]", "4": "socket:[200]", "5": "/dev/null"} {
+		c.Assert(os.Symlink(target, filepath.Join(fdDir, fd)), check.IsNil)
+	}
+
+	var mu sync.Mutex
+	var queued uint32
+	restore = proctree.MockUnixSockets(func() (map[uint32]proctree.UnixSocket, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return map[uint32]proctree.UnixSocket{
+			100: proctree.NewUnixSocket("", 101, queued),
+			101: proctree.NewUnixSocket("@/tmp/.X11-unix/X0", 100, 0),
+			200: proctree.NewUnixSocket("", 201, 0),
+			201: proctree.NewUnixSocket("/run/user/1000/bus", 200, 0),
+		}, nil
+	})
+	return func(n uint32) {
+		mu.Lock()
+		defer mu.Unlock()
+		queued = n
+	}, restore
+}
+
+func (p *proctreeTestSuite) TestProbeInput(c *check.C) {
+	r := proctree.MockProcRoot(p.procDir)
+	defer r()
+	r = proctree.MockReadyInterval(time.Millisecond)
+	defer r()
+	setQueued, r := p.mockDisplayConnection(c, 10)
+	defer r()
+
+	p.mockMainThread(c, 10, "S", "do_epoll_wait")
+	frozen := false
+	r = proctree.MockFreezeThread(func(tid int) (func() error, error) {
+		c.Check(tid, check.Equals, 10)
+		frozen = true
+		p.mockMainThread(c, 10, "t", "ptrace_stop")
+		return func() error {
+			frozen = false
+			// the main thread wakes up to read the key press, and then
+			// waits for events again
+			p.mockMainThread(c, 10, "R", "0")
+			go func() {
+				time.Sleep(10 * time.Millisecond)
+				setQueued(0)
+				p.mockMainThread(c, 10, "S", "do_epoll_wait")
+			}()
+			return nil
+		}, nil
+	})
+	defer r()
+
+	start := time.Now()
+	handled, err := proctree.ProbeInput(context.Background(), 10, func() error {
+		// the key press reaches the program while its main thread is
+		// stopped
+		c.Check(frozen, check.Equals, true)
+		setQueued(32)
+		return nil
+	})
+	c.Assert(err, check.IsNil)
+	c.Check(frozen, check.Equals, false)
+	c.Check(handled.Sub(start) >= 10*time.Millisecond, check.Equals, true)
+}
+
+func (p *proctreeTestSuite) TestProbeInputNotReceived(c *check.C) {
+	r := proctree.MockProcRoot(p.procDir)
+	defer r()
+	r = proctree.MockReadyInterval(time.Millisecond)
+	defer r()
+	_, r = p.mockDisplayConnection(c, 10)
+	defer r()
+
+	p.mockMainThread(c, 10, "S", "do_epoll_wait")
+	frozen := false
+	r = proctree.MockFreezeThread(func(tid int) (func() error, error) {
+		frozen = true
+		return func() error {
+			frozen = false
+			return nil
+		}, nil
+	})
+	defer r()
+
+	// waking up the main thread isn't enough, the key press must reach it
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := proctree.ProbeInput(ctx, 10, func() error { return nil })
+	c.Assert(err, check.ErrorMatches, "input never reached the program: context deadline exceeded")
+	c.Check(frozen, check.Equals, false)
+
+	_, err = proctree.ProbeInput(context.Background(), 10, func() error { return fmt.Errorf("cannot press") })
+	c.Assert(err, check.ErrorMatches, "cannot press")
+	c.Check(frozen, check.Equals, false)
+
+	// without a connection to the display server
+	c.Assert(os.Remove(filepath.Join(p.procDir, "10", "fd", "3")), check.IsNil)
+	_, err = proctree.ProbeInput(context.Background(), 10, func() error { return nil })
+	c.Assert(err, check.ErrorMatches, "cannot find the connection of process 10 to the display server")
+}
+
+func (p *proctreeTestSuite) TestParseUnixDiagMsg(c *check.C) {
+	msg := make([]byte, 16)
+	binary.LittleEndian.PutUint32(msg[4:], 100)
+	attr := func(typ uint16, value []byte) {
+		b := make([]byte, 4+len(value))
+		binary.LittleEndian.PutUint16(b[0:], uint16(len(b)))
+		binary.LittleEndian.PutUint16(b[2:], typ)
+		copy(b[4:], value)
+		for len(b)%4 != 0 {
+			b = append(b, 0)
+		}
+		msg = append(msg, b...)
+	}
+	u32 := func(vs ...uint32) []byte {
+		b := make([]byte, 4*len(vs))
+		for i, v := range vs {
+			binary.LittleEndian.PutUint32(b[4*i:], v)
+		}
+		return b
+	}
+	// the name of an abstract socket starts with a nul byte
+	attr(0, []byte("\x00/tmp/.X11-unix/X0"))
+	attr(2, u32(101))
+	attr(4, u32(32, 0))
+
+	ino, s, err := proctree.ParseUnixDiagMsg(msg)
+	c.Assert(err, check.IsNil)
+	c.Check(ino, check.Equals, uint32(100))
+	c.Check(s, check.Equals, proctree.NewUnixSocket("@/tmp/.X11-unix/X0", 101, 32))
+
+	_, _, err = proctree.ParseUnixDiagMsg(msg[:8])
+	c.Assert(err, check.ErrorMatches, "unix diag message too short")
+}
@@ -0,0 +1,205 @@
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package proctree
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/anonymouse64/etrace/internal/schema"
+)
+
+// Sample is the resource usage of a process tree over a single sampling
+// interval
+type Sample struct {
+	// Time is the end of the interval, relative to the start of the program
+	Time      time.Duration
+	Processes int
+	// CPUPercent is the cpu usage of the tree during the interval as a
+	// percentage of a single cpu
+	CPUPercent float64
+	// ReadBytes and WriteBytes are the bytes the tree caused to be read from
+	// or written to storage during the interval
+	ReadBytes  uint64
+	WriteBytes uint64
+	// PSSBytes is the proportional set size of the tree at the end of the
+	// interval, which doesn't count memory shared between the processes
+	// multiple times
+	PSSBytes uint64
+}
+
+// Structured returns the sample as encoded since version 2 of the schema.
+func (s Sample) Structured() interface{} {
+	type plain Sample
+	return struct {
+		plain
+		Time schema.Duration
+	}{plain(s), schema.NewDuration(s.Time)}
+}
+
+// usage is the cumulative resource usage of all processes in a tree
+type usage struct {
+	time      time.Time
+	processes int
+	cpuTicks  uint64
+	read      uint64
+	write     uint64
+	pss       uint64
+}
+
+// parseKeyValues parses the values of the given keys from a file with lines
+// like "key: value", like /proc/<pid>/io and /proc/<pid>/smaps_rollup. Values
+// with a kB unit are converted to bytes.
+func parseKeyValues(content []byte, keys ...string) map[string]uint64 {
+	want := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		want[k] = true
+	}
+	values := make(map[string]uint64, len(keys))
+	s := bufio.NewScanner(bytes.NewReader(content))
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		key := strings.TrimSuffix(fields[0], ":")
+		if !want[key] {
+			continue
+		}
+		v, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		if len(fields) > 2 && fields[2] == "kB" {
+			v *= 1024
+		}
+		values[key] = v
+	}
+	return values
+}
+
+// readUsage returns the resource usage of the process tree rooted at the given
+// pid. The io and memory usage of processes which can't be read, i.e. because
+// they are owned by another user, is not included.
+func readUsage(root int) (*usage, error) {
+	tree, err := Snapshot(root)
+	if err != nil {
+		return nil, err
+	}
+	u := &usage{
+		time:      tree.Time,
+		processes: len(tree.Processes),
+		cpuTicks:  tree.CPUTicks(),
+	}
+	for _, p := range tree.Processes {
+		dir := filepath.Join(procRoot, strconv.Itoa(p.Pid))
+		if io, err := ioutil.ReadFile(filepath.Join(dir, "io")); err == nil {
+			values := parseKeyValues(io, "read_bytes", "write_bytes")
+			u.read += values["read_bytes"]
+			u.write += values["write_bytes"]
+		}
+		if smaps, err := ioutil.ReadFile(filepath.Join(dir, "smaps_rollup")); err == nil {
+			u.pss += parseKeyValues(smaps, "Pss")["Pss"]
+		}
+	}
+	return u, nil
+}
+
+// delta returns the difference of two cumulative counters, which can go down
+// when processes exit
+func delta(now, then uint64) uint64 {
+	if now > then {
+		return now - then
+	}
+	return 0
+}
+
+// sampleBetween returns the sample for the interval between the two usages.
+func sampleBetween(start time.Time, prev, cur *usage) Sample {
+	s := Sample{
+		Time:       cur.time.Sub(start),
+		Processes:  cur.processes,
+		ReadBytes:  delta(cur.read, prev.read),
+		WriteBytes: delta(cur.write, prev.write),
+		PSSBytes:   cur.pss,
+	}
+	if elapsed := cur.time.Sub(prev.time).Seconds(); elapsed > 0 {
+		s.CPUPercent = 100 * float64(delta(cur.cpuTicks, prev.cpuTicks)) / clockTicks / elapsed
+	}
+	return s
+}
+
+// Sampler samples the resource usage of a process tree from /proc at a fixed
+// interval, which gives a coarse view of the cpu, io and memory phases of a
+// program without tracing it
+type Sampler struct {
+	root     int
+	interval time.Duration
+	samples  []Sample
+
+	stop chan struct{}
+	exit chan struct{}
+}
+
+// NewSampler returns a sampler of the process tree rooted at the given pid.
+func NewSampler(root int, interval time.Duration) *Sampler {
+	return &Sampler{
+		root:     root,
+		interval: interval,
+		stop:     make(chan struct{}),
+		exit:     make(chan struct{}),
+	}
+}
+
+// Start starts sampling, with times relative to the given start time. Sampling
+// stops by itself when the root process exits.
+func (s *Sampler) Start(start time.Time) {
+	go func() {
+		defer close(s.exit)
+		prev, err := readUsage(s.root)
+		if err != nil {
+			return
+		}
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-time.After(s.interval):
+			}
+			cur, err := readUsage(s.root)
+			if err != nil {
+				// the process exited
+				return
+			}
+			s.samples = append(s.samples, sampleBetween(start, prev, cur))
+			prev = cur
+		}
+	}()
+}
+
+// Stop stops sampling and returns all the samples.
+func (s *Sampler) Stop() []Sample {
+	close(s.stop)
+	<-s.exit
+	return s.samples
+}
@@ -0,0 +1,124 @@
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package proctree_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/anonymouse64/etrace/internal/proctree"
+
+	"gopkg.in/check.v1"
+)
+
+func (p *proctreeTestSuite) mockUsage(c *check.C, pid string, readBytes, pssKB int) {
+	dir := filepath.Join(p.procDir, pid)
+	io := "rchar: 5000\nwchar: 100\nread_bytes: " + strconv.Itoa(readBytes) + "\nwrite_bytes: 4096\ncancelled_write_bytes: 0\n"
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "io"), []byte(io), 0644), check.IsNil)
+	smaps := "55d0c6a4c000-7ffd8a5f3000 ---p 00000000 00:00 0                      [rollup]\nRss:               10000 kB\nPss:               " + strconv.Itoa(pssKB) + " kB\n"
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "smaps_rollup"), []byte(smaps), 0644), check.IsNil)
+}
+
+func (p *proctreeTestSuite) TestParseKeyValues(c *check.C) {
+	values := proctree.ParseKeyValues([]byte("Rss: 12 kB\nPss: 10 kB\nread_bytes: 4096\nbad: x\n"), "Pss", "read_bytes", "bad", "missing")
+	c.Assert(values, check.DeepEquals, map[string]uint64{
+		"Pss":        10 * 1024,
+		"read_bytes": 4096,
+	})
+}
+
+func (p *proctreeTestSuite) TestReadUsage(c *check.C) {
+	r := proctree.MockProcRoot(p.procDir)
+	defer r()
+
+	p.mockProc(c, 10, 1, "app", 5)
+	p.mockProc(c, 11, 10, "helper", 3)
+	p.mockUsage(c, "10", 8192, 100)
+	// the io and smaps of other users' processes can't be read
+	p.mockUsage(c, "11", 1, 1)
+	c.Assert(os.Remove(filepath.Join(p.procDir, "11", "io")), check.IsNil)
+	c.Assert(os.Remove(filepath.Join(p.procDir, "11", "smaps_rollup")), check.IsNil)
+
+	u, err := proctree.ReadUsage(10)
+	c.Assert(err, check.IsNil)
+	start := time.Now()
+	// check the fields through a sample from zero usage
+	s := proctree.SampleBetween(start, proctree.NewUsage(start, 0, 0, 0, 0, 0), u)
+	c.Assert(s.Processes, check.Equals, 2)
+	c.Assert(s.ReadBytes, check.Equals, uint64(8192))
+	c.Assert(s.WriteBytes, check.Equals, uint64(4096))
+	c.Assert(s.PSSBytes, check.Equals, uint64(100*1024))
+
+	_, err = proctree.ReadUsage(30)
+	c.Assert(err, check.ErrorMatches, "process 30 does not exist")
+}
+
+func (p *proctreeTestSuite) TestSampleBetween(c *check.C) {
+	start := time.Unix(1000, 0)
+	prev := proctree.NewUsage(start.Add(100*time.Millisecond), 2, 10, 4096, 0, 1024)
+	cur := proctree.NewUsage(start.Add(300*time.Millisecond), 3, 20, 8192, 0, 2048)
+	c.Assert(proctree.SampleBetween(start, prev, cur), check.Equals, proctree.Sample{
+		Time:       300 * time.Millisecond,
+		Processes:  3,
+		CPUPercent: 50,
+		ReadBytes:  4096,
+		PSSBytes:   2048,
+	})
+
+	// counters going down because processes exited don't wrap around
+	cur = proctree.NewUsage(start.Add(300*time.Millisecond), 1, 5, 0, 0, 512)
+	c.Assert(proctree.SampleBetween(start, prev, cur), check.Equals, proctree.Sample{
+		Time:      300 * time.Millisecond,
+		Processes: 1,
+		PSSBytes:  512,
+	})
+}
+
+func (p *proctreeTestSuite) TestSampler(c *check.C) {
+	r := proctree.MockProcRoot(p.procDir)
+	defer r()
+
+	p.mockProc(c, 10, 1, "app", 5)
+	p.mockUsage(c, "10", 0, 100)
+
+	s := proctree.NewSampler(10, time.Millisecond)
+	s.Start(time.Now())
+	time.Sleep(20 * time.Millisecond)
+	samples := s.Stop()
+	c.Assert(len(samples) > 0, check.Equals, true)
+	c.Assert(samples[0].Processes, check.Equals, 1)
+	c.Assert(samples[0].PSSBytes, check.Equals, uint64(100*1024))
+}
+
+func (p *proctreeTestSuite) TestSamplerProcessExits(c *check.C) {
+	r := proctree.MockProcRoot(p.procDir)
+	defer r()
+
+	p.mockProc(c, 10, 1, "app", 5)
+
+	s := proctree.NewSampler(10, time.Millisecond)
+	s.Start(time.Now())
+	time.Sleep(5 * time.Millisecond)
+	c.Assert(os.RemoveAll(filepath.Join(p.procDir, "10")), check.IsNil)
+	time.Sleep(5 * time.Millisecond)
+	// stopping after sampling stopped by itself is fine
+	s.Stop()
+}
@@ -0,0 +1,191 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package proctree
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/anonymouse64/etrace/internal/schema"
+)
+
+// SchedStat is the scheduling statistics of all the threads of a process tree,
+// as accounted by the kernel in /proc/<pid>/task/<tid>/schedstat
+type SchedStat struct {
+	Processes int
+	Threads   int
+	// RunTime is the time the threads spent running on a cpu
+	RunTime time.Duration
+	// WaitTime is the time the threads spent runnable on a run queue, waiting
+	// for a cpu to run on
+	WaitTime time.Duration
+	// Timeslices is the number of times the threads were scheduled to run
+	Timeslices uint64
+}
+
+// Structured returns the statistics as encoded since version 2 of the schema.
+func (s *SchedStat) Structured() interface{} {
+	type plain SchedStat
+	return struct {
+		plain
+		RunTime  schema.Duration
+		WaitTime schema.Duration
+	}{plain(*s), schema.NewDuration(s.RunTime), schema.NewDuration(s.WaitTime)}
+}
+
+// threadSchedStat is the cumulative scheduling statistics of a single thread
+type threadSchedStat struct {
+	pid        int
+	run        uint64
+	wait       uint64
+	timeslices uint64
+}
+
+// parseSchedStat parses the contents of a /proc/<pid>/task/<tid>/schedstat
+// file, which are the run time and wait time in nanoseconds and the number of
+// timeslices.
+func parseSchedStat(content string) (threadSchedStat, error) {
+	fields := strings.Fields(content)
+	if len(fields) != 3 {
+		return threadSchedStat{}, fmt.Errorf("invalid schedstat format: %q", content)
+	}
+	var values [3]uint64
+	for i, f := range fields {
+		v, err := strconv.ParseUint(f, 10, 64)
+		if err != nil {
+			return threadSchedStat{}, fmt.Errorf("invalid schedstat value: %v", err)
+		}
+		values[i] = v
+	}
+	return threadSchedStat{run: values[0], wait: values[1], timeslices: values[2]}, nil
+}
+
+// SchedSampler samples the scheduling statistics of the threads of a set of
+// processes at a fixed interval. The statistics of threads are gone once they
+// exit, so the last ones sampled are used for threads which exited in between.
+type SchedSampler struct {
+	pids     func() ([]int, error)
+	interval time.Duration
+	threads  map[int]threadSchedStat
+
+	stop chan struct{}
+	exit chan struct{}
+}
+
+// NewSchedSampler returns a sampler of the scheduling statistics of the
+// processes listed by pids before each sample.
+func NewSchedSampler(pids func() ([]int, error), interval time.Duration) *SchedSampler {
+	return &SchedSampler{
+		pids:     pids,
+		interval: interval,
+		threads:  make(map[int]threadSchedStat),
+		stop:     make(chan struct{}),
+		exit:     make(chan struct{}),
+	}
+}
+
+// TreePids returns a function listing the pids of the process tree rooted at
+// the given pid, which fails once the root process exited.
+func TreePids(root int) func() ([]int, error) {
+	return func() ([]int, error) {
+		tree, err := Snapshot(root)
+		if err != nil {
+			return nil, err
+		}
+		pids := make([]int, 0, len(tree.Processes))
+		for _, p := range tree.Processes {
+			pids = append(pids, p.Pid)
+		}
+		return pids, nil
+	}
+}
+
+// sample reads the statistics of all the threads of the processes, returning
+// false if they cannot be listed anymore.
+func (s *SchedSampler) sample() bool {
+	pids, err := s.pids()
+	if err != nil {
+		return false
+	}
+	for _, pid := range pids {
+		taskDir := filepath.Join(procRoot, strconv.Itoa(pid), "task")
+		tasks, err := ioutil.ReadDir(taskDir)
+		if err != nil {
+			// the process exited
+			continue
+		}
+		for _, task := range tasks {
+			tid, err := strconv.Atoi(task.Name())
+			if err != nil {
+				continue
+			}
+			content, err := ioutil.ReadFile(filepath.Join(taskDir, task.Name(), "schedstat"))
+			if err != nil {
+				continue
+			}
+			stat, err := parseSchedStat(string(content))
+			if err != nil {
+				continue
+			}
+			stat.pid = pid
+			s.threads[tid] = stat
+		}
+	}
+	return true
+}
+
+// Start starts sampling. Sampling stops by itself when the processes cannot be
+// listed anymore, like when the root of a tree exited.
+func (s *SchedSampler) Start() {
+	go func() {
+		defer close(s.exit)
+		for s.sample() {
+			select {
+			case <-s.stop:
+				// sample once more to count everything up to now
+				s.sample()
+				return
+			case <-time.After(s.interval):
+			}
+		}
+	}()
+}
+
+// Stop stops sampling and returns the scheduling statistics of the processes up
+// to now.
+func (s *SchedSampler) Stop() (*SchedStat, error) {
+	close(s.stop)
+	<-s.exit
+	if len(s.threads) == 0 {
+		return nil, fmt.Errorf("cannot read the scheduling statistics of any thread")
+	}
+	stat := &SchedStat{Threads: len(s.threads)}
+	pids := make(map[int]bool)
+	for _, t := range s.threads {
+		pids[t.pid] = true
+		stat.RunTime += time.Duration(t.run)
+		stat.WaitTime += time.Duration(t.wait)
+		stat.Timeslices += t.timeslices
+	}
+	stat.Processes = len(pids)
+	return stat, nil
+}
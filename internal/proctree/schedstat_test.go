@@ -0,0 +1,93 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package proctree_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/check.v1"
+
+	"github.com/anonymouse64/etrace/internal/proctree"
+)
+
+func (p *proctreeTestSuite) mockSchedStat(c *check.C, pid, tid int, run, wait, timeslices uint64) {
+	dir := filepath.Join(p.procDir, fmt.Sprint(pid), "task", fmt.Sprint(tid))
+	c.Assert(os.MkdirAll(dir, 0755), check.IsNil)
+	content := fmt.Sprintf("%d %d %d\n", run, wait, timeslices)
+	// write atomically as the schedstat file may be read concurrently
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "schedstat.tmp"), []byte(content), 0644), check.IsNil)
+	c.Assert(os.Rename(filepath.Join(dir, "schedstat.tmp"), filepath.Join(dir, "schedstat")), check.IsNil)
+}
+
+func (p *proctreeTestSuite) TestParseSchedStat(c *check.C) {
+	_, err := proctree.ParseSchedStat("1 2 3\n")
+	c.Assert(err, check.IsNil)
+
+	_, err = proctree.ParseSchedStat("1 2\n")
+	c.Assert(err, check.ErrorMatches, "invalid schedstat format: .*")
+	_, err = proctree.ParseSchedStat("1 two 3\n")
+	c.Assert(err, check.ErrorMatches, "invalid schedstat value: .*")
+}
+
+func (p *proctreeTestSuite) TestSchedSampler(c *check.C) {
+	r := proctree.MockProcRoot(p.procDir)
+	defer r()
+
+	p.mockProc(c, 10, 1, "app", 5)
+	p.mockSchedStat(c, 10, 10, 1000, 500, 3)
+	p.mockSchedStat(c, 10, 11, 2000, 100, 4)
+	p.mockProc(c, 12, 10, "helper", 1)
+	p.mockSchedStat(c, 12, 12, 3000, 400, 5)
+	// not part of the tree
+	p.mockProc(c, 20, 1, "other", 1)
+	p.mockSchedStat(c, 20, 20, 9000, 9000, 9)
+
+	s := proctree.NewSchedSampler(proctree.TreePids(10), time.Millisecond)
+	s.Start()
+	time.Sleep(10 * time.Millisecond)
+	// the statistics of the helper are still counted after it exited
+	c.Assert(os.RemoveAll(filepath.Join(p.procDir, "12")), check.IsNil)
+	p.mockSchedStat(c, 10, 10, 1500, 700, 4)
+	time.Sleep(10 * time.Millisecond)
+	stat, err := s.Stop()
+	c.Assert(err, check.IsNil)
+	c.Check(stat, check.DeepEquals, &proctree.SchedStat{
+		Processes:  2,
+		Threads:    3,
+		RunTime:    6500,
+		WaitTime:   1200,
+		Timeslices: 13,
+	})
+}
+
+func (p *proctreeTestSuite) TestSchedSamplerNoStats(c *check.C) {
+	r := proctree.MockProcRoot(p.procDir)
+	defer r()
+
+	p.mockProc(c, 10, 1, "app", 5)
+
+	s := proctree.NewSchedSampler(proctree.TreePids(10), time.Millisecond)
+	s.Start()
+	time.Sleep(5 * time.Millisecond)
+	_, err := s.Stop()
+	c.Assert(err, check.ErrorMatches, "cannot read the scheduling statistics of any thread")
+}
@@ -0,0 +1,217 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+package proctree
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// the sock_diag netlink protocol for unix sockets, see linux/sock_diag.h and
+// linux/unix_diag.h
+const (
+	// netlinkSockDiag is NETLINK_SOCK_DIAG, which is the same protocol as
+	// NETLINK_INET_DIAG
+	netlinkSockDiag  = syscall.NETLINK_INET_DIAG
+	sockDiagByFamily = 20
+	unixDiagReqLen   = 24
+	unixDiagMsgLen   = 16
+
+	udiagShowName  = 0x01
+	udiagShowPeer  = 0x04
+	udiagShowRQLen = 0x10
+
+	unixDiagName  = 0
+	unixDiagPeer  = 2
+	unixDiagRQLen = 4
+)
+
+// unixSocket is a unix socket as reported by sock_diag
+type unixSocket struct {
+	// name is the path the socket is bound to, or the one of the listening
+	// socket for the sockets it accepted, abstract names start with @
+	name string
+	// peer is the inode of the socket it is connected to
+	peer uint32
+	// queued is how many bytes are waiting to be read from the socket
+	queued uint32
+}
+
+// parseUnixDiagMsg parses a unix_diag_msg with its attributes and returns the
+// inode of the socket along with it.
+func parseUnixDiagMsg(data []byte) (uint32, unixSocket, error) {
+	if len(data) < unixDiagMsgLen {
+		return 0, unixSocket{}, fmt.Errorf("unix diag message too short")
+	}
+	ino := binary.LittleEndian.Uint32(data[4:])
+	var s unixSocket
+	attrs := data[unixDiagMsgLen:]
+	for len(attrs) >= syscall.SizeofRtAttr {
+		attrLen := int(binary.LittleEndian.Uint16(attrs[0:]))
+		if attrLen < syscall.SizeofRtAttr || attrLen > len(attrs) {
+			return 0, unixSocket{}, fmt.Errorf("invalid unix diag attribute length %d", attrLen)
+		}
+		value := attrs[syscall.SizeofRtAttr:attrLen]
+		switch binary.LittleEndian.Uint16(attrs[2:]) {
+		case unixDiagName:
+			name := string(value)
+			if strings.HasPrefix(name, "\x00") {
+				name = "@" + name[1:]
+			}
+			s.name = name
+		case unixDiagPeer:
+			if len(value) >= 4 {
+				s.peer = binary.LittleEndian.Uint32(value)
+			}
+		case unixDiagRQLen:
+			if len(value) >= 4 {
+				s.queued = binary.LittleEndian.Uint32(value)
+			}
+		}
+		// attributes are aligned to 4 bytes
+		next := (attrLen + syscall.RTA_ALIGNTO - 1) &^ (syscall.RTA_ALIGNTO - 1)
+		if next > len(attrs) {
+			break
+		}
+		attrs = attrs[next:]
+	}
+	return ino, s, nil
+}
+
+// unixSockets returns the unix sockets of the network namespace of etrace by
+// inode.
+var unixSockets = func() (map[uint32]unixSocket, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, netlinkSockDiag)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open socket diagnostics: %v", err)
+	}
+	defer syscall.Close(fd)
+
+	req := make([]byte, syscall.NLMSG_HDRLEN+unixDiagReqLen)
+	binary.LittleEndian.PutUint32(req[0:], uint32(len(req)))
+	binary.LittleEndian.PutUint16(req[4:], sockDiagByFamily)
+	binary.LittleEndian.PutUint16(req[6:], syscall.NLM_F_REQUEST|syscall.NLM_F_DUMP)
+	diag := req[syscall.NLMSG_HDRLEN:]
+	diag[0] = syscall.AF_UNIX
+	// all the states
+	binary.LittleEndian.PutUint32(diag[4:], ^uint32(0))
+	binary.LittleEndian.PutUint32(diag[12:], udiagShowName|udiagShowPeer|udiagShowRQLen)
+	if err := syscall.Sendto(fd, req, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return nil, fmt.Errorf("cannot list unix sockets: %v", err)
+	}
+
+	sockets := make(map[uint32]unixSocket)
+	buf := make([]byte, 8*os.Getpagesize())
+	for {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot list unix sockets: %v", err)
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return nil, fmt.Errorf("cannot list unix sockets: %v", err)
+		}
+		for _, msg := range msgs {
+			switch msg.Header.Type {
+			case syscall.NLMSG_DONE:
+				return sockets, nil
+			case syscall.NLMSG_ERROR:
+				if len(msg.Data) >= 4 {
+					err = syscall.Errno(-int32(binary.LittleEndian.Uint32(msg.Data)))
+				}
+				return nil, fmt.Errorf("cannot list unix sockets: %v", err)
+			}
+			ino, s, err := parseUnixDiagMsg(msg.Data)
+			if err != nil {
+				return nil, fmt.Errorf("cannot list unix sockets: %v", err)
+			}
+			sockets[ino] = s
+		}
+	}
+}
+
+// isDisplayServer returns whether the socket name is the one of an X11 or a
+// Wayland display server.
+func isDisplayServer(name string) bool {
+	name = strings.TrimPrefix(name, "@")
+	return strings.HasPrefix(name, "/tmp/.X11-unix/X") || strings.HasPrefix(filepath.Base(name), "wayland-")
+}
+
+// displaySockets returns the inodes of the sockets of the process with the
+// given pid which are connected to an X11 or a Wayland display server, which
+// is where its input events come from.
+func displaySockets(pid int) ([]uint32, error) {
+	fdDir := filepath.Join(procRoot, strconv.Itoa(pid), "fd")
+	fds, err := ioutil.ReadDir(fdDir)
+	if err != nil {
+		return nil, err
+	}
+	sockets, err := unixSockets()
+	if err != nil {
+		return nil, err
+	}
+	var inodes []uint32
+	for _, fd := range fds {
+		target, err := os.Readlink(filepath.Join(fdDir, fd.Name()))
+		if err != nil || !strings.HasPrefix(target, "socket:[") {
+			// the fd was closed since it was listed or isn't a socket
+			continue
+		}
+		ino, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(target, "socket:["), "]"), 10, 32)
+		if err != nil {
+			continue
+		}
+		s, ok := sockets[uint32(ino)]
+		if !ok || s.peer == 0 {
+			continue
+		}
+		if peer, ok := sockets[s.peer]; ok && isDisplayServer(peer.name) {
+			inodes = append(inodes, uint32(ino))
+		}
+	}
+	if len(inodes) == 0 {
+		return nil, fmt.Errorf("cannot find the connection of process %d to the display server", pid)
+	}
+	return inodes, nil
+}
+
+// queuedBytes returns how many bytes are waiting to be read from the sockets
+// with the given inodes.
+func queuedBytes(inodes []uint32) (uint64, error) {
+	sockets, err := unixSockets()
+	if err != nil {
+		return 0, err
+	}
+	var queued uint64
+	for _, ino := range inodes {
+		s, ok := sockets[ino]
+		if !ok {
+			return 0, fmt.Errorf("connection to the display server was closed")
+		}
+		queued += uint64(s.queued)
+	}
+	return queued, nil
+}
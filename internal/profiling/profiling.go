@@ -19,10 +19,15 @@ package profiling
 
 import (
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"time"
+
+	"github.com/anonymouse64/etrace/internal/schema"
 )
 
 // helper function to make testing easier
@@ -49,6 +54,65 @@ func FreeCaches() error {
 	return nil
 }
 
+// CachePriming is what was read into the page cache before a run
+type CachePriming struct {
+	Files int
+	Bytes int64
+	Time  time.Duration
+}
+
+// Structured returns the cache priming as encoded since version 2 of the
+// schema.
+func (p *CachePriming) Structured() interface{} {
+	type plain CachePriming
+	return struct {
+		plain
+		Time schema.Duration
+	}{plain(*p), schema.NewDuration(p.Time)}
+}
+
+// PrimeCaches reads the given files into the page cache, like vmtouch does, so
+// that every run starts with the same files cached instead of with whatever
+// the runs before left there. Paths which don't exist, can't be read or aren't
+// regular files are skipped.
+func PrimeCaches(paths []string) (*CachePriming, error) {
+	start := time.Now()
+	primed := &CachePriming{}
+	for _, path := range paths {
+		n, err := readFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read %s into the page cache: %v", path, err)
+		}
+		if n >= 0 {
+			primed.Files++
+			primed.Bytes += n
+		}
+	}
+	primed.Time = time.Since(start)
+	return primed, nil
+}
+
+// readFile reads the whole file and returns how many bytes it read, or -1 if
+// the file was skipped.
+func readFile(path string) (int64, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) || os.IsPermission(err) {
+		return -1, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if !fi.Mode().IsRegular() {
+		return -1, nil
+	}
+	return io.Copy(ioutil.Discard, f)
+}
+
 // RunScript will run the specified script with args, trying both a script on
 // $PATH, as well as from the current working directory for easy
 // scripting/measurement from the command line without large paths as arguments
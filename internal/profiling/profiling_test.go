@@ -18,6 +18,7 @@ package profiling_test
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"testing"
@@ -143,3 +144,17 @@ func (p *profilingTestSuite) TestFreeCaches(c *check.C) {
 	err := profiling.FreeCaches()
 	c.Assert(err, check.IsNil)
 }
+
+func (p *profilingTestSuite) TestPrimeCaches(c *check.C) {
+	dir := c.MkDir()
+	a := filepath.Join(dir, "a")
+	b := filepath.Join(dir, "b")
+	c.Assert(ioutil.WriteFile(a, make([]byte, 3000), 0644), check.IsNil)
+	c.Assert(ioutil.WriteFile(b, []byte("hello"), 0644), check.IsNil)
+
+	// directories and missing files are skipped
+	primed, err := profiling.PrimeCaches([]string{a, dir, filepath.Join(dir, "missing"), b})
+	c.Assert(err, check.IsNil)
+	c.Check(primed.Files, check.Equals, 2)
+	c.Check(primed.Bytes, check.Equals, int64(3005))
+}
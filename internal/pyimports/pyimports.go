@@ -0,0 +1,220 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package pyimports
+
+import (
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/anonymouse64/etrace/internal/files"
+	"github.com/anonymouse64/etrace/internal/schema"
+	"github.com/anonymouse64/etrace/internal/strace"
+)
+
+// matches the part of a path up to and including the directory python modules
+// are imported from, lines look like:
+// /usr/lib/python3.8/json/decoder.py
+// /snap/foo/1/lib/python3.8/site-packages/requests/__pycache__/api.cpython-38.pyc
+// /usr/lib/python3/dist-packages/gi/__init__.py
+var importDirRE = regexp.MustCompile(`^.*/lib/python[0-9.]*/(?:(?:site|dist)-packages/)?`)
+
+// PackageCost is the cost of importing a single top-level python package or
+// module
+type PackageCost struct {
+	Package string
+	// Accesses is the number of syscalls accessing .py and .pyc files of the
+	// package
+	Accesses int
+	// Files is the number of unique .py and .pyc files of the package
+	Files int
+	// Bytes is the total size of the unique files
+	Bytes int64
+	// Dirs is the number of unique directories the files were found in
+	Dirs int
+}
+
+// IsPythonSource returns whether the path is a python source or bytecode file.
+func IsPythonSource(path string) bool {
+	return strings.HasSuffix(path, ".py") || strings.HasSuffix(path, ".pyc")
+}
+
+// packageName returns the name of the top-level package or module that the
+// python file belongs to, or the empty string if the file is not in a python
+// import directory.
+func packageName(path string) string {
+	loc := importDirRE.FindStringIndex(path)
+	if loc == nil {
+		return ""
+	}
+	rel := strings.TrimPrefix(path[loc[1]:], "__pycache__/")
+	if i := strings.IndexByte(rel, '/'); i != -1 {
+		// a package directory
+		return rel[:i]
+	}
+	// a single module, i.e. os.py, six.py or os.cpython-38.pyc, drop the
+	// extension and any interpreter tag
+	if i := strings.IndexByte(rel, '.'); i != -1 {
+		return rel[:i]
+	}
+	return rel
+}
+
+type packageStats struct {
+	cost  PackageCost
+	files map[string]bool
+	dirs  map[string]bool
+}
+
+// Summarize aggregates the accesses of .py and .pyc files by all processes
+// into the import cost of each top-level package, sorted by the number of
+// accesses. It returns nil if no python files were accessed.
+func Summarize(e *strace.ExecvePaths, sizes *files.Sizes) []PackageCost {
+	byPkg := make(map[string]*packageStats)
+	for _, proc := range e.Processes {
+		for _, access := range proc.PathAccesses {
+			if !IsPythonSource(access.Path) {
+				continue
+			}
+			name := packageName(access.Path)
+			if name == "" {
+				continue
+			}
+			stats, ok := byPkg[name]
+			if !ok {
+				stats = &packageStats{
+					cost:  PackageCost{Package: name},
+					files: make(map[string]bool),
+					dirs:  make(map[string]bool),
+				}
+				byPkg[name] = stats
+			}
+			stats.cost.Accesses++
+			stats.dirs[filepath.Dir(access.Path)] = true
+			if !stats.files[access.Path] {
+				stats.files[access.Path] = true
+				// the file may have been removed since, in which case its
+				// size is unknown
+				if size, ok := sizes.Size(access.Path); ok {
+					stats.cost.Bytes += size
+				}
+			}
+		}
+	}
+	if len(byPkg) == 0 {
+		return nil
+	}
+
+	costs := make([]PackageCost, 0, len(byPkg))
+	for _, stats := range byPkg {
+		stats.cost.Files = len(stats.files)
+		stats.cost.Dirs = len(stats.dirs)
+		costs = append(costs, stats.cost)
+	}
+	sort.Slice(costs, func(i, j int) bool {
+		if costs[i].Accesses != costs[j].Accesses {
+			return costs[i].Accesses > costs[j].Accesses
+		}
+		return costs[i].Package < costs[j].Package
+	})
+	return costs
+}
+
+// BytecodeRecommendation is the recommendation for programs which fail to write
+// their bytecode caches
+const BytecodeRecommendation = "ship precompiled bytecode, i.e. by running python3 -m compileall when building the package"
+
+// BytecodeWriteFailures is the cost of python failing to write its bytecode
+// caches, which happens on every launch when the sources are on a read-only
+// filesystem such as the squashfs of a snap
+type BytecodeWriteFailures struct {
+	// FailedWrites is the number of failed syscalls creating __pycache__
+	// directories or .pyc files
+	FailedWrites int
+	// Modules is the number of unique source files which were compiled
+	// without their bytecode being saved
+	Modules int
+	// RecompileTime is the estimated time spent compiling those modules on
+	// every launch
+	RecompileTime time.Duration
+}
+
+// Structured returns the failures as encoded since version 2 of the schema.
+func (f *BytecodeWriteFailures) Structured() interface{} {
+	type plain BytecodeWriteFailures
+	return struct {
+		plain
+		RecompileTime schema.Duration
+	}{plain(*f), schema.NewDuration(f.RecompileTime)}
+}
+
+// isBytecodeWrite returns whether the path is a __pycache__ directory or a file
+// inside one, such as the temporary file a .pyc is first written to, i.e.
+// __pycache__/os.cpython-38.pyc.140234, and the directory that the source file
+// is in.
+func isBytecodeWrite(path string) (srcDir string, ok bool) {
+	if filepath.Base(path) == "__pycache__" {
+		return filepath.Dir(path), true
+	}
+	dir := filepath.Dir(path)
+	if filepath.Base(dir) == "__pycache__" {
+		return filepath.Dir(dir), true
+	}
+	return "", false
+}
+
+// BytecodeWrites returns the cost of failing to write bytecode caches, or nil
+// if there were no such failures. The compile time of each module is estimated
+// as the time from the last access of its source file until the failed write.
+func BytecodeWrites(e *strace.ExecvePaths) *BytecodeWriteFailures {
+	var res *BytecodeWriteFailures
+	seenSources := make(map[string]bool)
+	for _, proc := range e.Processes {
+		for _, write := range proc.FailedWrites {
+			srcDir, ok := isBytecodeWrite(write.Path)
+			if !ok {
+				continue
+			}
+			if res == nil {
+				res = &BytecodeWriteFailures{}
+			}
+			res.FailedWrites++
+
+			// the source being compiled is the last one accessed in the
+			// directory before the failure
+			var src *strace.PathAccess
+			for i, access := range proc.PathAccesses {
+				if access.Time.After(write.Time) {
+					break
+				}
+				if strings.HasSuffix(access.Path, ".py") && filepath.Dir(access.Path) == srcDir {
+					src = &proc.PathAccesses[i]
+				}
+			}
+			if src == nil || seenSources[src.Path] {
+				continue
+			}
+			seenSources[src.Path] = true
+			res.Modules++
+			res.RecompileTime += write.Time.Sub(src.Time)
+		}
+	}
+	return res
+}
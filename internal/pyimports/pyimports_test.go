@@ -0,0 +1,137 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package pyimports_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/anonymouse64/etrace/internal/files"
+	"github.com/anonymouse64/etrace/internal/pyimports"
+	"github.com/anonymouse64/etrace/internal/strace"
+
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type pyimportsTestSuite struct{}
+
+var _ = check.Suite(&pyimportsTestSuite{})
+
+func (p *pyimportsTestSuite) TestIsPythonSource(c *check.C) {
+	c.Check(pyimports.IsPythonSource("/usr/lib/python3.8/os.py"), check.Equals, true)
+	c.Check(pyimports.IsPythonSource("/usr/lib/python3.8/__pycache__/os.cpython-38.pyc"), check.Equals, true)
+	c.Check(pyimports.IsPythonSource("/usr/lib/python3.8/lib-dynload/_ssl.so"), check.Equals, false)
+}
+
+func (p *pyimportsTestSuite) TestSummarize(c *check.C) {
+	root := c.MkDir()
+	site := filepath.Join(root, "snap/foo/1/lib/python3.8/site-packages")
+	stdlib := filepath.Join(root, "usr/lib/python3.8")
+	write := func(path string, size int) string {
+		c.Assert(os.MkdirAll(filepath.Dir(path), 0755), check.IsNil)
+		c.Assert(ioutil.WriteFile(path, make([]byte, size), 0644), check.IsNil)
+		return path
+	}
+	reqInit := write(filepath.Join(site, "requests/__init__.py"), 100)
+	reqInitPyc := write(filepath.Join(site, "requests/__pycache__/__init__.cpython-38.pyc"), 200)
+	reqAPI := write(filepath.Join(site, "requests/__pycache__/api.cpython-38.pyc"), 50)
+	six := write(filepath.Join(site, "six.py"), 30)
+	osPyc := write(filepath.Join(stdlib, "__pycache__/os.cpython-38.pyc"), 10)
+
+	e := &strace.ExecvePaths{
+		Processes: []strace.ProcessRuntime{
+			{
+				Exe: "/snap/foo/1/usr/bin/python3",
+				PathAccesses: []strace.PathAccess{
+					{Path: osPyc},
+					{Path: osPyc},
+					{Path: filepath.Join(stdlib, "lib-dynload/_ssl.so")},
+					{Path: reqInit},
+					{Path: reqInitPyc},
+					{Path: reqInitPyc},
+					{Path: reqAPI},
+					// removed since the trace
+					{Path: filepath.Join(site, "requests/__pycache__/gone.cpython-38.pyc")},
+					{Path: "/home/user/script.py"},
+				},
+			},
+			{
+				Exe: "/snap/foo/1/usr/bin/python3",
+				PathAccesses: []strace.PathAccess{
+					{Path: six},
+				},
+			},
+		},
+	}
+	c.Assert(pyimports.Summarize(e, files.NewSizes("/")), check.DeepEquals, []pyimports.PackageCost{
+		{Package: "requests", Accesses: 5, Files: 4, Bytes: 350, Dirs: 2},
+		{Package: "os", Accesses: 2, Files: 1, Bytes: 10, Dirs: 1},
+		{Package: "six", Accesses: 1, Files: 1, Bytes: 30, Dirs: 1},
+	})
+
+	c.Assert(pyimports.Summarize(&strace.ExecvePaths{}, files.NewSizes("/")), check.IsNil)
+}
+
+func (p *pyimportsTestSuite) TestBytecodeWrites(c *check.C) {
+	start := time.Unix(1000, 0)
+	at := func(ms int) time.Time { return start.Add(time.Duration(ms) * time.Millisecond) }
+	lib := "/snap/foo/1/lib/python3.8"
+	e := &strace.ExecvePaths{
+		Processes: []strace.ProcessRuntime{
+			{
+				Exe: "/snap/foo/1/usr/bin/python3",
+				PathAccesses: []strace.PathAccess{
+					{Time: at(0), Path: lib + "/os.py"},
+					{Time: at(5), Path: lib + "/os.py"},
+					{Time: at(30), Path: lib + "/json/__init__.py"},
+					{Time: at(40), Path: lib + "/stat.py"},
+					{Time: at(55), Path: lib + "/json/decoder.py"},
+				},
+				FailedWrites: []strace.FailedWrite{
+					// os took 10ms to compile
+					{Time: at(15), Path: lib + "/__pycache__/os.cpython-38.pyc.1234", Errno: "EROFS"},
+					// json/__init__ took 5ms
+					{Time: at(35), Path: lib + "/json/__pycache__", Errno: "EROFS"},
+					// stat took 20ms
+					{Time: at(60), Path: lib + "/__pycache__/stat.cpython-38.pyc.1234", Errno: "EROFS"},
+					// not bytecode
+					{Time: at(70), Path: "/snap/foo/1/cache.db", Errno: "EROFS"},
+				},
+			},
+			{
+				Exe: "/snap/foo/1/usr/bin/python3",
+				FailedWrites: []strace.FailedWrite{
+					// no source accessed
+					{Time: at(80), Path: lib + "/__pycache__/abc.cpython-38.pyc.1234", Errno: "EROFS"},
+				},
+			},
+		},
+	}
+	c.Assert(pyimports.BytecodeWrites(e), check.DeepEquals, &pyimports.BytecodeWriteFailures{
+		FailedWrites:  4,
+		Modules:       3,
+		RecompileTime: 35 * time.Millisecond,
+	})
+
+	c.Assert(pyimports.BytecodeWrites(&strace.ExecvePaths{}), check.IsNil)
+}
@@ -0,0 +1,138 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package readiness probes whether a headless program, like the service of an
+// appliance snap, is ready to be used.
+package readiness
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Probe kinds
+const (
+	// KindTCP is ready when a TCP connection to an address succeeds
+	KindTCP = "tcp"
+	// KindUnix is ready when a connection to a unix socket succeeds
+	KindUnix = "unix"
+	// KindHTTP is ready when a GET of a URL returns a status below 500
+	KindHTTP = "http"
+	// KindFile is ready when a file exists
+	KindFile = "file"
+)
+
+// dialTimeout is how long a single attempt of a probe may take
+var dialTimeout = time.Second
+
+// Probe checks one condition of readiness
+type Probe struct {
+	Kind   string
+	Target string
+}
+
+// Parse parses a probe specified as tcp:HOST:PORT, unix:PATH, file:PATH or an
+// http or https URL.
+func Parse(spec string) (Probe, error) {
+	if strings.HasPrefix(spec, "http://") || strings.HasPrefix(spec, "https://") {
+		return Probe{Kind: KindHTTP, Target: spec}, nil
+	}
+	i := strings.IndexByte(spec, ':')
+	if i <= 0 || i == len(spec)-1 {
+		return Probe{}, fmt.Errorf("invalid probe %q: must be KIND:TARGET or a URL", spec)
+	}
+	p := Probe{Kind: spec[:i], Target: spec[i+1:]}
+	switch p.Kind {
+	case KindTCP:
+		if _, _, err := net.SplitHostPort(p.Target); err != nil {
+			return Probe{}, fmt.Errorf("invalid probe %q: %v", spec, err)
+		}
+	case KindUnix, KindFile:
+	default:
+		return Probe{}, fmt.Errorf("invalid probe %q: unknown kind %q", spec, p.Kind)
+	}
+	return p, nil
+}
+
+// String returns the probe as it is specified.
+func (p Probe) String() string {
+	if p.Kind == KindHTTP {
+		return p.Target
+	}
+	return p.Kind + ":" + p.Target
+}
+
+// Ready returns whether the condition of the probe holds.
+func (p Probe) Ready() bool {
+	switch p.Kind {
+	case KindTCP, KindUnix:
+		conn, err := net.DialTimeout(p.Kind, p.Target, dialTimeout)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	case KindHTTP:
+		client := &http.Client{Timeout: dialTimeout}
+		resp, err := client.Get(p.Target)
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode < 500
+	case KindFile:
+		_, err := os.Stat(p.Target)
+		return err == nil
+	}
+	return false
+}
+
+// Wait polls the probes until all of them are ready and returns how long
+// after start each of them became ready, in the order of the probes. When the
+// context is done first, the probes which were not ready are zero.
+func Wait(ctx context.Context, probes []Probe, start time.Time, interval time.Duration) ([]time.Duration, error) {
+	times := make([]time.Duration, len(probes))
+	left := len(probes)
+	for {
+		for i, p := range probes {
+			if times[i] != 0 || !p.Ready() {
+				continue
+			}
+			times[i] = time.Since(start)
+			left--
+		}
+		if left == 0 {
+			return times, nil
+		}
+		select {
+		case <-ctx.Done():
+			var waiting []string
+			for i, p := range probes {
+				if times[i] == 0 {
+					waiting = append(waiting, p.String())
+				}
+			}
+			return times, fmt.Errorf("%s not ready: %v", strings.Join(waiting, ", "), ctx.Err())
+		case <-time.After(interval):
+		}
+	}
+}
@@ -0,0 +1,118 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package readiness_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/anonymouse64/etrace/internal/readiness"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type readinessSuite struct{}
+
+var _ = Suite(&readinessSuite{})
+
+func (s *readinessSuite) TestParse(c *C) {
+	for _, t := range []struct {
+		spec  string
+		probe readiness.Probe
+		err   string
+	}{
+		{spec: "tcp:localhost:8080", probe: readiness.Probe{Kind: "tcp", Target: "localhost:8080"}},
+		{spec: "unix:/run/app.sock", probe: readiness.Probe{Kind: "unix", Target: "/run/app.sock"}},
+		{spec: "file:/run/app.ready", probe: readiness.Probe{Kind: "file", Target: "/run/app.ready"}},
+		{spec: "http://localhost:8080/health", probe: readiness.Probe{Kind: "http", Target: "http://localhost:8080/health"}},
+		{spec: "tcp:8080", err: `invalid probe "tcp:8080": .*missing port.*`},
+		{spec: "udp:localhost:53", err: `invalid probe "udp:localhost:53": unknown kind "udp"`},
+		{spec: "file:", err: `invalid probe "file:": must be KIND:TARGET or a URL`},
+	} {
+		p, err := readiness.Parse(t.spec)
+		if t.err != "" {
+			c.Check(err, ErrorMatches, t.err, Commentf(t.spec))
+			continue
+		}
+		c.Assert(err, IsNil)
+		c.Check(p, Equals, t.probe)
+		c.Check(p.String(), Equals, t.spec)
+	}
+}
+
+func (s *readinessSuite) TestReady(c *C) {
+	dir := c.MkDir()
+	file := readiness.Probe{Kind: "file", Target: filepath.Join(dir, "ready")}
+	c.Check(file.Ready(), Equals, false)
+	c.Assert(ioutil.WriteFile(file.Target, nil, 0644), IsNil)
+	c.Check(file.Ready(), Equals, true)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	tcp := readiness.Probe{Kind: "tcp", Target: l.Addr().String()}
+	c.Check(tcp.Ready(), Equals, true)
+	l.Close()
+	c.Check(tcp.Ready(), Equals, false)
+
+	status := http.StatusServiceUnavailable
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+	probe := readiness.Probe{Kind: "http", Target: srv.URL}
+	c.Check(probe.Ready(), Equals, false)
+	status = http.StatusNotFound
+	c.Check(probe.Ready(), Equals, true)
+}
+
+func (s *readinessSuite) TestWait(c *C) {
+	dir := c.MkDir()
+	ready := filepath.Join(dir, "ready")
+	probes := []readiness.Probe{
+		{Kind: "file", Target: filepath.Join(dir, "exists")},
+		{Kind: "file", Target: ready},
+	}
+	c.Assert(ioutil.WriteFile(probes[0].Target, nil, 0644), IsNil)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		ioutil.WriteFile(ready, nil, 0644)
+	}()
+
+	start := time.Now()
+	times, err := readiness.Wait(context.Background(), probes, start, 5*time.Millisecond)
+	c.Assert(err, IsNil)
+	c.Assert(times, HasLen, 2)
+	c.Check(times[0] < 50*time.Millisecond, Equals, true)
+	c.Check(times[1] >= 50*time.Millisecond, Equals, true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	probes[1].Target = filepath.Join(dir, "never")
+	times, err = readiness.Wait(ctx, probes, time.Now(), 5*time.Millisecond)
+	c.Check(err, ErrorMatches, "file:.*/never not ready: context deadline exceeded")
+	c.Check(times[0] != 0, Equals, true)
+	c.Check(times[1], Equals, time.Duration(0))
+}
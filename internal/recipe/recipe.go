@@ -0,0 +1,248 @@
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package recipe records everything needed to reproduce a measurement, so that
+// reported numbers can be reproduced on the same or another machine.
+package recipe
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/anonymouse64/etrace/internal/snaps"
+)
+
+var (
+	procRoot      = "/proc"
+	osReleasePath = "/etc/os-release"
+
+	snapRevision = snaps.Revision
+)
+
+// EnvVars are the environment variables which affect measurements and are
+// recorded in recipes. The rest of the environment is not recorded since it
+// may contain secrets.
+var EnvVars = []string{
+	"DISPLAY",
+	"WAYLAND_DISPLAY",
+	"XDG_SESSION_TYPE",
+	"XDG_CURRENT_DESKTOP",
+	"LANG",
+	"LC_ALL",
+}
+
+// baseSnaps are the snaps providing snapd and the base snaps whose revisions
+// are recorded in addition to the measured snap
+var baseSnaps = []string{"snapd", "core", "core18", "core20"}
+
+// Host is the facts about the machine a measurement was done on
+type Host struct {
+	Kernel   string `yaml:"kernel"`
+	OS       string `yaml:"os"`
+	CPU      string `yaml:"cpu"`
+	CPUs     int    `yaml:"cpus"`
+	MemoryKB uint64 `yaml:"memory-kb"`
+}
+
+// Recipe is everything needed to reproduce a measurement
+type Recipe struct {
+	Created time.Time `yaml:"created"`
+	// Args are the arguments etrace was run with, including the subcommand
+	// and the command that was measured
+	Args []string          `yaml:"args"`
+	Env  map[string]string `yaml:"env,omitempty"`
+	// Snaps are the revisions of the measured snap, snapd and the base
+	// snaps which were installed
+	Snaps map[string]string `yaml:"snaps,omitempty"`
+	Host  Host              `yaml:"host"`
+}
+
+// New returns a recipe for running etrace with the given arguments in the
+// current environment, measuring the given snap if it's not empty.
+func New(args []string, snap string) *Recipe {
+	return &Recipe{
+		Created: time.Now().UTC().Truncate(time.Second),
+		Args:    args,
+		Env:     currentEnv(),
+		Snaps:   snapRevisions(snap),
+		Host:    HostFacts(),
+	}
+}
+
+func currentEnv() map[string]string {
+	env := make(map[string]string)
+	for _, name := range EnvVars {
+		if v, ok := os.LookupEnv(name); ok {
+			env[name] = v
+		}
+	}
+	return env
+}
+
+func snapRevisions(snap string) map[string]string {
+	names := baseSnaps
+	if snap != "" {
+		names = append([]string{snap}, baseSnaps...)
+	}
+	revs := make(map[string]string)
+	for _, name := range names {
+		// snaps which are not installed are just not recorded
+		if rev, err := snapRevision(name); err == nil {
+			revs[name] = rev
+		}
+	}
+	return revs
+}
+
+// HostFacts returns the facts about the current machine, facts which can't be
+// read are left empty.
+func HostFacts() Host {
+	host := Host{CPUs: runtime.NumCPU()}
+	if out, err := ioutil.ReadFile(filepath.Join(procRoot, "sys/kernel/osrelease")); err == nil {
+		host.Kernel = strings.TrimSpace(string(out))
+	}
+	host.OS = readKeyValue(osReleasePath, "PRETTY_NAME", "=")
+	host.CPU = readKeyValue(filepath.Join(procRoot, "cpuinfo"), "model name", ":")
+	mem := strings.TrimSuffix(readKeyValue(filepath.Join(procRoot, "meminfo"), "MemTotal", ":"), " kB")
+	host.MemoryKB, _ = strconv.ParseUint(mem, 10, 64)
+	return host
+}
+
+// readKeyValue returns the value of the first line with the given key in a
+// file of key value lines, with any quotes removed.
+func readKeyValue(path, key, sep string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		kv := strings.SplitN(s.Text(), sep, 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) != key {
+			continue
+		}
+		return strings.Trim(strings.TrimSpace(kv[1]), `"`)
+	}
+	return ""
+}
+
+// Differences returns the ways the current machine differs from the one the
+// recipe was recorded on, which may make the measurement differ.
+func (r *Recipe) Differences() []string {
+	var diffs []string
+	host := HostFacts()
+	facts := []struct {
+		name          string
+		recorded, now string
+	}{
+		{"kernel", r.Host.Kernel, host.Kernel},
+		{"os", r.Host.OS, host.OS},
+		{"cpu", r.Host.CPU, host.CPU},
+		{"cpus", strconv.Itoa(r.Host.CPUs), strconv.Itoa(host.CPUs)},
+		{"memory", fmt.Sprintf("%d kB", r.Host.MemoryKB), fmt.Sprintf("%d kB", host.MemoryKB)},
+	}
+	for _, f := range facts {
+		if f.recorded != f.now {
+			diffs = append(diffs, fmt.Sprintf("%s is %q, recipe was recorded with %q", f.name, f.now, f.recorded))
+		}
+	}
+	// the variables of the session, like WAYLAND_DISPLAY, differ when the
+	// recipe is run in a different session, even though they are applied
+	for _, name := range EnvVars {
+		recorded, wasSet := r.Env[name]
+		now, isSet := os.LookupEnv(name)
+		switch {
+		case wasSet && !isSet:
+			diffs = append(diffs, fmt.Sprintf("%s is not set, recipe was recorded with %q", name, recorded))
+		case !wasSet && isSet:
+			diffs = append(diffs, fmt.Sprintf("%s is %q, recipe was recorded without it", name, now))
+		case now != recorded:
+			diffs = append(diffs, fmt.Sprintf("%s is %q, recipe was recorded with %q", name, now, recorded))
+		}
+	}
+	names := make([]string, 0, len(r.Snaps))
+	for name := range r.Snaps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		recorded := r.Snaps[name]
+		now, err := snapRevision(name)
+		switch {
+		case err != nil:
+			diffs = append(diffs, fmt.Sprintf("snap %s is not installed, recipe was recorded with revision %s", name, recorded))
+		case now != recorded:
+			diffs = append(diffs, fmt.Sprintf("snap %s is at revision %s, recipe was recorded with revision %s", name, now, recorded))
+		}
+	}
+	return diffs
+}
+
+// Apply sets the environment variables recorded in the recipe, and unsets the
+// ones which are recorded in recipes but weren't set when it was recorded.
+func (r *Recipe) Apply() error {
+	for _, name := range EnvVars {
+		if _, ok := r.Env[name]; ok {
+			continue
+		}
+		if err := os.Unsetenv(name); err != nil {
+			return err
+		}
+	}
+	for name, v := range r.Env {
+		if err := os.Setenv(name, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write writes the recipe as YAML to the given file.
+func Write(path string, r *Recipe) error {
+	out, err := yaml.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, out, 0644)
+}
+
+// Read reads a recipe from the given YAML file.
+func Read(path string) (*Recipe, error) {
+	out, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var r Recipe
+	if err := yaml.UnmarshalStrict(out, &r); err != nil {
+		return nil, fmt.Errorf("cannot parse recipe %s: %v", path, err)
+	}
+	if len(r.Args) == 0 {
+		return nil, fmt.Errorf("cannot use recipe %s: no args", path)
+	}
+	return &r, nil
+}
@@ -0,0 +1,161 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package recipe_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/anonymouse64/etrace/internal/recipe"
+
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type recipeTestSuite struct {
+	restores []func()
+	revs     map[string]string
+}
+
+var _ = check.Suite(&recipeTestSuite{})
+
+func (s *recipeTestSuite) SetUpTest(c *check.C) {
+	dir := c.MkDir()
+	proc := filepath.Join(dir, "proc")
+	c.Assert(os.MkdirAll(filepath.Join(proc, "sys/kernel"), 0755), check.IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(proc, "sys/kernel/osrelease"), []byte("5.11.0-25-generic\n"), 0644), check.IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(proc, "cpuinfo"), []byte("processor\t: 0\nmodel name\t: Intel(R) Core(TM) i7-8550U CPU @ 1.80GHz\n"), 0644), check.IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(proc, "meminfo"), []byte("MemTotal:       16261384 kB\nMemFree:         1234567 kB\n"), 0644), check.IsNil)
+	osRelease := filepath.Join(dir, "os-release")
+	c.Assert(ioutil.WriteFile(osRelease, []byte("NAME=\"Ubuntu\"\nPRETTY_NAME=\"Ubuntu 21.04\"\n"), 0644), check.IsNil)
+
+	s.revs = map[string]string{"snapd": "12345", "core20": "1081", "chromium": "1710"}
+	s.restores = []func(){
+		recipe.MockProcRoot(proc),
+		recipe.MockOSReleasePath(osRelease),
+		recipe.MockSnapRevision(func(snap string) (string, error) {
+			if rev, ok := s.revs[snap]; ok {
+				return rev, nil
+			}
+			return "", fmt.Errorf("no such snap: %s", snap)
+		}),
+	}
+	// the tests change the environment recorded in recipes
+	for _, name := range recipe.EnvVars {
+		name := name
+		if v, ok := os.LookupEnv(name); ok {
+			s.restores = append(s.restores, func() { os.Setenv(name, v) })
+		} else {
+			s.restores = append(s.restores, func() { os.Unsetenv(name) })
+		}
+	}
+}
+
+func (s *recipeTestSuite) TearDownTest(c *check.C) {
+	for _, restore := range s.restores {
+		restore()
+	}
+}
+
+func (s *recipeTestSuite) TestHostFacts(c *check.C) {
+	c.Check(recipe.HostFacts(), check.Equals, recipe.Host{
+		Kernel:   "5.11.0-25-generic",
+		OS:       "Ubuntu 21.04",
+		CPU:      "Intel(R) Core(TM) i7-8550U CPU @ 1.80GHz",
+		CPUs:     runtime.NumCPU(),
+		MemoryKB: 16261384,
+	})
+}
+
+func (s *recipeTestSuite) TestNewWriteRead(c *check.C) {
+	os.Setenv("XDG_SESSION_TYPE", "x11")
+
+	r := recipe.New([]string{"exec", "--use-snap-run", "chromium"}, "chromium")
+	c.Check(r.Snaps, check.DeepEquals, map[string]string{"snapd": "12345", "core20": "1081", "chromium": "1710"})
+	c.Check(r.Env["XDG_SESSION_TYPE"], check.Equals, "x11")
+
+	path := filepath.Join(c.MkDir(), "recipe.yaml")
+	c.Assert(recipe.Write(path, r), check.IsNil)
+	read, err := recipe.Read(path)
+	c.Assert(err, check.IsNil)
+	c.Check(read.Created.Equal(r.Created), check.Equals, true)
+	read.Created = r.Created
+	c.Check(read, check.DeepEquals, r)
+	c.Check(read.Differences(), check.HasLen, 0)
+}
+
+func (s *recipeTestSuite) TestDifferences(c *check.C) {
+	for _, name := range recipe.EnvVars {
+		os.Unsetenv(name)
+	}
+	os.Setenv("DISPLAY", ":0")
+	os.Setenv("XDG_SESSION_TYPE", "wayland")
+	os.Setenv("LANG", "C.UTF-8")
+
+	r := recipe.New([]string{"exec", "--use-snap-run", "chromium"}, "chromium")
+	r.Host.Kernel = "5.8.0-63-generic"
+	r.Env = map[string]string{
+		"DISPLAY":          ":0",
+		"WAYLAND_DISPLAY":  "wayland-0",
+		"XDG_SESSION_TYPE": "x11",
+	}
+	s.revs["chromium"] = "1711"
+	delete(s.revs, "core20")
+
+	c.Check(r.Differences(), check.DeepEquals, []string{
+		`kernel is "5.11.0-25-generic", recipe was recorded with "5.8.0-63-generic"`,
+		`WAYLAND_DISPLAY is not set, recipe was recorded with "wayland-0"`,
+		`XDG_SESSION_TYPE is "wayland", recipe was recorded with "x11"`,
+		`LANG is "C.UTF-8", recipe was recorded without it`,
+		"snap chromium is at revision 1711, recipe was recorded with revision 1710",
+		"snap core20 is not installed, recipe was recorded with revision 1081",
+	})
+}
+
+func (s *recipeTestSuite) TestApply(c *check.C) {
+	os.Setenv("WAYLAND_DISPLAY", "wayland-0")
+	os.Setenv("PATH_NOT_RECORDED", "kept")
+	defer os.Unsetenv("PATH_NOT_RECORDED")
+
+	r := &recipe.Recipe{Env: map[string]string{"LC_ALL": "C.UTF-8", "DISPLAY": ":0"}}
+	c.Assert(r.Apply(), check.IsNil)
+	c.Check(os.Getenv("LC_ALL"), check.Equals, "C.UTF-8")
+	c.Check(os.Getenv("DISPLAY"), check.Equals, ":0")
+	// the recipe was recorded in an X11 session
+	_, ok := os.LookupEnv("WAYLAND_DISPLAY")
+	c.Check(ok, check.Equals, false)
+	// only the variables which are recorded in recipes are unset
+	c.Check(os.Getenv("PATH_NOT_RECORDED"), check.Equals, "kept")
+}
+
+func (s *recipeTestSuite) TestReadErrors(c *check.C) {
+	dir := c.MkDir()
+	path := filepath.Join(dir, "recipe.yaml")
+	c.Assert(ioutil.WriteFile(path, []byte("args: []\n"), 0644), check.IsNil)
+	_, err := recipe.Read(path)
+	c.Check(err, check.ErrorMatches, "cannot use recipe .*/recipe.yaml: no args")
+
+	c.Assert(ioutil.WriteFile(path, []byte("args: [exec, true]\nunknown: 1\n"), 0644), check.IsNil)
+	_, err = recipe.Read(path)
+	c.Check(err, check.ErrorMatches, `cannot parse recipe .*/recipe.yaml: yaml: unmarshal errors:\n.*field unknown not found.*`)
+}
@@ -0,0 +1,168 @@
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package redact
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/anonymouse64/etrace/internal/strace"
+)
+
+// HomeReplacement is what home directories are replaced with
+const HomeReplacement = "$HOME"
+
+// matches the home directory of any user in a path, or anywhere in a string
+// with homeAnywhereRE, i.e.:
+// /home/egon/snap/brave/44/.local/share
+var (
+	homeRE         = regexp.MustCompile(`^/home/[^/]+`)
+	homeAnywhereRE = regexp.MustCompile(`/home/[^/\s"',:;)\]]+`)
+)
+
+// Rule rewrites paths starting with the From directory to start with To
+// instead
+type Rule struct {
+	From string
+	To   string
+}
+
+// ParseRule parses a rule specified as FROM=TO.
+func ParseRule(s string) (Rule, error) {
+	i := strings.IndexByte(s, '=')
+	if i <= 0 {
+		return Rule{}, fmt.Errorf("invalid path rewrite rule %q, expected FROM=TO", s)
+	}
+	from := s[:i]
+	if !filepath.IsAbs(from) {
+		return Rule{}, fmt.Errorf("invalid path rewrite rule %q, FROM must be an absolute path", s)
+	}
+	return Rule{From: filepath.Clean(from), To: s[i+1:]}, nil
+}
+
+// Redactor rewrites paths in results so they can be shared without leaking
+// user names and the local layout of the machine
+type Redactor struct {
+	rules      []Rule
+	redactHome bool
+}
+
+// New returns a Redactor applying the rules in order, and with redactHome also
+// replacing the home directory of any user under /home as well as the given
+// home directory with HomeReplacement.
+func New(rules []Rule, redactHome bool, home string) *Redactor {
+	r := &Redactor{redactHome: redactHome}
+	r.rules = append(r.rules, rules...)
+	// the home directory of the current user may not be under /home
+	if redactHome && home != "" && home != "/" && !homeRE.MatchString(home) {
+		r.rules = append(r.rules, Rule{From: filepath.Clean(home), To: HomeReplacement})
+	}
+	return r
+}
+
+// Path rewrites a single path.
+func (r *Redactor) Path(path string) string {
+	for _, rule := range r.rules {
+		if path == rule.From || strings.HasPrefix(path, rule.From+"/") {
+			return rule.To + path[len(rule.From):]
+		}
+	}
+	if r.redactHome {
+		return homeRE.ReplaceAllLiteralString(path, HomeReplacement)
+	}
+	return path
+}
+
+// String rewrites all paths appearing anywhere in a string, such as an error
+// message.
+func (r *Redactor) String(s string) string {
+	for _, rule := range r.rules {
+		s = replaceDir(s, rule.From, rule.To)
+	}
+	if r.redactHome {
+		s = homeAnywhereRE.ReplaceAllLiteralString(s, HomeReplacement)
+	}
+	return s
+}
+
+// replaceDir replaces all occurrences of dir in s which are either the whole
+// directory or followed by a path separator.
+func replaceDir(s, dir, replacement string) string {
+	var b strings.Builder
+	for {
+		i := strings.Index(s, dir)
+		if i == -1 {
+			b.WriteString(s)
+			return b.String()
+		}
+		end := i + len(dir)
+		b.WriteString(s[:i])
+		if end == len(s) || !isPathChar(s[end]) || s[end] == '/' {
+			b.WriteString(replacement)
+		} else {
+			b.WriteString(dir)
+		}
+		s = s[end:]
+	}
+}
+
+func isPathChar(c byte) bool {
+	return c != ' ' && c != '"' && c != '\'' && c != ':' && c != ','
+}
+
+// Strings rewrites all the strings in place.
+func (r *Redactor) Strings(strs []string) {
+	for i := range strs {
+		strs[i] = r.String(strs[i])
+	}
+}
+
+// ExecvePaths rewrites all the paths and programs in the file trace in place.
+func (r *Redactor) ExecvePaths(e *strace.ExecvePaths) {
+	if e == nil {
+		return
+	}
+	for i := range e.AllFiles {
+		e.AllFiles[i].Path = r.Path(e.AllFiles[i].Path)
+		e.AllFiles[i].Program = r.Path(e.AllFiles[i].Program)
+	}
+	for i := range e.Processes {
+		proc := &e.Processes[i]
+		proc.Exe = r.Path(proc.Exe)
+		for j := range proc.PathAccesses {
+			proc.PathAccesses[j].Path = r.Path(proc.PathAccesses[j].Path)
+		}
+		for j := range proc.FailedWrites {
+			proc.FailedWrites[j].Path = r.Path(proc.FailedWrites[j].Path)
+		}
+	}
+}
+
+// ExecveTiming rewrites all the programs and their arguments in the exec trace
+// in place.
+func (r *Redactor) ExecveTiming(t *strace.ExecveTiming) {
+	if t == nil {
+		return
+	}
+	for i := range t.ExeRuntimes {
+		t.ExeRuntimes[i].Exe = r.Path(t.ExeRuntimes[i].Exe)
+		r.Strings(t.ExeRuntimes[i].Args)
+	}
+}
@@ -0,0 +1,129 @@
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package redact_test
+
+import (
+	"testing"
+
+	"github.com/anonymouse64/etrace/internal/redact"
+	"github.com/anonymouse64/etrace/internal/strace"
+
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type redactTestSuite struct{}
+
+var _ = check.Suite(&redactTestSuite{})
+
+func (s *redactTestSuite) TestParseRule(c *check.C) {
+	rule, err := redact.ParseRule("/srv/builds/=/build")
+	c.Assert(err, check.IsNil)
+	c.Assert(rule, check.Equals, redact.Rule{From: "/srv/builds", To: "/build"})
+
+	_, err = redact.ParseRule("/srv/builds")
+	c.Assert(err, check.ErrorMatches, `invalid path rewrite rule "/srv/builds", expected FROM=TO`)
+	_, err = redact.ParseRule("srv=/build")
+	c.Assert(err, check.ErrorMatches, `invalid path rewrite rule "srv=/build", FROM must be an absolute path`)
+}
+
+func (s *redactTestSuite) TestPath(c *check.C) {
+	r := redact.New([]redact.Rule{{From: "/srv/builds", To: "/build"}}, true, "/var/lib/egon")
+	for _, t := range []struct {
+		path, exp string
+	}{
+		{"/home/egon/snap/brave/44/.config", "$HOME/snap/brave/44/.config"},
+		{"/home/egon", "$HOME"},
+		{"/var/lib/egon/.cache/fontconfig", "$HOME/.cache/fontconfig"},
+		{"/var/lib/egonx/file", "/var/lib/egonx/file"},
+		{"/srv/builds/app/bin/app", "/build/app/bin/app"},
+		{"/srv/buildsx", "/srv/buildsx"},
+		{"/usr/lib/libc.so.6", "/usr/lib/libc.so.6"},
+	} {
+		c.Check(r.Path(t.path), check.Equals, t.exp, check.Commentf(t.path))
+	}
+
+	// without redacting the home only the rules are applied
+	r = redact.New(nil, false, "/home/egon")
+	c.Assert(r.Path("/home/egon/file"), check.Equals, "/home/egon/file")
+}
+
+func (s *redactTestSuite) TestString(c *check.C) {
+	r := redact.New([]redact.Rule{{From: "/srv/builds", To: "/build"}}, true, "/home/egon")
+	c.Assert(
+		r.String(`running prepare script: open /home/egon/prepare.sh: no such file, and "/srv/builds/x" but not /srv/buildsx`),
+		check.Equals,
+		`running prepare script: open $HOME/prepare.sh: no such file, and "/build/x" but not /srv/buildsx`,
+	)
+}
+
+func (s *redactTestSuite) TestStringsMounts(c *check.C) {
+	r := redact.New(nil, true, "/home/egon")
+	// the mounts of a mount namespace, see mountns.Read
+	mounts := []string{
+		"/ ext4 /dev/sda1 /",
+		"/home/egon/snap ext4 /dev/sda1 /home/egon/snap",
+		"/snap/app/x1 squashfs /dev/loop /",
+	}
+	r.Strings(mounts)
+	c.Assert(mounts, check.DeepEquals, []string{
+		"/ ext4 /dev/sda1 /",
+		"$HOME/snap ext4 /dev/sda1 $HOME/snap",
+		"/snap/app/x1 squashfs /dev/loop /",
+	})
+}
+
+func (s *redactTestSuite) TestExecvePaths(c *check.C) {
+	r := redact.New(nil, true, "/home/egon")
+	e := &strace.ExecvePaths{
+		AllFiles: []strace.CommonFileInfo{
+			{Path: "/home/egon/.config/app.conf", Program: "/home/egon/bin/app", Size: 10},
+		},
+		Processes: []strace.ProcessRuntime{
+			{
+				Exe:          "/home/egon/bin/app",
+				PathAccesses: []strace.PathAccess{{Path: "/home/egon/.config/app.conf"}},
+				FailedWrites: []strace.FailedWrite{{Path: "/home/egon/.cache/x"}},
+			},
+		},
+	}
+	r.ExecvePaths(e)
+	c.Assert(e.AllFiles, check.DeepEquals, []strace.CommonFileInfo{
+		{Path: "$HOME/.config/app.conf", Program: "$HOME/bin/app", Size: 10},
+	})
+	c.Assert(e.Processes[0].Exe, check.Equals, "$HOME/bin/app")
+	c.Assert(e.Processes[0].PathAccesses[0].Path, check.Equals, "$HOME/.config/app.conf")
+	c.Assert(e.Processes[0].FailedWrites[0].Path, check.Equals, "$HOME/.cache/x")
+
+	// nil traces are fine
+	r.ExecvePaths(nil)
+}
+
+func (s *redactTestSuite) TestExecveTiming(c *check.C) {
+	r := redact.New(nil, true, "/home/egon")
+	t := &strace.ExecveTiming{
+		ExeRuntimes: []strace.ExeRuntime{
+			{Exe: "/home/egon/bin/app", Args: []string{"app", "--config=/home/egon/app.conf"}},
+		},
+	}
+	r.ExecveTiming(t)
+	c.Assert(t.ExeRuntimes, check.DeepEquals, []strace.ExeRuntime{
+		{Exe: "$HOME/bin/app", Args: []string{"app", "--config=$HOME/app.conf"}},
+	})
+}
@@ -0,0 +1,487 @@
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package report renders the JSON results of etrace as a self-contained HTML
+// report, which can be attached to bug reports and opened in any browser.
+package report
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/anonymouse64/etrace/analysis"
+	"github.com/anonymouse64/etrace/internal/schema"
+	"github.com/anonymouse64/etrace/internal/strace"
+)
+
+// Program is a program executed during a run
+type Program struct {
+	Exe string
+	// Start is relative to the first program of the run
+	Start    time.Duration
+	Duration time.Duration
+}
+
+// Milestone is when a run reached a milestone, relative to its start
+type Milestone struct {
+	Name string
+	Time time.Duration
+}
+
+// Run is a run of a result
+type Run struct {
+	TimeToDisplay time.Duration
+	TimeToRun     time.Duration
+	Programs      []Program
+	Milestones    []Milestone
+	Errors        []string
+}
+
+// Result is a result file of etrace exec or etrace file
+type Result struct {
+	// Name is the name of the result in the report, like its file name
+	Name string
+	Runs []Run
+	// Files are the files accessed, only results of etrace file have them
+	Files []strace.CommonFileInfo
+}
+
+// result decodes both the results of etrace exec and of etrace file
+type result struct {
+	Runs []struct {
+		ExecveTiming  *strace.ExecveTiming
+		TimeToDisplay time.Duration
+		TimeToRun     time.Duration
+		Milestones    []Milestone
+		Errors        []string
+	}
+	TimeToDisplay time.Duration
+	ExecvePaths   *strace.ExecvePaths
+	Errors        []string
+}
+
+// Load reads the JSON results of etrace exec or etrace file.
+func Load(r io.Reader, name string) (*Result, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	legacy, err := schema.Downgrade(data)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode etrace result: %v", err)
+	}
+	var res result
+	if err := json.Unmarshal(legacy, &res); err != nil {
+		return nil, fmt.Errorf("cannot decode etrace result: %v", err)
+	}
+	out := &Result{Name: name}
+	for _, r := range res.Runs {
+		run := Run{
+			TimeToDisplay: r.TimeToDisplay,
+			TimeToRun:     r.TimeToRun,
+			Milestones:    r.Milestones,
+			Errors:        r.Errors,
+		}
+		if r.ExecveTiming != nil {
+			run.Programs = programs(r.ExecveTiming.ExeRuntimes)
+		}
+		out.Runs = append(out.Runs, run)
+	}
+	if res.ExecvePaths != nil {
+		run := Run{TimeToDisplay: res.TimeToDisplay, Errors: res.Errors}
+		for _, p := range res.ExecvePaths.Processes {
+			run.Programs = append(run.Programs, Program{
+				Exe:      p.Exe,
+				Start:    p.Start.Sub(res.ExecvePaths.Start),
+				Duration: p.RunDuration,
+			})
+		}
+		out.Runs = append(out.Runs, run)
+		out.Files = res.ExecvePaths.AllFiles
+	}
+	if len(out.Runs) == 0 {
+		return nil, fmt.Errorf("cannot report etrace result: no runs")
+	}
+	return out, nil
+}
+
+// programs returns the programs relative to the first one, in the order they
+// started.
+func programs(runtimes []strace.ExeRuntime) []Program {
+	if len(runtimes) == 0 {
+		return nil
+	}
+	first := runtimes[0].Start
+	for _, rt := range runtimes {
+		if rt.Start.Before(first) {
+			first = rt.Start
+		}
+	}
+	progs := make([]Program, 0, len(runtimes))
+	for _, rt := range runtimes {
+		progs = append(progs, Program{Exe: rt.Exe, Start: rt.Start.Sub(first), Duration: rt.TotalSec})
+	}
+	sort.SliceStable(progs, func(i, j int) bool { return progs[i].Start < progs[j].Start })
+	return progs
+}
+
+// The sizes of the charts in pixels
+const (
+	chartWidth = 800
+	// labelWidth is the space left of the timeline for the programs
+	labelWidth = 200
+	rowHeight  = 16
+	barsHeight = 160
+)
+
+// bar is a bar of a chart, in pixels
+type bar struct {
+	X, Y, Width, Height float64
+	Label               string
+	Title               string
+}
+
+// timeline is the programs of a run on a time axis, with its milestones
+type timeline struct {
+	// Run is the run shown, starting at 1
+	Run    int
+	Height float64
+	Bars   []bar
+	Marks  []bar
+	End    time.Duration
+}
+
+// runsChart is the time to display of each run
+type runsChart struct {
+	Bars []bar
+	// Mean is the height of the mean of the runs
+	Mean float64
+	Max  time.Duration
+}
+
+// group is the files accessed by a program or in a directory
+type group struct {
+	Name  string
+	Files int
+	Bytes int64
+}
+
+// section is a result as shown in the report
+type section struct {
+	Name          string
+	Runs          int
+	Errors        int
+	TimeToDisplay *analysis.Distribution
+	TimeToRun     *analysis.Distribution
+	RunsChart     *runsChart
+	Timeline      *timeline
+	Programs      []Program
+	ByProgram     []group
+	ByDirectory   []group
+}
+
+// maxDirectories is how many of the directories with the most bytes read are
+// shown
+const maxDirectories = 20
+
+// newSection prepares the charts and tables of the result.
+func newSection(res *Result) section {
+	s := section{Name: res.Name, Runs: len(res.Runs)}
+	var ttd, ttr []time.Duration
+	for _, run := range res.Runs {
+		if len(run.Errors) != 0 {
+			s.Errors++
+			continue
+		}
+		if run.TimeToDisplay != 0 {
+			ttd = append(ttd, run.TimeToDisplay)
+		}
+		if run.TimeToRun != 0 {
+			ttr = append(ttr, run.TimeToRun)
+		}
+	}
+	if len(ttd) != 0 {
+		d := analysis.Describe(ttd)
+		s.TimeToDisplay = &d
+	}
+	if len(ttr) != 0 {
+		d := analysis.Describe(ttr)
+		s.TimeToRun = &d
+	}
+	if len(res.Runs) > 1 && s.TimeToDisplay != nil {
+		s.RunsChart = newRunsChart(res.Runs, s.TimeToDisplay.Mean)
+	}
+	if i := medianRun(res.Runs); i != -1 {
+		s.Timeline = newTimeline(i, res.Runs[i])
+		s.Programs = res.Runs[i].Programs
+	}
+	s.ByProgram, s.ByDirectory = fileGroups(res.Files)
+	return s
+}
+
+// medianRun returns the traced run whose time to display is the closest to
+// the median of the traced runs, or -1 if no run was traced.
+func medianRun(runs []Run) int {
+	var traced []int
+	for i, run := range runs {
+		if len(run.Programs) != 0 {
+			traced = append(traced, i)
+		}
+	}
+	if len(traced) == 0 {
+		return -1
+	}
+	sort.SliceStable(traced, func(i, j int) bool {
+		return runs[traced[i]].TimeToDisplay < runs[traced[j]].TimeToDisplay
+	})
+	return traced[(len(traced)-1)/2]
+}
+
+func newRunsChart(runs []Run, mean time.Duration) *runsChart {
+	c := &runsChart{}
+	for _, run := range runs {
+		if run.TimeToDisplay > c.Max {
+			c.Max = run.TimeToDisplay
+		}
+	}
+	if c.Max == 0 {
+		return nil
+	}
+	width := float64(chartWidth) / float64(len(runs))
+	for i, run := range runs {
+		h := float64(barsHeight) * float64(run.TimeToDisplay) / float64(c.Max)
+		title := fmt.Sprintf("run %d: %s", i+1, Millis(run.TimeToDisplay))
+		if len(run.Errors) != 0 {
+			title = fmt.Sprintf("run %d: %s", i+1, strings.Join(run.Errors, "; "))
+		}
+		c.Bars = append(c.Bars, bar{
+			X:      float64(i) * width,
+			Y:      barsHeight - h,
+			Width:  width * 0.8,
+			Height: h,
+			Label:  fmt.Sprint(i + 1),
+			Title:  title,
+		})
+	}
+	c.Mean = barsHeight - float64(barsHeight)*float64(mean)/float64(c.Max)
+	return c
+}
+
+func newTimeline(i int, run Run) *timeline {
+	t := &timeline{Run: i + 1}
+	for _, p := range run.Programs {
+		if end := p.Start + p.Duration; end > t.End {
+			t.End = end
+		}
+	}
+	for _, m := range run.Milestones {
+		if m.Time > t.End {
+			t.End = m.Time
+		}
+	}
+	if t.End == 0 {
+		return nil
+	}
+	scale := float64(chartWidth-labelWidth) / float64(t.End)
+	for j, p := range run.Programs {
+		t.Bars = append(t.Bars, bar{
+			X:      labelWidth + float64(p.Start)*scale,
+			Y:      float64(j * rowHeight),
+			Width:  float64(p.Duration) * scale,
+			Height: rowHeight - 2,
+			Label:  filepath.Base(p.Exe),
+			Title:  fmt.Sprintf("%s: %s from %s", p.Exe, Millis(p.Duration), Millis(p.Start)),
+		})
+	}
+	t.Height = float64(len(run.Programs) * rowHeight)
+	for _, m := range run.Milestones {
+		t.Marks = append(t.Marks, bar{
+			X:      labelWidth + float64(m.Time)*scale,
+			Height: t.Height,
+			Label:  m.Name,
+			Title:  fmt.Sprintf("%s at %s", m.Name, Millis(m.Time)),
+		})
+	}
+	return t
+}
+
+// fileGroups returns the files accessed by each program, and in each
+// directory of two levels like /usr/lib, with the most bytes first.
+func fileGroups(files []strace.CommonFileInfo) (byProgram, byDirectory []group) {
+	programs := make(map[string]*group)
+	dirs := make(map[string]*group)
+	add := func(groups map[string]*group, name string, f strace.CommonFileInfo) {
+		g, ok := groups[name]
+		if !ok {
+			g = &group{Name: name}
+			groups[name] = g
+		}
+		g.Files++
+		if f.Size > 0 {
+			g.Bytes += f.Size
+		}
+	}
+	for _, f := range files {
+		add(programs, f.Program, f)
+		add(dirs, topDirectory(f.Path), f)
+	}
+	byProgram = sortedGroups(programs)
+	byDirectory = sortedGroups(dirs)
+	if len(byDirectory) > maxDirectories {
+		byDirectory = byDirectory[:maxDirectories]
+	}
+	return byProgram, byDirectory
+}
+
+// topDirectory returns the directory of at most two levels the path is in.
+func topDirectory(path string) string {
+	parts := strings.SplitN(strings.TrimPrefix(filepath.Dir(path), "/"), "/", 3)
+	if len(parts) > 2 {
+		parts = parts[:2]
+	}
+	return "/" + strings.Join(parts, "/")
+}
+
+func sortedGroups(groups map[string]*group) []group {
+	sorted := make([]group, 0, len(groups))
+	for _, g := range groups {
+		sorted = append(sorted, *g)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Bytes != sorted[j].Bytes {
+			return sorted[i].Bytes > sorted[j].Bytes
+		}
+		return sorted[i].Name < sorted[j].Name
+	})
+	return sorted
+}
+
+// Millis formats the duration in milliseconds.
+func Millis(d time.Duration) string {
+	return fmt.Sprintf("%.1fms", float64(d)/float64(time.Millisecond))
+}
+
+// Write writes the HTML report of the results.
+func Write(w io.Writer, title string, results []*Result) error {
+	data := struct {
+		Title     string
+		Generated string
+		Sections  []section
+		Width     int
+		Bars      float64
+	}{
+		Title:     title,
+		Generated: time.Now().Format(time.RFC1123),
+		Width:     chartWidth,
+		Bars:      barsHeight,
+	}
+	for _, res := range results {
+		data.Sections = append(data.Sections, newSection(res))
+	}
+	return reportTemplate.Execute(w, data)
+}
+
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"ms":  Millis,
+	"px":  func(f float64) string { return fmt.Sprintf("%.1f", f) },
+	"add": func(a, b float64) float64 { return a + b },
+	"percent": func(f float64) string {
+		return fmt.Sprintf("%.1f%%", f)
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin: 1em 0; }
+th, td { border: 1px solid #ccc; padding: 0.2em 0.6em; text-align: right; }
+th:first-child, td:first-child, td.exe { text-align: left; }
+svg text { font-size: 11px; }
+.bar { fill: #4a90d9; }
+.mark { stroke: #d9534f; stroke-dasharray: 4 2; }
+.mean { stroke: #d9534f; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>Generated on {{.Generated}}.</p>
+{{if gt (len .Sections) 1}}
+<h2>Overview</h2>
+<table>
+<tr><th>Result</th><th>Runs</th><th>Errors</th><th>Median time to display</th><th>Median time to run</th></tr>
+{{range .Sections}}<tr><td>{{.Name}}</td><td>{{.Runs}}</td><td>{{.Errors}}</td><td>{{with .TimeToDisplay}}{{ms .Median}}{{else}}-{{end}}</td><td>{{with .TimeToRun}}{{ms .Median}}{{else}}-{{end}}</td></tr>
+{{end}}</table>
+{{end}}
+{{range .Sections}}
+<h2>{{.Name}}</h2>
+<p>Runs: {{.Runs}}, with errors: {{.Errors}}.</p>
+<table>
+<tr><th></th><th>N</th><th>Mean</th><th>Median</th><th>StdDev</th><th>Min</th><th>Max</th><th>P90</th><th>Variation</th></tr>
+{{with .TimeToDisplay}}<tr><td>Time to display</td><td>{{.N}}</td><td>{{ms .Mean}}</td><td>{{ms .Median}}</td><td>{{ms .StdDev}}</td><td>{{ms .Min}}</td><td>{{ms .Max}}</td><td>{{ms .P90}}</td><td>{{percent .Variation}}</td></tr>{{end}}
+{{with .TimeToRun}}<tr><td>Time to run</td><td>{{.N}}</td><td>{{ms .Mean}}</td><td>{{ms .Median}}</td><td>{{ms .StdDev}}</td><td>{{ms .Min}}</td><td>{{ms .Max}}</td><td>{{ms .P90}}</td><td>{{percent .Variation}}</td></tr>{{end}}
+</table>
+{{with .RunsChart}}
+<h3>Time to display of each run</h3>
+<svg width="{{$.Width}}" height="{{add $.Bars 20}}" xmlns="http://www.w3.org/2000/svg">
+{{range .Bars}}<rect class="bar" x="{{px .X}}" y="{{px .Y}}" width="{{px .Width}}" height="{{px .Height}}"><title>{{.Title}}</title></rect>
+<text x="{{px .X}}" y="{{$.Bars}}" dy="14">{{.Label}}</text>
+{{end}}<line class="mean" x1="0" x2="{{$.Width}}" y1="{{px .Mean}}" y2="{{px .Mean}}"><title>mean</title></line>
+</svg>
+<p>The line is the mean of the runs without errors, the highest bar is {{ms .Max}}.</p>
+{{end}}
+{{with .Timeline}}
+<h3>Startup timeline of run {{.Run}}</h3>
+<p>The run with the median time to display, {{ms .End}} from the first program to the end of the last one or the last milestone.</p>
+<svg width="{{$.Width}}" height="{{px (add .Height 20)}}" xmlns="http://www.w3.org/2000/svg">
+{{range .Bars}}<text x="0" y="{{px .Y}}" dy="11">{{.Label}}</text>
+<rect class="bar" x="{{px .X}}" y="{{px .Y}}" width="{{px .Width}}" height="{{px .Height}}"><title>{{.Title}}</title></rect>
+{{end}}{{range .Marks}}<line class="mark" x1="{{px .X}}" x2="{{px .X}}" y1="0" y2="{{px .Height}}"><title>{{.Title}}</title></line>
+<text x="{{px .X}}" y="{{px .Height}}" dy="14">{{.Label}}</text>
+{{end}}</svg>
+{{end}}
+{{if .Programs}}
+<h3>Programs executed</h3>
+<table>
+<tr><th>Start</th><th>Elapsed</th><th>Program</th></tr>
+{{range .Programs}}<tr><td>{{ms .Start}}</td><td>{{ms .Duration}}</td><td class="exe">{{.Exe}}</td></tr>
+{{end}}</table>
+{{end}}
+{{if .ByProgram}}
+<h3>Files accessed by program</h3>
+<table>
+<tr><th>Program</th><th>Files</th><th>Bytes</th></tr>
+{{range .ByProgram}}<tr><td>{{.Name}}</td><td>{{.Files}}</td><td>{{.Bytes}}</td></tr>
+{{end}}</table>
+<h3>Files accessed by directory</h3>
+<table>
+<tr><th>Directory</th><th>Files</th><th>Bytes</th></tr>
+{{range .ByDirectory}}<tr><td>{{.Name}}</td><td>{{.Files}}</td><td>{{.Bytes}}</td></tr>
+{{end}}</table>
+{{end}}
+{{end}}
+</body>
+</html>
+`))
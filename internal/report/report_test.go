@@ -0,0 +1,134 @@
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package report_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/anonymouse64/etrace/internal/report"
+	"github.com/anonymouse64/etrace/internal/strace"
+
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type reportTestSuite struct{}
+
+var _ = check.Suite(&reportTestSuite{})
+
+const execResult = `{"Runs": [
+	{"TimeToDisplay": 2500000000, "TimeToRun": 3000000000,
+	 "Milestones": [{"Name": "main-window", "Time": 2500000000}],
+	 "ExecveTiming": {"TotalTime": 3000000000, "ExeRuntimes": [
+		{"Start": "2021-07-26T10:00:00.5Z", "Exe": "/snap/foo/1/bin/foo", "TotalSec": 2500000000},
+		{"Start": "2021-07-26T10:00:00Z", "Exe": "/usr/bin/snap", "TotalSec": 500000000}
+	]}},
+	{"TimeToDisplay": 1500000000, "TimeToRun": 2000000000},
+	{"Errors": ["window did not appear"]}
+]}`
+
+const fileResult = `{"TimeToDisplay": 3000000000, "ExecvePaths": {
+	"Start": "2021-07-26T10:00:00Z",
+	"AllFiles": [
+		{"Path": "/etc/ld.so.cache", "Size": 100, "Program": "/usr/bin/snap"},
+		{"Path": "/snap/foo/1/lib/libfoo.so", "Size": 2000, "Program": "/snap/foo/1/bin/foo"},
+		{"Path": "/snap/foo/1/lib/x86_64/libbar.so", "Size": 1000, "Program": "/snap/foo/1/bin/foo"},
+		{"Path": "/gone", "Size": -1, "Program": "/snap/foo/1/bin/foo"}
+	],
+	"Processes": [
+		{"Start": "2021-07-26T10:00:00Z", "Exe": "/usr/bin/snap", "RunDuration": 1000000000},
+		{"Start": "2021-07-26T10:00:01Z", "Exe": "/snap/foo/1/bin/foo", "RunDuration": 2000000000}
+	]
+}}`
+
+func (s *reportTestSuite) TestLoadExec(c *check.C) {
+	res, err := report.Load(strings.NewReader(execResult), "foo.json")
+	c.Assert(err, check.IsNil)
+	c.Check(res.Name, check.Equals, "foo.json")
+	c.Assert(res.Runs, check.HasLen, 3)
+	// the programs are relative to the first one, in the order they started
+	c.Check(res.Runs[0].Programs, check.DeepEquals, []report.Program{
+		{Exe: "/usr/bin/snap", Start: 0, Duration: 500 * time.Millisecond},
+		{Exe: "/snap/foo/1/bin/foo", Start: 500 * time.Millisecond, Duration: 2500 * time.Millisecond},
+	})
+	c.Check(res.Runs[0].Milestones, check.DeepEquals, []report.Milestone{{Name: "main-window", Time: 2500 * time.Millisecond}})
+	c.Check(res.Runs[1].Programs, check.HasLen, 0)
+	c.Check(res.Runs[2].Errors, check.DeepEquals, []string{"window did not appear"})
+	c.Check(res.Files, check.HasLen, 0)
+}
+
+func (s *reportTestSuite) TestLoadFile(c *check.C) {
+	res, err := report.Load(strings.NewReader(fileResult), "files.json")
+	c.Assert(err, check.IsNil)
+	c.Assert(res.Runs, check.HasLen, 1)
+	c.Check(res.Runs[0].TimeToDisplay, check.Equals, 3*time.Second)
+	c.Check(res.Runs[0].Programs, check.DeepEquals, []report.Program{
+		{Exe: "/usr/bin/snap", Start: 0, Duration: time.Second},
+		{Exe: "/snap/foo/1/bin/foo", Start: time.Second, Duration: 2 * time.Second},
+	})
+	c.Check(res.Files, check.HasLen, 4)
+	c.Check(res.Files[0], check.Equals, strace.CommonFileInfo{Path: "/etc/ld.so.cache", Size: 100, Program: "/usr/bin/snap"})
+}
+
+func (s *reportTestSuite) TestLoadErrors(c *check.C) {
+	_, err := report.Load(strings.NewReader("{"), "bad.json")
+	c.Check(err, check.ErrorMatches, "cannot decode etrace result: .*")
+	_, err = report.Load(strings.NewReader(`{"Runs": []}`), "empty.json")
+	c.Check(err, check.ErrorMatches, "cannot report etrace result: no runs")
+}
+
+func (s *reportTestSuite) TestWrite(c *check.C) {
+	execRes, err := report.Load(strings.NewReader(execResult), "exec.json")
+	c.Assert(err, check.IsNil)
+	fileRes, err := report.Load(strings.NewReader(fileResult), "file.json")
+	c.Assert(err, check.IsNil)
+
+	var buf bytes.Buffer
+	c.Assert(report.Write(&buf, "Startup of foo <1>", []*report.Result{execRes, fileRes}), check.IsNil)
+	out := buf.String()
+
+	// the title is escaped
+	c.Check(out, check.Matches, `(?s)<!DOCTYPE html>.*<title>Startup of foo &lt;1&gt;</title>.*`)
+	// several results have an overview
+	c.Check(out, check.Matches, `(?s).*<h2>Overview</h2>.*<tr><td>exec.json</td><td>3</td><td>1</td><td>2000.0ms</td><td>2500.0ms</td></tr>.*`)
+	// the runs without errors are in the statistics
+	c.Check(out, check.Matches, `(?s).*<h2>exec.json</h2>\n<p>Runs: 3, with errors: 1.</p>.*<td>Time to display</td><td>2</td><td>2000.0ms</td>.*`)
+	c.Check(out, check.Matches, `(?s).*<h3>Time to display of each run</h3>.*<title>run 2: 1500.0ms</title>.*<title>run 3: window did not appear</title>.*`)
+	// the timeline is of the traced run
+	c.Check(out, check.Matches, `(?s).*<h3>Startup timeline of run 1</h3>.*<text x="0" y="16.0" dy="11">foo</text>.*<title>main-window at 2500.0ms</title>.*`)
+	c.Check(out, check.Matches, `(?s).*<tr><td>500.0ms</td><td>2500.0ms</td><td class="exe">/snap/foo/1/bin/foo</td></tr>.*`)
+	// the files are grouped by program and by directory, with the most
+	// bytes first and the sizes of missing files ignored
+	c.Check(out, check.Matches, `(?s).*<h3>Files accessed by program</h3>.*<tr><td>/snap/foo/1/bin/foo</td><td>3</td><td>3000</td></tr>\n<tr><td>/usr/bin/snap</td><td>1</td><td>100</td></tr>.*`)
+	c.Check(out, check.Matches, `(?s).*<h3>Files accessed by directory</h3>.*<tr><td>/snap/foo</td><td>2</td><td>3000</td></tr>\n<tr><td>/etc</td><td>1</td><td>100</td></tr>\n<tr><td>/</td><td>1</td><td>0</td></tr>.*`)
+	// a single file result has no runs chart
+	c.Check(strings.Count(out, "Time to display of each run"), check.Equals, 1)
+}
+
+func (s *reportTestSuite) TestWriteSingle(c *check.C) {
+	res, err := report.Load(strings.NewReader(execResult), "exec.json")
+	c.Assert(err, check.IsNil)
+	var buf bytes.Buffer
+	c.Assert(report.Write(&buf, "foo", []*report.Result{res}), check.IsNil)
+	c.Check(buf.String(), check.Not(check.Matches), `(?s).*Overview.*`)
+	c.Check(buf.String(), check.Not(check.Matches), `(?s).*Files accessed.*`)
+}
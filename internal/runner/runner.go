@@ -0,0 +1,324 @@
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package runner has the steps of a run of a program shared by etrace exec and
+// the trace package: tracing it, finding its processes, closing its windows and
+// killing what it left running.
+package runner
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"github.com/anonymouse64/etrace/internal/cgroup"
+	"github.com/anonymouse64/etrace/internal/pidfd"
+	"github.com/anonymouse64/etrace/internal/proctree"
+	"github.com/anonymouse64/etrace/internal/xdotool"
+)
+
+// Env is the environment variable set to the ID of the run for all the
+// processes of the run when it doesn't have its own cgroup
+const Env = "ETRACE_RUN"
+
+// leftoverGracePeriod is how long the processes of a run have to exit on their
+// own after the run before they are killed
+var leftoverGracePeriod = time.Second
+
+// leftoverPollInterval is how often to check if the processes of a run exited
+var leftoverPollInterval = 50 * time.Millisecond
+
+// DefaultExitTimeout is how long the command of a run has to exit after its
+// windows were closed before its processes are leftovers too
+const DefaultExitTimeout = 10 * time.Second
+
+// Run is a run of a program, whose processes are the ones with Env set to its
+// ID, which they keep even if they daemonized, and the ones in its cgroup if it
+// has one.
+type Run struct {
+	// ID identifies the run among the others of etrace
+	ID string
+	// Group is the cgroup of the run, if it has one
+	Group *cgroup.Group
+	// ExitTimeout is how long the command has to exit after its windows
+	// were closed, DefaultExitTimeout if zero
+	ExitTimeout time.Duration
+}
+
+// Prepare makes the command start as a process of the run, keeping the
+// environment the command already has. Started must be called once the command
+// started.
+func (r *Run) Prepare(cmd *exec.Cmd) {
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, Env+"="+r.ID)
+}
+
+// Started moves the command of the run which started with the given pid into
+// the cgroup of the run if it has one.
+func (r *Run) Started(pid int) error {
+	if r.Group == nil {
+		return nil
+	}
+	return r.Group.Add(pid)
+}
+
+// Processes returns the processes of the run.
+func (r *Run) Processes() ([]proctree.Process, error) {
+	// the processes the command started before it was moved into the
+	// cgroup are only found with Env
+	procs, err := proctree.WithEnv(Env, r.ID)
+	if err != nil || r.Group == nil {
+		return procs, err
+	}
+	pids, err := r.Group.Pids()
+	if err != nil {
+		return nil, err
+	}
+	found := make(map[int]bool, len(procs))
+	for _, proc := range procs {
+		found[proc.Pid] = true
+	}
+	for _, pid := range pids {
+		if found[pid] {
+			continue
+		}
+		proc, err := proctree.Stat(pid)
+		if err != nil {
+			// the process exited since the pids were listed
+			continue
+		}
+		procs = append(procs, proc)
+	}
+	return procs, nil
+}
+
+// ProgramPids returns a function listing the pids of the processes of the run
+// which are the program's, even the ones which daemonized, leaving out sudo and
+// strace when they start the command with the given pid, as they are not part
+// of the startup of the program.
+func (r *Run) ProgramPids(cmdPid int, traced bool) func() ([]int, error) {
+	return func() ([]int, error) {
+		procs, err := r.Processes()
+		if err != nil {
+			return nil, err
+		}
+		tracers := make(map[int]bool)
+		if traced {
+			tracers[cmdPid] = true
+			// sudo may fork before executing strace, which forks the
+			// program
+			for found := true; found; {
+				found = false
+				for _, proc := range procs {
+					if !tracers[proc.Pid] && tracers[proc.PPid] && (proc.Comm == "sudo" || proc.Comm == "strace") {
+						tracers[proc.Pid] = true
+						found = true
+					}
+				}
+			}
+		}
+		pids := make([]int, 0, len(procs))
+		for _, proc := range procs {
+			if !tracers[proc.Pid] {
+				pids = append(pids, proc.Pid)
+			}
+		}
+		return pids, nil
+	}
+}
+
+// killProcess kills a process of the run, unless it exited since it was
+// listed, without killing another process which got its pid since.
+func killProcess(proc proctree.Process) error {
+	p, err := pidfd.Open(proc.Pid)
+	if err == syscall.ESRCH {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer p.Close()
+	// the pidfd refers to the listed process if the process with the pid
+	// still started at the same time
+	if now, err := proctree.Stat(proc.Pid); err != nil || now.StartTime != proc.StartTime {
+		return nil
+	}
+	return p.Kill()
+}
+
+// killPasses is how many times Kill lists the processes of the run at most,
+// as the processes can start others until they are killed
+const killPasses = 10
+
+// Kill kills all the processes of the run right away, including the ones they
+// started while they were being killed. It returns the first error killing
+// them, after trying to kill all of them.
+func (r *Run) Kill() error {
+	type key struct {
+		pid   int
+		start uint64
+	}
+	killed := make(map[key]bool)
+	var firstErr error
+	for i := 0; i < killPasses; i++ {
+		procs, err := r.Processes()
+		if err != nil {
+			return fmt.Errorf("listing processes of the run: %w", err)
+		}
+		found := false
+		for _, proc := range procs {
+			k := key{proc.Pid, proc.StartTime}
+			if killed[k] {
+				// it was killed but wasn't reaped yet
+				continue
+			}
+			found = true
+			killed[k] = true
+			if err := killProcess(proc); err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("killing process pid %d: %w", proc.Pid, err)
+			}
+		}
+		if !found {
+			break
+		}
+	}
+	return firstErr
+}
+
+// KillLeftovers kills the processes of the run which are still running after
+// the grace period, except for the command with the given pid, which is waited
+// for by the caller. The processes of the tree of the command aren't leftovers
+// until done is closed once the command exited, or until the exit timeout of
+// the run, as programs can take a while to exit after their windows were
+// closed. It returns the leftovers it killed, and the first error killing
+// them after trying to kill all of them.
+func (r *Run) KillLeftovers(main int, done <-chan struct{}) ([]proctree.Process, error) {
+	exitTimeout := r.ExitTimeout
+	if exitTimeout == 0 {
+		exitTimeout = DefaultExitTimeout
+	}
+	start := time.Now()
+	deadline := start.Add(leftoverGracePeriod)
+	exited := false
+	for {
+		if !exited {
+			select {
+			case <-done:
+				exited = true
+				// what the command left running gets the grace period
+				// too
+				if d := time.Now().Add(leftoverGracePeriod); d.After(deadline) {
+					deadline = d
+				}
+			default:
+			}
+		}
+		// the tree of the command is taken after listing the processes,
+		// so that the ones it forked meanwhile are in it too
+		procs, err := r.Processes()
+		if err != nil {
+			return nil, fmt.Errorf("listing leftover processes: %w", err)
+		}
+		exempt := map[int]bool{main: true}
+		waitMain := !exited && time.Since(start) < exitTimeout
+		if waitMain {
+			tree, err := proctree.Snapshot(main)
+			if err != nil {
+				// the command exited since the processes were
+				// listed, which done tells soon
+				time.Sleep(leftoverPollInterval)
+				continue
+			}
+			for _, proc := range tree.Processes {
+				exempt[proc.Pid] = true
+			}
+		}
+		var leftovers []proctree.Process
+		for _, proc := range procs {
+			if !exempt[proc.Pid] {
+				leftovers = append(leftovers, proc)
+			}
+		}
+		if len(leftovers) == 0 && !waitMain {
+			return nil, nil
+		}
+		if len(leftovers) == 0 || time.Now().Before(deadline) {
+			time.Sleep(leftoverPollInterval)
+			continue
+		}
+
+		var firstErr error
+		for _, proc := range leftovers {
+			if err := killProcess(proc); err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("killing leftover process pid %d: %w", proc.Pid, err)
+			}
+		}
+		return leftovers, firstErr
+	}
+}
+
+// CloseWindows closes the windows and kills the processes that own them. It
+// returns the first error, after trying to close all of them.
+func CloseWindows(xtool xdotool.Xtooler, wids []string) error {
+	var firstErr error
+	fail := func(err error) {
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	// now get the processes before closing the window so we can gracefully
+	// try closing the windows before forcibly killing them later, through
+	// pidfds since their pids may be reused once they exited
+	var procs []*pidfd.Process
+	for _, wid := range wids {
+		pid, err := xtool.PidForWindowID(wid)
+		if err != nil {
+			fail(fmt.Errorf("getting pid for wid %s: %w", wid, err))
+			break
+		}
+		proc, err := pidfd.Open(pid)
+		if err != nil {
+			// the process may have already exited
+			if err != syscall.ESRCH {
+				fail(fmt.Errorf("opening window process pid %d: %w", pid, err))
+			}
+			continue
+		}
+		defer proc.Close()
+		procs = append(procs, proc)
+	}
+
+	// close the windows
+	for _, wid := range wids {
+		if err := xtool.CloseWindowID(wid); err != nil {
+			fail(fmt.Errorf("closing window: %w", err))
+		}
+	}
+
+	// kill the app processes in case x fails to close the window, which
+	// may have already exited after their window was closed
+	for _, proc := range procs {
+		if err := proc.Kill(); err != nil {
+			fail(fmt.Errorf("killing window process pid %d: %w", proc.Pid, err))
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,288 @@
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package runner_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/anonymouse64/etrace/internal/proctree"
+	"github.com/anonymouse64/etrace/internal/runner"
+	"github.com/anonymouse64/etrace/internal/strace"
+	"github.com/anonymouse64/etrace/internal/xdotool"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type runnerTestSuite struct{}
+
+var _ = Suite(&runnerTestSuite{})
+
+func (p *runnerTestSuite) TestPrepare(c *C) {
+	cmd := exec.Command("true")
+	(&runner.Run{ID: "test-prepare"}).Prepare(cmd)
+	c.Check(cmd.Env[len(cmd.Env)-1], Equals, "ETRACE_RUN=test-prepare")
+	c.Check(len(cmd.Env) > 1, Equals, true)
+
+	// the environment the command has is kept
+	cmd = exec.Command("true")
+	cmd.Env = []string{"A=b"}
+	(&runner.Run{ID: "test-prepare"}).Prepare(cmd)
+	c.Check(cmd.Env, DeepEquals, []string{"A=b", "ETRACE_RUN=test-prepare"})
+}
+
+func (p *runnerTestSuite) TestKillLeftovers(c *C) {
+	restore := runner.MockLeftoverGracePeriod(100 * time.Millisecond)
+	defer restore()
+
+	var cmds []*exec.Cmd
+	for _, runID := range []string{"test-1", "test-1", "test-2"} {
+		cmd := exec.Command("sleep", "10")
+		cmd.Env = append(os.Environ(), "ETRACE_RUN="+runID)
+		c.Assert(cmd.Start(), IsNil)
+		defer cmd.Process.Kill()
+		cmds = append(cmds, cmd)
+	}
+
+	// the command exited already
+	done := make(chan struct{})
+	close(done)
+	start := time.Now()
+	leftovers, err := (&runner.Run{ID: "test-1"}).KillLeftovers(cmds[0].Process.Pid, done)
+	c.Assert(err, IsNil)
+	c.Assert(leftovers, HasLen, 1)
+	c.Check(leftovers[0].Pid, Equals, cmds[1].Process.Pid)
+	c.Check(time.Since(start) >= 100*time.Millisecond, Equals, true)
+
+	// only the leftover of the run which is not excepted is killed
+	c.Assert(cmds[1].Wait(), ErrorMatches, "signal: killed")
+	for _, cmd := range []*exec.Cmd{cmds[0], cmds[2]} {
+		c.Check(cmd.Process.Signal(syscall.Signal(0)), IsNil)
+	}
+}
+
+func (p *runnerTestSuite) TestKillLeftoversWaitsForCommand(c *C) {
+	restore := runner.MockLeftoverGracePeriod(100 * time.Millisecond)
+	defer restore()
+
+	// the child of the command runs for longer than the grace period, but
+	// the command waits for it
+	cmd := exec.Command("sh", "-c", "sleep 0.5 & wait")
+	cmd.Env = append(os.Environ(), "ETRACE_RUN=test-exit")
+	c.Assert(cmd.Start(), IsNil)
+	defer cmd.Process.Kill()
+	done := make(chan struct{})
+	waitErr := make(chan error, 1)
+	go func() {
+		err := cmd.Wait()
+		close(done)
+		waitErr <- err
+	}()
+
+	start := time.Now()
+	leftovers, err := (&runner.Run{ID: "test-exit"}).KillLeftovers(cmd.Process.Pid, done)
+	c.Assert(err, IsNil)
+	c.Check(leftovers, HasLen, 0)
+	c.Check(time.Since(start) >= 500*time.Millisecond, Equals, true)
+	c.Check(<-waitErr, IsNil)
+}
+
+func (p *runnerTestSuite) TestProgramPids(c *C) {
+	cmd := exec.Command("sh", "-c", "sleep 10 & wait")
+	cmd.Env = append(os.Environ(), "ETRACE_RUN=test-pids")
+	c.Assert(cmd.Start(), IsNil)
+	defer cmd.Wait()
+	defer cmd.Process.Kill()
+
+	var sleepPid int
+	for i := 0; i < 100 && sleepPid == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		tree, err := proctree.Snapshot(cmd.Process.Pid)
+		c.Assert(err, IsNil)
+		for _, proc := range tree.Processes {
+			if proc.Comm == "sleep" {
+				sleepPid = proc.Pid
+			}
+		}
+	}
+	c.Assert(sleepPid, Not(Equals), 0)
+	defer syscall.Kill(sleepPid, syscall.SIGKILL)
+
+	pids, err := (&runner.Run{ID: "test-pids"}).ProgramPids(cmd.Process.Pid, false)()
+	c.Assert(err, IsNil)
+	sort.Ints(pids)
+	c.Check(pids, DeepEquals, []int{cmd.Process.Pid, sleepPid})
+
+	// the command is left out as the tracer, but not its children which are
+	// not sudo nor strace
+	pids, err = (&runner.Run{ID: "test-pids"}).ProgramPids(cmd.Process.Pid, true)()
+	c.Assert(err, IsNil)
+	c.Check(pids, DeepEquals, []int{sleepPid})
+}
+
+func (p *runnerTestSuite) TestKillLeftoversExitTimeout(c *C) {
+	restore := runner.MockLeftoverGracePeriod(0)
+	defer restore()
+
+	// the command doesn't exit, so its child is a leftover too after the
+	// exit timeout
+	cmd := exec.Command("sh", "-c", "sleep 10 & wait")
+	cmd.Env = append(os.Environ(), "ETRACE_RUN=test-exit-timeout")
+	c.Assert(cmd.Start(), IsNil)
+	defer cmd.Wait()
+	defer cmd.Process.Kill()
+
+	start := time.Now()
+	run := &runner.Run{ID: "test-exit-timeout", ExitTimeout: 100 * time.Millisecond}
+	leftovers, err := run.KillLeftovers(cmd.Process.Pid, nil)
+	c.Assert(err, IsNil)
+	c.Check(time.Since(start) >= 100*time.Millisecond, Equals, true)
+	c.Assert(leftovers, HasLen, 1)
+	c.Check(leftovers[0].Comm, Equals, "sleep")
+	// the command itself is left to the caller
+	c.Check(cmd.Process.Signal(syscall.Signal(0)), IsNil)
+}
+
+func (p *runnerTestSuite) TestKill(c *C) {
+	cmd := exec.Command("sh", "-c", "sleep 10 & wait")
+	run := &runner.Run{ID: "test-kill"}
+	run.Prepare(cmd)
+	c.Assert(cmd.Start(), IsNil)
+
+	// the program and what it started are killed
+	c.Assert(run.Kill(), IsNil)
+	c.Check(cmd.Wait(), ErrorMatches, "signal: killed")
+	for i := 0; i < 100; i++ {
+		procs, err := run.Processes()
+		c.Assert(err, IsNil)
+		if len(procs) == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Fatal("the processes of the run were not killed")
+}
+
+// fakeTool has windows owned by the processes in pids
+type fakeTool struct {
+	xdotool.Xtooler
+	pids   map[string]int
+	closed []string
+}
+
+func (t *fakeTool) PidForWindowID(wid string) (int, error) {
+	pid, ok := t.pids[wid]
+	if !ok {
+		return 0, fmt.Errorf("no such window")
+	}
+	return pid, nil
+}
+
+func (t *fakeTool) CloseWindowID(wid string) error {
+	t.closed = append(t.closed, wid)
+	return nil
+}
+
+func (p *runnerTestSuite) TestCloseWindows(c *C) {
+	cmd := exec.Command("sleep", "10")
+	c.Assert(cmd.Start(), IsNil)
+
+	tool := &fakeTool{pids: map[string]int{"1": cmd.Process.Pid}}
+	c.Assert(runner.CloseWindows(tool, []string{"1"}), IsNil)
+	c.Check(tool.closed, DeepEquals, []string{"1"})
+	// the program didn't exit once its window was closed
+	c.Check(cmd.Wait(), ErrorMatches, "signal: killed")
+
+	// the windows are closed even if their process isn't found
+	tool = &fakeTool{}
+	c.Assert(runner.CloseWindows(tool, []string{"2"}), ErrorMatches, "getting pid for wid 2: no such window")
+	c.Check(tool.closed, DeepEquals, []string{"2"})
+}
+
+func (p *runnerTestSuite) TestTrace(c *C) {
+	tr, err := runner.StartTrace(runner.TraceOptions{Scope: strace.ScopeAll})
+	c.Assert(err, IsNil)
+	defer tr.Remove()
+
+	// write the trace like strace would
+	f, err := os.OpenFile(tr.Log(), os.O_WRONLY, 0)
+	c.Assert(err, IsNil)
+	_, err = f.WriteString(`100 1542815326.000000 execve("/usr/bin/launcher", ["launcher"], 0x1566008 /* 69 vars */) = 0
+100 1542815326.600000 execve("/usr/bin/app", ["app"], 0x1566008 /* 69 vars */) = 0
+100 1542815327.000000 +++ exited with 0 +++
+`)
+	c.Assert(err, IsNil)
+	c.Assert(f.Close(), IsNil)
+
+	res := tr.Wait()
+	c.Assert(res.Err, IsNil)
+	c.Check(res.Capture, NotNil)
+	c.Assert(res.Timing.ExeRuntimes, HasLen, 2)
+	c.Check(res.Timing.ExeRuntimes[0].Exe, Equals, "/usr/bin/launcher")
+	c.Check(res.Timing.ExeRuntimes[1].Exe, Equals, "/usr/bin/app")
+	c.Check(res.Timing.TotalTime, Equals, time.Second)
+}
+
+func (p *runnerTestSuite) TestTraceExceeded(c *C) {
+	exceeded := 0
+	tr, err := runner.StartTrace(runner.TraceOptions{
+		Scope:  strace.ScopeAll,
+		Limits: strace.Limits{MaxExecs: 1},
+		Parse: func(parse func()) time.Duration {
+			parse()
+			return time.Millisecond
+		},
+		Exceeded: func() error {
+			exceeded++
+			return fmt.Errorf("cannot stop the run")
+		},
+	})
+	c.Assert(err, IsNil)
+	defer tr.Remove()
+
+	f, err := os.OpenFile(tr.Log(), os.O_WRONLY, 0)
+	c.Assert(err, IsNil)
+	defer f.Close()
+	// the run is stopped while strace still writes the trace
+	_, err = f.WriteString(`100 1542815326.000000 execve("/usr/bin/launcher", ["launcher"], 0x1566008 /* 69 vars */) = 0
+100 1542815326.600000 execve("/usr/bin/app", ["app"], 0x1566008 /* 69 vars */) = 0
+`)
+	c.Assert(err, IsNil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	done := make(chan runner.TraceResult, 1)
+	go func() { done <- tr.Wait() }()
+	select {
+	case res := <-done:
+		c.Check(res.Err, ErrorMatches, "traced program executed more than the limit of 1 programs")
+		c.Check(res.ExceededErr, ErrorMatches, "cannot stop the run")
+		c.Check(res.ParseTime, Equals, time.Millisecond)
+		c.Check(exceeded, Equals, 1)
+	case <-ctx.Done():
+		c.Fatal("the trace was still read after it exceeded its limits")
+	}
+}
@@ -0,0 +1,161 @@
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package runner
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/anonymouse64/etrace/internal/capture"
+	"github.com/anonymouse64/etrace/internal/strace"
+)
+
+// TraceOptions is how to trace a run
+type TraceOptions struct {
+	// Log is the fifo strace writes the trace to, like the one of a session,
+	// a new one is made if it is empty
+	Log string
+	// Scope is the processes whose programs are kept from the trace
+	Scope strace.Scope
+	// Exec is what is traced besides the execve syscalls
+	Exec strace.ExecOptions
+	// Limits are the limits of the trace
+	Limits strace.Limits
+	// Parse runs the parsing of the trace and returns the CPU time it took,
+	// if set
+	Parse func(parse func()) time.Duration
+	// Exceeded is called once the trace exceeded its limits, as nothing reads
+	// it anymore, and returns the error stopping the run
+	Exceeded func() error
+}
+
+// TraceResult is what was parsed from the trace of a run
+type TraceResult struct {
+	Capture *capture.Capture
+	Timing  *strace.ExecveTiming
+	Err     error
+	// ParseTime is the CPU time spent parsing the trace
+	ParseTime time.Duration
+	// ExceededErr is the error stopping the run after the trace exceeded its
+	// limits
+	ExceededErr error
+}
+
+// Trace is the trace of a run, which strace writes to a fifo which is parsed
+// while the program runs
+type Trace struct {
+	log   string
+	dir   string
+	scope strace.Scope
+	exec  strace.ExecOptions
+	fw    *os.File
+	done  chan TraceResult
+}
+
+// StartTrace starts reading the trace of a run.
+func StartTrace(opts TraceOptions) (*Trace, error) {
+	t := &Trace{log: opts.Log, scope: opts.Scope, exec: opts.Exec, done: make(chan TraceResult, 1)}
+	if t.log == "" {
+		// setup private tmp dir with strace fifo
+		dir, err := ioutil.TempDir("", "exec-trace")
+		if err != nil {
+			return nil, err
+		}
+		t.dir = dir
+		t.log = filepath.Join(dir, "strace.fifo")
+		if err := syscall.Mkfifo(t.log, 0640); err != nil {
+			t.Remove()
+			return nil, err
+		}
+	}
+	// ensure we have one writer on the fifo so that if strace fails nothing
+	// blocks
+	fw, err := os.OpenFile(t.log, os.O_RDWR, 0640)
+	if err != nil {
+		t.Remove()
+		return nil, err
+	}
+	t.fw = fw
+	// open the fifo for reading right away, as it would block once strace
+	// exited and the writer above was closed
+	fr, err := os.Open(t.log)
+	if err != nil {
+		t.Remove()
+		return nil, err
+	}
+
+	// read strace data from fifo async
+	go func() {
+		defer fr.Close()
+		var res TraceResult
+		parse := func() {
+			res.Capture, res.Err = strace.CaptureExecveFrom(fr, opts.Scope, opts.Limits)
+			if res.Err == nil {
+				res.Timing = strace.ExecveTimingFromCapture(res.Capture, -1)
+			}
+		}
+		if opts.Parse != nil {
+			res.ParseTime = opts.Parse(parse)
+		} else {
+			parse()
+		}
+		var limitErr *strace.LimitError
+		if errors.As(res.Err, &limitErr) && opts.Exceeded != nil {
+			// nothing reads the trace anymore, so stop the run right away
+			res.ExceededErr = opts.Exceeded()
+		}
+		t.done <- res
+		close(t.done)
+	}()
+	return t, nil
+}
+
+// Log returns the fifo strace writes the trace to.
+func (t *Trace) Log() string {
+	return t.log
+}
+
+// Command returns the command running the program under strace, as root if
+// privileged is true.
+func (t *Trace) Command(privileged bool, args ...string) (*exec.Cmd, error) {
+	return strace.TraceExecCommand(t.log, privileged, t.scope, t.exec, args...)
+}
+
+// Wait waits for the trace to be parsed once strace exited and returns what
+// was parsed.
+func (t *Trace) Wait() TraceResult {
+	// ensure we close the fifo here so that the parsing gets an EOF from the
+	// fifo (i.e. all writers must be closed for this)
+	t.fw.Close()
+	return <-t.done
+}
+
+// Remove removes the fifo made for the trace.
+func (t *Trace) Remove() {
+	if t.fw != nil {
+		t.fw.Close()
+	}
+	if t.dir != "" {
+		os.RemoveAll(t.dir)
+	}
+}
@@ -0,0 +1,108 @@
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package schema handles the versions of the JSON results of etrace. In the
+// first version durations are integers of nanoseconds, like encoding/json
+// encodes a time.Duration, which is awkward to consume from other languages.
+// Since version 2, durations are objects with both the nanoseconds and the
+// duration as text, like {"ns": 1234000000, "text": "1.234s"}.
+//
+// The types of the results with durations have a Structured method returning
+// them as encoded since version 2, usually as a struct embedding the type
+// without its methods along with fields which shadow the ones with durations,
+// which encoding/json encodes in place of the embedded ones.
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+)
+
+const (
+	// Legacy is the version of results with durations as nanoseconds
+	Legacy = 1
+	// Latest is the version of results with structured durations
+	Latest = 2
+)
+
+// Duration is a duration as encoded since version 2
+type Duration struct {
+	NS   int64  `json:"ns"`
+	Text string `json:"text"`
+}
+
+// NewDuration returns the duration as encoded since version 2.
+func NewDuration(d time.Duration) Duration {
+	return Duration{NS: int64(d), Text: d.String()}
+}
+
+// OptionalDuration returns the duration as encoded since version 2, or nil if
+// it is zero so that a field with omitempty is still left out.
+func OptionalDuration(d time.Duration) *Duration {
+	if d == 0 {
+		return nil
+	}
+	sd := NewDuration(d)
+	return &sd
+}
+
+// Durations returns the durations as encoded since version 2.
+func Durations(ds []time.Duration) []Duration {
+	if ds == nil {
+		return nil
+	}
+	sds := make([]Duration, 0, len(ds))
+	for _, d := range ds {
+		sds = append(sds, NewDuration(d))
+	}
+	return sds
+}
+
+// Downgrade converts a JSON result of any version to the first version, so
+// that it can be decoded into types with time.Duration fields.
+func Downgrade(data []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	// keep the nanoseconds exact
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(legacy(v))
+}
+
+func legacy(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if len(v) == 2 {
+			ns, isNumber := v["ns"].(json.Number)
+			_, isText := v["text"].(string)
+			if isNumber && isText {
+				return ns
+			}
+		}
+		for k, elem := range v {
+			v[k] = legacy(elem)
+		}
+	case []interface{}:
+		for i, elem := range v {
+			v[i] = legacy(elem)
+		}
+	}
+	return v
+}
@@ -0,0 +1,56 @@
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package schema_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/anonymouse64/etrace/internal/schema"
+
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type schemaTestSuite struct{}
+
+var _ = check.Suite(&schemaTestSuite{})
+
+func (s *schemaTestSuite) TestDurations(c *check.C) {
+	c.Check(schema.NewDuration(1234*time.Millisecond), check.DeepEquals, schema.Duration{NS: 1234000000, Text: "1.234s"})
+	c.Check(schema.NewDuration(0), check.DeepEquals, schema.Duration{NS: 0, Text: "0s"})
+
+	c.Check(schema.OptionalDuration(time.Microsecond), check.DeepEquals, &schema.Duration{NS: 1000, Text: "1µs"})
+	c.Check(schema.OptionalDuration(0), check.IsNil)
+
+	c.Check(schema.Durations([]time.Duration{1, time.Minute}), check.DeepEquals, []schema.Duration{{NS: 1, Text: "1ns"}, {NS: 60000000000, Text: "1m0s"}})
+	c.Check(schema.Durations(nil), check.IsNil)
+	c.Check(schema.Durations([]time.Duration{}), check.DeepEquals, []schema.Duration{})
+}
+
+func (s *schemaTestSuite) TestDowngrade(c *check.C) {
+	out := []byte(`{"Start":"2021-07-26T10:00:00Z","Total":{"ns":1234000000,"text":"1.234s"},"Inner":{"Took":{"ns":5000000,"text":"5ms"}},"Steps":[{"Took":{"ns":1000,"text":"1µs"}}],"Other":{"ns":1,"text":"1ns","more":true},"Count":3}`)
+	// results of both versions decode the same after being downgraded
+	legacy, err := schema.Downgrade(out)
+	c.Assert(err, check.IsNil)
+	c.Check(string(legacy), check.Equals, `{"Count":3,"Inner":{"Took":5000000},"Other":{"more":true,"ns":1,"text":"1ns"},"Start":"2021-07-26T10:00:00Z","Steps":[{"Took":1000}],"Total":1234000000}`)
+
+	_, err = schema.Downgrade([]byte("garbage"))
+	c.Check(err, check.NotNil)
+}
@@ -0,0 +1,54 @@
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package session
+
+import "time"
+
+var IsTraced = isTraced
+
+func MockSudo(new string) (restore func()) {
+	old := sudo
+	sudo = new
+	return func() {
+		sudo = old
+	}
+}
+
+func MockGeteuid(uid int) (restore func()) {
+	old := geteuid
+	geteuid = func() int { return uid }
+	return func() {
+		geteuid = old
+	}
+}
+
+func MockProcRoot(new string) (restore func()) {
+	old := procRoot
+	procRoot = new
+	return func() {
+		procRoot = old
+	}
+}
+
+func MockSudoRefreshInterval(new time.Duration) (restore func()) {
+	old := sudoRefreshInterval
+	sudoRefreshInterval = new
+	return func() {
+		sudoRefreshInterval = old
+	}
+}
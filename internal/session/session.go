@@ -0,0 +1,253 @@
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package session keeps what the runs of a measurement need to trace the
+// program set up across the runs, so that each run doesn't pay for setting it
+// up again while it is measured.
+package session
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/anonymouse64/etrace/internal/strace"
+)
+
+var (
+	sudo    = "sudo"
+	geteuid = os.Geteuid
+	// procRoot is where the status of the processes is read from
+	procRoot = "/proc"
+	// sudoRefreshInterval is how often the sudo credentials are refreshed,
+	// well within the 15 minutes they last by default
+	sudoRefreshInterval = time.Minute
+	// attachTimeout is how long strace may take to attach to a program
+	attachTimeout = 5 * time.Second
+	// attachPollInterval is how often to check whether strace attached
+	attachPollInterval = time.Millisecond
+)
+
+// gateScript holds the program back until a line is written to fd 3, and
+// exits without running it when fd 3 is closed instead. The program is then
+// executed in the same process, which is what strace attached to.
+const gateScript = `read -r line <&3 || exit 1; exec 3<&-; exec "$@"`
+
+// Session is what the runs of a measurement share
+type Session struct {
+	dir  string
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Start starts a session, asking for the sudo credentials once if not root
+// and keeping them fresh until the session is closed, and creates the fifo
+// strace writes its log of each run to.
+func Start() (*Session, error) {
+	root := geteuid() == 0
+	if !root {
+		cmd := exec.Command(sudo, "-v")
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return nil, fmt.Errorf("cannot get sudo credentials: %v", err)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "etrace-session")
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Mkfifo(filepath.Join(dir, "strace.fifo"), 0640); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	s := &Session{
+		dir:  dir,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	if root {
+		close(s.done)
+	} else {
+		go s.refreshSudo()
+	}
+	return s, nil
+}
+
+func (s *Session) refreshSudo() {
+	defer close(s.done)
+	ticker := time.NewTicker(sudoRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			// without a password prompt, the credentials are fresh
+			if out, err := exec.Command(sudo, "-n", "-v").CombinedOutput(); err != nil {
+				log.Printf("warning: cannot refresh sudo credentials: %v: %s", err, strings.TrimSpace(string(out)))
+			}
+		}
+	}
+}
+
+// StraceLog returns the path of the fifo strace writes its log to.
+func (s *Session) StraceLog() string {
+	return filepath.Join(s.dir, "strace.fifo")
+}
+
+// Close stops refreshing the sudo credentials and removes the fifo.
+func (s *Session) Close() error {
+	close(s.stop)
+	<-s.done
+	return os.RemoveAll(s.dir)
+}
+
+// Gate holds back a program started with GatedCommand
+type Gate struct {
+	r, w *os.File
+}
+
+// GatedCommand returns a command which waits for the gate to be released
+// before executing the program, so that strace can attach to it before it
+// runs.
+func GatedCommand(name string, args ...string) (*exec.Cmd, *Gate, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	cmd := exec.Command("/bin/sh", append([]string{"-c", gateScript, "etrace-gate", name}, args...)...)
+	cmd.ExtraFiles = []*os.File{r}
+	return cmd, &Gate{r: r, w: w}, nil
+}
+
+// Release lets the program run.
+func (g *Gate) Release() error {
+	g.r.Close()
+	_, err := g.w.Write([]byte("\n"))
+	g.w.Close()
+	return err
+}
+
+// Close makes the program exit without running if it wasn't released.
+func (g *Gate) Close() error {
+	g.r.Close()
+	return g.w.Close()
+}
+
+// Tracer is strace attached to a program
+type Tracer struct {
+	cmd    *exec.Cmd
+	stderr bytes.Buffer
+	exited chan struct{}
+	err    error
+}
+
+// Attach attaches strace to the process pid, which is held back by a gate,
+// and waits until it is traced. strace writes the execve{,at}() calls of the
+// process and of the processes it forks to the fifo of the session, and exits
+// once they all exited, along with what else opts asks for.
+func (s *Session) Attach(pid int, scope strace.Scope, opts strace.ExecOptions) (*Tracer, error) {
+	cmd, err := strace.AttachExecCommand(s.StraceLog(), pid, scope, opts)
+	if err != nil {
+		return nil, err
+	}
+	t := &Tracer{cmd: cmd, exited: make(chan struct{})}
+	cmd.Stderr = &t.stderr
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	go func() {
+		t.err = cmd.Wait()
+		close(t.exited)
+	}()
+
+	timeout := time.After(attachTimeout)
+	for {
+		traced, err := isTraced(pid)
+		if err != nil {
+			return nil, err
+		}
+		if traced {
+			return t, nil
+		}
+		select {
+		case <-t.exited:
+			return nil, fmt.Errorf("cannot attach strace to process %d: %v", pid, t.failure())
+		case <-timeout:
+			// sudo passes SIGTERM on to strace, but not SIGKILL
+			t.Stop()
+			return nil, fmt.Errorf("timed out attaching strace to process %d", pid)
+		case <-time.After(attachPollInterval):
+		}
+	}
+}
+
+// Stop stops strace, which detaches from the processes it still traces.
+func (t *Tracer) Stop() error {
+	return t.cmd.Process.Signal(syscall.SIGTERM)
+}
+
+// Wait waits for strace to exit.
+func (t *Tracer) Wait() error {
+	<-t.exited
+	if t.err != nil {
+		return fmt.Errorf("strace failed: %v", t.failure())
+	}
+	return nil
+}
+
+func (t *Tracer) failure() string {
+	if msg := strings.TrimSpace(t.stderr.String()); msg != "" {
+		return msg
+	}
+	if t.err != nil {
+		return t.err.Error()
+	}
+	return "strace exited"
+}
+
+// isTraced returns whether a tracer is attached to the process pid.
+func isTraced(pid int) (bool, error) {
+	f, err := os.Open(filepath.Join(procRoot, strconv.Itoa(pid), "status"))
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if v := strings.TrimPrefix(s.Text(), "TracerPid:"); v != s.Text() {
+			return strings.TrimSpace(v) != "0", nil
+		}
+	}
+	if err := s.Err(); err != nil {
+		return false, err
+	}
+	return false, fmt.Errorf("cannot find the tracer of process %d", pid)
+}
@@ -0,0 +1,154 @@
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package session_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/anonymouse64/etrace/internal/session"
+
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type sessionTestSuite struct{}
+
+var _ = check.Suite(&sessionTestSuite{})
+
+// mockSudo logs the arguments it was called with to the returned file
+func mockSudo(c *check.C, script string) (log string, restore func()) {
+	dir := c.MkDir()
+	log = filepath.Join(dir, "log")
+	sudo := filepath.Join(dir, "sudo")
+	c.Assert(ioutil.WriteFile(sudo, []byte("#!/bin/sh\nprintf '%s\\n' \"$*\" >> "+log+"\n"+script), 0755), check.IsNil)
+	return log, session.MockSudo(sudo)
+}
+
+func (p *sessionTestSuite) TestStartClose(c *check.C) {
+	defer session.MockGeteuid(1000)()
+	defer session.MockSudoRefreshInterval(5 * time.Millisecond)()
+	log, restore := mockSudo(c, "")
+	defer restore()
+
+	s, err := session.Start()
+	c.Assert(err, check.IsNil)
+	fi, err := os.Stat(s.StraceLog())
+	c.Assert(err, check.IsNil)
+	c.Check(fi.Mode()&os.ModeNamedPipe, check.Not(check.Equals), os.FileMode(0))
+
+	// the credentials are kept fresh until the session is closed
+	for i := 0; i < 100; i++ {
+		out, err := ioutil.ReadFile(log)
+		c.Assert(err, check.IsNil)
+		if strings.Count(string(out), "\n") >= 3 {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	c.Assert(s.Close(), check.IsNil)
+	out, err := ioutil.ReadFile(log)
+	c.Assert(err, check.IsNil)
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	c.Assert(len(lines) >= 3, check.Equals, true)
+	c.Check(lines[0], check.Equals, "-v")
+	for _, line := range lines[1:] {
+		c.Check(line, check.Equals, "-n -v")
+	}
+
+	_, err = os.Stat(filepath.Dir(s.StraceLog()))
+	c.Check(os.IsNotExist(err), check.Equals, true)
+}
+
+func (p *sessionTestSuite) TestStartRoot(c *check.C) {
+	defer session.MockGeteuid(0)()
+	log, restore := mockSudo(c, "")
+	defer restore()
+
+	s, err := session.Start()
+	c.Assert(err, check.IsNil)
+	c.Assert(s.Close(), check.IsNil)
+	_, err = os.Stat(log)
+	c.Check(os.IsNotExist(err), check.Equals, true)
+}
+
+func (p *sessionTestSuite) TestStartSudoFails(c *check.C) {
+	defer session.MockGeteuid(1000)()
+	_, restore := mockSudo(c, "exit 1\n")
+	defer restore()
+
+	_, err := session.Start()
+	c.Check(err, check.ErrorMatches, "cannot get sudo credentials: exit status 1")
+}
+
+func (p *sessionTestSuite) TestGatedCommand(c *check.C) {
+	ran := filepath.Join(c.MkDir(), "ran")
+	cmd, gate, err := session.GatedCommand("touch", ran)
+	c.Assert(err, check.IsNil)
+	c.Assert(cmd.Start(), check.IsNil)
+
+	// the program is held back until the gate is released
+	time.Sleep(20 * time.Millisecond)
+	_, err = os.Stat(ran)
+	c.Check(os.IsNotExist(err), check.Equals, true)
+	c.Assert(gate.Release(), check.IsNil)
+	c.Assert(cmd.Wait(), check.IsNil)
+	_, err = os.Stat(ran)
+	c.Check(err, check.IsNil)
+}
+
+func (p *sessionTestSuite) TestGatedCommandClosed(c *check.C) {
+	ran := filepath.Join(c.MkDir(), "ran")
+	cmd, gate, err := session.GatedCommand("touch", ran)
+	c.Assert(err, check.IsNil)
+	c.Assert(cmd.Start(), check.IsNil)
+
+	c.Assert(gate.Close(), check.IsNil)
+	c.Check(cmd.Wait(), check.ErrorMatches, "exit status 1")
+	_, err = os.Stat(ran)
+	c.Check(os.IsNotExist(err), check.Equals, true)
+}
+
+func (p *sessionTestSuite) TestIsTraced(c *check.C) {
+	root := c.MkDir()
+	defer session.MockProcRoot(root)()
+	c.Assert(os.MkdirAll(filepath.Join(root, "42"), 0755), check.IsNil)
+	status := filepath.Join(root, "42", "status")
+
+	c.Assert(ioutil.WriteFile(status, []byte("Name:\tsh\nTracerPid:\t0\nUid:\t1000\n"), 0644), check.IsNil)
+	traced, err := session.IsTraced(42)
+	c.Assert(err, check.IsNil)
+	c.Check(traced, check.Equals, false)
+
+	c.Assert(ioutil.WriteFile(status, []byte("Name:\tsh\nTracerPid:\t1234\nUid:\t1000\n"), 0644), check.IsNil)
+	traced, err = session.IsTraced(42)
+	c.Assert(err, check.IsNil)
+	c.Check(traced, check.Equals, true)
+
+	c.Assert(ioutil.WriteFile(status, []byte("Name:\tsh\n"), 0644), check.IsNil)
+	_, err = session.IsTraced(42)
+	c.Check(err, check.ErrorMatches, "cannot find the tracer of process 42")
+
+	_, err = session.IsTraced(43)
+	c.Check(err, check.NotNil)
+}
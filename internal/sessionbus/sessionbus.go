@@ -0,0 +1,129 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package sessionbus runs throwaway D-Bus session buses, so that traced
+// programs don't talk to the services of the user session.
+package sessionbus
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// EnvVar is the environment variable with the address of the session bus
+const EnvVar = "DBUS_SESSION_BUS_ADDRESS"
+
+var (
+	dbusDaemon = "dbus-daemon"
+	// startTimeout is how long to wait for the bus to report its address
+	startTimeout = 5 * time.Second
+)
+
+// Bus is a private session bus
+type Bus struct {
+	cmd     *exec.Cmd
+	dir     string
+	address string
+	stopped bool
+}
+
+// Start starts a private session bus listening on a socket in a new temporary
+// directory. The services the bus activates run in its process group, so that
+// they are stopped with it.
+func Start() (*Bus, error) {
+	if _, err := exec.LookPath(dbusDaemon); err != nil {
+		return nil, fmt.Errorf("cannot find dbus-daemon, please install it to use a private session bus")
+	}
+	dir, err := ioutil.TempDir("", "etrace-session-bus")
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(dbusDaemon,
+		"--session",
+		"--nofork",
+		"--nopidfile",
+		"--print-address=1",
+		"--address=unix:path="+dir+"/bus",
+	)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("cannot start dbus-daemon: %v", err)
+	}
+	b := &Bus{cmd: cmd, dir: dir}
+
+	// the address is printed once the bus is listening
+	addrCh := make(chan string, 1)
+	go func() {
+		s := bufio.NewScanner(stdout)
+		if s.Scan() {
+			addrCh <- strings.TrimSpace(s.Text())
+		}
+		close(addrCh)
+	}()
+	select {
+	case addr, ok := <-addrCh:
+		if !ok || addr == "" {
+			b.Stop()
+			return nil, fmt.Errorf("dbus-daemon exited without reporting its address")
+		}
+		b.address = addr
+	case <-time.After(startTimeout):
+		b.Stop()
+		return nil, fmt.Errorf("timed out waiting for dbus-daemon to start")
+	}
+	return b, nil
+}
+
+// Address returns the address of the bus.
+func (b *Bus) Address() string {
+	return b.address
+}
+
+// Env returns the environment variable pointing programs at the bus.
+func (b *Bus) Env() string {
+	return EnvVar + "=" + b.address
+}
+
+// Stop stops the bus and the services it activated, stopping it again does
+// nothing.
+func (b *Bus) Stop() error {
+	if b.stopped {
+		return nil
+	}
+	b.stopped = true
+	defer os.RemoveAll(b.dir)
+	// the services may ignore SIGTERM, they shouldn't outlive the bus
+	if err := syscall.Kill(-b.cmd.Process.Pid, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+		return err
+	}
+	// the bus was killed, so it exiting with an error is expected
+	b.cmd.Wait()
+	return nil
+}
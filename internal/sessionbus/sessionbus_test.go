@@ -0,0 +1,97 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package sessionbus_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/anonymouse64/etrace/internal/sessionbus"
+
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type sessionbusTestSuite struct{}
+
+var _ = check.Suite(&sessionbusTestSuite{})
+
+func mockDaemon(c *check.C, script string) (restore func()) {
+	daemon := filepath.Join(c.MkDir(), "dbus-daemon")
+	c.Assert(ioutil.WriteFile(daemon, []byte("#!/bin/sh\n"+script), 0755), check.IsNil)
+	return sessionbus.MockDBusDaemon(daemon)
+}
+
+func (p *sessionbusTestSuite) TestStartStop(c *check.C) {
+	// report the address the bus was asked to listen on like dbus-daemon
+	defer mockDaemon(c, `for arg; do
+	case "$arg" in
+	--address=*) echo "${arg#--address=},guid=1234" ;;
+	esac
+done
+exec sleep 60
+`)()
+
+	b, err := sessionbus.Start()
+	c.Assert(err, check.IsNil)
+	c.Check(strings.HasPrefix(b.Address(), "unix:path="), check.Equals, true)
+	c.Check(strings.HasSuffix(b.Address(), "/bus,guid=1234"), check.Equals, true)
+	c.Check(b.Env(), check.Equals, "DBUS_SESSION_BUS_ADDRESS="+b.Address())
+
+	dir := filepath.Dir(strings.TrimSuffix(strings.TrimPrefix(b.Address(), "unix:path="), ",guid=1234"))
+	_, err = os.Stat(dir)
+	c.Assert(err, check.IsNil)
+
+	done := make(chan error, 1)
+	go func() { done <- b.Stop() }()
+	select {
+	case err := <-done:
+		c.Assert(err, check.IsNil)
+	case <-time.After(5 * time.Second):
+		c.Fatal("the bus was not stopped")
+	}
+	_, err = os.Stat(dir)
+	c.Check(os.IsNotExist(err), check.Equals, true)
+}
+
+func (p *sessionbusTestSuite) TestStartExited(c *check.C) {
+	defer mockDaemon(c, "exit 1\n")()
+
+	_, err := sessionbus.Start()
+	c.Assert(err, check.ErrorMatches, "dbus-daemon exited without reporting its address")
+}
+
+func (p *sessionbusTestSuite) TestStartTimeout(c *check.C) {
+	defer mockDaemon(c, "exec sleep 60\n")()
+	defer sessionbus.MockStartTimeout(10 * time.Millisecond)()
+
+	_, err := sessionbus.Start()
+	c.Assert(err, check.ErrorMatches, "timed out waiting for dbus-daemon to start")
+}
+
+func (p *sessionbusTestSuite) TestStartNotInstalled(c *check.C) {
+	defer sessionbus.MockDBusDaemon("/nonexistent/dbus-daemon")()
+
+	_, err := sessionbus.Start()
+	c.Assert(err, check.ErrorMatches, "cannot find dbus-daemon, please install it to use a private session bus")
+}
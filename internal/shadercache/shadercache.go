@@ -0,0 +1,194 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package shadercache
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Modes for handling the shader caches between runs
+const (
+	// ModeClear deletes the shader caches before each run to measure a true
+	// first run
+	ModeClear = "clear"
+	// ModePreserve saves the shader caches before the first run and restores
+	// them before each following run so every run starts with the same caches
+	ModePreserve = "preserve"
+)
+
+var userHomeDir = os.UserHomeDir
+
+// cacheDirNames are the shader cache directories relative to a home directory
+var cacheDirNames = []string{
+	// mesa
+	".cache/mesa_shader_cache",
+	".cache/mesa_shader_cache_db",
+	// nvidia
+	".cache/nvidia/GLCache",
+	".nv/GLCache",
+}
+
+// IsShaderCachePath returns whether the path is inside of a shader cache
+// directory.
+func IsShaderCachePath(path string) bool {
+	for _, name := range cacheDirNames {
+		if strings.Contains(path, "/"+name+"/") || strings.HasSuffix(path, "/"+name) {
+			return true
+		}
+	}
+	return false
+}
+
+// CacheDirs returns the shader cache directories of the current user that
+// exist, including those in the user data of the snap if snapName is not empty.
+func CacheDirs(snapName string) ([]string, error) {
+	home, err := userHomeDir()
+	if err != nil {
+		return nil, err
+	}
+	homes := []string{home}
+	if snapName != "" {
+		// both the revisioned and common snap user data dirs
+		snapHomes, err := filepath.Glob(filepath.Join(home, "snap", snapName, "*"))
+		if err != nil {
+			return nil, err
+		}
+		for _, h := range snapHomes {
+			// current is a symlink to the user data dir of the current
+			// revision, which is already listed
+			if filepath.Base(h) != "current" {
+				homes = append(homes, h)
+			}
+		}
+	}
+	var dirs []string
+	for _, h := range homes {
+		for _, name := range cacheDirNames {
+			dir := filepath.Join(h, name)
+			if info, err := os.Stat(dir); err == nil && info.IsDir() {
+				dirs = append(dirs, dir)
+			}
+		}
+	}
+	return dirs, nil
+}
+
+// Clear deletes the shader cache directories of the current user, including
+// those in the user data of the snap if snapName is not empty.
+func Clear(snapName string) error {
+	dirs, err := CacheDirs(snapName)
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Size returns the total size of the files in the shader cache directories of
+// the current user, including those in the user data of the snap if snapName
+// is not empty.
+func Size(snapName string) (int64, error) {
+	dirs, err := CacheDirs(snapName)
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	for _, dir := range dirs {
+		err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.Mode().IsRegular() {
+				size += info.Size()
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return size, nil
+}
+
+// Snapshot is a saved copy of the shader caches
+type Snapshot struct {
+	snapName string
+	tmpDir   string
+	// saved maps the original cache directories to their copies
+	saved map[string]string
+}
+
+// Save saves a copy of the shader caches of the current user, including those
+// in the user data of the snap if snapName is not empty.
+func Save(snapName string) (*Snapshot, error) {
+	dirs, err := CacheDirs(snapName)
+	if err != nil {
+		return nil, err
+	}
+	tmpDir, err := ioutil.TempDir("", "etrace-shader-cache")
+	if err != nil {
+		return nil, err
+	}
+	snap := &Snapshot{
+		snapName: snapName,
+		tmpDir:   tmpDir,
+		saved:    make(map[string]string, len(dirs)),
+	}
+	for i, dir := range dirs {
+		saved := filepath.Join(tmpDir, strconv.Itoa(i))
+		if out, err := exec.Command("cp", "-a", dir, saved).CombinedOutput(); err != nil {
+			snap.Release()
+			return nil, fmt.Errorf("failed to save shader cache %s: %v (%s)", dir, err, string(out))
+		}
+		snap.saved[dir] = saved
+	}
+	return snap, nil
+}
+
+// Restore puts the shader caches back into the state they were in when the
+// snapshot was saved.
+func (s *Snapshot) Restore() error {
+	// clear everything first to also get rid of caches created since saving
+	if err := Clear(s.snapName); err != nil {
+		return err
+	}
+	for dir, saved := range s.saved {
+		if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+			return err
+		}
+		if out, err := exec.Command("cp", "-a", saved, dir).CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to restore shader cache %s: %v (%s)", dir, err, string(out))
+		}
+	}
+	return nil
+}
+
+// Release deletes the saved copy of the shader caches.
+func (s *Snapshot) Release() error {
+	return os.RemoveAll(s.tmpDir)
+}
@@ -0,0 +1,131 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package shadercache_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/anonymouse64/etrace/internal/shadercache"
+
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type shadercacheTestSuite struct {
+	home string
+}
+
+var _ = check.Suite(&shadercacheTestSuite{})
+
+func (p *shadercacheTestSuite) SetUpTest(c *check.C) {
+	p.home = c.MkDir()
+}
+
+func (p *shadercacheTestSuite) TestIsShaderCachePath(c *check.C) {
+	for path, exp := range map[string]bool{
+		"/home/user/.cache/mesa_shader_cache":                                 true,
+		"/home/user/.cache/mesa_shader_cache/index":                           true,
+		"/home/user/snap/app/x1/.cache/mesa_shader_cache_db/part0/mesa_cache": true,
+		"/home/user/.nv/GLCache/abc/def":                                      true,
+		"/home/user/.cache/mesa_shader_cache_other":                           false,
+		"/home/user/.cache/fontconfig/abc.cache-7":                            false,
+	} {
+		c.Check(shadercache.IsShaderCachePath(path), check.Equals, exp, check.Commentf(path))
+	}
+}
+
+func (p *shadercacheTestSuite) TestClear(c *check.C) {
+	r := shadercache.MockUserHomeDir(p.home)
+	defer r()
+
+	hostCache := filepath.Join(p.home, ".cache", "mesa_shader_cache")
+	snapCache := filepath.Join(p.home, "snap", "test-snap", "x1", ".cache", "mesa_shader_cache")
+	nvCache := filepath.Join(p.home, "snap", "test-snap", "common", ".nv", "GLCache")
+	otherSnapCache := filepath.Join(p.home, "snap", "other-snap", "x1", ".cache", "mesa_shader_cache")
+	for _, dir := range []string{hostCache, snapCache, nvCache, otherSnapCache} {
+		c.Assert(os.MkdirAll(dir, 0755), check.IsNil)
+	}
+	// the symlink to the current revision is not listed twice
+	c.Assert(os.Symlink("x1", filepath.Join(p.home, "snap", "test-snap", "current")), check.IsNil)
+
+	dirs, err := shadercache.CacheDirs("test-snap")
+	c.Assert(err, check.IsNil)
+	c.Assert(dirs, check.DeepEquals, []string{hostCache, nvCache, snapCache})
+
+	c.Assert(shadercache.Clear("test-snap"), check.IsNil)
+	for _, dir := range []string{hostCache, snapCache, nvCache} {
+		_, err := os.Stat(dir)
+		c.Check(os.IsNotExist(err), check.Equals, true, check.Commentf(dir))
+	}
+	_, err = os.Stat(otherSnapCache)
+	c.Assert(err, check.IsNil)
+}
+
+func (p *shadercacheTestSuite) TestSize(c *check.C) {
+	r := shadercache.MockUserHomeDir(p.home)
+	defer r()
+
+	size, err := shadercache.Size("test-snap")
+	c.Assert(err, check.IsNil)
+	c.Check(size, check.Equals, int64(0))
+
+	hostCache := filepath.Join(p.home, ".cache", "mesa_shader_cache", "ab")
+	snapCache := filepath.Join(p.home, "snap", "test-snap", "x1", ".cache", "mesa_shader_cache")
+	for _, dir := range []string{hostCache, snapCache} {
+		c.Assert(os.MkdirAll(dir, 0755), check.IsNil)
+	}
+	c.Assert(os.Symlink("x1", filepath.Join(p.home, "snap", "test-snap", "current")), check.IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(hostCache, "shader"), []byte("123"), 0644), check.IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(snapCache, "index"), []byte("12345"), 0644), check.IsNil)
+
+	size, err = shadercache.Size("test-snap")
+	c.Assert(err, check.IsNil)
+	c.Check(size, check.Equals, int64(8))
+}
+
+func (p *shadercacheTestSuite) TestSaveRestore(c *check.C) {
+	r := shadercache.MockUserHomeDir(p.home)
+	defer r()
+
+	cache := filepath.Join(p.home, ".cache", "mesa_shader_cache")
+	c.Assert(os.MkdirAll(filepath.Join(cache, "ab"), 0755), check.IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(cache, "ab", "shader"), []byte("original"), 0644), check.IsNil)
+
+	snap, err := shadercache.Save("")
+	c.Assert(err, check.IsNil)
+	defer snap.Release()
+
+	// a run modifies the cache and adds a new one
+	c.Assert(ioutil.WriteFile(filepath.Join(cache, "ab", "shader"), []byte("modified"), 0644), check.IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(cache, "new-shader"), []byte("new"), 0644), check.IsNil)
+	nvCache := filepath.Join(p.home, ".nv", "GLCache")
+	c.Assert(os.MkdirAll(nvCache, 0755), check.IsNil)
+
+	c.Assert(snap.Restore(), check.IsNil)
+	content, err := ioutil.ReadFile(filepath.Join(cache, "ab", "shader"))
+	c.Assert(err, check.IsNil)
+	c.Assert(string(content), check.Equals, "original")
+	_, err = os.Stat(filepath.Join(cache, "new-shader"))
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+	_, err = os.Stat(nvCache)
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+}
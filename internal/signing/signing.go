@@ -0,0 +1,75 @@
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package signing
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// SignatureFile returns the file the signature of the given file is written to
+// and read from, which is the default of minisign.
+func SignatureFile(file string) string {
+	return file + ".minisig"
+}
+
+func minisignCommand(args ...string) (*exec.Cmd, error) {
+	minisignPath, err := exec.LookPath("minisign")
+	if err != nil {
+		return nil, fmt.Errorf("cannot find an installed minisign, please try 'sudo apt install minisign'")
+	}
+	cmd := exec.Command(minisignPath, args...)
+	// minisign may prompt for the password of the secret key
+	cmd.Stdin = os.Stdin
+	return cmd, nil
+}
+
+// Sign signs the file with the minisign secret key file, writing the
+// signature next to the file.
+func Sign(secretKeyFile, file string) error {
+	cmd, err := minisignCommand("-S", "-s", secretKeyFile, "-m", file, "-x", SignatureFile(file))
+	if err != nil {
+		return err
+	}
+	// the password prompt is written to stderr
+	cmd.Stderr = os.Stderr
+	if out, err := cmd.Output(); err != nil {
+		return fmt.Errorf("cannot sign %s: %v (%s)", file, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// Verify verifies the signature of the file with the minisign public key,
+// which is either the path of a public key file or the base64 encoded public
+// key itself.
+func Verify(publicKey, file string) error {
+	keyOpt := "-P"
+	if _, err := os.Stat(publicKey); err == nil {
+		keyOpt = "-p"
+	}
+	cmd, err := minisignCommand("-V", keyOpt, publicKey, "-m", file, "-x", SignatureFile(file))
+	if err != nil {
+		return err
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("cannot verify %s: %v (%s)", file, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
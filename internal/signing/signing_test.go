@@ -0,0 +1,93 @@
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package signing_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/anonymouse64/etrace/internal/signing"
+
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type signingTestSuite struct {
+	tmpDir  string
+	logFile string
+	oldPath string
+}
+
+var _ = check.Suite(&signingTestSuite{})
+
+// mockMinisign is a minisign which logs its arguments and fails when the
+// signature is for a file named "bad"
+const mockMinisign = `#!/bin/sh
+echo "$@" >> "${0%/*}/minisign.log"
+case "$*" in
+	*bad.minisig*) echo "Signature verification failed"; exit 1;;
+esac
+`
+
+func (s *signingTestSuite) SetUpTest(c *check.C) {
+	s.tmpDir = c.MkDir()
+	s.logFile = filepath.Join(s.tmpDir, "minisign.log")
+	s.oldPath = os.Getenv("PATH")
+	os.Setenv("PATH", s.tmpDir)
+	err := ioutil.WriteFile(filepath.Join(s.tmpDir, "minisign"), []byte(mockMinisign), 0755)
+	c.Assert(err, check.IsNil)
+}
+
+func (s *signingTestSuite) TearDownTest(c *check.C) {
+	os.Setenv("PATH", s.oldPath)
+}
+
+func (s *signingTestSuite) calls(c *check.C) string {
+	out, err := ioutil.ReadFile(s.logFile)
+	c.Assert(err, check.IsNil)
+	return string(out)
+}
+
+func (s *signingTestSuite) TestSign(c *check.C) {
+	err := signing.Sign("/keys/lab.key", "/results/run.json")
+	c.Assert(err, check.IsNil)
+	c.Assert(s.calls(c), check.Equals, "-S -s /keys/lab.key -m /results/run.json -x /results/run.json.minisig\n")
+}
+
+func (s *signingTestSuite) TestVerify(c *check.C) {
+	keyFile := filepath.Join(s.tmpDir, "lab.pub")
+	c.Assert(ioutil.WriteFile(keyFile, nil, 0644), check.IsNil)
+
+	c.Assert(signing.Verify(keyFile, "/results/run.json"), check.IsNil)
+	c.Assert(signing.Verify("RWQf6LRCGA9i53mlYecO4IzT51TGPpvWucNSCh1CBM0QTaLn73Y7GFO3", "/results/run.json"), check.IsNil)
+	c.Assert(s.calls(c), check.Equals,
+		"-V -p "+keyFile+" -m /results/run.json -x /results/run.json.minisig\n"+
+			"-V -P RWQf6LRCGA9i53mlYecO4IzT51TGPpvWucNSCh1CBM0QTaLn73Y7GFO3 -m /results/run.json -x /results/run.json.minisig\n")
+
+	err := signing.Verify(keyFile, "/results/bad")
+	c.Assert(err, check.ErrorMatches, `cannot verify /results/bad: exit status 1 \(Signature verification failed\)`)
+}
+
+func (s *signingTestSuite) TestMinisignMissing(c *check.C) {
+	os.Setenv("PATH", c.MkDir())
+	err := signing.Sign("/keys/lab.key", "/results/run.json")
+	c.Assert(err, check.ErrorMatches, "cannot find an installed minisign.*")
+}
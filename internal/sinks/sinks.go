@@ -0,0 +1,315 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package sinks writes results to several destinations in different formats at
+// once, like JSON to a file for archiving and text to stdout for humans.
+package sinks
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/anonymouse64/etrace/internal/files"
+)
+
+// The formats results can be written in
+const (
+	// FormatText is the human readable output, which is written while
+	// measuring instead of from the results at the end
+	FormatText = "text"
+	// FormatJSON is the results encoded as JSON
+	FormatJSON = "json"
+	// FormatNDJSON is the records of the results encoded as JSON lines as
+	// soon as they are done, followed by the results
+	FormatNDJSON = "ndjson"
+	// FormatCSV is the table of the results as comma separated values
+	FormatCSV = "csv"
+	// FormatSQLite is the table of the results appended to a table of a
+	// SQLite database
+	FormatSQLite = "sqlite"
+	// FormatTraceEvent is the timeline of the results in the Chrome trace
+	// event format, which can be opened with Perfetto or chrome://tracing
+	FormatTraceEvent = "trace-event"
+	// FormatFolded is the hierarchy of the programs of the results as folded
+	// stacks, which flamegraph.pl and speedscope make flame graphs of
+	FormatFolded = "folded"
+)
+
+// Stdout is the path of the standard output in output specifications
+const Stdout = "-"
+
+// Spec is a destination to write results to in a format
+type Spec struct {
+	Format string
+	// Path is the file to write to, or Stdout
+	Path string
+}
+
+// ParseSpec parses an output specification of the form FORMAT=PATH.
+func ParseSpec(s string) (Spec, error) {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 || kv[1] == "" {
+		return Spec{}, fmt.Errorf("invalid output %q, must be FORMAT=PATH", s)
+	}
+	spec := Spec{Format: kv[0], Path: kv[1]}
+	switch spec.Format {
+	case FormatText, FormatJSON, FormatNDJSON, FormatCSV, FormatTraceEvent, FormatFolded:
+	case FormatSQLite:
+		if spec.Path == Stdout {
+			return Spec{}, fmt.Errorf("invalid output %q, cannot write sqlite to stdout", s)
+		}
+	default:
+		return Spec{}, fmt.Errorf("invalid output %q, unknown format %q", s, spec.Format)
+	}
+	return spec, nil
+}
+
+// Table is results as rows of values, for the formats which need them flat
+type Table struct {
+	// Name is the name of the table in databases
+	Name    string
+	Columns []string
+	// Rows are the values of the columns, which are strings, integers,
+	// floats, booleans or nil
+	Rows [][]interface{}
+}
+
+// Tabular is implemented by results which can be written as a table
+type Tabular interface {
+	Table() Table
+}
+
+// TraceEventer is implemented by results which can be written as a timeline
+// in the Chrome trace event format
+type TraceEventer interface {
+	WriteTraceEvents(w io.Writer) error
+}
+
+// FoldedStacker is implemented by results which can be written as folded
+// stacks
+type FoldedStacker interface {
+	WriteFoldedStacks(w io.Writer) error
+}
+
+// Sink writes results to a destination in a format
+type Sink interface {
+	Write(results interface{}) error
+}
+
+// Recorder is implemented by sinks which write the records of the results,
+// like the runs of a measurement, as soon as they are done, so that they are
+// not lost if the measurement doesn't finish
+type Recorder interface {
+	WriteRecord(record interface{}) error
+}
+
+type jsonSink struct {
+	w io.Writer
+}
+
+func (s *jsonSink) Write(results interface{}) error {
+	return json.NewEncoder(s.w).Encode(results)
+}
+
+// ndjsonSink writes each record and then the results as a line of JSON
+type ndjsonSink struct {
+	w io.Writer
+}
+
+func (s *ndjsonSink) WriteRecord(record interface{}) error {
+	return json.NewEncoder(s.w).Encode(record)
+}
+
+func (s *ndjsonSink) Write(results interface{}) error {
+	return json.NewEncoder(s.w).Encode(results)
+}
+
+type csvSink struct {
+	w io.Writer
+}
+
+func (s *csvSink) Write(results interface{}) error {
+	t, ok := results.(Tabular)
+	if !ok {
+		return fmt.Errorf("cannot write results in %s format", FormatCSV)
+	}
+	table := t.Table()
+	w := csv.NewWriter(s.w)
+	if err := w.Write(table.Columns); err != nil {
+		return err
+	}
+	for _, row := range table.Rows {
+		record := make([]string, len(row))
+		for i, v := range row {
+			record[i] = formatValue(v)
+		}
+		if err := w.Write(record); err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+type traceEventSink struct {
+	w io.Writer
+}
+
+func (s *traceEventSink) Write(results interface{}) error {
+	t, ok := results.(TraceEventer)
+	if !ok {
+		return fmt.Errorf("cannot write results in %s format", FormatTraceEvent)
+	}
+	return t.WriteTraceEvents(s.w)
+}
+
+type foldedSink struct {
+	w io.Writer
+}
+
+func (s *foldedSink) Write(results interface{}) error {
+	f, ok := results.(FoldedStacker)
+	if !ok {
+		return fmt.Errorf("cannot write results in %s format", FormatFolded)
+	}
+	return f.WriteFoldedStacks(s.w)
+}
+
+// formatValue formats a value of a table as text.
+func formatValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// Outputs is the set of destinations the results of a command are written to
+type Outputs struct {
+	// Text is where the human readable output is written to while
+	// measuring, it discards the output if there is no text output
+	Text  io.Writer
+	sinks []Sink
+	files []*os.File
+}
+
+// Open opens the outputs of the specifications, truncating the files except
+// for SQLite databases which are appended to. Only text and JSON outputs are
+// allowed if the results are not tabular, the tabular results of measurements
+// are also the ones with a timeline and the ones with folded stacks.
+func Open(specs []Spec, tabular bool) (*Outputs, error) {
+	o := &Outputs{}
+	var texts []io.Writer
+	for _, spec := range specs {
+		if !tabular && (spec.Format == FormatCSV || spec.Format == FormatSQLite || spec.Format == FormatTraceEvent || spec.Format == FormatFolded) {
+			o.Close()
+			return nil, fmt.Errorf("cannot write these results in %s format", spec.Format)
+		}
+		if spec.Format == FormatSQLite {
+			sink, err := newSQLiteSink(spec.Path)
+			if err != nil {
+				o.Close()
+				return nil, err
+			}
+			o.sinks = append(o.sinks, sink)
+			continue
+		}
+		var w io.Writer = os.Stdout
+		if spec.Path != Stdout {
+			f, err := files.EnsureExistsAndOpen(spec.Path, true)
+			if err != nil {
+				o.Close()
+				return nil, err
+			}
+			o.files = append(o.files, f)
+			w = f
+		}
+		switch spec.Format {
+		case FormatText:
+			texts = append(texts, w)
+		case FormatJSON:
+			o.sinks = append(o.sinks, &jsonSink{w: w})
+		case FormatNDJSON:
+			o.sinks = append(o.sinks, &ndjsonSink{w: w})
+		case FormatCSV:
+			o.sinks = append(o.sinks, &csvSink{w: w})
+		case FormatTraceEvent:
+			o.sinks = append(o.sinks, &traceEventSink{w: w})
+		case FormatFolded:
+			o.sinks = append(o.sinks, &foldedSink{w: w})
+		}
+	}
+	switch len(texts) {
+	case 0:
+		o.Text = ioutil.Discard
+	case 1:
+		o.Text = texts[0]
+	default:
+		o.Text = io.MultiWriter(texts...)
+	}
+	return o, nil
+}
+
+// HasText returns whether there is any text output, so that formatting the
+// text output can be skipped otherwise.
+func (o *Outputs) HasText() bool {
+	return o.Text != ioutil.Discard
+}
+
+// WriteRecord writes a record of the results to the outputs which write them
+// as soon as they are done.
+func (o *Outputs) WriteRecord(record interface{}) error {
+	for _, sink := range o.sinks {
+		if r, ok := sink.(Recorder); ok {
+			if err := r.WriteRecord(record); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Write writes the results to all the outputs other than the text ones.
+func (o *Outputs) Write(results interface{}) error {
+	for _, sink := range o.sinks {
+		if err := sink.Write(results); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes the files of the outputs.
+func (o *Outputs) Close() error {
+	var firstErr error
+	for _, f := range o.files {
+		if err := f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	o.files = nil
+	return firstErr
+}
@@ -0,0 +1,229 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package sinks_test
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/anonymouse64/etrace/internal/sinks"
+
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type sinksTestSuite struct{}
+
+var _ = check.Suite(&sinksTestSuite{})
+
+type results struct {
+	Name string
+	Time float64
+}
+
+func (r results) Table() sinks.Table {
+	return sinks.Table{
+		Name:    "runs",
+		Columns: []string{"name", "time", "ok"},
+		Rows: [][]interface{}{
+			{r.Name, r.Time, true},
+			{"it's", nil, false},
+		},
+	}
+}
+
+func (s *sinksTestSuite) TestParseSpec(c *check.C) {
+	spec, err := sinks.ParseSpec("json=out.json")
+	c.Assert(err, check.IsNil)
+	c.Check(spec, check.Equals, sinks.Spec{Format: sinks.FormatJSON, Path: "out.json"})
+	spec, err = sinks.ParseSpec("csv=-")
+	c.Assert(err, check.IsNil)
+	c.Check(spec, check.Equals, sinks.Spec{Format: sinks.FormatCSV, Path: sinks.Stdout})
+
+	for _, t := range []struct {
+		spec, err string
+	}{
+		{"out.json", `invalid output "out.json", must be FORMAT=PATH`},
+		{"json=", `invalid output "json=", must be FORMAT=PATH`},
+		{"xml=out.xml", `invalid output "xml=out.xml", unknown format "xml"`},
+		{"sqlite=-", `invalid output "sqlite=-", cannot write sqlite to stdout`},
+	} {
+		_, err := sinks.ParseSpec(t.spec)
+		c.Check(err, check.ErrorMatches, t.err)
+	}
+}
+
+func (s *sinksTestSuite) TestOpen(c *check.C) {
+	dir := c.MkDir()
+	specs := []sinks.Spec{
+		{Format: sinks.FormatText, Path: filepath.Join(dir, "a.txt")},
+		{Format: sinks.FormatText, Path: filepath.Join(dir, "b.txt")},
+		{Format: sinks.FormatJSON, Path: filepath.Join(dir, "out.json")},
+		{Format: sinks.FormatCSV, Path: filepath.Join(dir, "out.csv")},
+	}
+	o, err := sinks.Open(specs, true)
+	c.Assert(err, check.IsNil)
+	c.Check(o.HasText(), check.Equals, true)
+	_, err = o.Text.Write([]byte("Total startup time: 1.5\n"))
+	c.Assert(err, check.IsNil)
+	// only the ndjson output writes records
+	c.Assert(o.WriteRecord(results{Name: "record"}), check.IsNil)
+	c.Assert(o.Write(results{Name: "a,b", Time: 1.5}), check.IsNil)
+	c.Assert(o.Close(), check.IsNil)
+
+	for _, t := range []struct {
+		file, content string
+	}{
+		{"a.txt", "Total startup time: 1.5\n"},
+		{"b.txt", "Total startup time: 1.5\n"},
+		{"out.json", `{"Name":"a,b","Time":1.5}` + "\n"},
+		{"out.csv", "name,time,ok\n\"a,b\",1.5,true\nit's,,false\n"},
+	} {
+		out, err := ioutil.ReadFile(filepath.Join(dir, t.file))
+		c.Assert(err, check.IsNil)
+		c.Check(string(out), check.Equals, t.content, check.Commentf(t.file))
+	}
+}
+
+func (s *sinksTestSuite) TestNDJSON(c *check.C) {
+	path := filepath.Join(c.MkDir(), "out.ndjson")
+	o, err := sinks.Open([]sinks.Spec{{Format: sinks.FormatNDJSON, Path: path}}, false)
+	c.Assert(err, check.IsNil)
+	c.Assert(o.WriteRecord(results{Name: "first", Time: 1}), check.IsNil)
+	// the record is written right away
+	out, err := ioutil.ReadFile(path)
+	c.Assert(err, check.IsNil)
+	c.Check(string(out), check.Equals, `{"Name":"first","Time":1}`+"\n")
+
+	c.Assert(o.WriteRecord(results{Name: "second", Time: 2}), check.IsNil)
+	c.Assert(o.Write([]results{{Name: "first", Time: 1}, {Name: "second", Time: 2}}), check.IsNil)
+	c.Assert(o.Close(), check.IsNil)
+	out, err = ioutil.ReadFile(path)
+	c.Assert(err, check.IsNil)
+	c.Check(string(out), check.Equals, `{"Name":"first","Time":1}
+{"Name":"second","Time":2}
+[{"Name":"first","Time":1},{"Name":"second","Time":2}]
+`)
+}
+
+func (s *sinksTestSuite) TestOpenNoText(c *check.C) {
+	o, err := sinks.Open([]sinks.Spec{{Format: sinks.FormatJSON, Path: filepath.Join(c.MkDir(), "out.json")}}, false)
+	c.Assert(err, check.IsNil)
+	c.Check(o.HasText(), check.Equals, false)
+	c.Assert(o.Close(), check.IsNil)
+}
+
+func (s *sinksTestSuite) TestOpenNotTabular(c *check.C) {
+	_, err := sinks.Open([]sinks.Spec{{Format: sinks.FormatCSV, Path: sinks.Stdout}}, false)
+	c.Check(err, check.ErrorMatches, "cannot write these results in csv format")
+	_, err = sinks.Open([]sinks.Spec{{Format: sinks.FormatTraceEvent, Path: sinks.Stdout}}, false)
+	c.Check(err, check.ErrorMatches, "cannot write these results in trace-event format")
+	_, err = sinks.Open([]sinks.Spec{{Format: sinks.FormatFolded, Path: sinks.Stdout}}, false)
+	c.Check(err, check.ErrorMatches, "cannot write these results in folded format")
+}
+
+type timelineResults struct {
+	results
+}
+
+func (r timelineResults) WriteTraceEvents(w io.Writer) error {
+	_, err := fmt.Fprintf(w, `{"traceEvents":[{"name":%q}]}`, r.Name)
+	return err
+}
+
+func (s *sinksTestSuite) TestTraceEvent(c *check.C) {
+	spec, err := sinks.ParseSpec("trace-event=out.json")
+	c.Assert(err, check.IsNil)
+	c.Check(spec, check.Equals, sinks.Spec{Format: sinks.FormatTraceEvent, Path: "out.json"})
+
+	path := filepath.Join(c.MkDir(), "out.json")
+	o, err := sinks.Open([]sinks.Spec{{Format: sinks.FormatTraceEvent, Path: path}}, true)
+	c.Assert(err, check.IsNil)
+	c.Assert(o.Write(timelineResults{results{Name: "gedit"}}), check.IsNil)
+	// results without a timeline can't be written
+	c.Check(o.Write(results{Name: "gedit"}), check.ErrorMatches, "cannot write results in trace-event format")
+	c.Assert(o.Close(), check.IsNil)
+	out, err := ioutil.ReadFile(path)
+	c.Assert(err, check.IsNil)
+	c.Check(string(out), check.Equals, `{"traceEvents":[{"name":"gedit"}]}`)
+}
+
+type stackedResults struct {
+	results
+}
+
+func (r stackedResults) WriteFoldedStacks(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "launcher;%s 1000\n", r.Name)
+	return err
+}
+
+func (s *sinksTestSuite) TestFolded(c *check.C) {
+	spec, err := sinks.ParseSpec("folded=out.folded")
+	c.Assert(err, check.IsNil)
+	c.Check(spec, check.Equals, sinks.Spec{Format: sinks.FormatFolded, Path: "out.folded"})
+
+	path := filepath.Join(c.MkDir(), "out.folded")
+	o, err := sinks.Open([]sinks.Spec{{Format: sinks.FormatFolded, Path: path}}, true)
+	c.Assert(err, check.IsNil)
+	c.Assert(o.Write(stackedResults{results{Name: "gedit"}}), check.IsNil)
+	// results without folded stacks can't be written
+	c.Check(o.Write(results{Name: "gedit"}), check.ErrorMatches, "cannot write results in folded format")
+	c.Assert(o.Close(), check.IsNil)
+	out, err := ioutil.ReadFile(path)
+	c.Assert(err, check.IsNil)
+	c.Check(string(out), check.Equals, "launcher;gedit 1000\n")
+}
+
+func (s *sinksTestSuite) TestSQLite(c *check.C) {
+	dir := c.MkDir()
+	// the mock records its arguments and the statements
+	mock := filepath.Join(dir, "sqlite3")
+	script := "#!/bin/sh\necho \"$@\" > " + filepath.Join(dir, "args") + "\ncat > " + filepath.Join(dir, "sql") + "\n"
+	c.Assert(ioutil.WriteFile(mock, []byte(script), 0755), check.IsNil)
+	restore := sinks.MockSQLite3(mock)
+	defer restore()
+
+	db := filepath.Join(dir, "results.db")
+	o, err := sinks.Open([]sinks.Spec{{Format: sinks.FormatSQLite, Path: db}}, true)
+	c.Assert(err, check.IsNil)
+	c.Assert(o.Write(results{Name: "gnome-calculator", Time: 1.5}), check.IsNil)
+	c.Assert(o.Close(), check.IsNil)
+
+	args, err := ioutil.ReadFile(filepath.Join(dir, "args"))
+	c.Assert(err, check.IsNil)
+	c.Check(string(args), check.Equals, "-bail "+db+"\n")
+	sql, err := ioutil.ReadFile(filepath.Join(dir, "sql"))
+	c.Assert(err, check.IsNil)
+	c.Check(string(sql), check.Matches, `BEGIN;
+CREATE TABLE IF NOT EXISTS "runs" \("measured", "name", "time", "ok"\);
+INSERT INTO "runs" \("measured", "name", "time", "ok"\) VALUES \('\d{4}-\d\d-\d\dT\d\d:\d\d:\d\dZ', 'gnome-calculator', 1.5, 1\);
+INSERT INTO "runs" \("measured", "name", "time", "ok"\) VALUES \('[^']+', 'it''s', NULL, 0\);
+COMMIT;
+`)
+}
+
+func (s *sinksTestSuite) TestSQLiteMissing(c *check.C) {
+	restore := sinks.MockSQLite3("/nonexistent/sqlite3")
+	defer restore()
+	_, err := sinks.Open([]sinks.Spec{{Format: sinks.FormatSQLite, Path: "results.db"}}, true)
+	c.Check(err, check.ErrorMatches, "cannot write sqlite output: .*")
+}
@@ -0,0 +1,116 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package sinks
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sqlite3 is the command line shell of SQLite, which is used instead of a
+// driver to not need cgo
+var sqlite3 = "sqlite3"
+
+// measuredColumn is the column added to SQLite tables with when the results
+// were written, since the rows of several measurements are appended to them
+const measuredColumn = "measured"
+
+type sqliteSink struct {
+	path string
+}
+
+func newSQLiteSink(path string) (*sqliteSink, error) {
+	// fail before measuring if the results can't be written
+	if _, err := exec.LookPath(sqlite3); err != nil {
+		return nil, fmt.Errorf("cannot write sqlite output: %v", err)
+	}
+	return &sqliteSink{path: path}, nil
+}
+
+// quoteIdent quotes a table or column name.
+func quoteIdent(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+// quoteValue returns the SQL literal of a value of a table.
+func quoteValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "NULL"
+	case bool:
+		if v {
+			return "1"
+		}
+		return "0"
+	case int:
+		return strconv.Itoa(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case uint:
+		return strconv.FormatUint(uint64(v), 10)
+	case uint64:
+		return strconv.FormatUint(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	default:
+		return "'" + strings.Replace(fmt.Sprint(v), "'", "''", -1) + "'"
+	}
+}
+
+// tableSQL returns the statements appending the rows of the table to the
+// table of the same name, creating it if it doesn't exist yet.
+func tableSQL(table Table, measured time.Time) string {
+	columns := make([]string, 0, len(table.Columns)+1)
+	columns = append(columns, quoteIdent(measuredColumn))
+	for _, column := range table.Columns {
+		columns = append(columns, quoteIdent(column))
+	}
+	var sql strings.Builder
+	sql.WriteString("BEGIN;\n")
+	// the columns have no types, so the values keep the types they have
+	fmt.Fprintf(&sql, "CREATE TABLE IF NOT EXISTS %s (%s);\n", quoteIdent(table.Name), strings.Join(columns, ", "))
+	for _, row := range table.Rows {
+		values := make([]string, 0, len(row)+1)
+		values = append(values, quoteValue(measured.UTC().Format(time.RFC3339)))
+		for _, v := range row {
+			values = append(values, quoteValue(v))
+		}
+		fmt.Fprintf(&sql, "INSERT INTO %s (%s) VALUES (%s);\n", quoteIdent(table.Name), strings.Join(columns, ", "), strings.Join(values, ", "))
+	}
+	sql.WriteString("COMMIT;\n")
+	return sql.String()
+}
+
+func (s *sqliteSink) Write(results interface{}) error {
+	t, ok := results.(Tabular)
+	if !ok {
+		return fmt.Errorf("cannot write results in %s format", FormatSQLite)
+	}
+	cmd := exec.Command(sqlite3, "-bail", s.path)
+	cmd.Stdin = strings.NewReader(tableSQL(t.Table(), time.Now()))
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("cannot write results to %s: %v (%s)", s.path, err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
@@ -0,0 +1,234 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package snaps
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/anonymouse64/etrace/internal/schema"
+)
+
+var snapdSocket = "/run/snapd.socket"
+
+// Task is a single task of a snapd change
+type Task struct {
+	ID        string    `json:"id"`
+	Kind      string    `json:"kind"`
+	Summary   string    `json:"summary"`
+	Status    string    `json:"status"`
+	SpawnTime time.Time `json:"spawn-time"`
+	ReadyTime time.Time `json:"ready-time"`
+}
+
+// Change is a change of snapd, such as installing a snap, and its tasks
+type Change struct {
+	ID        string    `json:"id"`
+	Kind      string    `json:"kind"`
+	Summary   string    `json:"summary"`
+	Status    string    `json:"status"`
+	Ready     bool      `json:"ready"`
+	SpawnTime time.Time `json:"spawn-time"`
+	ReadyTime time.Time `json:"ready-time"`
+	Tasks     []Task    `json:"tasks"`
+}
+
+// snapdGet gets the result of a request to the snapd REST API.
+func snapdGet(path string, query url.Values, result interface{}) error {
+	_, err := snapdDo("GET", path, query, nil, result)
+	return err
+}
+
+// snapdDo sends a request with the body encoded as JSON to the snapd REST API
+// and decodes its result, it returns the id of the change for asynchronous
+// requests.
+func snapdDo(method, path string, query url.Values, body interface{}, result interface{}) (string, error) {
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", snapdSocket)
+			},
+		},
+		Timeout: 10 * time.Second,
+	}
+	u := url.URL{Scheme: "http", Host: "localhost", Path: path, RawQuery: query.Encode()}
+	var reqBody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return "", err
+		}
+		reqBody = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, u.String(), reqBody)
+	if err != nil {
+		return "", err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("cannot communicate with snapd: %v", err)
+	}
+	defer resp.Body.Close()
+	var rsp struct {
+		Type   string          `json:"type"`
+		Result json.RawMessage `json:"result"`
+		Change string          `json:"change"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&rsp); err != nil {
+		return "", fmt.Errorf("cannot decode snapd response: %v", err)
+	}
+	if rsp.Type == "error" {
+		var e struct {
+			Message string `json:"message"`
+		}
+		json.Unmarshal(rsp.Result, &e)
+		return "", fmt.Errorf("snapd error: %s", e.Message)
+	}
+	if result == nil || len(rsp.Result) == 0 {
+		return rsp.Change, nil
+	}
+	return rsp.Change, json.Unmarshal(rsp.Result, result)
+}
+
+// Changes returns all the changes of snapd affecting the snap, oldest first.
+func Changes(snap string) ([]Change, error) {
+	var changes []Change
+	if err := snapdGet("/v2/changes", url.Values{"select": {"all"}, "for": {snap}}, &changes); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(changes, func(i, j int) bool {
+		return changes[i].SpawnTime.Before(changes[j].SpawnTime)
+	})
+	return changes, nil
+}
+
+// LastChange returns the most recent change of the given kind affecting the
+// snap.
+func LastChange(snap, kind string) (*Change, error) {
+	changes, err := Changes(snap)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(changes) - 1; i >= 0; i-- {
+		if changes[i].Kind == kind {
+			return &changes[i], nil
+		}
+	}
+	return nil, fmt.Errorf("cannot find %s change of snap %s", kind, snap)
+}
+
+// ConnectionTime is how long snapd took to connect a plug to a slot
+type ConnectionTime struct {
+	Plug string
+	Slot string
+	Time time.Duration
+}
+
+// Structured returns the connection time as encoded since version 2 of the
+// schema.
+func (c ConnectionTime) Structured() interface{} {
+	type plain ConnectionTime
+	return struct {
+		plain
+		Time schema.Duration
+	}{plain(c), schema.NewDuration(c.Time)}
+}
+
+// connect tasks have summaries like:
+// Connect foo:home to snapd:home
+var connectSummaryRE = regexp.MustCompile(`^Connect (\S+) to (\S+)$`)
+
+// taskTime is a task which is done and how long it took
+type taskTime struct {
+	Task
+	Time time.Duration
+}
+
+// taskTimes returns how long each task of the change which is done took.
+// Tasks only record when they were created and when they were done, and the
+// tasks of a change mostly run one after the other, so a task is counted as
+// having started when it was created or when the task done before it was done,
+// whichever is later.
+func taskTimes(change *Change) []taskTime {
+	tasks := append([]Task{}, change.Tasks...)
+	sort.SliceStable(tasks, func(i, j int) bool {
+		return tasks[i].ReadyTime.Before(tasks[j].ReadyTime)
+	})
+	var times []taskTime
+	var prevReady time.Time
+	for _, task := range tasks {
+		if task.ReadyTime.IsZero() {
+			// not done yet
+			continue
+		}
+		start := task.SpawnTime
+		if prevReady.After(start) {
+			start = prevReady
+		}
+		prevReady = task.ReadyTime
+		times = append(times, taskTime{Task: task, Time: task.ReadyTime.Sub(start)})
+	}
+	return times
+}
+
+// ConnectionTimes returns how long each connection made by the change took,
+// which for changes installing snaps are the connections made automatically.
+// See taskTimes for how long tasks took.
+func ConnectionTimes(change *Change) []ConnectionTime {
+	var conns []ConnectionTime
+	for _, task := range taskTimes(change) {
+		if task.Kind != "connect" || task.Status != "Done" {
+			continue
+		}
+		match := connectSummaryRE.FindStringSubmatch(task.Summary)
+		if match == nil {
+			continue
+		}
+		conns = append(conns, ConnectionTime{
+			Plug: match[1],
+			Slot: match[2],
+			Time: task.Time,
+		})
+	}
+	return conns
+}
+
+// MountTime returns how long the task of the change mounting the squashfs of
+// the snap took, which for changes installing snaps includes setting up the
+// loop device. See taskTimes for how long tasks took.
+func MountTime(change *Change) (time.Duration, bool) {
+	for _, task := range taskTimes(change) {
+		if task.Kind == "mount-snap" && task.Status == "Done" {
+			return task.Time, true
+		}
+	}
+	return 0, false
+}
@@ -24,3 +24,11 @@ func MockSnapRoot(new string) (restore func()) {
 		snapRoot = old
 	}
 }
+
+func MockSnapdSocket(new string) (restore func()) {
+	old := snapdSocket
+	snapdSocket = new
+	return func() {
+		snapdSocket = old
+	}
+}
@@ -0,0 +1,106 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package snaps
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/anonymouse64/etrace/internal/schema"
+	"github.com/anonymouse64/etrace/internal/strace"
+)
+
+// HookTime is how long a snap hook ran
+type HookTime struct {
+	Hook string
+	Time time.Duration
+}
+
+// Structured returns the hook time as encoded since version 2 of the schema.
+func (h HookTime) Structured() interface{} {
+	type plain HookTime
+	return struct {
+		plain
+		Time schema.Duration
+	}{plain(h), schema.NewDuration(h.Time)}
+}
+
+// hookName returns the name of the hook run by snap run with the given
+// arguments, or an empty string if it doesn't run a hook.
+func hookName(exe string, args []string) string {
+	if filepath.Base(exe) != "snap" || len(args) < 2 || args[1] != "run" {
+		return ""
+	}
+	for i, arg := range args[2:] {
+		switch {
+		case strings.HasPrefix(arg, "--hook="):
+			return strings.TrimPrefix(arg, "--hook=")
+		case arg == "--hook" && i+3 < len(args):
+			return args[i+3]
+		case arg == "--":
+			return ""
+		}
+	}
+	return ""
+}
+
+// HookTimes returns how long each hook snapd ran took from the exec timings of
+// snapd. Hooks are run with snap run --hook, which executes snap-confine,
+// snap-exec and finally the hook in the same process, so a hook runs until the
+// last program executed by that process ended.
+func HookTimes(timing *strace.ExecveTiming) []HookTime {
+	runtimes := append([]strace.ExeRuntime{}, timing.ExeRuntimes...)
+	sort.SliceStable(runtimes, func(i, j int) bool {
+		return runtimes[i].Start.Before(runtimes[j].Start)
+	})
+	var hooks []HookTime
+	for i, rt := range runtimes {
+		name := hookName(rt.Exe, rt.Args)
+		if name == "" {
+			continue
+		}
+		end := rt.Start.Add(rt.TotalSec)
+		// the programs executed by the process each start when the previous
+		// one ended
+		for _, next := range runtimes[i+1:] {
+			if next.Pid == rt.Pid && next.Start.Equal(end) {
+				end = next.Start.Add(next.TotalSec)
+			}
+		}
+		hooks = append(hooks, HookTime{Hook: name, Time: end.Sub(rt.Start)})
+	}
+	return hooks
+}
+
+// DaemonPid returns the pid of snapd.
+func DaemonPid() (int, error) {
+	out, err := exec.Command("systemctl", "show", "--property=MainPID", "--value", "snapd.service").CombinedOutput()
+	if err != nil {
+		return 0, fmt.Errorf("cannot get the pid of snapd: %v (%s)", err, strings.TrimSpace(string(out)))
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(out)))
+	if err != nil || pid == 0 {
+		return 0, fmt.Errorf("cannot get the pid of snapd: snapd is not running")
+	}
+	return pid, nil
+}
@@ -0,0 +1,108 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package snaps
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/anonymouse64/etrace/internal/commands"
+)
+
+// refreshKinds are the kinds of changes which refresh snaps
+var refreshKinds = map[string]bool{
+	"refresh-snap": true,
+	"auto-refresh": true,
+	"revert-snap":  true,
+}
+
+// Base returns the base snap of the installed snap, which is empty for snaps
+// without a base like the base snaps themselves.
+func Base(snap string) (string, error) {
+	out, err := ioutil.ReadFile(filepath.Join(snapRoot, snap, "current/meta/snap.yaml"))
+	if err != nil {
+		return "", err
+	}
+	var meta struct {
+		Type string `yaml:"type"`
+		Base string `yaml:"base"`
+	}
+	if err := yaml.Unmarshal(out, &meta); err != nil {
+		return "", fmt.Errorf("cannot parse snap.yaml of snap %s: %v", snap, err)
+	}
+	switch {
+	case meta.Base != "":
+		return meta.Base, nil
+	case meta.Type == "base" || meta.Type == "os" || meta.Type == "snapd":
+		return "", nil
+	default:
+		// snaps without a base use core
+		return "core", nil
+	}
+}
+
+// Refreshes returns the changes refreshing any of the snaps which were in
+// progress at any time between start and end.
+func Refreshes(names []string, start, end time.Time) ([]Change, error) {
+	seen := make(map[string]bool)
+	var refreshes []Change
+	for _, name := range names {
+		changes, err := Changes(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, change := range changes {
+			if !refreshKinds[change.Kind] || seen[change.ID] {
+				continue
+			}
+			if change.SpawnTime.After(end) || (change.Ready && change.ReadyTime.Before(start)) {
+				continue
+			}
+			seen[change.ID] = true
+			refreshes = append(refreshes, change)
+		}
+	}
+	return refreshes, nil
+}
+
+func runRefresh(args ...string) error {
+	cmd := exec.Command("snap", append([]string{"refresh"}, args...)...)
+	if err := commands.AddSudoIfNeeded(cmd); err != nil {
+		return fmt.Errorf("failed to add sudo to command: %v", err)
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to run %v: %v (%s)", cmd.Args, err, string(out))
+	}
+	return nil
+}
+
+// HoldRefreshes holds the refreshes of the snaps until UnholdRefreshes is
+// called.
+func HoldRefreshes(names []string) error {
+	return runRefresh(append([]string{"--hold"}, names...)...)
+}
+
+// UnholdRefreshes removes the hold of the refreshes of the snaps.
+func UnholdRefreshes(names []string) error {
+	return runRefresh(append([]string{"--unhold"}, names...)...)
+}
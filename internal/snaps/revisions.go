@@ -0,0 +1,109 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package snaps
+
+import (
+	"net/url"
+	"sort"
+)
+
+// ContentProviders returns the snaps providing content to the snap through
+// its connected content plugs, sorted by name.
+func ContentProviders(snap string) ([]string, error) {
+	var conns struct {
+		Established []struct {
+			Interface string `json:"interface"`
+			Plug      struct {
+				Snap string `json:"snap"`
+			} `json:"plug"`
+			Slot struct {
+				Snap string `json:"snap"`
+			} `json:"slot"`
+		} `json:"established"`
+	}
+	if err := snapdGet("/v2/connections", url.Values{"snap": {snap}}, &conns); err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var providers []string
+	for _, conn := range conns.Established {
+		if conn.Interface != "content" || conn.Plug.Snap != snap || seen[conn.Slot.Snap] {
+			continue
+		}
+		seen[conn.Slot.Snap] = true
+		providers = append(providers, conn.Slot.Snap)
+	}
+	sort.Strings(providers)
+	return providers, nil
+}
+
+// Revisions returns the revisions of the snap, its base and the snaps
+// providing content to it, which are what the snap runs, by snap name.
+func Revisions(snap string) (map[string]string, error) {
+	names := []string{snap}
+	base, err := Base(snap)
+	if err != nil {
+		return nil, err
+	}
+	if base != "" {
+		names = append(names, base)
+	}
+	providers, err := ContentProviders(snap)
+	if err != nil {
+		return nil, err
+	}
+	names = append(names, providers...)
+
+	revisions := make(map[string]string, len(names))
+	for _, name := range names {
+		rev, err := Revision(name)
+		if err != nil {
+			return nil, err
+		}
+		revisions[name] = rev
+	}
+	return revisions, nil
+}
+
+// RevisionChange is a snap whose revision changed, or which was added or
+// removed, in which case its old or new revision is empty
+type RevisionChange struct {
+	Snap string
+	Old  string `json:",omitempty"`
+	New  string `json:",omitempty"`
+}
+
+// RevisionChanges returns the snaps whose revisions differ between old and
+// new, sorted by name.
+func RevisionChanges(old, new map[string]string) []RevisionChange {
+	var changes []RevisionChange
+	for name, rev := range new {
+		if old[name] != rev {
+			changes = append(changes, RevisionChange{Snap: name, Old: old[name], New: rev})
+		}
+	}
+	for name, rev := range old {
+		if _, ok := new[name]; !ok {
+			changes = append(changes, RevisionChange{Snap: name, Old: rev})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Snap < changes[j].Snap
+	})
+	return changes
+}
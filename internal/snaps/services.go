@@ -0,0 +1,95 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package snaps
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// changePollInterval is how often to check whether a change is done
+var changePollInterval = 20 * time.Millisecond
+
+// Service is a service of a snap as reported by snapd
+type Service struct {
+	Snap    string `json:"snap"`
+	Name    string `json:"name"`
+	Active  bool   `json:"active"`
+	Enabled bool   `json:"enabled"`
+}
+
+// FullName returns the name of the service as used by snap commands, like
+// snap.app.
+func (s Service) FullName() string {
+	return s.Snap + "." + s.Name
+}
+
+// Services returns the services with the given names, which are snaps or
+// snap.app services.
+func Services(names []string) ([]Service, error) {
+	var services []Service
+	query := url.Values{"select": {"service"}, "names": {strings.Join(names, ",")}}
+	if err := snapdGet("/v2/apps", query, &services); err != nil {
+		return nil, err
+	}
+	if len(services) == 0 {
+		return nil, fmt.Errorf("cannot find services of %s", strings.Join(names, ", "))
+	}
+	return services, nil
+}
+
+// ServiceAction asks snapd to start, stop or restart the services with the
+// given names and returns the id of the change doing it.
+func ServiceAction(action string, names []string) (string, error) {
+	body := map[string]interface{}{
+		"action": action,
+		"names":  names,
+	}
+	change, err := snapdDo("POST", "/v2/apps", nil, body, nil)
+	if err != nil {
+		return "", err
+	}
+	if change == "" {
+		return "", fmt.Errorf("cannot %s services: snapd did not start a change", action)
+	}
+	return change, nil
+}
+
+// WaitChange waits for the change to be done and returns it, the change
+// failing or not being ready before the timeout is an error.
+func WaitChange(id string, timeout time.Duration) (*Change, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		var change Change
+		if err := snapdGet("/v2/changes/"+id, nil, &change); err != nil {
+			return nil, err
+		}
+		if change.Ready {
+			if change.Status != "Done" {
+				return &change, fmt.Errorf("change %s %q is %s", id, change.Summary, change.Status)
+			}
+			return &change, nil
+		}
+		if time.Now().After(deadline) {
+			return &change, fmt.Errorf("change %s %q is not ready after %v", id, change.Summary, timeout)
+		}
+		time.Sleep(changePollInterval)
+	}
+}
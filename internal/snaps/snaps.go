@@ -24,13 +24,29 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/anonymouse64/etrace/internal/commands"
 )
 
 var snapRoot = "/snap"
 
+// SplitSnapApp splits a snap app name like foo.bar, as given to snap run, into
+// the names of its snap and of its app, the app of a snap named like the snap
+// itself can be run with the name of the snap only. It is what
+// snap.SplitSnapApp of snapd does.
+func SplitSnapApp(snapApp string) (snap, app string) {
+	l := strings.SplitN(snapApp, ".", 2)
+	if len(l) < 2 {
+		// the instance key isn't part of the app name
+		return l[0], strings.SplitN(l[0], "_", 2)[0]
+	}
+	return l[0], l[1]
+}
+
 // DiscardSnapNs runs snap-discard-ns on a snap to get an accurate startup time
 // of setting up that snap's namespace
 func DiscardSnapNs(snap string) error {
@@ -145,6 +161,74 @@ func CurrentConnections(snapName string) ([]Connection, error) {
 	return conns, nil
 }
 
+// TraceExecReport is the exec timing report from snap run --trace-exec.
+type TraceExecReport struct {
+	Execs     []TraceExecTiming
+	TotalTime time.Duration
+}
+
+// TraceExecTiming is a single exec call from snap run --trace-exec.
+type TraceExecTiming struct {
+	Exe  string
+	Time time.Duration
+}
+
+// lines are indented by two spaces and look like:
+// 0.015s snap-update-ns
+var traceExecLineRE = regexp.MustCompile(`^\s+([0-9.]+)s (.+)$`)
+
+// lines look like:
+// Total time: 1.234s
+var traceExecTotalRE = regexp.MustCompile(`^Total time: ([0-9.]+)s$`)
+
+func parseSeconds(s string) (time.Duration, error) {
+	secs, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(secs * float64(time.Second)), nil
+}
+
+// ParseTraceExecReport parses the report snap run --trace-exec displays on
+// stderr, which may be interleaved with other output from the snap.
+func ParseTraceExecReport(out []byte) (*TraceExecReport, error) {
+	report := &TraceExecReport{}
+	inReport := false
+	foundTotal := false
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		line := s.Text()
+		if strings.HasPrefix(line, "Slowest ") && strings.HasSuffix(line, " exec calls during snap run:") {
+			inReport = true
+			continue
+		}
+		if !inReport {
+			continue
+		}
+		if match := traceExecLineRE.FindStringSubmatch(line); match != nil {
+			d, err := parseSeconds(match[1])
+			if err != nil {
+				return nil, fmt.Errorf("cannot parse exec time in line %q: %v", line, err)
+			}
+			report.Execs = append(report.Execs, TraceExecTiming{Exe: match[2], Time: d})
+			continue
+		}
+		if match := traceExecTotalRE.FindStringSubmatch(line); match != nil {
+			d, err := parseSeconds(match[1])
+			if err != nil {
+				return nil, fmt.Errorf("cannot parse total time in line %q: %v", line, err)
+			}
+			report.TotalTime = d
+			foundTotal = true
+			break
+		}
+	}
+	if !foundTotal {
+		return nil, fmt.Errorf("cannot find snap run --trace-exec report in output")
+	}
+	return report, nil
+}
+
 func IsInstalled(snapName string) bool {
 	if _, err := exec.Command("snap", "list", snapName).CombinedOutput(); err != nil {
 		// then the snap is assumed to not be installed
@@ -18,11 +18,19 @@
 package snaps
 
 import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	. "gopkg.in/check.v1"
+
+	"github.com/anonymouse64/etrace/internal/strace"
 )
 
 func Test(t *testing.T) { TestingT(t) }
@@ -88,3 +96,398 @@ func (s *snapsTestSuite) TestRevision(c *C) {
 		}
 	}
 }
+
+func (s *snapsTestSuite) TestParseTraceExecReport(c *C) {
+	out := []byte(`some output from the app
+Slowest 3 exec calls during snap run:
+  0.123s snap-update-ns
+  0.010s /usr/lib/snapd/snap-exec
+  1.500s /snap/test-snap/x1/bin/app
+Total time: 1.712s
+more output from the app
+`)
+	report, err := ParseTraceExecReport(out)
+	c.Assert(err, IsNil)
+	c.Assert(report, DeepEquals, &TraceExecReport{
+		Execs: []TraceExecTiming{
+			{Exe: "snap-update-ns", Time: 123 * time.Millisecond},
+			{Exe: "/usr/lib/snapd/snap-exec", Time: 10 * time.Millisecond},
+			{Exe: "/snap/test-snap/x1/bin/app", Time: 1500 * time.Millisecond},
+		},
+		TotalTime: 1712 * time.Millisecond,
+	})
+
+	_, err = ParseTraceExecReport([]byte("no report here\nTotal time: 1.0s\n"))
+	c.Assert(err, ErrorMatches, "cannot find snap run --trace-exec report in output")
+}
+
+func (s *snapsTestSuite) TestHookTimes(c *C) {
+	base := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(ms int) time.Time {
+		return base.Add(time.Duration(ms) * time.Millisecond)
+	}
+	ms := func(ms int) time.Duration {
+		return time.Duration(ms) * time.Millisecond
+	}
+	timing := &strace.ExecveTiming{
+		ExeRuntimes: []strace.ExeRuntime{
+			// out of order to check that they are sorted
+			{Start: at(110), Exe: "/usr/lib/snapd/snap-confine", TotalSec: ms(40), Pid: 10},
+			{Start: at(100), Exe: "/usr/bin/snap", Args: []string{"/usr/bin/snap", "run", "--hook=install", "-r", "x1", "foo"}, TotalSec: ms(10), Pid: 10},
+			{Start: at(150), Exe: "/usr/lib/snapd/snap-exec", TotalSec: ms(5), Pid: 10},
+			{Start: at(155), Exe: "/snap/foo/x1/meta/hooks/install", TotalSec: ms(145), Pid: 10},
+			// a program run by the hook in another process
+			{Start: at(200), Exe: "/usr/bin/sleep", TotalSec: ms(50), Pid: 11},
+			// not a hook
+			{Start: at(310), Exe: "/usr/bin/snap", Args: []string{"snap", "run", "foo"}, TotalSec: ms(10), Pid: 12},
+			{Start: at(400), Exe: "/snap/snapd/123/usr/bin/snap", Args: []string{"snap", "run", "--hook", "connect-plug-home", "foo"}, TotalSec: ms(20), Pid: 13},
+			// the pid was reused later on
+			{Start: at(600), Exe: "/usr/bin/true", TotalSec: ms(1), Pid: 13},
+		},
+	}
+	c.Assert(HookTimes(timing), DeepEquals, []HookTime{
+		{Hook: "install", Time: ms(200)},
+		{Hook: "connect-plug-home", Time: ms(20)},
+	})
+
+	c.Assert(HookTimes(&strace.ExecveTiming{}), HasLen, 0)
+}
+
+func (s *snapsTestSuite) mockSnapd(c *C, handler http.HandlerFunc) (restore func()) {
+	socket := filepath.Join(c.MkDir(), "snapd.socket")
+	l, err := net.Listen("unix", socket)
+	c.Assert(err, IsNil)
+	srv := &http.Server{Handler: handler}
+	go srv.Serve(l)
+	restoreSocket := MockSnapdSocket(socket)
+	return func() {
+		srv.Close()
+		restoreSocket()
+	}
+}
+
+func (s *snapsTestSuite) TestLastChange(c *C) {
+	restore := s.mockSnapd(c, func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.URL.Path, Equals, "/v2/changes")
+		c.Check(r.URL.Query().Get("select"), Equals, "all")
+		c.Check(r.URL.Query().Get("for"), Equals, "foo")
+		fmt.Fprint(w, `{"type": "sync", "result": [
+			{"id": "3", "kind": "install-snap", "spawn-time": "2021-01-01T10:00:00Z"},
+			{"id": "1", "kind": "install-snap", "spawn-time": "2021-01-01T09:00:00Z"},
+			{"id": "2", "kind": "remove-snap", "spawn-time": "2021-01-01T09:30:00Z"}
+		]}`)
+	})
+	defer restore()
+
+	change, err := LastChange("foo", "install-snap")
+	c.Assert(err, IsNil)
+	c.Check(change.ID, Equals, "3")
+
+	_, err = LastChange("foo", "refresh-snap")
+	c.Check(err, ErrorMatches, "cannot find refresh-snap change of snap foo")
+}
+
+func (s *snapsTestSuite) TestChangesError(c *C) {
+	restore := s.mockSnapd(c, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(401)
+		fmt.Fprint(w, `{"type": "error", "result": {"message": "access denied"}}`)
+	})
+	defer restore()
+
+	_, err := Changes("foo")
+	c.Check(err, ErrorMatches, "snapd error: access denied")
+}
+
+func (s *snapsTestSuite) TestConnectionTimes(c *C) {
+	base := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(ms int) time.Time {
+		return base.Add(time.Duration(ms) * time.Millisecond)
+	}
+	change := &Change{
+		Tasks: []Task{
+			{Kind: "mount-snap", Status: "Done", SpawnTime: at(0), ReadyTime: at(100)},
+			{Kind: "auto-connect", Status: "Done", SpawnTime: at(0), ReadyTime: at(150)},
+			// spawned by auto-connect, so done after it
+			{Kind: "connect", Summary: "Connect foo:home to snapd:home", Status: "Done", SpawnTime: at(140), ReadyTime: at(200)},
+			{Kind: "connect", Summary: "Connect foo:x11 to snapd:x11", Status: "Done", SpawnTime: at(140), ReadyTime: at(230)},
+			{Kind: "connect", Summary: "Connect foo:network to snapd:network", Status: "Undone", SpawnTime: at(140), ReadyTime: at(240)},
+			{Kind: "run-hook", Status: "Do", SpawnTime: at(0)},
+		},
+	}
+	c.Check(ConnectionTimes(change), DeepEquals, []ConnectionTime{
+		{Plug: "foo:home", Slot: "snapd:home", Time: 50 * time.Millisecond},
+		{Plug: "foo:x11", Slot: "snapd:x11", Time: 30 * time.Millisecond},
+	})
+}
+
+func (s *snapsTestSuite) TestMountTime(c *C) {
+	base := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(ms int) time.Time {
+		return base.Add(time.Duration(ms) * time.Millisecond)
+	}
+	change := &Change{
+		Tasks: []Task{
+			{Kind: "prerequisites", Status: "Done", SpawnTime: at(0), ReadyTime: at(20)},
+			{Kind: "prepare-snap", Status: "Done", SpawnTime: at(0), ReadyTime: at(50)},
+			{Kind: "mount-snap", Status: "Done", SpawnTime: at(0), ReadyTime: at(130)},
+			{Kind: "copy-snap-data", Status: "Do", SpawnTime: at(0)},
+		},
+	}
+	t, ok := MountTime(change)
+	c.Check(ok, Equals, true)
+	c.Check(t, Equals, 80*time.Millisecond)
+
+	change.Tasks[2].Status = "Error"
+	_, ok = MountTime(change)
+	c.Check(ok, Equals, false)
+}
+
+func (s *snapsTestSuite) TestSplitSnapApp(c *C) {
+	for _, t := range []struct {
+		snapApp, snap, app string
+	}{
+		{"chromium", "chromium", "chromium"},
+		{"chromium.chromedriver", "chromium", "chromedriver"},
+		{"foo_bar", "foo_bar", "foo"},
+		{"foo_bar.baz", "foo_bar", "baz"},
+	} {
+		snap, app := SplitSnapApp(t.snapApp)
+		c.Check(snap, Equals, t.snap, Commentf(t.snapApp))
+		c.Check(app, Equals, t.app, Commentf(t.snapApp))
+	}
+}
+
+func (s *snapsTestSuite) TestBase(c *C) {
+	tmpDir := c.MkDir()
+	restore := MockSnapRoot(tmpDir)
+	defer restore()
+
+	mockSnapYaml := func(snap, content string) {
+		dir := filepath.Join(tmpDir, snap, "current", "meta")
+		c.Assert(os.MkdirAll(dir, 0755), IsNil)
+		c.Assert(ioutil.WriteFile(filepath.Join(dir, "snap.yaml"), []byte(content), 0644), IsNil)
+	}
+	mockSnapYaml("foo", "name: foo\nbase: core20\n")
+	mockSnapYaml("legacy", "name: legacy\n")
+	mockSnapYaml("core20", "name: core20\ntype: base\n")
+
+	for _, t := range []struct {
+		snap, base string
+	}{
+		{"foo", "core20"},
+		{"legacy", "core"},
+		{"core20", ""},
+	} {
+		base, err := Base(t.snap)
+		c.Assert(err, IsNil)
+		c.Check(base, Equals, t.base, Commentf(t.snap))
+	}
+
+	_, err := Base("missing")
+	c.Check(err, NotNil)
+}
+
+func (s *snapsTestSuite) TestRefreshes(c *C) {
+	restore := s.mockSnapd(c, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("for") {
+		case "foo":
+			fmt.Fprint(w, `{"type": "sync", "result": [
+				{"id": "1", "kind": "refresh-snap", "ready": true, "spawn-time": "2021-01-01T09:00:00Z", "ready-time": "2021-01-01T09:01:00Z"},
+				{"id": "2", "kind": "install-snap", "ready": true, "spawn-time": "2021-01-01T10:00:00Z", "ready-time": "2021-01-01T10:01:00Z"},
+				{"id": "3", "kind": "auto-refresh", "ready": true, "spawn-time": "2021-01-01T10:02:00Z", "ready-time": "2021-01-01T10:03:00Z"}
+			]}`)
+		case "core20":
+			fmt.Fprint(w, `{"type": "sync", "result": [
+				{"id": "3", "kind": "auto-refresh", "ready": true, "spawn-time": "2021-01-01T10:02:00Z", "ready-time": "2021-01-01T10:03:00Z"},
+				{"id": "4", "kind": "refresh-snap", "ready": false, "spawn-time": "2021-01-01T09:50:00Z"}
+			]}`)
+		default:
+			fmt.Fprint(w, `{"type": "sync", "result": []}`)
+		}
+	})
+	defer restore()
+
+	start := time.Date(2021, 1, 1, 10, 0, 0, 0, time.UTC)
+	changes, err := Refreshes([]string{"foo", "core20", "snapd"}, start, start.Add(10*time.Minute))
+	c.Assert(err, IsNil)
+	var ids []string
+	for _, change := range changes {
+		ids = append(ids, change.ID)
+	}
+	c.Check(ids, DeepEquals, []string{"3", "4"})
+}
+
+func (s *snapsTestSuite) TestServices(c *C) {
+	restore := s.mockSnapd(c, func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.URL.Path, Equals, "/v2/apps")
+		c.Check(r.URL.Query().Get("select"), Equals, "service")
+		if r.URL.Query().Get("names") == "none" {
+			fmt.Fprint(w, `{"type": "sync", "result": []}`)
+			return
+		}
+		c.Check(r.URL.Query().Get("names"), Equals, "foo,bar.web")
+		fmt.Fprint(w, `{"type": "sync", "result": [
+			{"snap": "foo", "name": "daemon", "active": true, "enabled": true},
+			{"snap": "bar", "name": "web", "enabled": true}
+		]}`)
+	})
+	defer restore()
+
+	services, err := Services([]string{"foo", "bar.web"})
+	c.Assert(err, IsNil)
+	c.Check(services, DeepEquals, []Service{
+		{Snap: "foo", Name: "daemon", Active: true, Enabled: true},
+		{Snap: "bar", Name: "web", Enabled: true},
+	})
+	c.Check(services[1].FullName(), Equals, "bar.web")
+
+	_, err = Services([]string{"none"})
+	c.Check(err, ErrorMatches, "cannot find services of none")
+}
+
+func (s *snapsTestSuite) TestServiceAction(c *C) {
+	restore := s.mockSnapd(c, func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.Method, Equals, "POST")
+		c.Check(r.URL.Path, Equals, "/v2/apps")
+		var body struct {
+			Action string   `json:"action"`
+			Names  []string `json:"names"`
+		}
+		c.Check(json.NewDecoder(r.Body).Decode(&body), IsNil)
+		c.Check(body.Names, DeepEquals, []string{"foo.daemon"})
+		if body.Action == "stop" {
+			w.WriteHeader(403)
+			fmt.Fprint(w, `{"type": "error", "result": {"message": "access denied"}}`)
+			return
+		}
+		c.Check(body.Action, Equals, "start")
+		w.WriteHeader(202)
+		fmt.Fprint(w, `{"type": "async", "change": "42"}`)
+	})
+	defer restore()
+
+	change, err := ServiceAction("start", []string{"foo.daemon"})
+	c.Assert(err, IsNil)
+	c.Check(change, Equals, "42")
+
+	_, err = ServiceAction("stop", []string{"foo.daemon"})
+	c.Check(err, ErrorMatches, "snapd error: access denied")
+}
+
+func (s *snapsTestSuite) TestWaitChange(c *C) {
+	oldInterval := changePollInterval
+	changePollInterval = time.Millisecond
+	defer func() {
+		changePollInterval = oldInterval
+	}()
+	polls := 0
+	restore := s.mockSnapd(c, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/changes/1":
+			polls++
+			if polls < 3 {
+				fmt.Fprint(w, `{"type": "sync", "result": {"id": "1", "status": "Doing"}}`)
+				return
+			}
+			fmt.Fprint(w, `{"type": "sync", "result": {"id": "1", "status": "Done", "ready": true}}`)
+		case "/v2/changes/2":
+			fmt.Fprint(w, `{"type": "sync", "result": {"id": "2", "summary": "Running service command", "status": "Error", "ready": true}}`)
+		default:
+			fmt.Fprint(w, `{"type": "sync", "result": {"id": "3", "summary": "Running service command", "status": "Doing"}}`)
+		}
+	})
+	defer restore()
+
+	change, err := WaitChange("1", time.Minute)
+	c.Assert(err, IsNil)
+	c.Check(change.Status, Equals, "Done")
+	c.Check(polls, Equals, 3)
+
+	_, err = WaitChange("2", time.Minute)
+	c.Check(err, ErrorMatches, `change 2 "Running service command" is Error`)
+
+	_, err = WaitChange("3", 5*time.Millisecond)
+	c.Check(err, ErrorMatches, `change 3 "Running service command" is not ready after 5ms`)
+}
+
+func (s *snapsTestSuite) TestChangeTimings(c *C) {
+	restore := s.mockSnapd(c, func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.URL.Path, Equals, "/v2/debug")
+		c.Check(r.URL.Query().Get("aspect"), Equals, "change-timings")
+		if r.URL.Query().Get("change-id") == "9" {
+			fmt.Fprint(w, `{"type": "sync", "result": []}`)
+			return
+		}
+		c.Check(r.URL.Query().Get("change-id"), Equals, "7")
+		fmt.Fprint(w, `{"type": "sync", "result": [{"change-id": "7", "change-timings": {
+			"12": {"kind": "setup-profiles", "summary": "Setup snap \"foo\" security profiles", "status": "Done", "ready-time": "2021-01-01T10:00:02Z", "doing-time": 350000000, "doing-timings": [
+				{"label": "setup-security-backend", "summary": "Setup security backend \"apparmor\" for snap \"foo\"", "duration": 300000000},
+				{"level": 1, "label": "load-profiles", "summary": "Load AppArmor profiles", "duration": 250000000}
+			]},
+			"11": {"kind": "mount-snap", "summary": "Mount snap \"foo\"", "status": "Done", "ready-time": "2021-01-01T10:00:01Z", "doing-time": 120000000},
+			"13": {"kind": "prerequisites", "summary": "Ensure prerequisites", "status": "Done", "ready-time": "2021-01-01T10:00:00Z"}
+		}}]}`)
+	})
+	defer restore()
+
+	tasks, err := ChangeTimings("7")
+	c.Assert(err, IsNil)
+	c.Check(tasks, DeepEquals, []TaskTimings{
+		{TaskID: "11", Kind: "mount-snap", Summary: `Mount snap "foo"`, DoingTime: 120 * time.Millisecond},
+		{TaskID: "12", Kind: "setup-profiles", Summary: `Setup snap "foo" security profiles`, DoingTime: 350 * time.Millisecond, Timings: []Timing{
+			{Label: "setup-security-backend", Summary: `Setup security backend "apparmor" for snap "foo"`, Duration: 300 * time.Millisecond},
+			{Level: 1, Label: "load-profiles", Summary: "Load AppArmor profiles", Duration: 250 * time.Millisecond},
+		}},
+	})
+
+	_, err = ChangeTimings("9")
+	c.Check(err, ErrorMatches, "cannot find timings of change 9")
+}
+
+func (s *snapsTestSuite) TestRevisions(c *C) {
+	tmpDir := c.MkDir()
+	defer MockSnapRoot(tmpDir)()
+	mockSnap := func(snap, rev, content string) {
+		dir := filepath.Join(tmpDir, snap, rev, "meta")
+		c.Assert(os.MkdirAll(dir, 0755), IsNil)
+		c.Assert(ioutil.WriteFile(filepath.Join(dir, "snap.yaml"), []byte(content), 0644), IsNil)
+		c.Assert(os.Symlink(rev, filepath.Join(tmpDir, snap, "current")), IsNil)
+	}
+	mockSnap("foo", "12", "name: foo\nbase: core20\n")
+	mockSnap("core20", "1405", "name: core20\ntype: base\n")
+	mockSnap("gnome-3-38-2004", "99", "name: gnome-3-38-2004\nbase: core20\n")
+	mockSnap("gtk-common-themes", "1519", "name: gtk-common-themes\n")
+
+	restore := s.mockSnapd(c, func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.URL.Path, Equals, "/v2/connections")
+		c.Check(r.URL.Query().Get("snap"), Equals, "foo")
+		fmt.Fprint(w, `{"type": "sync", "result": {"established": [
+			{"interface": "content", "plug": {"snap": "foo", "plug": "gnome-3-38-2004"}, "slot": {"snap": "gnome-3-38-2004", "slot": "gnome-3-38-2004"}},
+			{"interface": "content", "plug": {"snap": "foo", "plug": "gtk-3-themes"}, "slot": {"snap": "gtk-common-themes", "slot": "gtk-3-themes"}},
+			{"interface": "content", "plug": {"snap": "foo", "plug": "icon-themes"}, "slot": {"snap": "gtk-common-themes", "slot": "icon-themes"}},
+			{"interface": "content", "plug": {"snap": "other", "plug": "data"}, "slot": {"snap": "foo", "slot": "data"}},
+			{"interface": "home", "plug": {"snap": "foo", "plug": "home"}, "slot": {"snap": "snapd", "slot": "home"}}
+		]}}`)
+	})
+	defer restore()
+
+	revisions, err := Revisions("foo")
+	c.Assert(err, IsNil)
+	c.Check(revisions, DeepEquals, map[string]string{
+		"foo":               "12",
+		"core20":            "1405",
+		"gnome-3-38-2004":   "99",
+		"gtk-common-themes": "1519",
+	})
+}
+
+func (s *snapsTestSuite) TestRevisionChanges(c *C) {
+	old := map[string]string{"foo": "12", "core20": "1405", "gtk-common-themes": "1519"}
+	new := map[string]string{"foo": "12", "core20": "1601", "gnome-3-38-2004": "99"}
+	c.Check(RevisionChanges(old, new), DeepEquals, []RevisionChange{
+		{Snap: "core20", Old: "1405", New: "1601"},
+		{Snap: "gnome-3-38-2004", New: "99"},
+		{Snap: "gtk-common-themes", Old: "1519"},
+	})
+	c.Check(RevisionChanges(old, old), IsNil)
+}
@@ -0,0 +1,126 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package snaps
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/anonymouse64/etrace/internal/schema"
+)
+
+// Timing is a measured step of the work snapd did for a task, like
+// generating the AppArmor profiles of a snap
+type Timing struct {
+	// Level is how deeply the step is nested in other steps
+	Level    int           `json:"level"`
+	Label    string        `json:"label"`
+	Summary  string        `json:"summary"`
+	Duration time.Duration `json:"duration"`
+}
+
+// Structured returns the timing as encoded since version 2 of the schema.
+func (t Timing) Structured() interface{} {
+	type plain Timing
+	return struct {
+		plain
+		Duration schema.Duration `json:"duration"`
+	}{plain(t), schema.NewDuration(t.Duration)}
+}
+
+// TaskTimings is how long snapd spent doing a task of a change and the steps
+// it measured
+type TaskTimings struct {
+	TaskID    string
+	Kind      string
+	Summary   string
+	DoingTime time.Duration
+	Timings   []Timing `json:",omitempty"`
+}
+
+// Structured returns the timings as encoded since version 2 of the schema.
+func (t TaskTimings) Structured() interface{} {
+	type plain TaskTimings
+	v := struct {
+		plain
+		DoingTime schema.Duration
+		Timings   []interface{} `json:",omitempty"`
+	}{
+		plain:     plain(t),
+		DoingTime: schema.NewDuration(t.DoingTime),
+	}
+	for _, timing := range t.Timings {
+		v.Timings = append(v.Timings, timing.Structured())
+	}
+	return v
+}
+
+// ChangeTimings returns how long snapd spent doing each task of the change
+// which did something, in the order the tasks were done, from the debug
+// timings snapd keeps for recent changes.
+func ChangeTimings(id string) ([]TaskTimings, error) {
+	var debug []struct {
+		ChangeTimings map[string]struct {
+			Kind         string        `json:"kind"`
+			Summary      string        `json:"summary"`
+			ReadyTime    time.Time     `json:"ready-time"`
+			DoingTime    time.Duration `json:"doing-time"`
+			DoingTimings []Timing      `json:"doing-timings"`
+		} `json:"change-timings"`
+	}
+	query := url.Values{"aspect": {"change-timings"}, "change-id": {id}}
+	if err := snapdGet("/v2/debug", query, &debug); err != nil {
+		return nil, err
+	}
+	if len(debug) == 0 {
+		return nil, fmt.Errorf("cannot find timings of change %s", id)
+	}
+	type doneTask struct {
+		TaskTimings
+		ready time.Time
+	}
+	var done []doneTask
+	for taskID, t := range debug[0].ChangeTimings {
+		if t.DoingTime == 0 {
+			continue
+		}
+		done = append(done, doneTask{
+			TaskTimings: TaskTimings{
+				TaskID:    taskID,
+				Kind:      t.Kind,
+				Summary:   t.Summary,
+				DoingTime: t.DoingTime,
+				Timings:   t.DoingTimings,
+			},
+			ready: t.ReadyTime,
+		})
+	}
+	sort.Slice(done, func(i, j int) bool {
+		if done[i].ready.Equal(done[j].ready) {
+			return done[i].TaskID < done[j].TaskID
+		}
+		return done[i].ready.Before(done[j].ready)
+	})
+	tasks := make([]TaskTimings, 0, len(done))
+	for _, t := range done {
+		tasks = append(tasks, t.TaskTimings)
+	}
+	return tasks, nil
+}
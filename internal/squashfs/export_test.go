@@ -0,0 +1,41 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package squashfs
+
+import "github.com/anonymouse64/etrace/internal/proctree"
+
+var ParseCompression = parseCompression
+
+func MockProcSelfMountInfo(new string) (restore func()) {
+	old := procSelfMountInfo
+	procSelfMountInfo = new
+	return func() {
+		procSelfMountInfo = old
+	}
+}
+
+func MockSnapshot(f func(root int) (*proctree.Tree, error)) (restore func()) {
+	old := snapshot
+	snapshot = f
+	return func() {
+		snapshot = old
+	}
+}
+
+var ParseReadOutput = parseReadOutput
+var ParseListing = parseListing
@@ -0,0 +1,331 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package squashfs estimates how much of the startup of a snap is spent
+// decompressing its squashfs, which is what choosing a compression method for
+// a snap trades off against its size.
+package squashfs
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/anonymouse64/etrace/internal/commands"
+	"github.com/anonymouse64/etrace/internal/proctree"
+	"github.com/anonymouse64/etrace/internal/schema"
+	"github.com/anonymouse64/etrace/internal/strace"
+)
+
+var (
+	procSelfMountInfo = "/proc/self/mountinfo"
+
+	// kthreaddPid is the parent of all kernel threads
+	kthreaddPid = 2
+
+	// clockTicks is USER_HZ, which the cpu times of processes are measured in
+	clockTicks = 100
+
+	snapshot = proctree.Snapshot
+)
+
+// Cost is the estimated cost of decompressing the files of a snap which were
+// accessed during startup
+type Cost struct {
+	Compression string
+	// Files and Bytes are the number and total size of the files in the snap
+	// which were accessed
+	Files int
+	Bytes int64
+	// DecompressTime is how long decompressing the accessed files takes, as
+	// measured by extracting them from the snap with unsquashfs
+	DecompressTime time.Duration
+	// LoopCPUTime is the cpu time the kernel threads of the loop device of
+	// the snap used during the run, it is only known on kernels with a
+	// thread per loop device
+	LoopCPUTime time.Duration `json:",omitempty"`
+	// StartupPercent is the decompression time as a percentage of the
+	// startup time
+	StartupPercent float64
+}
+
+// Structured returns the cost as encoded since version 2 of the schema.
+func (c *Cost) Structured() interface{} {
+	type plain Cost
+	return struct {
+		plain
+		DecompressTime schema.Duration
+		LoopCPUTime    *schema.Duration `json:",omitempty"`
+	}{plain(*c), schema.NewDuration(c.DecompressTime), schema.OptionalDuration(c.LoopCPUTime)}
+}
+
+var compressionLineRE = regexp.MustCompile(`^Compression ([a-zA-Z0-9]+)$`)
+
+// parseCompression parses the compression of a squashfs from the output of
+// unsquashfs -s.
+func parseCompression(out []byte) (string, error) {
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		if matches := compressionLineRE.FindStringSubmatch(s.Text()); matches != nil {
+			return strings.ToLower(matches[1]), nil
+		}
+	}
+	// TODO: what about test snaps with actually no compression in the squashfs?
+	return "", fmt.Errorf("error: snap has no compression or unsquashfs output is corrupted")
+}
+
+// Compression returns the compression method of the squashfs file.
+func Compression(file string) (string, error) {
+	cmd := exec.Command("unsquashfs", "-s", file)
+	if err := commands.AddSudoIfNeeded(cmd); err != nil {
+		return "", err
+	}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("cannot read superblock of %s: %v (%s)", file, err, string(out))
+	}
+	return parseCompression(out)
+}
+
+// AccessedFiles returns the paths relative to the mount directory of the files
+// in the squashfs which were accessed, and their total size.
+func AccessedFiles(e *strace.ExecvePaths, mountDirs ...string) ([]string, int64) {
+	seen := make(map[string]bool)
+	var paths []string
+	var total int64
+	for _, f := range e.AllFiles {
+		if f.Size < 0 {
+			// not a file which still exists
+			continue
+		}
+		for _, dir := range mountDirs {
+			rel, err := filepath.Rel(dir, f.Path)
+			if err != nil || rel == "." || strings.HasPrefix(rel, "../") {
+				continue
+			}
+			if !seen[rel] {
+				seen[rel] = true
+				paths = append(paths, rel)
+				total += f.Size
+			}
+			break
+		}
+	}
+	return paths, total
+}
+
+// ExtractTime returns how long extracting the files from the squashfs takes
+// with a single thread, which is dominated by decompressing them.
+func ExtractTime(file string, paths []string) (time.Duration, error) {
+	tmpDir, err := ioutil.TempDir("", "etrace-squashfs")
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		// the files are extracted as root
+		rmCmd := exec.Command("rm", "-rf", tmpDir)
+		if err := commands.AddSudoIfNeeded(rmCmd); err == nil {
+			rmCmd.Run()
+		}
+	}()
+	list := filepath.Join(tmpDir, "files")
+	if err := ioutil.WriteFile(list, []byte(strings.Join(paths, "\n")+"\n"), 0644); err != nil {
+		return 0, err
+	}
+	cmd := exec.Command("unsquashfs", "-n", "-no-xattrs", "-p", "1", "-d", filepath.Join(tmpDir, "root"), "-ef", list, file)
+	if err := commands.AddSudoIfNeeded(cmd); err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return 0, fmt.Errorf("cannot extract files from %s: %v (%s)", file, err, string(out))
+	}
+	return time.Since(start), nil
+}
+
+// LoopDevice returns the name of the loop device mounted at the directory,
+// i.e. loop3.
+func LoopDevice(mountDir string) (string, error) {
+	f, err := os.Open(procSelfMountInfo)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		// the mount point is the 5th field and the source is the 2nd field
+		// after the separator
+		fields := strings.Fields(s.Text())
+		if len(fields) < 10 || fields[4] != mountDir {
+			continue
+		}
+		for i, field := range fields {
+			if field == "-" && i+2 < len(fields) {
+				if dev := fields[i+2]; strings.HasPrefix(dev, "/dev/loop") {
+					return strings.TrimPrefix(dev, "/dev/"), nil
+				}
+			}
+		}
+	}
+	if err := s.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("cannot find loop device mounted at %s", mountDir)
+}
+
+// LoopCPUTicks returns the total cpu time in clock ticks of the kernel threads
+// serving the loop device.
+func LoopCPUTicks(loop string) (uint64, error) {
+	tree, err := snapshot(kthreaddPid)
+	if err != nil {
+		return 0, err
+	}
+	total := uint64(0)
+	for _, p := range tree.Processes {
+		// older kernels have a thread per loop device, workers of newer
+		// kernels name the device they are working for
+		if p.Comm == loop || strings.HasSuffix(p.Comm, "-"+loop) || strings.HasSuffix(p.Comm, "+"+loop) {
+			total += p.CPUTicks
+		}
+	}
+	return total, nil
+}
+
+// TicksDuration converts cpu clock ticks to a duration.
+func TicksDuration(ticks uint64) time.Duration {
+	return time.Duration(ticks) * time.Second / time.Duration(clockTicks)
+}
+
+// Throughput is how fast the files of a squashfs could be read
+type Throughput struct {
+	Bytes int64
+	Time  time.Duration
+}
+
+// MiBPerSecond returns the throughput in MiB per second.
+func (t *Throughput) MiBPerSecond() float64 {
+	if t.Time <= 0 {
+		return 0
+	}
+	return float64(t.Bytes) / (1024 * 1024) / t.Time.Seconds()
+}
+
+// readScript mounts the squashfs given as the first argument at the directory
+// given as the second argument and reads all of its files, printing how long
+// reading them took in nanoseconds and their total size in bytes. It is run in
+// a private mount namespace, so that the mount is gone once it exits.
+const readScript = `set -e
+mount -t squashfs -o ro,loop "$1" "$2"
+start=$(date +%s%N)
+find "$2" -type f -exec cat {} + > /dev/null
+end=$(date +%s%N)
+echo "$((end - start)) $(du -s -b --apparent-size "$2" | cut -f1)"
+`
+
+// parseReadOutput parses the last line of the output of readScript.
+func parseReadOutput(out []byte) (*Throughput, error) {
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	fields := strings.Fields(lines[len(lines)-1])
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("unexpected output %q", out)
+	}
+	ns, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid read time: %v", err)
+	}
+	size, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid size: %v", err)
+	}
+	return &Throughput{Bytes: size, Time: time.Duration(ns)}, nil
+}
+
+// ReadThroughput mounts the squashfs file read-only in a private mount
+// namespace, without installing anything, and measures how fast all of its
+// files can be read, which includes decompressing them. The caches should be
+// dropped before to measure a cold read.
+func ReadThroughput(file string) (*Throughput, error) {
+	mountDir, err := ioutil.TempDir("", "etrace-squashfs-mount")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(mountDir)
+	cmd := exec.Command("unshare", "--mount", "--propagation", "private", "sh", "-c", readScript, "sh", file, mountDir)
+	if err := commands.AddSudoIfNeeded(cmd); err != nil {
+		return nil, err
+	}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("cannot read files of %s: %v (%s)", file, err, string(out))
+	}
+	return parseReadOutput(out)
+}
+
+// File is a regular file in a squashfs
+type File struct {
+	// Path is relative to the root of the squashfs
+	Path string
+	Size int64
+}
+
+// parseListing parses the regular files out of the long listing of unsquashfs
+// with the root directory named "root".
+func parseListing(out []byte) ([]File, error) {
+	var files []File
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		// the mode, owner, size, date and time come before the path
+		if len(fields) < 6 || len(fields[0]) != 10 || fields[0][0] != '-' {
+			// not a regular file, or not a file at all
+			continue
+		}
+		size, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid size in %q: %v", line, err)
+		}
+		// the path may contain spaces, so take the rest of the line after the
+		// time
+		i := strings.Index(line, " "+fields[4]+" ") + len(fields[4]) + 2
+		files = append(files, File{
+			Path: strings.TrimPrefix(line[i:], "root/"),
+			Size: size,
+		})
+	}
+	return files, nil
+}
+
+// Files returns the regular files in the squashfs file.
+func Files(file string) ([]File, error) {
+	cmd := exec.Command("unsquashfs", "-lls", "-d", "root", file)
+	if err := commands.AddSudoIfNeeded(cmd); err != nil {
+		return nil, err
+	}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("cannot list files of %s: %v (%s)", file, err, string(out))
+	}
+	return parseListing(out)
+}
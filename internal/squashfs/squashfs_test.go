@@ -0,0 +1,139 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package squashfs_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gopkg.in/check.v1"
+
+	"github.com/anonymouse64/etrace/internal/proctree"
+	"github.com/anonymouse64/etrace/internal/squashfs"
+	"github.com/anonymouse64/etrace/internal/strace"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type squashfsTestSuite struct{}
+
+var _ = check.Suite(&squashfsTestSuite{})
+
+func (s *squashfsTestSuite) TestParseCompression(c *check.C) {
+	out := []byte(`Found a valid SQUASHFS 4:0 superblock on foo.snap.
+Creation or last append time Thu Jan  1 00:00:00 2021
+Filesystem size 1234 Kbytes (1.21 Mbytes)
+Compression xz
+Block size 131072
+`)
+	compression, err := squashfs.ParseCompression(out)
+	c.Assert(err, check.IsNil)
+	c.Check(compression, check.Equals, "xz")
+
+	_, err = squashfs.ParseCompression([]byte("garbage\n"))
+	c.Check(err, check.ErrorMatches, "error: snap has no compression or unsquashfs output is corrupted")
+}
+
+func (s *squashfsTestSuite) TestAccessedFiles(c *check.C) {
+	e := &strace.ExecvePaths{
+		AllFiles: []strace.CommonFileInfo{
+			{Path: "/snap/foo/x1/bin/foo", Size: 100},
+			{Path: "/snap/foo/current/lib/libfoo.so", Size: 50},
+			// accessed through both paths
+			{Path: "/snap/foo/current/bin/foo", Size: 100},
+			// doesn't exist
+			{Path: "/snap/foo/x1/missing", Size: -1},
+			{Path: "/snap/foo/x10/bin/foo", Size: 100},
+			{Path: "/usr/lib/libc.so", Size: 1000},
+		},
+	}
+	paths, total := squashfs.AccessedFiles(e, "/snap/foo/x1", "/snap/foo/current")
+	c.Check(paths, check.DeepEquals, []string{"bin/foo", "lib/libfoo.so"})
+	c.Check(total, check.Equals, int64(150))
+}
+
+func (s *squashfsTestSuite) TestLoopDevice(c *check.C) {
+	mountinfo := filepath.Join(c.MkDir(), "mountinfo")
+	c.Assert(ioutil.WriteFile(mountinfo, []byte(`25 1 259:2 / / rw,relatime shared:1 - ext4 /dev/nvme0n1p2 rw
+100 25 7:3 / /snap/foo/x1 ro,nodev,relatime shared:50 - squashfs /dev/loop3 ro
+101 25 7:4 / /snap/bar/x2 ro,nodev,relatime shared:51 - squashfs /dev/loop4 ro
+`), 0644), check.IsNil)
+	restore := squashfs.MockProcSelfMountInfo(mountinfo)
+	defer restore()
+
+	loop, err := squashfs.LoopDevice("/snap/foo/x1")
+	c.Assert(err, check.IsNil)
+	c.Check(loop, check.Equals, "loop3")
+
+	_, err = squashfs.LoopDevice("/")
+	c.Check(err, check.ErrorMatches, "cannot find loop device mounted at /")
+}
+
+func (s *squashfsTestSuite) TestLoopCPUTicks(c *check.C) {
+	restore := squashfs.MockSnapshot(func(root int) (*proctree.Tree, error) {
+		c.Check(root, check.Equals, 2)
+		return &proctree.Tree{Processes: []proctree.Process{
+			{Pid: 2, Comm: "kthreadd", CPUTicks: 1},
+			{Pid: 10, Comm: "loop3", CPUTicks: 5},
+			{Pid: 11, Comm: "kworker/u8:1-loop3", CPUTicks: 7},
+			{Pid: 12, Comm: "loop30", CPUTicks: 100},
+			{Pid: 13, Comm: "kworker/2:1-events", CPUTicks: 100},
+		}}, nil
+	})
+	defer restore()
+
+	ticks, err := squashfs.LoopCPUTicks("loop3")
+	c.Assert(err, check.IsNil)
+	c.Check(ticks, check.Equals, uint64(12))
+	c.Check(squashfs.TicksDuration(ticks), check.Equals, 120*time.Millisecond)
+}
+
+func (s *squashfsTestSuite) TestParseReadOutput(c *check.C) {
+	t, err := squashfs.ParseReadOutput([]byte("some warning\n2000000000 4194304\n"))
+	c.Assert(err, check.IsNil)
+	c.Check(t, check.DeepEquals, &squashfs.Throughput{Bytes: 4194304, Time: 2 * time.Second})
+	c.Check(t.MiBPerSecond(), check.Equals, 2.0)
+
+	_, err = squashfs.ParseReadOutput([]byte("mount: permission denied\n"))
+	c.Check(err, check.ErrorMatches, "unexpected output .*")
+	_, err = squashfs.ParseReadOutput([]byte("soon 1\n"))
+	c.Check(err, check.ErrorMatches, "invalid read time: .*")
+}
+
+func (s *squashfsTestSuite) TestParseListing(c *check.C) {
+	out := []byte(`Parallel unsquashfs: Using 8 processors
+4 inodes (3 blocks) to write
+
+drwxr-xr-x root/root               101 2021-01-01 00:00 root
+drwxr-xr-x root/root                29 2021-01-01 00:00 root/meta
+-rw-r--r-- root/root              1234 2021-01-01 00:00 root/meta/snap.yaml
+lrwxrwxrwx root/root                 7 2021-01-01 00:00 root/lib -> usr/lib
+-rwxr-xr-x root/root            100000 2021-01-01 00:00 root/bin/my app
+`)
+	files, err := squashfs.ParseListing(out)
+	c.Assert(err, check.IsNil)
+	c.Check(files, check.DeepEquals, []squashfs.File{
+		{Path: "meta/snap.yaml", Size: 1234},
+		{Path: "bin/my app", Size: 100000},
+	})
+
+	_, err = squashfs.ParseListing([]byte("-rw-r--r-- root/root big 2021-01-01 00:00 root/foo\n"))
+	c.Check(err, check.ErrorMatches, `invalid size in .*`)
+}
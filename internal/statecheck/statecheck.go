@@ -0,0 +1,116 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package statecheck records checksums of the state of the system, so that
+// scripts restoring it after a measurement can be checked to really restore
+// it.
+package statecheck
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// State is the checksum of each of a set of paths, paths which don't exist have
+// an empty checksum
+type State map[string]string
+
+// checksum returns the checksum of the path and everything under it, which
+// covers the names, permissions, file contents and symlink targets but not the
+// times, which restoring from a copy changes.
+func checksum(path string) (string, error) {
+	h := sha256.New()
+	err := filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(path, p)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "%s\x00%v\x00", rel, info.Mode())
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, "%s\x00", target)
+		case info.Mode().IsRegular():
+			f, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			if _, err := io.Copy(h, f); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Record returns the current state of the paths.
+func Record(paths []string) (State, error) {
+	s := make(State, len(paths))
+	for _, path := range paths {
+		if _, err := os.Lstat(path); os.IsNotExist(err) {
+			s[path] = ""
+			continue
+		}
+		sum, err := checksum(path)
+		if err != nil {
+			return nil, fmt.Errorf("cannot record state of %s: %v", path, err)
+		}
+		s[path] = sum
+	}
+	return s, nil
+}
+
+// Drift describes how each path of the current state differs from the
+// recorded one, sorted by path.
+func (s State) Drift(now State) []string {
+	paths := make([]string, 0, len(s))
+	for path := range s {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	var drift []string
+	for _, path := range paths {
+		before, after := s[path], now[path]
+		switch {
+		case before == after:
+		case before == "":
+			drift = append(drift, fmt.Sprintf("%s was created", path))
+		case after == "":
+			drift = append(drift, fmt.Sprintf("%s was removed", path))
+		default:
+			drift = append(drift, fmt.Sprintf("%s was modified", path))
+		}
+	}
+	return drift
+}
@@ -0,0 +1,94 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package statecheck_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/anonymouse64/etrace/internal/statecheck"
+
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type statecheckTestSuite struct{}
+
+var _ = check.Suite(&statecheckTestSuite{})
+
+func (s *statecheckTestSuite) TestDrift(c *check.C) {
+	dir := c.MkDir()
+	config := filepath.Join(dir, "config")
+	c.Assert(os.MkdirAll(filepath.Join(config, "app"), 0755), check.IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(config, "app", "settings"), []byte("a=1\n"), 0644), check.IsNil)
+	c.Assert(os.Symlink("settings", filepath.Join(config, "app", "link")), check.IsNil)
+	cache := filepath.Join(dir, "cache")
+	c.Assert(ioutil.WriteFile(cache, []byte("cached"), 0644), check.IsNil)
+	missing := filepath.Join(dir, "missing")
+	untouched := filepath.Join(dir, "untouched")
+	c.Assert(ioutil.WriteFile(untouched, []byte("same"), 0644), check.IsNil)
+	paths := []string{config, cache, missing, untouched}
+
+	before, err := statecheck.Record(paths)
+	c.Assert(err, check.IsNil)
+	c.Check(before[missing], check.Equals, "")
+
+	// restoring the same contents with new times is no drift
+	later := time.Now().Add(time.Hour)
+	c.Assert(os.Chtimes(untouched, later, later), check.IsNil)
+	now, err := statecheck.Record(paths)
+	c.Assert(err, check.IsNil)
+	c.Check(before.Drift(now), check.HasLen, 0)
+
+	c.Assert(ioutil.WriteFile(filepath.Join(config, "app", "settings"), []byte("a=2\n"), 0644), check.IsNil)
+	c.Assert(os.Remove(cache), check.IsNil)
+	c.Assert(ioutil.WriteFile(missing, nil, 0644), check.IsNil)
+	now, err = statecheck.Record(paths)
+	c.Assert(err, check.IsNil)
+	c.Check(before.Drift(now), check.DeepEquals, []string{
+		cache + " was removed",
+		config + " was modified",
+		missing + " was created",
+	})
+}
+
+func (s *statecheckTestSuite) TestDriftModeAndLinks(c *check.C) {
+	dir := c.MkDir()
+	script := filepath.Join(dir, "script")
+	c.Assert(ioutil.WriteFile(script, []byte("#!/bin/sh\n"), 0755), check.IsNil)
+	link := filepath.Join(dir, "link")
+	c.Assert(os.Symlink("script", link), check.IsNil)
+	paths := []string{script, link}
+
+	before, err := statecheck.Record(paths)
+	c.Assert(err, check.IsNil)
+
+	c.Assert(os.Chmod(script, 0644), check.IsNil)
+	c.Assert(os.Remove(link), check.IsNil)
+	c.Assert(os.Symlink("other", link), check.IsNil)
+	now, err := statecheck.Record(paths)
+	c.Assert(err, check.IsNil)
+	c.Check(before.Drift(now), check.DeepEquals, []string{
+		link + " was modified",
+		script + " was modified",
+	})
+}
@@ -19,19 +19,232 @@ package strace
 
 import (
 	"fmt"
+	"os"
 	"os/exec"
 	"os/user"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/anonymouse64/etrace/internal/commands"
 )
 
 // These syscalls are excluded because they make strace hang on all or
-// some architectures (gettimeofday on arm64).
-var excludedSyscalls = "!select,pselect6,_newselect,clock_gettime,sigaltstack,gettid,gettimeofday,nanosleep"
+// some architectures (gettimeofday on arm64). Not all of them exist on every
+// architecture, e.g. select doesn't on arm64 and riscv64, and strace refuses
+// to run with names it doesn't know, so only the ones strace knows are used.
+var defaultExcludedSyscalls = []string{
+	"select",
+	"pselect6",
+	"_newselect",
+	"clock_gettime",
+	"sigaltstack",
+	"gettid",
+	"gettimeofday",
+	"nanosleep",
+}
+
+// excludedSyscalls overrides the default excluded syscalls if it's not nil
+var excludedSyscalls []string
+
+// probedSyscalls are the default excluded syscalls known by each strace
+var probedSyscalls = map[string][]string{}
+
+// waitSyscalls are the syscalls processes block in while they wait for other
+// threads or processes, or for I/O, which are traced with their durations if
+// ExecOptions.Waits is set, the ones strace doesn't know on the architecture are
+// ignored thanks to the ? prefix
+var waitSyscalls = []string{
+	"?futex",
+	"?poll",
+	"?ppoll",
+	"?epoll_wait",
+	"?epoll_pwait",
+	"?epoll_pwait2",
+	"?wait4",
+	"?waitid",
+}
+
+// ExecOptions is what TraceExecCommand traces besides the execve syscalls
+type ExecOptions struct {
+	// Forks traces the forks of the processes, to know which process
+	// forked which for the tree of the programs and the critical path
+	Forks bool
+	// Waits traces how long the processes spend in the syscalls they block
+	// in, like futex and poll
+	Waits bool
+	// Connects traces the connections of the processes to sockets, to know
+	// when they connected to the display server
+	Connects bool
+}
+
+// syscallClasses are the syscalls of each class of activity the file tracing
+// can be limited to, the ones strace doesn't know on the architecture are
+// ignored thanks to the ? prefix. The syscalls which make strace hang are left
+// out.
+var syscallClasses = map[string][]string{
+	"file": {
+		"?open", "?openat", "?openat2", "?creat", "?close",
+		"?read", "?pread64", "?readv", "?preadv", "?preadv2",
+		"?write", "?pwrite64", "?writev", "?pwritev", "?pwritev2",
+		"?lseek", "?_llseek", "?mmap", "?mmap2", "?fcntl", "?fcntl64",
+		"?stat", "?stat64", "?lstat", "?lstat64", "?fstat", "?fstat64",
+		"?newfstatat", "?fstatat64", "?statx", "?statfs", "?fstatfs",
+		"?access", "?faccessat", "?faccessat2",
+		"?readlink", "?readlinkat", "?getdents", "?getdents64",
+		"?getxattr", "?lgetxattr", "?fgetxattr", "?listxattr", "?llistxattr", "?flistxattr",
+		"?mkdir", "?mkdirat", "?rmdir", "?unlink", "?unlinkat",
+		"?rename", "?renameat", "?renameat2", "?link", "?linkat", "?symlink", "?symlinkat",
+		"?chmod", "?fchmod", "?fchmodat", "?chown", "?fchown", "?fchownat", "?lchown",
+		"?truncate", "?ftruncate", "?utimensat", "?chdir", "?fchdir",
+		"?fadvise64", "?readahead", "?sendfile", "?copy_file_range",
+		"?fsync", "?fdatasync", "?flock", "?inotify_add_watch",
+	},
+	"net": {
+		"?socket", "?socketpair", "?connect", "?accept", "?accept4",
+		"?bind", "?listen", "?getsockname", "?getpeername",
+		"?sendto", "?recvfrom", "?sendmsg", "?recvmsg", "?sendmmsg", "?recvmmsg",
+		"?setsockopt", "?getsockopt", "?shutdown",
+	},
+	"ipc": {
+		"?pipe", "?pipe2", "?eventfd", "?eventfd2", "?memfd_create",
+		"?mq_open", "?mq_unlink", "?mq_timedsend", "?mq_timedreceive",
+		"?shmget", "?shmat", "?shmdt", "?shmctl",
+		"?semget", "?semop", "?semtimedop", "?semctl",
+		"?msgget", "?msgsnd", "?msgrcv", "?msgctl",
+	},
+	"process": {
+		"?execve", "?execveat", "?clone", "?clone3", "?fork", "?vfork",
+		"?exit", "?exit_group", "?wait4", "?waitid",
+		"?kill", "?tkill", "?tgkill", "?prctl", "?unshare", "?setns",
+		"?chroot", "?pivot_root", "?capset",
+		"?setuid", "?setgid", "?setresuid", "?setresgid", "?setgroups",
+	},
+}
+
+// processSyscalls are traced with any class of syscalls, to know which
+// program each process was running when it accessed the files
+var processSyscalls = []string{"?execve", "?execveat", "?clone", "?clone3", "?fork", "?vfork"}
+
+// tracedSyscallClasses are the classes of syscalls TraceFilesCommand traces,
+// all the syscalls which are not excluded are traced if there are none
+var tracedSyscallClasses []string
+
+// SyscallClasses returns the names of the classes of syscalls.
+func SyscallClasses() []string {
+	names := make([]string, 0, len(syscallClasses))
+	for name := range syscallClasses {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SetSyscallClasses sets the classes of syscalls TraceFilesCommand traces
+// instead of all the syscalls which are not excluded, like only the ones
+// accessing files or the network, which makes the traces of big programs much
+// smaller. No classes traces all of them again.
+func SetSyscallClasses(classes []string) error {
+	for _, class := range classes {
+		if _, ok := syscallClasses[class]; !ok {
+			return fmt.Errorf("unknown syscall class %q, must be one of %s", class, strings.Join(SyscallClasses(), ", "))
+		}
+	}
+	tracedSyscallClasses = classes
+	return nil
+}
+
+// syscallClassesExpr returns the strace expression tracing the syscalls of
+// the classes and the ones telling which programs the processes run, without
+// the excluded syscalls, or an empty string if there are no classes.
+func syscallClassesExpr() string {
+	if len(tracedSyscallClasses) == 0 {
+		return ""
+	}
+	excluded := make(map[string]bool)
+	for _, name := range excludedSyscalls {
+		excluded[name] = true
+	}
+	seen := make(map[string]bool)
+	var names []string
+	add := func(syscalls []string) {
+		for _, name := range syscalls {
+			if seen[name] || excluded[strings.TrimPrefix(name, "?")] {
+				continue
+			}
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	add(processSyscalls)
+	for _, class := range tracedSyscallClasses {
+		add(syscallClasses[class])
+	}
+	return "trace=" + strings.Join(names, ",")
+}
+
+// SetExcludedSyscalls sets the syscalls which are not traced instead of the
+// default ones, an empty list traces all syscalls.
+func SetExcludedSyscalls(names []string) {
+	excludedSyscalls = names
+	if excludedSyscalls == nil {
+		excludedSyscalls = []string{}
+	}
+}
+
+// knownSyscalls returns the syscalls of the names which the strace knows on
+// this architecture.
+func knownSyscalls(stracePath string, names []string) []string {
+	var known []string
+	for _, name := range names {
+		out, err := exec.Command(stracePath, "-e", "trace="+name, "-o", os.DevNull, "true").CombinedOutput()
+		// other errors, like ptrace being forbidden, don't tell whether the
+		// syscall is known, so it is still excluded
+		if err != nil && strings.Contains(string(out), "invalid system call") {
+			continue
+		}
+		known = append(known, name)
+	}
+	return known
+}
+
+// excludedSyscallsExpr returns the strace expression excluding the syscalls,
+// or an empty string if none are.
+func excludedSyscallsExpr(stracePath string) string {
+	names := excludedSyscalls
+	if names == nil {
+		var ok bool
+		names, ok = probedSyscalls[stracePath]
+		if !ok {
+			names = knownSyscalls(stracePath, defaultExcludedSyscalls)
+			probedSyscalls[stracePath] = names
+		}
+	}
+	if len(names) == 0 {
+		return ""
+	}
+	return "!" + strings.Join(names, ",")
+}
+
+// Scope is which processes of a traced program are kept in the trace
+type Scope string
+
+const (
+	// ScopeAll keeps every process the program runs
+	ScopeAll Scope = "all"
+	// ScopeFirstExec keeps only the initial process and the programs it
+	// executes itself, which is the application for launchers like snap run
+	// which execute it in the same process
+	ScopeFirstExec Scope = "first-exec"
+	// ScopeDirectChildren keeps the initial process and the processes it
+	// forks itself, but not their descendants
+	ScopeDirectChildren Scope = "direct-children"
+)
 
 // Command returns how to run strace in the users context with the
-// right set of excluded system calls.
-func straceCommand(extraStraceOpts []string, traceeCmd ...string) (*exec.Cmd, error) {
+// right set of excluded system calls. If privileged is true, the traced command
+// is run as root instead.
+func straceCommand(extraStraceOpts []string, privileged bool, traceeCmd ...string) (*exec.Cmd, error) {
 	current, err := user.Current()
 	if err != nil {
 		return nil, err
@@ -42,11 +255,13 @@ func straceCommand(extraStraceOpts []string, traceeCmd ...string) (*exec.Cmd, er
 		return nil, fmt.Errorf("cannot find an installed strace, please try 'snap install strace-static'")
 	}
 
-	args := []string{
-		stracePath,
-		"-u", current.Username,
-		"-f",
-		"-e", excludedSyscalls,
+	args := []string{stracePath}
+	if !privileged {
+		args = append(args, "-u", current.Username)
+	}
+	args = append(args, "-f")
+	if expr := excludedSyscallsExpr(stracePath); expr != "" {
+		args = append(args, "-e", expr)
 	}
 	args = append(args, extraStraceOpts...)
 	args = append(args, traceeCmd...)
@@ -64,23 +279,64 @@ func straceCommand(extraStraceOpts []string, traceeCmd ...string) (*exec.Cmd, er
 }
 
 // TraceExecCommand returns an exec.Cmd suitable for tracking timings of
-// execve{,at}() calls
-func TraceExecCommand(straceLogPath string, origCmd ...string) (*exec.Cmd, error) {
+// execve{,at}() calls and what else opts asks for, running the command as
+// root if privileged is true. The processes outside of the scope are still
+// followed, but dropped when the log is captured.
+func TraceExecCommand(straceLogPath string, privileged bool, scope Scope, opts ExecOptions, origCmd ...string) (*exec.Cmd, error) {
+	return straceCommand(traceExecOpts(straceLogPath, scope, opts), privileged, origCmd...)
+}
+
+// AttachExecCommand returns an exec.Cmd which attaches to the running process
+// pid to track the timings of the execve{,at}() calls of it and of the
+// processes it forks, like TraceExecCommand. The process is traced as the
+// user it already runs as.
+func AttachExecCommand(straceLogPath string, pid int, scope Scope, opts ExecOptions) (*exec.Cmd, error) {
+	extraStraceOpts := append(traceExecOpts(straceLogPath, scope, opts), "-p", strconv.Itoa(pid))
+	// the process is already running, so there is no user to run it as
+	return straceCommand(extraStraceOpts, true)
+}
+
+// traceExecOpts returns the strace options of TraceExecCommand and
+// AttachExecCommand.
+func traceExecOpts(straceLogPath string, scope Scope, opts ExecOptions) []string {
+	// only trace the execve syscalls
+	syscalls := "trace=execve,execveat"
+	if scope == ScopeDirectChildren {
+		// the fork syscalls are needed too to know which processes are the
+		// children of the initial process, the process class includes
+		// clone3() on the strace versions which know about it
+		syscalls = "trace=process"
+	}
+	if opts.Forks {
+		syscalls += ",?clone,?clone3,?fork,?vfork"
+	} else if opts.Waits || opts.Connects {
+		// the clones are needed to know which process the threads
+		// waiting or connecting belong to
+		syscalls += ",?clone,?clone3"
+	}
+	if opts.Waits {
+		syscalls += "," + strings.Join(waitSyscalls, ",")
+	}
+	if opts.Connects {
+		syscalls += ",connect"
+	}
 	extraStraceOpts := []string{
 		// we want maximum timing accuracy for measuring exec's
 		"-ttt",
-		// only trace the execve syscalls
-		"-e", "trace=execve,execveat",
+		"-e", syscalls,
 		// the output file to use (this is usually a fifo for best performance)
 		"-o", straceLogPath,
 	}
-
-	return straceCommand(extraStraceOpts, origCmd...)
+	if opts.Waits {
+		// the time spent in each syscall
+		extraStraceOpts = append(extraStraceOpts, "-T")
+	}
+	return extraStraceOpts
 }
 
 // TraceFilesCommand returns an exec.Cmd suitable for tracking files opened/used
-// during execution
-func TraceFilesCommand(straceLogPattern string, origCmd ...string) (*exec.Cmd, error) {
+// during execution, running the command as root if privileged is true
+func TraceFilesCommand(straceLogPattern string, privileged bool, origCmd ...string) (*exec.Cmd, error) {
 	extraStraceOpts := []string{
 		// we don't need timing info here, but we need to re-merge the
 		// logs, with strace-log-merge, and to work across day changes, this is
@@ -114,6 +370,11 @@ func TraceFilesCommand(straceLogPattern string, origCmd ...string) (*exec.Cmd, e
 		// strace-log-merge expects the files to be named
 		"-o", straceLogPattern,
 	}
+	if expr := syscallClassesExpr(); expr != "" {
+		// the traced syscalls given after the excluded ones replace
+		// them, like in TraceExecCommand
+		extraStraceOpts = append(extraStraceOpts, "-e", expr)
+	}
 
-	return straceCommand(extraStraceOpts, origCmd...)
+	return straceCommand(extraStraceOpts, privileged, origCmd...)
 }
@@ -0,0 +1,126 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package strace_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/anonymouse64/etrace/internal/strace"
+)
+
+type commandsSuite struct{}
+
+var _ = Suite(&commandsSuite{})
+
+// fakeStrace is like strace on arm64, which doesn't know select and
+// _newselect
+const fakeStrace = `#!/bin/sh
+case "$2" in
+trace=select|trace=_newselect)
+	echo "strace: invalid system call '${2#trace=}'" >&2
+	exit 1
+	;;
+esac
+`
+
+func (p *commandsSuite) TestExcludedSyscallsExpr(c *C) {
+	stracePath := filepath.Join(c.MkDir(), "strace")
+	c.Assert(ioutil.WriteFile(stracePath, []byte(fakeStrace), 0755), IsNil)
+
+	c.Check(strace.ExcludedSyscallsExpr(stracePath), Equals, "!pselect6,clock_gettime,sigaltstack,gettid,gettimeofday,nanosleep")
+
+	// the probed syscalls are kept for the next commands
+	c.Assert(ioutil.WriteFile(stracePath, []byte("#!/bin/sh\nexit 1\n"), 0755), IsNil)
+	c.Check(strace.ExcludedSyscallsExpr(stracePath), Equals, "!pselect6,clock_gettime,sigaltstack,gettid,gettimeofday,nanosleep")
+}
+
+func (p *commandsSuite) TestExcludedSyscallsExprUnknownError(c *C) {
+	// strace failing for other reasons doesn't drop the syscalls
+	stracePath := filepath.Join(c.MkDir(), "strace")
+	c.Assert(ioutil.WriteFile(stracePath, []byte("#!/bin/sh\necho 'strace: ptrace(PTRACE_TRACEME): Operation not permitted' >&2\nexit 1\n"), 0755), IsNil)
+
+	c.Check(strace.ExcludedSyscallsExpr(stracePath), Equals, "!select,pselect6,_newselect,clock_gettime,sigaltstack,gettid,gettimeofday,nanosleep")
+}
+
+func (p *commandsSuite) TestSetExcludedSyscalls(c *C) {
+	restore := strace.MockExcludedSyscalls(nil)
+	defer restore()
+
+	strace.SetExcludedSyscalls([]string{"gettimeofday", "futex"})
+	c.Check(strace.ExcludedSyscallsExpr("/not/probed"), Equals, "!gettimeofday,futex")
+
+	// nothing is excluded
+	strace.SetExcludedSyscalls(nil)
+	c.Check(strace.ExcludedSyscallsExpr("/not/probed"), Equals, "")
+}
+
+func (p *commandsSuite) TestSetSyscallClasses(c *C) {
+	restore := strace.MockSyscallClasses(nil)
+	defer restore()
+	restore = strace.MockExcludedSyscalls(nil)
+	defer restore()
+
+	c.Check(strace.SyscallClasses(), DeepEquals, []string{"file", "ipc", "net", "process"})
+
+	// all the syscalls are traced without classes
+	c.Check(strace.SyscallClassesExpr(), Equals, "")
+
+	// the syscalls telling which programs run are always traced, only once
+	c.Assert(strace.SetSyscallClasses([]string{"net", "process"}), IsNil)
+	c.Check(strace.SyscallClassesExpr(), Equals, "trace=?execve,?execveat,?clone,?clone3,?fork,?vfork,"+
+		"?socket,?socketpair,?connect,?accept,?accept4,?bind,?listen,?getsockname,?getpeername,"+
+		"?sendto,?recvfrom,?sendmsg,?recvmsg,?sendmmsg,?recvmmsg,?setsockopt,?getsockopt,?shutdown,"+
+		"?exit,?exit_group,?wait4,?waitid,?kill,?tkill,?tgkill,?prctl,?unshare,?setns,"+
+		"?chroot,?pivot_root,?capset,?setuid,?setgid,?setresuid,?setresgid,?setgroups")
+
+	// the excluded syscalls are still not traced
+	strace.SetExcludedSyscalls([]string{"connect", "clone3"})
+	c.Assert(strace.SetSyscallClasses([]string{"net"}), IsNil)
+	c.Check(strace.SyscallClassesExpr(), Equals, "trace=?execve,?execveat,?clone,?fork,?vfork,"+
+		"?socket,?socketpair,?accept,?accept4,?bind,?listen,?getsockname,?getpeername,"+
+		"?sendto,?recvfrom,?sendmsg,?recvmsg,?sendmmsg,?recvmmsg,?setsockopt,?getsockopt,?shutdown")
+
+	c.Check(strace.SetSyscallClasses([]string{"file", "disk"}), ErrorMatches, `unknown syscall class "disk", must be one of file, ipc, net, process`)
+	// the classes are unchanged
+	c.Check(strace.SyscallClassesExpr(), Matches, `trace=.*,\?shutdown`)
+}
+
+func (p *commandsSuite) TestTraceExecOpts(c *C) {
+	for _, t := range []struct {
+		scope    strace.Scope
+		opts     strace.ExecOptions
+		syscalls string
+	}{
+		{strace.ScopeAll, strace.ExecOptions{}, "trace=execve,execveat"},
+		{strace.ScopeDirectChildren, strace.ExecOptions{}, "trace=process"},
+		{strace.ScopeAll, strace.ExecOptions{Forks: true}, "trace=execve,execveat,?clone,?clone3,?fork,?vfork"},
+		{strace.ScopeAll, strace.ExecOptions{Connects: true}, "trace=execve,execveat,?clone,?clone3,connect"},
+		{strace.ScopeAll, strace.ExecOptions{Forks: true, Waits: true}, "trace=execve,execveat,?clone,?clone3,?fork,?vfork," +
+			"?futex,?poll,?ppoll,?epoll_wait,?epoll_pwait,?epoll_pwait2,?wait4,?waitid"},
+	} {
+		opts := strace.TraceExecOpts("/tmp/strace.fifo", t.scope, t.opts)
+		expected := []string{"-ttt", "-e", t.syscalls, "-o", "/tmp/strace.fifo"}
+		if t.opts.Waits {
+			expected = append(expected, "-T")
+		}
+		c.Check(opts, DeepEquals, expected, Commentf("%+v", t))
+	}
+}
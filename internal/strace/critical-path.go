@@ -0,0 +1,283 @@
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package strace
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/anonymouse64/etrace/internal/schema"
+)
+
+// PathStep is a part of the critical path of an execution, the time a program
+// ran without waiting for another program on the path
+type PathStep struct {
+	Start    time.Time
+	Duration time.Duration
+	Exe      string
+	// Pid is the process which executed the program
+	Pid int `json:"-"`
+}
+
+// Structured returns the step as encoded since version 2 of the schema.
+func (s PathStep) Structured() interface{} {
+	type plain PathStep
+	return struct {
+		plain
+		Duration schema.Duration
+	}{plain(s), schema.NewDuration(s.Duration)}
+}
+
+// CriticalPath is the chain of programs whose serial execution determined how
+// long an execution took, in the order they ran. A program is on it several
+// times if it waited for the processes it forked in between.
+type CriticalPath []PathStep
+
+// Structured returns the path as encoded since version 2 of the schema.
+func (p CriticalPath) Structured() interface{} {
+	if p == nil {
+		return nil
+	}
+	steps := make([]interface{}, 0, len(p))
+	for _, s := range p {
+		steps = append(steps, s.Structured())
+	}
+	return steps
+}
+
+// pathNode is a program of the process tree
+type pathNode struct {
+	rt ExeRuntime
+	// end is when the program stopped running, and stop is the same but no
+	// later than the end of the path
+	end, stop time.Time
+	// prev and next are the programs the process executed before and after,
+	// or -1
+	prev, next int
+	// parent is the program which forked the process if this is the first
+	// program of the process, or -1
+	parent int
+	// forked are the first programs of the processes the program forked
+	forked []int
+}
+
+// execTree returns the programs which started before the given time, or all of
+// them if it is zero, linked to the programs their processes executed before
+// and after them and to the programs which forked their processes. The forks
+// are only known with the pid tracker.
+func (stt *ExecveTiming) execTree(until time.Time) []pathNode {
+	var nodes []pathNode
+	for _, rt := range stt.ExeRuntimes {
+		if !until.IsZero() && !rt.Start.Before(until) {
+			continue
+		}
+		end := rt.Start.Add(rt.TotalSec)
+		stop := end
+		if !until.IsZero() && stop.After(until) {
+			stop = until
+		}
+		nodes = append(nodes, pathNode{rt: rt, end: end, stop: stop, prev: -1, next: -1, parent: -1})
+	}
+
+	// running returns the program the process was running at the given
+	// time, or -1
+	running := func(pid int, t time.Time) int {
+		for i, n := range nodes {
+			if n.rt.Pid == pid && !t.Before(n.rt.Start) && t.Before(n.end) {
+				return i
+			}
+		}
+		return -1
+	}
+	for i := range nodes {
+		n := &nodes[i]
+		for j, m := range nodes {
+			// the previous program ended when the process executed
+			// this one
+			if j != i && m.rt.Pid == n.rt.Pid && m.end.Equal(n.rt.Start) {
+				n.prev = j
+				nodes[j].next = i
+				break
+			}
+		}
+		if n.prev != -1 || stt.pidTracker == nil {
+			continue
+		}
+		// the process may have been forked by a process which didn't
+		// execute any program, which was forked by another one
+		seen := make(map[string]bool)
+		for pid := strconv.Itoa(n.rt.Pid); !seen[pid]; {
+			seen[pid] = true
+			parent, forkTime := stt.getFork(pid)
+			if parent == "" {
+				break
+			}
+			ppid, err := strconv.Atoi(parent)
+			if err != nil {
+				break
+			}
+			if p := running(ppid, forkTime); p != -1 {
+				n.parent = p
+				nodes[p].forked = append(nodes[p].forked, i)
+				break
+			}
+			pid = parent
+		}
+	}
+	return nodes
+}
+
+// CriticalPath returns the critical path of the execution until the given
+// time, like when the window appeared, or until the end of the trace if it is
+// zero. The path goes back from the program the initial process was running
+// last, through the programs which executed it and the processes they forked
+// and waited for. It needs all the programs of the trace and the forks of the
+// processes.
+func (stt *ExecveTiming) CriticalPath(until time.Time) CriticalPath {
+	nodes := stt.execTree(until)
+
+	last := func(i int) int {
+		for nodes[i].next != -1 {
+			i = nodes[i].next
+		}
+		return i
+	}
+
+	// start from the program the initial process was running last
+	cur := -1
+	for i, n := range nodes {
+		if n.prev != -1 || n.parent != -1 {
+			continue
+		}
+		if l := last(i); cur == -1 || nodes[l].stop.After(nodes[cur].stop) {
+			cur = l
+		}
+	}
+	if cur == -1 {
+		return nil
+	}
+
+	var path CriticalPath
+	addStep := func(n pathNode, from, to time.Time) {
+		if to.After(from) {
+			path = append(path, PathStep{Start: from, Duration: to.Sub(from), Exe: n.rt.Exe, Pid: n.rt.Pid})
+		}
+	}
+	waited := make(map[int]bool)
+	t := nodes[cur].stop
+	// every program is on the path at most once for itself and once for
+	// each process it waited for
+	for steps := 0; cur != -1 && steps <= 2*len(nodes); steps++ {
+		n := nodes[cur]
+		// the program may have waited for the process it forked which
+		// exited last before
+		head, child := -1, -1
+		for _, h := range n.forked {
+			l := last(h)
+			if waited[h] || nodes[l].end.After(t) {
+				continue
+			}
+			if child == -1 || nodes[l].end.After(nodes[child].end) {
+				head, child = h, l
+			}
+		}
+		if child != -1 {
+			addStep(n, nodes[child].end, t)
+			waited[head] = true
+			cur, t = child, nodes[child].end
+			continue
+		}
+		addStep(n, n.rt.Start, t)
+		t = n.rt.Start
+		if n.prev != -1 {
+			cur = n.prev
+		} else {
+			cur = n.parent
+		}
+	}
+
+	// the path was found backwards
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
+	}
+	return path
+}
+
+// Display shows the critical path
+func (p CriticalPath) Display(w io.Writer) {
+	if len(p) == 0 {
+		return
+	}
+	var total time.Duration
+	for _, step := range p {
+		total += step.Duration
+	}
+	fmt.Fprintf(w, "Critical path of %v in %d steps:\n", total, len(p))
+	fmt.Fprintf(w, "\tStart\tStop\tElapsed\tExec\n")
+	for _, step := range p {
+		relativeStart := step.Start.Sub(p[0].Start)
+		fmt.Fprintf(w,
+			"\t%d\t%d\t%v\t%s\n",
+			int64(relativeStart/time.Microsecond),
+			int64((relativeStart+step.Duration)/time.Microsecond),
+			step.Duration,
+			step.Exe,
+		)
+	}
+}
+
+// FoldedStack is a program executed with the programs which led to it, the
+// ones its process executed before it and the ones which forked its process
+type FoldedStack struct {
+	// Stack is the base names of the programs, outermost first and ending
+	// with the program
+	Stack    []string
+	Duration time.Duration
+}
+
+// FoldedStacks returns the stack of each program of the execution, in the
+// order they were executed, for flame graphs where a program spans the time
+// of the programs it led to. Without the forks of the processes, only the
+// programs executed by the same process are stacked.
+func (stt *ExecveTiming) FoldedStacks() []FoldedStack {
+	nodes := stt.execTree(time.Time{})
+	stacks := make([]FoldedStack, 0, len(nodes))
+	for j, n := range nodes {
+		var stack []string
+		seen := make(map[int]bool)
+		for i := j; i != -1 && !seen[i]; {
+			seen[i] = true
+			// semicolons separate the frames of folded stacks
+			stack = append(stack, strings.Replace(filepath.Base(nodes[i].rt.Exe), ";", "_", -1))
+			if nodes[i].prev != -1 {
+				i = nodes[i].prev
+			} else {
+				i = nodes[i].parent
+			}
+		}
+		for l, r := 0, len(stack)-1; l < r; l, r = l+1, r-1 {
+			stack[l], stack[r] = stack[r], stack[l]
+		}
+		stacks = append(stacks, FoldedStack{Stack: stack, Duration: n.rt.TotalSec})
+	}
+	return stacks
+}
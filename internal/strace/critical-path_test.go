@@ -0,0 +1,227 @@
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package strace_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/anonymouse64/etrace/internal/strace"
+)
+
+type criticalPathSuite struct{}
+
+var _ = Suite(&criticalPathSuite{})
+
+// the launcher waits for a helper and executes the app, and a daemon forked
+// in between keeps running after the launcher executed the app
+var criticalPathLog = `100 1542815326.000000 execve("/usr/bin/launcher", ["launcher"], 0x1566008 /* 69 vars */) = 0
+100 1542815326.050000 clone(child_stack=0x7f5e3a1eefb0, flags=CLONE_VM|CLONE_FS|CLONE_FILES|CLONE_SIGHAND|CLONE_THREAD|CLONE_SYSVSEM|CLONE_SETTLS|CLONE_PARENT_SETTID|CLONE_CHILD_CLEARTID, parent_tid=[110], tls=0x7f5e3a1ef700, child_tidptr=0x7f5e3a1ef9d0) = 110
+110 1542815326.100000 clone(child_stack=NULL, flags=CLONE_CHILD_CLEARTID|CLONE_CHILD_SETTID|SIGCHLD, child_tidptr=0x7f5e3b1f0a10) = 101
+101 1542815326.150000 execve("/usr/bin/helper", ["helper"], 0x1566008 /* 69 vars */) = 0
+100 1542815326.400000 --- SIGCHLD {si_signo=SIGCHLD, si_code=CLD_EXITED, si_pid=101, si_uid=1000, si_status=0, si_utime=0, si_stime=0} ---
+100 1542815326.450000 clone(child_stack=NULL, flags=CLONE_CHILD_CLEARTID|CLONE_CHILD_SETTID|SIGCHLD, child_tidptr=0x7f5e3b1f0a10) = 102
+102 1542815326.500000 execve("/usr/bin/daemon", ["daemon"], 0x1566008 /* 69 vars */) = 0
+100 1542815326.600000 execve("/usr/bin/app", ["app"], 0x1566008 /* 69 vars */) = 0
+102 1542815326.800000 +++ killed by SIGKILL +++
+100 1542815327.000000 +++ exited with 0 +++
+`
+
+func (s *criticalPathSuite) TestCriticalPath(c *C) {
+	log := filepath.Join(c.MkDir(), "strace.log")
+	c.Assert(ioutil.WriteFile(log, []byte(criticalPathLog), 0644), IsNil)
+	timing, err := strace.TraceExecveTimings(log, -1)
+	c.Assert(err, IsNil)
+
+	start := time.Unix(1542815326, 0)
+	type step struct {
+		exe        string
+		start, end time.Duration
+	}
+	for _, t := range []struct {
+		until time.Duration
+		exp   []step
+	}{
+		// the helper forked by a thread of the launcher is waited for,
+		// the daemon exited after the launcher executed the app
+		{0, []step{
+			{"/usr/bin/launcher", 0, 150 * time.Millisecond},
+			{"/usr/bin/helper", 150 * time.Millisecond, 400 * time.Millisecond},
+			{"/usr/bin/launcher", 400 * time.Millisecond, 600 * time.Millisecond},
+			{"/usr/bin/app", 600 * time.Millisecond, time.Second},
+		}},
+		// the app wasn't executed yet
+		{550 * time.Millisecond, []step{
+			{"/usr/bin/launcher", 0, 150 * time.Millisecond},
+			{"/usr/bin/helper", 150 * time.Millisecond, 400 * time.Millisecond},
+			{"/usr/bin/launcher", 400 * time.Millisecond, 550 * time.Millisecond},
+		}},
+	} {
+		var until time.Time
+		if t.until != 0 {
+			until = start.Add(t.until)
+		}
+		path := timing.CriticalPath(until)
+		c.Assert(path, HasLen, len(t.exp), Commentf("until %v", t.until))
+		for i, step := range path {
+			c.Check(step.Exe, Equals, t.exp[i].exe)
+			c.Check(step.Start.Sub(start), Equals, t.exp[i].start)
+			c.Check(step.Start.Add(step.Duration).Sub(start), Equals, t.exp[i].end)
+		}
+	}
+}
+
+func (s *criticalPathSuite) TestCriticalPathWithoutForks(c *C) {
+	// without the forks, only the programs executed by the initial process
+	// are known to be on the path
+	start := time.Unix(1542815326, 0)
+	timing := &strace.ExecveTiming{ExeRuntimes: []strace.ExeRuntime{
+		{Start: start, Exe: "/usr/bin/launcher", TotalSec: 600 * time.Millisecond, Pid: 100},
+		{Start: start.Add(150 * time.Millisecond), Exe: "/usr/bin/helper", TotalSec: 250 * time.Millisecond, Pid: 101},
+		{Start: start.Add(600 * time.Millisecond), Exe: "/usr/bin/app", TotalSec: 400 * time.Millisecond, Pid: 100},
+	}}
+	path := timing.CriticalPath(time.Time{})
+	c.Assert(path, HasLen, 2)
+	c.Check(path[0].Exe, Equals, "/usr/bin/launcher")
+	c.Check(path[0].Duration, Equals, 600*time.Millisecond)
+	c.Check(path[1].Exe, Equals, "/usr/bin/app")
+	c.Check(path[1].Duration, Equals, 400*time.Millisecond)
+
+	c.Check((&strace.ExecveTiming{}).CriticalPath(time.Time{}), IsNil)
+}
+
+func (s *criticalPathSuite) TestDisplay(c *C) {
+	start := time.Unix(1542815326, 0)
+	path := strace.CriticalPath{
+		{Start: start, Duration: 150 * time.Millisecond, Exe: "/usr/bin/launcher"},
+		{Start: start.Add(150 * time.Millisecond), Duration: 250 * time.Millisecond, Exe: "/usr/bin/helper"},
+	}
+	var buf bytes.Buffer
+	path.Display(&buf)
+	c.Check(buf.String(), Equals, `Critical path of 400ms in 2 steps:
+	Start	Stop	Elapsed	Exec
+	0	150000	150ms	/usr/bin/launcher
+	150000	400000	250ms	/usr/bin/helper
+`)
+}
+
+func (s *criticalPathSuite) TestFoldedStacks(c *C) {
+	log := filepath.Join(c.MkDir(), "strace.log")
+	c.Assert(ioutil.WriteFile(log, []byte(criticalPathLog), 0644), IsNil)
+	timing, err := strace.TraceExecveTimings(log, -1)
+	c.Assert(err, IsNil)
+
+	// the app replaced the launcher in its process, the helper and the
+	// daemon were forked by it
+	c.Check(timing.FoldedStacks(), DeepEquals, []strace.FoldedStack{
+		{Stack: []string{"launcher"}, Duration: 600 * time.Millisecond},
+		{Stack: []string{"launcher", "helper"}, Duration: 250 * time.Millisecond},
+		{Stack: []string{"launcher", "daemon"}, Duration: 300 * time.Millisecond},
+		{Stack: []string{"launcher", "app"}, Duration: 400 * time.Millisecond},
+	})
+}
+
+func (s *criticalPathSuite) TestFoldedStacksWithoutForks(c *C) {
+	start := time.Unix(1542815326, 0)
+	timing := &strace.ExecveTiming{ExeRuntimes: []strace.ExeRuntime{
+		{Start: start, Exe: "/usr/lib/snapd/snap-confine", TotalSec: 100 * time.Millisecond, Pid: 100},
+		{Start: start.Add(100 * time.Millisecond), Exe: "/usr/lib/snapd/snap-exec", TotalSec: 50 * time.Millisecond, Pid: 100},
+		{Start: start.Add(150 * time.Millisecond), Exe: "/snap/app/1/bin/my;app", TotalSec: 850 * time.Millisecond, Pid: 100},
+		{Start: start.Add(200 * time.Millisecond), Exe: "/usr/bin/helper", TotalSec: 250 * time.Millisecond, Pid: 101},
+	}}
+	c.Check(timing.FoldedStacks(), DeepEquals, []strace.FoldedStack{
+		{Stack: []string{"snap-confine"}, Duration: 100 * time.Millisecond},
+		{Stack: []string{"snap-confine", "snap-exec"}, Duration: 50 * time.Millisecond},
+		{Stack: []string{"snap-confine", "snap-exec", "my_app"}, Duration: 850 * time.Millisecond},
+		{Stack: []string{"helper"}, Duration: 250 * time.Millisecond},
+	})
+}
+
+// the helper forked by the launcher executes another helper after the
+// launcher executed the app, which forks a worker
+var treeLog = `100 1542815326.000000 execve("/usr/bin/launcher", ["launcher"], 0x1566008 /* 69 vars */) = 0
+100 1542815326.050000 clone(child_stack=NULL, flags=CLONE_CHILD_CLEARTID|CLONE_CHILD_SETTID|SIGCHLD, child_tidptr=0x7f5e3b1f0a10) = 101
+101 1542815326.100000 execve("/usr/bin/helper", ["helper"], 0x1566008 /* 69 vars */) = 0
+100 1542815326.200000 execve("/usr/bin/app", ["app"], 0x1566008 /* 69 vars */) = 0
+101 1542815326.300000 execve("/usr/bin/helper2", ["helper2"], 0x1566008 /* 69 vars */) = 0
+100 1542815326.350000 clone(child_stack=NULL, flags=CLONE_CHILD_CLEARTID|CLONE_CHILD_SETTID|SIGCHLD, child_tidptr=0x7f5e3b1f0a10) = 102
+102 1542815326.400000 execve("/usr/bin/worker", ["worker"], 0x1566008 /* 69 vars */) = 0
+102 1542815326.500000 +++ exited with 0 +++
+100 1542815326.500000 --- SIGCHLD {si_signo=SIGCHLD, si_code=CLD_EXITED, si_pid=102, si_uid=1000, si_status=0, si_utime=0, si_stime=0} ---
+101 1542815326.600000 +++ exited with 0 +++
+100 1542815326.600000 --- SIGCHLD {si_signo=SIGCHLD, si_code=CLD_EXITED, si_pid=101, si_uid=1000, si_status=0, si_utime=0, si_stime=0} ---
+100 1542815327.000000 +++ exited with 0 +++
+`
+
+func (s *criticalPathSuite) TestDisplayTree(c *C) {
+	log := filepath.Join(c.MkDir(), "strace.log")
+	c.Assert(ioutil.WriteFile(log, []byte(treeLog), 0644), IsNil)
+	timing, err := strace.TraceExecveTimings(log, -1)
+	c.Assert(err, IsNil)
+
+	// the programs of the processes forked by a program are underneath it,
+	// the programs executed next by a process are lined up with the
+	// program it executed before
+	var buf bytes.Buffer
+	timing.Display(&buf, nil)
+	c.Check(buf.String(), Equals, `5 exec calls during snap run:
+	Start	Stop	Elapsed	User	System	Exec
+	0	200000	200ms	-	-	/usr/bin/launcher
+	100000	300000	200ms	-	-	  /usr/bin/helper
+	300000	600000	300ms	0s	0s	  /usr/bin/helper2
+	200000	1000000	800ms	-	-	/usr/bin/app
+	400000	500000	100ms	0s	0s	  /usr/bin/worker
+Total time:  1s
+`)
+
+	// in the order the programs started
+	buf.Reset()
+	timing.Display(&buf, &strace.DisplayOptions{Flat: true})
+	c.Check(buf.String(), Equals, `5 exec calls during snap run:
+	Start	Stop	Elapsed	User	System	Exec
+	0	200000	200ms	-	-	/usr/bin/launcher
+	100000	300000	200ms	-	-	/usr/bin/helper
+	200000	1000000	800ms	-	-	/usr/bin/app
+	300000	600000	300ms	0s	0s	/usr/bin/helper2
+	400000	500000	100ms	0s	0s	/usr/bin/worker
+Total time:  1s
+`)
+}
+
+func (s *criticalPathSuite) TestDisplayTreeWithoutForks(c *C) {
+	// without the forks, the programs are in the order they started
+	start := time.Unix(1542815326, 0)
+	timing := &strace.ExecveTiming{ExeRuntimes: []strace.ExeRuntime{
+		{Start: start, Exe: "/usr/bin/launcher", TotalSec: 200 * time.Millisecond, Pid: 100},
+		{Start: start.Add(100 * time.Millisecond), Exe: "/usr/bin/helper", TotalSec: 500 * time.Millisecond, Pid: 101},
+		{Start: start.Add(200 * time.Millisecond), Exe: "/usr/bin/app", TotalSec: 800 * time.Millisecond, Pid: 100},
+	}, TotalTime: time.Second}
+	var buf bytes.Buffer
+	timing.Display(&buf, nil)
+	c.Check(buf.String(), Equals, `3 exec calls during snap run:
+	Start	Stop	Elapsed	User	System	Exec
+	0	200000	200ms	-	-	/usr/bin/launcher
+	100000	600000	500ms	-	-	/usr/bin/helper
+	200000	1000000	800ms	-	-	/usr/bin/app
+Total time:  1s
+`)
+}
@@ -22,4 +22,7 @@ package strace
 // TODO: make this go away and do it more cleanly
 type DisplayOptions struct {
 	NoDisplayPrograms bool
+	// Flat shows the programs executed in the order they started instead
+	// of as a tree of the processes forking them
+	Flat bool
 }
@@ -21,20 +21,63 @@ import (
 	"bufio"
 	"fmt"
 	"io"
-	"math"
 	"os"
+	"path/filepath"
 	"regexp"
 	"sort"
 	"strconv"
+	"strings"
 	"time"
+
+	"github.com/anonymouse64/etrace/internal/capture"
+	"github.com/anonymouse64/etrace/internal/schema"
 )
 
 // ExeRuntime is the runtime of an individual executable
 type ExeRuntime struct {
 	Start    time.Time
 	Exe      string
+	Args     []string `json:",omitempty"`
 	TotalSec time.Duration
-	pid      string
+	// CPU is the CPU time the process used, it is only known for the last
+	// program a process executed when its parent was traced, and includes
+	// the CPU time of the programs the process executed before
+	CPU *capture.CPUTime `json:",omitempty"`
+	// Blocked is the time the threads of the process spent waiting in the
+	// futex, poll and wait system calls while running the program, the
+	// threads may wait at the same time so it can be longer than the
+	// program ran, it is only measured when tracing the waits
+	Blocked time.Duration `json:",omitempty"`
+	// DisplayConnection is how long after it was executed the program first
+	// connected to the X11 or Wayland display server, it is only measured
+	// when tracing the connections
+	DisplayConnection time.Duration `json:",omitempty"`
+	// Pid is the process which executed the program
+	Pid int `json:"-"`
+	// Parent is the process which forked the one which executed the
+	// program, it is 0 if the fork wasn't traced
+	Parent int `json:"-"`
+}
+
+// Structured returns the runtime as encoded since version 2 of the schema.
+func (rt ExeRuntime) Structured() interface{} {
+	type plain ExeRuntime
+	v := struct {
+		plain
+		TotalSec          schema.Duration
+		CPU               interface{}      `json:",omitempty"`
+		Blocked           *schema.Duration `json:",omitempty"`
+		DisplayConnection *schema.Duration `json:",omitempty"`
+	}{
+		plain:             plain(rt),
+		TotalSec:          schema.NewDuration(rt.TotalSec),
+		Blocked:           schema.OptionalDuration(rt.Blocked),
+		DisplayConnection: schema.OptionalDuration(rt.DisplayConnection),
+	}
+	if rt.CPU != nil {
+		v.CPU = rt.CPU.Structured()
+	}
+	return v
 }
 
 // ExecveTiming measures the execve calls timings under strace. This is
@@ -51,22 +94,60 @@ type ExecveTiming struct {
 	*pidTracker
 }
 
+// Structured returns the timing as encoded since version 2 of the schema.
+func (t *ExecveTiming) Structured() interface{} {
+	type plain ExecveTiming
+	v := struct {
+		plain
+		TotalTime   schema.Duration
+		ExeRuntimes []interface{}
+	}{
+		plain:     plain(*t),
+		TotalTime: schema.NewDuration(t.TotalTime),
+	}
+	if t.ExeRuntimes != nil {
+		v.ExeRuntimes = make([]interface{}, 0, len(t.ExeRuntimes))
+		for _, rt := range t.ExeRuntimes {
+			v.ExeRuntimes = append(v.ExeRuntimes, rt.Structured())
+		}
+	}
+	return v
+}
+
 type execveTimingTracer interface {
-	addExeRuntime(start float64, exe string, totalSec float64, pid string)
+	addExeRuntime(start time.Time, exe string, total time.Duration, pid string, cpu *capture.CPUTime)
 
-	getPid(pid string) (startTime float64, exe string)
-	addPid(pid string, startTime float64, exe string)
+	getPid(pid string) (startTime time.Time, exe string)
+	addPid(pid string, startTime time.Time, exe string)
+	setArgs(pid string, args []string)
+	addBlocked(pid string, d time.Duration)
+	addFork(pid, child string, forkTime time.Time)
+	addDisplayConnection(pid string, t time.Time)
 	deletePid(pid string)
 }
 
-func unixFloatSecondsToTime(t float64) time.Time {
-	// check to make sure the time isn't outside of the bounds of an int64
-	if t > math.MaxInt64 || t < math.MinInt64 {
-		panic(fmt.Sprintf("time %f is outside of int64 range", t))
+// parseStraceTime parses the seconds since the epoch with microseconds as
+// strace prints them exactly, i.e. 1542815326.700248
+func parseStraceTime(s string) (time.Time, error) {
+	secStr, fracStr := s, ""
+	if i := strings.IndexByte(s, '.'); i != -1 {
+		secStr, fracStr = s[:i], s[i+1:]
+	}
+	if len(fracStr) > 9 {
+		fracStr = fracStr[:9]
+	}
+	sec, err := strconv.ParseInt(secStr, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var nsec int64
+	if fracStr != "" {
+		nsec, err = strconv.ParseInt(fracStr+strings.Repeat("0", 9-len(fracStr)), 10, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
 	}
-	startUnixSeconds := math.Floor(t)
-	startUnixNanoseconds := (t - startUnixSeconds) * float64(time.Second)
-	return time.Unix(int64(startUnixSeconds), int64(startUnixNanoseconds))
+	return time.Unix(sec, nsec), nil
 }
 
 // newExecveTiming returns a new ExecveTiming struct that keeps
@@ -78,18 +159,45 @@ func newExecveTiming(nSlowestSamples int) *ExecveTiming {
 	return e
 }
 
-func (stt *ExecveTiming) addExeRuntime(start float64, exe string, totalSec float64, pid string) {
+func (stt *ExecveTiming) addExeRuntime(start time.Time, exe string, total time.Duration, pid string, cpu *capture.CPUTime) {
+	pidNum, _ := strconv.Atoi(pid)
+	var displayConnection time.Duration
+	if connected := stt.getDisplayConnection(pid); !connected.IsZero() {
+		displayConnection = connected.Sub(start)
+	}
+	parent, _ := stt.getFork(pid)
+	parentNum, _ := strconv.Atoi(parent)
 	stt.ExeRuntimes = append(stt.ExeRuntimes, ExeRuntime{
-		Start:    unixFloatSecondsToTime(start),
-		Exe:      exe,
-		TotalSec: time.Duration(totalSec * float64(time.Second)),
-		pid:      pid,
+		Start:             start,
+		Exe:               exe,
+		Args:              stt.getArgs(pid),
+		TotalSec:          total,
+		CPU:               cpu,
+		Blocked:           stt.getBlocked(pid),
+		DisplayConnection: displayConnection,
+		Pid:               pidNum,
+		Parent:            parentNum,
 	})
 	if stt.nSlowestSamples > 0 {
 		stt.prune()
 	}
 }
 
+// sortExeRuntimes sorts the runtimes by when they started, breaking ties so
+// that the same trace always results in the same order.
+func (stt *ExecveTiming) sortExeRuntimes() {
+	sort.SliceStable(stt.ExeRuntimes, func(i, j int) bool {
+		a, b := stt.ExeRuntimes[i], stt.ExeRuntimes[j]
+		if !a.Start.Equal(b.Start) {
+			return a.Start.Before(b.Start)
+		}
+		if a.Pid != b.Pid {
+			return a.Pid < b.Pid
+		}
+		return a.Exe < b.Exe
+	})
+}
+
 // prune() ensures the number of ExeRuntimes stays with the nSlowestSamples
 // limit
 func (stt *ExecveTiming) prune() {
@@ -111,33 +219,178 @@ func (stt *ExecveTiming) Display(w io.Writer, opts *DisplayOptions) {
 		return
 	}
 
+	// the blocked time is only shown if the waits were traced
+	withBlocked := false
+	for _, rt := range stt.ExeRuntimes {
+		if rt.Blocked != 0 {
+			withBlocked = true
+			break
+		}
+	}
+
 	fmt.Fprintf(w, "%d exec calls during snap run:\n", len(stt.ExeRuntimes))
-	fmt.Fprintf(w, "\tStart\tStop\tElapsed\tExec\n")
+	if withBlocked {
+		fmt.Fprintf(w, "\tStart\tStop\tElapsed\tUser\tSystem\tBlocked\tExec\n")
+	} else {
+		fmt.Fprintf(w, "\tStart\tStop\tElapsed\tUser\tSystem\tExec\n")
+	}
 
-	sort.Slice(stt.ExeRuntimes, func(i, j int) bool {
-		return stt.ExeRuntimes[i].Start.Before(stt.ExeRuntimes[j].Start)
-	})
+	stt.sortExeRuntimes()
 
-	// TODO: this shows processes linearly, when really I think we want a
-	// tree/forest style output showing forked processes indented underneath the
-	// parent, with exec'd processes lined up with their previous executable
-	// but note that doing so in the most generic case isn't neat since you can
-	// have processes that are forked much later than others and will be aligned
-	// with previous executables much earlier in the output
-	for _, rt := range stt.ExeRuntimes {
+	// the programs are shown as a tree when the forks are known, with the
+	// programs of the forked processes indented underneath the program
+	// which forked them and the programs executed by a process lined up
+	// with the program it executed before
+	order := make([]int, len(stt.ExeRuntimes))
+	for i := range order {
+		order[i] = i
+	}
+	var depths []int
+	if (opts == nil || !opts.Flat) && stt.pidTracker != nil && len(stt.forks) != 0 {
+		order, depths = stt.treeOrder()
+	}
+	for j, i := range order {
+		rt := stt.ExeRuntimes[i]
 		relativeStart := rt.Start.Sub(stt.ExeRuntimes[0].Start)
+		exe := rt.Exe
+		if depths != nil {
+			exe = strings.Repeat("  ", depths[j]) + exe
+		}
+		user, system := "-", "-"
+		if rt.CPU != nil {
+			user, system = rt.CPU.User.String(), rt.CPU.System.String()
+		}
+		if withBlocked {
+			system += "\t" + rt.Blocked.String()
+		}
 		fmt.Fprintf(w,
-			"\t%d\t%d\t%v\t%s\n",
+			"\t%d\t%d\t%v\t%s\t%s\t%s\n",
 			int64(relativeStart/time.Microsecond),
 			int64((relativeStart+rt.TotalSec)/time.Microsecond),
 			rt.TotalSec,
-			rt.Exe,
+			user,
+			system,
+			exe,
 		)
 	}
 
 	fmt.Fprintln(w, "Total time: ", stt.TotalTime)
 }
 
+// treeOrder returns the indexes of the programs in the order of the tree of
+// the processes forking them, each program followed by the programs of the
+// processes it forked and then by the program its process executed next, and
+// the depth of each of them in the tree.
+func (stt *ExecveTiming) treeOrder() (order, depths []int) {
+	nodes := stt.execTree(time.Time{})
+	order = make([]int, 0, len(nodes))
+	depths = make([]int, 0, len(nodes))
+	visited := make([]bool, len(nodes))
+	var visit func(i, depth int)
+	visit = func(i, depth int) {
+		for ; i != -1 && !visited[i]; i = nodes[i].next {
+			visited[i] = true
+			order = append(order, i)
+			depths = append(depths, depth)
+			for _, child := range nodes[i].forked {
+				visit(child, depth+1)
+			}
+		}
+	}
+	for i, n := range nodes {
+		if n.prev == -1 && n.parent == -1 {
+			visit(i, 0)
+		}
+	}
+	// programs whose chain wasn't reached are kept at the top
+	for i := range nodes {
+		visit(i, 0)
+	}
+	return order, depths
+}
+
+// snapdInternalExes are the basenames of programs from snapd that are executed
+// while setting up a snap for running, before any program from the snap itself
+// is executed
+var snapdInternalExes = map[string]bool{
+	"snap":            true,
+	"snap-confine":    true,
+	"snap-update-ns":  true,
+	"snap-exec":       true,
+	"snap-seccomp":    true,
+	"snap-discard-ns": true,
+	"apparmor_parser": true,
+}
+
+// NamespaceSetupTime returns the time from when snap-confine was first executed
+// until the first program which is not part of snapd was executed, which is
+// the time spent constructing the snap's mount namespace and sandbox. The
+// second return value is false if the trace doesn't contain both of those
+// executions.
+func (stt *ExecveTiming) NamespaceSetupTime() (time.Duration, bool) {
+	confineStart, appStart := stt.confinementStarts()
+	if appStart.IsZero() {
+		return 0, false
+	}
+	return appStart.Sub(confineStart), true
+}
+
+// StoppedInConfinement returns whether the trace executed snap-confine but no
+// program which is not part of snapd after it. This is what the trace of a
+// snap looks like when strace couldn't follow snap-confine, which as the
+// current user it can't on some kernels because of the setuid transition, so
+// the app was never seen running and the trace stopped early.
+func (stt *ExecveTiming) StoppedInConfinement() bool {
+	confineStart, appStart := stt.confinementStarts()
+	return !confineStart.IsZero() && appStart.IsZero()
+}
+
+// confinementStarts returns when snap-confine was first executed and when the
+// first program which is not part of snapd was executed after it, each is the
+// zero time if the trace doesn't contain it.
+func (stt *ExecveTiming) confinementStarts() (confineStart, appStart time.Time) {
+	sorted := make([]ExeRuntime, len(stt.ExeRuntimes))
+	copy(sorted, stt.ExeRuntimes)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Start.Before(sorted[j].Start)
+	})
+
+	for _, rt := range sorted {
+		base := filepath.Base(rt.Exe)
+		if confineStart.IsZero() {
+			if base == "snap-confine" {
+				confineStart = rt.Start
+			}
+			continue
+		}
+		if !snapdInternalExes[base] {
+			return confineStart, rt.Start
+		}
+	}
+	return confineStart, time.Time{}
+}
+
+// FirstDisplayConnection returns when any process of the trace first connected
+// to the X11 or Wayland display server, or the zero time if the connections
+// weren't traced or none connected.
+func (stt *ExecveTiming) FirstDisplayConnection() time.Time {
+	if stt.pidTracker != nil {
+		return stt.firstDisplayConnection
+	}
+	// the processes which didn't execute a program are only known while
+	// tracing
+	var first time.Time
+	for _, rt := range stt.ExeRuntimes {
+		if rt.DisplayConnection == 0 {
+			continue
+		}
+		if connected := rt.Start.Add(rt.DisplayConnection); first.IsZero() || connected.Before(first) {
+			first = connected
+		}
+	}
+	return first
+}
+
 // TODO: can execve calls be "interrupted" like clone() below?
 // lines look like:
 // PID   TIME              SYSCALL
@@ -154,24 +407,109 @@ var execveatRE = regexp.MustCompile(`([0-9]+)\ +([0-9.]+) execveat\(.*\["([^"]+)
 // 17559 1542815330.242750 --- SIGCHLD {si_signo=SIGCHLD, si_code=CLD_EXITED, si_pid=17643, si_uid=1000, si_status=0, si_utime=0, si_stime=0} ---
 var sigChldTermRE = regexp.MustCompile(`[0-9]+\ +([0-9.]+).*SIG(CHLD|TERM)\ {.*si_pid=([0-9]+),`)
 
+// SIGCHLD lines also have the user and system CPU time the child used in clock
+// ticks, see sigChldTermRE
+var sigChldCPURE = regexp.MustCompile(`si_utime=([0-9]+), si_stime=([0-9]+)`)
+
+// clockTicks is USER_HZ, which the CPU times of SIGCHLD are measured in
+const clockTicks = 100
+
 // lines look like
 // PID   TIME                            SIGNAL
 // 20882 1573257274.988650 +++ killed by SIGKILL +++
 var sigkillRE = regexp.MustCompile(`([0-9]+)\ +([0-9.]+) \+\+\+ killed by SIGKILL \+\+\+`)
 
+// lines look like (the fork may also be interrupted and resumed later):
+// PID   TIME              SYSCALL
+// 17363 1542815326.700248 clone(child_stack=NULL, flags=CLONE_CHILD_CLEARTID|CLONE_CHILD_SETTID|SIGCHLD, child_tidptr=0x7f5e3b1f0a10) = 17364
+// 17363 1542815326.700248 <... clone3 resumed> => {parent_tid=[17364]}, 88) = 17364
+var forkRE = regexp.MustCompile(`^([0-9]+)\ +([0-9.]+) (?:<\.\.\. )?(?:clone3?|v?fork)(?:\(| resumed>).* = ([0-9]+)`)
+
+// lines look like (the clone may also be interrupted and resumed later, in
+// which case only the interrupted line has the flags):
+// PID   TIME              SYSCALL
+// 17363 1542815326.700248 clone(child_stack=0x7f5e3a1eefb0, flags=CLONE_VM|CLONE_FS|CLONE_FILES|CLONE_SIGHAND|CLONE_THREAD|CLONE_SYSVSEM|CLONE_SETTLS|CLONE_PARENT_SETTID|CLONE_CHILD_CLEARTID, parent_tid=[17364], tls=0x7f5e3a1ef700, child_tidptr=0x7f5e3a1ef9d0) = 17364
+// 17363 1542815326.700248 clone3({flags=CLONE_VM|CLONE_FS|CLONE_FILES|CLONE_SIGHAND|CLONE_THREAD|CLONE_SYSVSEM|CLONE_SETTLS|CLONE_PARENT_SETTID|CLONE_CHILD_CLEARTID, child_tid=0x7f5e3a1ef9d0, parent_tid=0x7f5e3a1ef9d0, exit_signal=0, stack=0x7f5e3a1ef000, stack_size=0x7fff00, tls=0x7f5e3a1ef700} <unfinished ...>
+var cloneThreadRE = regexp.MustCompile(`^([0-9]+)\ +[0-9.]+ clone3?\(.*CLONE_THREAD`)
+
+// lines look like (with -T the time spent in the syscall is at the end, the
+// syscall may also be interrupted and resumed later):
+// PID   TIME              SYSCALL
+// 17363 1542815326.700248 futex(0x7f5e3b1f0a10, FUTEX_WAIT_PRIVATE, 0, NULL) = 0 <0.250371>
+// 17363 1542815326.700248 <... poll resumed>) = 1 ([{fd=3, revents=POLLIN}]) <0.012345>
+var waitRE = regexp.MustCompile(`^([0-9]+)\ +([0-9.]+) (?:<\.\.\. )?(futex|poll|ppoll|epoll_wait|epoll_pwait2?|wait4|waitid)(?:\(| resumed>).*<([0-9.]+)>$`)
+
+// lines look like (the socket of X11 is usually abstract, which strace shows
+// with a leading @):
+// PID   TIME              SYSCALL
+// 17363 1542815326.700248 connect(3, {sa_family=AF_UNIX, sun_path=@"/tmp/.X11-unix/X0"}, 20) = 0
+// 17363 1542815326.700248 connect(4, {sa_family=AF_UNIX, sun_path="/run/user/1000/wayland-0"}, 27) = 0
+var displayConnectRE = regexp.MustCompile(`^([0-9]+)\ +([0-9.]+) connect\([0-9]+(?:<[^>]*>)?, \{sa_family=AF_UNIX, sun_path=(@?"[^"]*(?:/\.X11-unix/X[0-9]+|/wayland-[0-9]+)")\}, [0-9]+\) = 0`)
+
+// lines look like
+// PID   TIME              EXIT
+// 17363 1542815330.242750 +++ exited with 0 +++
+var exitedRE = regexp.MustCompile(`^([0-9]+)\ +([0-9.]+) \+\+\+ exited with [0-9]+ \+\+\+`)
+
 // this is a silly function but de-duplicates the code
-func parsePIDAndReturnOthers(match []string) (string, float64, string, error) {
-	execStart, err := strconv.ParseFloat(match[2], 64)
-	if err != nil {
-		return "", 0, "", err
-	}
+func parsePIDAndReturnOthers(match []string) (int, time.Time, string, error) {
 	// for all matches, match[1] is the pid and match[2] is the time
 	// for execve matches, match[3] is the exe
 	// for file matches, match[3] is the syscall
-	return match[1], execStart, match[3], nil
+	// for fork matches, match[3] is the new process
+	// for display connection matches, match[3] is the socket
+	pid, err := strconv.Atoi(match[1])
+	if err != nil {
+		return 0, time.Time{}, "", err
+	}
+	t, err := parseStraceTime(match[2])
+	if err != nil {
+		return 0, time.Time{}, "", err
+	}
+	return pid, t, match[3], nil
 }
 
-func handleExecMatch(trace execveTimingTracer, match []string) error {
+// parseExecArgs returns the argv array of an execve{,at}() line, which is the
+// first array argument of the syscall. Escape sequences are kept as strace
+// printed them, and note that strace truncates long strings and adds "..."
+// after them, which is dropped here.
+func parseExecArgs(line string) []string {
+	lparen := strings.Index(line, "(")
+	if lparen == -1 {
+		return nil
+	}
+	var args []string
+	inArray, inString, escaped := false, false, false
+	var cur strings.Builder
+	for _, r := range line[lparen+1:] {
+		switch {
+		case inString && escaped:
+			cur.WriteRune(r)
+			escaped = false
+		case inString && r == '\\':
+			cur.WriteRune(r)
+			escaped = true
+		case inString && r == '"':
+			inString = false
+			if inArray {
+				args = append(args, cur.String())
+			}
+			cur.Reset()
+		case inString:
+			cur.WriteRune(r)
+		case r == '"':
+			inString = true
+		case r == '[' && !inArray:
+			inArray = true
+		case r == ']' && inArray:
+			return args
+		}
+	}
+	// the array was never closed
+	return nil
+}
+
+func handleExecMatch(c *capture.Capture, line string, match []string) error {
 	if len(match) == 0 {
 		return nil
 	}
@@ -181,45 +519,81 @@ func handleExecMatch(trace execveTimingTracer, match []string) error {
 		return err
 	}
 
-	// deal with subsequent execve()
-	if start, exe := trace.getPid(pid); exe != "" {
-		trace.addExeRuntime(start, exe, execStart-start, pid)
-	}
-	trace.addPid(pid, execStart, exe)
+	c.Events = append(c.Events, capture.Event{
+		Kind: capture.Exec,
+		Time: execStart,
+		Pid:  pid,
+		Path: exe,
+		Args: parseExecArgs(line),
+	})
 	return nil
 }
 
-func handleSignalMatch(trace execveTimingTracer, match []string) error {
+// parseChildCPU returns the CPU time the child used from a SIGCHLD line, or
+// nil if the line doesn't have it.
+func parseChildCPU(line string) *capture.CPUTime {
+	match := sigChldCPURE.FindStringSubmatch(line)
+	if len(match) == 0 {
+		return nil
+	}
+	user, err := strconv.ParseUint(match[1], 10, 64)
+	if err != nil {
+		return nil
+	}
+	system, err := strconv.ParseUint(match[2], 10, 64)
+	if err != nil {
+		return nil
+	}
+	return &capture.CPUTime{
+		User:   time.Duration(user) * time.Second / clockTicks,
+		System: time.Duration(system) * time.Second / clockTicks,
+	}
+}
+
+func handleSignalMatch(c *capture.Capture, line string, match []string) error {
 	if len(match) == 0 {
 		return nil
 	}
-	sigTime, err := strconv.ParseFloat(match[1], 64)
+	sigTime, err := parseStraceTime(match[1])
+	if err != nil {
+		return err
+	}
+	sigPid, err := strconv.Atoi(match[3])
 	if err != nil {
 		return err
 	}
-	sigPid := match[3]
 
-	if start, exe := trace.getPid(sigPid); exe != "" {
-		trace.addExeRuntime(start, exe, sigTime-start, sigPid)
-		trace.deletePid(sigPid)
+	ev := capture.Event{
+		Kind: capture.Exit,
+		Time: sigTime,
+		Pid:  sigPid,
 	}
+	if match[2] == "CHLD" {
+		ev.CPU = parseChildCPU(line)
+	}
+	c.Events = append(c.Events, ev)
 	return nil
 }
 
-func handleSigkillMatch(trace execveTimingTracer, match []string) error {
+func handleSigkillMatch(c *capture.Capture, match []string) error {
 	if len(match) == 0 {
 		return nil
 	}
-	pid := match[1]
-	sigTime, err := strconv.ParseFloat(match[2], 64)
+	pid, err := strconv.Atoi(match[1])
 	if err != nil {
 		return err
 	}
-
-	if start, exe := trace.getPid(pid); exe != "" {
-		trace.addExeRuntime(start, exe, sigTime-start, pid)
-		trace.deletePid(pid)
+	sigTime, err := parseStraceTime(match[2])
+	if err != nil {
+		return err
 	}
+
+	c.Events = append(c.Events, capture.Event{
+		Kind:   capture.Signal,
+		Time:   sigTime,
+		Pid:    pid,
+		Signal: "SIGKILL",
+	})
 	return nil
 }
 
@@ -242,31 +616,219 @@ func handleSigkillMatch(trace execveTimingTracer, match []string) error {
 // 	return nil
 // }
 
-// TraceExecveTimings will read an strace log and produce a timing report of the
-// n slowest exec's
-func TraceExecveTimings(straceLog string, nSlowest int) (*ExecveTiming, error) {
-	slog, err := os.Open(straceLog)
+// Limits are the limits of a trace, beyond which the traced program is
+// considered to be misbehaving and the trace is aborted
+type Limits struct {
+	// MaxExecs is the maximum number of programs executed, 0 means no limit
+	MaxExecs int
+	// MaxSize is the maximum size of the strace log in bytes, 0 means no
+	// limit
+	MaxSize int64
+}
+
+// LimitError is returned when a trace is aborted because it exceeded its
+// limits
+type LimitError struct {
+	msg string
+}
+
+func (e *LimitError) Error() string {
+	return e.msg
+}
+
+// threadGroups tracks which process the threads of a trace belong to, as the
+// system calls of threads are logged with the id of the thread
+type threadGroups struct {
+	tgids map[int]int
+	// cloning are the threads whose clone() of a new thread was interrupted
+	cloning map[int]bool
+}
+
+// addClone records the new thread cloned in a line of the log, and returns
+// the match of forkRE if the line forked a new process instead.
+func (t *threadGroups) addClone(line string) []string {
+	if match := cloneThreadRE.FindStringSubmatch(line); len(match) != 0 {
+		tid, err := strconv.Atoi(match[1])
+		if err != nil {
+			return nil
+		}
+		if strings.HasSuffix(line, "<unfinished ...>") {
+			t.cloning[tid] = true
+			return nil
+		}
+	}
+	match := forkRE.FindStringSubmatch(line)
+	if len(match) == 0 {
+		return nil
+	}
+	tid, err := strconv.Atoi(match[1])
 	if err != nil {
-		return nil, err
+		return nil
 	}
-	defer slog.Close()
+	child, err := strconv.Atoi(match[3])
+	if err != nil {
+		return nil
+	}
+	resumed := strings.Contains(line, " resumed>")
+	thread := (resumed && t.cloning[tid]) || (!resumed && cloneThreadRE.MatchString(line))
+	if resumed {
+		delete(t.cloning, tid)
+	}
+	if thread {
+		t.tgids[child] = t.process(tid)
+		return nil
+	}
+	return match
+}
+
+// process returns the process the thread belongs to.
+func (t *threadGroups) process(tid int) int {
+	if tgid, ok := t.tgids[tid]; ok {
+		return tgid
+	}
+	return tid
+}
 
-	// pidChildTracker := newPidChildTracker()
+// handleWaitMatch records the wait of the process the thread of the line
+// belongs to.
+func handleWaitMatch(c *capture.Capture, threads *threadGroups, match []string) error {
+	if len(match) == 0 {
+		return nil
+	}
+	tid, end, syscall, err := parsePIDAndReturnOthers(match)
+	if err != nil {
+		return err
+	}
+	secs, err := strconv.ParseFloat(match[4], 64)
+	if err != nil {
+		return err
+	}
+	c.Events = append(c.Events, capture.Event{
+		Kind:     capture.Wait,
+		Time:     end,
+		Pid:      threads.process(tid),
+		Syscall:  syscall,
+		Duration: time.Duration(secs * float64(time.Second)),
+	})
+	return nil
+}
 
+// handleForkMatch records the fork of a new process by the process the thread
+// of the line belongs to.
+func handleForkMatch(c *capture.Capture, threads *threadGroups, match []string) error {
+	if len(match) == 0 {
+		return nil
+	}
+	tid, forkTime, childStr, err := parsePIDAndReturnOthers(match)
+	if err != nil {
+		return err
+	}
+	child, err := strconv.Atoi(childStr)
+	if err != nil {
+		return err
+	}
+	c.Events = append(c.Events, capture.Event{
+		Kind:  capture.Fork,
+		Time:  forkTime,
+		Pid:   threads.process(tid),
+		Child: child,
+	})
+	return nil
+}
+
+// handleDisplayConnectMatch records the connection to the display server of
+// the process the thread of the line belongs to.
+func handleDisplayConnectMatch(c *capture.Capture, threads *threadGroups, match []string) error {
+	if len(match) == 0 {
+		return nil
+	}
+	tid, t, socket, err := parsePIDAndReturnOthers(match)
+	if err != nil {
+		return err
+	}
+	c.Events = append(c.Events, capture.Event{
+		Kind: capture.Connect,
+		Time: t,
+		Pid:  threads.process(tid),
+		Path: strings.Replace(socket, `"`, "", -1),
+	})
+	return nil
+}
+
+// scopeFilter tracks which processes of a trace are in a scope
+type scopeFilter struct {
+	scope Scope
+	root  int
+	// children are the processes forked by the initial process
+	children map[int]bool
+}
+
+// addFork records the fork in a line of the log.
+func (f *scopeFilter) addFork(line string) {
+	if f.scope != ScopeDirectChildren {
+		return
+	}
+	match := forkRE.FindStringSubmatch(line)
+	if len(match) == 0 || match[1] != strconv.Itoa(f.root) {
+		return
+	}
+	child, err := strconv.Atoi(match[3])
+	if err != nil {
+		return
+	}
+	f.children[child] = true
+}
+
+func (f *scopeFilter) keep(pid int) bool {
+	switch f.scope {
+	case ScopeFirstExec:
+		return pid == f.root
+	case ScopeDirectChildren:
+		return pid == f.root || f.children[pid]
+	}
+	return true
+}
+
+// filter drops the events from the given index on of processes outside of
+// the scope.
+func (f *scopeFilter) filter(c *capture.Capture, from int) {
+	kept := c.Events[:from]
+	for _, ev := range c.Events[from:] {
+		if f.keep(ev.Pid) {
+			kept = append(kept, ev)
+		}
+	}
+	c.Events = kept
+}
+
+// captureLog parses an strace log into a capture of the program executions
+// and, if files is true, the file accesses of the processes in the scope.
+// Parsing stops with a *LimitError as soon as the log exceeds the limits.
+func captureLog(slog io.Reader, files bool, scope Scope, limits Limits) (*capture.Capture, error) {
 	var line string
-	var start, end float64
 	var startPID, endPID int
-	trace := newExecveTiming(nSlowest)
+	var startTime, endTime string
+	var size int64
+	execs := 0
+	rootExited := false
+	c := &capture.Capture{}
+	scoped := &scopeFilter{scope: scope, children: make(map[int]bool)}
+	threads := &threadGroups{tgids: make(map[int]int), cloning: make(map[int]bool)}
 	r := bufio.NewScanner(slog)
 	for r.Scan() {
 		line = r.Text()
-		if start == 0.0 {
-			if _, err := fmt.Sscanf(line, "%d %f ", &startPID, &start); err != nil {
+		size += int64(len(line)) + 1
+		if limits.MaxSize != 0 && size > limits.MaxSize {
+			return nil, &LimitError{msg: fmt.Sprintf("trace is larger than the limit of %d bytes", limits.MaxSize)}
+		}
+		if startTime == "" {
+			if _, err := fmt.Sscanf(line, "%d %s ", &startPID, &startTime); err != nil {
 				return nil, fmt.Errorf("cannot parse start of exec profile: %s", err)
 			}
+			scoped.root = startPID
 		}
-		// handleExecMatch looks for execve{,at}() calls and
-		// uses the pidTracker to keep track of execution of
+		scoped.addFork(line)
+		// execve{,at}() calls are used to keep track of execution of
 		// things. Because of fork() we may see many pids and
 		// within each pid we can see multiple execve{,at}()
 		// calls.
@@ -277,48 +839,199 @@ func TraceExecveTimings(straceLog string, nSlowest int) (*ExecveTiming, error) {
 		//    pid 20817 execve("/snap/test-snapd-sh/x2/bin/sh")
 		//    pid 20817 execve("/bin/sh")
 		//    pid 2023  execve("/bin/true")
+		before := len(c.Events)
 		match := execveRE.FindStringSubmatch(line)
-		if err := handleExecMatch(trace, match); err != nil {
+		if err := handleExecMatch(c, line, match); err != nil {
 			return nil, err
 		}
 		match = execveatRE.FindStringSubmatch(line)
-		if err := handleExecMatch(trace, match); err != nil {
+		if err := handleExecMatch(c, line, match); err != nil {
+			return nil, err
+		}
+		scoped.filter(c, before)
+		execs += len(c.Events) - before
+		if limits.MaxExecs != 0 && execs > limits.MaxExecs {
+			return nil, &LimitError{msg: fmt.Sprintf("traced program executed more than the limit of %d programs", limits.MaxExecs)}
+		}
+		// the forks of threads are only tracked to know which process
+		// they belong to
+		match = threads.addClone(line)
+		if err := handleForkMatch(c, threads, match); err != nil {
 			return nil, err
 		}
-		// handleSignalMatch looks for SIG{CHLD,TERM} signals and
-		// maps them via the pidTracker to the execve{,at}() calls
-		// of the terminating PID to calculate the total time of
-		// an execve{,at}() call.
+		// only the waits of traces with -T are timed
+		if strings.HasSuffix(line, ">") {
+			match = waitRE.FindStringSubmatch(line)
+			if err := handleWaitMatch(c, threads, match); err != nil {
+				return nil, err
+			}
+		}
+
+		match = displayConnectRE.FindStringSubmatch(line)
+		if err := handleDisplayConnectMatch(c, threads, match); err != nil {
+			return nil, err
+		}
+
+		// handleSignalMatch looks for SIG{CHLD,TERM} signals, which
+		// mark the end of the terminating PID
 		match = sigChldTermRE.FindStringSubmatch(line)
-		if err := handleSignalMatch(trace, match); err != nil {
+		if err := handleSignalMatch(c, line, match); err != nil {
 			return nil, err
 		}
 
-		// handleSignalMatch looks for SIGKILL signals for processes and uses
-		// the time that SIGKILL happens to calculate the total time of an
-		// execve{,at}() call.
+		// handleSigkillMatch looks for processes killed by SIGKILL
 		match = sigkillRE.FindStringSubmatch(line)
-		if err := handleSigkillMatch(trace, match); err != nil {
+		if err := handleSigkillMatch(c, match); err != nil {
 			return nil, err
 		}
+
+		if files {
+			if err := handleFileMatches(c, line); err != nil {
+				return nil, err
+			}
+		}
+
+		// the initial process is not a child of a traced process, so its
+		// exit is only seen as such, which matters when it exits before
+		// the processes of other scopes do
+		if scope == ScopeFirstExec || scope == ScopeDirectChildren {
+			match = exitedRE.FindStringSubmatch(line)
+			if len(match) != 0 && match[1] == strconv.Itoa(startPID) {
+				exitTime, err := parseStraceTime(match[2])
+				if err != nil {
+					return nil, err
+				}
+				c.Events = append(c.Events, capture.Event{
+					Kind: capture.Exit,
+					Time: exitTime,
+					Pid:  startPID,
+				})
+				rootExited = true
+			}
+		}
+		scoped.filter(c, before)
+	}
+	if r.Err() != nil {
+		return nil, r.Err()
+	}
+
+	if _, err := fmt.Sscanf(line, "%d %s", &endPID, &endTime); err != nil {
+		return nil, fmt.Errorf("cannot parse end of exec profile: %s", err)
 	}
-	if _, err := fmt.Sscanf(line, "%v %f", &endPID, &end); err != nil {
+	var err error
+	if c.Start, err = parseStraceTime(startTime); err != nil {
+		return nil, fmt.Errorf("cannot parse start of exec profile: %s", err)
+	}
+	if c.End, err = parseStraceTime(endTime); err != nil {
 		return nil, fmt.Errorf("cannot parse end of exec profile: %s", err)
 	}
 
-	// handle processes which don't execve{,at} at all
-	if startPID == endPID {
-		pidString := strconv.Itoa(startPID)
-		if start, exe := trace.getPid(pidString); exe != "" {
-			trace.addExeRuntime(start, exe, end-start, pidString)
-			trace.deletePid(pidString)
+	// handle processes which don't execve{,at} at all, which end with the
+	// trace
+	if startPID == endPID && !rootExited {
+		c.Events = append(c.Events, capture.Event{
+			Kind: capture.Exit,
+			Time: c.End,
+			Pid:  endPID,
+		})
+	}
+
+	return c, nil
+}
+
+// replay feeds the events of a capture to a tracer, mapping the exits of the
+// processes to their execve{,at}() calls to calculate the total time of each
+// execve{,at}() call.
+func replay(trace execveTimingTracer, c *capture.Capture) {
+	pathsTrace, withPaths := trace.(execvePathsTracer)
+	for _, ev := range c.Events {
+		pid := strconv.Itoa(ev.Pid)
+		switch ev.Kind {
+		case capture.Exec:
+			// deal with subsequent execve()
+			if start, exe := trace.getPid(pid); exe != "" {
+				trace.addExeRuntime(start, exe, ev.Time.Sub(start), pid, nil)
+			}
+			trace.addPid(pid, ev.Time, ev.Path)
+			trace.setArgs(pid, ev.Args)
+		case capture.Wait:
+			trace.addBlocked(pid, ev.Duration)
+		case capture.Fork:
+			trace.addFork(pid, strconv.Itoa(ev.Child), ev.Time)
+		case capture.Connect:
+			trace.addDisplayConnection(pid, ev.Time)
+		case capture.Exit, capture.Signal:
+			if start, exe := trace.getPid(pid); exe != "" {
+				trace.addExeRuntime(start, exe, ev.Time.Sub(start), pid, ev.CPU)
+				trace.deletePid(pid)
+			}
+		case capture.Open:
+			if !withPaths {
+				continue
+			}
+			if ev.Errno != "" {
+				pathsTrace.addProcessFailedWrite(FailedWrite{
+					Time:    ev.Time,
+					Path:    ev.Path,
+					Syscall: ev.Syscall,
+					Errno:   ev.Errno,
+					pid:     pid,
+				})
+			} else {
+				pathsTrace.addProcessPathAccess(PathAccess{
+					Time:    ev.Time,
+					Path:    ev.Path,
+					Syscall: ev.Syscall,
+					Bytes:   ev.Bytes,
+					pid:     pid,
+				})
+			}
 		}
 	}
-	trace.TotalTime = unixFloatSecondsToTime(end).Sub(unixFloatSecondsToTime(start))
+}
 
-	if r.Err() != nil {
-		return nil, r.Err()
+// CaptureExecve reads an strace log of program executions into a capture.
+func CaptureExecve(straceLog string) (*capture.Capture, error) {
+	return CaptureExecveWithLimits(straceLog, ScopeAll, Limits{})
+}
+
+// CaptureExecveWithLimits reads an strace log of program executions of the
+// processes in the scope into a capture, stopping with a *LimitError as soon as
+// the log exceeds the limits.
+func CaptureExecveWithLimits(straceLog string, scope Scope, limits Limits) (*capture.Capture, error) {
+	slog, err := os.Open(straceLog)
+	if err != nil {
+		return nil, err
 	}
+	defer slog.Close()
+
+	return CaptureExecveFrom(slog, scope, limits)
+}
 
-	return trace, nil
+// CaptureExecveFrom reads an strace log of program executions from the reader
+// like CaptureExecveWithLimits, for logs which are already open such as fifos.
+func CaptureExecveFrom(slog io.Reader, scope Scope, limits Limits) (*capture.Capture, error) {
+	return captureLog(slog, false, scope, limits)
+}
+
+// ExecveTimingFromCapture produces a timing report of the n slowest exec's from
+// a capture
+func ExecveTimingFromCapture(c *capture.Capture, nSlowest int) *ExecveTiming {
+	trace := newExecveTiming(nSlowest)
+	replay(trace, c)
+	trace.TotalTime = c.End.Sub(c.Start)
+	// the runtimes are added as the programs exit, sort them so that the
+	// output doesn't depend on it
+	trace.sortExeRuntimes()
+	return trace
+}
+
+// TraceExecveTimings will read an strace log and produce a timing report of the
+// n slowest exec's
+func TraceExecveTimings(straceLog string, nSlowest int) (*ExecveTiming, error) {
+	c, err := CaptureExecve(straceLog)
+	if err != nil {
+		return nil, err
+	}
+	return ExecveTimingFromCapture(c, nSlowest), nil
 }
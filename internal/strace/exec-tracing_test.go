@@ -0,0 +1,436 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package strace_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/anonymouse64/etrace/internal/capture"
+	"github.com/anonymouse64/etrace/internal/strace"
+)
+
+type execTracingSuite struct{}
+
+var _ = Suite(&execTracingSuite{})
+
+func (p *execTracingSuite) TestNamespaceSetupTime(c *C) {
+	start := time.Unix(1574886785, 0)
+	at := func(ms int) time.Time {
+		return start.Add(time.Duration(ms) * time.Millisecond)
+	}
+
+	tt := []struct {
+		runtimes []strace.ExeRuntime
+		exp      time.Duration
+		expOk    bool
+		comment  string
+	}{
+		{
+			runtimes: []strace.ExeRuntime{
+				// out of order to check that they are sorted
+				{Start: at(400), Exe: "/snap/test-snap/x1/bin/app"},
+				{Start: at(0), Exe: "/usr/bin/snap"},
+				{Start: at(100), Exe: "/usr/lib/snapd/snap-confine"},
+				{Start: at(150), Exe: "snap-update-ns"},
+				{Start: at(300), Exe: "/usr/lib/snapd/snap-exec"},
+				{Start: at(500), Exe: "/usr/bin/date"},
+			},
+			exp:     300 * time.Millisecond,
+			expOk:   true,
+			comment: "snap run",
+		},
+		{
+			runtimes: []strace.ExeRuntime{
+				{Start: at(0), Exe: "/snap/snapd/123/usr/bin/snap"},
+				{Start: at(10), Exe: "/snap/snapd/123/usr/lib/snapd/snap-confine"},
+				{Start: at(20), Exe: "/snap/snapd/123/usr/lib/snapd/snap-exec"},
+				{Start: at(30), Exe: "/snap/test-snap/x1/bin/app"},
+			},
+			exp:     20 * time.Millisecond,
+			expOk:   true,
+			comment: "snapd from the snapd snap",
+		},
+		{
+			runtimes: []strace.ExeRuntime{
+				{Start: at(0), Exe: "/usr/bin/true"},
+			},
+			comment: "not a snap",
+		},
+		{
+			runtimes: []strace.ExeRuntime{
+				{Start: at(0), Exe: "/usr/bin/snap"},
+				{Start: at(10), Exe: "/usr/lib/snapd/snap-confine"},
+			},
+			comment: "snap never ran",
+		},
+	}
+
+	for _, t := range tt {
+		timing := &strace.ExecveTiming{ExeRuntimes: t.runtimes}
+		d, ok := timing.NamespaceSetupTime()
+		c.Check(ok, Equals, t.expOk, Commentf(t.comment))
+		c.Check(d, Equals, t.exp, Commentf(t.comment))
+	}
+}
+
+func (p *execTracingSuite) TestStoppedInConfinement(c *C) {
+	start := time.Unix(1574886785, 0)
+	at := func(ms int) time.Time {
+		return start.Add(time.Duration(ms) * time.Millisecond)
+	}
+
+	tt := []struct {
+		runtimes []strace.ExeRuntime
+		exp      bool
+		comment  string
+	}{
+		{
+			runtimes: []strace.ExeRuntime{
+				{Start: at(0), Exe: "/usr/bin/snap"},
+				{Start: at(100), Exe: "/usr/lib/snapd/snap-confine"},
+				{Start: at(300), Exe: "/usr/lib/snapd/snap-exec"},
+				{Start: at(400), Exe: "/snap/test-snap/x1/bin/app"},
+			},
+			comment: "the app ran",
+		},
+		{
+			runtimes: []strace.ExeRuntime{
+				{Start: at(0), Exe: "/usr/bin/snap"},
+				{Start: at(100), Exe: "/usr/lib/snapd/snap-confine"},
+			},
+			exp:     true,
+			comment: "the trace stopped in snap-confine",
+		},
+		{
+			runtimes: []strace.ExeRuntime{
+				// a wrapper ran before snap run
+				{Start: at(0), Exe: "/usr/bin/env"},
+				{Start: at(10), Exe: "/usr/bin/snap"},
+				{Start: at(100), Exe: "/usr/lib/snapd/snap-confine"},
+				{Start: at(150), Exe: "/usr/lib/snapd/snap-update-ns"},
+			},
+			exp:     true,
+			comment: "only snapd programs after snap-confine",
+		},
+		{
+			runtimes: []strace.ExeRuntime{
+				{Start: at(0), Exe: "/usr/bin/true"},
+			},
+			comment: "not a snap",
+		},
+	}
+
+	for _, t := range tt {
+		timing := &strace.ExecveTiming{ExeRuntimes: t.runtimes}
+		c.Check(timing.StoppedInConfinement(), Equals, t.exp, Commentf(t.comment))
+	}
+}
+
+func (p *execTracingSuite) TestParseExecArgs(c *C) {
+	tt := []struct {
+		line    string
+		exp     []string
+		comment string
+	}{
+		{
+			`17363 1542815326.700248 execve("/snap/brave/44/usr/bin/update-mime-database", ["update-mime-database", "/home/egon/snap/brave/44/.local/"...], 0x1566008 /* 69 vars */) = 0`,
+			[]string{"update-mime-database", "/home/egon/snap/brave/44/.local/"},
+			"execve with truncated arg",
+		},
+		{
+			`14157 1542875582.816782 execveat(3, "", ["snap-update-ns", "--from-snap-confine", "test-snapd-tools"], 0x7ffce7dd6160 /* 0 vars */, AT_EMPTY_PATH) = 0`,
+			[]string{"snap-update-ns", "--from-snap-confine", "test-snapd-tools"},
+			"execveat",
+		},
+		{
+			`100 1542815326.700248 execve("/bin/sh", ["sh", "-c", "echo \"[a, b]\""], 0x1566008 /* 69 vars */) = 0`,
+			[]string{"sh", "-c", `echo \"[a, b]\"`},
+			"args with escaped quotes and brackets",
+		},
+		{
+			`121185 1574886787.979943 execve("/snap/chromium/958/usr/sbin/update-icon-caches", [...], 0x561bce4ee880 /* 105 vars */) = 0`,
+			nil,
+			"abbreviated args",
+		},
+	}
+
+	for _, t := range tt {
+		c.Check(strace.ParseExecArgs(t.line), DeepEquals, t.exp, Commentf(t.comment))
+	}
+}
+
+func (p *execTracingSuite) TestTraceExecveTimings(c *C) {
+	log := filepath.Join(c.MkDir(), "strace.log")
+	c.Assert(ioutil.WriteFile(log, []byte(`100 1542815326.000000 execve("/usr/bin/snap", ["snap", "run", "app"], 0x1566008 /* 69 vars */) = 0
+100 1542815326.100000 execve("/snap/app/x1/bin/app", ["app", "--type=zygote"], 0x1566008 /* 69 vars */) = 0
+101 1542815326.200000 execve("/bin/true", ["true"], 0x1566008 /* 69 vars */) = 0
+100 1542815326.300000 --- SIGCHLD {si_signo=SIGCHLD, si_code=CLD_EXITED, si_pid=101, si_uid=1000, si_status=0, si_utime=12, si_stime=3} ---
+100 1542815326.500000 +++ exited with 0 +++
+`), 0644), IsNil)
+
+	timing, err := strace.TraceExecveTimings(log, -1)
+	c.Assert(err, IsNil)
+	c.Assert(timing.TotalTime, Equals, 500*time.Millisecond)
+	c.Assert(timing.ExeRuntimes, HasLen, 3)
+	exp := []struct {
+		exe  string
+		args []string
+	}{
+		{"/usr/bin/snap", []string{"snap", "run", "app"}},
+		// sorted by when they started, not when they exited
+		{"/snap/app/x1/bin/app", []string{"app", "--type=zygote"}},
+		{"/bin/true", []string{"true"}},
+	}
+	for i, rt := range timing.ExeRuntimes {
+		c.Check(rt.Exe, Equals, exp[i].exe)
+		c.Check(rt.Args, DeepEquals, exp[i].args)
+	}
+	// the CPU time of a process is only known when its traced parent got
+	// SIGCHLD, and only for the last program it executed
+	c.Check(timing.ExeRuntimes[0].CPU, IsNil)
+	c.Check(timing.ExeRuntimes[1].CPU, IsNil)
+	c.Check(timing.ExeRuntimes[2].CPU, DeepEquals, &capture.CPUTime{User: 120 * time.Millisecond, System: 30 * time.Millisecond})
+}
+
+func (p *execTracingSuite) TestCaptureExecve(c *C) {
+	log := filepath.Join(c.MkDir(), "strace.log")
+	c.Assert(ioutil.WriteFile(log, []byte(`100 1542815326.000000 execve("/usr/bin/snap", ["snap", "run", "app"], 0x1566008 /* 69 vars */) = 0
+101 1542815326.200000 execve("/bin/true", ["true"], 0x1566008 /* 69 vars */) = 0
+100 1542815326.300000 --- SIGCHLD {si_signo=SIGCHLD, si_code=CLD_EXITED, si_pid=101, si_uid=1000, si_status=0, si_utime=1, si_stime=2} ---
+102 1542815326.400000 +++ killed by SIGKILL +++
+100 1542815326.500001 +++ exited with 0 +++
+`), 0644), IsNil)
+
+	start := time.Unix(1542815326, 0)
+	capt, err := strace.CaptureExecve(log)
+	c.Assert(err, IsNil)
+	c.Check(capt.Start.Equal(start), Equals, true)
+	c.Check(capt.End.Sub(start), Equals, 500001*time.Microsecond)
+	c.Assert(capt.Events, HasLen, 5)
+	exp := []struct {
+		kind capture.Kind
+		pid  int
+		at   time.Duration
+	}{
+		{capture.Exec, 100, 0},
+		{capture.Exec, 101, 200 * time.Millisecond},
+		{capture.Exit, 101, 300 * time.Millisecond},
+		{capture.Signal, 102, 400 * time.Millisecond},
+		// the process which never executed anything else ends with the trace
+		{capture.Exit, 100, 500001 * time.Microsecond},
+	}
+	for i, ev := range capt.Events {
+		c.Check(ev.Kind, Equals, exp[i].kind)
+		c.Check(ev.Pid, Equals, exp[i].pid)
+		c.Check(ev.Time.Sub(start), Equals, exp[i].at)
+	}
+	c.Check(capt.Events[0].Args, DeepEquals, []string{"snap", "run", "app"})
+
+	// the same timings come from the capture after it was recorded
+	var buf bytes.Buffer
+	c.Assert(capture.Write(&buf, capt), IsNil)
+	replayed, err := capture.Read(&buf)
+	c.Assert(err, IsNil)
+	timing := strace.ExecveTimingFromCapture(replayed, -1)
+	c.Check(timing.TotalTime, Equals, 500001*time.Microsecond)
+	c.Assert(timing.ExeRuntimes, HasLen, 2)
+	c.Check(timing.ExeRuntimes[0].Exe, Equals, "/usr/bin/snap")
+	c.Check(timing.ExeRuntimes[0].TotalSec, Equals, 500001*time.Microsecond)
+	c.Check(timing.ExeRuntimes[1].Exe, Equals, "/bin/true")
+	c.Check(timing.ExeRuntimes[1].TotalSec, Equals, 100*time.Millisecond)
+	c.Check(timing.ExeRuntimes[1].CPU, DeepEquals, &capture.CPUTime{User: 10 * time.Millisecond, System: 20 * time.Millisecond})
+}
+
+func (p *execTracingSuite) TestCaptureExecveWaits(c *C) {
+	log := filepath.Join(c.MkDir(), "strace.log")
+	c.Assert(ioutil.WriteFile(log, []byte(`100 1542815326.000000 execve("/snap/app/x1/bin/app", ["app"], 0x1566008 /* 69 vars */) = 0 <0.000500>
+100 1542815326.010000 clone(child_stack=0x7f5e3a1eefb0, flags=CLONE_VM|CLONE_FS|CLONE_FILES|CLONE_SIGHAND|CLONE_THREAD|CLONE_SYSVSEM|CLONE_SETTLS|CLONE_PARENT_SETTID|CLONE_CHILD_CLEARTID, parent_tid=[101], tls=0x7f5e3a1ef700, child_tidptr=0x7f5e3a1ef9d0) = 101 <0.000100>
+101 1542815326.020000 clone3({flags=CLONE_VM|CLONE_FS|CLONE_FILES|CLONE_SIGHAND|CLONE_THREAD|CLONE_SYSVSEM|CLONE_SETTLS|CLONE_PARENT_SETTID|CLONE_CHILD_CLEARTID, child_tid=0x7f5e3a1ef9d0, parent_tid=0x7f5e3a1ef9d0, exit_signal=0, stack=0x7f5e3a1ef000, stack_size=0x7fff00, tls=0x7f5e3a1ef700} <unfinished ...>
+100 1542815326.021000 futex(0x7f5e3b1f0a10, FUTEX_WAIT_PRIVATE, 0, NULL <unfinished ...>
+101 1542815326.030000 <... clone3 resumed> => {parent_tid=[102]}, 88) = 102 <0.010000>
+100 1542815326.040000 clone(child_stack=NULL, flags=CLONE_CHILD_CLEARTID|CLONE_CHILD_SETTID|SIGCHLD, child_tidptr=0x7f5e3b1f0a10) = 103 <0.000200>
+102 1542815326.100000 poll([{fd=3, events=POLLIN}], 1, -1) = 1 ([{fd=3, revents=POLLIN}]) <0.050000>
+100 1542815326.271000 <... futex resumed>) = 0 <0.250000>
+103 1542815326.300000 execve("/bin/true", ["true"], 0x1566008 /* 69 vars */) = 0 <0.000300>
+103 1542815326.310000 wait4(-1, 0x7ffce7dd6160, 0, NULL) = -1 ECHILD (No child processes) <0.000010>
+100 1542815326.400000 --- SIGCHLD {si_signo=SIGCHLD, si_code=CLD_EXITED, si_pid=103, si_uid=1000, si_status=0, si_utime=0, si_stime=0} ---
+100 1542815326.500000 +++ exited with 0 +++
+`), 0644), IsNil)
+
+	capt, err := strace.CaptureExecve(log)
+	c.Assert(err, IsNil)
+	var waits []capture.Event
+	for _, ev := range capt.Events {
+		if ev.Kind == capture.Wait {
+			waits = append(waits, ev)
+		}
+	}
+	// the waits of the threads are the waits of their process, the forked
+	// process is a process of its own
+	c.Assert(waits, HasLen, 3)
+	for i, exp := range []struct {
+		pid      int
+		syscall  string
+		duration time.Duration
+	}{
+		{100, "poll", 50 * time.Millisecond},
+		{100, "futex", 250 * time.Millisecond},
+		{103, "wait4", 10 * time.Microsecond},
+	} {
+		c.Check(waits[i].Pid, Equals, exp.pid)
+		c.Check(waits[i].Syscall, Equals, exp.syscall)
+		c.Check(waits[i].Duration, Equals, exp.duration)
+	}
+
+	timing := strace.ExecveTimingFromCapture(capt, -1)
+	c.Assert(timing.ExeRuntimes, HasLen, 2)
+	c.Check(timing.ExeRuntimes[0].Exe, Equals, "/snap/app/x1/bin/app")
+	c.Check(timing.ExeRuntimes[0].Blocked, Equals, 300*time.Millisecond)
+	c.Check(timing.ExeRuntimes[1].Exe, Equals, "/bin/true")
+	c.Check(timing.ExeRuntimes[1].Blocked, Equals, 10*time.Microsecond)
+}
+
+func (p *execTracingSuite) TestCaptureExecveDisplayConnections(c *C) {
+	log := filepath.Join(c.MkDir(), "strace.log")
+	c.Assert(ioutil.WriteFile(log, []byte(`100 1542815326.000000 execve("/snap/app/x1/bin/app", ["app"], 0x1566008 /* 69 vars */) = 0
+100 1542815326.010000 clone(child_stack=0x7f5e3a1eefb0, flags=CLONE_VM|CLONE_FS|CLONE_FILES|CLONE_SIGHAND|CLONE_THREAD|CLONE_SYSVSEM|CLONE_SETTLS|CLONE_PARENT_SETTID|CLONE_CHILD_CLEARTID, parent_tid=[101], tls=0x7f5e3a1ef700, child_tidptr=0x7f5e3a1ef9d0) = 101
+100 1542815326.020000 connect(3, {sa_family=AF_UNIX, sun_path="/run/user/1000/bus"}, 110) = 0
+100 1542815326.030000 connect(4, {sa_family=AF_UNIX, sun_path="/run/user/1000/wayland-0"}, 27) = -1 ECONNREFUSED (Connection refused)
+101 1542815326.100000 connect(4, {sa_family=AF_UNIX, sun_path=@"/tmp/.X11-unix/X0"}, 20) = 0
+100 1542815326.150000 connect(5, {sa_family=AF_UNIX, sun_path="/run/user/1000/wayland-0"}, 27) = 0
+100 1542815326.200000 clone(child_stack=NULL, flags=CLONE_CHILD_CLEARTID|CLONE_CHILD_SETTID|SIGCHLD, child_tidptr=0x7f5e3b1f0a10) = 102
+102 1542815326.300000 execve("/bin/true", ["true"], 0x1566008 /* 69 vars */) = 0
+100 1542815326.400000 --- SIGCHLD {si_signo=SIGCHLD, si_code=CLD_EXITED, si_pid=102, si_uid=1000, si_status=0, si_utime=0, si_stime=0} ---
+100 1542815326.500000 +++ exited with 0 +++
+`), 0644), IsNil)
+
+	capt, err := strace.CaptureExecve(log)
+	c.Assert(err, IsNil)
+	var connects []capture.Event
+	for _, ev := range capt.Events {
+		if ev.Kind == capture.Connect {
+			connects = append(connects, ev)
+		}
+	}
+	// only the successful connections to the display server count, the
+	// connections of the threads are the ones of their process
+	c.Assert(connects, HasLen, 2)
+	c.Check(connects[0].Pid, Equals, 100)
+	c.Check(connects[0].Path, Equals, "@/tmp/.X11-unix/X0")
+	c.Check(connects[1].Pid, Equals, 100)
+	c.Check(connects[1].Path, Equals, "/run/user/1000/wayland-0")
+
+	timing := strace.ExecveTimingFromCapture(capt, -1)
+	c.Assert(timing.ExeRuntimes, HasLen, 2)
+	c.Check(timing.ExeRuntimes[0].Exe, Equals, "/snap/app/x1/bin/app")
+	c.Check(timing.ExeRuntimes[0].DisplayConnection, Equals, 100*time.Millisecond)
+	c.Check(timing.ExeRuntimes[1].Exe, Equals, "/bin/true")
+	c.Check(timing.ExeRuntimes[1].DisplayConnection, Equals, time.Duration(0))
+	// the parent is the process which forked the one which executed
+	c.Check(timing.ExeRuntimes[0].Parent, Equals, 0)
+	c.Check(timing.ExeRuntimes[1].Parent, Equals, 100)
+	c.Check(timing.FirstDisplayConnection(), Equals, time.Unix(1542815326, 100000000))
+
+	// without the tracker, like for timings read back from results
+	fromResults := &strace.ExecveTiming{ExeRuntimes: timing.ExeRuntimes}
+	c.Check(fromResults.FirstDisplayConnection(), Equals, time.Unix(1542815326, 100000000))
+}
+
+func (p *execTracingSuite) TestCaptureExecveScope(c *C) {
+	log := filepath.Join(c.MkDir(), "strace.log")
+	c.Assert(ioutil.WriteFile(log, []byte(`100 1542815326.000000 execve("/usr/bin/snap", ["snap", "run", "app"], 0x1566008 /* 69 vars */) = 0
+100 1542815326.100000 clone(child_stack=NULL, flags=CLONE_CHILD_CLEARTID|CLONE_CHILD_SETTID|SIGCHLD, child_tidptr=0x7f5e3b1f0a10) = 101
+101 1542815326.200000 execve("/usr/bin/helper", ["helper"], 0x1566008 /* 69 vars */) = 0
+101 1542815326.250000 clone3({flags=CLONE_VM|CLONE_VFORK, exit_signal=SIGCHLD, stack=0x7f, stack_size=0x9000}, 88 <unfinished ...>
+101 1542815326.260000 <... clone3 resumed> => {parent_tid=[0]}, 88) = 102
+102 1542815326.300000 execve("/bin/true", ["true"], 0x1566008 /* 69 vars */) = 0
+101 1542815326.350000 --- SIGCHLD {si_signo=SIGCHLD, si_code=CLD_EXITED, si_pid=102, si_uid=1000, si_status=0, si_utime=0, si_stime=0} ---
+100 1542815326.400000 +++ exited with 0 +++
+100 1542815326.400000 --- SIGCHLD {si_signo=SIGCHLD, si_code=CLD_EXITED, si_pid=101, si_uid=1000, si_status=0, si_utime=0, si_stime=0} ---
+101 1542815326.500000 +++ exited with 0 +++
+`), 0644), IsNil)
+
+	start := time.Unix(1542815326, 0)
+	type event struct {
+		kind capture.Kind
+		pid  int
+		at   time.Duration
+	}
+	for _, t := range []struct {
+		scope strace.Scope
+		exp   []event
+	}{
+		{strace.ScopeAll, []event{
+			{capture.Exec, 100, 0},
+			{capture.Fork, 100, 100 * time.Millisecond},
+			{capture.Exec, 101, 200 * time.Millisecond},
+			{capture.Fork, 101, 260 * time.Millisecond},
+			{capture.Exec, 102, 300 * time.Millisecond},
+			{capture.Exit, 102, 350 * time.Millisecond},
+			{capture.Exit, 101, 400 * time.Millisecond},
+		}},
+		{strace.ScopeFirstExec, []event{
+			{capture.Exec, 100, 0},
+			{capture.Fork, 100, 100 * time.Millisecond},
+			{capture.Exit, 100, 400 * time.Millisecond},
+		}},
+		{strace.ScopeDirectChildren, []event{
+			{capture.Exec, 100, 0},
+			{capture.Fork, 100, 100 * time.Millisecond},
+			{capture.Exec, 101, 200 * time.Millisecond},
+			{capture.Fork, 101, 260 * time.Millisecond},
+			{capture.Exit, 100, 400 * time.Millisecond},
+			{capture.Exit, 101, 400 * time.Millisecond},
+		}},
+	} {
+		capt, err := strace.CaptureExecveWithLimits(log, t.scope, strace.Limits{})
+		c.Assert(err, IsNil)
+		c.Assert(capt.Events, HasLen, len(t.exp), Commentf("scope %s", t.scope))
+		for i, ev := range capt.Events {
+			c.Check(ev.Kind, Equals, t.exp[i].kind, Commentf("scope %s", t.scope))
+			c.Check(ev.Pid, Equals, t.exp[i].pid, Commentf("scope %s", t.scope))
+			c.Check(ev.Time.Sub(start), Equals, t.exp[i].at, Commentf("scope %s", t.scope))
+		}
+	}
+}
+
+func (p *execTracingSuite) TestCaptureExecveWithLimits(c *C) {
+	log := filepath.Join(c.MkDir(), "strace.log")
+	c.Assert(ioutil.WriteFile(log, []byte(`100 1542815326.000000 execve("/usr/bin/snap", ["snap", "run", "app"], 0x1566008 /* 69 vars */) = 0
+101 1542815326.200000 execve("/bin/true", ["true"], 0x1566008 /* 69 vars */) = 0
+100 1542815326.500001 +++ exited with 0 +++
+`), 0644), IsNil)
+
+	_, err := strace.CaptureExecveWithLimits(log, strace.ScopeAll, strace.Limits{MaxExecs: 2, MaxSize: 1024})
+	c.Assert(err, IsNil)
+
+	_, err = strace.CaptureExecveWithLimits(log, strace.ScopeAll, strace.Limits{MaxExecs: 1})
+	c.Assert(err, ErrorMatches, "traced program executed more than the limit of 1 programs")
+	_, ok := err.(*strace.LimitError)
+	c.Check(ok, Equals, true)
+
+	_, err = strace.CaptureExecveWithLimits(log, strace.ScopeAll, strace.Limits{MaxSize: 100})
+	c.Assert(err, ErrorMatches, "trace is larger than the limit of 100 bytes")
+	_, ok = err.(*strace.LimitError)
+	c.Check(ok, Equals, true)
+}
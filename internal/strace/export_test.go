@@ -22,4 +22,37 @@ var (
 	AbsPathRE        = absPathRE
 	AbsPathFirstRE   = absPathFirstRE
 	FdRE             = fdRE
+	FailedWriteRE    = failedWriteRE
+	ParseExecArgs    = parseExecArgs
+	CaptureLog       = captureLog
+	TraceExecOpts    = traceExecOpts
 )
+
+func MockExcludedSyscalls(names []string) (restore func()) {
+	old := excludedSyscalls
+	excludedSyscalls = names
+	return func() {
+		excludedSyscalls = old
+	}
+}
+
+func MockSyscallClasses(classes []string) (restore func()) {
+	old := tracedSyscallClasses
+	tracedSyscallClasses = classes
+	return func() {
+		tracedSyscallClasses = old
+	}
+}
+
+func SyscallClassesExpr() string {
+	return syscallClassesExpr()
+}
+
+func ExcludedSyscallsExpr(stracePath string) string {
+	return excludedSyscallsExpr(stracePath)
+}
+
+func PathAccessWithPid(access PathAccess, pid string) PathAccess {
+	access.pid = pid
+	return access
+}
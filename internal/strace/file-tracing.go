@@ -18,7 +18,6 @@
 package strace
 
 import (
-	"bufio"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -32,7 +31,9 @@ import (
 	"strings"
 	"time"
 
+	"github.com/anonymouse64/etrace/internal/capture"
 	"github.com/anonymouse64/etrace/internal/files"
+	"github.com/anonymouse64/etrace/internal/schema"
 )
 
 // TODO: support syscalls like mount that have an absolute path we care about
@@ -117,12 +118,52 @@ var fdRE = regexp.MustCompile(
 	`([0-9]+)\s+([0-9]+\.[0-9]+)\s+(.*)\(.*[0-9]+<(\/.*?)>.*= [0-9]+(?:\s*$|x[0-9a-f]+$|<.*>$|$)`,
 )
 
+// matches syscalls creating a file or directory by path which failed because
+// the filesystem is read-only or the access was denied
+// lines look like:
+// 25251 1588799883.286400 openat(AT_FDCWD, "/snap/foo/1/lib/python3.8/__pycache__/os.cpython-38.pyc.140234", O_WRONLY|O_CREAT|O_EXCL|O_CLOEXEC, 0644) = -1 EROFS (Read-only file system)
+// 25251 1588799883.286512 mkdir("/snap/foo/1/lib/python3.8/site-packages/six/__pycache__", 0777) = -1 EROFS (Read-only file system)
+// DOES NOT MATCH these lines:
+// 25251 1588799883.286400 openat(AT_FDCWD, "/snap/foo/1/lib/python3.8/__pycache__/os.cpython-38.pyc", O_RDONLY|O_CLOEXEC) = -1 ENOENT (No such file or directory)
+var failedWriteRE = regexp.MustCompile(
+	`^([0-9]+) ([0-9]+\.[0-9]+) (open|openat|creat|mkdir)\((?:AT_FDCWD,\s+)?"(.*?)"(.*)\) = -1 (EROFS|EACCES|EPERM) .*$`,
+)
+
+// matches the number of bytes returned by the syscalls reading from a file
+// descriptor
+// lines look like:
+// 120990 1574886796.126170 read(156</snap/chromium/958/data-dir/icons/Yaru/cursors/text>, ""..., 1024) = 1024
+var readReturnRE = regexp.MustCompile(`\) = ([0-9]+)$`)
+
+// readSyscalls are the syscalls whose return value is the number of bytes read
+// from their file descriptor
+var readSyscalls = map[string]bool{
+	"read":    true,
+	"pread64": true,
+	"readv":   true,
+	"preadv":  true,
+	"preadv2": true,
+}
+
 // PathAccess represents a single syscall accessing a file
 type PathAccess struct {
 	Time    time.Time
 	Path    string
 	Syscall string
-	pid     string
+	// Bytes is the number of bytes read from the file by read syscalls
+	Bytes int64 `json:",omitempty"`
+	pid   string
+}
+
+// FailedWrite represents a single syscall which failed to create a file or
+// directory
+type FailedWrite struct {
+	Time    time.Time
+	Path    string
+	Syscall string
+	// Errno is the error the syscall failed with, i.e. EROFS
+	Errno string
+	pid   string
 }
 
 // ProcessRuntime represents a single program and the file accesses over the
@@ -132,9 +173,26 @@ type ProcessRuntime struct {
 	Exe          string
 	RunDuration  time.Duration
 	PathAccesses []PathAccess
+	FailedWrites []FailedWrite `json:",omitempty"`
 	pid          string
 }
 
+// Structured returns the runtime as encoded since version 2 of the schema.
+func (rt ProcessRuntime) Structured() interface{} {
+	type plain ProcessRuntime
+	return struct {
+		plain
+		RunDuration schema.Duration
+	}{plain(rt), schema.NewDuration(rt.RunDuration)}
+}
+
+// Pid returns the process which executed the program.
+func (p ProcessRuntime) Pid() int {
+	// the pid always comes from a regexp match of digits
+	pid, _ := strconv.Atoi(p.pid)
+	return pid
+}
+
 // CommonFileInfo contains the path of a file and the size of it
 type CommonFileInfo struct {
 	// Path is where the file was measured as
@@ -143,10 +201,6 @@ type CommonFileInfo struct {
 	Size int64
 	// Program is the program that accessed this file
 	Program string
-
-	// pid is not output or used except for comparing whether a file access is
-	// duplicate
-	pid string
 }
 
 // ExecvePaths represents the set of processes and files accessed by those
@@ -154,17 +208,81 @@ type CommonFileInfo struct {
 type ExecvePaths struct {
 	AllFiles  []CommonFileInfo
 	Processes []ProcessRuntime
+	Start     time.Time
 	TotalTime time.Duration
 
 	*pidTracker
 
 	persistentPidTracker *pidTracker
 	pathProcesses        []PathAccess
+	failedWrites         []FailedWrite
+	// filter selects the path accesses which are kept while replaying
+	filter *pathFilter
+}
+
+// Structured returns the paths as encoded since version 2 of the schema.
+func (p *ExecvePaths) Structured() interface{} {
+	type plain ExecvePaths
+	v := struct {
+		plain
+		Processes []interface{}
+		TotalTime schema.Duration
+	}{
+		plain:     plain(*p),
+		TotalTime: schema.NewDuration(p.TotalTime),
+	}
+	if p.Processes != nil {
+		v.Processes = make([]interface{}, 0, len(p.Processes))
+		for _, rt := range p.Processes {
+			v.Processes = append(v.Processes, rt.Structured())
+		}
+	}
+	return v
+}
+
+// pathFilter selects the files and the programs whose accesses are kept, it
+// is applied as the capture is replayed so that targeted queries don't keep
+// every access of the trace around
+type pathFilter struct {
+	files, programs *regexp.Regexp
+	// exclude are the globs of the programs whose accesses are never kept
+	exclude []string
+}
+
+// newPathFilter returns the filter of the accesses of the files matching
+// fileRegex by the programs matching programRegex and none of the globs.
+func newPathFilter(fileRegex, programRegex *regexp.Regexp, exclude []string) (*pathFilter, error) {
+	for _, pattern := range exclude {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("internal error: pattern %q is invalid: %v", pattern, err)
+		}
+	}
+	return &pathFilter{files: fileRegex, programs: programRegex, exclude: exclude}, nil
+}
+
+// file returns whether the accesses of the path are kept.
+func (f *pathFilter) file(path string) bool {
+	return f.files.FindString(path) != ""
+}
+
+// program returns whether the accesses of the program are kept.
+func (f *pathFilter) program(exe string) bool {
+	if f.programs.FindString(exe) == "" {
+		return false
+	}
+	for _, pattern := range f.exclude {
+		// the patterns were checked already
+		if matches, _ := filepath.Match(pattern, exe); matches {
+			return false
+		}
+	}
+	return true
 }
 
 type execvePathsTracer interface {
 	execveTimingTracer
 	addProcessPathAccess(path PathAccess)
+	addProcessFailedWrite(write FailedWrite)
 }
 
 // NewExecveFiles returns a ExecveFiles suitable for
@@ -178,21 +296,36 @@ func newExecveFiles() *ExecvePaths {
 	return e
 }
 
-func (e *ExecvePaths) addExeRuntime(start float64, exe string, totalSec float64, pid string) {
+func (e *ExecvePaths) addExeRuntime(start time.Time, exe string, total time.Duration, pid string, cpu *capture.CPUTime) {
 	e.Processes = append(e.Processes, ProcessRuntime{
-		Start:       unixFloatSecondsToTime(start),
+		Start:       start,
 		Exe:         exe,
-		RunDuration: time.Duration(totalSec * float64(time.Second)),
+		RunDuration: total,
 		pid:         pid,
 	})
 }
 
 func (e *ExecvePaths) addProcessPathAccess(path PathAccess) {
+	if e.filter != nil {
+		if !e.filter.file(path.Path) {
+			return
+		}
+		// the program is checked again once the accesses are correlated
+		// to the processes if it isn't known yet
+		if _, exe := e.getPid(path.pid); exe != "" && !e.filter.program(exe) {
+			return
+		}
+	}
 	// save the path access for later, when we have all the processes finished
 	// and we can correlate path accesses to particular processes
 	e.pathProcesses = append(e.pathProcesses, path)
 }
 
+func (e *ExecvePaths) addProcessFailedWrite(write FailedWrite) {
+	// like path accesses, these are correlated to processes at the end
+	e.failedWrites = append(e.failedWrites, write)
+}
+
 // Display shows the final exec timing output
 func (e *ExecvePaths) Display(w io.Writer, opts *DisplayOptions) {
 	if len(e.AllFiles) == 0 {
@@ -238,43 +371,261 @@ func (e *ExecvePaths) Display(w io.Writer, opts *DisplayOptions) {
 	fmt.Fprintln(w)
 }
 
-func handlePathMatchElem4(trace execvePathsTracer, match []string) (bool, error) {
-	if len(match) == 0 {
-		return false, nil
+// AccessPhase is the span of time during which some set of paths was accessed,
+// relative to the start of the trace
+type AccessPhase struct {
+	Start    time.Duration
+	End      time.Duration
+	Accesses int
+}
+
+// Structured returns the phase as encoded since version 2 of the schema.
+func (p *AccessPhase) Structured() interface{} {
+	type plain AccessPhase
+	return struct {
+		plain
+		Start schema.Duration
+		End   schema.Duration
+	}{plain(*p), schema.NewDuration(p.Start), schema.NewDuration(p.End)}
+}
+
+// writeSyscalls are the syscalls which modify the file or directory they
+// access, the paths accessed by opens don't tell whether they were opened for
+// writing
+var writeSyscalls = map[string]bool{
+	"write":     true,
+	"pwrite64":  true,
+	"writev":    true,
+	"pwritev":   true,
+	"pwritev2":  true,
+	"ftruncate": true,
+	"fallocate": true,
+	"rename":    true,
+	"renameat":  true,
+	"renameat2": true,
+	"link":      true,
+	"linkat":    true,
+	"unlink":    true,
+	"unlinkat":  true,
+	"mkdir":     true,
+	"mkdirat":   true,
+}
+
+// IsWrite returns whether the syscall of the access modified the file or
+// directory.
+func (a PathAccess) IsWrite() bool {
+	return writeSyscalls[a.Syscall]
+}
+
+// AccessPhase returns the span of time during which paths for which the match
+// function returns true were accessed by any process, or nil if no such paths
+// were accessed.
+func (e *ExecvePaths) AccessPhase(match func(path string) bool) *AccessPhase {
+	return e.accessPhase(match, false)
+}
+
+// WritePhase returns the span of time during which paths for which the match
+// function returns true were modified by any process, or nil if no such paths
+// were modified.
+func (e *ExecvePaths) WritePhase(match func(path string) bool) *AccessPhase {
+	return e.accessPhase(match, true)
+}
+
+func (e *ExecvePaths) accessPhase(match func(path string) bool, writes bool) *AccessPhase {
+	var phase *AccessPhase
+	for _, proc := range e.Processes {
+		for _, access := range proc.PathAccesses {
+			if !match(access.Path) || (writes && !access.IsWrite()) {
+				continue
+			}
+			t := access.Time.Sub(e.Start)
+			if phase == nil {
+				phase = &AccessPhase{Start: t, End: t}
+			}
+			if t < phase.Start {
+				phase.Start = t
+			}
+			if t > phase.End {
+				phase.End = t
+			}
+			phase.Accesses++
+		}
 	}
+	return phase
+}
 
-	pid, execStart, syscall, err := parsePIDAndReturnOthers(match)
-	if err != nil {
-		return false, err
+// ExecPhase is the file I/O that happened while a single program was the most
+// recently started program still running
+type ExecPhase struct {
+	Exe string
+	// Start is when the program was executed, relative to the start of the
+	// trace
+	Start       time.Duration
+	RunDuration time.Duration
+	// FileOps is the number of syscalls accessing files by any process during
+	// the phase
+	FileOps int
+	// Files is the number of unique files accessed during the phase
+	Files int
+	// Bytes is the total size of the unique files accessed during the phase
+	Bytes int64
+}
+
+// Structured returns the phase as encoded since version 2 of the schema.
+func (p ExecPhase) Structured() interface{} {
+	type plain ExecPhase
+	return struct {
+		plain
+		Start       schema.Duration
+		RunDuration schema.Duration
+	}{plain(p), schema.NewDuration(p.Start), schema.NewDuration(p.RunDuration)}
+}
+
+// Timeline buckets the file accesses of all processes into the time windows of
+// each program that was executed, so that the file I/O of each phase of the
+// execution is explicit. When programs run concurrently, an access is counted in
+// the phase of the most recently started program that was running at the time.
+// The bytes are the sizes of the regular files accessed in each phase.
+func (e *ExecvePaths) Timeline(sizes *files.Sizes) []ExecPhase {
+	procs := make([]ProcessRuntime, len(e.Processes))
+	copy(procs, e.Processes)
+	sort.SliceStable(procs, func(i, j int) bool {
+		return procs[i].Start.Before(procs[j].Start)
+	})
+
+	phases := make([]ExecPhase, len(procs))
+	phaseFiles := make([]map[string]bool, len(procs))
+	for i, proc := range procs {
+		phases[i] = ExecPhase{
+			Exe:         proc.Exe,
+			Start:       proc.Start.Sub(e.Start),
+			RunDuration: proc.RunDuration,
+		}
+		phaseFiles[i] = make(map[string]bool)
 	}
 
-	// if the match has "(deleted)" on it, trim that off because that just means
-	// strace lost track of the fd, but the app still would have used it
-	if strings.HasSuffix(match[4], "(deleted)") {
-		match[4] = strings.TrimSuffix(match[4], " (deleted)")
+	for _, proc := range procs {
+		for _, access := range proc.PathAccesses {
+			// find the latest started program running at the time
+			for i := len(procs) - 1; i >= 0; i-- {
+				start := procs[i].Start
+				end := start.Add(procs[i].RunDuration)
+				if access.Time.Before(start) || access.Time.After(end) {
+					continue
+				}
+				phases[i].FileOps++
+				if !phaseFiles[i][access.Path] {
+					phaseFiles[i][access.Path] = true
+					phases[i].Files++
+					// the size is unknown if the file doesn't exist
+					// anymore
+					if size, ok := sizes.Size(access.Path); ok {
+						phases[i].Bytes += size
+					}
+				}
+				break
+			}
+		}
 	}
+	return phases
+}
 
-	// add this path to the tracer's total list of paths
-	trace.addProcessPathAccess(
-		PathAccess{
-			Time:    unixFloatSecondsToTime(execStart),
-			Path:    match[4],
-			Syscall: syscall,
-			pid:     pid,
-		},
-	)
+// ReadBytes returns the number of bytes read from each file by all the
+// processes.
+func (e *ExecvePaths) ReadBytes() map[string]int64 {
+	read := make(map[string]int64)
+	for _, proc := range e.Processes {
+		for _, access := range proc.PathAccesses {
+			if access.Bytes != 0 {
+				read[access.Path] += access.Bytes
+			}
+		}
+	}
+	return read
+}
 
-	return true, nil
+// AccessRecord is a single file access by a process, flattened for exporting
+// to tabular formats
+type AccessRecord struct {
+	Pid     int
+	Time    time.Time
+	Syscall string
+	Path    string
+	Program string
+	// Size is -1 if the path isn't a regular file or doesn't exist anymore
+	Size int64
+}
+
+// AccessRecords returns every file access of every process as individual
+// records, sorted by time.
+func (e *ExecvePaths) AccessRecords(sizes *files.Sizes) []AccessRecord {
+	var records []AccessRecord
+	for _, proc := range e.Processes {
+		for _, access := range proc.PathAccesses {
+			size, _ := sizes.Size(access.Path)
+			// the pid always comes from a regexp match of digits
+			pid, _ := strconv.Atoi(access.pid)
+			records = append(records, AccessRecord{
+				Pid:     pid,
+				Time:    access.Time,
+				Syscall: access.Syscall,
+				Path:    access.Path,
+				Program: proc.Exe,
+				Size:    size,
+			})
+		}
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Time.Before(records[j].Time)
+	})
+	return records
+}
+
+func addPathAccess(c *capture.Capture, match []string, path string) error {
+	pid, t, syscall, err := parsePIDAndReturnOthers(match)
+	if err != nil {
+		return err
+	}
+	c.Events = append(c.Events, capture.Event{
+		Kind:    capture.Open,
+		Time:    t,
+		Pid:     pid,
+		Syscall: syscall,
+		Path:    path,
+	})
+	return nil
+}
+
+// addReadBytes adds the number of bytes read by the line to the file access
+// just added for it.
+func addReadBytes(c *capture.Capture, line string) {
+	match := readReturnRE.FindStringSubmatch(line)
+	if len(match) == 0 {
+		return
+	}
+	n, err := strconv.ParseInt(match[1], 10, 64)
+	if err != nil {
+		return
+	}
+	c.Events[len(c.Events)-1].Bytes = n
 }
 
-func handleFdAndPathMatch(trace execvePathsTracer, match []string) (bool, error) {
+func handlePathMatchElem4(c *capture.Capture, match []string) (bool, error) {
 	if len(match) == 0 {
 		return false, nil
 	}
 
-	pid, execStart, syscall, err := parsePIDAndReturnOthers(match)
-	if err != nil {
-		return false, err
+	// if the match has "(deleted)" on it, trim that off because that just means
+	// strace lost track of the fd, but the app still would have used it
+	path := strings.TrimSuffix(match[4], " (deleted)")
+
+	// add this path to the capture's total list of paths
+	return true, addPathAccess(c, match, path)
+}
+
+func handleFdAndPathMatch(c *capture.Capture, match []string) (bool, error) {
+	if len(match) == 0 {
+		return false, nil
 	}
 
 	// for this, we need to join the fd + path
@@ -282,59 +633,98 @@ func handleFdAndPathMatch(trace execvePathsTracer, match []string) (bool, error)
 
 	// if the match has "(deleted)" on it, trim that off because that just means
 	// strace lost track of the fd, but the app still would have used it
-	if strings.HasSuffix(fullPath, "(deleted)") {
-		fullPath = strings.TrimSuffix(fullPath, " (deleted)")
-	}
+	fullPath = strings.TrimSuffix(fullPath, " (deleted)")
 
-	trace.addProcessPathAccess(
-		PathAccess{
-			Time:    unixFloatSecondsToTime(execStart),
-			Path:    fullPath,
-			Syscall: syscall,
-			pid:     pid,
-		},
-	)
+	return true, addPathAccess(c, match, fullPath)
+}
 
-	return true, nil
+func handleAbsPathMatch(c *capture.Capture, match []string) (bool, error) {
+	if len(match) == 0 {
+		return false, nil
+	}
+
+	// add this path to the capture's total list of paths
+	return true, addPathAccess(c, match, match[4])
 }
 
-func handleAbsPathMatch(trace execvePathsTracer, line string, match []string) (bool, error) {
+func handleFailedWriteMatch(c *capture.Capture, match []string) (bool, error) {
 	if len(match) == 0 {
 		return false, nil
 	}
 
-	pid, execStart, syscall, err := parsePIDAndReturnOthers(match)
+	// only opens which would create or write to the file are interesting
+	if strings.HasPrefix(match[3], "open") &&
+		!strings.Contains(match[5], "O_WRONLY") &&
+		!strings.Contains(match[5], "O_RDWR") &&
+		!strings.Contains(match[5], "O_CREAT") {
+		return false, nil
+	}
+
+	pid, t, syscall, err := parsePIDAndReturnOthers(match)
 	if err != nil {
 		return false, err
 	}
 
-	// add this path to the tracer's total list of paths
-	trace.addProcessPathAccess(
-		PathAccess{
-			Time:    unixFloatSecondsToTime(execStart),
-			Path:    match[4],
-			Syscall: syscall,
-			pid:     pid,
-		},
-	)
+	c.Events = append(c.Events, capture.Event{
+		Kind:    capture.Open,
+		Time:    t,
+		Pid:     pid,
+		Syscall: syscall,
+		Path:    match[4],
+		Errno:   match[6],
+	})
 
 	return true, nil
 }
 
-// TraceExecveWithFiles will merge strace logs matching the given pattern and
-// produce a file report with all the files matching the specified pattern read
-// by every process in the execution
-// TODO: we could speed this up if we injected the provided regex into the
-// regular expressions we use to match all the strace lines, but that requires
-// some really tough regular expression work and may have odd user behavior for
-// "simple" cases like `.*`, which probably the user wants to use as `.*?`,
-// otherwise they would get filepaths like `/some/file/thing/", "` because the
-// filepath really has to stop at the last `"` character
-func TraceExecveWithFiles(
-	straceLogPattern string,
-	fileRegex, programRegex *regexp.Regexp,
-	excludeListProgramPatterns []string,
-) (*ExecvePaths, error) {
+// handleFileMatches adds the file access of a line to the capture, if it
+// accesses a file.
+func handleFileMatches(c *capture.Capture, line string) error {
+	// failed writes never match any of the file access patterns below
+	// since those all require the syscall to succeed
+	match := failedWriteRE.FindStringSubmatch(line)
+	matched, err := handleFailedWriteMatch(c, match)
+	if err != nil || matched {
+		return err
+	}
+
+	// first up handle any fd matches
+	match = fdAndPathRE.FindStringSubmatch(line)
+	matched, err = handleFdAndPathMatch(c, match)
+	if err != nil || matched {
+		return err
+	}
+
+	match = fdRE.FindStringSubmatch(line)
+	matched, err = handlePathMatchElem4(c, match)
+	if err != nil || matched {
+		if matched && readSyscalls[match[3]] {
+			addReadBytes(c, line)
+		}
+		return err
+	}
+
+	match = absPathWithCWDRE.FindStringSubmatch(line)
+	matched, err = handlePathMatchElem4(c, match)
+	if err != nil || matched {
+		return err
+	}
+
+	match = absPathRE.FindStringSubmatch(line)
+	matched, err = handleAbsPathMatch(c, match)
+	if err != nil || matched {
+		return err
+	}
+
+	match = absPathFirstRE.FindStringSubmatch(line)
+	_, err = handleAbsPathMatch(c, match)
+	return err
+}
+
+// CaptureExecveWithFiles will merge strace logs matching the given pattern
+// into a capture of the program executions and file accesses of every process
+// of the execution in the scope
+func CaptureExecveWithFiles(straceLogPattern string, scope Scope) (*capture.Capture, error) {
 	// first ensure the log file is empty and exists and open it
 	mergedFile, err := files.EnsureExistsAndOpen(straceLogPattern, true)
 	if err != nil {
@@ -369,125 +759,60 @@ func TraceExecveWithFiles(
 		return nil, err
 	}
 
-	// start scanning the file
-	var line string
-	var start, end float64
-	var startPID, endPID int
-	trace := newExecveFiles()
-	r := bufio.NewScanner(mergedFile)
-	for r.Scan() {
-		line = r.Text()
-		if start == 0.0 {
-			if _, err := fmt.Sscanf(line, "%d %f ", &startPID, &start); err != nil {
-				return nil, fmt.Errorf("cannot parse start of exec profile: %s", err)
-			}
-		}
-		// handleExecMatch looks for execve{,at}() calls and
-		// uses the pidTracker to keep track of execution of
-		// things. Because of fork() we may see many pids and
-		// within each pid we can see multiple execve{,at}()
-		// calls.
-		// An example of pids/exec transitions:
-		// $ snap run --trace-exec test-snapd-sh -c "/bin/true"
-		//    pid 20817 execve("snap-confine")
-		//    pid 20817 execve("snap-exec")
-		//    pid 20817 execve("/snap/test-snapd-sh/x2/bin/sh")
-		//    pid 20817 execve("/bin/sh")
-		//    pid 2023  execve("/bin/true")
-		match := execveRE.FindStringSubmatch(line)
-		if err := handleExecMatch(trace, match); err != nil {
-			return nil, err
-		}
-		match = execveatRE.FindStringSubmatch(line)
-		if err := handleExecMatch(trace, match); err != nil {
-			return nil, err
-		}
-		// handleSignalMatch looks for SIG{CHLD,TERM} signals and
-		// maps them via the pidTracker to the execve{,at}() calls
-		// of the terminating PID to calculate the total time of
-		// an execve{,at}() call.
-		match = sigChldTermRE.FindStringSubmatch(line)
-		if err := handleSignalMatch(trace, match); err != nil {
-			return nil, err
-		}
-
-		// handleSignalMatch looks for SIGKILL signals for processes and uses
-		// the time that SIGKILL happens to calculate the total time of an
-		// execve{,at}() call.
-		match = sigkillRE.FindStringSubmatch(line)
-		if err := handleSigkillMatch(trace, match); err != nil {
-			return nil, err
-		}
-
-		// now handle any file access matches
-
-		// first up handle any fd matches
-		match = fdAndPathRE.FindStringSubmatch(line)
-		matched, err := handleFdAndPathMatch(trace, match)
-		if err != nil {
-			return nil, err
-		}
-		if matched {
-			continue
-		}
-
-		match = fdRE.FindStringSubmatch(line)
-		matched, err = handlePathMatchElem4(trace, match)
-		if err != nil {
-			return nil, err
-		}
-		if matched {
-			continue
-		}
-
-		match = absPathWithCWDRE.FindStringSubmatch(line)
-		matched, err = handlePathMatchElem4(trace, match)
-		if err != nil {
-			return nil, err
-		}
-		if matched {
-			continue
-		}
-
-		match = absPathRE.FindStringSubmatch(line)
-		matched, err = handleAbsPathMatch(trace, line, match)
-		if err != nil {
-			return nil, err
-		}
-		if matched {
-			continue
-		}
-
-		match = absPathFirstRE.FindStringSubmatch(line)
-		matched, err = handleAbsPathMatch(trace, line, match)
-		if err != nil {
-			return nil, err
-		}
-		if matched {
-			continue
-		}
-	}
+	return captureLog(mergedFile, true, scope, Limits{})
+}
 
-	// check scanning error
-	if r.Err() != nil {
-		return nil, r.Err()
+// CaptureLogFile reads an existing strace log of a whole execution, like the
+// ones merged by strace-log-merge, into a capture of the program executions
+// and file accesses of every process of the execution in the scope
+func CaptureLogFile(straceLog string, scope Scope) (*capture.Capture, error) {
+	f, err := os.Open(straceLog)
+	if err != nil {
+		return nil, err
 	}
+	defer f.Close()
+	return captureLog(f, true, scope, Limits{})
+}
 
-	// scan the last line to see if it matches the end line to compare with the
-	// start
-	if _, err := fmt.Sscanf(line, "%v %f", &endPID, &end); err != nil {
-		return nil, fmt.Errorf("cannot parse end of exec profile: %s", err)
+// TraceExecveWithFiles will merge strace logs matching the given pattern and
+// produce a file report with all the files matching the specified pattern read
+// by every process in the execution
+// TODO: we could speed this up if we injected the provided regex into the
+// regular expressions we use to match all the strace lines, but that requires
+// some really tough regular expression work and may have odd user behavior for
+// "simple" cases like `.*`, which probably the user wants to use as `.*?`,
+// otherwise they would get filepaths like `/some/file/thing/", "` because the
+// filepath really has to stop at the last `"` character
+func TraceExecveWithFiles(
+	straceLogPattern string,
+	fileRegex, programRegex *regexp.Regexp,
+	excludeListProgramPatterns []string,
+) (*ExecvePaths, error) {
+	c, err := CaptureExecveWithFiles(straceLogPattern, ScopeAll)
+	if err != nil {
+		return nil, err
 	}
+	return ExecvePathsFromCapture(c, fileRegex, programRegex, excludeListProgramPatterns)
+}
 
-	// handle processes which don't execve{,at} at all
-	if startPID == endPID {
-		pidString := strconv.Itoa(startPID)
-		if start, exe := trace.getPid(pidString); exe != "" {
-			trace.addExeRuntime(start, exe, end-start, pidString)
-			trace.deletePid(pidString)
-		}
+// ExecvePathsFromCapture produces a file report from a capture with all the
+// files matching the specified pattern read by every process in the execution.
+// The accesses of the other files and programs are dropped as the capture is
+// replayed, so the processes of the report only have the matching accesses.
+func ExecvePathsFromCapture(
+	c *capture.Capture,
+	fileRegex, programRegex *regexp.Regexp,
+	excludeListProgramPatterns []string,
+) (*ExecvePaths, error) {
+	filter, err := newPathFilter(fileRegex, programRegex, excludeListProgramPatterns)
+	if err != nil {
+		return nil, err
 	}
-	trace.TotalTime = unixFloatSecondsToTime(end).Sub(unixFloatSecondsToTime(start))
+	trace := newExecveFiles()
+	trace.filter = filter
+	replay(trace, c)
+	trace.Start = c.Start
+	trace.TotalTime = c.End.Sub(c.Start)
 
 	// put all the path accesses from the trace into their respective processes
 	for _, path := range trace.pathProcesses {
@@ -509,42 +834,52 @@ func TraceExecveWithFiles(
 		}
 	}
 
+	// and the same for the failed writes
+	for _, write := range trace.failedWrites {
+		for i, proc := range trace.Processes {
+			if proc.pid == write.pid {
+				start := proc.Start
+				end := proc.Start.Add(proc.RunDuration)
+				if write.Time.After(start) && write.Time.Before(end) {
+					trace.Processes[i].FailedWrites = append(trace.Processes[i].FailedWrites, write)
+					break
+				}
+			}
+		}
+	}
+
 	// free up the path process access memory
 	trace.pathProcesses = nil
+	trace.failedWrites = nil
+
+	// the processes are added as they exit, sort them by when they started so
+	// that the output doesn't depend on it
+	sort.SliceStable(trace.Processes, func(i, j int) bool {
+		a, b := trace.Processes[i], trace.Processes[j]
+		if !a.Start.Equal(b.Start) {
+			return a.Start.Before(b.Start)
+		}
+		if a.pid != b.pid {
+			return a.pid < b.pid
+		}
+		return a.Exe < b.Exe
+	})
 
-	// use a map to not count file accesses by the same program multiple times
+	// use a map to not count file accesses by the same program multiple
+	// times, even from different processes of the program
 	seenFiles := make(map[CommonFileInfo]bool, 0)
 
 	// now build up a list of path, program, and file size infos
-	for _, proc := range trace.Processes {
+	for i, proc := range trace.Processes {
+		if !filter.program(proc.Exe) {
+			// the accesses made before the program was known
+			trace.Processes[i].PathAccesses = nil
+			continue
+		}
 		for _, pathAccess := range proc.PathAccesses {
-			if fileRegex.FindString(pathAccess.Path) == "" {
-				continue
-			}
-
-			if programRegex.FindString(proc.Exe) == "" {
-				continue
-			}
-
-			filtered := false
-			for _, pattern := range excludeListProgramPatterns {
-				matches, err := filepath.Match(pattern, proc.Exe)
-				if err != nil {
-					return nil, fmt.Errorf("internal error: pattern %q is invalid: %v", pattern, err)
-				}
-				if matches {
-					filtered = true
-					break
-				}
-			}
-			if filtered {
-				continue
-			}
-
 			fileInfo := CommonFileInfo{
 				Path:    pathAccess.Path,
 				Program: proc.Exe,
-				pid:     proc.pid,
 			}
 
 			if seenFiles[fileInfo] {
@@ -564,9 +899,14 @@ func TraceExecveWithFiles(
 		}
 	}
 
-	// sort the all files by the path member for nicer formatting
+	// sort the all files by the path member for nicer formatting, and then
+	// by the program so that the order is always the same
 	sort.Slice(trace.AllFiles, func(i, j int) bool {
-		return trace.AllFiles[i].Path < trace.AllFiles[j].Path
+		a, b := trace.AllFiles[i], trace.AllFiles[j]
+		if a.Path != b.Path {
+			return a.Path < b.Path
+		}
+		return a.Program < b.Program
 	})
 
 	return trace, nil
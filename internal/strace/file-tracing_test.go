@@ -17,10 +17,17 @@
 package strace_test
 
 import (
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
 	"testing"
+	"time"
 
 	. "gopkg.in/check.v1"
 
+	"github.com/anonymouse64/etrace/internal/capture"
+	"github.com/anonymouse64/etrace/internal/files"
 	"github.com/anonymouse64/etrace/internal/strace"
 )
 
@@ -316,3 +323,360 @@ func (p *regexpMatchSuite) TestfdRE(c *C) {
 		c.Check(matches, DeepEquals, exp, Commentf(t.comment))
 	}
 }
+
+func (p *regexpMatchSuite) TestFailedWriteRE(c *C) {
+	tt := []regexSyscallTestCase{
+		{
+			`25251 1588799883.286400 openat(AT_FDCWD, "/snap/foo/1/lib/python3.8/__pycache__/os.cpython-38.pyc.140234", O_WRONLY|O_CREAT|O_EXCL|O_CLOEXEC, 0644) = -1 EROFS (Read-only file system)`,
+			[]string{
+				"25251",
+				"1588799883.286400",
+				"openat",
+				"/snap/foo/1/lib/python3.8/__pycache__/os.cpython-38.pyc.140234",
+				", O_WRONLY|O_CREAT|O_EXCL|O_CLOEXEC, 0644",
+				"EROFS",
+			},
+			"openat creating a file",
+		},
+		{
+			`25251 1588799883.286512 mkdir("/snap/foo/1/lib/python3.8/site-packages/six/__pycache__", 0777) = -1 EACCES (Permission denied)`,
+			[]string{
+				"25251",
+				"1588799883.286512",
+				"mkdir",
+				"/snap/foo/1/lib/python3.8/site-packages/six/__pycache__",
+				", 0777",
+				"EACCES",
+			},
+			"mkdir",
+		},
+		// negative cases we expect not to match
+		{
+			`25251 1588799883.286400 openat(AT_FDCWD, "/snap/foo/1/lib/python3.8/__pycache__/os.cpython-38.pyc", O_RDONLY|O_CLOEXEC) = -1 ENOENT (No such file or directory)`,
+			[]string{},
+			"missing file",
+		},
+		{
+			`25251 1588799883.286400 openat(AT_FDCWD, "/snap/foo/1/lib/python3.8/os.py", O_RDONLY|O_CLOEXEC) = 3</snap/foo/1/lib/python3.8/os.py>`,
+			[]string{},
+			"successful open",
+		},
+	}
+
+	for _, t := range tt {
+		matches := strace.FailedWriteRE.FindStringSubmatch(t.line)
+		var exp []string
+		if len(t.expmatches) != 0 {
+			exp = append([]string{t.line}, t.expmatches...)
+		}
+		c.Check(matches, DeepEquals, exp, Commentf(t.comment))
+	}
+}
+
+type execvePathsSuite struct{}
+
+var _ = Suite(&execvePathsSuite{})
+
+func (p *execvePathsSuite) TestAccessPhase(c *C) {
+	start := time.Unix(1574886785, 0)
+	at := func(ms int) time.Time {
+		return start.Add(time.Duration(ms) * time.Millisecond)
+	}
+	paths := &strace.ExecvePaths{
+		Start: start,
+		Processes: []strace.ProcessRuntime{
+			{
+				Exe: "/snap/app/x1/bin/app",
+				PathAccesses: []strace.PathAccess{
+					{Time: at(100), Path: "/home/user/.cache/mesa_shader_cache/index"},
+					{Time: at(150), Path: "/usr/lib/libGL.so"},
+					{Time: at(400), Path: "/home/user/.cache/mesa_shader_cache/ab/cd"},
+				},
+			},
+			{
+				Exe: "/snap/app/x1/bin/helper",
+				PathAccesses: []strace.PathAccess{
+					{Time: at(50), Path: "/home/user/.cache/mesa_shader_cache/index"},
+				},
+			},
+		},
+	}
+
+	isShaderCache := func(path string) bool {
+		return strings.Contains(path, "mesa_shader_cache")
+	}
+	c.Assert(paths.AccessPhase(isShaderCache), DeepEquals, &strace.AccessPhase{
+		Start:    50 * time.Millisecond,
+		End:      400 * time.Millisecond,
+		Accesses: 3,
+	})
+
+	c.Assert(paths.AccessPhase(func(string) bool { return false }), IsNil)
+}
+
+func (p *execvePathsSuite) TestWritePhase(c *C) {
+	start := time.Unix(1574886785, 0)
+	at := func(ms int) time.Time {
+		return start.Add(time.Duration(ms) * time.Millisecond)
+	}
+	paths := &strace.ExecvePaths{
+		Start: start,
+		Processes: []strace.ProcessRuntime{
+			{
+				Exe: "/usr/bin/fc-cache",
+				PathAccesses: []strace.PathAccess{
+					{Time: at(100), Path: "/home/user/.cache/fontconfig/abc-le64.cache-7", Syscall: "openat"},
+					{Time: at(200), Path: "/home/user/.cache/fontconfig/abc-le64.cache-7.TMP-x", Syscall: "write"},
+					{Time: at(300), Path: "/home/user/.cache/fontconfig/abc-le64.cache-7.TMP-x", Syscall: "rename"},
+					{Time: at(400), Path: "/home/user/.cache/fontconfig/def-le64.cache-7", Syscall: "read"},
+				},
+			},
+		},
+	}
+
+	isFontCache := func(path string) bool {
+		return strings.Contains(path, "/.cache/fontconfig/")
+	}
+	c.Assert(paths.WritePhase(isFontCache), DeepEquals, &strace.AccessPhase{
+		Start:    200 * time.Millisecond,
+		End:      300 * time.Millisecond,
+		Accesses: 2,
+	})
+	c.Assert(paths.AccessPhase(isFontCache).Accesses, Equals, 4)
+
+	paths.Processes[0].PathAccesses = paths.Processes[0].PathAccesses[3:]
+	c.Assert(paths.WritePhase(isFontCache), IsNil)
+}
+
+func (p *execvePathsSuite) TestTimeline(c *C) {
+	start := time.Unix(1574886785, 0)
+	at := func(ms int) time.Time {
+		return start.Add(time.Duration(ms) * time.Millisecond)
+	}
+	dir := c.MkDir()
+	big := filepath.Join(dir, "big")
+	c.Assert(ioutil.WriteFile(big, make([]byte, 1000), 0644), IsNil)
+	small := filepath.Join(dir, "small")
+	c.Assert(ioutil.WriteFile(small, make([]byte, 10), 0644), IsNil)
+
+	paths := &strace.ExecvePaths{
+		Start: start,
+		Processes: []strace.ProcessRuntime{
+			{
+				Start:       at(100),
+				Exe:         "/snap/app/x1/bin/app",
+				RunDuration: 900 * time.Millisecond,
+				PathAccesses: []strace.PathAccess{
+					{Time: at(150), Path: big},
+					{Time: at(160), Path: big},
+					{Time: at(600), Path: small},
+				},
+			},
+			{
+				Start:       at(0),
+				Exe:         "/usr/lib/snapd/snap-confine",
+				RunDuration: 100 * time.Millisecond,
+				PathAccesses: []strace.PathAccess{
+					{Time: at(10), Path: small},
+					{Time: at(20), Path: "/does/not/exist"},
+				},
+			},
+			{
+				Start:       at(500),
+				Exe:         "/snap/app/x1/bin/helper",
+				RunDuration: 200 * time.Millisecond,
+				PathAccesses: []strace.PathAccess{
+					{Time: at(550), Path: small},
+				},
+			},
+		},
+	}
+
+	c.Assert(paths.Timeline(files.NewSizes("/")), DeepEquals, []strace.ExecPhase{
+		{
+			Exe:         "/usr/lib/snapd/snap-confine",
+			RunDuration: 100 * time.Millisecond,
+			FileOps:     2,
+			Files:       2,
+			Bytes:       10,
+		},
+		{
+			Exe:         "/snap/app/x1/bin/app",
+			Start:       100 * time.Millisecond,
+			RunDuration: 900 * time.Millisecond,
+			FileOps:     2,
+			Files:       1,
+			Bytes:       1000,
+		},
+		{
+			// the app's access while the helper was running counts here
+			Exe:         "/snap/app/x1/bin/helper",
+			Start:       500 * time.Millisecond,
+			RunDuration: 200 * time.Millisecond,
+			FileOps:     2,
+			Files:       1,
+			Bytes:       10,
+		},
+	})
+}
+
+func (p *execvePathsSuite) TestAccessRecords(c *C) {
+	start := time.Unix(1574886785, 0)
+	at := func(ms int) time.Time {
+		return start.Add(time.Duration(ms) * time.Millisecond)
+	}
+	dir := c.MkDir()
+	file := filepath.Join(dir, "file")
+	c.Assert(ioutil.WriteFile(file, make([]byte, 100), 0644), IsNil)
+
+	paths := &strace.ExecvePaths{
+		Start: start,
+		Processes: []strace.ProcessRuntime{
+			{
+				Exe: "/snap/app/x1/bin/app",
+				PathAccesses: []strace.PathAccess{
+					strace.PathAccessWithPid(strace.PathAccess{Time: at(30), Path: file, Syscall: "read"}, "42"),
+				},
+			},
+			{
+				Exe: "/usr/lib/snapd/snap-confine",
+				PathAccesses: []strace.PathAccess{
+					strace.PathAccessWithPid(strace.PathAccess{Time: at(10), Path: file, Syscall: "openat"}, "41"),
+					strace.PathAccessWithPid(strace.PathAccess{Time: at(20), Path: "/does/not/exist", Syscall: "stat"}, "41"),
+				},
+			},
+		},
+	}
+
+	c.Assert(paths.AccessRecords(files.NewSizes("/")), DeepEquals, []strace.AccessRecord{
+		{Pid: 41, Time: at(10), Syscall: "openat", Path: file, Program: "/usr/lib/snapd/snap-confine", Size: 100},
+		{Pid: 41, Time: at(20), Syscall: "stat", Path: "/does/not/exist", Program: "/usr/lib/snapd/snap-confine", Size: -1},
+		{Pid: 42, Time: at(30), Syscall: "read", Path: file, Program: "/snap/app/x1/bin/app", Size: 100},
+	})
+}
+
+func (p *execvePathsSuite) TestExecvePathsFromCaptureOrder(c *C) {
+	start := time.Unix(1574886785, 0)
+	at := func(ms int) time.Time {
+		return start.Add(time.Duration(ms) * time.Millisecond)
+	}
+	capt := &capture.Capture{
+		Start: start,
+		End:   at(100),
+		Events: []capture.Event{
+			{Kind: capture.Exec, Time: at(0), Pid: 10, Path: "/bin/sh"},
+			{Kind: capture.Exec, Time: at(1), Pid: 11, Path: "/bin/sh"},
+			{Kind: capture.Open, Time: at(2), Pid: 11, Path: "/etc/ld.so.cache", Syscall: "openat"},
+			{Kind: capture.Exec, Time: at(3), Pid: 12, Path: "/usr/bin/app"},
+			{Kind: capture.Open, Time: at(4), Pid: 12, Path: "/etc/ld.so.cache", Syscall: "openat"},
+			{Kind: capture.Open, Time: at(5), Pid: 10, Path: "/etc/ld.so.cache", Syscall: "openat"},
+			{Kind: capture.Exit, Time: at(6), Pid: 12},
+			{Kind: capture.Exit, Time: at(7), Pid: 11},
+			{Kind: capture.Exit, Time: at(8), Pid: 10},
+		},
+	}
+	matchAll := regexp.MustCompile(".*")
+	paths, err := strace.ExecvePathsFromCapture(capt, matchAll, matchAll, nil)
+	c.Assert(err, IsNil)
+
+	// the processes are sorted by when they started, not when they exited
+	var exes []string
+	for _, proc := range paths.Processes {
+		exes = append(exes, proc.Exe)
+	}
+	c.Check(exes, DeepEquals, []string{"/bin/sh", "/bin/sh", "/usr/bin/app"})
+
+	// the accesses of the same program from different processes are only
+	// listed once
+	var files []string
+	for _, f := range paths.AllFiles {
+		files = append(files, f.Program+" "+f.Path)
+	}
+	c.Check(files, DeepEquals, []string{
+		"/bin/sh /etc/ld.so.cache",
+		"/usr/bin/app /etc/ld.so.cache",
+	})
+}
+
+func (p *execvePathsSuite) TestReadBytes(c *C) {
+	log := `100 1574886785.000000 execve("/usr/bin/app", ["app"], 0x1566008 /* 69 vars */) = 0
+100 1574886785.001000 openat(AT_FDCWD, "/etc/app.conf", O_RDONLY|O_CLOEXEC) = 3</etc/app.conf>
+100 1574886785.002000 read(3</etc/app.conf>, ""..., 4096) = 4096
+100 1574886785.003000 pread64(3</etc/app.conf>, ""..., 4096, 4096) = 100
+100 1574886785.004000 read(3</etc/app.conf>, ""..., 4096) = 0
+100 1574886785.005000 lseek(3</etc/app.conf>, 0, SEEK_SET) = 0
+100 1574886785.006000 read(4</usr/share/app/data>, ""..., 1024) = 1024
+100 1574886785.010000 +++ exited with 0 +++
+`
+	capt, err := strace.CaptureLog(strings.NewReader(log), true, strace.ScopeAll, strace.Limits{})
+	c.Assert(err, IsNil)
+	var reads []int64
+	for _, ev := range capt.Events {
+		if ev.Kind == capture.Open {
+			reads = append(reads, ev.Bytes)
+		}
+	}
+	// only the read syscalls have the bytes they read, the execve and the
+	// openat are file accesses too
+	c.Check(reads, DeepEquals, []int64{0, 0, 4096, 100, 0, 0, 1024})
+
+	matchAll := regexp.MustCompile(".*")
+	paths, err := strace.ExecvePathsFromCapture(capt, matchAll, matchAll, nil)
+	c.Assert(err, IsNil)
+	c.Check(paths.ReadBytes(), DeepEquals, map[string]int64{
+		"/etc/app.conf":       4196,
+		"/usr/share/app/data": 1024,
+	})
+}
+
+func (p *execvePathsSuite) TestExecvePathsFromCaptureFiltered(c *C) {
+	log := `100 1574886785.000000 execve("/usr/bin/launcher", ["launcher"], 0x1566008 /* 69 vars */) = 0
+100 1574886785.001000 openat(AT_FDCWD, "/snap/foo/current/launcher.conf", O_RDONLY|O_CLOEXEC) = 3</snap/foo/current/launcher.conf>
+100 1574886785.002000 openat(AT_FDCWD, "/etc/launcher.conf", O_RDONLY|O_CLOEXEC) = 3</etc/launcher.conf>
+100 1574886785.003000 execve("/usr/bin/app", ["app"], 0x1566008 /* 69 vars */) = 0
+100 1574886785.004000 openat(AT_FDCWD, "/snap/foo/current/app.conf", O_RDONLY|O_CLOEXEC) = 3</snap/foo/current/app.conf>
+100 1574886785.005000 openat(AT_FDCWD, "/etc/app.conf", O_RDONLY|O_CLOEXEC) = 3</etc/app.conf>
+100 1574886785.010000 +++ exited with 0 +++
+`
+	capt, err := strace.CaptureLog(strings.NewReader(log), true, strace.ScopeAll, strace.Limits{})
+	c.Assert(err, IsNil)
+
+	accesses := func(paths *strace.ExecvePaths) map[string][]string {
+		m := make(map[string][]string)
+		for _, proc := range paths.Processes {
+			for _, access := range proc.PathAccesses {
+				m[proc.Exe] = append(m[proc.Exe], access.Path)
+			}
+		}
+		return m
+	}
+
+	// only the matching accesses are kept in the processes too
+	paths, err := strace.ExecvePathsFromCapture(capt, regexp.MustCompile("^/snap/foo/"), regexp.MustCompile(".*"), nil)
+	c.Assert(err, IsNil)
+	c.Check(accesses(paths), DeepEquals, map[string][]string{
+		"/usr/bin/launcher": {"/snap/foo/current/launcher.conf"},
+		"/usr/bin/app":      {"/snap/foo/current/app.conf"},
+	})
+	c.Check(paths.Processes, HasLen, 2)
+
+	paths, err = strace.ExecvePathsFromCapture(capt, regexp.MustCompile(".*"), regexp.MustCompile(".*"), []string{"/usr/*/launcher"})
+	c.Assert(err, IsNil)
+	c.Check(accesses(paths), DeepEquals, map[string][]string{
+		"/usr/bin/app": {"/snap/foo/current/app.conf", "/etc/app.conf"},
+	})
+	var files []string
+	for _, f := range paths.AllFiles {
+		files = append(files, f.Path)
+	}
+	c.Check(files, DeepEquals, []string{"/etc/app.conf", "/snap/foo/current/app.conf"})
+
+	paths, err = strace.ExecvePathsFromCapture(capt, regexp.MustCompile("conf$"), regexp.MustCompile("launcher"), nil)
+	c.Assert(err, IsNil)
+	c.Check(accesses(paths), DeepEquals, map[string][]string{
+		"/usr/bin/launcher": {"/snap/foo/current/launcher.conf", "/etc/launcher.conf"},
+	})
+
+	_, err = strace.ExecvePathsFromCapture(capt, regexp.MustCompile(".*"), regexp.MustCompile(".*"), []string{"["})
+	c.Check(err, ErrorMatches, `internal error: pattern "\[" is invalid: .*`)
+}
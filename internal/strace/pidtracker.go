@@ -17,6 +17,8 @@
 
 package strace
 
+import "time"
+
 // type childPidStart struct {
 // 	start float64
 // 	pid   string
@@ -40,31 +42,96 @@ package strace
 // }
 
 type exeStart struct {
-	start float64
-	exe   string
+	start   time.Time
+	exe     string
+	args    []string
+	blocked time.Duration
+	// displayConnection is when the program first connected to the display
+	// server
+	displayConnection time.Time
+}
+
+// forkedPid is a process forked by another one
+type forkedPid struct {
+	parent string
+	time   time.Time
 }
 
 type pidTracker struct {
 	pidToExeStart map[string]exeStart
+	// forks are the parents of the processes, which unlike the programs
+	// they execute are kept after the processes exit
+	forks map[string]forkedPid
+	// firstDisplayConnection is when any process first connected to the
+	// display server
+	firstDisplayConnection time.Time
 }
 
 func newpidTracker() *pidTracker {
 	return &pidTracker{
 		pidToExeStart: make(map[string]exeStart),
+		forks:         make(map[string]forkedPid),
 	}
 }
 
-func (pt *pidTracker) getPid(pid string) (startTime float64, exe string) {
+func (pt *pidTracker) getPid(pid string) (startTime time.Time, exe string) {
 	if exeStart, ok := pt.pidToExeStart[pid]; ok {
 		return exeStart.start, exeStart.exe
 	}
-	return 0, ""
+	return time.Time{}, ""
 }
 
-func (pt *pidTracker) addPid(pid string, startTime float64, exe string) {
+func (pt *pidTracker) addPid(pid string, startTime time.Time, exe string) {
 	pt.pidToExeStart[pid] = exeStart{start: startTime, exe: exe}
 }
 
+func (pt *pidTracker) getArgs(pid string) []string {
+	return pt.pidToExeStart[pid].args
+}
+
+func (pt *pidTracker) setArgs(pid string, args []string) {
+	if exeStart, ok := pt.pidToExeStart[pid]; ok {
+		exeStart.args = args
+		pt.pidToExeStart[pid] = exeStart
+	}
+}
+
+func (pt *pidTracker) getBlocked(pid string) time.Duration {
+	return pt.pidToExeStart[pid].blocked
+}
+
+func (pt *pidTracker) addBlocked(pid string, d time.Duration) {
+	if exeStart, ok := pt.pidToExeStart[pid]; ok {
+		exeStart.blocked += d
+		pt.pidToExeStart[pid] = exeStart
+	}
+}
+
+func (pt *pidTracker) getDisplayConnection(pid string) time.Time {
+	return pt.pidToExeStart[pid].displayConnection
+}
+
+func (pt *pidTracker) addDisplayConnection(pid string, t time.Time) {
+	if pt.firstDisplayConnection.IsZero() || t.Before(pt.firstDisplayConnection) {
+		pt.firstDisplayConnection = t
+	}
+	if exeStart, ok := pt.pidToExeStart[pid]; ok && exeStart.displayConnection.IsZero() {
+		exeStart.displayConnection = t
+		pt.pidToExeStart[pid] = exeStart
+	}
+}
+
+func (pt *pidTracker) addFork(pid, child string, forkTime time.Time) {
+	pt.forks[child] = forkedPid{parent: pid, time: forkTime}
+}
+
+// getFork returns the process which forked the given one and when, the parent
+// is empty if the fork wasn't traced.
+func (pt *pidTracker) getFork(pid string) (parent string, forkTime time.Time) {
+	fork := pt.forks[pid]
+	return fork.parent, fork.time
+}
+
 func (pt *pidTracker) deletePid(pid string) {
 	delete(pt.pidToExeStart, pid)
 }
@@ -0,0 +1,179 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package sysstat samples the CPU usage and load of the whole system, to tell
+// when a program was slowed down by the rest of the system rather than by
+// itself.
+package sysstat
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var procRoot = "/proc"
+
+// Sample is the CPU usage of the system over a single sampling interval
+type Sample struct {
+	// Time is the end of the interval, relative to the start of the program
+	Time time.Duration
+	// CPUPercent is the percentage of the time of all the CPUs spent running
+	// anything
+	CPUPercent float64
+	// IOWaitPercent is the percentage of the time of all the CPUs spent idle
+	// while there was I/O in progress
+	IOWaitPercent float64
+}
+
+// times is the cumulative time spent by all the CPUs in each state, in clock
+// ticks
+type times struct {
+	time   time.Time
+	total  uint64
+	idle   uint64
+	iowait uint64
+}
+
+// readTimes reads the CPU times from the first line of /proc/stat, which is
+// the sum of all the CPUs.
+func readTimes() (*times, error) {
+	content, err := ioutil.ReadFile(filepath.Join(procRoot, "stat"))
+	if err != nil {
+		return nil, err
+	}
+	line, err := bufio.NewReader(bytes.NewReader(content)).ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("cannot read cpu times: %v", err)
+	}
+	// cpu user nice system idle iowait irq softirq steal guest guest_nice
+	fields := strings.Fields(line)
+	if len(fields) < 9 || fields[0] != "cpu" {
+		return nil, fmt.Errorf("cannot parse cpu times %q", strings.TrimSpace(line))
+	}
+	t := &times{time: time.Now()}
+	// guest and guest_nice are already included in user and nice
+	for i, f := range fields[1:9] {
+		v, err := strconv.ParseUint(f, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse cpu times %q", strings.TrimSpace(line))
+		}
+		t.total += v
+		switch i {
+		case 3:
+			t.idle = v
+		case 4:
+			t.iowait = v
+		}
+	}
+	return t, nil
+}
+
+// delta returns the difference of two cumulative counters, iowait can go down
+// on some kernels
+func delta(now, then uint64) uint64 {
+	if now > then {
+		return now - then
+	}
+	return 0
+}
+
+// sampleBetween returns the sample for the interval between the two times.
+func sampleBetween(start time.Time, prev, cur *times) Sample {
+	s := Sample{Time: cur.time.Sub(start)}
+	total := delta(cur.total, prev.total)
+	if total == 0 {
+		return s
+	}
+	idle := delta(cur.idle, prev.idle)
+	iowait := delta(cur.iowait, prev.iowait)
+	s.CPUPercent = 100 * float64(delta(total, idle+iowait)) / float64(total)
+	s.IOWaitPercent = 100 * float64(iowait) / float64(total)
+	return s
+}
+
+// LoadAverage returns the load average of the system over the last minute,
+// i.e. the average number of processes running or waiting to run.
+func LoadAverage() (float64, error) {
+	content, err := ioutil.ReadFile(filepath.Join(procRoot, "loadavg"))
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(content))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("cannot parse load average %q", strings.TrimSpace(string(content)))
+	}
+	load, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse load average %q", strings.TrimSpace(string(content)))
+	}
+	return load, nil
+}
+
+// Sampler samples the CPU usage of the system at a fixed interval
+type Sampler struct {
+	interval time.Duration
+	samples  []Sample
+
+	stop chan struct{}
+	exit chan struct{}
+}
+
+// NewSampler returns a sampler of the CPU usage of the system.
+func NewSampler(interval time.Duration) *Sampler {
+	return &Sampler{
+		interval: interval,
+		stop:     make(chan struct{}),
+		exit:     make(chan struct{}),
+	}
+}
+
+// Start starts sampling, with times relative to the given start time.
+func (s *Sampler) Start(start time.Time) {
+	go func() {
+		defer close(s.exit)
+		prev, err := readTimes()
+		if err != nil {
+			return
+		}
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-time.After(s.interval):
+			}
+			cur, err := readTimes()
+			if err != nil {
+				return
+			}
+			s.samples = append(s.samples, sampleBetween(start, prev, cur))
+			prev = cur
+		}
+	}()
+}
+
+// Stop stops sampling and returns all the samples.
+func (s *Sampler) Stop() []Sample {
+	close(s.stop)
+	<-s.exit
+	return s.samples
+}
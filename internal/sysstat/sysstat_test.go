@@ -0,0 +1,93 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package sysstat_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/anonymouse64/etrace/internal/sysstat"
+
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type sysstatTestSuite struct{}
+
+var _ = check.Suite(&sysstatTestSuite{})
+
+func (s *sysstatTestSuite) TestSampler(c *check.C) {
+	dir := c.MkDir()
+	restore := sysstat.MockProcRoot(dir)
+	defer restore()
+	stat := filepath.Join(dir, "stat")
+	c.Assert(ioutil.WriteFile(stat, []byte("cpu  100 0 100 700 100 0 0 0 0 0\ncpu0 50 0 50 350 50 0 0 0 0 0\n"), 0644), check.IsNil)
+
+	sampler := sysstat.NewSampler(time.Millisecond)
+	sampler.Start(time.Now())
+	time.Sleep(5 * time.Millisecond)
+	// 1000 ticks later, 500 of them busy and 250 waiting for I/O, the file
+	// is replaced so that it is never read half written
+	c.Assert(ioutil.WriteFile(stat+".new", []byte("cpu  300 0 400 950 350 0 0 0 0 0\ncpu0 50 0 50 350 50 0 0 0 0 0\n"), 0644), check.IsNil)
+	c.Assert(os.Rename(stat+".new", stat), check.IsNil)
+	time.Sleep(5 * time.Millisecond)
+	samples := sampler.Stop()
+
+	var found bool
+	for _, sample := range samples {
+		c.Check(sample.Time > 0, check.Equals, true)
+		if sample.CPUPercent != 0 {
+			found = true
+			c.Check(sample.CPUPercent, check.Equals, 50.0)
+			c.Check(sample.IOWaitPercent, check.Equals, 25.0)
+		}
+	}
+	c.Check(found, check.Equals, true)
+}
+
+func (s *sysstatTestSuite) TestSamplerNoStat(c *check.C) {
+	restore := sysstat.MockProcRoot(c.MkDir())
+	defer restore()
+
+	sampler := sysstat.NewSampler(time.Millisecond)
+	sampler.Start(time.Now())
+	c.Check(sampler.Stop(), check.HasLen, 0)
+}
+
+func (s *sysstatTestSuite) TestLoadAverage(c *check.C) {
+	dir := c.MkDir()
+	restore := sysstat.MockProcRoot(dir)
+	defer restore()
+
+	_, err := sysstat.LoadAverage()
+	c.Check(err, check.NotNil)
+
+	loadavg := filepath.Join(dir, "loadavg")
+	c.Assert(ioutil.WriteFile(loadavg, []byte("2.50 1.20 0.80 3/812 12345\n"), 0644), check.IsNil)
+	load, err := sysstat.LoadAverage()
+	c.Assert(err, check.IsNil)
+	c.Check(load, check.Equals, 2.5)
+
+	c.Assert(ioutil.WriteFile(loadavg, []byte("busy\n"), 0644), check.IsNil)
+	_, err = sysstat.LoadAverage()
+	c.Check(err, check.ErrorMatches, `cannot parse load average "busy"`)
+}
@@ -0,0 +1,136 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package thermal reads the cpu frequencies, temperatures and throttling
+// counters of the machine, so that results which get slower over a session can
+// be attributed to thermal throttling.
+package thermal
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var sysRoot = "/sys"
+
+// coolDownInterval is how often the temperature is read while cooling down
+var coolDownInterval = time.Second
+
+// Reading is the thermal state of the machine at a point in time, facts which
+// can't be read, i.e. in virtual machines, are left empty
+type Reading struct {
+	// FrequencyMHz is the average current frequency of the cpus
+	FrequencyMHz float64 `json:",omitempty"`
+	// TemperatureC is the highest temperature of all the thermal zones
+	TemperatureC float64 `json:",omitempty"`
+	// ThrottleCount is the total number of times the cpus were throttled
+	// since boot, which is only counted on x86
+	ThrottleCount uint64 `json:",omitempty"`
+}
+
+// Telemetry is the thermal state of the machine at the start and end of a run
+type Telemetry struct {
+	Start Reading
+	End   Reading
+	// ThrottleEvents is the number of times the cpus were throttled during
+	// the run
+	ThrottleEvents uint64 `json:",omitempty"`
+}
+
+// readUint reads a file containing a single unsigned integer.
+func readUint(path string) (uint64, bool) {
+	out, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, false
+	}
+	v, err := strconv.ParseUint(strings.TrimSpace(string(out)), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return v, true
+}
+
+// Read returns the current thermal state of the machine.
+func Read() Reading {
+	var r Reading
+
+	freqs, _ := filepath.Glob(filepath.Join(sysRoot, "devices/system/cpu/cpu[0-9]*/cpufreq/scaling_cur_freq"))
+	total, n := uint64(0), 0
+	for _, path := range freqs {
+		// the frequency is in kHz
+		if khz, ok := readUint(path); ok {
+			total += khz
+			n++
+		}
+	}
+	if n != 0 {
+		r.FrequencyMHz = float64(total) / float64(n) / 1000
+	}
+
+	zones, _ := filepath.Glob(filepath.Join(sysRoot, "class/thermal/thermal_zone[0-9]*/temp"))
+	for _, path := range zones {
+		// the temperature is in millidegrees Celsius
+		if milli, ok := readUint(path); ok {
+			if c := float64(milli) / 1000; c > r.TemperatureC {
+				r.TemperatureC = c
+			}
+		}
+	}
+
+	// the package counters are the same for all the cpus of a package, but
+	// only the difference between readings matters
+	for _, name := range []string{"core_throttle_count", "package_throttle_count"} {
+		counts, _ := filepath.Glob(filepath.Join(sysRoot, "devices/system/cpu/cpu[0-9]*/thermal_throttle", name))
+		for _, path := range counts {
+			if count, ok := readUint(path); ok {
+				r.ThrottleCount += count
+			}
+		}
+	}
+	return r
+}
+
+// Between returns the telemetry of a run from the readings at its start and
+// end.
+func Between(start, end Reading) *Telemetry {
+	t := &Telemetry{Start: start, End: end}
+	if end.ThrottleCount > start.ThrottleCount {
+		t.ThrottleEvents = end.ThrottleCount - start.ThrottleCount
+	}
+	return t
+}
+
+// CoolDown waits until the highest temperature of the machine is at most the
+// given one, for at most the timeout, and returns how long it waited and
+// whether the machine cooled down. Machines whose temperature can't be read
+// are not waited for.
+func CoolDown(maxC float64, timeout time.Duration) (time.Duration, bool) {
+	start := time.Now()
+	for {
+		temp := Read().TemperatureC
+		if temp == 0 || temp <= maxC {
+			return time.Since(start), true
+		}
+		if time.Since(start) >= timeout {
+			return time.Since(start), false
+		}
+		time.Sleep(coolDownInterval)
+	}
+}
@@ -0,0 +1,113 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package thermal_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gopkg.in/check.v1"
+
+	"github.com/anonymouse64/etrace/internal/thermal"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type thermalTestSuite struct {
+	sysDir string
+}
+
+var _ = check.Suite(&thermalTestSuite{})
+
+func (s *thermalTestSuite) SetUpTest(c *check.C) {
+	s.sysDir = c.MkDir()
+}
+
+func (s *thermalTestSuite) mockFile(c *check.C, path, content string) {
+	full := filepath.Join(s.sysDir, path)
+	c.Assert(os.MkdirAll(filepath.Dir(full), 0755), check.IsNil)
+	c.Assert(ioutil.WriteFile(full, []byte(content), 0644), check.IsNil)
+}
+
+func (s *thermalTestSuite) TestRead(c *check.C) {
+	r := thermal.MockSysRoot(s.sysDir)
+	defer r()
+
+	s.mockFile(c, "devices/system/cpu/cpu0/cpufreq/scaling_cur_freq", "2000000\n")
+	s.mockFile(c, "devices/system/cpu/cpu1/cpufreq/scaling_cur_freq", "3000000\n")
+	s.mockFile(c, "devices/system/cpu/cpu0/thermal_throttle/core_throttle_count", "2\n")
+	s.mockFile(c, "devices/system/cpu/cpu0/thermal_throttle/package_throttle_count", "5\n")
+	s.mockFile(c, "devices/system/cpu/cpu1/thermal_throttle/core_throttle_count", "1\n")
+	s.mockFile(c, "class/thermal/thermal_zone0/temp", "45000\n")
+	s.mockFile(c, "class/thermal/thermal_zone1/temp", "61500\n")
+	// unreadable values are ignored
+	s.mockFile(c, "class/thermal/thermal_zone2/temp", "invalid\n")
+
+	c.Check(thermal.Read(), check.Equals, thermal.Reading{
+		FrequencyMHz:  2500,
+		TemperatureC:  61.5,
+		ThrottleCount: 8,
+	})
+}
+
+func (s *thermalTestSuite) TestReadNothing(c *check.C) {
+	r := thermal.MockSysRoot(s.sysDir)
+	defer r()
+
+	c.Check(thermal.Read(), check.Equals, thermal.Reading{})
+}
+
+func (s *thermalTestSuite) TestBetween(c *check.C) {
+	t := thermal.Between(thermal.Reading{ThrottleCount: 3}, thermal.Reading{ThrottleCount: 7})
+	c.Check(t.ThrottleEvents, check.Equals, uint64(4))
+
+	// the counters of cpus which went offline are missing from the end
+	t = thermal.Between(thermal.Reading{ThrottleCount: 3}, thermal.Reading{ThrottleCount: 1})
+	c.Check(t.ThrottleEvents, check.Equals, uint64(0))
+}
+
+func (s *thermalTestSuite) TestCoolDown(c *check.C) {
+	r := thermal.MockSysRoot(s.sysDir)
+	defer r()
+	r = thermal.MockCoolDownInterval(time.Millisecond)
+	defer r()
+
+	// temperatures which can't be read are not waited for
+	waited, ok := thermal.CoolDown(50, time.Second)
+	c.Check(ok, check.Equals, true)
+	c.Check(waited < 100*time.Millisecond, check.Equals, true)
+
+	s.mockFile(c, "class/thermal/thermal_zone0/temp", "70000\n")
+	waited, ok = thermal.CoolDown(50, 5*time.Millisecond)
+	c.Check(ok, check.Equals, false)
+	c.Check(waited >= 5*time.Millisecond, check.Equals, true)
+
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		// replaced so that it is never read half written
+		zone := filepath.Join(s.sysDir, "class/thermal/thermal_zone0")
+		ioutil.WriteFile(filepath.Join(zone, "temp.new"), []byte("45000\n"), 0644)
+		os.Rename(filepath.Join(zone, "temp.new"), filepath.Join(zone, "temp"))
+	}()
+	waited, ok = thermal.CoolDown(50, 10*time.Second)
+	c.Check(ok, check.Equals, true)
+	c.Check(waited >= 5*time.Millisecond, check.Equals, true)
+}
@@ -0,0 +1,180 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package timechart writes a timechart of a run in the Chrome trace event
+// format, which can be opened with Perfetto (https://ui.perfetto.dev) or
+// chrome://tracing, with the programs and file accesses of the run next to
+// the usage of the system.
+package timechart
+
+import (
+	"encoding/json"
+	"io"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	// the trace process of the system counters and of the programs, the
+	// programs are threads of it with their pids as thread IDs
+	systemPid   = 0
+	programsPid = 1
+)
+
+// event is an event of the Chrome trace event format, see
+// https://docs.google.com/document/d/1CvAClvFfyA5R-PhYUmn5OOQtYMH4h6I0nSsKchNAySU
+type event struct {
+	Name  string `json:"name"`
+	Phase string `json:"ph"`
+	// Time and Duration are in microseconds
+	Time     float64                `json:"ts"`
+	Duration float64                `json:"dur,omitempty"`
+	Pid      int                    `json:"pid"`
+	Tid      int                    `json:"tid"`
+	Scope    string                 `json:"s,omitempty"`
+	Args     map[string]interface{} `json:"args,omitempty"`
+}
+
+// Chart is a timechart of a run
+type Chart struct {
+	// Name is added to the names of the processes of the chart, to tell
+	// apart the runs written together
+	Name     string
+	start    time.Time
+	events   []event
+	programs map[int]bool
+	// system is whether the usage of the system was sampled
+	system bool
+}
+
+// New returns an empty timechart of a run which started at the given time.
+func New(start time.Time) *Chart {
+	return &Chart{
+		start:    start,
+		programs: make(map[int]bool),
+	}
+}
+
+// micros returns the time in microseconds since the start of the run.
+func (c *Chart) micros(t time.Time) float64 {
+	return float64(t.Sub(c.start).Nanoseconds()) / 1e3
+}
+
+// Program adds the execution of a program by the process with the pid, every
+// process gets its own track.
+func (c *Chart) Program(pid int, exe string, start time.Time, duration time.Duration) {
+	if !c.programs[pid] {
+		c.programs[pid] = true
+		c.events = append(c.events, event{
+			Name:  "thread_name",
+			Phase: "M",
+			Pid:   programsPid,
+			Tid:   pid,
+			Args:  map[string]interface{}{"name": filepath.Base(exe)},
+		})
+	}
+	c.events = append(c.events, event{
+		Name:     filepath.Base(exe),
+		Phase:    "X",
+		Time:     c.micros(start),
+		Duration: float64(duration.Nanoseconds()) / 1e3,
+		Pid:      programsPid,
+		Tid:      pid,
+		Args:     map[string]interface{}{"exe": exe},
+	})
+}
+
+// FileAccess adds the access of a file by the process with the pid.
+func (c *Chart) FileAccess(pid int, path, syscall string, t time.Time) {
+	c.events = append(c.events, event{
+		Name:  path,
+		Phase: "i",
+		Time:  c.micros(t),
+		Pid:   programsPid,
+		Tid:   pid,
+		Scope: "t",
+		Args:  map[string]interface{}{"syscall": syscall},
+	})
+}
+
+// Mark adds a point in time of the whole run, like when the window appeared.
+func (c *Chart) Mark(name string, t time.Time) {
+	c.events = append(c.events, event{
+		Name:  name,
+		Phase: "i",
+		Time:  c.micros(t),
+		Pid:   programsPid,
+		Scope: "g",
+	})
+}
+
+// SystemUsage adds a sample of the CPU usage of the system, as the percentage
+// of the time of all the CPUs which was spent running anything and waiting
+// for I/O.
+func (c *Chart) SystemUsage(t time.Time, cpuPercent, ioWaitPercent float64) {
+	c.system = true
+	c.events = append(c.events, event{
+		Name:  "CPU",
+		Phase: "C",
+		Time:  c.micros(t),
+		Pid:   systemPid,
+		Args:  map[string]interface{}{"busy": cpuPercent, "iowait": ioWaitPercent},
+	})
+}
+
+// Write writes the timechart as JSON, sorted by time.
+func (c *Chart) Write(w io.Writer) error {
+	return WriteAll(w, []*Chart{c})
+}
+
+// WriteAll writes the timecharts of several runs as JSON, sorted by time. The
+// runs get their own processes in the trace, and all start at the same time
+// so that they can be compared.
+func WriteAll(w io.Writer, charts []*Chart) error {
+	var events []event
+	for i, c := range charts {
+		// every chart has its own system and programs processes
+		offset := 2 * i
+		suffix := ""
+		if c.Name != "" {
+			suffix = " (" + c.Name + ")"
+		}
+		if c.system {
+			events = append(events, event{Name: "process_name", Phase: "M", Pid: systemPid + offset, Args: map[string]interface{}{"name": "System" + suffix}})
+		}
+		events = append(events, event{Name: "process_name", Phase: "M", Pid: programsPid + offset, Args: map[string]interface{}{"name": "Programs" + suffix}})
+		for _, ev := range c.events {
+			ev.Pid += offset
+			events = append(events, ev)
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		// metadata events have no time and go first
+		if (events[i].Phase == "M") != (events[j].Phase == "M") {
+			return events[i].Phase == "M"
+		}
+		return events[i].Time < events[j].Time
+	})
+	if events == nil {
+		events = []event{}
+	}
+	return json.NewEncoder(w).Encode(struct {
+		TraceEvents     []event `json:"traceEvents"`
+		DisplayTimeUnit string  `json:"displayTimeUnit"`
+	}{events, "ms"})
+}
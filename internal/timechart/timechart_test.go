@@ -0,0 +1,95 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package timechart_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/anonymouse64/etrace/internal/timechart"
+
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type timechartTestSuite struct{}
+
+var _ = check.Suite(&timechartTestSuite{})
+
+func (s *timechartTestSuite) TestWrite(c *check.C) {
+	start := time.Date(2021, 7, 1, 12, 0, 0, 0, time.UTC)
+	chart := timechart.New(start)
+	chart.SystemUsage(start.Add(50*time.Millisecond), 75, 20)
+	chart.Program(42, "/usr/bin/gedit", start.Add(time.Millisecond), 2*time.Second)
+	chart.FileAccess(42, "/usr/lib/libgtk-3.so.0", "openat", start.Add(10*time.Millisecond))
+	chart.Mark("window", start.Add(time.Second))
+
+	var buf bytes.Buffer
+	c.Assert(chart.Write(&buf), check.IsNil)
+
+	var trace struct {
+		TraceEvents []map[string]interface{} `json:"traceEvents"`
+	}
+	c.Assert(json.Unmarshal(buf.Bytes(), &trace), check.IsNil)
+	c.Check(trace.TraceEvents, check.DeepEquals, []map[string]interface{}{
+		{"name": "process_name", "ph": "M", "ts": 0.0, "pid": 0.0, "tid": 0.0, "args": map[string]interface{}{"name": "System"}},
+		{"name": "process_name", "ph": "M", "ts": 0.0, "pid": 1.0, "tid": 0.0, "args": map[string]interface{}{"name": "Programs"}},
+		{"name": "thread_name", "ph": "M", "ts": 0.0, "pid": 1.0, "tid": 42.0, "args": map[string]interface{}{"name": "gedit"}},
+		{"name": "gedit", "ph": "X", "ts": 1000.0, "dur": 2e6, "pid": 1.0, "tid": 42.0, "args": map[string]interface{}{"exe": "/usr/bin/gedit"}},
+		{"name": "/usr/lib/libgtk-3.so.0", "ph": "i", "ts": 10000.0, "pid": 1.0, "tid": 42.0, "s": "t", "args": map[string]interface{}{"syscall": "openat"}},
+		{"name": "CPU", "ph": "C", "ts": 50000.0, "pid": 0.0, "tid": 0.0, "args": map[string]interface{}{"busy": 75.0, "iowait": 20.0}},
+		{"name": "window", "ph": "i", "ts": 1e6, "pid": 1.0, "tid": 0.0, "s": "g"},
+	})
+}
+
+func (s *timechartTestSuite) TestWriteAll(c *check.C) {
+	start := time.Date(2021, 7, 1, 12, 0, 0, 0, time.UTC)
+	first := timechart.New(start)
+	first.Name = "run 1"
+	first.Program(42, "/usr/bin/gedit", start, time.Second)
+	// the second run started later, but is shown from the same time
+	second := timechart.New(start.Add(time.Minute))
+	second.Name = "run 2"
+	second.Program(43, "/usr/bin/gedit", start.Add(time.Minute), 2*time.Second)
+	second.Mark("window", start.Add(time.Minute+time.Second))
+
+	var buf bytes.Buffer
+	c.Assert(timechart.WriteAll(&buf, []*timechart.Chart{first, second}), check.IsNil)
+
+	var trace struct {
+		TraceEvents []map[string]interface{} `json:"traceEvents"`
+	}
+	c.Assert(json.Unmarshal(buf.Bytes(), &trace), check.IsNil)
+	// without samples of the system there is no system process
+	c.Check(trace.TraceEvents, check.DeepEquals, []map[string]interface{}{
+		{"name": "process_name", "ph": "M", "ts": 0.0, "pid": 1.0, "tid": 0.0, "args": map[string]interface{}{"name": "Programs (run 1)"}},
+		{"name": "thread_name", "ph": "M", "ts": 0.0, "pid": 1.0, "tid": 42.0, "args": map[string]interface{}{"name": "gedit"}},
+		{"name": "process_name", "ph": "M", "ts": 0.0, "pid": 3.0, "tid": 0.0, "args": map[string]interface{}{"name": "Programs (run 2)"}},
+		{"name": "thread_name", "ph": "M", "ts": 0.0, "pid": 3.0, "tid": 43.0, "args": map[string]interface{}{"name": "gedit"}},
+		{"name": "gedit", "ph": "X", "ts": 0.0, "dur": 1e6, "pid": 1.0, "tid": 42.0, "args": map[string]interface{}{"exe": "/usr/bin/gedit"}},
+		{"name": "gedit", "ph": "X", "ts": 0.0, "dur": 2e6, "pid": 3.0, "tid": 43.0, "args": map[string]interface{}{"exe": "/usr/bin/gedit"}},
+		{"name": "window", "ph": "i", "ts": 1e6, "pid": 3.0, "tid": 0.0, "s": "g"},
+	})
+
+	buf.Reset()
+	c.Assert(timechart.WriteAll(&buf, nil), check.IsNil)
+	c.Check(buf.String(), check.Equals, `{"traceEvents":[],"displayTimeUnit":"ms"}`+"\n")
+}
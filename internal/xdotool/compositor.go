@@ -0,0 +1,228 @@
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package xdotool
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	// ToolXDoTool uses xdotool, which only works on X11
+	ToolXDoTool = "xdotool"
+	// ToolKWin uses the scripting D-Bus API of KWin
+	ToolKWin = "kwin"
+	// ToolSway uses the IPC socket of Sway and other wlroots compositors
+	// implementing it
+	ToolSway = "sway"
+	// ToolGnomeShell uses the Eval D-Bus method of GNOME Shell, which needs
+	// it to be in unsafe mode
+	ToolGnomeShell = "gnome-shell"
+)
+
+// DetectTool returns the tool which works best with the current session.
+func DetectTool() string {
+	if os.Getenv("SWAYSOCK") != "" {
+		return ToolSway
+	}
+	wayland := strings.TrimSpace(strings.ToLower(os.Getenv("XDG_SESSION_TYPE"))) == "wayland"
+	for _, desktop := range strings.Split(os.Getenv("XDG_CURRENT_DESKTOP"), ":") {
+		if desktop == "KDE" && wayland {
+			return ToolKWin
+		}
+		if desktop == "GNOME" && wayland {
+			return ToolGnomeShell
+		}
+	}
+	return ToolXDoTool
+}
+
+// windowInfo is a window as listed by a compositor
+type windowInfo struct {
+	ID        string
+	Pid       int
+	Class     string
+	ClassName string
+	Name      string
+	Visible   bool
+	// ActiveWorkspace is whether the window is on the active workspace
+	ActiveWorkspace bool
+}
+
+// matcher returns a function matching windows to the specification, which like
+// with xdotool search is a regular expression for each attribute set, a window
+// must match all of them.
+func (w Window) matcher() (func(info windowInfo) bool, error) {
+	attrs := w.attrs()
+	if len(attrs) == 0 {
+		return nil, fmt.Errorf("window specification is empty")
+	}
+	res := make([]*regexp.Regexp, len(attrs))
+	for i, attr := range attrs {
+		re, err := regexp.Compile(attr.pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid window %s %s: %v", attr.desc, attr.pattern, err)
+		}
+		res[i] = re
+	}
+	return func(info windowInfo) bool {
+		if w.ActiveWorkspace && !info.ActiveWorkspace {
+			return false
+		}
+		if w.excluded(info.ID) {
+			return false
+		}
+		for i, attr := range attrs {
+			if !res[i].MatchString(attr.field(info)) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// parseScriptWindows parses the windows reported as JSON by the scripts listing
+// them in KWin and GNOME Shell.
+func parseScriptWindows(out string) ([]windowInfo, error) {
+	var windows []struct {
+		ID        string `json:"id"`
+		Pid       int    `json:"pid"`
+		Class     string `json:"class"`
+		ClassName string `json:"classname"`
+		Name      string `json:"name"`
+		Visible   bool   `json:"visible"`
+		Active    bool   `json:"active"`
+	}
+	if err := json.Unmarshal([]byte(out), &windows); err != nil {
+		return nil, err
+	}
+	infos := make([]windowInfo, len(windows))
+	for i, w := range windows {
+		infos[i] = windowInfo{
+			ID:              w.ID,
+			Pid:             w.Pid,
+			Class:           w.Class,
+			ClassName:       w.ClassName,
+			Name:            w.Name,
+			Visible:         w.Visible,
+			ActiveWorkspace: w.Active,
+		}
+	}
+	return infos, nil
+}
+
+// compositor implements Xtooler for compositors which can list, close and
+// activate their windows
+type compositor struct {
+	name     string
+	list     func() ([]windowInfo, error)
+	close    func(id string) error
+	activate func(id string) error
+	// ready waits until the windows can be listed, if it takes a while
+	ready func(ctx context.Context) error
+}
+
+func (c *compositor) waitReady(ctx context.Context) error {
+	if c.ready == nil {
+		return nil
+	}
+	return c.ready(ctx)
+}
+
+func (c *compositor) WaitForWindow(ctx context.Context, w Window) ([]string, error) {
+	match, err := w.matcher()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.waitReady(ctx); err != nil {
+		return nil, err
+	}
+	for {
+		windows, err := c.list()
+		if err != nil {
+			return nil, err
+		}
+		var wids []string
+		for _, info := range windows {
+			if info.Visible && match(info) {
+				wids = append(wids, info.ID)
+			}
+		}
+		if len(wids) != 0 {
+			return wids, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("timed out waiting for window with %s to appear: %w", w.windowSpecErrDescription(), ctx.Err())
+		case <-time.After(newWindowPollInterval):
+		}
+	}
+}
+
+func (c *compositor) CloseWindowID(wid string) error {
+	if err := c.close(wid); err != nil {
+		return fmt.Errorf("%s failed to close window ID %s: %v", c.name, wid, err)
+	}
+	return nil
+}
+
+func (c *compositor) ActivateWindowID(wid string) error {
+	if err := c.activate(wid); err != nil {
+		return fmt.Errorf("%s failed to activate window ID %s: %v", c.name, wid, err)
+	}
+	return nil
+}
+
+func (c *compositor) PidForWindowID(wid string) (int, error) {
+	windows, err := c.list()
+	if err != nil {
+		return 0, err
+	}
+	for _, info := range windows {
+		if info.ID == wid {
+			return info.Pid, nil
+		}
+	}
+	return 0, fmt.Errorf("%s failed to get pid for window ID %s: no such window", c.name, wid)
+}
+
+func (c *compositor) VisibleWindowIDs() ([]string, error) {
+	windows, err := c.list()
+	if err != nil {
+		return nil, err
+	}
+	var wids []string
+	for _, info := range windows {
+		if info.Visible {
+			wids = append(wids, info.ID)
+		}
+	}
+	return wids, nil
+}
+
+func (c *compositor) WaitForNewWindow(ctx context.Context, existing []string) (string, error) {
+	if err := c.waitReady(ctx); err != nil {
+		return "", err
+	}
+	return waitForNewWindow(ctx, existing, c.VisibleWindowIDs)
+}
@@ -0,0 +1,366 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package xdotool_test
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/anonymouse64/etrace/internal/xdotool"
+
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type compositorTestSuite struct {
+	restore   func()
+	listeners []net.Listener
+}
+
+var _ = check.Suite(&compositorTestSuite{})
+
+func (s *compositorTestSuite) SetUpTest(c *check.C) {
+	s.restore = xdotool.MockNewWindowPollInterval(time.Millisecond)
+}
+
+func (s *compositorTestSuite) TearDownTest(c *check.C) {
+	s.restore()
+	for _, l := range s.listeners {
+		l.Close()
+	}
+	s.listeners = nil
+}
+
+const swayTree = `{
+	"id": 1, "type": "root", "name": "root", "pid": 0, "focus": [3],
+	"nodes": [{
+		"id": 3, "type": "output", "name": "eDP-1", "pid": 0, "focus": [4, 5],
+		"nodes": [{
+			"id": 4, "type": "workspace", "name": "1", "pid": 0,
+			"nodes": [
+				{"id": 7, "type": "con", "name": "Terminal", "pid": 100, "app_id": "foot", "visible": true, "nodes": []},
+				{"id": 8, "type": "con", "name": "Chromium", "pid": 200, "app_id": null, "visible": false,
+				 "window_properties": {"class": "Chromium-browser", "instance": "chromium-browser"}, "nodes": []}
+			],
+			"floating_nodes": [
+				{"id": 9, "type": "floating_con", "name": "Calculator", "pid": 300, "app_id": "gnome-calculator", "visible": true, "nodes": []}
+			]
+		}, {
+			"id": 5, "type": "workspace", "name": "2", "pid": 0,
+			"nodes": [
+				{"id": 10, "type": "con", "name": "Terminal", "pid": 400, "app_id": "foot", "visible": true, "nodes": []}
+			]
+		}]
+	}]
+}`
+
+// fakeSway serves the sway IPC protocol on a socket, replying to each message
+// with the reply for its type and recording the payloads received
+func (s *compositorTestSuite) fakeSway(c *check.C, replies map[uint32]string) (socket string, payloads chan string) {
+	socket = filepath.Join(c.MkDir(), "sway.sock")
+	l, err := net.Listen("unix", socket)
+	c.Assert(err, check.IsNil)
+	payloads = make(chan string, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			header := make([]byte, 14)
+			if _, err := io.ReadFull(conn, header); err != nil {
+				conn.Close()
+				continue
+			}
+			payload := make([]byte, binary.LittleEndian.Uint32(header[6:]))
+			io.ReadFull(conn, payload)
+			select {
+			case payloads <- string(payload):
+			default:
+			}
+			msgType := binary.LittleEndian.Uint32(header[10:])
+			reply := replies[msgType]
+			binary.LittleEndian.PutUint32(header[6:], uint32(len(reply)))
+			conn.Write(append(header, reply...))
+			conn.Close()
+		}
+	}()
+	s.listeners = append(s.listeners, l)
+	return socket, payloads
+}
+
+func (s *compositorTestSuite) TestSwayWaitForWindow(c *check.C) {
+	socket, _ := s.fakeSway(c, map[uint32]string{4: swayTree})
+	tool := xdotool.MakeSwayTool(socket)
+
+	wids, err := tool.WaitForWindow(context.Background(), xdotool.Window{Class: "^foot$"})
+	c.Assert(err, check.IsNil)
+	c.Assert(wids, check.DeepEquals, []string{"7", "10"})
+
+	wids, err = tool.WaitForWindow(context.Background(), xdotool.Window{Class: "^foot$", ActiveWorkspace: true})
+	c.Assert(err, check.IsNil)
+	c.Assert(wids, check.DeepEquals, []string{"7"})
+
+	wids, err = tool.WaitForWindow(context.Background(), xdotool.Window{Class: "^foot$", Exclude: []string{"7"}})
+	c.Assert(err, check.IsNil)
+	c.Assert(wids, check.DeepEquals, []string{"10"})
+
+	wids, err = tool.WaitForWindow(context.Background(), xdotool.Window{Name: "Calc"})
+	c.Assert(err, check.IsNil)
+	c.Assert(wids, check.DeepEquals, []string{"9"})
+
+	// hidden windows are not matched
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = tool.WaitForWindow(ctx, xdotool.Window{ClassName: "chromium"})
+	c.Assert(err, check.ErrorMatches, "timed out waiting for window with class name chromium to appear: context deadline exceeded")
+
+	// neither are excluded windows
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = tool.WaitForWindow(ctx, xdotool.Window{Name: "Calc", Exclude: []string{"9"}})
+	c.Assert(err, check.ErrorMatches, "timed out waiting for window with name Calc to appear: context deadline exceeded")
+}
+
+func (s *compositorTestSuite) TestSwayVisibleWindowIDsAndPid(c *check.C) {
+	socket, _ := s.fakeSway(c, map[uint32]string{4: swayTree})
+	tool := xdotool.MakeSwayTool(socket)
+
+	wids, err := tool.VisibleWindowIDs()
+	c.Assert(err, check.IsNil)
+	c.Assert(wids, check.DeepEquals, []string{"7", "9", "10"})
+
+	pid, err := tool.PidForWindowID("8")
+	c.Assert(err, check.IsNil)
+	c.Assert(pid, check.Equals, 200)
+
+	_, err = tool.PidForWindowID("42")
+	c.Assert(err, check.ErrorMatches, "sway failed to get pid for window ID 42: no such window")
+}
+
+func (s *compositorTestSuite) TestWatchNewWindows(c *check.C) {
+	socket, _ := s.fakeSway(c, map[uint32]string{4: swayTree})
+	tool := xdotool.MakeSwayTool(socket)
+	restore := xdotool.MockWatchWindowsInterval(time.Millisecond)
+	defer restore()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	before := time.Now()
+	appeared, err := xdotool.WatchNewWindows(ctx, tool, []string{"7"})
+	c.Assert(err, check.IsNil)
+	c.Assert(appeared, check.HasLen, 2)
+	c.Check(appeared[0].ID, check.Equals, "9")
+	c.Check(appeared[1].ID, check.Equals, "10")
+	c.Check(appeared[0].Time.Before(before), check.Equals, false)
+}
+
+func (s *compositorTestSuite) TestSwayCloseWindowID(c *check.C) {
+	socket, payloads := s.fakeSway(c, map[uint32]string{0: `[{"success": true}]`})
+	tool := xdotool.MakeSwayTool(socket)
+
+	c.Assert(tool.CloseWindowID("7"), check.IsNil)
+	c.Assert(<-payloads, check.Equals, "[con_id=7] kill")
+
+	err := tool.CloseWindowID("7; exit")
+	c.Assert(err, check.ErrorMatches, `sway failed to close window ID 7; exit: invalid window ID`)
+}
+
+func (s *compositorTestSuite) TestSwayActivateWindowID(c *check.C) {
+	socket, payloads := s.fakeSway(c, map[uint32]string{0: `[{"success": true}]`})
+	tool := xdotool.MakeSwayTool(socket)
+
+	c.Assert(tool.ActivateWindowID("7"), check.IsNil)
+	c.Assert(<-payloads, check.Equals, "[con_id=7] focus")
+
+	err := tool.ActivateWindowID("7; exit")
+	c.Assert(err, check.ErrorMatches, `sway failed to activate window ID 7; exit: invalid window ID`)
+}
+
+func (s *compositorTestSuite) TestSwayCloseWindowIDError(c *check.C) {
+	socket, _ := s.fakeSway(c, map[uint32]string{0: `[{"success": false, "error": "No matching node."}]`})
+	tool := xdotool.MakeSwayTool(socket)
+
+	err := tool.CloseWindowID("7")
+	c.Assert(err, check.ErrorMatches, "sway failed to close window ID 7: No matching node.")
+}
+
+func (s *compositorTestSuite) TestSwayNoSocket(c *check.C) {
+	tool := xdotool.MakeSwayTool(filepath.Join(c.MkDir(), "missing"))
+	_, err := tool.VisibleWindowIDs()
+	c.Assert(err, check.ErrorMatches, "sway failed to list windows: .*no such file or directory")
+}
+
+func (s *compositorTestSuite) TestWaitForWindowInvalidSpec(c *check.C) {
+	tool := xdotool.MakeSwayTool("")
+	_, err := tool.WaitForWindow(context.Background(), xdotool.Window{})
+	c.Assert(err, check.ErrorMatches, "window specification is empty")
+	_, err = tool.WaitForWindow(context.Background(), xdotool.Window{Name: "("})
+	c.Assert(err, check.ErrorMatches, "invalid window name \\(: .*")
+}
+
+func (s *compositorTestSuite) TestParseScriptWindows(c *check.C) {
+	windows, err := xdotool.ParseScriptWindows(`[{"id": "{1e8c}", "pid": 10, "class": "konsole", "classname": "konsole", "name": "Konsole", "visible": true, "active": true}]`)
+	c.Assert(err, check.IsNil)
+	c.Assert(windows, check.DeepEquals, []xdotool.WindowInfo{
+		{ID: "{1e8c}", Pid: 10, Class: "konsole", ClassName: "konsole", Name: "Konsole", Visible: true, ActiveWorkspace: true},
+	})
+
+	_, err = xdotool.ParseScriptWindows("undefined")
+	c.Assert(err, check.NotNil)
+}
+
+func (s *compositorTestSuite) TestGnomeShell(c *check.C) {
+	var scripts []string
+	restore := xdotool.MockShellEval(func(code string) (string, error) {
+		scripts = append(scripts, code)
+		if strings.Contains(code, "delete(") || strings.Contains(code, "activateWindow(") {
+			if strings.Contains(code, `"12"`) {
+				return "true", nil
+			}
+			return "false", nil
+		}
+		return `[{"id":"12","pid":100,"class":"org.gnome.TextEditor","classname":"org.gnome.TextEditor","name":"Untitled","visible":true,"active":true},` +
+			`{"id":"13","pid":200,"class":"Firefox","classname":"Navigator","name":"Mozilla Firefox","visible":false,"active":true}]`, nil
+	})
+	defer restore()
+
+	tool := xdotool.MakeGnomeShellTool()
+	wids, err := tool.WaitForWindow(context.Background(), xdotool.Window{Class: "TextEditor"})
+	c.Assert(err, check.IsNil)
+	c.Check(wids, check.DeepEquals, []string{"12"})
+
+	wids, err = tool.VisibleWindowIDs()
+	c.Assert(err, check.IsNil)
+	c.Check(wids, check.DeepEquals, []string{"12"})
+
+	pid, err := tool.PidForWindowID("13")
+	c.Assert(err, check.IsNil)
+	c.Check(pid, check.Equals, 200)
+
+	c.Assert(tool.CloseWindowID("12"), check.IsNil)
+	c.Assert(tool.CloseWindowID("14"), check.ErrorMatches, "gnome-shell failed to close window ID 14: no such window")
+	c.Assert(tool.ActivateWindowID("12"), check.IsNil)
+	c.Assert(tool.ActivateWindowID("14"), check.ErrorMatches, "gnome-shell failed to activate window ID 14: no such window")
+	c.Check(scripts, check.HasLen, 7)
+}
+
+func (s *compositorTestSuite) TestWaitForWindowAllAttributes(c *check.C) {
+	restore := xdotool.MockShellEval(func(code string) (string, error) {
+		return `[{"id":"12","pid":100,"class":"Firefox","classname":"Navigator","name":"Mozilla Firefox","visible":true,"active":true},` +
+			`{"id":"13","pid":100,"class":"Firefox","classname":"Navigator","name":"Firefox Nightly 96.0a1","visible":true,"active":true}]`, nil
+	})
+	defer restore()
+
+	tool := xdotool.MakeGnomeShellTool()
+	wids, err := tool.WaitForWindow(context.Background(), xdotool.Window{Class: "^Firefox$", Name: "Nightly [0-9.]+a1$"})
+	c.Assert(err, check.IsNil)
+	c.Check(wids, check.DeepEquals, []string{"13"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = tool.WaitForWindow(ctx, xdotool.Window{Class: "^Firefox$", ClassName: "Toolkit"})
+	c.Assert(err, check.ErrorMatches, `timed out waiting for window with class \^Firefox\$ and class name Toolkit to appear: context deadline exceeded`)
+
+	_, err = tool.WaitForWindow(context.Background(), xdotool.Window{Class: "Firefox", Name: "("})
+	c.Assert(err, check.ErrorMatches, `invalid window name \(: .*`)
+}
+
+func (s *compositorTestSuite) TestWaitForProgramWindow(c *check.C) {
+	lists := 0
+	restore := xdotool.MockShellEval(func(code string) (string, error) {
+		lists++
+		if lists < 3 {
+			// only the window which was already open matches at first
+			return `[{"id":"12","pid":100,"class":"gnome-terminal","name":"Terminal","visible":true,"active":true}]`, nil
+		}
+		return `[{"id":"12","pid":100,"class":"gnome-terminal","name":"Terminal","visible":true,"active":true},` +
+			`{"id":"14","pid":200,"class":"gnome-terminal","name":"Terminal","visible":true,"active":true}]`, nil
+	})
+	defer restore()
+
+	tool := xdotool.MakeGnomeShellTool()
+	wids, ignored, err := xdotool.WaitForProgramWindow(context.Background(), tool, xdotool.Window{Class: "terminal"}, []string{"12"})
+	c.Assert(err, check.IsNil)
+	c.Check(ignored, check.Equals, true)
+	c.Check(wids, check.DeepEquals, []string{"14"})
+
+	// a new window matched along with the existing one
+	wids, ignored, err = xdotool.WaitForProgramWindow(context.Background(), tool, xdotool.Window{Class: "terminal"}, []string{"12"})
+	c.Assert(err, check.IsNil)
+	c.Check(ignored, check.Equals, false)
+	c.Check(wids, check.DeepEquals, []string{"12", "14"})
+}
+
+func (s *compositorTestSuite) TestGnomeShellUnsafeMode(c *check.C) {
+	restore := xdotool.MockShellEval(func(code string) (string, error) {
+		return "", fmt.Errorf("cannot evaluate script: is GNOME Shell in unsafe mode?")
+	})
+	defer restore()
+
+	c.Assert(xdotool.CheckGnomeShell(), check.ErrorMatches, "cannot evaluate script: .*")
+	_, err := xdotool.MakeGnomeShellTool().VisibleWindowIDs()
+	c.Assert(err, check.ErrorMatches, "gnome-shell failed to list windows: cannot evaluate script: .*")
+}
+
+func (s *compositorTestSuite) TestDetectTool(c *check.C) {
+	for _, t := range []struct {
+		swaysock, session, desktop string
+		tool                       string
+	}{
+		{"/run/user/1000/sway-ipc.sock", "wayland", "sway", xdotool.ToolSway},
+		{"", "wayland", "KDE", xdotool.ToolKWin},
+		{"", "x11", "KDE", xdotool.ToolXDoTool},
+		{"", "wayland", "ubuntu:GNOME", xdotool.ToolGnomeShell},
+		{"", "x11", "ubuntu:GNOME", xdotool.ToolXDoTool},
+	} {
+		restore := setenv(map[string]string{
+			"SWAYSOCK":            t.swaysock,
+			"XDG_SESSION_TYPE":    t.session,
+			"XDG_CURRENT_DESKTOP": t.desktop,
+		})
+		c.Check(xdotool.DetectTool(), check.Equals, t.tool, check.Commentf("%+v", t))
+		restore()
+	}
+}
+
+func (s *compositorTestSuite) TestCloseNothingLoaded(c *check.C) {
+	c.Check(xdotool.Close(), check.IsNil)
+}
+
+func setenv(env map[string]string) (restore func()) {
+	old := make(map[string]string)
+	for k, v := range env {
+		old[k] = os.Getenv(k)
+		os.Setenv(k, v)
+	}
+	return func() {
+		for k, v := range old {
+			os.Setenv(k, v)
+		}
+	}
+}
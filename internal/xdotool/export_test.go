@@ -0,0 +1,58 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package xdotool
+
+import (
+	"time"
+)
+
+type WindowInfo = windowInfo
+
+var ParseScriptWindows = parseScriptWindows
+
+func MockShellEval(new func(code string) (string, error)) (restore func()) {
+	old := shellEval
+	shellEval = new
+	return func() {
+		shellEval = old
+	}
+}
+
+func MockMonotonicNow(new func() (time.Duration, error)) (restore func()) {
+	old := monotonicNow
+	monotonicNow = new
+	return func() {
+		monotonicNow = old
+	}
+}
+
+func MockNewWindowPollInterval(new time.Duration) (restore func()) {
+	old := newWindowPollInterval
+	newWindowPollInterval = new
+	return func() {
+		newWindowPollInterval = old
+	}
+}
+
+func MockWatchWindowsInterval(new time.Duration) (restore func()) {
+	old := watchWindowsInterval
+	watchWindowsInterval = new
+	return func() {
+		watchWindowsInterval = old
+	}
+}
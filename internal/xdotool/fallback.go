@@ -0,0 +1,75 @@
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package xdotool
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Closers which can be used to close windows when the tool fails to
+const (
+	// CloserWMCtrl closes windows gracefully with wmctrl
+	CloserWMCtrl = "wmctrl"
+	// CloserXKill forcibly disconnects the client owning the window from the
+	// X server with xkill
+	CloserXKill = "xkill"
+)
+
+var closerArgs = map[string]func(wid string) []string{
+	CloserWMCtrl: func(wid string) []string { return []string{"wmctrl", "-i", "-c", wid} },
+	CloserXKill:  func(wid string) []string { return []string{"xkill", "-id", wid} },
+}
+
+type fallbackCloser struct {
+	Xtooler
+	closers []string
+}
+
+// WithFallbackClosers returns a Xtooler which tries closing windows with each
+// of the closers in turn when the given one fails to close them. The closers
+// work with X11 window IDs.
+func WithFallbackClosers(x Xtooler, closers []string) (Xtooler, error) {
+	for _, name := range closers {
+		if closerArgs[name] == nil {
+			return nil, fmt.Errorf("unknown window closer %q", name)
+		}
+	}
+	if len(closers) == 0 {
+		return x, nil
+	}
+	return &fallbackCloser{Xtooler: x, closers: closers}, nil
+}
+
+func (f *fallbackCloser) CloseWindowID(wid string) error {
+	err := f.Xtooler.CloseWindowID(wid)
+	if err == nil {
+		return nil
+	}
+	errs := []string{err.Error()}
+	for _, name := range f.closers {
+		args := closerArgs[name](wid)
+		out, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, fmt.Sprintf("%s failed to close window ID %s: %v", name, wid, outputErr(out, err)))
+	}
+	return fmt.Errorf("%s", strings.Join(errs, ", "))
+}
@@ -0,0 +1,138 @@
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package xdotool_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/anonymouse64/etrace/internal/xdotool"
+
+	"gopkg.in/check.v1"
+)
+
+type fallbackTestSuite struct {
+	binDir  string
+	oldPath string
+}
+
+var _ = check.Suite(&fallbackTestSuite{})
+
+func (s *fallbackTestSuite) SetUpTest(c *check.C) {
+	s.binDir = c.MkDir()
+	s.oldPath = os.Getenv("PATH")
+	os.Setenv("PATH", s.binDir+":"+s.oldPath)
+}
+
+func (s *fallbackTestSuite) TearDownTest(c *check.C) {
+	os.Setenv("PATH", s.oldPath)
+}
+
+// mockCommand writes a command which logs its arguments and exits with the
+// given status
+func (s *fallbackTestSuite) mockCommand(c *check.C, name string, status int) (log string) {
+	log = filepath.Join(s.binDir, name+".log")
+	script := fmt.Sprintf("#!/bin/sh\necho \"$@\" >> %s\necho %s failed >&2\nexit %d\n", log, name, status)
+	c.Assert(ioutil.WriteFile(filepath.Join(s.binDir, name), []byte(script), 0755), check.IsNil)
+	return log
+}
+
+type failingTool struct {
+	closed []string
+}
+
+func (t *failingTool) WaitForWindow(ctx context.Context, w xdotool.Window) ([]string, error) {
+	return nil, nil
+}
+
+func (t *failingTool) CloseWindowID(wid string) error {
+	t.closed = append(t.closed, wid)
+	return fmt.Errorf("tool failed to close window ID %s", wid)
+}
+
+func (t *failingTool) ActivateWindowID(wid string) error { return nil }
+
+func (t *failingTool) PidForWindowID(wid string) (int, error) { return 0, nil }
+
+func (t *failingTool) VisibleWindowIDs() ([]string, error) { return nil, nil }
+
+func (t *failingTool) WaitForNewWindow(ctx context.Context, existing []string) (string, error) {
+	return "", nil
+}
+
+func (s *fallbackTestSuite) TestNoClosers(c *check.C) {
+	tool := &failingTool{}
+	x, err := xdotool.WithFallbackClosers(tool, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(x, check.Equals, xdotool.Xtooler(tool))
+}
+
+func (s *fallbackTestSuite) TestUnknownCloser(c *check.C) {
+	_, err := xdotool.WithFallbackClosers(&failingTool{}, []string{"wmctrl", "kill"})
+	c.Assert(err, check.ErrorMatches, `unknown window closer "kill"`)
+}
+
+func (s *fallbackTestSuite) TestFallback(c *check.C) {
+	wmctrlLog := s.mockCommand(c, "wmctrl", 1)
+	xkillLog := s.mockCommand(c, "xkill", 0)
+
+	tool := &failingTool{}
+	x, err := xdotool.WithFallbackClosers(tool, []string{"wmctrl", "xkill"})
+	c.Assert(err, check.IsNil)
+	c.Assert(x.CloseWindowID("1234"), check.IsNil)
+	c.Assert(tool.closed, check.DeepEquals, []string{"1234"})
+
+	out, err := ioutil.ReadFile(wmctrlLog)
+	c.Assert(err, check.IsNil)
+	c.Check(string(out), check.Equals, "-i -c 1234\n")
+	out, err = ioutil.ReadFile(xkillLog)
+	c.Assert(err, check.IsNil)
+	c.Check(string(out), check.Equals, "-id 1234\n")
+}
+
+func (s *fallbackTestSuite) TestFallbackAllFail(c *check.C) {
+	s.mockCommand(c, "wmctrl", 1)
+	s.mockCommand(c, "xkill", 1)
+
+	x, err := xdotool.WithFallbackClosers(&failingTool{}, []string{"wmctrl", "xkill"})
+	c.Assert(err, check.IsNil)
+	err = x.CloseWindowID("1234")
+	c.Assert(err, check.ErrorMatches, "tool failed to close window ID 1234, wmctrl failed to close window ID 1234: wmctrl failed, xkill failed to close window ID 1234: xkill failed")
+}
+
+func (s *fallbackTestSuite) TestPressShift(c *check.C) {
+	xdotoolLog := s.mockCommand(c, "xdotool", 0)
+	ydotoolLog := s.mockCommand(c, "ydotool", 0)
+
+	c.Assert(xdotool.PressShift("xdotool"), check.IsNil)
+	c.Assert(xdotool.PressShift("ydotool"), check.IsNil)
+	// the key press isn't sent to a window, as that makes it synthetic
+	out, err := ioutil.ReadFile(xdotoolLog)
+	c.Assert(err, check.IsNil)
+	c.Check(string(out), check.Equals, "key shift\n")
+	out, err = ioutil.ReadFile(ydotoolLog)
+	c.Assert(err, check.IsNil)
+	c.Check(string(out), check.Equals, "key 42:1 42:0\n")
+
+	c.Assert(xdotool.PressShift("wtype"), check.ErrorMatches, `unknown input tool "wtype"`)
+	s.mockCommand(c, "ydotool", 1)
+	c.Assert(xdotool.PressShift("ydotool"), check.ErrorMatches, "ydotool failed to press shift: ydotool failed")
+}
@@ -0,0 +1,104 @@
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package xdotool
+
+import (
+	"fmt"
+)
+
+// gnomeShellListScript returns all the windows managed by GNOME Shell, on
+// Wayland the class is the app ID
+const gnomeShellListScript = `(function() {
+	let workspace = global.workspace_manager.get_active_workspace();
+	return global.get_window_actors().map(actor => actor.meta_window).filter(win => !win.is_override_redirect()).map(win => ({
+		id: String(win.get_id()),
+		pid: win.get_pid(),
+		class: win.get_wm_class() || '',
+		classname: win.get_wm_class_instance() || '',
+		name: win.get_title() || '',
+		visible: !win.minimized && !win.is_hidden(),
+		active: win.is_on_all_workspaces() || win.get_workspace() == workspace
+	}));
+})()`
+
+// gnomeShellCloseScript closes the window with the ID and returns whether it
+// found it, the placeholder is the ID of the window
+const gnomeShellCloseScript = `(function() {
+	let actor = global.get_window_actors().find(actor => String(actor.meta_window.get_id()) == %q);
+	if (!actor)
+		return false;
+	actor.meta_window.delete(global.get_current_time());
+	return true;
+})()`
+
+// gnomeShellActivateScript activates the window with the ID and returns
+// whether it found it, the placeholder is the ID of the window
+const gnomeShellActivateScript = `(function() {
+	let actor = global.get_window_actors().find(actor => String(actor.meta_window.get_id()) == %q);
+	if (!actor)
+		return false;
+	Main.activateWindow(actor.meta_window);
+	return true;
+})()`
+
+// MakeGnomeShellTool returns a Xtooler that interacts with the windows of
+// GNOME Shell through its Eval D-Bus method, which works on both X11 and
+// Wayland but needs GNOME Shell to be in unsafe mode since GNOME 41.
+func MakeGnomeShellTool() Xtooler {
+	return &compositor{name: "gnome-shell", list: gnomeShellWindows, close: gnomeShellClose, activate: gnomeShellActivate}
+}
+
+// CheckGnomeShell checks that the code of etrace can be evaluated in GNOME
+// Shell.
+func CheckGnomeShell() error {
+	_, err := shellEval("true")
+	return err
+}
+
+func gnomeShellWindows() ([]windowInfo, error) {
+	out, err := shellEval(gnomeShellListScript)
+	if err != nil {
+		return nil, fmt.Errorf("gnome-shell failed to list windows: %v", err)
+	}
+	windows, err := parseScriptWindows(out)
+	if err != nil {
+		return nil, fmt.Errorf("gnome-shell failed to list windows: %v", err)
+	}
+	return windows, nil
+}
+
+func gnomeShellClose(wid string) error {
+	return gnomeShellWindowScript(gnomeShellCloseScript, wid)
+}
+
+func gnomeShellActivate(wid string) error {
+	return gnomeShellWindowScript(gnomeShellActivateScript, wid)
+}
+
+// gnomeShellWindowScript evaluates the script with the window ID, which returns
+// whether it found the window.
+func gnomeShellWindowScript(script, wid string) error {
+	out, err := shellEval(fmt.Sprintf(script, wid))
+	if err != nil {
+		return err
+	}
+	if out != "true" {
+		return fmt.Errorf("no such window")
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+package xdotool
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// Tools which can send input to programs
+const (
+	// InputXDoTool presses keys through the XTEST extension with xdotool,
+	// which only works on X11
+	InputXDoTool = "xdotool"
+	// InputYDoTool presses keys through uinput with ydotool, which works on
+	// Wayland too but needs ydotoold to be running
+	InputYDoTool = "ydotool"
+)
+
+// keyLeftShift is the code of the left Shift key for ydotool, see
+// linux/input-event-codes.h
+const keyLeftShift = "42"
+
+// PressShift presses and releases Shift like a real keyboard would, so the key
+// press goes to the focused window, which handles it without doing anything.
+// Key presses sent to a given window with xdotool key --window are synthetic
+// events which toolkits like GTK and Qt ignore, so the window needs to be
+// activated first instead.
+func PressShift(tool string) error {
+	var args []string
+	switch tool {
+	case InputXDoTool:
+		args = []string{"xdotool", "key", "shift"}
+	case InputYDoTool:
+		args = []string{"ydotool", "key", keyLeftShift + ":1", keyLeftShift + ":0"}
+	default:
+		return fmt.Errorf("unknown input tool %q", tool)
+	}
+	out, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s failed to press shift: %v", tool, outputErr(out, err))
+	}
+	return nil
+}
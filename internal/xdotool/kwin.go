@@ -0,0 +1,380 @@
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package xdotool
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/godbus/dbus"
+)
+
+const (
+	kwinService     = "org.kde.KWin"
+	kwinScripting   = "org.kde.kwin.Scripting"
+	kwinScript      = "org.kde.kwin.Script"
+	kwinResultPath  = "/io/github/anonymouse64/etrace"
+	kwinResultIface = "io.github.anonymouse64.etrace.KWin"
+)
+
+// kwinScriptTimeout is how long to wait for a KWin script to report back
+var kwinScriptTimeout = 5 * time.Second
+
+// kwinWatchScript reports all the windows managed by KWin back to etrace when
+// it is loaded and again whenever they change, so that listing the windows
+// doesn't need to run a script each time. It stops once etrace is gone from
+// the bus. The placeholders are the D-Bus service, path and interface to
+// report to.
+const kwinWatchScript = `var service = %q, path = %q, iface = %q;
+// clientList was renamed to windowList in KWin 6, along with the signals
+var kwin6 = workspace.windowList !== undefined;
+var handlers = [];
+function connect(signal, handler) {
+	signal.connect(handler);
+	handlers.push({signal: signal, handler: handler});
+}
+function report(removed) {
+	var clients = kwin6 ? workspace.windowList() : workspace.clientList();
+	var windows = [];
+	for (var i = 0; i < clients.length; i++) {
+		var c = clients[i];
+		if (c === removed)
+			continue;
+		windows.push({
+			id: c.internalId.toString(),
+			pid: c.pid,
+			class: String(c.resourceClass),
+			classname: String(c.resourceName),
+			name: String(c.caption),
+			visible: !c.minimized,
+			// desktops replaced desktop in KWin 6
+			active: c.onAllDesktops || (c.desktops ? c.desktops.indexOf(workspace.currentDesktop) >= 0 : c.desktop == workspace.currentDesktop)
+		});
+	}
+	callDBus(service, path, iface, "Windows", JSON.stringify(windows));
+}
+function changed(removed) {
+	callDBus("org.freedesktop.DBus", "/org/freedesktop/DBus", "org.freedesktop.DBus", "NameHasOwner", service, function(owned) {
+		if (owned) {
+			report(removed);
+			return;
+		}
+		for (var i = 0; i < handlers.length; i++) {
+			try {
+				handlers[i].signal.disconnect(handlers[i].handler);
+			} catch (e) {
+				// the window is gone already
+			}
+		}
+		handlers = [];
+	});
+}
+function watch(c) {
+	connect(c.minimizedChanged, function() { changed(null); });
+	connect(c.captionChanged, function() { changed(null); });
+	connect(kwin6 ? c.desktopsChanged : c.desktopChanged, function() { changed(null); });
+}
+var clients = kwin6 ? workspace.windowList() : workspace.clientList();
+for (var i = 0; i < clients.length; i++)
+	watch(clients[i]);
+connect(kwin6 ? workspace.windowAdded : workspace.clientAdded, function(c) {
+	watch(c);
+	changed(null);
+});
+connect(kwin6 ? workspace.windowRemoved : workspace.clientRemoved, function(c) { changed(c); });
+connect(workspace.currentDesktopChanged, function() { changed(null); });
+report(null);
+`
+
+// kwinCloseScript closes the window with the ID and reports back whether it
+// was found, the placeholders are the ID and then the D-Bus service, path,
+// interface and the token of the script to report back with
+const kwinCloseScript = `// clientList was renamed to windowList in KWin 6
+var clients = workspace.windowList ? workspace.windowList() : workspace.clientList();
+var found = false;
+for (var i = 0; i < clients.length; i++) {
+	if (clients[i].internalId.toString() == %q) {
+		clients[i].closeWindow();
+		found = true;
+	}
+}
+callDBus(%q, %q, %q, "Result", %q, JSON.stringify(found));
+`
+
+// kwinActivateScript activates the window with the ID and reports back whether
+// it was found, the placeholders are the same as for kwinCloseScript
+const kwinActivateScript = `// clientList and activeClient were renamed to windowList and activeWindow in
+// KWin 6
+var kwin6 = workspace.windowList !== undefined;
+var clients = kwin6 ? workspace.windowList() : workspace.clientList();
+var found = false;
+for (var i = 0; i < clients.length; i++) {
+	if (clients[i].internalId.toString() == %q) {
+		if (kwin6)
+			workspace.activeWindow = clients[i];
+		else
+			workspace.activeClient = clients[i];
+		found = true;
+	}
+}
+callDBus(%q, %q, %q, "Result", %q, JSON.stringify(found));
+`
+
+type kwin struct {
+	watchMu sync.Mutex
+	// watching is whether the watch script was loaded, or failed to be
+	watching bool
+	// watchErr is the error loading the watch script
+	watchErr error
+	// watchPlugin is the name the watch script was loaded under
+	watchPlugin string
+	conn        *dbus.Conn
+	reported    chan struct{}
+	results     chan kwinScriptResult
+
+	mu sync.Mutex
+	// windows is the last list of windows reported by the watch script
+	windows []windowInfo
+	scripts int
+}
+
+// kwinScriptResult is what a script reported back, with the token telling
+// which script it is
+type kwinScriptResult struct {
+	token string
+	out   string
+}
+
+// kwinWatcher is shared by all the KWin tools, so that only one watch script
+// is loaded into KWin
+var kwinWatcher = &kwin{}
+
+// Close unloads what the tools loaded into the compositor to follow its
+// windows, the tools load it again if they are used after.
+func Close() error {
+	return kwinWatcher.close()
+}
+
+// MakeKWinTool returns a Xtooler that interacts with the windows of KWin
+// through its scripting D-Bus API, which works on both X11 and Wayland.
+func MakeKWinTool() Xtooler {
+	k := kwinWatcher
+	return &compositor{name: "kwin", list: k.listWindows, close: k.closeWindow, activate: k.activateWindow, ready: k.waitReported}
+}
+
+// kwinReceiver receives what the scripts report back over D-Bus
+type kwinReceiver struct {
+	k *kwin
+}
+
+func (r kwinReceiver) Windows(out string) *dbus.Error {
+	windows, err := parseScriptWindows(out)
+	if err != nil {
+		return dbus.MakeFailedError(err)
+	}
+	r.k.mu.Lock()
+	defer r.k.mu.Unlock()
+	if r.k.windows == nil {
+		close(r.k.reported)
+	}
+	if windows == nil {
+		windows = []windowInfo{}
+	}
+	r.k.windows = windows
+	return nil
+}
+
+func (r kwinReceiver) Result(token, out string) *dbus.Error {
+	select {
+	case r.k.results <- kwinScriptResult{token: token, out: out}:
+	default:
+		// nothing is waiting for this result anymore
+	}
+	return nil
+}
+
+// connect connects to the session bus and loads the watch script the first
+// time it is called, or the first time after close.
+func (k *kwin) connect() error {
+	k.watchMu.Lock()
+	defer k.watchMu.Unlock()
+	if !k.watching {
+		k.watchErr = k.watch()
+		k.watching = true
+	}
+	return k.watchErr
+}
+
+// close unloads the watch script from KWin, it stops reporting the windows
+// otherwise only once etrace is gone from the bus.
+func (k *kwin) close() error {
+	k.watchMu.Lock()
+	defer k.watchMu.Unlock()
+	if !k.watching || k.watchErr != nil {
+		k.watching = false
+		return nil
+	}
+	k.watching = false
+	err := k.conn.Object(kwinService, "/Scripting").Call(kwinScripting+".unloadScript", 0, k.watchPlugin).Err
+	k.conn.Export(nil, kwinResultPath, kwinResultIface)
+	k.mu.Lock()
+	k.windows = nil
+	k.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("cannot unload script: %v", err)
+	}
+	return nil
+}
+
+func (k *kwin) watch() error {
+	conn, err := dbus.SessionBus()
+	if err != nil {
+		return fmt.Errorf("cannot connect to the session bus: %v", err)
+	}
+	k.results = make(chan kwinScriptResult, 1)
+	k.mu.Lock()
+	k.reported = make(chan struct{})
+	k.mu.Unlock()
+	if err := conn.Export(kwinReceiver{k}, kwinResultPath, kwinResultIface); err != nil {
+		return err
+	}
+	k.conn = conn
+	k.watchPlugin = fmt.Sprintf("etrace-%d-watch", os.Getpid())
+	if err := k.load(k.watchPlugin, kwinWatchScript, conn.Names()[0], kwinResultPath, kwinResultIface); err != nil {
+		conn.Export(nil, kwinResultPath, kwinResultIface)
+		return fmt.Errorf("cannot watch windows: %v", err)
+	}
+	return nil
+}
+
+// load loads a script into KWin under the plugin name and runs it. The script
+// is formatted with the arguments.
+func (k *kwin) load(plugin, script string, args ...interface{}) error {
+	f, err := ioutil.TempFile("", "etrace-kwin-*.js")
+	if err != nil {
+		return err
+	}
+	// KWin reads the script when it is loaded
+	defer os.Remove(f.Name())
+	if _, err := fmt.Fprintf(f, script, args...); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	scripting := k.conn.Object(kwinService, "/Scripting")
+	var id int32
+	if err := scripting.Call(kwinScripting+".loadScript", 0, f.Name(), plugin).Store(&id); err != nil {
+		return fmt.Errorf("cannot load script: %v", err)
+	}
+	// the path of loaded scripts changed in KWin 5.21
+	err = k.conn.Object(kwinService, dbus.ObjectPath(fmt.Sprintf("/Scripting/Script%d", id))).Call(kwinScript+".run", 0).Err
+	if err != nil {
+		err = k.conn.Object(kwinService, dbus.ObjectPath(fmt.Sprintf("/%d", id))).Call(kwinScript+".run", 0).Err
+	}
+	if err != nil {
+		scripting.Call(kwinScripting+".unloadScript", 0, plugin)
+		return fmt.Errorf("cannot run script: %v", err)
+	}
+	return nil
+}
+
+// run runs a script in KWin once and returns what it reported back. The
+// script is formatted with the D-Bus service, path and interface and the token
+// to report back with after any other arguments.
+func (k *kwin) run(script string, args ...interface{}) (string, error) {
+	if err := k.connect(); err != nil {
+		return "", err
+	}
+	k.mu.Lock()
+	k.scripts++
+	plugin := fmt.Sprintf("etrace-%d-%d", os.Getpid(), k.scripts)
+	k.mu.Unlock()
+
+	args = append(args, k.conn.Names()[0], kwinResultPath, kwinResultIface, plugin)
+	if err := k.load(plugin, script, args...); err != nil {
+		return "", err
+	}
+	defer k.conn.Object(kwinService, "/Scripting").Call(kwinScripting+".unloadScript", 0, plugin)
+
+	timeout := time.After(kwinScriptTimeout)
+	for {
+		select {
+		case res := <-k.results:
+			// drop the stale result of a script which timed out
+			if res.token == plugin {
+				return res.out, nil
+			}
+		case <-timeout:
+			return "", fmt.Errorf("timed out waiting for script")
+		}
+	}
+}
+
+// waitReported waits until the watch script first reported the windows.
+func (k *kwin) waitReported(ctx context.Context) error {
+	if err := k.connect(); err != nil {
+		return fmt.Errorf("kwin failed to list windows: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, kwinScriptTimeout)
+	defer cancel()
+	select {
+	case <-k.reported:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("kwin failed to list windows: timed out waiting for script: %w", ctx.Err())
+	}
+}
+
+// listWindows returns the windows last reported by the watch script.
+func (k *kwin) listWindows() ([]windowInfo, error) {
+	if err := k.waitReported(context.Background()); err != nil {
+		return nil, err
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return append([]windowInfo(nil), k.windows...), nil
+}
+
+func (k *kwin) closeWindow(wid string) error {
+	out, err := k.run(kwinCloseScript, wid)
+	if err != nil {
+		return err
+	}
+	if out != "true" {
+		return fmt.Errorf("no such window")
+	}
+	return nil
+}
+
+func (k *kwin) activateWindow(wid string) error {
+	out, err := k.run(kwinActivateScript, wid)
+	if err != nil {
+		return err
+	}
+	if out != "true" {
+		return fmt.Errorf("no such window")
+	}
+	return nil
+}
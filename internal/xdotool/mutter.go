@@ -0,0 +1,218 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package xdotool
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/godbus/dbus"
+)
+
+const (
+	shellService = "org.gnome.Shell"
+	shellPath    = "/org/gnome/Shell"
+	shellIface   = "org.gnome.Shell"
+)
+
+// mutterWatchScript records when the first frame of each new window was
+// presented in a global of GNOME Shell, the placeholder is the name of the
+// global
+const mutterWatchScript = `(function() {
+	const GLib = imports.gi.GLib;
+	let state = {frames: []};
+	state.handler = global.display.connect('window-created', (display, win) => {
+		let actor = win.get_compositor_private();
+		if (!actor)
+			return;
+		let id = actor.connect('first-frame', () => {
+			actor.disconnect(id);
+			state.frames.push({
+				id: String(win.get_id()),
+				pid: win.get_pid(),
+				class: win.get_wm_class() || '',
+				classname: win.get_wm_class_instance() || '',
+				name: win.get_title() || '',
+				time: GLib.get_monotonic_time()
+			});
+		});
+	});
+	global[%q] = state;
+	return true;
+})()`
+
+// mutterFramesScript returns the frames recorded so far, the placeholder is
+// the name of the global
+const mutterFramesScript = `(function() {
+	let state = global[%q];
+	return state ? state.frames : [];
+})()`
+
+// mutterStopScript stops recording, the placeholder is the name of the global
+const mutterStopScript = `(function() {
+	let state = global[%[1]q];
+	if (state)
+		global.display.disconnect(state.handler);
+	delete global[%[1]q];
+	return true;
+})()`
+
+// shellEval evaluates the JavaScript code in GNOME Shell and returns the
+// result as JSON, which needs GNOME Shell to be in unsafe mode since GNOME 41
+var shellEval = func(code string) (string, error) {
+	conn, err := dbus.SessionBus()
+	if err != nil {
+		return "", fmt.Errorf("cannot connect to the session bus: %v", err)
+	}
+	var ok bool
+	var out string
+	if err := conn.Object(shellService, shellPath).Call(shellIface+".Eval", 0, code).Store(&ok, &out); err != nil {
+		return "", err
+	}
+	if !ok {
+		if out == "" {
+			out = "is GNOME Shell in unsafe mode?"
+		}
+		return "", fmt.Errorf("cannot evaluate script: %s", out)
+	}
+	return out, nil
+}
+
+// monotonicNow returns the current time of CLOCK_MONOTONIC, which is the clock
+// of GLib.get_monotonic_time.
+var monotonicNow = func() (time.Duration, error) {
+	var ts syscall.Timespec
+	const clockMonotonic = 1
+	if _, _, errno := syscall.Syscall(syscall.SYS_CLOCK_GETTIME, clockMonotonic, uintptr(unsafe.Pointer(&ts)), 0); errno != 0 {
+		return 0, errno
+	}
+	return time.Duration(ts.Nano()), nil
+}
+
+// Frame is the first frame of a window presented by the compositor
+type Frame struct {
+	// ID is the ID of the window in the compositor, which is not the same as
+	// the ID of the window for the window tool
+	ID        string
+	Pid       int
+	Class     string
+	ClassName string
+	Name      string
+	Time      time.Time
+}
+
+// FrameWatcher records when Mutter presented the first frame of each new
+// window, which is more precise than when the window became visible.
+type FrameWatcher struct {
+	global string
+	// offset converts monotonic frame timestamps to the wall clock
+	offset time.Time
+}
+
+// WatchFirstFrames starts recording the first frames of the new windows in
+// GNOME Shell through its Eval D-Bus method.
+func WatchFirstFrames() (*FrameWatcher, error) {
+	mono, err := monotonicNow()
+	if err != nil {
+		return nil, err
+	}
+	f := &FrameWatcher{
+		global: fmt.Sprintf("_etraceFirstFrames%d", os.Getpid()),
+		offset: time.Now().Add(-mono),
+	}
+	if _, err := shellEval(fmt.Sprintf(mutterWatchScript, f.global)); err != nil {
+		return nil, fmt.Errorf("cannot watch first frames in GNOME Shell: %v", err)
+	}
+	return f, nil
+}
+
+// Frames returns the first frames of the windows created since
+// WatchFirstFrames, in the order they were presented.
+func (f *FrameWatcher) Frames() ([]Frame, error) {
+	out, err := shellEval(fmt.Sprintf(mutterFramesScript, f.global))
+	if err != nil {
+		return nil, fmt.Errorf("cannot get first frames from GNOME Shell: %v", err)
+	}
+	var recorded []struct {
+		ID        string `json:"id"`
+		Pid       int    `json:"pid"`
+		Class     string `json:"class"`
+		ClassName string `json:"classname"`
+		Name      string `json:"name"`
+		// Time is in microseconds of CLOCK_MONOTONIC
+		Time int64 `json:"time"`
+	}
+	if err := json.Unmarshal([]byte(out), &recorded); err != nil {
+		return nil, fmt.Errorf("cannot get first frames from GNOME Shell: %v", err)
+	}
+	frames := make([]Frame, len(recorded))
+	for i, r := range recorded {
+		frames[i] = Frame{
+			ID:        r.ID,
+			Pid:       r.Pid,
+			Class:     r.Class,
+			ClassName: r.ClassName,
+			Name:      r.Name,
+			Time:      f.offset.Add(time.Duration(r.Time) * time.Microsecond),
+		}
+	}
+	return frames, nil
+}
+
+// WaitFirstFrame waits until the first frame of a window matching the
+// specification was presented, which is often after the window became visible
+// as the program still has to draw it. The window IDs to exclude in the
+// specification are ignored as they are not the IDs of the compositor.
+func (f *FrameWatcher) WaitFirstFrame(ctx context.Context, w Window) (Frame, error) {
+	w.Exclude = nil
+	w.ActiveWorkspace = false
+	match, err := w.matcher()
+	if err != nil {
+		return Frame{}, err
+	}
+	for {
+		frames, err := f.Frames()
+		if err != nil {
+			return Frame{}, err
+		}
+		for _, frame := range frames {
+			info := windowInfo{ID: frame.ID, Pid: frame.Pid, Class: frame.Class, ClassName: frame.ClassName, Name: frame.Name}
+			if match(info) {
+				return frame, nil
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return Frame{}, ctx.Err()
+		case <-time.After(newWindowPollInterval):
+		}
+	}
+}
+
+// Stop stops recording the first frames.
+func (f *FrameWatcher) Stop() error {
+	if _, err := shellEval(fmt.Sprintf(mutterStopScript, f.global)); err != nil {
+		return fmt.Errorf("cannot stop watching first frames in GNOME Shell: %v", err)
+	}
+	return nil
+}
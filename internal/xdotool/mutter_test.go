@@ -0,0 +1,115 @@
+/*
+ * Copyright (C) 2019-2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package xdotool_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/anonymouse64/etrace/internal/xdotool"
+
+	"gopkg.in/check.v1"
+)
+
+type mutterTestSuite struct{}
+
+var _ = check.Suite(&mutterTestSuite{})
+
+func (s *mutterTestSuite) TestFirstFrames(c *check.C) {
+	restore := xdotool.MockMonotonicNow(func() (time.Duration, error) {
+		return 10 * time.Second, nil
+	})
+	defer restore()
+	restore = xdotool.MockNewWindowPollInterval(time.Millisecond)
+	defer restore()
+	var scripts []string
+	restore = xdotool.MockShellEval(func(code string) (string, error) {
+		scripts = append(scripts, code)
+		switch len(scripts) {
+		case 1:
+			return "true", nil
+		case 2:
+			// the main window is visible but not drawn yet
+			return `[{"id":"7","pid":42,"class":"Splash","classname":"splash","name":"Loading","time":10500000}]`, nil
+		default:
+			return `[{"id":"7","pid":42,"class":"Splash","classname":"splash","name":"Loading","time":10500000},` +
+				`{"id":"8","pid":42,"class":"Gedit","classname":"gedit","name":"Untitled","time":11250000}]`, nil
+		}
+	})
+	defer restore()
+
+	before := time.Now()
+	watcher, err := xdotool.WatchFirstFrames()
+	c.Assert(err, check.IsNil)
+	after := time.Now()
+	frame, err := watcher.WaitFirstFrame(context.Background(), xdotool.Window{Class: "Gedit", Exclude: []string{"8"}})
+	c.Assert(err, check.IsNil)
+	c.Check(frame.ID, check.Equals, "8")
+	c.Check(frame.Pid, check.Equals, 42)
+	c.Check(frame.Class, check.Equals, "Gedit")
+	c.Check(frame.ClassName, check.Equals, "gedit")
+	c.Check(frame.Name, check.Equals, "Untitled")
+	// the monotonic timestamps are relative to when watching started
+	c.Check(frame.Time.Before(before.Add(1250*time.Millisecond)), check.Equals, false)
+	c.Check(frame.Time.After(after.Add(1250*time.Millisecond)), check.Equals, false)
+
+	frames, err := watcher.Frames()
+	c.Assert(err, check.IsNil)
+	c.Assert(frames, check.HasLen, 2)
+	c.Check(frames[1].Time.Sub(frames[0].Time), check.Equals, 750*time.Millisecond)
+
+	c.Assert(watcher.Stop(), check.IsNil)
+
+	global := fmt.Sprintf("_etraceFirstFrames%d", os.Getpid())
+	c.Assert(scripts, check.HasLen, 5)
+	c.Check(strings.Contains(scripts[0], "'first-frame'"), check.Equals, true)
+	c.Check(strings.Contains(scripts[0], fmt.Sprintf("global[%q] = state", global)), check.Equals, true)
+	c.Check(strings.Contains(scripts[4], fmt.Sprintf("delete global[%q]", global)), check.Equals, true)
+}
+
+func (s *mutterTestSuite) TestWaitFirstFrameTimeout(c *check.C) {
+	restore := xdotool.MockNewWindowPollInterval(time.Millisecond)
+	defer restore()
+	restore = xdotool.MockShellEval(func(code string) (string, error) {
+		if strings.Contains(code, "'first-frame'") {
+			return "true", nil
+		}
+		return `[{"id":"7","pid":42,"class":"Splash","classname":"splash","name":"Loading","time":10500000}]`, nil
+	})
+	defer restore()
+
+	watcher, err := xdotool.WatchFirstFrames()
+	c.Assert(err, check.IsNil)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = watcher.WaitFirstFrame(ctx, xdotool.Window{Name: "^Preferences$"})
+	c.Check(err, check.Equals, context.DeadlineExceeded)
+}
+
+func (s *mutterTestSuite) TestWatchFirstFramesError(c *check.C) {
+	restore := xdotool.MockShellEval(func(code string) (string, error) {
+		return "", fmt.Errorf("cannot evaluate script: is GNOME Shell in unsafe mode?")
+	})
+	defer restore()
+
+	_, err := xdotool.WatchFirstFrames()
+	c.Check(err, check.ErrorMatches, `cannot watch first frames in GNOME Shell: cannot evaluate script: is GNOME Shell in unsafe mode\?`)
+}
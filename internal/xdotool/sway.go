@@ -0,0 +1,195 @@
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package xdotool
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// the i3 IPC protocol used by sway, see sway-ipc(7)
+const (
+	swayIPCMagic   = "i3-ipc"
+	swayRunCommand = 0
+	swayGetTree    = 4
+)
+
+type sway struct {
+	socket string
+}
+
+// MakeSwayTool returns a Xtooler that interacts with the windows of Sway, or
+// another compositor implementing its IPC protocol, on the given socket.
+func MakeSwayTool(socket string) Xtooler {
+	s := &sway{socket: socket}
+	return &compositor{name: "sway", list: s.windows, close: s.kill, activate: s.focus}
+}
+
+// request sends a message to sway and decodes the JSON reply.
+func (s *sway) request(msgType uint32, payload string, reply interface{}) error {
+	conn, err := net.Dial("unix", s.socket)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// sway uses the native byte order, which is little endian on all the
+	// architectures it is used on
+	msg := make([]byte, len(swayIPCMagic)+8+len(payload))
+	copy(msg, swayIPCMagic)
+	binary.LittleEndian.PutUint32(msg[len(swayIPCMagic):], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(msg[len(swayIPCMagic)+4:], msgType)
+	copy(msg[len(swayIPCMagic)+8:], payload)
+	if _, err := conn.Write(msg); err != nil {
+		return err
+	}
+
+	header := make([]byte, len(swayIPCMagic)+8)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return fmt.Errorf("cannot read reply: %v", err)
+	}
+	if string(header[:len(swayIPCMagic)]) != swayIPCMagic {
+		return fmt.Errorf("invalid reply magic %q", header[:len(swayIPCMagic)])
+	}
+	if t := binary.LittleEndian.Uint32(header[len(swayIPCMagic)+4:]); t != msgType {
+		return fmt.Errorf("unexpected reply type %d", t)
+	}
+	body := make([]byte, binary.LittleEndian.Uint32(header[len(swayIPCMagic):]))
+	if _, err := io.ReadFull(conn, body); err != nil {
+		return fmt.Errorf("cannot read reply: %v", err)
+	}
+	return json.Unmarshal(body, reply)
+}
+
+// swayNode is a node of the sway layout tree, only views have a pid
+type swayNode struct {
+	ID      int64   `json:"id"`
+	Type    string  `json:"type"`
+	Name    string  `json:"name"`
+	Pid     int     `json:"pid"`
+	AppID   *string `json:"app_id"`
+	Visible bool    `json:"visible"`
+	// WindowProperties is only set for Xwayland windows
+	WindowProperties *struct {
+		Class    string `json:"class"`
+		Instance string `json:"instance"`
+	} `json:"window_properties"`
+	// Focus is the IDs of the children in the order they were focused
+	Focus         []int64    `json:"focus"`
+	Nodes         []swayNode `json:"nodes"`
+	FloatingNodes []swayNode `json:"floating_nodes"`
+}
+
+// focusedWorkspace returns the ID of the focused workspace, which is found by
+// following the most recently focused children from the root.
+func (n *swayNode) focusedWorkspace() int64 {
+	for n.Type != "workspace" {
+		if len(n.Focus) == 0 {
+			return -1
+		}
+		var next *swayNode
+		for i := range n.Nodes {
+			if n.Nodes[i].ID == n.Focus[0] {
+				next = &n.Nodes[i]
+			}
+		}
+		if next == nil {
+			return -1
+		}
+		n = next
+	}
+	return n.ID
+}
+
+func (n *swayNode) views(windows []windowInfo, workspace, active int64) []windowInfo {
+	if n.Type == "workspace" {
+		workspace = n.ID
+	}
+	if n.Pid != 0 {
+		info := windowInfo{
+			ID:              strconv.FormatInt(n.ID, 10),
+			Pid:             n.Pid,
+			Name:            n.Name,
+			Visible:         n.Visible,
+			ActiveWorkspace: workspace != -1 && workspace == active,
+		}
+		switch {
+		case n.WindowProperties != nil:
+			info.Class = n.WindowProperties.Class
+			info.ClassName = n.WindowProperties.Instance
+		case n.AppID != nil:
+			// native wayland windows only have an app id
+			info.Class = *n.AppID
+			info.ClassName = *n.AppID
+		}
+		windows = append(windows, info)
+	}
+	for i := range n.Nodes {
+		windows = n.Nodes[i].views(windows, workspace, active)
+	}
+	for i := range n.FloatingNodes {
+		windows = n.FloatingNodes[i].views(windows, workspace, active)
+	}
+	return windows
+}
+
+func (s *sway) windows() ([]windowInfo, error) {
+	var tree swayNode
+	if err := s.request(swayGetTree, "", &tree); err != nil {
+		return nil, fmt.Errorf("sway failed to list windows: %v", err)
+	}
+	return tree.views(nil, -1, tree.focusedWorkspace()), nil
+}
+
+func (s *sway) kill(wid string) error {
+	return s.command(wid, "kill")
+}
+
+func (s *sway) focus(wid string) error {
+	return s.command(wid, "focus")
+}
+
+// command runs the command on the view with the given ID.
+func (s *sway) command(wid, command string) error {
+	// don't let the window ID inject other commands
+	if _, err := strconv.ParseInt(wid, 10, 64); err != nil {
+		return fmt.Errorf("invalid window ID")
+	}
+	var results []struct {
+		Success bool   `json:"success"`
+		Error   string `json:"error"`
+	}
+	if err := s.request(swayRunCommand, fmt.Sprintf("[con_id=%s] %s", wid, command), &results); err != nil {
+		return err
+	}
+	var errs []string
+	for _, res := range results {
+		if !res.Success {
+			errs = append(errs, res.Error)
+		}
+	}
+	if len(errs) != 0 {
+		return fmt.Errorf("%s", strings.Join(errs, ", "))
+	}
+	return nil
+}
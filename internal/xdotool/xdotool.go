@@ -26,6 +26,7 @@ import (
 	"os/exec"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type xdotool struct{}
@@ -35,36 +36,80 @@ type Window struct {
 	Class     string
 	ClassName string
 	Name      string
+	// ActiveWorkspace restricts matching to windows on the active workspace
+	ActiveWorkspace bool
+	// Exclude is the IDs of windows which are never matched, such as windows
+	// which existed before the program was started
+	Exclude []string
 }
 
-func (w Window) windowSpecErrDescription() string {
-	if w.Class != "" {
-		return fmt.Sprintf("class %s", w.Class)
-	} else if w.Name != "" {
-		return fmt.Sprintf("name %s", w.Name)
-	} else if w.ClassName != "" {
-		return fmt.Sprintf("class name %s", w.ClassName)
-	} else {
-		return "no specification"
+// filter returns the window IDs which are not excluded.
+func (w Window) filter(wids []string) []string {
+	var filtered []string
+	for _, wid := range wids {
+		if !w.excluded(wid) {
+			filtered = append(filtered, wid)
+		}
+	}
+	return filtered
+}
+
+func (w Window) excluded(wid string) bool {
+	for _, ex := range w.Exclude {
+		if wid == ex {
+			return true
+		}
 	}
+	return false
+}
+
+// windowAttr is an attribute of windows set in a window specification
+type windowAttr struct {
+	// desc describes the attribute in errors
+	desc string
+	// option is the option of xdotool search matching the attribute
+	option  string
+	pattern string
+	field   func(info windowInfo) string
 }
 
-func (w Window) searchArgs() []string {
+// attrs returns the attributes set in the specification, which a window must
+// all match.
+func (w Window) attrs() []windowAttr {
+	var attrs []windowAttr
 	if w.Class != "" {
-		return []string{"--class", w.Class}
-	} else if w.Name != "" {
-		return []string{"--name", w.Name}
-	} else if w.ClassName != "" {
-		return []string{"--classname", w.ClassName}
+		attrs = append(attrs, windowAttr{"class", "--class", w.Class, func(info windowInfo) string { return info.Class }})
 	}
-	return nil
+	if w.Name != "" {
+		attrs = append(attrs, windowAttr{"name", "--name", w.Name, func(info windowInfo) string { return info.Name }})
+	}
+	if w.ClassName != "" {
+		attrs = append(attrs, windowAttr{"class name", "--classname", w.ClassName, func(info windowInfo) string { return info.ClassName }})
+	}
+	return attrs
+}
+
+func (w Window) windowSpecErrDescription() string {
+	attrs := w.attrs()
+	if len(attrs) == 0 {
+		return "no specification"
+	}
+	descs := make([]string, len(attrs))
+	for i, attr := range attrs {
+		descs[i] = fmt.Sprintf("%s %s", attr.desc, attr.pattern)
+	}
+	return strings.Join(descs, " and ")
 }
 
-// Xtooler works with xdotool to perform various operations on X11 windows
+// Xtooler works with xdotool or a compositor to perform various operations on
+// windows
 type Xtooler interface {
 	WaitForWindow(ctx context.Context, w Window) ([]string, error)
 	CloseWindowID(wid string) error
+	ActivateWindowID(wid string) error
 	PidForWindowID(wid string) (int, error)
+	VisibleWindowIDs() ([]string, error)
+	WaitForNewWindow(ctx context.Context, existing []string) (string, error)
 }
 
 // MakeXDoTool returns a Xtooler that can interact with windows
@@ -73,29 +118,213 @@ func MakeXDoTool() Xtooler {
 }
 
 func (x *xdotool) WaitForWindow(ctx context.Context, w Window) ([]string, error) {
-	searchArgs := w.searchArgs()
-	if searchArgs == nil {
+	attrs := w.attrs()
+	if len(attrs) == 0 {
 		return nil, fmt.Errorf("window specification is empty")
 	}
 
+	args := []string{"search", "--onlyvisible"}
+	if w.ActiveWorkspace {
+		out, err := exec.Command("xdotool", "get_desktop").CombinedOutput()
+		if err != nil {
+			return nil, fmt.Errorf("xdotool failed to get the active workspace: %v", outputErr(out, err))
+		}
+		args = append(args, "--desktop", strings.TrimSpace(string(out)))
+	}
+	if len(attrs) > 1 {
+		return x.waitForAll(ctx, w, args, attrs)
+	}
+	args = append(args, "--sync", attrs[0].option, attrs[0].pattern)
+
 	var err error
 	out := []byte{}
-	for i := 0; i < 10; i++ {
-		out, err = exec.CommandContext(ctx, "xdotool", append([]string{"search", "--sync", "--onlyvisible"}, searchArgs...)...).CombinedOutput()
+	for i := 0; i < 10; {
+		out, err = exec.CommandContext(ctx, "xdotool", args...).CombinedOutput()
 		if err != nil {
 			// check specifically for deadline exceeded error, if so give up,
 			// otherwise keep trying
 			if ctx.Err() == context.DeadlineExceeded {
 				return nil, fmt.Errorf("timed out waiting for window with %s to appear: %w", w.windowSpecErrDescription(), ctx.Err())
 			}
+			i++
 			continue
 		}
 		// TODO: return better error if we timeout due to context expiration?
-		return strings.Split(strings.TrimSpace(string(out)), "\n"), nil
+		if wids := w.filter(strings.Split(strings.TrimSpace(string(out)), "\n")); len(wids) != 0 {
+			return wids, nil
+		}
+		// only excluded windows matched, --sync returns immediately then so
+		// poll until another one appears
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("timed out waiting for window with %s to appear: %w", w.windowSpecErrDescription(), ctx.Err())
+		case <-time.After(newWindowPollInterval):
+		}
 	}
 	return nil, fmt.Errorf("xdotool failed to find window with %s: %v", w.windowSpecErrDescription(), outputErr(out, err))
 }
 
+// waitForAll polls the windows until one matches all the attributes, as
+// xdotool search only matches a single pattern the windows matching each
+// attribute are listed and intersected.
+func (x *xdotool) waitForAll(ctx context.Context, w Window, args []string, attrs []windowAttr) ([]string, error) {
+	for {
+		var wids []string
+		for i, attr := range attrs {
+			search := append(append([]string(nil), args...), attr.option, attr.pattern)
+			out, err := exec.CommandContext(ctx, "xdotool", search...).CombinedOutput()
+			trimmed := strings.TrimSpace(string(out))
+			if err != nil && trimmed != "" && ctx.Err() == nil {
+				return nil, fmt.Errorf("xdotool failed to find window with %s: %v", w.windowSpecErrDescription(), outputErr(out, err))
+			}
+			if err != nil || trimmed == "" {
+				// xdotool exits non-zero without any output when
+				// nothing matched
+				wids = nil
+				break
+			}
+			matched := strings.Split(trimmed, "\n")
+			if i == 0 {
+				wids = matched
+				continue
+			}
+			wids = intersect(wids, matched)
+		}
+		if wids = w.filter(wids); len(wids) != 0 {
+			return wids, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("timed out waiting for window with %s to appear: %w", w.windowSpecErrDescription(), ctx.Err())
+		case <-time.After(newWindowPollInterval):
+		}
+	}
+}
+
+// intersect returns the window IDs of the first list which are also in the
+// second one, in order.
+func intersect(wids, others []string) []string {
+	in := make(map[string]bool, len(others))
+	for _, wid := range others {
+		in[wid] = true
+	}
+	var both []string
+	for _, wid := range wids {
+		if in[wid] {
+			both = append(both, wid)
+		}
+	}
+	return both
+}
+
+// WaitForProgramWindow waits for a window of the specification like
+// WaitForWindow, but when only windows in the list of existing window IDs
+// matched, which were open before the program was started and would make it
+// look like it displayed its window right away, it waits again for another
+// one. It reports whether existing windows were ignored.
+func WaitForProgramWindow(ctx context.Context, x Xtooler, w Window, existing []string) (wids []string, ignored bool, err error) {
+	wids, err = x.WaitForWindow(ctx, w)
+	if err != nil || len(wids) == 0 || len(intersect(wids, existing)) != len(wids) {
+		return wids, false, err
+	}
+	w.Exclude = append(append([]string(nil), w.Exclude...), existing...)
+	wids, err = x.WaitForWindow(ctx, w)
+	return wids, true, err
+}
+
+// VisibleWindowIDs returns the window IDs of all currently visible windows.
+func (x *xdotool) VisibleWindowIDs() ([]string, error) {
+	out, err := exec.Command("xdotool", "search", "--onlyvisible", ".*").CombinedOutput()
+	trimmed := strings.TrimSpace(string(out))
+	if err != nil {
+		// xdotool exits non-zero without any output when nothing matched
+		if trimmed == "" {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("xdotool failed to list visible windows: %v", outputErr(out, err))
+	}
+	if trimmed == "" {
+		return nil, nil
+	}
+	return strings.Split(trimmed, "\n"), nil
+}
+
+// newWindowPollInterval is how often to check for new windows in
+// WaitForNewWindow
+var newWindowPollInterval = 10 * time.Millisecond
+
+// WaitForNewWindow waits until any visible window which is not in the list of
+// existing window IDs appears and returns the ID of that window.
+func (x *xdotool) WaitForNewWindow(ctx context.Context, existing []string) (string, error) {
+	return waitForNewWindow(ctx, existing, x.VisibleWindowIDs)
+}
+
+// waitForNewWindow polls the visible windows until one which is not in the
+// list of existing window IDs appears.
+func waitForNewWindow(ctx context.Context, existing []string, visible func() ([]string, error)) (string, error) {
+	seen := make(map[string]bool, len(existing))
+	for _, wid := range existing {
+		seen[wid] = true
+	}
+	for {
+		wids, err := visible()
+		if err != nil {
+			return "", err
+		}
+		for _, wid := range wids {
+			if !seen[wid] {
+				return wid, nil
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(newWindowPollInterval):
+		}
+	}
+}
+
+// watchWindowsInterval is how often to check for new windows in
+// WatchNewWindows, which lists the windows during the whole startup of the
+// program, so it does so less often to not slow the startup down
+var watchWindowsInterval = 50 * time.Millisecond
+
+// WindowAppearance is when a window appeared
+type WindowAppearance struct {
+	ID   string
+	Time time.Time
+}
+
+// WatchNewWindows records when each visible window which is not in the list of
+// existing window IDs appears until the context is done, the windows are
+// returned in the order they appeared. The times are accurate to
+// watchWindowsInterval.
+func WatchNewWindows(ctx context.Context, x Xtooler, existing []string) ([]WindowAppearance, error) {
+	seen := make(map[string]bool, len(existing))
+	for _, wid := range existing {
+		seen[wid] = true
+	}
+	var appeared []WindowAppearance
+	for {
+		wids, err := x.VisibleWindowIDs()
+		if err != nil {
+			return appeared, err
+		}
+		now := time.Now()
+		for _, wid := range wids {
+			if !seen[wid] {
+				seen[wid] = true
+				appeared = append(appeared, WindowAppearance{ID: wid, Time: now})
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return appeared, nil
+		case <-time.After(watchWindowsInterval):
+		}
+	}
+}
+
 func (x *xdotool) CloseWindowID(wid string) error {
 	out, err := exec.Command("xdotool", "windowkill", wid).CombinedOutput()
 	if err != nil {
@@ -104,6 +333,14 @@ func (x *xdotool) CloseWindowID(wid string) error {
 	return nil
 }
 
+func (x *xdotool) ActivateWindowID(wid string) error {
+	out, err := exec.Command("xdotool", "windowactivate", "--sync", wid).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("xdotool failed to activate window ID %s: %v", wid, outputErr(out, err))
+	}
+	return nil
+}
+
 func (x *xdotool) PidForWindowID(wid string) (int, error) {
 	out, err := exec.Command("xdotool", "getwindowpid", wid).CombinedOutput()
 	if err != nil {
@@ -0,0 +1,99 @@
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package xdotool_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/anonymouse64/etrace/internal/xdotool"
+
+	"gopkg.in/check.v1"
+)
+
+type xdotoolTestSuite struct {
+	binDir  string
+	oldPath string
+	restore func()
+}
+
+var _ = check.Suite(&xdotoolTestSuite{})
+
+func (s *xdotoolTestSuite) SetUpTest(c *check.C) {
+	s.binDir = c.MkDir()
+	s.oldPath = os.Getenv("PATH")
+	os.Setenv("PATH", s.binDir+":"+s.oldPath)
+	s.restore = xdotool.MockNewWindowPollInterval(time.Millisecond)
+}
+
+func (s *xdotoolTestSuite) TearDownTest(c *check.C) {
+	os.Setenv("PATH", s.oldPath)
+	s.restore()
+}
+
+// mockXDoTool writes a xdotool which logs its arguments and lists the windows
+// for the option of the search, exiting non-zero without output when none
+// matched like xdotool
+func (s *xdotoolTestSuite) mockXDoTool(c *check.C, windows map[string]string) (log string) {
+	log = filepath.Join(s.binDir, "xdotool.log")
+	script := fmt.Sprintf("#!/bin/sh\necho \"$@\" >> %s\ncase \"$*\" in\n", log)
+	for option, wids := range windows {
+		script += fmt.Sprintf("*\"%s \"*) printf '%s\\n' ;;\n", option, strings.Replace(wids, " ", "\\n", -1))
+	}
+	script += "*) exit 1 ;;\nesac\n"
+	c.Assert(ioutil.WriteFile(filepath.Join(s.binDir, "xdotool"), []byte(script), 0755), check.IsNil)
+	return log
+}
+
+func (s *xdotoolTestSuite) TestWaitForWindow(c *check.C) {
+	log := s.mockXDoTool(c, map[string]string{"--class": "1 2"})
+
+	wids, err := xdotool.MakeXDoTool().WaitForWindow(context.Background(), xdotool.Window{Class: "gedit", Exclude: []string{"1"}})
+	c.Assert(err, check.IsNil)
+	c.Check(wids, check.DeepEquals, []string{"2"})
+
+	out, err := ioutil.ReadFile(log)
+	c.Assert(err, check.IsNil)
+	c.Check(string(out), check.Equals, "search --onlyvisible --sync --class gedit\n")
+}
+
+func (s *xdotoolTestSuite) TestWaitForWindowAllAttributes(c *check.C) {
+	log := s.mockXDoTool(c, map[string]string{"--class": "1 2 3", "--name": "3 2"})
+
+	wids, err := xdotool.MakeXDoTool().WaitForWindow(context.Background(), xdotool.Window{Class: "^Firefox$", Name: "Nightly"})
+	c.Assert(err, check.IsNil)
+	c.Check(wids, check.DeepEquals, []string{"2", "3"})
+
+	out, err := ioutil.ReadFile(log)
+	c.Assert(err, check.IsNil)
+	c.Check(string(out), check.Equals, "search --onlyvisible --class ^Firefox$\nsearch --onlyvisible --name Nightly\n")
+}
+
+func (s *xdotoolTestSuite) TestWaitForWindowAllAttributesTimeout(c *check.C) {
+	s.mockXDoTool(c, map[string]string{"--class": "1 2"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := xdotool.MakeXDoTool().WaitForWindow(ctx, xdotool.Window{Class: "Firefox", Name: "Nightly"})
+	c.Assert(err, check.ErrorMatches, "timed out waiting for window with class Firefox and name Nightly to appear: context deadline exceeded")
+}
@@ -0,0 +1,342 @@
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package trace runs programs and traces them like etrace exec and etrace
+// file, so that CI tools and benchmark harnesses can measure programs from Go
+// without running the etrace binary and decoding its output. A run goes
+// through the same steps as the runs of etrace exec.
+package trace
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sync/atomic"
+	"time"
+
+	"github.com/anonymouse64/etrace/internal/runner"
+	"github.com/anonymouse64/etrace/internal/strace"
+	"github.com/anonymouse64/etrace/internal/xdotool"
+)
+
+// Program is a program executed during a traced run
+type Program struct {
+	// Exe is the path of the program
+	Exe string
+	// Args is the arguments the program was executed with
+	Args []string
+	// Start is when the program was executed
+	Start time.Time
+	// Duration is how long the program ran, until it exited or its process
+	// executed another program
+	Duration time.Duration
+}
+
+// Timing is the timing of the programs executed during a traced run
+type Timing struct {
+	// TotalTime is how long the trace lasted
+	TotalTime time.Duration
+	// Programs is the programs executed, in the order they were executed
+	Programs []Program
+}
+
+// FileAccess is a system call of a program accessing a file
+type FileAccess struct {
+	Time    time.Time
+	Path    string
+	Syscall string
+}
+
+// ProgramFiles is a program executed during a traced run with the files it
+// accessed
+type ProgramFiles struct {
+	Exe      string
+	Start    time.Time
+	Duration time.Duration
+	Accesses []FileAccess
+}
+
+// File is a file accessed during a traced run
+type File struct {
+	// Path is the path the file was accessed as
+	Path string
+	// Size is the size of the file, or -1 if it is unknown
+	Size int64
+	// Program is the program which accessed the file
+	Program string
+}
+
+// Files is the files accessed by the programs executed during a traced run
+type Files struct {
+	// TotalTime is how long the trace lasted
+	TotalTime time.Duration
+	// Files is the files accessed
+	Files []File
+	// Programs is the programs executed with the files each accessed
+	Programs []ProgramFiles
+}
+
+// Window is the specification of a window to wait for, each attribute set is
+// a regular expression which must match
+type Window struct {
+	Class     string
+	ClassName string
+	Name      string
+}
+
+// the names of the window tools, see Options.WindowTool
+const (
+	WindowToolXDoTool    = xdotool.ToolXDoTool
+	WindowToolKWin       = xdotool.ToolKWin
+	WindowToolSway       = xdotool.ToolSway
+	WindowToolGnomeShell = xdotool.ToolGnomeShell
+)
+
+// newWindowTool returns the window tool with the given name, or the one which
+// works best with the current session if the name is empty.
+var newWindowTool = func(name string) (xdotool.Xtooler, error) {
+	if name == "" {
+		name = xdotool.DetectTool()
+	}
+	switch name {
+	case WindowToolXDoTool:
+		return xdotool.MakeXDoTool(), nil
+	case WindowToolKWin:
+		return xdotool.MakeKWinTool(), nil
+	case WindowToolSway:
+		socket := os.Getenv("SWAYSOCK")
+		if socket == "" {
+			return nil, fmt.Errorf("cannot use sway for windows without $SWAYSOCK")
+		}
+		return xdotool.MakeSwayTool(socket), nil
+	case WindowToolGnomeShell:
+		return xdotool.MakeGnomeShellTool(), nil
+	}
+	return nil, fmt.Errorf("unknown window tool %q", name)
+}
+
+func timing(t *strace.ExecveTiming) *Timing {
+	res := &Timing{TotalTime: t.TotalTime}
+	for _, rt := range t.ExeRuntimes {
+		res.Programs = append(res.Programs, Program{
+			Exe:      rt.Exe,
+			Args:     rt.Args,
+			Start:    rt.Start,
+			Duration: rt.TotalSec,
+		})
+	}
+	return res
+}
+
+// TraceExecveTimings returns the timing of the programs executed in the strace
+// log written by a traced run, keeping only the given number of the slowest
+// programs if it is positive.
+func TraceExecveTimings(straceLog string, nSlowest int) (*Timing, error) {
+	t, err := strace.TraceExecveTimings(straceLog, nSlowest)
+	if err != nil {
+		return nil, err
+	}
+	return timing(t), nil
+}
+
+// TraceExecveWithFiles returns the files matching fileRegex accessed by the
+// programs matching programRegex in the strace logs written by strace -ff with
+// the given prefix, ignoring the programs matching the exclude patterns.
+func TraceExecveWithFiles(straceLogPattern string, fileRegex, programRegex *regexp.Regexp, excludeProgramPatterns []string) (*Files, error) {
+	paths, err := strace.TraceExecveWithFiles(straceLogPattern, fileRegex, programRegex, excludeProgramPatterns)
+	if err != nil {
+		return nil, err
+	}
+	res := &Files{TotalTime: paths.TotalTime}
+	for _, f := range paths.AllFiles {
+		res.Files = append(res.Files, File{Path: f.Path, Size: f.Size, Program: f.Program})
+	}
+	for _, proc := range paths.Processes {
+		prog := ProgramFiles{Exe: proc.Exe, Start: proc.Start, Duration: proc.RunDuration}
+		for _, access := range proc.PathAccesses {
+			prog.Accesses = append(prog.Accesses, FileAccess{Time: access.Time, Path: access.Path, Syscall: access.Syscall})
+		}
+		res.Programs = append(res.Programs, prog)
+	}
+	return res, nil
+}
+
+// DefaultWindowTimeout is how long Run waits for the window by default
+const DefaultWindowTimeout = time.Minute
+
+// DefaultExitTimeout is how long the program has to exit once its windows
+// were closed by default
+const DefaultExitTimeout = runner.DefaultExitTimeout
+
+// Options is how to run a program
+type Options struct {
+	// Command is the program to run and its arguments
+	Command []string
+	// Trace runs the program under strace to time the programs it executes,
+	// through sudo unless already running as root
+	Trace bool
+	// Privileged runs the program as root when tracing it instead of as the
+	// current user
+	Privileged bool
+	// Window is the window to wait for, by default the window whose class is
+	// the name of the program
+	Window Window
+	// WindowTool is the name of the tool to wait for and close the window
+	// with, by default the one which works best with the current session
+	WindowTool string
+	// WindowTimeout is how long to wait for the window, DefaultWindowTimeout
+	// if zero
+	WindowTimeout time.Duration
+	// ExitTimeout is how long the program has to exit once its windows were
+	// closed before it is killed, DefaultExitTimeout if zero
+	ExitTimeout time.Duration
+	// NoWindowWait waits for the program to exit instead of for its window
+	NoWindowWait bool
+}
+
+// Result is the measurement of a run
+type Result struct {
+	// TimeToDisplay is how long it took for the window to appear, or for
+	// the program to exit with NoWindowWait
+	TimeToDisplay time.Duration
+	// WindowIDs is the IDs of the windows which matched
+	WindowIDs []string
+	// Timing is the timing of the programs executed, if traced
+	Timing *Timing
+}
+
+// runs is the number of runs started, which identifies them among the runs of
+// the process
+var runs int32
+
+// Run runs the program once like etrace exec, waiting for its window to appear
+// and then closing it. The program and all the processes it started are killed
+// if the window doesn't appear in time, or if they are still running once the
+// program exited or was given ExitTimeout to exit.
+func Run(ctx context.Context, opts Options) (*Result, error) {
+	if len(opts.Command) == 0 {
+		return nil, fmt.Errorf("cannot run without a command")
+	}
+	var tool xdotool.Xtooler
+	w := xdotool.Window{Class: opts.Window.Class, ClassName: opts.Window.ClassName, Name: opts.Window.Name}
+	var existing []string
+	if !opts.NoWindowWait {
+		var err error
+		tool, err = newWindowTool(opts.WindowTool)
+		if err != nil {
+			return nil, err
+		}
+		if w.Class == "" && w.Name == "" && w.ClassName == "" {
+			w.Class = filepath.Base(opts.Command[0])
+		}
+		existing, err = tool.VisibleWindowIDs()
+		if err != nil {
+			return nil, fmt.Errorf("cannot list existing windows: %v", err)
+		}
+	}
+
+	run := &runner.Run{
+		ID:          fmt.Sprintf("trace-%d-%d", os.Getpid(), atomic.AddInt32(&runs, 1)),
+		ExitTimeout: opts.ExitTimeout,
+	}
+	var cmd *exec.Cmd
+	var tr *runner.Trace
+	if opts.Trace {
+		var err error
+		tr, err = runner.StartTrace(runner.TraceOptions{Scope: strace.ScopeAll})
+		if err != nil {
+			return nil, err
+		}
+		defer tr.Remove()
+		cmd, err = tr.Command(opts.Privileged, opts.Command...)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		cmd = exec.Command(opts.Command[0], opts.Command[1:]...)
+	}
+	run.Prepare(cmd)
+
+	res := &Result{}
+	start := time.Now()
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	if err := run.Started(cmd.Process.Pid); err != nil {
+		cmd.Process.Kill()
+		return nil, err
+	}
+	exited := make(chan struct{})
+	var waitErr error
+	go func() {
+		waitErr = cmd.Wait()
+		close(exited)
+	}()
+
+	if opts.NoWindowWait {
+		<-exited
+		res.TimeToDisplay = time.Since(start)
+		if waitErr != nil {
+			run.Kill()
+			return nil, fmt.Errorf("cannot run %v: %v", opts.Command, waitErr)
+		}
+	} else {
+		timeout := opts.WindowTimeout
+		if timeout == 0 {
+			timeout = DefaultWindowTimeout
+		}
+		waitCtx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		wids, _, err := xdotool.WaitForProgramWindow(waitCtx, tool, w, existing)
+		res.TimeToDisplay = time.Since(start)
+		if err != nil {
+			// sudo and strace exit once the program did
+			run.Kill()
+			<-exited
+			return nil, err
+		}
+		res.WindowIDs = wids
+		if err := runner.CloseWindows(tool, wids); err != nil {
+			run.Kill()
+			<-exited
+			return nil, err
+		}
+	}
+	// the program is given time to exit after its windows were closed, and
+	// what it left running is killed
+	if _, err := run.KillLeftovers(cmd.Process.Pid, exited); err != nil {
+		return nil, err
+	}
+	select {
+	case <-exited:
+	default:
+		run.Kill()
+		<-exited
+	}
+
+	if tr != nil {
+		traced := tr.Wait()
+		if traced.Err != nil {
+			return nil, traced.Err
+		}
+		res.Timing = timing(traced.Timing)
+	}
+	return res, nil
+}
@@ -0,0 +1,161 @@
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package trace_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/anonymouse64/etrace/internal/xdotool"
+	"github.com/anonymouse64/etrace/trace"
+
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type traceTestSuite struct{}
+
+var _ = check.Suite(&traceTestSuite{})
+
+// fakeTool has the windows in wids appear right away, owned by the process
+// with the pid
+type fakeTool struct {
+	existing []string
+	wids     []string
+	pid      int
+	closeErr error
+	waited   []xdotool.Window
+	closed   []string
+}
+
+func (t *fakeTool) WaitForWindow(ctx context.Context, w xdotool.Window) ([]string, error) {
+	t.waited = append(t.waited, w)
+	if len(t.wids) == 0 {
+		<-ctx.Done()
+		return nil, fmt.Errorf("timed out waiting for window: %w", ctx.Err())
+	}
+	return t.wids, nil
+}
+
+func (t *fakeTool) CloseWindowID(wid string) error {
+	t.closed = append(t.closed, wid)
+	return t.closeErr
+}
+
+func (t *fakeTool) ActivateWindowID(wid string) error { return nil }
+
+func (t *fakeTool) PidForWindowID(wid string) (int, error) { return t.pid, nil }
+
+func (t *fakeTool) VisibleWindowIDs() ([]string, error) { return t.existing, nil }
+
+func (t *fakeTool) WaitForNewWindow(ctx context.Context, existing []string) (string, error) {
+	return "", nil
+}
+
+func (s *traceTestSuite) TestRunNoWindowWait(c *check.C) {
+	res, err := trace.Run(context.Background(), trace.Options{Command: []string{"/bin/sh", "-c", "sleep 0.01"}, NoWindowWait: true})
+	c.Assert(err, check.IsNil)
+	c.Check(res.TimeToDisplay >= 10*time.Millisecond, check.Equals, true)
+	c.Check(res.WindowIDs, check.IsNil)
+	c.Check(res.Timing, check.IsNil)
+
+	_, err = trace.Run(context.Background(), trace.Options{Command: []string{"/bin/false"}, NoWindowWait: true})
+	c.Assert(err, check.ErrorMatches, `cannot run \[/bin/false\]: exit status 1`)
+
+	_, err = trace.Run(context.Background(), trace.Options{NoWindowWait: true})
+	c.Assert(err, check.ErrorMatches, "cannot run without a command")
+}
+
+func (s *traceTestSuite) TestRunWindow(c *check.C) {
+	// the window is owned by another process, which is killed once the
+	// window was closed
+	owner := exec.Command("sleep", "10")
+	c.Assert(owner.Start(), check.IsNil)
+	defer owner.Process.Kill()
+	tool := &fakeTool{existing: []string{"1"}, wids: []string{"2"}, pid: owner.Process.Pid}
+	restore := trace.MockWindowTool(tool)
+	defer restore()
+
+	// the program doesn't exit once its window is closed and is killed
+	start := time.Now()
+	res, err := trace.Run(context.Background(), trace.Options{Command: []string{"/bin/sleep", "10"}, ExitTimeout: 10 * time.Millisecond})
+	c.Assert(err, check.IsNil)
+	c.Check(time.Since(start) < 5*time.Second, check.Equals, true)
+	c.Check(res.WindowIDs, check.DeepEquals, []string{"2"})
+	c.Check(tool.closed, check.DeepEquals, []string{"2"})
+	c.Check(owner.Wait(), check.ErrorMatches, "signal: killed")
+	// the window class is the name of the program by default
+	c.Check(tool.waited, check.DeepEquals, []xdotool.Window{{Class: "sleep"}})
+
+	tool.waited = nil
+	_, err = trace.Run(context.Background(), trace.Options{Command: []string{"/bin/true"}, Window: trace.Window{Name: "^Calculator$"}})
+	c.Assert(err, check.IsNil)
+	c.Check(tool.waited, check.DeepEquals, []xdotool.Window{{Name: "^Calculator$"}})
+
+	// failing to close the window fails the run
+	tool.closeErr = fmt.Errorf("cannot close")
+	_, err = trace.Run(context.Background(), trace.Options{Command: []string{"/bin/sleep", "10"}})
+	c.Assert(err, check.ErrorMatches, "closing window: cannot close")
+}
+
+func (s *traceTestSuite) TestRunWindowTimeout(c *check.C) {
+	tool := &fakeTool{}
+	restore := trace.MockWindowTool(tool)
+	defer restore()
+
+	// the program and what it started are killed
+	start := time.Now()
+	_, err := trace.Run(context.Background(), trace.Options{Command: []string{"/bin/sh", "-c", "sleep 10 & wait"}, WindowTimeout: 10 * time.Millisecond})
+	c.Assert(err, check.ErrorMatches, ".*context deadline exceeded")
+	c.Check(time.Since(start) < 5*time.Second, check.Equals, true)
+	c.Check(tool.closed, check.IsNil)
+}
+
+func (s *traceTestSuite) TestNewWindowTool(c *check.C) {
+	tool, err := trace.NewWindowTool(trace.WindowToolXDoTool)
+	c.Assert(err, check.IsNil)
+	c.Check(tool, check.NotNil)
+
+	_, err = trace.NewWindowTool("xwininfo")
+	c.Assert(err, check.ErrorMatches, `unknown window tool "xwininfo"`)
+}
+
+func (s *traceTestSuite) TestTraceExecveTimings(c *check.C) {
+	log := filepath.Join(c.MkDir(), "strace.log")
+	c.Assert(ioutil.WriteFile(log, []byte(`100 1542815326.000000 execve("/usr/bin/launcher", ["launcher"], 0x1566008 /* 69 vars */) = 0
+100 1542815326.600000 execve("/usr/bin/app", ["app"], 0x1566008 /* 69 vars */) = 0
+100 1542815327.000000 +++ exited with 0 +++
+`), 0644), check.IsNil)
+
+	timing, err := trace.TraceExecveTimings(log, 0)
+	c.Assert(err, check.IsNil)
+	start := time.Unix(1542815326, 0)
+	c.Check(timing, check.DeepEquals, &trace.Timing{
+		TotalTime: time.Second,
+		Programs: []trace.Program{
+			{Exe: "/usr/bin/launcher", Args: []string{"launcher"}, Start: start, Duration: 600 * time.Millisecond},
+			{Exe: "/usr/bin/app", Args: []string{"app"}, Start: start.Add(600 * time.Millisecond), Duration: 400 * time.Millisecond},
+		},
+	})
+}